@@ -1,3 +1,10 @@
 module helpers
 
 go 1.21.5
+
+require github.com/google/gopacket v1.1.19
+
+require (
+	golang.org/x/net v0.25.0 // indirect
+	golang.org/x/sys v0.20.0 // indirect
+)
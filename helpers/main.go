@@ -2,16 +2,68 @@
 package main
 
 import (
+    "flag"
     "fmt"
+    "os"
+    "path/filepath"
+    "strings"
 
     "helpers/geolocation"
+    "helpers/replayfile"
 )
 
 func main() {
-    //TODO: reformat to allow different scripts to be run using command line args
+    // converts a pcap of an app session into a replay file
+    replaySubcommand := flag.NewFlagSet("replay", flag.ExitOnError)
+    replayPcapFile := replaySubcommand.String("pcap", "", "pcap or pcapng capture of the app session")
+    replayName := replaySubcommand.String("name", "", "name of the replay; defaults to the name of the capture file without its extension")
+    replayUDP := replaySubcommand.Bool("udp", false, "replay the UDP packets of the session instead of its TCP connection")
+    replayServerIP := replaySubcommand.String("server-ip", "", "IP of the server to replay; defaults to the side that didn't send first")
+    replayServerPort := replaySubcommand.Int("server-port", 0, "port of the server to replay; 0 for any port")
+    replayOutputDir := replaySubcommand.String("o", "../res/replays", "tests directory to write the replay to")
+    replayCaptureLocation := replaySubcommand.String("capture-location", "", "where the session was captured, e.g. the city and network, to document the traffic of the replay")
+    replayUsageNotes := replaySubcommand.String("usage-notes", "", "terms, attribution, or other notes on using the traffic of the replay")
 
-    err := geolocation.GetGeolocationData()
+    // downloading the geolocation data was the only script, so it still runs without a command
+    command := "geolocation"
+    if len(os.Args) > 1 {
+        command = os.Args[1]
+    }
+
+    var err error
+    switch command {
+    case "geolocation":
+        err = geolocation.GetGeolocationData()
+    case "replay":
+        replaySubcommand.Parse(os.Args[2:])
+        if *replayPcapFile == "" {
+            fmt.Println("-pcap is required")
+            os.Exit(1)
+        }
+        if *replayName == "" {
+            base := filepath.Base(*replayPcapFile)
+            *replayName = strings.TrimSuffix(base, filepath.Ext(base))
+        }
+        var path string
+        path, err = replayfile.Convert(replayfile.Options{
+            PcapFile: *replayPcapFile,
+            ReplayName: *replayName,
+            IsTCP: !*replayUDP,
+            ServerIP: *replayServerIP,
+            ServerPort: *replayServerPort,
+            OutputDir: *replayOutputDir,
+            CaptureLocation: *replayCaptureLocation,
+            UsageNotes: *replayUsageNotes,
+        })
+        if err == nil {
+            fmt.Println("Wrote", path)
+        }
+    default:
+        fmt.Println("\"geolocation\" or \"replay\" command expected")
+        os.Exit(1)
+    }
     if err != nil {
         fmt.Println(err)
+        os.Exit(1)
     }
 }
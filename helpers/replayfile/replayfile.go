@@ -0,0 +1,459 @@
+// Converts a packet capture of an app session into a replay file that the server can run, in the
+// <name>.pcap_server_all.json format that the Wehe python tooling writes. For TCP, one connection is
+// replayed: the bytes the client sent before each response are summarized by their length and SHA-1
+// hash, and the packets the server answered with are kept with their timing. For UDP, every packet
+// the server sent is kept with the time it was sent since the start of the session.
+package replayfile
+
+import (
+    "crypto/sha1"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "time"
+
+    "github.com/google/gopacket"
+    "github.com/google/gopacket/layers"
+    "github.com/google/gopacket/pcapgo"
+)
+
+// How to convert a capture.
+type Options struct {
+    PcapFile string // the capture of the app session
+    ReplayName string // the name of the replay, e.g. Youtube_12122018
+    IsTCP bool // true to replay the TCP connection of the session, false to replay its UDP packets
+    ServerIP string // only packets to and from this IP are replayed; empty to tell the server apart by who sent first
+    ServerPort int // only packets to and from this server port are replayed; 0 for any port
+    OutputDir string // the tests directory the replay is written to, as <OutputDir>/<name>/<name>.pcap_server_all.json
+    CaptureLocation string // where the session was captured, recorded in the provenance of the replay; may be empty
+    UsageNotes string // terms or attribution of the traffic, recorded in the provenance of the replay; may be empty
+}
+
+// The contents of a replay file. The fields match testdata.ReplayFileInfo in the server.
+type replayFile struct {
+    ReplayName string `json:"test_name"`
+    IsTCP bool `json:"is_tcp"`
+    Duration float64 `json:"duration"` // seconds from the first packet of the session to the last packet the server sent
+    Ports []int `json:"ports,omitempty"` // port of the server of a TCP replay
+    Provenance *provenance `json:"provenance,omitempty"`
+    Packets []udpPacket `json:"packets,omitempty"`
+    ResponseSets []responseSet `json:"response_sets,omitempty"`
+}
+
+// Where the traffic of the replay came from.
+type provenance struct {
+    CaptureDate string `json:"capture_date,omitempty"` // day of the first packet of the capture, as YYYY-MM-DD in UTC
+    CaptureLocation string `json:"capture_location,omitempty"`
+    UsageNotes string `json:"usage_notes,omitempty"`
+}
+
+// The packets the server sent after receiving a request from the client.
+type responseSet struct {
+    RequestLength int `json:"request_length"` // bytes of the request
+    RequestHash string `json:"request_hash"` // hex SHA-1 hash of the request
+    ThinkTime float64 `json:"think_time"` // seconds from the end of the request to the first packet of the response
+    Packets []tcpPacket `json:"packets"`
+}
+
+type tcpPacket struct {
+    Timestamp float64 `json:"timestamp"` // seconds since the first packet of the response set
+    Payload string `json:"payload"` // hex encoded
+}
+
+type udpPacket struct {
+    CSPair string `json:"c_s_pair"` // {client_IP}.{client_port}-{server_IP}.{server_port}
+    Timestamp float64 `json:"timestamp"` // seconds since the first packet of the session
+    Payload string `json:"payload"` // hex encoded
+    End bool `json:"end"`
+}
+
+// An endpoint of a flow.
+type endpoint struct {
+    IP string
+    Port int
+}
+
+func (e endpoint) String() string {
+    return e.IP + "." + strconv.Itoa(e.Port)
+}
+
+// A TCP or UDP packet with a payload, or a TCP SYN or SYN-ACK, read from the capture.
+type segment struct {
+    Time time.Time // when the packet was captured
+    Src endpoint // where the packet came from
+    Dst endpoint // where the packet went
+    Seq uint32 // TCP sequence number of the first byte of the payload
+    SYN bool // true if the packet is a TCP SYN or SYN-ACK
+    ACK bool // true if the TCP ACK flag is set
+    Payload []byte
+}
+
+// Converts a capture into a replay file and writes it.
+// options: how to convert the capture
+// Returns the path of the replay file or any errors
+func Convert(options Options) (string, error) {
+    segments, err := readCapture(options)
+    if err != nil {
+        return "", err
+    }
+    file := replayFile{
+        ReplayName: options.ReplayName,
+        IsTCP: options.IsTCP,
+        Provenance: &provenance{
+            CaptureLocation: options.CaptureLocation,
+            UsageNotes: options.UsageNotes,
+        },
+    }
+    if len(segments) > 0 {
+        file.Provenance.CaptureDate = segments[0].Time.UTC().Format("2006-01-02")
+    }
+    if options.IsTCP {
+        err = convertTCP(segments, options, &file)
+    } else {
+        err = convertUDP(segments, options, &file)
+    }
+    if err != nil {
+        return "", err
+    }
+
+    data, err := json.Marshal(file)
+    if err != nil {
+        return "", err
+    }
+    replayDir := filepath.Join(options.OutputDir, options.ReplayName)
+    err = os.MkdirAll(replayDir, 0755)
+    if err != nil {
+        return "", err
+    }
+    path := filepath.Join(replayDir, options.ReplayName + ".pcap_server_all.json")
+    return path, os.WriteFile(path, data, 0644)
+}
+
+// Reads the packets of the protocol being replayed from a capture.
+// options: how to convert the capture
+// Returns the packets in the order they were captured or any errors
+func readCapture(options Options) ([]segment, error) {
+    file, err := os.Open(options.PcapFile)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    // pcapng captures, e.g. from Wireshark, start with a section header block
+    var source interface {
+        ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+    }
+    var linkType layers.LinkType
+    ngReader, err := pcapgo.NewNgReader(file, pcapgo.DefaultNgReaderOptions)
+    if err == nil {
+        source, linkType = ngReader, ngReader.LinkType()
+    } else {
+        _, err = file.Seek(0, io.SeekStart)
+        if err != nil {
+            return nil, err
+        }
+        reader, err := pcapgo.NewReader(file)
+        if err != nil {
+            return nil, fmt.Errorf("Unable to read %s as a pcap or pcapng file: %v", options.PcapFile, err)
+        }
+        source, linkType = reader, reader.LinkType()
+    }
+
+    var segments []segment
+    for {
+        data, captureInfo, err := source.ReadPacketData()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        seg, ok := decode(gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true}), options.IsTCP)
+        if !ok {
+            continue
+        }
+        seg.Time = captureInfo.Timestamp
+        if !matches(seg, options) {
+            continue
+        }
+        segments = append(segments, seg)
+    }
+    if len(segments) == 0 {
+        return nil, fmt.Errorf("No packets in %s match the protocol, server IP, and server port", options.PcapFile)
+    }
+    // captures from several interfaces aren't always in order
+    sort.SliceStable(segments, func(i, j int) bool {
+        return segments[i].Time.Before(segments[j].Time)
+    })
+    return segments, nil
+}
+
+// Gets the fields of a packet that a replay is built from.
+// packet: the packet
+// isTCP: true to look for TCP packets, false to look for UDP packets
+// Returns the packet, or false if it isn't of the protocol or has nothing to replay
+func decode(packet gopacket.Packet, isTCP bool) (segment, bool) {
+    var seg segment
+    switch ip := packet.NetworkLayer().(type) {
+    case *layers.IPv4:
+        seg.Src.IP, seg.Dst.IP = ip.SrcIP.String(), ip.DstIP.String()
+    case *layers.IPv6:
+        seg.Src.IP, seg.Dst.IP = ip.SrcIP.String(), ip.DstIP.String()
+    default:
+        return segment{}, false
+    }
+    if isTCP {
+        tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+        if !ok {
+            return segment{}, false
+        }
+        seg.Src.Port, seg.Dst.Port = int(tcp.SrcPort), int(tcp.DstPort)
+        seg.Seq = tcp.Seq
+        seg.SYN = tcp.SYN
+        seg.ACK = tcp.ACK
+        seg.Payload = tcp.Payload
+        return seg, seg.SYN || len(seg.Payload) > 0
+    }
+    udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+    if !ok {
+        return segment{}, false
+    }
+    seg.Src.Port, seg.Dst.Port = int(udp.SrcPort), int(udp.DstPort)
+    seg.Payload = udp.Payload
+    return seg, len(seg.Payload) > 0
+}
+
+// Checks if a packet is to or from the server being replayed.
+// seg: the packet
+// options: how to convert the capture
+// Returns true if the packet is part of the replay
+func matches(seg segment, options Options) bool {
+    if options.ServerIP != "" {
+        serverIP := net.ParseIP(options.ServerIP)
+        if !serverIP.Equal(net.ParseIP(seg.Src.IP)) && !serverIP.Equal(net.ParseIP(seg.Dst.IP)) {
+            return false
+        }
+    }
+    if options.ServerPort != 0 && seg.Src.Port != options.ServerPort && seg.Dst.Port != options.ServerPort {
+        return false
+    }
+    return true
+}
+
+// Checks if the first packet of a flow was sent by the server. Without a server IP or port, the
+// side that sent first is taken to be the client.
+// seg: the first packet of the flow
+// options: how to convert the capture
+// Returns true if the server sent the packet
+func fromServer(seg segment, options Options) bool {
+    if options.ServerIP != "" {
+        return net.ParseIP(options.ServerIP).Equal(net.ParseIP(seg.Src.IP))
+    }
+    if options.ServerPort != 0 {
+        return seg.Src.Port == options.ServerPort
+    }
+    return false
+}
+
+// Builds the response sets of a TCP replay from the connection in which the server sent the most
+// bytes. Retransmitted bytes are only counted once.
+// segments: the TCP packets of the capture
+// options: how to convert the capture
+// file: the replay file to fill in
+// Returns any errors
+func convertTCP(segments []segment, options Options, file *replayFile) error {
+    // the client of a connection is the side that sent the SYN or, if the handshake wasn't
+    // captured, the side that sent first
+    type connection struct {
+        client endpoint
+        server endpoint
+        segments []segment
+        serverBytes int
+    }
+    connections := make(map[[2]endpoint]*connection)
+    for _, seg := range segments {
+        conn, exists := connections[[2]endpoint{seg.Src, seg.Dst}]
+        if !exists {
+            conn, exists = connections[[2]endpoint{seg.Dst, seg.Src}]
+        }
+        if !exists {
+            client, server := seg.Src, seg.Dst
+            if (seg.SYN && seg.ACK) || (!seg.SYN && fromServer(seg, options)) {
+                client, server = seg.Dst, seg.Src
+            }
+            conn = &connection{client: client, server: server}
+            connections[[2]endpoint{client, server}] = conn
+        }
+        conn.segments = append(conn.segments, seg)
+        if seg.Src == conn.server {
+            conn.serverBytes += len(seg.Payload)
+        }
+    }
+    var chosen *connection
+    for _, conn := range connections {
+        if chosen == nil || conn.serverBytes > chosen.serverBytes {
+            chosen = conn
+        }
+    }
+    if chosen.serverBytes == 0 {
+        return fmt.Errorf("The server didn't send any data on a TCP connection")
+    }
+
+    startTime := chosen.segments[0].Time
+    var request []byte
+    var lastRequestTime time.Time
+    var current *responseSet
+    var responseStart time.Time
+    var lastServerTime time.Time
+    streams := map[endpoint]*tcpStream{
+        chosen.client: {},
+        chosen.server: {},
+    }
+    for _, seg := range chosen.segments {
+        stream := streams[seg.Src]
+        if seg.SYN {
+            stream.start(seg.Seq + 1)
+            continue
+        }
+        payload := stream.add(seg.Seq, seg.Payload)
+        if len(payload) == 0 {
+            continue
+        }
+        if seg.Src == chosen.client {
+            // the response to the previous request is over once the client sends again
+            if current != nil {
+                file.ResponseSets = append(file.ResponseSets, *current)
+                current = nil
+            }
+            request = append(request, payload...)
+            lastRequestTime = seg.Time
+            continue
+        }
+        if current == nil {
+            hash := sha1.Sum(request)
+            current = &responseSet{
+                RequestLength: len(request),
+                RequestHash: hex.EncodeToString(hash[:]),
+                Packets: []tcpPacket{},
+            }
+            if !lastRequestTime.IsZero() {
+                current.ThinkTime = max(seg.Time.Sub(lastRequestTime).Seconds(), 0)
+            }
+            responseStart = seg.Time
+            request = nil
+        }
+        current.Packets = append(current.Packets, tcpPacket{
+            Timestamp: seg.Time.Sub(responseStart).Seconds(),
+            Payload: hex.EncodeToString(payload),
+        })
+        lastServerTime = seg.Time
+    }
+    if current != nil {
+        file.ResponseSets = append(file.ResponseSets, *current)
+    }
+    // the server waits for the last request even if it didn't answer it
+    if len(request) > 0 {
+        hash := sha1.Sum(request)
+        file.ResponseSets = append(file.ResponseSets, responseSet{
+            RequestLength: len(request),
+            RequestHash: hex.EncodeToString(hash[:]),
+            Packets: []tcpPacket{},
+        })
+    }
+    file.Ports = []int{chosen.server.Port}
+    file.Duration = lastServerTime.Sub(startTime).Seconds()
+    return nil
+}
+
+// The bytes received so far in one direction of a TCP connection.
+type tcpStream struct {
+    started bool // true once the sequence number of the next byte is known
+    next uint32 // sequence number of the next byte expected
+    pending map[uint32][]byte // payloads that arrived before the bytes in front of them; key is the sequence number
+}
+
+// Sets the sequence number of the first byte of the stream.
+// seq: the sequence number
+func (stream *tcpStream) start(seq uint32) {
+    stream.started = true
+    stream.next = seq
+}
+
+// Adds a payload to the stream.
+// seq: the sequence number of the first byte of the payload
+// payload: the payload
+// Returns the bytes the payload adds to the end of the stream, including any that were waiting for
+//     it; empty if the payload is a retransmission or arrived early
+func (stream *tcpStream) add(seq uint32, payload []byte) []byte {
+    if !stream.started {
+        stream.start(seq)
+    }
+    offset := int32(seq - stream.next)
+    if offset > 0 {
+        if stream.pending == nil {
+            stream.pending = make(map[uint32][]byte)
+        }
+        stream.pending[seq] = payload
+        return nil
+    }
+    if int(-offset) >= len(payload) {
+        return nil
+    }
+    added := append([]byte(nil), payload[-offset:]...)
+    stream.next += uint32(len(added))
+    for {
+        waiting, found := stream.pending[stream.next]
+        if !found {
+            break
+        }
+        delete(stream.pending, stream.next)
+        added = append(added, waiting...)
+        stream.next += uint32(len(waiting))
+    }
+    return added
+}
+
+// Builds the packets of a UDP replay from every packet the server sent.
+// segments: the UDP packets of the capture
+// options: how to convert the capture
+// file: the replay file to fill in
+// Returns any errors
+func convertUDP(segments []segment, options Options, file *replayFile) error {
+    startTime := segments[0].Time
+    var lastServerTime time.Time
+    // the client of each flow is the side that sent first
+    clients := make(map[[2]endpoint]endpoint)
+    for _, seg := range segments {
+        client, exists := clients[[2]endpoint{seg.Src, seg.Dst}]
+        if !exists {
+            client, exists = clients[[2]endpoint{seg.Dst, seg.Src}]
+        }
+        if !exists {
+            client = seg.Src
+            if fromServer(seg, options) {
+                client = seg.Dst
+            }
+            clients[[2]endpoint{seg.Src, seg.Dst}] = client
+        }
+        if seg.Src == client {
+            continue
+        }
+        file.Packets = append(file.Packets, udpPacket{
+            CSPair: seg.Dst.String() + "-" + seg.Src.String(),
+            Timestamp: seg.Time.Sub(startTime).Seconds(),
+            Payload: hex.EncodeToString(seg.Payload),
+        })
+        lastServerTime = seg.Time
+    }
+    if len(file.Packets) == 0 {
+        return fmt.Errorf("The server didn't send any UDP packets")
+    }
+    file.Duration = lastServerTime.Sub(startTime).Seconds()
+    return nil
+}
@@ -0,0 +1,227 @@
+// Authenticates and authorizes requests to the admin API. Every request must carry a bearer token,
+// and each token has a role: read-only tokens can view the status of the server, e.g. for
+// dashboards, and operator tokens can also take actions that change the server, such as killing
+// tests, reloading, and deleting user data. Every call that needs the operator role is written to
+// an audit log, whether or not it is allowed.
+//
+// Tokens are never stored in plain text. The tokens file contains the SHA-256 hash of each token:
+//     [{"name": "grafana", "role": "read_only", "sha256": "<hex SHA-256 of the token>"}]
+// A token and its hash can be made with:
+//     token=$(openssl rand -hex 32); echo $token; echo -n $token | sha256sum
+package admin
+
+import (
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+// What a token is allowed to do
+type Role string
+
+const (
+    ReadOnly Role = "read_only" // can view the status of the server
+    Operator Role = "operator" // can view the status of the server and take actions that change it
+)
+
+// Checks if a role has at least the permissions of another role.
+// required: the role needed
+// Returns true if the role can do everything the required role can
+func (role Role) allows(required Role) bool {
+    switch role {
+    case Operator:
+        return required == Operator || required == ReadOnly
+    case ReadOnly:
+        return required == ReadOnly
+    default:
+        return false
+    }
+}
+
+// A token that can access the admin API.
+type token struct {
+    Name string `json:"name"` // who the token belongs to, written to the audit log
+    Role Role `json:"role"` // what the token is allowed to do
+    SHA256 string `json:"sha256"` // hex SHA-256 hash of the token
+    hash []byte // decoded SHA256
+}
+
+// Checks bearer tokens and records privileged calls.
+type Authorizer struct {
+    tokens []token // the tokens that can access the admin API
+    auditLog *os.File // where privileged calls are recorded
+    mutex sync.Mutex // prevents multiple goroutines from writing to the audit log at the same time
+}
+
+// A privileged call to the admin API.
+type auditEntry struct {
+    Time time.Time `json:"time"` // when the call was made
+    Token string `json:"token"` // name of the token used, or empty if the token is unknown
+    Method string `json:"method"` // HTTP method of the call
+    Path string `json:"path"` // URL path of the call
+    Query string `json:"query,omitempty"` // URL query of the call
+    RemoteAddr string `json:"remote_addr"` // address the call came from
+    Allowed bool `json:"allowed"` // true if the token was allowed to make the call
+    Status int `json:"status"` // HTTP status code of the response
+}
+
+// A change to the running server whose details the entry of an API call doesn't show, such as the
+// settings changed by a config reload, which can also be triggered without the API.
+type changeEntry struct {
+    Time time.Time `json:"time"` // when the change was made
+    Source string `json:"source"` // what triggered the change, e.g. SIGHUP or the path of the API call
+    Action string `json:"action"` // what was changed, e.g. config_reload
+    Changes []string `json:"changes"` // what changed, one item per setting
+    Error string `json:"error,omitempty"` // why the change failed, if it did
+}
+
+// Creates a new Authorizer.
+// tokensFilename: path to the JSON file containing the tokens
+// auditLogFilename: path of the audit log; missing directories are created and the log is appended to
+// Returns the authorizer or any errors
+func NewAuthorizer(tokensFilename string, auditLogFilename string) (*Authorizer, error) {
+    data, err := os.ReadFile(tokensFilename)
+    if err != nil {
+        return nil, err
+    }
+    var tokens []token
+    err = json.Unmarshal(data, &tokens)
+    if err != nil {
+        return nil, fmt.Errorf("Unable to parse admin tokens file %s: %v", tokensFilename, err)
+    }
+    for i := range tokens {
+        if tokens[i].Role != ReadOnly && tokens[i].Role != Operator {
+            return nil, fmt.Errorf("Admin token %s has unknown role %s; must be %s or %s", tokens[i].Name, tokens[i].Role, ReadOnly, Operator)
+        }
+        tokens[i].hash, err = hex.DecodeString(tokens[i].SHA256)
+        if err != nil || len(tokens[i].hash) != sha256.Size {
+            return nil, fmt.Errorf("Admin token %s does not have a valid hex SHA-256 hash.", tokens[i].Name)
+        }
+    }
+
+    err = os.MkdirAll(filepath.Dir(auditLogFilename), os.ModePerm)
+    if err != nil {
+        return nil, err
+    }
+    auditLog, err := os.OpenFile(auditLogFilename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+    if err != nil {
+        return nil, err
+    }
+    return &Authorizer{
+        tokens: tokens,
+        auditLog: auditLog,
+    }, nil
+}
+
+// Finds the token used to make a request.
+// r: the request
+// Returns the token and true if the request has a known bearer token
+func (authorizer *Authorizer) authenticate(r *http.Request) (token, bool) {
+    bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+    if !found || bearer == "" {
+        return token{}, false
+    }
+    hash := sha256.Sum256([]byte(bearer))
+    for _, t := range authorizer.tokens {
+        if subtle.ConstantTimeCompare(hash[:], t.hash) == 1 {
+            return t, true
+        }
+    }
+    return token{}, false
+}
+
+// Wraps a handler so that it can only be called with a token that has a role. Requests without a
+// known token get 401; requests whose token doesn't have the role get 403. Calls that need the
+// operator role are written to the audit log.
+// required: the role needed to call the handler
+// handler: the handler to protect
+// Returns the protected handler
+func (authorizer *Authorizer) Require(required Role, handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        t, authenticated := authorizer.authenticate(r)
+        allowed := authenticated && t.Role.allows(required)
+
+        recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+        if !authenticated {
+            http.Error(recorder, "Unauthorized", http.StatusUnauthorized)
+        } else if !allowed {
+            http.Error(recorder, "Forbidden", http.StatusForbidden)
+        } else {
+            handler.ServeHTTP(recorder, r)
+        }
+
+        if required == Operator {
+            authorizer.audit(auditEntry{
+                Time: time.Now().UTC(),
+                Token: t.Name,
+                Method: r.Method,
+                Path: r.URL.Path,
+                Query: r.URL.RawQuery,
+                RemoteAddr: r.RemoteAddr,
+                Allowed: allowed,
+                Status: recorder.status,
+            })
+        }
+    })
+}
+
+// Records a change to the running server in the audit log.
+// source: what triggered the change, e.g. SIGHUP or the path of the API call
+// action: what was changed, e.g. config_reload
+// changes: what changed, one item per setting
+// err: why the change failed, or nil if it succeeded
+func (authorizer *Authorizer) AuditChange(source string, action string, changes []string, err error) {
+    entry := changeEntry{
+        Time: time.Now().UTC(),
+        Source: source,
+        Action: action,
+        Changes: changes,
+    }
+    if err != nil {
+        entry.Error = err.Error()
+    }
+    authorizer.audit(entry)
+}
+
+// Writes an entry to the audit log. Failing to write the entry doesn't undo the call, so errors
+// are only logged.
+// entry: the privileged call or change to record
+func (authorizer *Authorizer) audit(entry interface{}) {
+    line, err := json.Marshal(entry)
+    if err != nil {
+        slog.Error("Unable to write admin audit log", "error", err)
+        return
+    }
+    authorizer.mutex.Lock()
+    defer authorizer.mutex.Unlock()
+    _, err = authorizer.auditLog.Write(append(line, '\n'))
+    if err != nil {
+        slog.Error("Unable to write admin audit log", "error", err)
+    }
+}
+
+// Closes the audit log.
+// Returns any errors
+func (authorizer *Authorizer) Close() error {
+    return authorizer.auditLog.Close()
+}
+
+// Keeps track of the status code written by a handler so that it can be audited.
+type statusRecorder struct {
+    http.ResponseWriter
+    status int // the status code written to the response
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+    recorder.status = status
+    recorder.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,115 @@
+// The admin API of the server. Every endpoint that reveals data needs a bearer token with a role; see
+// auth.go.
+//
+// Endpoints:
+//     GET /metrics  read_only  counters in the Prometheus text format
+//     GET /status   read_only  JSON object with the status reported by each part of the server
+// Other parts of the server can add endpoints with Handle, or with HandlePublic for files that
+// contain no data, such as the pages of the dashboard.
+package admin
+
+import (
+    "crypto/tls"
+    "encoding/json"
+    "log/slog"
+    "net"
+    "net/http"
+    "sync"
+
+    "wehe-server/internal/metrics"
+)
+
+// Gets the current status of a part of the server. The status is encoded as JSON.
+type StatusFunc func() interface{}
+
+// Serves the admin API.
+type Server struct {
+    authorizer *Authorizer // checks the token of each request
+    mux *http.ServeMux // routes requests to the endpoints
+    statusMutex sync.Mutex // prevents multiple goroutines from accessing statuses
+    statuses map[string]StatusFunc // the status of each part of the server; key is the name in the status response
+}
+
+// Creates a new admin API server.
+// authorizer: checks the token of each request
+// Returns the server
+func NewServer(authorizer *Authorizer) *Server {
+    server := &Server{
+        authorizer: authorizer,
+        mux: http.NewServeMux(),
+        statuses: make(map[string]StatusFunc),
+    }
+    server.Handle("/metrics", ReadOnly, metrics.Handler())
+    server.Handle("/status", ReadOnly, http.HandlerFunc(server.serveStatus))
+    return server
+}
+
+// Adds an endpoint to the admin API.
+// pattern: the path of the endpoint
+// role: the role needed to call the endpoint
+// handler: handles calls to the endpoint
+func (server *Server) Handle(pattern string, role Role, handler http.Handler) {
+    server.mux.Handle(pattern, server.authorizer.Require(role, handler))
+}
+
+// Adds an endpoint that can be called without a token. Only use this for endpoints that reveal
+// nothing about the server or its clients.
+// pattern: the path of the endpoint
+// handler: handles calls to the endpoint
+func (server *Server) HandlePublic(pattern string, handler http.Handler) {
+    server.mux.Handle(pattern, handler)
+}
+
+// Adds the status of a part of the server to the status endpoint.
+// name: the key of the status in the status response
+// status: gets the current status
+func (server *Server) AddStatus(name string, status StatusFunc) {
+    server.statusMutex.Lock()
+    defer server.statusMutex.Unlock()
+    server.statuses[name] = status
+}
+
+// Responds with the current status of every part of the server.
+// w: the response
+// r: the request
+func (server *Server) serveStatus(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    server.statusMutex.Lock()
+    response := make(map[string]interface{}, len(server.statuses))
+    for name, status := range server.statuses {
+        response[name] = status()
+    }
+    server.statusMutex.Unlock()
+
+    jsonResponse, err := json.Marshal(response)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(jsonResponse)
+}
+
+// Binds the port of the admin API. Binding is separate from serving so that the port can be bound
+// before the server drops its privileges.
+// addr: the IP and port to listen on
+// Returns the listener or any errors
+func Listen(addr string) (net.Listener, error) {
+    return net.Listen("tcp", addr)
+}
+
+// Serves the admin API over HTTPS so that tokens are never sent in the clear.
+// listener: the listener returned by Listen
+// tlsConfig: the TLS config of the server
+// errChan: channel used to communicate errors back to the main thread
+func (server *Server) Serve(listener net.Listener, tlsConfig *tls.Config, errChan chan<- error) {
+    httpServer := &http.Server{
+        Handler: server.mux,
+        TLSConfig: tlsConfig,
+    }
+    slog.Info("Admin API listening", "addr", listener.Addr())
+    errChan <- httpServer.ServeTLS(listener, "", "")
+}
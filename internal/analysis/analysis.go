@@ -11,11 +11,8 @@ import (
     "time"
 
     "gonum.org/v1/gonum/stat"
-)
 
-const (
-    alpha = 0.95
-    r = 100.0
+    "wehe-server/internal/errs"
 )
 
 // An object that holds the results of different statistical analyses.
@@ -30,6 +27,50 @@ type AnalysisResults struct {
     DValAvg float64
     PValAvg float64
     KS2AcceptRatio float64
+    Policy DecisionPolicy // the policy used to make the decision
+    Differentiation bool // true if the policy found differentiation
+    Verdict VerdictResult // the checks of the policy that the decision was made from
+    Samples SampleCheck // the throughput samples that were compared, and whether there were enough
+}
+
+// The throughput samples of the two replays of an analysis, checked against the fewest that the K-S
+// tests are run on. The K-S tests of a replay that was cut very short, e.g. to a handful of samples,
+// say little either way, so such a test is inconclusive rather than run.
+type SampleCheck struct {
+    OriginalSamples int `json:"original_samples"` // nonzero samples of the original replay, or of the replay compared against a control
+    RandomSamples int `json:"random_samples"` // nonzero samples of the random replay, or of the control
+    MinSamples int `json:"min_samples"` // the fewest samples each replay needs; 0 if there is no minimum
+    Enough bool `json:"enough"` // true if both replays have at least MinSamples samples, so the K-S tests were run
+}
+
+// Checks that both replays of an analysis have enough throughput samples to run the K-S tests on.
+// Only nonzero samples count, as NewDataSetStats drops the rest, so this can be checked before the
+// stats are built, which fails for a replay without any samples.
+// originalData: the throughputs of the original replay
+// randomData: the throughputs of the random replay
+// minSamples: the fewest samples each replay needs; 0 for no minimum
+// Returns the check
+func CheckSamples(originalData []float64, randomData []float64, minSamples int) SampleCheck {
+    check := SampleCheck{
+        OriginalSamples: countNonzero(originalData),
+        RandomSamples: countNonzero(randomData),
+        MinSamples: minSamples,
+    }
+    check.Enough = check.OriginalSamples >= minSamples && check.RandomSamples >= minSamples
+    return check
+}
+
+// Counts the values in data that aren't 0.
+// data: the data
+// Returns the number of nonzero values
+func countNonzero(data []float64) int {
+    count := 0
+    for _, value := range data {
+        if value != 0 {
+            count++
+        }
+    }
+    return count
 }
 
 func NewAnalysisResults(originalReplayStats *DataSetStats, randomReplayStats *DataSetStats,
@@ -70,7 +111,7 @@ func NewDataSetStats(data []float64) (*DataSetStats, error) {
         }
     }
     if len(cleanedData) == 0 {
-        return nil, fmt.Errorf("Slice cannot be of length 0.")
+        return nil, fmt.Errorf("%w: slice cannot be of length 0.", errs.ErrNotEnoughData)
     }
 
     sortedCleanedData := make([]float64, len(cleanedData))
@@ -105,10 +146,9 @@ func CalculateArea0Var(avg1 float64, avg2 float64) float64 {
 // data2: second sample of data, assumed to be drawn from a continuous distribution, can be
 //     different size than data1
 // Returns the KS test statistic and p-value, or any errors
-func KS2Samp(data1 []float64, data2 []float64) (float64, float64, error) {
+func scipyKS2Samp(data1 []float64, data2 []float64) (float64, float64, error) {
     data1Formatted := strings.ReplaceAll(fmt.Sprintf("%g", data1), " ", ",")
     data2Formatted := strings.ReplaceAll(fmt.Sprintf("%g", data2), " ", ",")
-    // TODO: python call takes too long (10 sec)
     ksTestCmd := fmt.Sprintf("from scipy.stats import ks_2samp; (stat,pval) = ks_2samp(%s,%s); print(stat,pval)",
         data1Formatted, data2Formatted)
     cmd := exec.Command("python3", "-c", ksTestCmd)
@@ -152,9 +192,12 @@ func KS2Samp(data1 []float64, data2 []float64) (float64, float64, error) {
 // data2: second sample of data, assumed to be drawn from a continuous distribution, can be
 //     different size than data1
 // ks2pVal: p-value of the first run of the two-sample KS test
+// policy: the decision policy, which gives the confidence level and the number of runs r
 // Returns average statistic, average p-value, and percentage of runs where p-value was accepted,
 //     or any errors
-func SampleKS2(data1 []float64, data2 []float64, ks2pVal float64) (float64, float64, float64, error) {
+func SampleKS2(data1 []float64, data2 []float64, ks2pVal float64, policy DecisionPolicy) (float64, float64, float64, error) {
+    alpha := policy.Alpha
+    r := float64(policy.Resamples)
     greater := ks2pVal >= (1 - alpha)
 
     var dVals []float64
@@ -198,7 +241,7 @@ func SampleKS2(data1 []float64, data2 []float64, ks2pVal float64) (float64, floa
 // Returns a random subset of the given data, or any errors
 func randomSample(data []float64, newSize int) ([]float64, error) {
     if newSize < 0 || newSize > len(data) {
-        return nil, fmt.Errorf("Sample larger than population or is negative: %d", newSize)
+        return nil, fmt.Errorf("%w: sample larger than population or is negative: %d", errs.ErrNotEnoughData, newSize)
     }
     if newSize == 0 {
         return []float64{}, nil
@@ -0,0 +1,92 @@
+// Runs the two-sample Kolmogorov-Smirnov test natively. Running it with scipy costs a python3
+// process per test, and each analysis runs the test over a hundred times.
+package analysis
+
+import (
+    "fmt"
+    "math"
+    "slices"
+    "sync/atomic"
+
+    "gonum.org/v1/gonum/stat"
+
+    "wehe-server/internal/errs"
+)
+
+const (
+    kolmogorovTerms = 100 // most terms of the Kolmogorov series that are summed
+    kolmogorovTolerance = 1e-12 // the series is stopped once a term is smaller than this
+)
+
+var (
+    useScipy atomic.Bool // true if the K-S test is run with scipy instead of natively; can change while tests are analyzed
+)
+
+// Makes KS2Samp run the test with scipy instead of natively, e.g. to cross-validate the native
+// p-values against scipy.
+// enabled: true to run the test with scipy
+func UseScipy(enabled bool) {
+    useScipy.Store(enabled)
+}
+
+// Performs a two-sample Kolmogorov-Smirnov test, natively or with scipy as set by UseScipy.
+// data1: first sample of data, assumed to be drawn from a continuous distribution, can be
+//     different size than data2
+// data2: second sample of data, assumed to be drawn from a continuous distribution, can be
+//     different size than data1
+// Returns the KS test statistic and p-value, or any errors
+func KS2Samp(data1 []float64, data2 []float64) (float64, float64, error) {
+    if useScipy.Load() {
+        return scipyKS2Samp(data1, data2)
+    }
+    return nativeKS2Samp(data1, data2)
+}
+
+// Performs a two-sample Kolmogorov-Smirnov test. The p-value is the limiting one, from the
+// Kolmogorov distribution at sqrt(en) * D, where en = n1 * n2 / (n1 + n2), as in scipy before 1.5.
+// It only approximates current scipy: ks_2samp with mode="asymp" uses kstwo.sf(D, round(en)), the
+// distribution of the one-sample statistic for round(en) samples, and by default ks_2samp gives the
+// exact p-value for samples as small as the throughputs of a replay. The p-values converge as the
+// samples grow, but for replays of a few dozen samples they can differ in the second or third
+// decimal place, so a p-value close to the threshold can be decided differently than with
+// ks_test = scipy.
+// data1: first sample of data, can be different size than data2
+// data2: second sample of data, can be different size than data1
+// Returns the KS test statistic and p-value, or any errors
+func nativeKS2Samp(data1 []float64, data2 []float64) (float64, float64, error) {
+    if len(data1) == 0 || len(data2) == 0 {
+        return -1.0, -1.0, fmt.Errorf("%w: K-S test needs two non-empty samples; got %d and %d values", errs.ErrNotEnoughData, len(data1), len(data2))
+    }
+    sorted1 := slices.Clone(data1)
+    sorted2 := slices.Clone(data2)
+    slices.Sort(sorted1)
+    slices.Sort(sorted2)
+    statistic := stat.KolmogorovSmirnov(sorted1, nil, sorted2, nil)
+
+    n1 := float64(len(data1))
+    n2 := float64(len(data2))
+    effectiveN := n1 * n2 / (n1 + n2)
+    return statistic, kolmogorovSurvival(math.Sqrt(effectiveN) * statistic), nil
+}
+
+// Gets the probability that a value of the Kolmogorov distribution is greater than x, i.e.
+// 2 * sum over k >= 1 of (-1)^(k-1) * exp(-2 * k^2 * x^2).
+// x: the value
+// Returns the probability
+func kolmogorovSurvival(x float64) float64 {
+    // the series converges too slowly to sum near 0, where the probability is 1 anyway
+    if x < 0.2 {
+        return 1.0
+    }
+    sum := 0.0
+    sign := 1.0
+    for k := 1.0; k <= kolmogorovTerms; k++ {
+        term := math.Exp(-2 * k * k * x * x)
+        sum += sign * term
+        if term < kolmogorovTolerance {
+            break
+        }
+        sign = -sign
+    }
+    return math.Max(0, math.Min(1, 2 * sum))
+}
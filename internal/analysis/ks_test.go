@@ -0,0 +1,95 @@
+// Tests of the native two-sample Kolmogorov-Smirnov test against values of scipy's limiting
+// distribution, so that the native statistic that decides verdicts can be trusted without scipy.
+package analysis
+
+import (
+    "math"
+    "testing"
+)
+
+// Checks the statistic and p-value of the native K-S test for fixed samples. The expected p-values
+// are kstwobign.sf(sqrt(en) * D), en = n1 * n2 / (n1 + n2), which is what scipy's ks_2samp gave
+// with mode="asymp" before scipy 1.5; they were computed from the theta function form of the
+// Kolmogorov distribution, which shares no code with the series summed here.
+func TestNativeKS2Samp(t *testing.T) {
+    tests := []struct {
+        name string
+        data1 []float64
+        data2 []float64
+        wantD float64
+        wantP float64
+    }{
+        {"equal sizes",
+            []float64{1.2, 3.4, 2.2, 5.1, 4.4, 6.0, 2.9, 3.3},
+            []float64{7.1, 8.2, 6.6, 9.0, 5.5, 7.7, 8.8, 6.1},
+            0.875, 0.004374982190571086},
+        {"unequal sizes",
+            []float64{10.5, 11.2, 9.8, 12.1, 10.9, 11.7, 10.1, 9.5, 12.4, 11.0, 10.3, 9.9},
+            []float64{11.8, 12.6, 13.1, 12.2, 13.5, 11.4, 12.9},
+            0.75, 0.013835225577991994},
+        {"ties within and across samples",
+            []float64{1, 2, 2, 3, 3, 3, 4, 5},
+            []float64{2, 3, 3, 4, 4, 5, 5, 6, 6},
+            0.4166666666666667, 0.45400768799514646},
+        {"identical samples", []float64{1, 2, 3, 4}, []float64{1, 2, 3, 4}, 0, 1},
+        // D = 1/50 and en = 25, so sqrt(en) * D = 0.1 is below the cutoff of the series
+        {"below the series cutoff", sequence(1, 50), sequence(1.5, 50), 0.02, 1},
+    }
+    for _, test := range tests {
+        test := test
+        t.Run(test.name, func(t *testing.T) {
+            d, p, err := nativeKS2Samp(test.data1, test.data2)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if math.Abs(d - test.wantD) > 1e-12 {
+                t.Errorf("D = %v; want %v", d, test.wantD)
+            }
+            if math.Abs(p - test.wantP) > 1e-9 {
+                t.Errorf("p = %v; want %v", p, test.wantP)
+            }
+        })
+    }
+
+    _, _, err := nativeKS2Samp(nil, []float64{1})
+    if err == nil {
+        t.Error("nativeKS2Samp() of an empty sample returned no error")
+    }
+}
+
+// Builds a sample of consecutive values.
+// start: the first value
+// n: the number of values
+// Returns the sample
+func sequence(start float64, n int) []float64 {
+    data := make([]float64, n)
+    for i := range data {
+        data[i] = start + float64(i)
+    }
+    return data
+}
+
+// Checks the Kolmogorov survival function on both sides of the x < 0.2 cutoff, where it returns 1
+// instead of summing the series, against kstwobign.sf.
+func TestKolmogorovSurvival(t *testing.T) {
+    tests := []struct {
+        x float64
+        want float64
+    }{
+        {0, 1},
+        {0.1, 1},
+        {0.19, 0.999999999999981},
+        {0.2, 0.999999999999495},
+        {0.3, 0.9999906941986655},
+        {0.5, 0.9639452436648751},
+        {1.0, 0.2699996716773546},
+        {1.36, 0.049485876755377856},
+        {2.0, 0.0006709252557797196},
+        {3.0, 3.045995977668525e-08},
+    }
+    for _, test := range tests {
+        if got := kolmogorovSurvival(test.x); math.Abs(got - test.want) > 1e-9 {
+            t.Errorf("kolmogorovSurvival(%v) = %v; want %v", test.x, got, test.want)
+        }
+    }
+}
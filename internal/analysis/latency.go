@@ -0,0 +1,50 @@
+// Compares the latencies clients measured during the original and random replays. A network that
+// queues or delays the traffic of an app, rather than throttling it, can show up in latency without
+// showing up in throughput.
+package analysis
+
+import (
+    "slices"
+)
+
+// The results of comparing the latencies of two replays.
+type LatencyResults struct {
+    OriginalReplayStats *DataSetStats // RTTs measured during the original replay, in milliseconds
+    RandomReplayStats *DataSetStats // RTTs measured during the random replay, in milliseconds
+    MedianDiff float64 // (original median - random median) / larger median; positive when the original replay saw more latency
+    KS2dVal float64 // K-S test statistic of the two RTT distributions
+    KS2pVal float64 // K-S p-value of the two RTT distributions
+    Differentiation bool // true if the original replay saw more latency by the thresholds of the policy
+}
+
+// Compares the RTTs measured during the original and random replays. Latency differentiation is
+// found when the median RTT of the original replay is higher than that of the random replay by more
+// than the area threshold of the policy, and the K-S test finds the RTT distributions to be
+// different.
+// original: RTTs measured during the original replay, in milliseconds
+// random: RTTs measured during the random replay, in milliseconds
+// policy: the thresholds used to decide if there is differentiation
+// Returns the results of the comparison or any errors
+func CompareLatencies(original []float64, random []float64, policy DecisionPolicy) (*LatencyResults, error) {
+    originalStats, err := NewDataSetStats(original)
+    if err != nil {
+        return nil, err
+    }
+    randomStats, err := NewDataSetStats(random)
+    if err != nil {
+        return nil, err
+    }
+    ks2dVal, ks2pVal, err := KS2Samp(originalStats.Data, randomStats.Data)
+    if err != nil {
+        return nil, err
+    }
+    medianDiff := (originalStats.Median - randomStats.Median) / slices.Max([]float64{originalStats.Median, randomStats.Median})
+    return &LatencyResults{
+        OriginalReplayStats: originalStats,
+        RandomReplayStats: randomStats,
+        MedianDiff: medianDiff,
+        KS2dVal: ks2dVal,
+        KS2pVal: ks2pVal,
+        Differentiation: medianDiff > policy.AreaThreshold && ks2pVal < policy.KS2pValThreshold,
+    }, nil
+}
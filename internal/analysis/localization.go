@@ -0,0 +1,149 @@
+// Tells throttling apart from congestion by the packets the server had to retransmit during the
+// original and random replays, as in the localization analysis of Wehe. A network that throttles an
+// app by policing drops the packets of the original replay but not those of the random replay,
+// while congestion drops the packets of both replays alike. Each server port of the replays is
+// compared on its own, since a network can throttle the traffic to one port of an app and not the
+// others.
+package analysis
+
+import (
+    "math"
+    "slices"
+)
+
+const (
+    LocalizationThrottling = "throttling" // the original replay lost more packets than the random replay
+    LocalizationCongestion = "congestion" // both replays lost packets at about the same rate
+    LocalizationNone = "none" // neither replay lost enough packets to tell
+    congestionLossRate = 0.01 // both replays must lose at least this fraction of their packets to call it congestion
+)
+
+// The packets the server sent on one port during a replay, taken from a packet capture.
+type LossStats struct {
+    DataPackets int `json:"data_packets"` // packets with a payload that the server sent, including retransmissions
+    Retransmissions int `json:"retransmissions"` // packets the server sent again because they were lost or not acknowledged in time
+    RTTSamples int `json:"rtt_samples"` // packets whose RTT was measured from the acknowledgement of the client
+    RTTMeanMs float64 `json:"rtt_mean_ms"` // mean RTT of those packets, in milliseconds
+}
+
+// Gets the fraction of the packets that were retransmitted.
+// Returns the loss rate, or 0 if no packets were sent
+func (stats LossStats) LossRate() float64 {
+    if stats.DataPackets == 0 {
+        return 0
+    }
+    return float64(stats.Retransmissions) / float64(stats.DataPackets)
+}
+
+// Adds the packets of another port to the stats.
+// other: the stats of the other port
+// Returns the combined stats
+func (stats LossStats) add(other LossStats) LossStats {
+    rttSamples := stats.RTTSamples + other.RTTSamples
+    rttMeanMs := 0.0
+    if rttSamples > 0 {
+        rttMeanMs = (stats.RTTMeanMs * float64(stats.RTTSamples) + other.RTTMeanMs * float64(other.RTTSamples)) / float64(rttSamples)
+    }
+    return LossStats{
+        DataPackets: stats.DataPackets + other.DataPackets,
+        Retransmissions: stats.Retransmissions + other.Retransmissions,
+        RTTSamples: rttSamples,
+        RTTMeanMs: rttMeanMs,
+    }
+}
+
+// The comparison of the loss of the original and random replays on one server port.
+type PortLoss struct {
+    Port int `json:"port"` // the server port; 0 for all ports together
+    Original LossStats `json:"original"` // the packets of the original replay
+    Random LossStats `json:"random"` // the packets of the random replay
+    LossDiff float64 `json:"loss_diff"` // (original loss rate - random loss rate) / larger loss rate; positive when the original replay lost more
+    PVal float64 `json:"pval"` // p-value of the one-sided test that the original replay lost more packets
+    Differentiation bool `json:"differentiation"` // true if the original replay lost more packets by the thresholds of the policy
+}
+
+// The results of comparing the loss of the original and random replays.
+type LocalizationResults struct {
+    Result string `json:"result"` // LocalizationThrottling, LocalizationCongestion, or LocalizationNone
+    Overall PortLoss `json:"overall"` // the comparison of all ports together
+    Ports []PortLoss `json:"ports"` // the comparison of each port, sorted by port
+}
+
+// Compares the packets the server retransmitted during the original and random replays. A port
+// shows differentiation when the loss rate of the original replay is higher than that of the random
+// replay by more than the area threshold of the policy, and a one-sided two-proportion z-test finds
+// the difference significant at the K-S p-value threshold. The test is throttling if any port, or
+// all ports together, show differentiation, and congestion if both replays lost at least
+// congestionLossRate of their packets without it.
+// original: the packets of the original replay on each server port; key is the port
+// random: the packets of the random replay on each server port; key is the port
+// policy: the thresholds used to decide if there is differentiation
+// Returns the results of the comparison, or nil if neither replay has packets to compare
+func Localize(original map[int]LossStats, random map[int]LossStats, policy DecisionPolicy) *LocalizationResults {
+    var ports []int
+    for port := range original {
+        ports = append(ports, port)
+    }
+    for port := range random {
+        if _, exists := original[port]; !exists {
+            ports = append(ports, port)
+        }
+    }
+    slices.Sort(ports)
+
+    var results LocalizationResults
+    var originalTotal LossStats
+    var randomTotal LossStats
+    throttled := false
+    for _, port := range ports {
+        portLoss := compareLoss(port, original[port], random[port], policy)
+        throttled = throttled || portLoss.Differentiation
+        results.Ports = append(results.Ports, portLoss)
+        originalTotal = originalTotal.add(original[port])
+        randomTotal = randomTotal.add(random[port])
+    }
+    if originalTotal.DataPackets == 0 && randomTotal.DataPackets == 0 {
+        return nil
+    }
+    results.Overall = compareLoss(0, originalTotal, randomTotal, policy)
+    throttled = throttled || results.Overall.Differentiation
+
+    switch {
+    case throttled:
+        results.Result = LocalizationThrottling
+    case originalTotal.LossRate() >= congestionLossRate && randomTotal.LossRate() >= congestionLossRate:
+        results.Result = LocalizationCongestion
+    default:
+        results.Result = LocalizationNone
+    }
+    return &results
+}
+
+// Compares the loss of the original and random replays on one port.
+// port: the server port
+// original: the packets of the original replay
+// random: the packets of the random replay
+// policy: the thresholds used to decide if there is differentiation
+// Returns the comparison
+func compareLoss(port int, original LossStats, random LossStats, policy DecisionPolicy) PortLoss {
+    portLoss := PortLoss{
+        Port: port,
+        Original: original,
+        Random: random,
+        PVal: 1,
+    }
+    originalRate := original.LossRate()
+    randomRate := random.LossRate()
+    if original.DataPackets == 0 || random.DataPackets == 0 || max(originalRate, randomRate) == 0 {
+        return portLoss
+    }
+    portLoss.LossDiff = (originalRate - randomRate) / max(originalRate, randomRate)
+    pooledRate := float64(original.Retransmissions + random.Retransmissions) / float64(original.DataPackets + random.DataPackets)
+    standardError := math.Sqrt(pooledRate * (1 - pooledRate) * (1 / float64(original.DataPackets) + 1 / float64(random.DataPackets)))
+    if standardError > 0 {
+        z := (originalRate - randomRate) / standardError
+        portLoss.PVal = 0.5 * math.Erfc(z / math.Sqrt2)
+    }
+    portLoss.Differentiation = portLoss.LossDiff > policy.AreaThreshold && portLoss.PVal < policy.KS2pValThreshold
+    return portLoss
+}
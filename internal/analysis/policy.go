@@ -0,0 +1,90 @@
+// Decision policies: the thresholds used to decide if a test shows differentiation.
+package analysis
+
+import (
+    "fmt"
+)
+
+// A named set of thresholds used to decide if a test shows differentiation.
+type DecisionPolicy struct {
+    Name string `json:"name"` // the name of the policy
+    Alpha float64 `json:"alpha"` // confidence level of the K-S tests; p-values are compared against 1 - Alpha
+    AreaThreshold float64 `json:"area_threshold"` // area0var must be above this for differentiation
+    KS2pValThreshold float64 `json:"ks2_pval_threshold"` // the K-S p-value must be below this for differentiation
+    AcceptRatioThreshold float64 `json:"accept_ratio_threshold"` // fraction of resampled K-S tests that must agree with the full test
+    Resamples int `json:"resamples"` // number of resampled K-S tests run to validate the full test
+    Verdict string `json:"verdict"` // the name of the verdict that combines the checks of the thresholds
+}
+
+// The policy used when none is configured; these are the thresholds the Wehe clients have always
+// used.
+var DefaultPolicy = DecisionPolicy{
+    Name: "default",
+    Alpha: 0.95,
+    AreaThreshold: 0.1,
+    KS2pValThreshold: 0.05,
+    AcceptRatioThreshold: 0.95,
+    Resamples: 100,
+    Verdict: "all",
+}
+
+// Checks that the thresholds of a policy are usable.
+// Returns any errors
+func (policy DecisionPolicy) Validate() error {
+    if policy.Name == "" {
+        return fmt.Errorf("Decision policy has no name")
+    }
+    if policy.Alpha <= 0 || policy.Alpha >= 1 {
+        return fmt.Errorf("Alpha of decision policy %s must be between 0 and 1 exclusive; got %v", policy.Name, policy.Alpha)
+    }
+    if policy.AreaThreshold < 0 || policy.AreaThreshold > 1 {
+        return fmt.Errorf("Area threshold of decision policy %s must be between 0 and 1; got %v", policy.Name, policy.AreaThreshold)
+    }
+    if policy.KS2pValThreshold <= 0 || policy.KS2pValThreshold >= 1 {
+        return fmt.Errorf("K-S p-value threshold of decision policy %s must be between 0 and 1 exclusive; got %v", policy.Name, policy.KS2pValThreshold)
+    }
+    if policy.AcceptRatioThreshold < 0 || policy.AcceptRatioThreshold > 1 {
+        return fmt.Errorf("Accept ratio threshold of decision policy %s must be between 0 and 1; got %v", policy.Name, policy.AcceptRatioThreshold)
+    }
+    if policy.Resamples < 1 {
+        return fmt.Errorf("Decision policy %s must run at least 1 resample; got %d", policy.Name, policy.Resamples)
+    }
+    _, err := GetVerdict(policy.Verdict)
+    if err != nil {
+        return fmt.Errorf("%v in decision policy %s", err, policy.Name)
+    }
+    return nil
+}
+
+// Decides if the results of an analysis show differentiation. Each threshold of the policy is
+// checked: the throughputs of the two replays must differ by more than the area threshold, the K-S
+// test must find the throughput distributions to be different, and enough of the resampled K-S tests
+// must agree. The verdict of the policy then decides which of the checks must pass. A test whose
+// replays had too few samples for the K-S tests is inconclusive and never shows differentiation.
+// results: the results of the analysis of a test
+// Returns the decision and the checks it was made from
+func (policy DecisionPolicy) Decide(results *AnalysisResults) VerdictResult {
+    if !results.Samples.Enough {
+        return VerdictResult{
+            Policy: policy.Name,
+            Verdict: policy.Verdict,
+            Inconclusive: true,
+        }
+    }
+    checks := VerdictChecks{
+        AreaAboveThreshold: results.Area0var > policy.AreaThreshold,
+        KS2pValBelowThreshold: results.KS2pVal < policy.KS2pValThreshold,
+        AcceptRatioMet: results.KS2AcceptRatio >= policy.AcceptRatioThreshold,
+    }
+    // policies are validated when they are loaded, so the verdict always exists
+    verdict, err := GetVerdict(policy.Verdict)
+    if err != nil {
+        verdict = AllChecksVerdict{}
+    }
+    return VerdictResult{
+        Differentiation: verdict.Differentiation(checks),
+        Policy: policy.Name,
+        Verdict: policy.Verdict,
+        Checks: checks,
+    }
+}
@@ -0,0 +1,81 @@
+// Verdicts: how the checks of a decision policy are combined into the decision of whether a test
+// shows differentiation. Each check compares one result of the analysis against a threshold of the
+// policy; the verdict named by the policy decides which of them must pass.
+package analysis
+
+import (
+    "fmt"
+    "slices"
+)
+
+// The checks of a decision policy against the results of a test.
+type VerdictChecks struct {
+    AreaAboveThreshold bool `json:"area_above_threshold"` // area0var is above the area threshold
+    KS2pValBelowThreshold bool `json:"ks2_pval_below_threshold"` // the K-S p-value is below its threshold
+    AcceptRatioMet bool `json:"accept_ratio_met"` // enough of the resampled K-S tests agree with the full test
+}
+
+// The decision of a policy and the checks it was made from, sent to clients and written to the
+// decision files so that a decision can be explained.
+type VerdictResult struct {
+    Differentiation bool `json:"differentiation"` // true if the policy found differentiation
+    Policy string `json:"policy"` // the name of the decision policy
+    Verdict string `json:"verdict"` // the name of the verdict that combined the checks
+    Checks VerdictChecks `json:"checks"` // the checks of the policy
+    Inconclusive bool `json:"inconclusive"` // true if a replay had too few throughput samples to decide; Differentiation is then false
+}
+
+// Combines the checks of a decision policy into the decision of whether a test shows
+// differentiation.
+type Verdict interface {
+    // Decides if a test shows differentiation.
+    // checks: the checks of the policy against the results of the test
+    // Returns true if the test shows differentiation
+    Differentiation(checks VerdictChecks) bool
+}
+
+// Finds differentiation only when every check passes; the rule the Wehe clients have always used.
+type AllChecksVerdict struct{}
+
+func (AllChecksVerdict) Differentiation(checks VerdictChecks) bool {
+    return checks.AreaAboveThreshold && checks.KS2pValBelowThreshold && checks.AcceptRatioMet
+}
+
+// Finds differentiation when the K-S tests do, however small the difference in average throughput.
+// Catches throttling that changes the shape of the throughputs more than their average, such as
+// bursts followed by long pauses.
+type KSVerdict struct{}
+
+func (KSVerdict) Differentiation(checks VerdictChecks) bool {
+    return checks.KS2pValBelowThreshold && checks.AcceptRatioMet
+}
+
+var (
+    // the verdicts a decision policy can name; key is the name used in the config file
+    verdicts = map[string]Verdict{
+        "all": AllChecksVerdict{},
+        "ks": KSVerdict{},
+    }
+)
+
+// Gets the names of the verdicts a decision policy can use.
+// Returns the names, sorted alphabetically
+func VerdictNames() []string {
+    names := make([]string, 0, len(verdicts))
+    for name := range verdicts {
+        names = append(names, name)
+    }
+    slices.Sort(names)
+    return names
+}
+
+// Gets a verdict by name.
+// name: the name of the verdict
+// Returns the verdict or an error if there is no verdict with the name
+func GetVerdict(name string) (Verdict, error) {
+    verdict, exists := verdicts[name]
+    if !exists {
+        return nil, fmt.Errorf("Unknown verdict %s; must be one of %v", name, VerdictNames())
+    }
+    return verdict, nil
+}
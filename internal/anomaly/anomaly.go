@@ -0,0 +1,249 @@
+// Watches the verdicts of the node for the signs of a problem with the node rather than with the
+// networks it tests. A node whose own path is congested, or whose pacing is broken, slows the
+// original replay down more than the random one in almost every test, so it suddenly reports
+// differentiation for every app, carrier, and client. The detector compares the share of recent
+// tests that showed differentiation with the share that the baselines of the fleet expect for the
+// same apps, and raises an alert when it is far higher than they can explain.
+package anomaly
+
+import (
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "math"
+    "os"
+    "sync"
+    "time"
+
+    "wehe-server/internal/clock"
+    "wehe-server/internal/metrics"
+    "wehe-server/internal/report"
+)
+
+const (
+    minExpectedRate = 0.001 // baselines are kept at least this far from 0 and 1 so that one test can't make the deviation infinite
+)
+
+var (
+    verdictAnomaly = metrics.NewGaugeVec("wehe_verdict_anomaly",
+        "The latest check of the recent verdicts of the node: alerting is 1 while they look like a node problem, rate and expected_rate are the shares of tests showing differentiation, and z_score is how far apart they are.", "measure")
+)
+
+// The share of tests expected to show differentiation when the node is healthy.
+type Baselines struct {
+    Rate float64 // share of the tests of apps without their own baseline
+    ByApp map[string]float64 // share of the tests of each app; key is the name of the original replay
+}
+
+// Gets the share of the tests of an app that is expected to show differentiation.
+// app: the name of the original replay
+// Returns the share, kept away from 0 and 1
+func (baselines Baselines) rate(app string) float64 {
+    rate, exists := baselines.ByApp[app]
+    if !exists {
+        rate = baselines.Rate
+    }
+    return min(max(rate, minExpectedRate), 1 - minExpectedRate)
+}
+
+// Reads baselines from a daily report, e.g. one added up over the fleet, so that each app is
+// compared with how often it shows differentiation elsewhere. Only analyzed tests count, and apps
+// with too few of them in the report use the rate of the whole report.
+// path: the path of the report, in JSON
+// defaultRate: the rate used if the report has no analyzed tests
+// minTests: the fewest analyzed tests an app needs in the report to get its own baseline
+// Returns the baselines or any errors
+func LoadBaselines(path string, defaultRate float64, minTests int) (Baselines, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return Baselines{}, err
+    }
+    var dailyReport report.Report
+    err = json.Unmarshal(data, &dailyReport)
+    if err != nil {
+        return Baselines{}, fmt.Errorf("Unable to parse baselines file %s: %v", path, err)
+    }
+    baselines := Baselines{
+        Rate: defaultRate,
+        ByApp: make(map[string]float64),
+    }
+    rate, analyzed := differentiationRate(dailyReport.Total)
+    if analyzed > 0 {
+        baselines.Rate = rate
+    }
+    for app, counts := range dailyReport.ByApp {
+        rate, analyzed := differentiationRate(*counts)
+        if analyzed >= max(minTests, 1) {
+            baselines.ByApp[app] = rate
+        }
+    }
+    return baselines, nil
+}
+
+// Gets the share of the analyzed tests in a set of counts that showed differentiation.
+// counts: the counts
+// Returns the share and the number of analyzed tests
+func differentiationRate(counts report.Counts) (float64, int) {
+    analyzed := counts.Differentiation + counts.NoDifferentiation
+    if analyzed == 0 {
+        return 0, 0
+    }
+    return float64(counts.Differentiation) / float64(analyzed), analyzed
+}
+
+// When the detector raises an alert.
+type Settings struct {
+    Window time.Duration // how far back the verdicts are looked at
+    MinTests int // the fewest analyzed tests in the window to check them
+    MinRate float64 // the share of tests in the window showing differentiation must be at least this to alert
+    ZThreshold float64 // how many standard deviations above the baselines the differentiation must be to alert
+    Baselines Baselines // the share of tests expected to show differentiation
+}
+
+// The verdict of an analyzed test.
+type verdict struct {
+    time time.Time // when the test was analyzed
+    app string // the name of the original replay of the test
+    differentiation bool // true if the test showed differentiation
+}
+
+// The result of the latest check of the recent verdicts, as shown to operators.
+type Status struct {
+    Alerting bool `json:"alerting"` // true if the recent verdicts look like a node problem
+    AlertingSince *time.Time `json:"alerting_since,omitempty"` // when the alert was raised; nil if there is no alert
+    CheckedAt time.Time `json:"checked_at"` // when the verdicts were last checked
+    Tests int `json:"tests"` // analyzed tests in the window
+    Differentiation int `json:"differentiation"` // tests in the window that showed differentiation
+    Rate float64 `json:"rate"` // share of the tests in the window that showed differentiation
+    ExpectedRate float64 `json:"expected_rate"` // share that the baselines expect for the apps of those tests
+    ZScore float64 `json:"z_score"` // standard deviations the differentiation is above what is expected; 0 if there are too few tests
+}
+
+// Checks the recent verdicts of the node against baselines.
+type Detector struct {
+    settings Settings
+    clk clock.Clock // the time source for verdict times and checks
+    mutex sync.Mutex // prevents multiple goroutines from accessing verdicts and status
+    verdicts []verdict // the analyzed tests in the window, oldest first
+    status Status // the result of the latest check
+}
+
+// Creates a new Detector. Start must be called for the verdicts to be checked in the background.
+// settings: when the detector raises an alert
+// clk: the time source for verdict times and checks
+// Returns the detector or any errors
+func New(settings Settings, clk clock.Clock) (*Detector, error) {
+    if settings.Window <= 0 {
+        return nil, fmt.Errorf("Verdict anomaly window must be positive; got %v", settings.Window)
+    }
+    if settings.MinTests < 1 {
+        return nil, fmt.Errorf("Verdict anomaly detection needs at least 1 test; got %d", settings.MinTests)
+    }
+    if settings.Baselines.Rate < 0 || settings.Baselines.Rate > 1 {
+        return nil, fmt.Errorf("Baseline differentiation rate must be between 0 and 1; got %f", settings.Baselines.Rate)
+    }
+    return &Detector{
+        settings: settings,
+        clk: clk,
+    }, nil
+}
+
+// Records the verdict of an analyzed test.
+// app: the name of the original replay of the test
+// differentiation: true if the test showed differentiation
+func (detector *Detector) Record(app string, differentiation bool) {
+    detector.mutex.Lock()
+    defer detector.mutex.Unlock()
+    detector.verdicts = append(detector.verdicts, verdict{
+        time: detector.clk.Now(),
+        app: app,
+        differentiation: differentiation,
+    })
+}
+
+// Checks the verdicts every interval. This function should be run in a new thread, as it never
+// returns.
+// interval: how often the verdicts are checked
+func (detector *Detector) Start(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for range ticker.C {
+        detector.Check()
+    }
+}
+
+// Compares the verdicts in the window with the baselines, and raises or clears the alert. An alert
+// is raised once the differentiation is ZThreshold standard deviations above what the baselines
+// expect, and only cleared once it falls below half of that, so that a node near the threshold
+// doesn't flap.
+// Returns the result of the check
+func (detector *Detector) Check() Status {
+    detector.mutex.Lock()
+    defer detector.mutex.Unlock()
+    now := detector.clk.Now()
+    expired := 0
+    for expired < len(detector.verdicts) && now.Sub(detector.verdicts[expired].time) > detector.settings.Window {
+        expired++
+    }
+    detector.verdicts = detector.verdicts[expired:]
+
+    status := Status{
+        Alerting: detector.status.Alerting,
+        AlertingSince: detector.status.AlertingSince,
+        CheckedAt: now,
+        Tests: len(detector.verdicts),
+    }
+    var expected float64
+    var variance float64
+    for _, verdict := range detector.verdicts {
+        if verdict.differentiation {
+            status.Differentiation++
+        }
+        rate := detector.settings.Baselines.rate(verdict.app)
+        expected += rate
+        variance += rate * (1 - rate)
+    }
+    if status.Tests > 0 {
+        status.Rate = float64(status.Differentiation) / float64(status.Tests)
+        status.ExpectedRate = expected / float64(status.Tests)
+    }
+    enoughTests := status.Tests >= detector.settings.MinTests
+    if enoughTests {
+        status.ZScore = (float64(status.Differentiation) - expected) / math.Sqrt(variance)
+    }
+
+    threshold := detector.settings.ZThreshold
+    if status.Alerting {
+        threshold /= 2
+    }
+    anomalous := enoughTests && status.Rate >= detector.settings.MinRate && status.ZScore >= threshold
+    if anomalous && !status.Alerting {
+        status.Alerting = true
+        status.AlertingSince = &now
+        slog.Error("Recent verdicts look like a problem with the node; check its path and pacing", "tests", status.Tests,
+            "differentiation", status.Differentiation, "rate", status.Rate, "expected_rate", status.ExpectedRate, "z_score", status.ZScore)
+    } else if !anomalous && status.Alerting {
+        status.Alerting = false
+        status.AlertingSince = nil
+        slog.Info("Recent verdicts are back in line with the baselines", "tests", status.Tests, "rate", status.Rate, "expected_rate", status.ExpectedRate)
+    }
+    detector.status = status
+
+    alerting := 0.0
+    if status.Alerting {
+        alerting = 1
+    }
+    verdictAnomaly.Set("alerting", alerting)
+    verdictAnomaly.Set("rate", status.Rate)
+    verdictAnomaly.Set("expected_rate", status.ExpectedRate)
+    verdictAnomaly.Set("z_score", status.ZScore)
+    return status
+}
+
+// Gets the result of the latest check.
+// Returns the status
+func (detector *Detector) Status() Status {
+    detector.mutex.Lock()
+    defer detector.mutex.Unlock()
+    return detector.status
+}
@@ -0,0 +1,309 @@
+// Anonymizes client IP addresses before they are written to disk. IPv4 addresses are truncated to
+// their /24 and IPv6 addresses to their /48 by default; both prefix lengths are configurable.
+// Addresses are anonymized in the JSON result files as well as in packet captures, where the IP
+// headers, the addresses embedded in ICMP error messages, and all affected checksums are rewritten.
+package anonymize
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+
+    "github.com/google/gopacket"
+    "github.com/google/gopacket/layers"
+
+    "wehe-server/internal/pcapfile"
+)
+
+const (
+    DefaultIPv4PrefixLen = 24
+    DefaultIPv6PrefixLen = 48
+)
+
+// Truncates IP addresses to a prefix.
+type Anonymizer struct {
+    IPv4PrefixLen int // number of leading bits of IPv4 addresses to keep
+    IPv6PrefixLen int // number of leading bits of IPv6 addresses to keep
+}
+
+// Creates a new Anonymizer.
+// ipv4PrefixLen: number of leading bits of IPv4 addresses to keep, between 0 and 32
+// ipv6PrefixLen: number of leading bits of IPv6 addresses to keep, between 0 and 128
+// Returns the anonymizer or any errors
+func New(ipv4PrefixLen int, ipv6PrefixLen int) (Anonymizer, error) {
+    if ipv4PrefixLen < 0 || ipv4PrefixLen > 32 {
+        return Anonymizer{}, fmt.Errorf("IPv4 prefix length must be between 0 and 32; got %d", ipv4PrefixLen)
+    }
+    if ipv6PrefixLen < 0 || ipv6PrefixLen > 128 {
+        return Anonymizer{}, fmt.Errorf("IPv6 prefix length must be between 0 and 128; got %d", ipv6PrefixLen)
+    }
+    return Anonymizer{
+        IPv4PrefixLen: ipv4PrefixLen,
+        IPv6PrefixLen: ipv6PrefixLen,
+    }, nil
+}
+
+// Creates an Anonymizer with the default /24 and /48 prefix lengths.
+// Returns the anonymizer
+func Default() Anonymizer {
+    return Anonymizer{
+        IPv4PrefixLen: DefaultIPv4PrefixLen,
+        IPv6PrefixLen: DefaultIPv6PrefixLen,
+    }
+}
+
+// Anonymizes an IP address.
+// ip: the IP address to anonymize
+// Returns the anonymized IP address, in its 4 byte form for IPv4 addresses, or nil if the address
+//     is invalid
+func (anonymizer Anonymizer) IP(ip net.IP) net.IP {
+    ipv4 := ip.To4()
+    if ipv4 != nil {
+        return ipv4.Mask(net.CIDRMask(anonymizer.IPv4PrefixLen, 32))
+    }
+
+    ipv6 := ip.To16()
+    if ipv6 != nil {
+        return ipv6.Mask(net.CIDRMask(anonymizer.IPv6PrefixLen, 128))
+    }
+    return nil
+}
+
+// Anonymizes an IP address string.
+// ipString: the IP address to anonymize
+// Returns the anonymized IP address or any errors
+func (anonymizer Anonymizer) IPString(ipString string) (string, error) {
+    ip := net.ParseIP(ipString)
+    if ip == nil {
+        return "", fmt.Errorf("%s is not a valid IP address.\n", ipString)
+    }
+    anonIP := anonymizer.IP(ip)
+    if anonIP == nil {
+        return "", fmt.Errorf("Unknown IP address type: %s\n", ipString)
+    }
+    return anonIP.String(), nil
+}
+
+// Anonymizes the IP addresses in the raw bytes of an address field in place.
+// addr: the 4 byte IPv4 or 16 byte IPv6 address to anonymize
+func (anonymizer Anonymizer) maskInPlace(addr []byte) {
+    var mask net.IPMask
+    if len(addr) == net.IPv4len {
+        mask = net.CIDRMask(anonymizer.IPv4PrefixLen, 32)
+    } else {
+        mask = net.CIDRMask(anonymizer.IPv6PrefixLen, 128)
+    }
+    for i := range addr {
+        addr[i] &= mask[i]
+    }
+}
+
+// Anonymizes the IP addresses in a packet. The source and destination addresses of every IPv4 and
+// IPv6 header are anonymized, as are the addresses of the original packet quoted in ICMP and
+// ICMPv6 error messages. The IPv4 header, TCP, UDP, ICMP, and ICMPv6 checksums, including those of
+// the quoted packet, are updated incrementally (RFC 1624) so that the packet stays valid.
+// data: the raw bytes of the packet
+// linkType: the link layer type of the packet
+// Returns a copy of the packet with the addresses anonymized
+func (anonymizer Anonymizer) Packet(data []byte, linkType layers.LinkType) []byte {
+    buf := make([]byte, len(data))
+    copy(buf, data)
+    // the layers point into buf, so modifying them modifies buf
+    packet := gopacket.NewPacket(buf, linkType, gopacket.NoCopy)
+
+    var oldPseudoAddrs []byte // addresses of the network layer that the next transport layer checksums
+    var newPseudoAddrs []byte
+    for _, layer := range packet.Layers() {
+        contents := layer.LayerContents()
+        switch layer.LayerType() {
+        case layers.LayerTypeIPv4:
+            if len(contents) < 20 {
+                continue
+            }
+            oldPseudoAddrs, newPseudoAddrs = anonymizer.maskAddrs(contents[12:20], net.IPv4len)
+            updateChecksum(contents[10:12], oldPseudoAddrs, newPseudoAddrs)
+        case layers.LayerTypeIPv6:
+            if len(contents) < 40 {
+                continue
+            }
+            oldPseudoAddrs, newPseudoAddrs = anonymizer.maskAddrs(contents[8:40], net.IPv6len)
+        case layers.LayerTypeTCP:
+            if len(contents) >= 18 {
+                updateChecksum(contents[16:18], oldPseudoAddrs, newPseudoAddrs)
+            }
+            oldPseudoAddrs, newPseudoAddrs = nil, nil
+        case layers.LayerTypeUDP:
+            // a UDP checksum of 0 over IPv4 means no checksum was computed
+            if len(contents) >= 8 && binary.BigEndian.Uint16(contents[6:8]) != 0 {
+                updateChecksum(contents[6:8], oldPseudoAddrs, newPseudoAddrs)
+                if binary.BigEndian.Uint16(contents[6:8]) == 0 {
+                    binary.BigEndian.PutUint16(contents[6:8], 0xffff)
+                }
+            }
+            oldPseudoAddrs, newPseudoAddrs = nil, nil
+        case layers.LayerTypeICMPv4:
+            // error messages quote the IP header of the packet that caused the error
+            icmp := layer.(*layers.ICMPv4)
+            quoted := icmp.LayerPayload()
+            if isICMPv4Error(icmp.TypeCode.Type()) && len(quoted) >= 20 && quoted[0] >> 4 == 4 {
+                anonymizer.quotedPacket(quoted, contents[2:4])
+            }
+            oldPseudoAddrs, newPseudoAddrs = nil, nil
+        case layers.LayerTypeICMPv6:
+            // ICMPv6 checksums include the pseudo header, and error messages quote the IPv6 header of
+            // the packet that caused the error after 4 bytes of type-specific data
+            icmp := layer.(*layers.ICMPv6)
+            updateChecksum(contents[2:4], oldPseudoAddrs, newPseudoAddrs)
+            payload := icmp.LayerPayload()
+            if isICMPv6Error(icmp.TypeCode.Type()) && len(payload) >= 44 && payload[4] >> 4 == 6 {
+                anonymizer.quotedPacket(payload[4:], contents[2:4])
+            }
+            oldPseudoAddrs, newPseudoAddrs = nil, nil
+        }
+    }
+    return buf
+}
+
+// Anonymizes the packet quoted in an ICMP or ICMPv6 error message in place. The addresses of the
+// quoted IP header are anonymized, and the checksums of the quoted IPv4 header and of the quoted TCP
+// or UDP header, if enough of it was quoted, are updated, as is the checksum of the error message,
+// which covers all of them.
+// quoted: the quoted packet, starting with its IPv4 or IPv6 header; at least 20 bytes for IPv4 and
+//     40 bytes for IPv6
+// icmpChecksum: the 2 byte checksum field of the error message
+func (anonymizer Anonymizer) quotedPacket(quoted []byte, icmpChecksum []byte) {
+    // the quoted packet starts at an even offset of the message, so the checksum of the message can
+    // be updated with everything that changed in it at once
+    before := make([]byte, len(quoted) &^ 1)
+    copy(before, quoted)
+
+    var oldAddrs, newAddrs []byte
+    var protocol layers.IPProtocol
+    var transport []byte
+    if quoted[0] >> 4 == 4 {
+        oldAddrs, newAddrs = anonymizer.maskAddrs(quoted[12:20], net.IPv4len)
+        updateChecksum(quoted[10:12], oldAddrs, newAddrs)
+        protocol = layers.IPProtocol(quoted[9])
+        headerLen := int(quoted[0] & 0x0f) * 4
+        if headerLen >= 20 && headerLen <= len(quoted) {
+            transport = quoted[headerLen:]
+        }
+    } else {
+        // extension headers aren't followed, so only a transport header right after the IPv6
+        // header is updated
+        oldAddrs, newAddrs = anonymizer.maskAddrs(quoted[8:40], net.IPv6len)
+        protocol = layers.IPProtocol(quoted[6])
+        transport = quoted[40:]
+    }
+    switch protocol {
+    case layers.IPProtocolTCP:
+        if len(transport) >= 18 {
+            updateChecksum(transport[16:18], oldAddrs, newAddrs)
+        }
+    case layers.IPProtocolUDP:
+        if len(transport) >= 8 && binary.BigEndian.Uint16(transport[6:8]) != 0 {
+            updateChecksum(transport[6:8], oldAddrs, newAddrs)
+            if binary.BigEndian.Uint16(transport[6:8]) == 0 {
+                binary.BigEndian.PutUint16(transport[6:8], 0xffff)
+            }
+        }
+    }
+    updateChecksum(icmpChecksum, before, quoted[:len(before)])
+}
+
+// Anonymizes a source and destination address pair in place.
+// addrs: the source address followed by the destination address
+// addrLen: the length of one address in bytes
+// Returns copies of the addresses before and after anonymization
+func (anonymizer Anonymizer) maskAddrs(addrs []byte, addrLen int) ([]byte, []byte) {
+    oldAddrs := make([]byte, len(addrs))
+    copy(oldAddrs, addrs)
+    anonymizer.maskInPlace(addrs[:addrLen])
+    anonymizer.maskInPlace(addrs[addrLen:2 * addrLen])
+    newAddrs := make([]byte, len(addrs))
+    copy(newAddrs, addrs)
+    return oldAddrs, newAddrs
+}
+
+// Checks if an ICMP type is an error message that quotes the packet that caused the error.
+// icmpType: the ICMP type
+// Returns true if the type is an error message; false otherwise
+func isICMPv4Error(icmpType uint8) bool {
+    switch icmpType {
+    case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench, layers.ICMPv4TypeRedirect,
+        layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+        return true
+    default:
+        return false
+    }
+}
+
+// Checks if an ICMPv6 type is an error message that quotes the packet that caused the error.
+// icmpType: the ICMPv6 type
+// Returns true if the type is an error message; false otherwise
+func isICMPv6Error(icmpType uint8) bool {
+    switch icmpType {
+    case layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6TypePacketTooBig, layers.ICMPv6TypeTimeExceeded,
+        layers.ICMPv6TypeParameterProblem:
+        return true
+    default:
+        return false
+    }
+}
+
+// Incrementally updates an internet checksum after some of the data it covers has changed
+// (RFC 1624: HC' = ~(~HC + ~m + m')). The changed data must start at an even offset of the data
+// covered by the checksum.
+// checksum: the 2 byte checksum field to update in place
+// oldData: the data before it changed
+// newData: the data after it changed; must be the same even length as oldData
+func updateChecksum(checksum []byte, oldData []byte, newData []byte) {
+    if len(oldData) == 0 || len(oldData) != len(newData) || len(oldData) % 2 != 0 {
+        return
+    }
+    sum := uint32(^binary.BigEndian.Uint16(checksum))
+    for i := 0; i < len(oldData); i += 2 {
+        sum += uint32(^binary.BigEndian.Uint16(oldData[i:i + 2]))
+        sum += uint32(binary.BigEndian.Uint16(newData[i:i + 2]))
+    }
+    for sum > 0xffff {
+        sum = (sum & 0xffff) + (sum >> 16)
+    }
+    binary.BigEndian.PutUint16(checksum, ^uint16(sum))
+}
+
+// Anonymizes every packet in a PCAP file and writes the result to a new compressed PCAP file.
+// inFilename: the plain or compressed PCAP file to anonymize
+// outFilename: the path of the anonymized PCAP file, without .zst, which is added; missing
+//     directories are created
+// Returns any errors
+func (anonymizer Anonymizer) Pcap(inFilename string, outFilename string) error {
+    reader, err := pcapfile.Open(inFilename)
+    if err != nil {
+        return err
+    }
+    defer reader.Close()
+
+    writer, err := pcapfile.Create(outFilename, reader.Snaplen(), reader.LinkType())
+    if err != nil {
+        return err
+    }
+    for {
+        data, captureInfo, err := reader.ReadPacketData()
+        if err != nil {
+            if err == io.EOF {
+                break
+            }
+            writer.Close()
+            return err
+        }
+        err = writer.WritePacket(captureInfo, anonymizer.Packet(data, reader.LinkType()))
+        if err != nil {
+            writer.Close()
+            return err
+        }
+    }
+    _, err = writer.Close()
+    return err
+}
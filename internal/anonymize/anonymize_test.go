@@ -0,0 +1,255 @@
+// Tests of anonymizing packets, which must mask every address, including those quoted in ICMP
+// errors, and leave every checksum valid.
+package anonymize
+
+import (
+    "bytes"
+    "encoding/binary"
+    "net"
+    "testing"
+
+    "github.com/google/gopacket"
+    "github.com/google/gopacket/layers"
+)
+
+var (
+    clientIPv4 = net.ParseIP("198.51.100.77").To4()
+    serverIPv4 = net.ParseIP("203.0.113.9").To4()
+    routerIPv4 = net.ParseIP("192.0.2.254").To4()
+    clientIPv6 = net.ParseIP("2001:db8:aaaa:bbbb::77")
+    serverIPv6 = net.ParseIP("2001:db8:cccc:dddd::9")
+    routerIPv6 = net.ParseIP("2001:db8:eeee:ffff::fe")
+)
+
+// Serializes layers with their lengths and checksums computed.
+// t: the test
+// serializable: the layers, starting with the network layer
+// Returns the bytes of the packet
+func serialize(t *testing.T, serializable ...gopacket.SerializableLayer) []byte {
+    for _, layer := range serializable {
+        var network gopacket.NetworkLayer
+        switch ip := layer.(type) {
+        case *layers.IPv4:
+            network = ip
+        case *layers.IPv6:
+            network = ip
+        default:
+            continue
+        }
+        for _, upper := range serializable {
+            if withChecksum, ok := upper.(interface{ SetNetworkLayerForChecksum(gopacket.NetworkLayer) error }); ok {
+                withChecksum.SetNetworkLayerForChecksum(network)
+            }
+        }
+        break
+    }
+    buffer := gopacket.NewSerializeBuffer()
+    err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, serializable...)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return buffer.Bytes()
+}
+
+// Builds an IPv4 header.
+// src: the source address
+// dst: the destination address
+// protocol: the protocol of the payload
+// Returns the header
+func ipv4(src net.IP, dst net.IP, protocol layers.IPProtocol) *layers.IPv4 {
+    return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Id: 0x1234, Protocol: protocol, SrcIP: src, DstIP: dst}
+}
+
+// Builds an IPv6 header.
+// src: the source address
+// dst: the destination address
+// nextHeader: the protocol of the payload
+// Returns the header
+func ipv6(src net.IP, dst net.IP, nextHeader layers.IPProtocol) *layers.IPv6 {
+    return &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: nextHeader, SrcIP: src, DstIP: dst}
+}
+
+// Builds a TCP header.
+// Returns the header
+func tcp() *layers.TCP {
+    return &layers.TCP{SrcPort: 51234, DstPort: 443, Seq: 1000, Ack: 2000, ACK: true, PSH: true, Window: 65535}
+}
+
+// Builds a UDP header.
+// Returns the header
+func udp() *layers.UDP {
+    return &layers.UDP{SrcPort: 51234, DstPort: 443}
+}
+
+// Computes the internet checksum sum of some data. Data that checksums correctly, including its
+// checksum field, sums to 0xffff.
+// data: the pieces of data, each of even length except the last
+// Returns the one's complement sum
+func onesSum(data ...[]byte) uint16 {
+    var sum uint32
+    for _, piece := range data {
+        for i := 0; i + 1 < len(piece); i += 2 {
+            sum += uint32(binary.BigEndian.Uint16(piece[i:i + 2]))
+        }
+        if len(piece) % 2 == 1 {
+            sum += uint32(piece[len(piece) - 1]) << 8
+        }
+    }
+    for sum > 0xffff {
+        sum = (sum & 0xffff) + (sum >> 16)
+    }
+    return uint16(sum)
+}
+
+// Builds the pseudo header a transport checksum covers.
+// network: the network layer the transport layer is carried in
+// protocol: the protocol of the transport layer
+// length: the length of the transport layer with its payload
+// Returns the pseudo header
+func pseudoHeader(network gopacket.Layer, protocol layers.IPProtocol, length int) []byte {
+    switch ip := network.(type) {
+    case *layers.IPv4:
+        header := append(append([]byte{}, ip.SrcIP.To4()...), ip.DstIP.To4()...)
+        return append(header, 0, byte(protocol), byte(length >> 8), byte(length))
+    case *layers.IPv6:
+        header := append(append([]byte{}, ip.SrcIP.To16()...), ip.DstIP.To16()...)
+        return append(header, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length), 0, 0, 0, byte(protocol))
+    }
+    return nil
+}
+
+// Checks that every checksum of a packet is valid and that every address is anonymized, including
+// those of a packet quoted in an ICMP error, which must be quoted whole.
+// t: the test
+// packet: the anonymized packet
+// anonymizer: the anonymizer that anonymized it
+// Returns the number of checksums checked
+func checkPacket(t *testing.T, packet gopacket.Packet, anonymizer Anonymizer) int {
+    checked := 0
+    var network gopacket.Layer
+    for _, layer := range packet.Layers() {
+        contents := layer.LayerContents()
+        segment := append(append([]byte{}, contents...), layer.LayerPayload()...)
+        switch ip := layer.(type) {
+        case *layers.IPv4:
+            network = layer
+            if sum := onesSum(contents); sum != 0xffff {
+                t.Errorf("IPv4 header checksum of %v > %v doesn't verify: sum %#04x", ip.SrcIP, ip.DstIP, sum)
+            }
+            checked++
+            for _, addr := range []net.IP{ip.SrcIP, ip.DstIP} {
+                if !addr.Equal(anonymizer.IP(addr)) {
+                    t.Errorf("IPv4 address %v isn't anonymized", addr)
+                }
+            }
+        case *layers.IPv6:
+            network = layer
+            for _, addr := range []net.IP{ip.SrcIP, ip.DstIP} {
+                if !addr.Equal(anonymizer.IP(addr)) {
+                    t.Errorf("IPv6 address %v isn't anonymized", addr)
+                }
+            }
+        case *layers.TCP:
+            if sum := onesSum(pseudoHeader(network, layers.IPProtocolTCP, len(segment)), segment); sum != 0xffff {
+                t.Errorf("TCP checksum doesn't verify: sum %#04x", sum)
+            }
+            checked++
+        case *layers.UDP:
+            if ip.Checksum == 0 {
+                continue
+            }
+            if sum := onesSum(pseudoHeader(network, layers.IPProtocolUDP, len(segment)), segment); sum != 0xffff {
+                t.Errorf("UDP checksum doesn't verify: sum %#04x", sum)
+            }
+            checked++
+        case *layers.ICMPv4:
+            if sum := onesSum(segment); sum != 0xffff {
+                t.Errorf("ICMP checksum doesn't verify: sum %#04x", sum)
+            }
+            checked++
+            if isICMPv4Error(ip.TypeCode.Type()) {
+                quoted := gopacket.NewPacket(layer.LayerPayload(), layers.LayerTypeIPv4, gopacket.Default)
+                checked += checkPacket(t, quoted, anonymizer)
+            }
+        case *layers.ICMPv6:
+            if sum := onesSum(pseudoHeader(network, layers.IPProtocolICMPv6, len(segment)), segment); sum != 0xffff {
+                t.Errorf("ICMPv6 checksum doesn't verify: sum %#04x", sum)
+            }
+            checked++
+            if isICMPv6Error(ip.TypeCode.Type()) {
+                quoted := gopacket.NewPacket(layer.LayerPayload()[4:], layers.LayerTypeIPv6, gopacket.Default)
+                checked += checkPacket(t, quoted, anonymizer)
+            }
+        }
+    }
+    return checked
+}
+
+// Anonymizes packets of each kind and checks that their addresses are masked and that all of their
+// checksums, including those of the packets quoted in ICMP errors, still verify.
+func TestPacketChecksums(t *testing.T) {
+    payload := gopacket.Payload("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n!")
+    quotedIPv4UDP := serialize(t, ipv4(clientIPv4, serverIPv4, layers.IPProtocolUDP), udp(), payload)
+    quotedIPv4TCP := serialize(t, ipv4(clientIPv4, serverIPv4, layers.IPProtocolTCP), tcp(), payload)
+    quotedIPv6UDP := serialize(t, ipv6(clientIPv6, serverIPv6, layers.IPProtocolUDP), udp(), payload)
+    ipv4UDPNoChecksum := serialize(t, ipv4(clientIPv4, serverIPv4, layers.IPProtocolUDP), udp(), payload)
+    binary.BigEndian.PutUint16(ipv4UDPNoChecksum[26:28], 0)
+
+    tests := []struct {
+        name string
+        data []byte // the packet, starting with its IP header
+        firstLayer gopacket.LayerType // the type of the IP header
+        wantChecked int // the number of checksums that must verify
+    }{
+        {"IPv4/TCP", serialize(t, ipv4(clientIPv4, serverIPv4, layers.IPProtocolTCP), tcp(), payload), layers.LayerTypeIPv4, 2},
+        {"IPv4/UDP", serialize(t, ipv4(clientIPv4, serverIPv4, layers.IPProtocolUDP), udp(), payload), layers.LayerTypeIPv4, 2},
+        {"IPv4/UDP without a checksum", ipv4UDPNoChecksum, layers.LayerTypeIPv4, 1},
+        {"IPv6/TCP", serialize(t, ipv6(clientIPv6, serverIPv6, layers.IPProtocolTCP), tcp(), payload), layers.LayerTypeIPv6, 1},
+        {"IPv6/UDP", serialize(t, ipv6(clientIPv6, serverIPv6, layers.IPProtocolUDP), udp(), payload), layers.LayerTypeIPv6, 1},
+        {"ICMP error quoting IPv4/UDP", serialize(t, ipv4(routerIPv4, clientIPv4, layers.IPProtocolICMPv4),
+            &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, 0)},
+            gopacket.Payload(quotedIPv4UDP)), layers.LayerTypeIPv4, 4},
+        {"ICMP error quoting IPv4/TCP", serialize(t, ipv4(routerIPv4, clientIPv4, layers.IPProtocolICMPv4),
+            &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort)},
+            gopacket.Payload(quotedIPv4TCP)), layers.LayerTypeIPv4, 4},
+        {"ICMPv6 error quoting IPv6/UDP", serialize(t, ipv6(routerIPv6, clientIPv6, layers.IPProtocolICMPv6),
+            &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodePortUnreachable)},
+            gopacket.Payload(append(make([]byte, 4), quotedIPv6UDP...))), layers.LayerTypeIPv6, 2},
+    }
+    anonymizer := Default()
+    for _, test := range tests {
+        test := test
+        t.Run(test.name, func(t *testing.T) {
+            before := gopacket.NewPacket(test.data, test.firstLayer, gopacket.Default)
+            if checked := checkChecksumsOnly(t, before); checked != test.wantChecked {
+                t.Fatalf("Original packet has %d valid checksums; want %d", checked, test.wantChecked)
+            }
+
+            data := append([]byte{}, test.data...)
+            anonymized := anonymizer.Packet(data, layers.LinkTypeRaw)
+            if !bytes.Equal(data, test.data) {
+                t.Error("Packet() changed the packet it was given")
+            }
+            if bytes.Equal(anonymized, test.data) {
+                t.Fatal("Packet() didn't change the packet")
+            }
+            packet := gopacket.NewPacket(anonymized, test.firstLayer, gopacket.Default)
+            if checked := checkPacket(t, packet, anonymizer); checked != test.wantChecked {
+                t.Errorf("Checked %d checksums of the anonymized packet; want %d", checked, test.wantChecked)
+            }
+            if test.name == "IPv4/UDP without a checksum" && binary.BigEndian.Uint16(anonymized[26:28]) != 0 {
+                t.Errorf("UDP checksum of 0 became %#04x", binary.BigEndian.Uint16(anonymized[26:28]))
+            }
+        })
+    }
+}
+
+// Checks the checksums of a packet that hasn't been anonymized, so that the test packets are known
+// to be valid to begin with.
+// t: the test
+// packet: the packet
+// Returns the number of checksums that verify
+func checkChecksumsOnly(t *testing.T, packet gopacket.Packet) int {
+    // every address is its own anonymization with no bits masked
+    return checkPacket(t, packet, Anonymizer{IPv4PrefixLen: 32, IPv6PrefixLen: 128})
+}
@@ -11,16 +11,58 @@ import (
     "encoding/pem"
     "fmt"
     "io/ioutil"
+    "log/slog"
     "math/big"
     "net"
     "os"
+    "os/signal"
+    "os/user"
+    "path/filepath"
+    "slices"
+    "strconv"
+    "strings"
+    "syscall"
     "time"
 
+    "wehe-server/internal/admin"
+    "wehe-server/internal/analysis"
+    "wehe-server/internal/anomaly"
+    "wehe-server/internal/anonymize"
+    "wehe-server/internal/artifacts"
+    "wehe-server/internal/buildinfo"
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/clock"
+    "wehe-server/internal/compat"
     "wehe-server/internal/config"
+    "wehe-server/internal/dashboard"
+    "wehe-server/internal/denials"
+    "wehe-server/internal/devices"
+    "wehe-server/internal/errorbudget"
     "wehe-server/internal/geolocation"
+    "wehe-server/internal/logging"
+    "wehe-server/internal/maintenance"
+    "wehe-server/internal/metrics"
     "wehe-server/internal/network"
+    "wehe-server/internal/notify"
+    "wehe-server/internal/report"
+    "wehe-server/internal/resultfile"
+    "wehe-server/internal/resultsdb"
+    "wehe-server/internal/shutdown"
+    "wehe-server/internal/standby"
+    "wehe-server/internal/testdata"
+    "wehe-server/internal/update"
+    "wehe-server/internal/upload"
+    "wehe-server/internal/xray"
 )
 
+// resource readings used in developer mode; low enough that every test is admitted
+var devResources = clienthandler.FixedResources{
+    CPU: 10,
+    Memory: 10,
+    Disk: 10,
+    Upload: 0,
+}
+
 type TestPortNumbers struct {
     TCPPorts []int `json:"tcp_ports"`
     UDPPorts []int `json:"udp_ports"`
@@ -28,21 +70,158 @@ type TestPortNumbers struct {
 
 // Run the Wehe server.
 // cfg: the configurations to run Wehe with
+// devMode: true to run without the geonames data and with resource checks that always pass, so that
+//     the server can run on a developer's machine
 // Returns any errors
-func Run(cfg config.Config) error {
-    replayNames, err := getReplayNames(cfg.TestsDir)
+func Run(cfg config.Config, devMode bool) error {
+    logFile, err := logging.Init(cfg.LogLevel, cfg.LogFormat, cfg.LogFile, int64(cfg.LogMaxSizeMB) * 1024 * 1024, cfg.LogMaxFiles, cfg.NodeLabels)
     if err != nil {
         return err
     }
-    portNumbers, err := getTestPorts(cfg.PortNumbersFile)
+    defer logFile.Close()
+    buildinfo.SetNodeLabels(cfg.NodeLabels)
+    metrics.SetConstLabels(cfg.NodeLabels)
+
+    var linter *testdata.Linter
+    if cfg.ReplayLintEnabled {
+        linter, err = testdata.NewLinter(cfg.ReplayLintPatterns, cfg.ReplayLintAllowUnscrubbed)
+        if err != nil {
+            return err
+        }
+    }
+    replays, err := testdata.NewRegistry(cfg.TestsDir, linter)
+    if err != nil {
+        return err
+    }
+    if cfg.CalibrationEnabled {
+        err = replays.EnableCalibration()
+        if err != nil {
+            return err
+        }
+    }
+    clienthandler.SetReplayRegistry(replays)
+    filePorts, err := getTestPorts(cfg.PortNumbersFile)
+    if err != nil {
+        return err
+    }
+    portNumbers := addReplayPorts(filePorts, replays)
+    if len(portNumbers.TCPPorts) == 0 && len(portNumbers.UDPPorts) == 0 {
+        return fmt.Errorf("No test ports; the replays in %s don't declare any and port_numbers_file lists none", cfg.TestsDir)
+    }
+
+    if devMode {
+        slog.Warn("Running in developer mode: locations resolve to a few embedded cities and resource checks always pass")
+        err = geolocation.InitFixture()
+        clienthandler.SetResourceMonitor(devResources)
+    } else {
+        err = geolocation.Init()
+        // resources are sampled in the background so that asking for permission doesn't wait on a reading
+        resourceSampler := clienthandler.NewResourceSampler(time.Duration(cfg.ResourceSampleIntervalSeconds) * time.Second, time.Duration(cfg.ResourceAverageWindowSeconds) * time.Second)
+        clienthandler.SetResourceMonitor(resourceSampler)
+        go resourceSampler.Start()
+    }
+    if err != nil {
+        return err
+    }
+
+    err = devices.Init()
+    if err != nil {
+        return err
+    }
+
+    resultsLayout, anonymizer, err := setUpResults(cfg)
     if err != nil {
         return err
     }
 
-    err = geolocation.Init()
+    decisionPolicy, err := getDecisionPolicy(cfg, cfg.DecisionPolicy)
+    if err != nil {
+        return err
+    }
+    clienthandler.SetDecisionPolicy(decisionPolicy)
+    analysis.UseScipy(cfg.KSTest == "scipy")
+    clienthandler.SetMinThroughputSamples(cfg.MinThroughputSamples)
+    buildinfo.SetFeatures(features(cfg, cfg.DecisionPolicy))
+
+    var replayGroups *clienthandler.ReplayGroups
+    if len(cfg.ReplayGroups) > 0 {
+        replayGroups, err = clienthandler.NewReplayGroups(cfg.ReplayGroups, time.Duration(cfg.ReplayGroupWaitSeconds) * time.Second)
+        if err != nil {
+            return err
+        }
+        clienthandler.SetReplayGroups(replayGroups)
+    }
+
+    var replayScheduler *clienthandler.ReplayScheduler
+    if cfg.SchedulerMaxConcurrentReplays > 0 {
+        replayScheduler = clienthandler.NewReplayScheduler(cfg.SchedulerMaxConcurrentReplays, cfg.SchedulerMaxQueueLength, time.Duration(cfg.SchedulerMaxWaitSeconds) * time.Second)
+        clienthandler.SetReplayScheduler(replayScheduler)
+    }
+
+    if cfg.FairnessPolicy == "recent_usage" {
+        clienthandler.SetFairnessPolicy(clienthandler.NewRecentUsageFairness(cfg.FairnessContentionThreshold, cfg.FairnessMaxRecentTests, time.Duration(cfg.FairnessWindowHours) * time.Hour))
+    }
+
+    bandwidthLedger, err := clienthandler.NewBandwidthLedger(cfg.BandwidthUsageFile, int64(cfg.BandwidthMonthlyUserCapMB) * 1024 * 1024, time.Now())
     if err != nil {
         return err
     }
+    clienthandler.SetBandwidthLedger(bandwidthLedger)
+    if cfg.BandwidthProbeKB > 0 {
+        bandwidthProbes, err := clienthandler.NewBandwidthProbes(int64(cfg.BandwidthProbeKB) * 1024, time.Duration(cfg.BandwidthProbeTimeoutMs) * time.Millisecond, cfg.BandwidthProbePolicy)
+        if err != nil {
+            return err
+        }
+        clienthandler.SetBandwidthProbes(bandwidthProbes)
+    }
+    clienthandler.SetResourceThresholds(resourceThresholds(cfg))
+    clienthandler.SetSamplesPerReplay(cfg.SamplesPerReplay, cfg.MinSamplesPerReplay, cfg.MaxSamplesPerReplay)
+    network.SetUDPReplayTimeout(time.Duration(cfg.UDPReplayTimeoutSeconds) * time.Second)
+    network.SetMaxUDPReplayTimeout(time.Duration(cfg.MaxUDPReplayTimeoutSeconds) * time.Second)
+    network.SetUDPSendOptions(udpSendOptions(cfg))
+    configReloader := newReloader(cfg, bandwidthLedger)
+
+    var maintenanceCalendar *maintenance.Calendar
+    if len(cfg.MaintenanceWindows) > 0 {
+        maintenanceCalendar, err = maintenance.NewCalendar(cfg.MaintenanceWindows)
+        if err != nil {
+            return err
+        }
+        clienthandler.SetMaintenanceCalendar(maintenanceCalendar)
+    }
+
+    var errorBudget *errorbudget.Tracker
+    if cfg.ErrorBudgetEnabled {
+        errorBudget = errorbudget.New(map[errorbudget.Kind]int{
+            errorbudget.FailedTests: cfg.FailedTestsPerHour,
+            errorbudget.PacingViolations: cfg.PacingViolationsPerHour,
+            errorbudget.CaptureDrops: cfg.CaptureDropsPerHour,
+        }, time.Duration(cfg.PacingToleranceMs) * time.Millisecond, clock.Real{})
+        errorbudget.SetTracker(errorBudget)
+    }
+
+    var anomalyDetector *anomaly.Detector
+    if cfg.AnomalyEnabled {
+        baselines := anomaly.Baselines{Rate: cfg.AnomalyBaselineRate}
+        if cfg.AnomalyBaselinesFile != "" {
+            baselines, err = anomaly.LoadBaselines(cfg.AnomalyBaselinesFile, cfg.AnomalyBaselineRate, cfg.AnomalyMinTests)
+            if err != nil {
+                return err
+            }
+        }
+        anomalyDetector, err = anomaly.New(anomaly.Settings{
+            Window: time.Duration(cfg.AnomalyWindowMinutes) * time.Minute,
+            MinTests: cfg.AnomalyMinTests,
+            MinRate: cfg.AnomalyMinRate,
+            ZThreshold: cfg.AnomalyZThreshold,
+            Baselines: baselines,
+        }, clock.Real{})
+        if err != nil {
+            return err
+        }
+        clienthandler.SetAnomalyDetector(anomalyDetector)
+        go anomalyDetector.Start(time.Duration(cfg.AnomalyCheckIntervalSeconds) * time.Second)
+    }
 
     caKeyPassword := os.Getenv("WEHE_KEY_PASSWORD")
     if caKeyPassword == "" {
@@ -53,67 +232,899 @@ func Run(cfg config.Config) error {
     if err != nil {
         return err
     }
+    tlsSettings, err := network.NewTLSSettings(cfg.TLSMinVersion, cfg.TLSCipherSuites, cfg.TLSClientCAFile, cfg.TLSRequireClientCert)
+    if err != nil {
+        return err
+    }
+    // only the side channels authenticate clients; old clients and operators fetch results without a cert
+    sideChannelTLS := tlsSettings.ServerConfig(cert, true)
+    serverTLS := tlsSettings.ServerConfig(cert, false)
 
-    errChan := make(chan error)
-    sideChannel, err := network.NewSideChannel("0.0.0.0", replayNames, cfg.UUIDPrefixFile, cfg.TmpResultsDir, cfg.ResultsDir)
+    sideChannel, err := network.NewSideChannel("0.0.0.0", replays, portNumbers.TCPPorts, portNumbers.UDPPorts, cfg.UUIDPrefixFile, cfg.TmpResultsDir, cfg.ResultsDir, cfg.DuplicateTestPolicy)
     if err != nil {
         return err
     }
-    go sideChannel.StartServer(cert, errChan)
+
+    sideChannel.Port = cfg.SideChannelPort
+    sideChannel.Timeouts = network.SideChannelTimeouts{
+        Read: time.Duration(cfg.SideChannelReadTimeoutSeconds) * time.Second,
+        Write: time.Duration(cfg.SideChannelWriteTimeoutSeconds) * time.Second,
+        MaxTest: time.Duration(cfg.MaxTestSeconds) * time.Second,
+    }
+    if cfg.MinClientVersion != "" {
+        sideChannel.MinClientVersion, err = compat.ParseVersion(cfg.MinClientVersion)
+        if err != nil {
+            return err
+        }
+    }
+
+    // the capture is opened while the server can still capture packets, before it drops privileges
+    if cfg.LossCaptureInterface != "" {
+        sideChannel.LossCaptures, err = network.NewLossCaptures(cfg.LossCaptureInterface, nonReplayPorts(cfg))
+        if err != nil {
+            return fmt.Errorf("Unable to capture packets on %s: %v", cfg.LossCaptureInterface, err)
+        }
+        go sideChannel.LossCaptures.Run()
+    }
+
+    shutdownReporter := shutdown.New(cfg.ShutdownReportDir, cfg.ShutdownGoroutineDump, time.Duration(cfg.ShutdownDrainSeconds) * time.Second, time.Duration(cfg.ShutdownGraceSeconds) * time.Second, sideChannel.InFlightTests)
+    shutdown.SetReporter(shutdownReporter)
+    defer shutdown.RecoverPanic()
 
     // TODO: revisit this comment - will we still use WHATSMYIPMAN? will it be on a separate port?
     // for backwards compatibility, we open all TCP and UDP replay ports needed to run all tests
     // during server initialization since clients v3.7.4 and older will make a request to the test
     // port to get its public IP (WHATSMYIPMAN) before it connects to the side channel, so we don't
     // know when client will make a request to a test port
-    var tcpServers []network.TCPServer
-    var udpServers []network.UDPServer
-    for _, port := range portNumbers.TCPPorts {
-        tcpServer := network.NewTCPServer("0.0.0.0", port, sideChannel.ConnectedClients)
-        go tcpServer.StartServer(errChan)
-        tcpServers = append(tcpServers, tcpServer)
+    errorPolicies := network.ReplayErrorPolicies{
+        Default: network.ReplayErrorPolicy(cfg.ReplayErrorPolicy),
+        Overrides: make(map[string]network.ReplayErrorPolicy),
+    }
+    for replayName, policy := range cfg.ReplayErrorPolicyOverrides {
+        errorPolicies.Overrides[replayName] = network.ReplayErrorPolicy(policy)
+    }
+
+    // in a standby pair, everything above is loaded by both processes so that the standby can start
+    // serving as soon as it takes over the ports of the leader
+    if cfg.StandbyLockFile != "" {
+        leaderLock, err := standby.AcquireLeadership(cfg.StandbyLockFile)
+        if err != nil {
+            return err
+        }
+        defer leaderLock.Release()
+    }
+
+    // bind every port before dropping privileges so that replays can run on privileged ports, such
+    // as 80 and 443, without the server staying root
+    sideChannelListener, err := sideChannel.Listen(sideChannelTLS)
+    if err != nil {
+        return err
+    }
+    var grpcSideChannel *network.GRPCSideChannel
+    var grpcSideChannelListener net.Listener
+    if cfg.GRPCSideChannelAddr != "" {
+        grpcSideChannel = network.NewGRPCSideChannel(sideChannel, cfg.GRPCSideChannelAddr)
+        grpcSideChannelListener, err = grpcSideChannel.Listen()
+        if err != nil {
+            return err
+        }
+    }
+
+    loadBudget := testdata.LoadBudget{
+        ParseTime: time.Duration(cfg.ReplayParseBudgetMs) * time.Millisecond,
+        FileBytes: int64(cfg.ReplayFileBudgetMB) * 1024 * 1024,
+    }
+    replayCache := testdata.NewCache(replays, int64(cfg.ReplayCacheMaxMB) * 1024 * 1024, loadBudget)
+    if cfg.ReplayCachePreload {
+        err = replayCache.Preload()
+        if err != nil {
+            return err
+        }
+    }
+    network.SetConnectionRateLimit(connectionRateLimit(cfg))
+    udpPathMTU := network.UDPPathMTU{
+        DontFragment: cfg.UDPDontFragment,
+        Clamp: cfg.UDPClampToPathMTU,
+    }
+    servers := &replayServers{
+        portNumbersFile: cfg.PortNumbersFile,
+        filePorts: filePorts,
+        replays: replays,
+        sideChannel: sideChannel,
+        newTCPServer: func(port int) network.TCPServer {
+            return network.NewTCPServer("0.0.0.0", port, sideChannel.ConnectedClients, errorPolicies, network.RequestHashCheck(cfg.RequestHashCheck), replayCache)
+        },
+        newUDPServer: func(port int) network.UDPServer {
+            return network.NewUDPServer("0.0.0.0", port, sideChannel.ConnectedClients, errorPolicies, udpPathMTU, replayCache)
+        },
+    }
+    _, err = servers.listen(portNumbers)
+    if err != nil {
+        return err
+    }
+    configReloader.replayServers = servers
+    go replays.WatchForChanges(servers.replaysChanged)
+
+    oldAnalyzerListener, err := network.ListenOldAnalyzerServer(cfg.OldAnalyzerPort)
+    if err != nil {
+        return err
     }
 
-    for _, port := range portNumbers.UDPPorts {
-        udpServer := network.NewUDPServer("0.0.0.0", port, sideChannel.ConnectedClients)
-        go udpServer.StartServer(errChan)
-        udpServers = append(udpServers, udpServer)
+    var adminListener net.Listener
+    if cfg.AdminListenAddr != "" {
+        adminListener, err = admin.Listen(cfg.AdminListenAddr)
+        if err != nil {
+            return err
+        }
     }
 
-    go network.StartOldAnalyzerServer(cert, errChan)
+    err = dropPrivileges(cfg.RunAsUser, cfg.RunAsGroup)
+    if err != nil {
+        return err
+    }
+    servers.setRunAsUser(cfg.RunAsUser)
 
-    err = <-errChan
+    denialLog, err := denials.New(cfg.DenialLogFile, int64(cfg.DenialLogMaxSizeMB) * 1024 * 1024, cfg.DenialLogMaxFiles)
     if err != nil {
         return err
     }
+    defer denialLog.Close()
+    clienthandler.SetDenialLog(denialLog)
+
+    var resultsStore *resultsdb.Store
+    if cfg.ResultsDBDriver != "" {
+        resultsStore, err = resultsdb.Open(cfg.ResultsDBDriver, cfg.ResultsDBSource)
+        if err != nil {
+            return err
+        }
+        defer resultsStore.Close()
+        clienthandler.SetResultsStore(resultsStore)
+    }
+
+    var reporter *report.Reporter
+    if cfg.ReportEnabled {
+        privacy := report.Privacy{
+            Epsilon: cfg.ReportPrivacyEpsilon,
+            MinCount: cfg.ReportMinGroupCount,
+        }
+        reporter, err = report.New(filepath.Join(cfg.ResultsDir, "report"), cfg.ReportWebhookURL, denialLog, privacy)
+        if err != nil {
+            return err
+        }
+        clienthandler.SetTestReporter(reporter)
+        go reporter.Start()
+    }
+
+    if cfg.VerdictWebhookURL != "" {
+        verdictWebhookKey := os.Getenv("WEHE_VERDICT_WEBHOOK_KEY")
+        if verdictWebhookKey == "" {
+            return fmt.Errorf("WEHE_VERDICT_WEBHOOK_KEY is not set in environment.")
+        }
+        verdictNotifier := notify.New(cfg.VerdictWebhookURL, []byte(verdictWebhookKey))
+        clienthandler.SetVerdictNotifier(verdictNotifier)
+        go verdictNotifier.Start()
+    }
+
+    var resultsUploader *upload.Uploader
+    if cfg.UploadEnabled {
+        settings := upload.Settings{
+            Provider: cfg.UploadProvider,
+            Endpoint: cfg.UploadEndpoint,
+            Region: cfg.UploadRegion,
+            Bucket: cfg.UploadBucket,
+            Prefix: cfg.UploadPrefix,
+            AccessKey: os.Getenv("WEHE_UPLOAD_ACCESS_KEY"),
+            SecretKey: os.Getenv("WEHE_UPLOAD_SECRET_KEY"),
+            MinAge: time.Duration(cfg.UploadMinAgeMinutes) * time.Minute,
+            Interval: time.Duration(cfg.UploadIntervalSeconds) * time.Second,
+            MaxMbps: cfg.UploadMaxMbps,
+        }
+        if settings.AccessKey == "" || settings.SecretKey == "" {
+            return fmt.Errorf("WEHE_UPLOAD_ACCESS_KEY and WEHE_UPLOAD_SECRET_KEY must be set in environment.")
+        }
+        if cfg.UploadEncryptionKeyFile != "" {
+            settings.PublicKey, err = upload.LoadPublicKey(cfg.UploadEncryptionKeyFile)
+            if err != nil {
+                return err
+            }
+        }
+        resultsUploader = upload.New(settings, cfg.TmpResultsDir, resultsLayout)
+        go resultsUploader.Start()
+    }
+
+    errChan := make(chan error)
+    if adminListener != nil {
+        authorizer, err := admin.NewAuthorizer(cfg.AdminTokensFile, cfg.AdminAuditLogFile)
+        if err != nil {
+            return err
+        }
+        defer authorizer.Close()
+        adminServer := admin.NewServer(authorizer)
+        configReloader.authorizer = authorizer
+        adminServer.Handle("/reload", admin.Operator, configReloader)
+        introspector := &introspector{
+            connectedClients: sideChannel.ConnectedClients,
+            replays: replays,
+            replayCache: replayCache,
+            servers: servers,
+            resultsStore: resultsStore,
+            authorizer: authorizer,
+        }
+        if cfg.DebugCaptureInterface != "" {
+            settings := network.DebugCaptureSettings{
+                Interface: cfg.DebugCaptureInterface,
+                Dir: cfg.DebugCaptureDir,
+                MaxDuration: time.Duration(cfg.DebugCaptureMaxSeconds) * time.Second,
+                MaxBytes: int64(cfg.DebugCaptureMaxMB) * 1024 * 1024,
+            }
+            introspector.captures = network.NewDebugCaptures(settings, anonymizer)
+        }
+        introspector.register(adminServer)
+        adminServer.AddStatus("side_channel_tls_handshake_failures", func() interface{} {
+            return network.TLSHandshakeFailures()
+        })
+        if replayGroups != nil {
+            adminServer.AddStatus("replay_groups", func() interface{} {
+                return replayGroups.Status()
+            })
+        }
+        if replayScheduler != nil {
+            adminServer.AddStatus("replay_scheduler", func() interface{} {
+                return replayScheduler.Status()
+            })
+        }
+        if maintenanceCalendar != nil {
+            adminServer.AddStatus("maintenance", func() interface{} {
+                return maintenanceCalendar.Status(time.Now())
+            })
+        }
+        if errorBudget != nil {
+            adminServer.AddStatus("error_budget", func() interface{} {
+                return errorBudget.Status()
+            })
+            adminServer.HandlePublic("/ready", errorBudget.ReadinessHandler())
+        }
+        if anomalyDetector != nil {
+            adminServer.AddStatus("verdict_anomaly", func() interface{} {
+                return anomalyDetector.Status()
+            })
+        }
+        adminServer.AddStatus("bandwidth", func() interface{} {
+            return bandwidthLedger.Status(time.Now())
+        })
+        adminServer.AddStatus("old_protocol", func() interface{} {
+            return network.OldProtocolUsage()
+        })
+        if resultsUploader != nil {
+            adminServer.AddStatus("uploader", func() interface{} {
+                return resultsUploader.Status()
+            })
+        }
+        adminServer.AddStatus("udp_sessions", func() interface{} {
+            return servers.udpSessions()
+        })
+        dash := dashboard.New(sideChannel.ConnectedClients, reporter, cfg.ResultsDir)
+        go dash.SampleHealth()
+        adminServer.HandlePublic("/dashboard/", dashboard.StaticHandler("/dashboard/"))
+        adminServer.Handle("/dashboard/data", admin.ReadOnly, dash.DataHandler())
+        go adminServer.Serve(adminListener, serverTLS, errChan)
+    }
+    go sideChannel.StartServer(sideChannelListener, errChan)
+    go sideChannel.ReapStaleClients()
+    if grpcSideChannel != nil {
+        go grpcSideChannel.StartServer(grpcSideChannelListener, sideChannelTLS, errChan)
+        go grpcSideChannel.ReapIdleTests()
+    }
+    servers.start(errChan)
+    go network.StartOldAnalyzerServer(oldAnalyzerListener, serverTLS, errChan)
+    go network.ReportOldProtocolUsage()
+    hangups := make(chan os.Signal, 1)
+    signal.Notify(hangups, syscall.SIGHUP)
+    go configReloader.reloadOnSignal(hangups)
+
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+    select {
+    case sig := <-signals:
+        // the replay ports stay open so that the running tests can finish their replays
+        sideChannelListener.Close()
+        if grpcSideChannelListener != nil {
+            grpcSideChannelListener.Close()
+        }
+        shutdownReporter.Drain("signal: " + sig.String(), signals)
+        return nil
+    case err = <-errChan:
+        cause := "a server stopped"
+        if err != nil {
+            cause = "error: " + err.Error()
+        }
+        shutdownReporter.Shutdown(cause)
+        return err
+    }
+}
+
+// Sets how the results of tests are written: the results layout, the anonymizer of client IPs, and
+// the data profiles.
+// cfg: the configurations
+// Returns the results layout and the anonymizer, or any errors
+func setUpResults(cfg config.Config) (*artifacts.Layout, anonymize.Anonymizer, error) {
+    layoutTemplates := make(map[artifacts.Kind]string)
+    for kind, template := range cfg.ResultsLayoutTemplates {
+        layoutTemplates[artifacts.Kind(kind)] = template
+    }
+    resultsLayout, err := artifacts.NewLayout(cfg.ResultsLayoutPreset, layoutTemplates)
+    if err != nil {
+        return nil, anonymize.Anonymizer{}, err
+    }
+    clienthandler.SetResultsLayout(resultsLayout)
+    resultfile.SetDurable(cfg.DurableResultWrites)
+
+    anonymizer, err := anonymize.New(cfg.AnonIPv4PrefixLen, cfg.AnonIPv6PrefixLen)
+    if err != nil {
+        return nil, anonymize.Anonymizer{}, err
+    }
+    clienthandler.SetAnonymizer(anonymizer)
+
+    var profiles []clienthandler.DataProfile
+    for name, profileConfig := range cfg.DataProfiles {
+        profileAnonymizer, err := anonymize.New(profileConfig.AnonIPv4PrefixLen, profileConfig.AnonIPv6PrefixLen)
+        if err != nil {
+            return nil, anonymize.Anonymizer{}, fmt.Errorf("%v in data profile %s", err, name)
+        }
+        profiles = append(profiles, clienthandler.DataProfile{
+            Name: name,
+            Countries: profileConfig.Countries,
+            Location: clienthandler.LocationPrecision(profileConfig.Location),
+            Anonymizer: profileAnonymizer,
+            StoreSideChannelRTTs: profileConfig.SideChannelRTTs,
+        })
+    }
+    dataProfiles, err := clienthandler.NewDataProfiles(profiles)
+    if err != nil {
+        return nil, anonymize.Anonymizer{}, err
+    }
+    clienthandler.SetDataProfiles(dataProfiles)
+    return resultsLayout, anonymizer, nil
+}
+
+// Gets a decision policy defined in the config file.
+// cfg: the configurations with the decision policies
+// name: the name of the policy
+// Returns the decision policy or an error if it isn't defined or is invalid
+func getDecisionPolicy(cfg config.Config, name string) (analysis.DecisionPolicy, error) {
+    policyConfig, exists := cfg.DecisionPolicies[name]
+    if !exists {
+        return analysis.DecisionPolicy{}, fmt.Errorf("Decision policy %s is not defined in the config file", name)
+    }
+    decisionPolicy := analysis.DecisionPolicy{
+        Name: name,
+        Alpha: policyConfig.Alpha,
+        AreaThreshold: policyConfig.AreaThreshold,
+        KS2pValThreshold: policyConfig.KS2pValThreshold,
+        AcceptRatioThreshold: policyConfig.AcceptRatioThreshold,
+        Resamples: policyConfig.Resamples,
+        Verdict: policyConfig.Verdict,
+    }
+    err := decisionPolicy.Validate()
+    if err != nil {
+        return analysis.DecisionPolicy{}, err
+    }
+    return decisionPolicy, nil
+}
+
+// Gets the TCP ports of a config that clients connect to for something other than a replay.
+// cfg: the configurations
+// Returns the ports
+func nonReplayPorts(cfg config.Config) []int {
+    ports := []int{cfg.SideChannelPort, cfg.OldAnalyzerPort}
+    if cfg.GRPCSideChannelAddr != "" {
+        _, portString, err := net.SplitHostPort(cfg.GRPCSideChannelAddr)
+        port, convErr := strconv.Atoi(portString)
+        if err == nil && convErr == nil {
+            ports = append(ports, port)
+        }
+    }
+    return ports
+}
+
+// Gets how the UDP replay servers of a config send packets.
+// cfg: the configurations
+// Returns the send options
+func udpSendOptions(cfg config.Config) network.UDPSendOptions {
+    return network.UDPSendOptions{
+        BatchSize: cfg.UDPSendBatchSize,
+        BatchWindow: time.Duration(cfg.UDPSendBatchWindowMicroseconds) * time.Microsecond,
+        SocketPerFlow: cfg.UDPSocketPerFlow,
+    }
+}
+
+// Gets the settings that change how tests are run, which are stamped into the result files.
+// cfg: the configurations
+// policyName: the name of the decision policy in use
+// Returns the settings; key is the setting name
+func features(cfg config.Config, policyName string) map[string]string {
+    return map[string]string{
+        "analysis.policy": policyName,
+        "analysis.ks_test": cfg.KSTest,
+        "analysis.min_throughput_samples": strconv.Itoa(cfg.MinThroughputSamples),
+        "replay_error_policy.default": cfg.ReplayErrorPolicy,
+        "request_hash.check": cfg.RequestHashCheck,
+        "udp_path_mtu.dont_fragment": strconv.FormatBool(cfg.UDPDontFragment),
+        "udp_path_mtu.clamp": strconv.FormatBool(cfg.UDPClampToPathMTU),
+        "udp_send.batch_size": strconv.Itoa(cfg.UDPSendBatchSize),
+        "udp_send.socket_per_flow": strconv.FormatBool(cfg.UDPSocketPerFlow),
+    }
+}
+
+// Analyzes tests offline from their client throughput files, the same way the server does, and
+// prints the decision of each. Decision files are written to outputDir using the results layout.
+// cfg: the configurations with the decision policies and the results layout
+// policyName: the decision policy to use; empty to use the policy of the config file
+// outputDir: the root directory to write the decision files in
+// paths: either the original and random throughput files of one test, or one directory that is
+//     searched for the throughput files of every test in it
+// Returns any errors
+func Analyze(cfg config.Config, policyName string, outputDir string, paths []string) error {
+    if policyName == "" {
+        policyName = cfg.DecisionPolicy
+    }
+    decisionPolicy, err := getDecisionPolicy(cfg, policyName)
+    if err != nil {
+        return err
+    }
+    clienthandler.SetDecisionPolicy(decisionPolicy)
+    analysis.UseScipy(cfg.KSTest == "scipy")
+    clienthandler.SetMinThroughputSamples(cfg.MinThroughputSamples)
+    buildinfo.SetFeatures(features(cfg, policyName))
+
+    layoutTemplates := make(map[artifacts.Kind]string)
+    for kind, template := range cfg.ResultsLayoutTemplates {
+        layoutTemplates[artifacts.Kind(kind)] = template
+    }
+    resultsLayout, err := artifacts.NewLayout(cfg.ResultsLayoutPreset, layoutTemplates)
+    if err != nil {
+        return err
+    }
+    clienthandler.SetResultsLayout(resultsLayout)
+    resultfile.SetDurable(cfg.DurableResultWrites)
+
+    var tests []clienthandler.ThroughputFiles
+    switch len(paths) {
+    case 1:
+        tests, err = clienthandler.FindThroughputFiles(paths[0])
+        if err != nil {
+            return err
+        }
+        if len(tests) == 0 {
+            return fmt.Errorf("No tests with throughputs for both replays found in %s", paths[0])
+        }
+    case 2:
+        tests = []clienthandler.ThroughputFiles{clienthandler.NewThroughputFiles(paths[0], paths[1])}
+    default:
+        return fmt.Errorf("Expected two throughput files or one directory; received %d paths", len(paths))
+    }
+
+    for _, test := range tests {
+        clt, err := test.Analyze(outputDir)
+        if err != nil {
+            return fmt.Errorf("Unable to analyze test %d of user %s: %v", test.TestID, test.UserID, err)
+        }
+        fmt.Printf("user %s test %d: differentiation=%t inconclusive=%t samples=%d/%d area0var=%f ks2_pval=%f ks2_accept_ratio=%f policy=%s verdict=%s\n", test.UserID, test.TestID, clt.Analysis.Differentiation, clt.Analysis.Verdict.Inconclusive, clt.Analysis.Samples.OriginalSamples, clt.Analysis.Samples.RandomSamples, clt.Analysis.Area0var, clt.Analysis.KS2pVal, clt.Analysis.KS2AcceptRatio, policyName, clt.Analysis.Verdict.Verdict)
+    }
     return nil
 }
 
-// Get names of the replays, which are used by the client to tell the server which replay it wants
-// to use. The replay name is the name of the directory that the replay file is contained in.
-// dirPath: the path to a directory containing directories which contain the replay files
-// Returns a list of replay names or an error
-func getReplayNames(dirPath string) ([]string, error) {
-    var testNames []string
+// Writes a corpus of synthetic tests, with the results layout, anonymizer, data profiles, and
+// decision policy of the config file, and prints what was written. The corpus can't be written to the
+// results directories of the config file, so that synthetic tests are never mixed with real ones.
+// cfg: the configurations with the replays and how results are written
+// outputDir: the root directory to write the corpus in
+// settings: what the corpus looks like
+// Returns any errors
+func GenerateCorpus(cfg config.Config, outputDir string, settings clienthandler.CorpusSettings) error {
+    for _, resultsDir := range []string{cfg.ResultsDir, cfg.TmpResultsDir} {
+        if resultsDir != "" && filepath.Clean(outputDir) == filepath.Clean(resultsDir) {
+            return fmt.Errorf("Refusing to write synthetic tests to the results directory %s", resultsDir)
+        }
+    }
+
+    replays, err := testdata.NewRegistry(cfg.TestsDir, nil)
+    if err != nil {
+        return err
+    }
+    err = devices.Init()
+    if err != nil {
+        return err
+    }
+    _, _, err = setUpResults(cfg)
+    if err != nil {
+        return err
+    }
+    decisionPolicy, err := getDecisionPolicy(cfg, cfg.DecisionPolicy)
+    if err != nil {
+        return err
+    }
+    clienthandler.SetDecisionPolicy(decisionPolicy)
+    analysis.UseScipy(cfg.KSTest == "scipy")
+    clienthandler.SetMinThroughputSamples(cfg.MinThroughputSamples)
+    clienthandler.SetSamplesPerReplay(cfg.SamplesPerReplay, cfg.MinSamplesPerReplay, cfg.MaxSamplesPerReplay)
+
+    stats, err := clienthandler.GenerateCorpus(replays, settings, outputDir)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("users=%d tests=%d files=%d throttled=%d differentiation=%d seed=%d\n", stats.Users, stats.Tests, stats.Files, stats.Throttled, stats.Differentiation, settings.Seed)
+    return nil
+}
 
-    entries, err := os.ReadDir(dirPath)
+// Prints everything the server recorded about one test: its result files in the results
+// directories, the lines logged about it, and the debug captures taken while it ran.
+// cfg: the configurations with the results directories, results layout, log file, and capture
+//     directory
+// userID: the user ID of the test
+// testID: the test ID, with _attempt<n> for attempts after the first
+// asJSON: true to print the report as JSON rather than as text
+// Returns any errors
+func XRay(cfg config.Config, userID string, testID string, asJSON bool) error {
+    resultsLayout, _, err := setUpResults(cfg)
+    if err != nil {
+        return err
+    }
+    testReport, err := xray.Gather(xray.Sources{
+        Layout: resultsLayout,
+        ResultsDirs: []string{cfg.TmpResultsDir, cfg.ResultsDir},
+        LogFile: cfg.LogFile,
+        CaptureDir: cfg.DebugCaptureDir,
+    }, userID, testID)
     if err != nil {
-        return nil, err
+        return err
     }
+    if asJSON {
+        encoder := json.NewEncoder(os.Stdout)
+        encoder.SetIndent("", "  ")
+        return encoder.Encode(testReport)
+    }
+    return testReport.Print(os.Stdout)
+}
 
-    for _, entry := range entries {
-        if entry.IsDir() {
-            testNames = append(testNames, entry.Name())
+// Measures how long result files take to write in place and durably on the disk of the tmp results
+// directory, and prints the timings of both, so that operators can see what durable_result_writes
+// would cost on this server before turning it on.
+// cfg: the configurations with the tmp results directory
+// files: the number of files to write each way
+// size: the size of each file in bytes
+// Returns any errors
+func BenchmarkResultWrites(cfg config.Config, files int, size int) error {
+    plain, durable, err := resultfile.Benchmark(cfg.TmpResultsDir, files, size)
+    if err != nil {
+        return err
+    }
+    for _, timings := range []struct {
+        name string
+        timings resultfile.WriteTimings
+    }{{"plain", plain}, {"durable", durable}} {
+        fmt.Printf("%s: files=%d size=%dB median=%v p99=%v files_per_second=%.1f\n", timings.name, timings.timings.Files, size, timings.timings.Median, timings.timings.P99, timings.timings.FilesPerSecond)
+    }
+    if plain.Median > 0 {
+        fmt.Printf("durable writes take %.1fx as long at the median\n", float64(durable.Median) / float64(plain.Median))
+    }
+    return nil
+}
+
+// Decrypts results archives that were encrypted before they were uploaded. Each archive is written to
+// the output directory under its name without .enc, e.g. <userID>_<testID>.tar.gz. Runs on the
+// analysis host, so it needs no server config.
+// privateKeyFile: PEM file of the RSA private key of the public key the archives were encrypted with
+// outputDir: the directory to write the decrypted archives to
+// archives: paths of the encrypted archives
+// Returns any errors
+func DecryptResults(privateKeyFile string, outputDir string, archives []string) error {
+    if len(archives) == 0 {
+        return fmt.Errorf("No archives to decrypt given")
+    }
+    privateKey, err := upload.LoadPrivateKey(privateKeyFile)
+    if err != nil {
+        return err
+    }
+    err = os.MkdirAll(outputDir, 0755)
+    if err != nil {
+        return err
+    }
+    for _, archive := range archives {
+        envelope, err := os.ReadFile(archive)
+        if err != nil {
+            return err
+        }
+        plaintext, err := upload.Open(privateKey, envelope)
+        if err != nil {
+            return fmt.Errorf("Unable to decrypt %s: %v", archive, err)
         }
+        outputFile := filepath.Join(outputDir, strings.TrimSuffix(filepath.Base(archive), upload.EncryptedSuffix))
+        err = os.WriteFile(outputFile, plaintext, 0644)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("%s -> %s\n", archive, outputFile)
+    }
+    return nil
+}
+
+// Checks every replay in the tests directory for problems that would otherwise only show when a client
+// runs it, e.g. malformed payloads and request hashes, timestamps that go backwards, and ports that
+// can't be listened on, and prints them without starting any listeners.
+// cfg: the configurations with the tests directory and the ports of the server
+// Returns true if no replay has problems, or any errors
+func ValidateReplays(cfg config.Config) (bool, error) {
+    portNumbers, err := getTestPorts(cfg.PortNumbersFile)
+    if err != nil {
+        return false, err
+    }
+    results, err := testdata.ValidateReplays(cfg.TestsDir, testdata.PortCoverage{
+        TCPPorts: portNumbers.TCPPorts,
+        ReservedTCPPorts: nonReplayPorts(cfg),
+    })
+    if err != nil {
+        return false, err
     }
 
-    return testNames, nil
+    passed := true
+    for _, result := range results {
+        if result.NumProblems == 0 {
+            fmt.Printf("%s: ok\n", result.ReplayName)
+            continue
+        }
+        passed = false
+        fmt.Printf("%s: %d problems\n", result.ReplayName, result.NumProblems)
+        for _, problem := range result.Problems {
+            fmt.Println("    ", problem)
+        }
+        if result.NumProblems > len(result.Problems) {
+            fmt.Printf("     and %d more\n", result.NumProblems - len(result.Problems))
+        }
+    }
+    return passed, nil
+}
+
+// Checks every replay in the tests directory for sensitive content and prints what was found, without
+// starting the server.
+// cfg: the configurations with the tests directory and the lint patterns
+// Returns true if every replay can be served, or any errors
+func LintReplays(cfg config.Config) (bool, error) {
+    linter, err := testdata.NewLinter(cfg.ReplayLintPatterns, cfg.ReplayLintAllowUnscrubbed)
+    if err != nil {
+        return false, err
+    }
+    results, err := linter.LintDir(cfg.TestsDir)
+    if err != nil {
+        return false, err
+    }
+
+    passed := true
+    for _, result := range results {
+        if result.NumFindings == 0 {
+            fmt.Printf("%s: ok\n", result.ReplayName)
+            continue
+        }
+        if result.Allowed {
+            fmt.Printf("%s: %d matches, allowed by allow_unscrubbed\n", result.ReplayName, result.NumFindings)
+        } else {
+            fmt.Printf("%s: %d matches, will not be served\n", result.ReplayName, result.NumFindings)
+            passed = false
+        }
+        for _, finding := range result.Findings {
+            fmt.Println("    ", finding)
+        }
+        if result.NumFindings > len(result.Findings) {
+            fmt.Printf("     and %d more\n", result.NumFindings - len(result.Findings))
+        }
+    }
+    return passed, nil
+}
+
+// Runs replays through the replay servers over loopback and prints how closely what the servers send
+// matches the replay files, without starting the server. Replays that are being authored can be
+// checked from a tests directory of their own before they are published.
+// cfg: the configurations with the tests directory
+// testsDir: the directory of the replays to check; empty to use the tests directory of the config
+// replayNames: the replays to check; empty to check every replay in the tests directory
+// tolerance: how far off schedule the 95th percentile of packets can arrive for a replay to pass
+// reportFile: the file the reports are written to as JSON; empty to only print them
+// Returns true if every replay passed, or any errors
+func CheckFidelity(cfg config.Config, testsDir string, replayNames []string, tolerance time.Duration, reportFile string) (bool, error) {
+    if testsDir == "" {
+        testsDir = cfg.TestsDir
+    }
+    // replays with sensitive content can still be checked, since they aren't served to clients
+    replays, err := testdata.NewRegistry(testsDir, nil)
+    if err != nil {
+        return false, err
+    }
+    if len(replayNames) == 0 {
+        replayNames = replays.Names()
+    }
+    replayCache := testdata.NewCache(replays, 0, testdata.LoadBudget{})
+    network.SetUDPReplayTimeout(time.Duration(cfg.UDPReplayTimeoutSeconds) * time.Second)
+    network.SetMaxUDPReplayTimeout(time.Duration(cfg.MaxUDPReplayTimeoutSeconds) * time.Second)
+    network.SetUDPSendOptions(udpSendOptions(cfg))
+
+    passed := true
+    var reports []network.FidelityReport
+    for _, replayName := range replayNames {
+        report, err := network.CheckFidelity(replayCache, replayName, tolerance)
+        if err != nil {
+            return false, fmt.Errorf("Unable to check %s: %v", replayName, err)
+        }
+        reports = append(reports, report)
+        result := "ok"
+        if !report.Passed {
+            result = "FAILED"
+            passed = false
+        }
+        fmt.Printf("%s: %s; %d/%d packets missing, %d unexpected, %d out of order, content mismatch %t, timing error mean %.1f ms, p95 %.1f ms, max %.1f ms, CPU %.0f ms (%.0f ms/Gbit)\n",
+            replayName, result, report.MissingPackets, report.ExpectedPackets, report.UnexpectedPackets,
+            report.OutOfOrderPackets, report.ContentMismatch, report.TimingErrorMeanMs,
+            report.TimingErrorP95Ms, report.TimingErrorMaxMs, report.CPUMs, report.CPUMsPerGbit)
+        for _, replayError := range report.ReplayErrors {
+            fmt.Println("    ", replayError)
+        }
+    }
+
+    if reportFile != "" {
+        jsonOutput, err := json.MarshalIndent(reports, "", "  ")
+        if err != nil {
+            return false, err
+        }
+        err = os.WriteFile(reportFile, jsonOutput, 0644)
+        if err != nil {
+            return false, err
+        }
+    }
+    return passed, nil
+}
+
+// Fetches new replays and test ports, checks them, and installs them in place of the replays in the
+// tests directory and the port numbers file. Replays are checked the same way as when they are
+// served, including the replay lint if it is on, so that a bad update never replaces working replays.
+// A running server reloads the replays on its own, and listens on new ports once it is reloaded.
+// cfg: the configurations with the tests directory, port numbers file, and update source
+// source: where to fetch from; empty to use the source of the config file
+// Returns any errors
+func Update(cfg config.Config, source string) error {
+    if source == "" {
+        source = cfg.UpdateSource
+    }
+    if source == "" {
+        return fmt.Errorf("No update source; set source in the [update] section of the config file or pass -source")
+    }
+
+    // staged next to the tests directory so that the new replays can be renamed into place
+    testsDir := filepath.Clean(cfg.TestsDir)
+    stagingDir, err := os.MkdirTemp(filepath.Dir(testsDir), ".update-")
+    if err != nil {
+        return err
+    }
+    // kept if the previous replays are left in it because they couldn't be moved back
+    keepStagingDir := false
+    defer func() {
+        if !keepStagingDir {
+            os.RemoveAll(stagingDir)
+        }
+    }()
+
+    fmt.Println("Fetching", source)
+    fetchedDir := filepath.Join(stagingDir, "fetched")
+    sourceRoot, err := update.Fetch(source, fetchedDir)
+    if err != nil {
+        return err
+    }
+
+    var linter *testdata.Linter
+    if cfg.ReplayLintEnabled {
+        linter, err = testdata.NewLinter(cfg.ReplayLintPatterns, cfg.ReplayLintAllowUnscrubbed)
+        if err != nil {
+            return err
+        }
+    }
+    newReplaysDir := filepath.Join(sourceRoot, update.ReplaysDirName)
+    replayNames, err := testdata.ValidateDir(newReplaysDir, linter)
+    if err != nil {
+        return err
+    }
+    // without a port numbers file, the test ports come from the replays alone
+    portsChanged := false
+    newPortNumbersFile := filepath.Join(sourceRoot, update.PortNumbersFileName)
+    if cfg.PortNumbersFile != "" {
+        newPortNumbers, err := getTestPorts(newPortNumbersFile)
+        if err != nil {
+            return err
+        }
+        oldPortNumbers, err := getTestPorts(cfg.PortNumbersFile)
+        portsChanged = err != nil || !slices.Equal(oldPortNumbers.TCPPorts, newPortNumbers.TCPPorts) || !slices.Equal(oldPortNumbers.UDPPorts, newPortNumbers.UDPPorts)
+    }
+
+    // the replays are swapped first since the swap is the step most likely to fail; if the port
+    // numbers file can't be replaced after it, the previous replays are swapped back so that the
+    // replays and the ports always come from the same update
+    previousDir := filepath.Join(stagingDir, "previous")
+    err = update.SwapDir(newReplaysDir, testsDir, previousDir)
+    if err != nil {
+        _, statErr := os.Stat(testsDir)
+        keepStagingDir = statErr != nil
+        return err
+    }
+    if cfg.PortNumbersFile != "" {
+        err = update.ReplaceFile(newPortNumbersFile, cfg.PortNumbersFile)
+        if err != nil {
+            restoreErr := update.SwapDir(previousDir, testsDir, filepath.Join(stagingDir, "failed"))
+            if restoreErr != nil {
+                keepStagingDir = true
+                return fmt.Errorf("Unable to replace %s: %v; unable to restore the previous replays, which are at %s: %v", cfg.PortNumbersFile, err, previousDir, restoreErr)
+            }
+            return err
+        }
+    }
+
+    fmt.Printf("Installed %d replays in %s: %s\n", len(replayNames), testsDir, strings.Join(replayNames, ", "))
+    if portsChanged {
+        fmt.Printf("The test ports in %s changed; reload the server (SIGHUP or POST /reload) to listen on them\n", cfg.PortNumbersFile)
+    }
+    return nil
+}
+
+// Switches the process to an unprivileged user and group once the ports are bound. Files written
+// after this point, such as results and logs, are written as that user, so the directories they are
+// written to must be writable by it.
+// userName: the user to run as; empty to keep the current user
+// groupName: the group to run as; empty to use the primary group of the user
+// Returns any errors
+func dropPrivileges(userName string, groupName string) error {
+    if userName == "" {
+        if groupName != "" {
+            return fmt.Errorf("run_as_group is set but run_as_user is not.")
+        }
+        if os.Geteuid() == 0 {
+            slog.Warn("The server is running as root. Set run_as_user to drop privileges once the ports are bound.")
+        }
+        return nil
+    }
+
+    runAsUser, err := user.Lookup(userName)
+    if err != nil {
+        return err
+    }
+    gidString := runAsUser.Gid
+    if groupName != "" {
+        runAsGroup, err := user.LookupGroup(groupName)
+        if err != nil {
+            return err
+        }
+        gidString = runAsGroup.Gid
+    }
+    uid, err := strconv.Atoi(runAsUser.Uid)
+    if err != nil {
+        return err
+    }
+    gid, err := strconv.Atoi(gidString)
+    if err != nil {
+        return err
+    }
+
+    err = setIDs(uid, gid)
+    if err != nil {
+        return err
+    }
+    slog.Info("Dropped privileges", "user", userName, "uid", uid, "gid", gid)
+    return nil
 }
 
 // Get port numbers for all replays.
-// portFile: path to a file containing the ports needed to be opened to run all tests
+// portFile: path to a file containing the ports needed to be opened to run all tests; empty if there
+//     is none
 // Returns TCP and UDP port numbers or an error
 func getTestPorts(portFile string) (TestPortNumbers, error) {
+    if portFile == "" {
+        return TestPortNumbers{}, nil
+    }
     data, err := os.ReadFile(portFile)
     if err != nil {
         return TestPortNumbers{}, err
@@ -140,6 +1151,22 @@ func getTestPorts(portFile string) (TestPortNumbers, error) {
     return testPortNumbers, err
 }
 
+// Adds the ports the replays run on to a list of test ports.
+// portNumbers: the test ports, e.g. from the port numbers file
+// replays: the replays on the server
+// Returns the TCP and UDP ports of both, each sorted
+func addReplayPorts(portNumbers TestPortNumbers, replays *testdata.Registry) TestPortNumbers {
+    replayTCPPorts, replayUDPPorts := replays.Ports()
+    tcpPorts := append(slices.Clone(portNumbers.TCPPorts), replayTCPPorts...)
+    udpPorts := append(slices.Clone(portNumbers.UDPPorts), replayUDPPorts...)
+    slices.Sort(tcpPorts)
+    slices.Sort(udpPorts)
+    return TestPortNumbers{
+        TCPPorts: slices.Compact(tcpPorts),
+        UDPPorts: slices.Compact(udpPorts),
+    }
+}
+
 // Uses Root CA cert to generate a server cert and writes the server cert and key to file.
 // hostInfoFilename: file path to JSON file containing the DNS names and IPs of the server
 // caCertFilename: file path to a x509 root CA certificate in PEM format
@@ -282,7 +1309,7 @@ func getHostInfo(hostInfoFilename string) ([]string, []net.IP, error) {
     for _, ip := range hostInfo.IPs {
         parsedIP := net.ParseIP(ip)
         if parsedIP == nil {
-            return nil, nil, fmt.Errorf("Cannot parse invalid IP:", ip)
+            return nil, nil, fmt.Errorf("Cannot parse invalid IP: %s", ip)
         }
         ips = append(ips, parsedIP)
     }
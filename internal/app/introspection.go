@@ -0,0 +1,380 @@
+// Endpoints of the admin API that let operators see inside the running server without attaching a
+// debugger, evict clients that are stuck holding a replay, and capture the packets of one client.
+//
+// Endpoints:
+//     GET  /clients            read_only  clients running a replay, with anonymized IPs
+//     POST /clients/evict?id=  operator   removes a client, so that its IP can run a replay again
+//     GET  /replays            read_only  replays on the server and the ones loaded into memory, with
+//                                         any of their ports that are disabled
+//     GET  /ports              read_only  test ports and whether they are disabled
+//     POST /ports/disable?port= operator  stops new replays on a port, e.g. tcp/80, with an optional
+//                                         reason; replays that already started finish
+//     POST /ports/enable?port= operator   lets new replays run on a port again
+//     GET  /resources          read_only  resource readings checked before a test is admitted
+//     GET  /captures           read_only  running and recent packet captures of clients
+//     POST /captures/start     operator   captures the packets of the client given by id, test_id,
+//                                         or ip (anonymized), for seconds if given
+//     POST /captures/stop?id=  operator   stops a packet capture
+//     GET  /tests?user_id=     read_only  every test of a user in the results database
+// The capture endpoints are only served if captures are turned on, and the tests endpoint if results
+// are stored in a database.
+package app
+
+import (
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "wehe-server/internal/admin"
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/network"
+    "wehe-server/internal/resultsdb"
+    "wehe-server/internal/testdata"
+)
+
+const (
+    evictAction = "client_evict" // action of the audit log entries of evictions
+    captureStartAction = "capture_start" // action of the audit log entries of started captures
+    captureStopAction = "capture_stop" // action of the audit log entries of stopped captures
+    portDisableAction = "port_disable" // action of the audit log entries of disabled ports
+    portEnableAction = "port_enable" // action of the audit log entries of enabled ports
+)
+
+// A replay on the server, as shown to operators.
+type replayListing struct {
+    Name string `json:"name"` // name of the replay
+    IsTCP bool `json:"is_tcp"` // true if the replay is TCP, false if it is UDP
+    Loaded bool `json:"loaded"` // true if the packets of the replay are in memory
+    DisabledPorts []string `json:"disabled_ports,omitempty"` // ports of the replay that are disabled, e.g. tcp/80; new replays of it are denied while any are
+    Provenance *testdata.Provenance `json:"provenance,omitempty"` // where the traffic of the replay came from; omitted if the replay file doesn't say
+}
+
+// The replays on the server, as shown to operators.
+type replaysResponse struct {
+    Replays []replayListing `json:"replays"` // every replay that is served, sorted by name
+    CachedReplays int `json:"cached_replays"` // replays in memory, including any dropped from the server since they were loaded
+    StoredPayloadBytes int64 `json:"stored_payload_bytes"` // payload bytes kept in memory
+    TotalPayloadBytes int64 `json:"total_payload_bytes"` // payload bytes the loaded replays would take up without sharing payloads
+}
+
+// Serves the introspection endpoints of the admin API.
+type introspector struct {
+    connectedClients *clienthandler.ConnectedClients // the clients running a replay
+    replays *testdata.Registry // the replays on the server
+    replayCache *testdata.Cache // the replays loaded into memory
+    servers *replayServers // the replay servers, whose ports can be disabled
+    captures *network.DebugCaptures // captures the packets of clients; nil if captures are off
+    authorizer *admin.Authorizer // records evictions and captures in the audit log
+    resultsStore *resultsdb.Store // the results database; nil if results are only written to files
+}
+
+// Adds the introspection endpoints to the admin API.
+// adminServer: the admin API
+func (introspector *introspector) register(adminServer *admin.Server) {
+    adminServer.Handle("/clients", admin.ReadOnly, http.HandlerFunc(introspector.serveClients))
+    adminServer.Handle("/clients/evict", admin.Operator, http.HandlerFunc(introspector.serveEvict))
+    adminServer.Handle("/replays", admin.ReadOnly, http.HandlerFunc(introspector.serveReplays))
+    adminServer.Handle("/resources", admin.ReadOnly, http.HandlerFunc(introspector.serveResources))
+    adminServer.Handle("/ports", admin.ReadOnly, http.HandlerFunc(introspector.servePorts))
+    adminServer.Handle("/ports/disable", admin.Operator, http.HandlerFunc(introspector.servePortDisable))
+    adminServer.Handle("/ports/enable", admin.Operator, http.HandlerFunc(introspector.servePortEnable))
+    if introspector.captures != nil {
+        adminServer.Handle("/captures", admin.ReadOnly, http.HandlerFunc(introspector.serveCaptures))
+        adminServer.Handle("/captures/start", admin.Operator, http.HandlerFunc(introspector.serveCaptureStart))
+        adminServer.Handle("/captures/stop", admin.Operator, http.HandlerFunc(introspector.serveCaptureStop))
+    }
+    if introspector.resultsStore != nil {
+        adminServer.Handle("/tests", admin.ReadOnly, http.HandlerFunc(introspector.serveTests))
+    }
+}
+
+// Responds with the clients running a replay.
+// w: the response
+// r: the request
+func (introspector *introspector) serveClients(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    writeJSON(w, introspector.connectedClients.List())
+}
+
+// Evicts the client with the ID in the id query parameter, and responds with the client that was
+// evicted.
+// w: the response
+// r: the request
+func (introspector *introspector) serveEvict(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+    if err != nil {
+        http.Error(w, "id must be the ID of a client from /clients", http.StatusBadRequest)
+        return
+    }
+    client, evicted := introspector.connectedClients.Evict(id)
+    if !evicted {
+        http.Error(w, fmt.Sprintf("No client with ID %d is running a replay", id), http.StatusNotFound)
+        return
+    }
+    slog.Warn("Evicted client", "client_id", client.ID, "anon_client_ip", client.IP, "replay", client.ReplayName, "elapsed_seconds", client.ElapsedSeconds)
+    introspector.authorizer.AuditChange(r.URL.Path, evictAction, []string{fmt.Sprintf("client %d (%s) running %s", client.ID, client.IP, client.ReplayName)}, nil)
+    writeJSON(w, client)
+}
+
+// Responds with the replays on the server and how many of them are in memory.
+// w: the response
+// r: the request
+func (introspector *introspector) serveReplays(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    loaded := make(map[string]bool)
+    for _, name := range introspector.replayCache.Loaded() {
+        loaded[name] = true
+    }
+    stats := introspector.replayCache.Stats()
+    response := replaysResponse{
+        Replays: []replayListing{},
+        CachedReplays: stats.Replays,
+        StoredPayloadBytes: stats.StoredPayloadBytes,
+        TotalPayloadBytes: stats.TotalPayloadBytes,
+    }
+    for _, metadata := range introspector.replays.All() {
+        response.Replays = append(response.Replays, replayListing{
+            Name: metadata.Name,
+            IsTCP: metadata.IsTCP,
+            Loaded: loaded[metadata.Name],
+            DisabledPorts: clienthandler.ReplayDisabledPorts(metadata.Name),
+            Provenance: metadata.Provenance,
+        })
+    }
+    writeJSON(w, response)
+}
+
+// Responds with the current resource readings of the server and whether tests are admitted.
+// w: the response
+// r: the request
+func (introspector *introspector) serveResources(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    writeJSON(w, clienthandler.CurrentResources())
+}
+
+// Responds with the test ports and whether they are disabled.
+// w: the response
+// r: the request
+func (introspector *introspector) servePorts(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    writeJSON(w, introspector.servers.portStatuses())
+}
+
+// Disables the test port in the port query parameter, with the reason in the reason query parameter,
+// and responds with the state of the port.
+// w: the response
+// r: the request
+func (introspector *introspector) servePortDisable(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    protocol, port, ok := introspector.testPort(w, r)
+    if !ok {
+        return
+    }
+    status, changed := clienthandler.DisablePort(protocol, port, r.URL.Query().Get("reason"))
+    if changed {
+        slog.Warn("Disabled test port", "port", status.Port, "reason", status.Reason)
+        introspector.authorizer.AuditChange(r.URL.Path, portDisableAction, []string{status.Port}, nil)
+    }
+    writeJSON(w, status)
+}
+
+// Enables the test port in the port query parameter, and responds with the state of the port.
+// w: the response
+// r: the request
+func (introspector *introspector) servePortEnable(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    protocol, port, ok := introspector.testPort(w, r)
+    if !ok {
+        return
+    }
+    status, changed := clienthandler.EnablePort(protocol, port)
+    if changed {
+        slog.Info("Enabled test port", "port", status.Port)
+        introspector.authorizer.AuditChange(r.URL.Path, portEnableAction, []string{status.Port}, nil)
+    }
+    writeJSON(w, status)
+}
+
+// Gets the test port in the port query parameter, e.g. tcp/80. An error is sent if the parameter
+// isn't a port that a replay server listens on.
+// w: the response
+// r: the request
+// Returns the protocol and port number, and false if the parameter isn't a test port
+func (introspector *introspector) testPort(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+    protocol, portStr, found := strings.Cut(r.URL.Query().Get("port"), "/")
+    port, err := strconv.Atoi(portStr)
+    if !found || (protocol != "tcp" && protocol != "udp") || err != nil {
+        http.Error(w, "port must be a test port from /ports, e.g. tcp/80", http.StatusBadRequest)
+        return "", 0, false
+    }
+    if !introspector.servers.listensOn(protocol, port) {
+        http.Error(w, fmt.Sprintf("%s/%d is not a test port", protocol, port), http.StatusNotFound)
+        return "", 0, false
+    }
+    return protocol, port, true
+}
+
+// Responds with the running packet captures and the most recent ones that stopped.
+// w: the response
+// r: the request
+func (introspector *introspector) serveCaptures(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    writeJSON(w, introspector.captures.List())
+}
+
+// Starts capturing the packets of the client given by the id, test_id, or ip query parameter, for
+// the number of seconds in the seconds query parameter or the longest a capture can run. The client
+// must be the only one that matches. Responds with the capture that was started.
+// w: the response
+// r: the request
+func (introspector *introspector) serveCaptureStart(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    query := r.URL.Query()
+    var duration time.Duration
+    if query.Has("seconds") {
+        seconds, err := strconv.Atoi(query.Get("seconds"))
+        if err != nil || seconds <= 0 {
+            http.Error(w, "seconds must be a positive number of seconds", http.StatusBadRequest)
+            return
+        }
+        duration = time.Duration(seconds) * time.Second
+    }
+
+    var match func(clienthandler.ConnectedClientInfo) bool
+    switch {
+    case query.Has("id"):
+        id, err := strconv.ParseUint(query.Get("id"), 10, 64)
+        if err != nil {
+            http.Error(w, "id must be the ID of a client from /clients", http.StatusBadRequest)
+            return
+        }
+        match = func(client clienthandler.ConnectedClientInfo) bool {
+            return client.ID == id
+        }
+    case query.Has("test_id"):
+        match = func(client clienthandler.ConnectedClientInfo) bool {
+            return client.TestID == query.Get("test_id")
+        }
+    case query.Has("ip"):
+        match = func(client clienthandler.ConnectedClientInfo) bool {
+            return client.IP == query.Get("ip")
+        }
+    default:
+        http.Error(w, "One of id, test_id, or ip is needed to pick the client to capture", http.StatusBadRequest)
+        return
+    }
+    ips, clients := introspector.connectedClients.Find(match)
+    if len(clients) == 0 {
+        http.Error(w, "No client that is running a replay matches", http.StatusNotFound)
+        return
+    }
+    if len(clients) > 1 {
+        http.Error(w, fmt.Sprintf("%d clients match; pick one by id", len(clients)), http.StatusConflict)
+        return
+    }
+
+    capture, err := introspector.captures.Start(ips[0], clients[0], duration)
+    change := fmt.Sprintf("client %d (%s)", clients[0].ID, clients[0].IP)
+    if err == nil {
+        change += fmt.Sprintf(" until %s as capture %d", capture.Until.Format(time.RFC3339), capture.ID)
+    }
+    introspector.authorizer.AuditChange(r.URL.Path, captureStartAction, []string{change}, err)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusConflict)
+        return
+    }
+    writeJSON(w, capture)
+}
+
+// Stops the packet capture with the ID in the id query parameter, and responds with the capture.
+// w: the response
+// r: the request
+func (introspector *introspector) serveCaptureStop(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+    if err != nil {
+        http.Error(w, "id must be the ID of a capture from /captures", http.StatusBadRequest)
+        return
+    }
+    capture, err := introspector.captures.Stop(id)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+    introspector.authorizer.AuditChange(r.URL.Path, captureStopAction, []string{fmt.Sprintf("capture %d of client %d (%s)", capture.ID, capture.ClientID, capture.IP)}, nil)
+    writeJSON(w, capture)
+}
+
+// Responds with every test of the user in the user_id query parameter, oldest first.
+// w: the response
+// r: the request
+func (introspector *introspector) serveTests(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    userID := r.URL.Query().Get("user_id")
+    if userID == "" {
+        http.Error(w, "user_id must be given", http.StatusBadRequest)
+        return
+    }
+    tests, err := introspector.resultsStore.UserTests(userID)
+    if err != nil {
+        slog.Error("Unable to look up tests in the results database", "error", err)
+        http.Error(w, "Unable to look up tests", http.StatusInternalServerError)
+        return
+    }
+    if tests == nil {
+        tests = []clienthandler.StoredTest{}
+    }
+    writeJSON(w, tests)
+}
+
+// Responds with a value encoded as JSON.
+// w: the response
+// value: the value to encode
+func writeJSON(w http.ResponseWriter, value interface{}) {
+    jsonResponse, err := json.Marshal(value)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    w.Write(jsonResponse)
+}
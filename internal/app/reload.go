@@ -0,0 +1,253 @@
+// Rereads the config file while the server runs, on SIGHUP or a call to the admin API, and puts the
+// settings that are safe to change into effect without closing the listeners or the tests that are
+// running. The replays and test ports are reloaded at the same time. Every other setting only takes
+// effect when the server restarts.
+package app
+
+import (
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+    "reflect"
+    "slices"
+    "sync"
+    "time"
+
+    "wehe-server/internal/admin"
+    "wehe-server/internal/analysis"
+    "wehe-server/internal/buildinfo"
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/config"
+    "wehe-server/internal/logging"
+    "wehe-server/internal/network"
+)
+
+const (
+    reloadAction = "config_reload" // action of the audit log entries of reloads
+)
+
+// A setting that can be changed while the server runs.
+type reloadableSetting struct {
+    name string // name of the setting in the config file, e.g. logging.level
+    fields []string // the fields of config.Config the setting is read into
+    apply func(cfg config.Config) error // puts the setting of cfg into effect
+}
+
+// Rereads the config file and applies the settings that changed.
+type reloader struct {
+    mutex sync.Mutex // prevents reloads from running at the same time
+    cfg config.Config // the config in effect; settings that need a restart keep the values the server started with
+    settings []reloadableSetting // the settings that can be changed while the server runs
+    authorizer *admin.Authorizer // records reloads in the admin audit log; nil if there is no admin API
+    replayServers *replayServers // reloads the replays and opens new test ports; nil until the ports are bound
+}
+
+// Creates a new reloader.
+// cfg: the config the server started with
+// bandwidthLedger: the ledger whose monthly cap can be changed
+// Returns the reloader
+func newReloader(cfg config.Config, bandwidthLedger *clienthandler.BandwidthLedger) *reloader {
+    settings := []reloadableSetting{
+        {
+            name: "logging.level",
+            fields: []string{"LogLevel"},
+            apply: func(cfg config.Config) error {
+                return logging.SetLevel(cfg.LogLevel)
+            },
+        },
+        {
+            name: "resources",
+            fields: []string{"MaxCPUPercent", "MaxMemoryPercent", "MaxDiskPercent", "MaxUploadMbps"},
+            apply: func(cfg config.Config) error {
+                clienthandler.SetResourceThresholds(resourceThresholds(cfg))
+                return nil
+            },
+        },
+        {
+            name: "connection_rate_limit",
+            fields: []string{"ConnectionRatePerSecond", "ConnectionRateBurst", "ConnectionRateBanAfter", "ConnectionRateBanSeconds"},
+            apply: func(cfg config.Config) error {
+                network.SetConnectionRateLimit(connectionRateLimit(cfg))
+                return nil
+            },
+        },
+        {
+            name: "bandwidth.monthly_user_cap_mb",
+            fields: []string{"BandwidthMonthlyUserCapMB"},
+            apply: func(cfg config.Config) error {
+                return bandwidthLedger.SetMonthlyCap(int64(cfg.BandwidthMonthlyUserCapMB) * 1024 * 1024)
+            },
+        },
+        {
+            name: "analysis.policy",
+            fields: []string{"DecisionPolicy", "DecisionPolicies"},
+            apply: func(cfg config.Config) error {
+                decisionPolicy, err := getDecisionPolicy(cfg, cfg.DecisionPolicy)
+                if err != nil {
+                    return err
+                }
+                clienthandler.SetDecisionPolicy(decisionPolicy)
+                return nil
+            },
+        },
+        {
+            name: "analysis.ks_test",
+            fields: []string{"KSTest"},
+            apply: func(cfg config.Config) error {
+                analysis.UseScipy(cfg.KSTest == "scipy")
+                return nil
+            },
+        },
+    }
+    return &reloader{
+        cfg: cfg,
+        settings: settings,
+    }
+}
+
+// Gets the resource thresholds of a config.
+// cfg: the config
+// Returns the thresholds
+func resourceThresholds(cfg config.Config) clienthandler.ResourceThresholds {
+    return clienthandler.ResourceThresholds{
+        CPUPercent: cfg.MaxCPUPercent,
+        MemoryPercent: cfg.MaxMemoryPercent,
+        DiskPercent: cfg.MaxDiskPercent,
+        UploadMbps: cfg.MaxUploadMbps,
+    }
+}
+
+// Gets the connection rate limit of the replay ports of a config.
+// cfg: the config
+// Returns the rate limit
+func connectionRateLimit(cfg config.Config) network.ConnectionRateLimit {
+    return network.ConnectionRateLimit{
+        PerSecond: cfg.ConnectionRatePerSecond,
+        Burst: cfg.ConnectionRateBurst,
+        BanAfter: cfg.ConnectionRateBanAfter,
+        BanDuration: time.Duration(cfg.ConnectionRateBanSeconds) * time.Second,
+    }
+}
+
+// Gets the values of fields of a config.
+// cfg: the config
+// fields: the names of the fields
+// Returns the values, in the order of fields
+func fieldValues(cfg config.Config, fields []string) []interface{} {
+    value := reflect.ValueOf(cfg)
+    values := make([]interface{}, len(fields))
+    for i, field := range fields {
+        values[i] = value.FieldByName(field).Interface()
+    }
+    return values
+}
+
+// Rereads the config file and puts the settings that changed into effect. The new config is
+// validated before anything is applied, so a config file with a mistake in it changes nothing.
+// Settings that changed but need a restart are listed but not applied.
+// source: what triggered the reload, e.g. SIGHUP, for the log and the audit log
+// Returns what changed, one item per setting, or any errors
+func (reloader *reloader) reload(source string) ([]string, error) {
+    reloader.mutex.Lock()
+    defer reloader.mutex.Unlock()
+
+    changes, err := reloader.apply()
+    if err != nil {
+        slog.Error("Unable to reload config", "source", source, "file", reloader.cfg.Path, "changes", changes, "error", err)
+    } else {
+        slog.Info("Reloaded config", "source", source, "file", reloader.cfg.Path, "changes", changes)
+    }
+    if reloader.authorizer != nil {
+        reloader.authorizer.AuditChange(source, reloadAction, changes, err)
+    }
+    return changes, err
+}
+
+// Rereads the config file and puts the settings that changed into effect, then reloads the replays
+// and test ports. The mutex must be held.
+// Returns what changed, including any settings that were applied before an error, or any errors
+func (reloader *reloader) apply() ([]string, error) {
+    path := reloader.cfg.Path
+    newCfg, err := config.New(&path)
+    if err != nil {
+        return nil, err
+    }
+    _, err = getDecisionPolicy(newCfg, newCfg.DecisionPolicy)
+    if err != nil {
+        return nil, err
+    }
+
+    var changes []string
+    current := reflect.ValueOf(&reloader.cfg).Elem()
+    reloadableFields := []string{"Path"}
+    for _, setting := range reloader.settings {
+        reloadableFields = append(reloadableFields, setting.fields...)
+        oldValues := fieldValues(reloader.cfg, setting.fields)
+        newValues := fieldValues(newCfg, setting.fields)
+        if reflect.DeepEqual(oldValues, newValues) {
+            continue
+        }
+        err = setting.apply(newCfg)
+        if err != nil {
+            return changes, fmt.Errorf("Unable to apply %s: %v", setting.name, err)
+        }
+        for _, field := range setting.fields {
+            current.FieldByName(field).Set(reflect.ValueOf(newCfg).FieldByName(field))
+        }
+        changes = append(changes, fmt.Sprintf("%s: %v -> %v", setting.name, oldValues, newValues))
+        buildinfo.SetFeatures(features(reloader.cfg, reloader.cfg.DecisionPolicy))
+    }
+
+    // the rest of the config is left as the server started with it
+    configType := current.Type()
+    for i := 0; i < configType.NumField(); i++ {
+        field := configType.Field(i).Name
+        if slices.Contains(reloadableFields, field) {
+            continue
+        }
+        if !reflect.DeepEqual(current.Field(i).Interface(), reflect.ValueOf(newCfg).Field(i).Interface()) {
+            changes = append(changes, fmt.Sprintf("%s changed but only takes effect after a restart", field))
+        }
+    }
+
+    if reloader.replayServers != nil {
+        replayChanges, err := reloader.replayServers.reload()
+        changes = append(changes, replayChanges...)
+        if err != nil {
+            return changes, err
+        }
+    }
+    return changes, nil
+}
+
+// Reloads the config every time the server gets a signal. This function should be run in a new
+// thread, as it never returns.
+// signals: the channel the reload signals, i.e. SIGHUP, are delivered on
+func (reloader *reloader) reloadOnSignal(signals <-chan os.Signal) {
+    for sig := range signals {
+        reloader.reload(sig.String())
+    }
+}
+
+// Handles calls to the reload endpoint of the admin API, which reload the config and respond with
+// what changed as a JSON object: {"changes": [...]}, plus "error" if the reload failed.
+// w: the response
+// r: the request
+func (reloader *reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+    changes, err := reloader.reload(r.URL.Path)
+    response := map[string]interface{}{
+        "changes": changes,
+    }
+    w.Header().Set("Content-Type", "application/json")
+    if err != nil {
+        response["error"] = err.Error()
+        w.WriteHeader(http.StatusBadRequest)
+    }
+    json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,368 @@
+// The replay servers, one for each test port. The test ports are the ports the replays run on and the
+// ports in the port numbers file. When the replays change or the config is reloaded, a server is
+// started on every port that was added, so that replays needing new ports can be deployed without a
+// restart. Ports that were removed are no longer offered to old clients, and their servers are closed
+// once every client that was granted a replay before the port was removed is done, since running
+// tests and clients that looked up the old ports may still use them. Once the server runs as
+// run_as_user, privileged ports can't be added without a restart.
+package app
+
+import (
+    "errors"
+    "fmt"
+    "log/slog"
+    "net"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/network"
+    "wehe-server/internal/testdata"
+)
+
+const (
+    removedPortCheckInterval = time.Minute // how often the servers of removed test ports are checked for whether they can be closed
+    lowestUnprivilegedPort = 1024 // ports below this can only be bound by root
+)
+
+// The TCP and UDP replay servers and the ports they listen on.
+type replayServers struct {
+    portNumbersFile string // the file listing test ports besides the ports of the replays; empty if there is none
+    filePorts TestPortNumbers // the ports in the port numbers file when it was last read
+    replays *testdata.Registry // the replays on the server
+    sideChannel network.SideChannel // told which ports are open, for the server mapping of old clients
+    newTCPServer func(port int) network.TCPServer // creates the server of a TCP port
+    newUDPServer func(port int) network.UDPServer // creates the server of a UDP port
+    tcpServers []network.TCPServer // the TCP servers, in the order they were added
+    tcpListeners []net.Listener // the listener of each TCP server
+    udpServers []network.UDPServer // the UDP servers, in the order they were added
+    udpConns []net.PacketConn // the socket of each UDP server
+    removedPorts map[string]time.Time // ports that are no longer test ports but still listen, e.g. tcp/8080; value is when they were removed
+    runAsUser string // the user the server switched to, which can't bind privileged ports; empty until it switches
+    errChan chan<- error // where the servers report errors; nil until the servers are started
+    mutex sync.Mutex // protects the servers, filePorts, removedPorts, runAsUser, and errChan
+}
+
+// Records that the server switched to run_as_user, after which privileged ports can't be bound.
+// userName: the user the server runs as
+func (servers *replayServers) setRunAsUser(userName string) {
+    servers.mutex.Lock()
+    defer servers.mutex.Unlock()
+    servers.runAsUser = userName
+}
+
+// Binds the test ports that aren't bound yet. Every port is tried, even if others fail. Servers
+// added after start are started right away. A removed port that is a test port again is no longer
+// closed.
+// portNumbers: the test ports
+// Returns the ports that were bound, e.g. "tcp/8080", and the errors of the ports that couldn't be
+//     bound, joined
+func (servers *replayServers) listen(portNumbers TestPortNumbers) ([]string, error) {
+    servers.mutex.Lock()
+    defer servers.mutex.Unlock()
+
+    var added []string
+    var listenErrs []error
+    for _, port := range portNumbers.TCPPorts {
+        delete(servers.removedPorts, clienthandler.PortName("tcp", port))
+        if slices.ContainsFunc(servers.tcpServers, func(server network.TCPServer) bool { return server.Port == port }) {
+            continue
+        }
+        err := servers.checkPrivileged(port)
+        if err != nil {
+            listenErrs = append(listenErrs, fmt.Errorf("Unable to listen on TCP port %d: %w", port, err))
+            continue
+        }
+        tcpServer := servers.newTCPServer(port)
+        listener, err := tcpServer.Listen()
+        if err != nil {
+            listenErrs = append(listenErrs, fmt.Errorf("Unable to listen on TCP port %d: %v", port, err))
+            continue
+        }
+        servers.tcpServers = append(servers.tcpServers, tcpServer)
+        servers.tcpListeners = append(servers.tcpListeners, listener)
+        if servers.errChan != nil {
+            go tcpServer.StartServer(listener, servers.errChan)
+        }
+        added = append(added, fmt.Sprintf("tcp/%d", port))
+    }
+
+    for _, port := range portNumbers.UDPPorts {
+        delete(servers.removedPorts, clienthandler.PortName("udp", port))
+        if slices.ContainsFunc(servers.udpServers, func(server network.UDPServer) bool { return server.Port == port }) {
+            continue
+        }
+        err := servers.checkPrivileged(port)
+        if err != nil {
+            listenErrs = append(listenErrs, fmt.Errorf("Unable to listen on UDP port %d: %w", port, err))
+            continue
+        }
+        udpServer := servers.newUDPServer(port)
+        conn, err := udpServer.Listen()
+        if err != nil {
+            listenErrs = append(listenErrs, fmt.Errorf("Unable to listen on UDP port %d: %v", port, err))
+            continue
+        }
+        servers.udpServers = append(servers.udpServers, udpServer)
+        servers.udpConns = append(servers.udpConns, conn)
+        if servers.errChan != nil {
+            go udpServer.StartServer(conn, servers.errChan)
+            go udpServer.ReapSessions()
+        }
+        added = append(added, fmt.Sprintf("udp/%d", port))
+    }
+    return added, errors.Join(listenErrs...)
+}
+
+// Checks if a port can be bound by the user the server runs as. The mutex must be held.
+// port: the port number
+// Returns an error if the port is privileged and the server no longer runs as root
+func (servers *replayServers) checkPrivileged(port int) error {
+    if servers.runAsUser == "" || port >= lowestUnprivilegedPort {
+        return nil
+    }
+    return fmt.Errorf("ports below %d can't be bound once the server runs as run_as_user %s; restart the server to add the port", lowestUnprivilegedPort, servers.runAsUser)
+}
+
+// Closes the servers of ports that are no longer test ports, once no client that was granted its
+// replay before the port was removed is still running it.
+// portNumbers: the test ports
+// now: the current time, recorded as when a port was removed the first time it is seen removed
+// Returns the ports that were closed, e.g. "tcp/8080"
+func (servers *replayServers) closeRemovedPorts(portNumbers TestPortNumbers, now time.Time) []string {
+    servers.mutex.Lock()
+    defer servers.mutex.Unlock()
+    if servers.removedPorts == nil {
+        servers.removedPorts = make(map[string]time.Time)
+    }
+
+    // whether a removed port can be closed; the port is recorded as removed if it wasn't yet
+    canClose := func(protocol string, port int, testPorts []int) bool {
+        if slices.Contains(testPorts, port) {
+            return false
+        }
+        name := clienthandler.PortName(protocol, port)
+        removedSince, removed := servers.removedPorts[name]
+        if !removed {
+            removedSince = now
+            servers.removedPorts[name] = now
+        }
+        return !servers.sideChannel.ConnectedClients.GrantedBefore(removedSince)
+    }
+
+    var closed []string
+    for i := 0; i < len(servers.tcpServers); i++ {
+        port := servers.tcpServers[i].Port
+        if !canClose("tcp", port, portNumbers.TCPPorts) {
+            continue
+        }
+        err := servers.tcpListeners[i].Close()
+        if err != nil {
+            slog.Warn("Unable to close removed test port", "port", clienthandler.PortName("tcp", port), "error", err)
+        }
+        servers.tcpServers = slices.Delete(servers.tcpServers, i, i + 1)
+        servers.tcpListeners = slices.Delete(servers.tcpListeners, i, i + 1)
+        delete(servers.removedPorts, clienthandler.PortName("tcp", port))
+        closed = append(closed, clienthandler.PortName("tcp", port))
+        i--
+    }
+    for i := 0; i < len(servers.udpServers); i++ {
+        port := servers.udpServers[i].Port
+        if !canClose("udp", port, portNumbers.UDPPorts) {
+            continue
+        }
+        err := servers.udpServers[i].Close(servers.udpConns[i])
+        if err != nil {
+            slog.Warn("Unable to close removed test port", "port", clienthandler.PortName("udp", port), "error", err)
+        }
+        servers.udpServers = slices.Delete(servers.udpServers, i, i + 1)
+        servers.udpConns = slices.Delete(servers.udpConns, i, i + 1)
+        delete(servers.removedPorts, clienthandler.PortName("udp", port))
+        closed = append(closed, clienthandler.PortName("udp", port))
+        i--
+    }
+    return closed
+}
+
+// Gets the test ports that a replay server listens on, which are the ones offered to old clients.
+// portNumbers: the test ports
+// Returns the TCP and UDP test ports that are bound
+func (servers *replayServers) boundPorts(portNumbers TestPortNumbers) ([]int, []int) {
+    servers.mutex.Lock()
+    defer servers.mutex.Unlock()
+    var tcpPorts []int
+    for _, port := range portNumbers.TCPPorts {
+        if slices.ContainsFunc(servers.tcpServers, func(server network.TCPServer) bool { return server.Port == port }) {
+            tcpPorts = append(tcpPorts, port)
+        }
+    }
+    var udpPorts []int
+    for _, port := range portNumbers.UDPPorts {
+        if slices.ContainsFunc(servers.udpServers, func(server network.UDPServer) bool { return server.Port == port }) {
+            udpPorts = append(udpPorts, port)
+        }
+    }
+    return tcpPorts, udpPorts
+}
+
+// Closes the servers of removed test ports once their clients are done. This function should be
+// run in a new thread, as it never returns.
+func (servers *replayServers) reapRemovedPorts() {
+    for range time.Tick(removedPortCheckInterval) {
+        closedPorts := servers.closeRemovedPorts(servers.testPorts(), time.Now())
+        if len(closedPorts) > 0 {
+            slog.Info("Stopped listening on removed test ports", "ports", strings.Join(closedPorts, ", "))
+        }
+    }
+}
+
+// Gets the current test ports: the ports of the replays and those in the port numbers file.
+// Returns the test ports
+func (servers *replayServers) testPorts() TestPortNumbers {
+    servers.mutex.Lock()
+    defer servers.mutex.Unlock()
+    return addReplayPorts(servers.filePorts, servers.replays)
+}
+
+// Starts serving replays on every bound port.
+// errChan: channel used to communicate errors back to the main thread
+func (servers *replayServers) start(errChan chan<- error) {
+    servers.mutex.Lock()
+    defer servers.mutex.Unlock()
+    servers.errChan = errChan
+    for i, tcpServer := range servers.tcpServers {
+        go tcpServer.StartServer(servers.tcpListeners[i], errChan)
+    }
+    for i, udpServer := range servers.udpServers {
+        go udpServer.StartServer(servers.udpConns[i], errChan)
+        go udpServer.ReapSessions()
+    }
+    go servers.reapRemovedPorts()
+}
+
+// Gets the UDP sessions of every UDP server.
+// Returns the sessions
+func (servers *replayServers) udpSessions() []network.UDPSessionInfo {
+    servers.mutex.Lock()
+    defer servers.mutex.Unlock()
+    var sessions []network.UDPSessionInfo
+    for _, udpServer := range servers.udpServers {
+        sessions = append(sessions, udpServer.Sessions()...)
+    }
+    return sessions
+}
+
+// Gets the state of every test port the replay servers listen on.
+// Returns the state of each port, TCP ports first, in the order they were bound
+func (servers *replayServers) portStatuses() []clienthandler.PortStatus {
+    servers.mutex.Lock()
+    defer servers.mutex.Unlock()
+    statuses := make([]clienthandler.PortStatus, 0, len(servers.tcpServers) + len(servers.udpServers))
+    for _, tcpServer := range servers.tcpServers {
+        statuses = append(statuses, clienthandler.GetPortStatus("tcp", tcpServer.Port))
+    }
+    for _, udpServer := range servers.udpServers {
+        statuses = append(statuses, clienthandler.GetPortStatus("udp", udpServer.Port))
+    }
+    return statuses
+}
+
+// Checks if a replay server listens on a test port.
+// protocol: tcp or udp
+// port: the port number
+// Returns true if a replay server listens on the port
+func (servers *replayServers) listensOn(protocol string, port int) bool {
+    servers.mutex.Lock()
+    defer servers.mutex.Unlock()
+    if protocol == "tcp" {
+        return slices.ContainsFunc(servers.tcpServers, func(server network.TCPServer) bool { return server.Port == port })
+    }
+    return slices.ContainsFunc(servers.udpServers, func(server network.UDPServer) bool { return server.Port == port })
+}
+
+// Reads the replays and the port numbers file again and listens on any new ports. The port numbers
+// file is checked before anything changes, and replays that don't load leave the previous ones
+// being served. Once the server has switched to run_as_user, privileged ports can't be added.
+// Removed ports are closed once their clients are done.
+// Returns what changed or any errors
+func (servers *replayServers) reload() ([]string, error) {
+    filePorts, err := getTestPorts(servers.portNumbersFile)
+    if err != nil {
+        return nil, err
+    }
+
+    oldNames := servers.replays.Names()
+    err = servers.replays.Load()
+    if err != nil {
+        return nil, fmt.Errorf("Unable to reload replays: %v", err)
+    }
+    var changes []string
+    newNames := servers.replays.Names()
+    added, removed := nameChanges(oldNames, newNames)
+    if len(added) > 0 {
+        changes = append(changes, "replays added: " + strings.Join(added, ", "))
+    }
+    if len(removed) > 0 {
+        changes = append(changes, "replays removed: " + strings.Join(removed, ", "))
+    }
+
+    servers.mutex.Lock()
+    servers.filePorts = filePorts
+    servers.mutex.Unlock()
+    openedPorts, closedPorts, err := servers.openTestPorts()
+    if len(openedPorts) > 0 {
+        changes = append(changes, "ports opened: " + strings.Join(openedPorts, ", "))
+    }
+    if len(closedPorts) > 0 {
+        changes = append(changes, "ports closed: " + strings.Join(closedPorts, ", "))
+    }
+    return changes, err
+}
+
+// Listens on the ports of replays that were added when the tests directory changed. Run by the
+// replay registry after it reloads the replays.
+func (servers *replayServers) replaysChanged() {
+    openedPorts, closedPorts, err := servers.openTestPorts()
+    if len(openedPorts) > 0 {
+        slog.Info("Listening on the ports of new replays", "ports", strings.Join(openedPorts, ", "))
+    }
+    if len(closedPorts) > 0 {
+        slog.Info("Stopped listening on removed test ports", "ports", strings.Join(closedPorts, ", "))
+    }
+    if err != nil {
+        slog.Error("Unable to listen on the ports of new replays", "error", err)
+    }
+}
+
+// Listens on the test ports that aren't bound yet, closes removed ports whose clients are done, and
+// offers old clients only the current test ports that are bound, even if some couldn't be bound.
+// Returns the ports that were bound and the ports that were closed, e.g. "tcp/8080", and any errors
+func (servers *replayServers) openTestPorts() ([]string, []string, error) {
+    portNumbers := servers.testPorts()
+    openedPorts, err := servers.listen(portNumbers)
+    closedPorts := servers.closeRemovedPorts(portNumbers, time.Now())
+    servers.sideChannel.SetReplayPorts(servers.boundPorts(portNumbers))
+    return openedPorts, closedPorts, err
+}
+
+// Compares two sorted lists of replay names.
+// oldNames: the names before
+// newNames: the names after
+// Returns the names only in newNames and the names only in oldNames
+func nameChanges(oldNames []string, newNames []string) ([]string, []string) {
+    var added []string
+    var removed []string
+    for _, name := range newNames {
+        if !slices.Contains(oldNames, name) {
+            added = append(added, name)
+        }
+    }
+    for _, name := range oldNames {
+        if !slices.Contains(newNames, name) {
+            removed = append(removed, name)
+        }
+    }
+    return added, removed
+}
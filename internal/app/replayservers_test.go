@@ -0,0 +1,138 @@
+// Tests of binding and closing the test ports of the replay servers, which must try every port,
+// refuse privileged ports once the server runs as run_as_user, and close removed ports only once
+// their clients are done.
+package app
+
+import (
+    "net"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/network"
+)
+
+// Finds a TCP port and a UDP port on localhost that nothing listens on.
+// t: the test
+// Returns the TCP port and the UDP port
+func freePorts(t *testing.T) (int, int) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+    conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    return listener.Addr().(*net.TCPAddr).Port, conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Creates replay servers that listen on localhost.
+// t: the test
+// Returns the replay servers, whose ports are closed when the test ends, and the number of servers
+//     created so far
+func newTestReplayServers(t *testing.T) (*replayServers, *int) {
+    connectedClients := clienthandler.NewConnectedClients()
+    created := 0
+    servers := &replayServers{
+        sideChannel: network.SideChannel{ConnectedClients: connectedClients},
+        newTCPServer: func(port int) network.TCPServer {
+            created++
+            return network.NewTCPServer("127.0.0.1", port, connectedClients, network.ReplayErrorPolicies{}, "", nil)
+        },
+        newUDPServer: func(port int) network.UDPServer {
+            created++
+            return network.NewUDPServer("127.0.0.1", port, connectedClients, network.ReplayErrorPolicies{}, network.UDPPathMTU{}, nil)
+        },
+    }
+    t.Cleanup(func() {
+        servers.closeRemovedPorts(TestPortNumbers{}, time.Now().Add(time.Hour))
+    })
+    return servers, &created
+}
+
+// Binds a port that is taken along with ports that are free, and checks that the free ones are still
+// bound and that the error names the port that is taken.
+func TestListenTriesEveryPort(t *testing.T) {
+    servers, _ := newTestReplayServers(t)
+    taken, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer taken.Close()
+    takenPort := taken.Addr().(*net.TCPAddr).Port
+    tcpPort, udpPort := freePorts(t)
+
+    added, err := servers.listen(TestPortNumbers{TCPPorts: []int{takenPort, tcpPort}, UDPPorts: []int{udpPort}})
+    if err == nil || !strings.Contains(err.Error(), "TCP port") {
+        t.Fatalf("listen() with a port that is taken returned %v", err)
+    }
+    if len(added) != 2 || !servers.listensOn("tcp", tcpPort) || !servers.listensOn("udp", udpPort) {
+        t.Errorf("listen() bound %v; want the free TCP and UDP ports", added)
+    }
+    if servers.listensOn("tcp", takenPort) {
+        t.Error("listen() added a server for the port that is taken")
+    }
+}
+
+// Switches the servers to run_as_user and checks that privileged ports are refused without trying
+// to bind them, while other ports are still bound.
+func TestListenRefusesPrivilegedPorts(t *testing.T) {
+    servers, created := newTestReplayServers(t)
+    servers.setRunAsUser("wehe")
+    tcpPort, _ := freePorts(t)
+
+    added, err := servers.listen(TestPortNumbers{TCPPorts: []int{80, tcpPort}, UDPPorts: []int{443}})
+    if err == nil || !strings.Contains(err.Error(), "TCP port 80") || !strings.Contains(err.Error(), "UDP port 443") || !strings.Contains(err.Error(), "run_as_user wehe") {
+        t.Fatalf("listen() of privileged ports as run_as_user returned %v", err)
+    }
+    if *created != 1 || len(added) != 1 || added[0] != "tcp/" + strconv.Itoa(tcpPort) {
+        t.Errorf("listen() created %d servers and bound %v; want only tcp/%d", *created, added, tcpPort)
+    }
+}
+
+// Removes ports while a client that was granted its replay before still runs it, and checks that
+// the ports are only closed, and can be bound again, once the client is done.
+func TestCloseRemovedPorts(t *testing.T) {
+    servers, _ := newTestReplayServers(t)
+    tcpPort, udpPort := freePorts(t)
+    _, err := servers.listen(TestPortNumbers{TCPPorts: []int{tcpPort}, UDPPorts: []int{udpPort}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if closed := servers.closeRemovedPorts(TestPortNumbers{TCPPorts: []int{tcpPort}, UDPPorts: []int{udpPort}}, time.Now()); len(closed) != 0 {
+        t.Fatalf("closeRemovedPorts() closed test ports %v", closed)
+    }
+
+    servers.sideChannel.ConnectedClients.Grant("192.0.2.1", "replay")
+    removedAt := time.Now().Add(time.Millisecond)
+    if closed := servers.closeRemovedPorts(TestPortNumbers{}, removedAt); len(closed) != 0 {
+        t.Fatalf("closeRemovedPorts() closed %v while a client may still use them", closed)
+    }
+    if tcpPorts, udpPorts := servers.boundPorts(TestPortNumbers{}); len(tcpPorts) != 0 || len(udpPorts) != 0 {
+        t.Errorf("boundPorts() offers removed ports %v and %v", tcpPorts, udpPorts)
+    }
+
+    // a client granted its replay after the ports were removed can't have been sent to them
+    servers.sideChannel.ConnectedClients.Revoke("192.0.2.1")
+    time.Sleep(2 * time.Millisecond)
+    servers.sideChannel.ConnectedClients.Grant("192.0.2.2", "replay")
+    closed := servers.closeRemovedPorts(TestPortNumbers{}, time.Now())
+    if len(closed) != 2 || servers.listensOn("tcp", tcpPort) || servers.listensOn("udp", udpPort) {
+        t.Fatalf("closeRemovedPorts() once the client was done closed %v; want both ports", closed)
+    }
+    listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(tcpPort)))
+    if err != nil {
+        t.Fatalf("Closed TCP port can't be bound again: %v", err)
+    }
+    listener.Close()
+    conn, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(udpPort)))
+    if err != nil {
+        t.Fatalf("Closed UDP port can't be bound again: %v", err)
+    }
+    conn.Close()
+}
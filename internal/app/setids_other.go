@@ -0,0 +1,18 @@
+//go:build !unix
+
+// Platforms without Unix users, such as Windows, can't drop privileges. The server still builds there
+// for development, but fails to start if run_as_user is set.
+package app
+
+import (
+    "fmt"
+    "runtime"
+)
+
+// Reports that switching users isn't supported.
+// uid: the ID of the user to run as
+// gid: the ID of the group to run as
+// Returns an error
+func setIDs(uid int, gid int) error {
+    return fmt.Errorf("run_as_user is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+// Switching users on Unix.
+package app
+
+import (
+    "fmt"
+    "syscall"
+)
+
+// Switches the process to a user and group.
+// uid: the ID of the user to run as
+// gid: the ID of the group to run as
+// Returns any errors
+func setIDs(uid int, gid int) error {
+    // the group must be changed first, since changing the user gives up the permission to do so
+    err := syscall.Setgroups([]int{gid})
+    if err != nil {
+        return fmt.Errorf("Unable to set supplementary groups: %v", err)
+    }
+    err = syscall.Setgid(gid)
+    if err != nil {
+        return fmt.Errorf("Unable to set group to %d: %v", gid, err)
+    }
+    err = syscall.Setuid(uid)
+    if err != nil {
+        return fmt.Errorf("Unable to set user to %d: %v", uid, err)
+    }
+
+    // make sure root can't be regained
+    if uid != 0 && syscall.Setuid(0) == nil {
+        return fmt.Errorf("Privileges were not dropped; the server can still become root.")
+    }
+    return nil
+}
@@ -0,0 +1,297 @@
+// Builds the paths of the result files written for each test. Paths are built from templates so
+// that deployments can choose how results are laid out on disk without code changes.
+package artifacts
+
+import (
+    "fmt"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "text/template"
+    "time"
+)
+
+// The type of result file
+type Kind string
+
+const (
+    ClientThroughputs Kind = "client_xputs" // throughputs and sample times sent by the client
+    ReplayInfo Kind = "replay_info" // information about a replay
+    SideChannelRTT Kind = "side_channel_rtt" // RTTs of the side channel measured during a test
+    ServerThroughputs Kind = "server_xputs" // throughputs sampled from the bytes the server sent, to check those of the client against
+    ClientLatencies Kind = "client_latencies" // RTTs to the replay port measured by the client before, during, and after a replay
+    Decision Kind = "decision" // whether the test shows differentiation and the decision policy used to decide
+    TestManifest Kind = "manifest" // the sizes and checksums of the other result files of a test
+    AnalysisResults Kind = "results" // the full analysis of a test, in the format of the results files of wehe-py3
+)
+
+var (
+    // all the kinds of result files
+    kinds = []Kind{ClientThroughputs, ReplayInfo, SideChannelRTT, ServerThroughputs, ClientLatencies, Decision, TestManifest, AnalysisResults}
+
+    // kinds of result files that are written once per replay rather than once per test
+    perReplayKinds = map[Kind]bool{
+        ClientThroughputs: true,
+        ReplayInfo: true,
+        ServerThroughputs: true,
+        ClientLatencies: true,
+    }
+
+    // the built in layouts
+    presets = map[string]map[Kind]string{
+        // the layout of the old server: results are grouped by user, then by type of file
+        "default": {
+            ClientThroughputs: "{{.UserID}}/clientXputs/Xput_{{.UserID}}_{{.TestID}}_{{.ReplayID}}.json",
+            ReplayInfo: "{{.UserID}}/replayInfo/replayInfo_{{.UserID}}_{{.TestID}}_{{.ReplayID}}.json",
+            SideChannelRTT: "{{.UserID}}/sideChannelRTTs/sideChannelRTT_{{.UserID}}_{{.TestID}}.json",
+            ServerThroughputs: "{{.UserID}}/serverXputs/serverXput_{{.UserID}}_{{.TestID}}_{{.ReplayID}}.json",
+            ClientLatencies: "{{.UserID}}/clientLatencies/latency_{{.UserID}}_{{.TestID}}_{{.ReplayID}}.json",
+            Decision: "{{.UserID}}/decisions/decision_{{.UserID}}_{{.TestID}}.json",
+            AnalysisResults: "{{.UserID}}/decisions/results_{{.UserID}}_Client_{{.TestID}}_1.json",
+            TestManifest: "{{.UserID}}/manifests/manifest_{{.UserID}}_{{.TestID}}.json",
+        },
+        // all results are in one directory
+        "flat": {
+            ClientThroughputs: "Xput_{{.UserID}}_{{.TestID}}_{{.ReplayID}}.json",
+            ReplayInfo: "replayInfo_{{.UserID}}_{{.TestID}}_{{.ReplayID}}.json",
+            SideChannelRTT: "sideChannelRTT_{{.UserID}}_{{.TestID}}.json",
+            ServerThroughputs: "serverXput_{{.UserID}}_{{.TestID}}_{{.ReplayID}}.json",
+            ClientLatencies: "latency_{{.UserID}}_{{.TestID}}_{{.ReplayID}}.json",
+            Decision: "decision_{{.UserID}}_{{.TestID}}.json",
+            AnalysisResults: "results_{{.UserID}}_Client_{{.TestID}}_1.json",
+            TestManifest: "manifest_{{.UserID}}_{{.TestID}}.json",
+        },
+        // results are grouped by the UTC date the test started, then by user
+        "date": {
+            ClientThroughputs: "{{.Year}}/{{.Month}}/{{.Day}}/{{.UserID}}/clientXputs/Xput_{{.UserID}}_{{.TestID}}_{{.ReplayID}}.json",
+            ReplayInfo: "{{.Year}}/{{.Month}}/{{.Day}}/{{.UserID}}/replayInfo/replayInfo_{{.UserID}}_{{.TestID}}_{{.ReplayID}}.json",
+            SideChannelRTT: "{{.Year}}/{{.Month}}/{{.Day}}/{{.UserID}}/sideChannelRTTs/sideChannelRTT_{{.UserID}}_{{.TestID}}.json",
+            ServerThroughputs: "{{.Year}}/{{.Month}}/{{.Day}}/{{.UserID}}/serverXputs/serverXput_{{.UserID}}_{{.TestID}}_{{.ReplayID}}.json",
+            ClientLatencies: "{{.Year}}/{{.Month}}/{{.Day}}/{{.UserID}}/clientLatencies/latency_{{.UserID}}_{{.TestID}}_{{.ReplayID}}.json",
+            Decision: "{{.Year}}/{{.Month}}/{{.Day}}/{{.UserID}}/decisions/decision_{{.UserID}}_{{.TestID}}.json",
+            AnalysisResults: "{{.Year}}/{{.Month}}/{{.Day}}/{{.UserID}}/decisions/results_{{.UserID}}_Client_{{.TestID}}_1.json",
+            TestManifest: "{{.Year}}/{{.Month}}/{{.Day}}/{{.UserID}}/manifests/manifest_{{.UserID}}_{{.TestID}}.json",
+        },
+        // the M-Lab layout: results are grouped by datatype, then by UTC date
+        "mlab": {
+            ClientThroughputs: "clientXputs/{{.Year}}/{{.Month}}/{{.Day}}/Xput_{{.UserID}}_{{.TestID}}_{{.ReplayID}}.json",
+            ReplayInfo: "replayInfo/{{.Year}}/{{.Month}}/{{.Day}}/replayInfo_{{.UserID}}_{{.TestID}}_{{.ReplayID}}.json",
+            SideChannelRTT: "sideChannelRTTs/{{.Year}}/{{.Month}}/{{.Day}}/sideChannelRTT_{{.UserID}}_{{.TestID}}.json",
+            ServerThroughputs: "serverXputs/{{.Year}}/{{.Month}}/{{.Day}}/serverXput_{{.UserID}}_{{.TestID}}_{{.ReplayID}}.json",
+            ClientLatencies: "clientLatencies/{{.Year}}/{{.Month}}/{{.Day}}/latency_{{.UserID}}_{{.TestID}}_{{.ReplayID}}.json",
+            Decision: "decisions/{{.Year}}/{{.Month}}/{{.Day}}/decision_{{.UserID}}_{{.TestID}}.json",
+            AnalysisResults: "decisions/{{.Year}}/{{.Month}}/{{.Day}}/results_{{.UserID}}_Client_{{.TestID}}_1.json",
+            TestManifest: "manifests/{{.Year}}/{{.Month}}/{{.Day}}/manifest_{{.UserID}}_{{.TestID}}.json",
+        },
+    }
+)
+
+// Information about a test used to fill in the path templates. Templates can use {{.UserID}},
+// {{.TestID}}, {{.ReplayID}}, {{.Year}}, {{.Month}}, and {{.Day}}.
+type TestInfo struct {
+    UserID string // the 10 character user ID
+    TestID string // the test ID, including the attempt number if the test was submitted more than once
+    ReplayID int // the type of replay; unused for files written once per test
+    StartTime time.Time // the time the test started
+}
+
+// Gets the four digit UTC year the test started.
+func (info TestInfo) Year() string {
+    return info.StartTime.UTC().Format("2006")
+}
+
+// Gets the two digit UTC month the test started.
+func (info TestInfo) Month() string {
+    return info.StartTime.UTC().Format("01")
+}
+
+// Gets the two digit UTC day the test started.
+func (info TestInfo) Day() string {
+    return info.StartTime.UTC().Format("02")
+}
+
+// The templates used to build the path of each kind of result file.
+type Layout struct {
+    templates map[Kind]*template.Template
+}
+
+// Gets the names of the built in layouts.
+// Returns the preset names
+func Presets() []string {
+    return []string{"default", "flat", "date", "mlab"}
+}
+
+// Creates the layout that matches the old server.
+// Returns the default layout
+func DefaultLayout() *Layout {
+    layout, err := NewLayout("default", nil)
+    if err != nil {
+        panic(err)
+    }
+    return layout
+}
+
+// Creates a new Layout. The templates are validated so that bad templates are caught at startup
+// rather than when a test finishes.
+// preset: the name of the built in layout to start from
+// overrides: templates that replace the templates of the preset; key is the kind of result file
+// Returns the layout or any errors
+func NewLayout(preset string, overrides map[Kind]string) (*Layout, error) {
+    presetTemplates, exists := presets[preset]
+    if !exists {
+        return nil, fmt.Errorf("%s is not a results layout. Choose from %s.", preset, strings.Join(Presets(), ", "))
+    }
+
+    layout := &Layout{
+        templates: make(map[Kind]*template.Template),
+    }
+    for _, kind := range kinds {
+        text := presetTemplates[kind]
+        override, exists := overrides[kind]
+        if exists {
+            text = override
+        }
+        tmpl, err := template.New(string(kind)).Option("missingkey=error").Parse(text)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid %s results template: %v", kind, err)
+        }
+        layout.templates[kind] = tmpl
+        err = layout.validate(kind)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    for kind := range overrides {
+        _, exists := layout.templates[kind]
+        if !exists {
+            return nil, fmt.Errorf("%s is not a kind of result file.", kind)
+        }
+    }
+    return layout, nil
+}
+
+// Checks that a template produces relative paths that stay in the results directory, and that
+// different tests never write to the same file.
+// kind: the kind of result file whose template to check
+// Returns any errors
+func (layout *Layout) validate(kind Kind) error {
+    startTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+    samples := []TestInfo{
+        {UserID: "aaaaaaaaaa", TestID: "1", ReplayID: 0, StartTime: startTime},
+        {UserID: "bbbbbbbbbb", TestID: "1", ReplayID: 0, StartTime: startTime},
+        {UserID: "aaaaaaaaaa", TestID: "2", ReplayID: 0, StartTime: startTime},
+        {UserID: "aaaaaaaaaa", TestID: "2_attempt2", ReplayID: 0, StartTime: startTime},
+    }
+    if perReplayKinds[kind] {
+        samples = append(samples, TestInfo{UserID: "aaaaaaaaaa", TestID: "2", ReplayID: 1, StartTime: startTime})
+    }
+
+    seen := make(map[string]bool)
+    for _, sample := range samples {
+        path, err := layout.render(kind, sample)
+        if err != nil {
+            return fmt.Errorf("Invalid %s results template: %v", kind, err)
+        }
+        if path == "" || filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, ".." + string(filepath.Separator)) {
+            return fmt.Errorf("%s results template must produce a relative path inside the results directory; got %s", kind, path)
+        }
+        if seen[path] {
+            return fmt.Errorf("%s results template produces the same path for different tests: %s", kind, path)
+        }
+        seen[path] = true
+    }
+    return nil
+}
+
+// Fills in the template of a kind of result file.
+// kind: the kind of result file
+// info: information about the test
+// Returns the cleaned relative path of the result file or any errors
+func (layout *Layout) render(kind Kind, info TestInfo) (string, error) {
+    tmpl, exists := layout.templates[kind]
+    if !exists {
+        return "", fmt.Errorf("%s is not a kind of result file.", kind)
+    }
+    var path strings.Builder
+    err := tmpl.Execute(&path, info)
+    if err != nil {
+        return "", err
+    }
+    return filepath.Clean(path.String()), nil
+}
+
+// Gets the path of a result file.
+// root: the directory that contains all the results
+// kind: the kind of result file
+// info: information about the test
+// Returns the path of the result file or any errors
+func (layout *Layout) Path(root string, kind Kind, info TestInfo) (string, error) {
+    path, err := layout.render(kind, info)
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(root, path), nil
+}
+
+// Fills in the path templates with wildcards, so that the result files of every test, or of a test
+// whose start date isn't known, can be found.
+type globInfo struct {
+    UserID string
+    TestID string
+    ReplayID string
+}
+
+// Gets a wildcard for the year.
+func (info globInfo) Year() string {
+    return "*"
+}
+
+// Gets a wildcard for the month.
+func (info globInfo) Month() string {
+    return "*"
+}
+
+// Gets a wildcard for the day.
+func (info globInfo) Day() string {
+    return "*"
+}
+
+// Gets a pattern that matches the result files of a kind for every test, for use with
+// filepath.Glob.
+// root: the directory that contains all the results
+// kind: the kind of result file
+// Returns the pattern or any errors
+func (layout *Layout) Glob(root string, kind Kind) (string, error) {
+    return layout.glob(root, kind, globInfo{UserID: "*", TestID: "*", ReplayID: "*"})
+}
+
+// Gets a pattern that matches a result file of one test whatever day the test started on, for use
+// with filepath.Glob.
+// root: the directory that contains all the results
+// kind: the kind of result file
+// userID: the user ID of the test
+// testID: the test ID, including the attempt number if the test was submitted more than once
+// replayID: the type of replay; unused for files written once per test
+// Returns the pattern or any errors
+func (layout *Layout) TestGlob(root string, kind Kind, userID string, testID string, replayID int) (string, error) {
+    return layout.glob(root, kind, globInfo{UserID: userID, TestID: testID, ReplayID: strconv.Itoa(replayID)})
+}
+
+// Fills in the template of a kind of result file with wildcards.
+// root: the directory that contains all the results
+// kind: the kind of result file
+// info: the values or wildcards of the template fields
+// Returns the pattern or any errors
+func (layout *Layout) glob(root string, kind Kind, info globInfo) (string, error) {
+    tmpl, exists := layout.templates[kind]
+    if !exists {
+        return "", fmt.Errorf("%s is not a kind of result file.", kind)
+    }
+    var pattern strings.Builder
+    err := tmpl.Execute(&pattern, info)
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(root, filepath.Clean(pattern.String())), nil
+}
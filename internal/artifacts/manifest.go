@@ -0,0 +1,112 @@
+// Lists the result files of a test with their sizes and checksums, so that a partly written or
+// truncated copy of a result file can be caught by whatever reads, uploads, or exports the results.
+package artifacts
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// The result files of a test, written as JSON to the manifest path of the test.
+type Manifest struct {
+    UserID string `json:"userID"` // the 10 character user ID
+    TestID string `json:"testID"` // the test ID, including the attempt number if the test was submitted more than once
+    StartTime time.Time `json:"startTime"` // the time the test started
+    Files []ManifestFile `json:"files"` // the result files of the test
+}
+
+// A result file listed in a manifest.
+type ManifestFile struct {
+    Kind Kind `json:"kind"` // the kind of result file
+    ReplayID *int `json:"replayID,omitempty"` // the replay the file belongs to; omitted for files written once per test
+    Path string `json:"path"` // the path of the file, relative to the results directory
+    Size int64 `json:"size"` // the size of the file in bytes
+    SHA256 string `json:"sha256"` // the hex SHA-256 checksum of the file
+}
+
+// Adds a result file to the manifest, reading it to get its size and checksum.
+// root: the directory that contains all the results
+// kind: the kind of result file
+// replayID: the replay the file belongs to; ignored for files written once per test
+// path: the path of the file
+// Returns any errors
+func (manifest *Manifest) Add(root string, kind Kind, replayID int, path string) error {
+    relPath, err := filepath.Rel(root, path)
+    if err != nil {
+        return err
+    }
+    size, checksum, err := checksumFile(path)
+    if err != nil {
+        return err
+    }
+    file := ManifestFile{
+        Kind: kind,
+        Path: filepath.ToSlash(relPath),
+        Size: size,
+        SHA256: checksum,
+    }
+    if perReplayKinds[kind] {
+        file.ReplayID = &replayID
+    }
+    manifest.Files = append(manifest.Files, file)
+    return nil
+}
+
+// Checks that every file in the manifest exists under a directory with the size and checksum it
+// was listed with.
+// root: the directory that contains all the results, or a copy of them
+// Returns an error naming the first file that is missing or doesn't match
+func (manifest Manifest) Verify(root string) error {
+    for _, file := range manifest.Files {
+        size, checksum, err := checksumFile(filepath.Join(root, filepath.FromSlash(file.Path)))
+        if err != nil {
+            return err
+        }
+        if size != file.Size {
+            return fmt.Errorf("%s is %d bytes; manifest lists %d bytes", file.Path, size, file.Size)
+        }
+        if checksum != file.SHA256 {
+            return fmt.Errorf("%s has SHA-256 %s; manifest lists %s", file.Path, checksum, file.SHA256)
+        }
+    }
+    return nil
+}
+
+// Reads a manifest.
+// path: the path of the manifest
+// Returns the manifest or any errors
+func ReadManifest(path string) (Manifest, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return Manifest{}, err
+    }
+    var manifest Manifest
+    err = json.Unmarshal(data, &manifest)
+    if err != nil {
+        return Manifest{}, fmt.Errorf("Unable to parse manifest %s: %v", path, err)
+    }
+    return manifest, nil
+}
+
+// Gets the size and checksum of a file.
+// path: the path of the file
+// Returns the size in bytes, the hex SHA-256 checksum, or any errors
+func checksumFile(path string) (int64, string, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return 0, "", err
+    }
+    defer file.Close()
+    hash := sha256.New()
+    size, err := io.Copy(hash, file)
+    if err != nil {
+        return 0, "", err
+    }
+    return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,98 @@
+// Identifies the build of the server and the features it runs tests with. The info is stamped into
+// the result files so that longitudinal analyses can tell a change in behavior that came with a new
+// server release or setting apart from a change made by an ISP.
+package buildinfo
+
+import (
+    "maps"
+    "runtime"
+    "runtime/debug"
+    "sync"
+)
+
+var (
+    // the release of the server, set when building with
+    // -ldflags "-X wehe-server/internal/buildinfo.Version=<version>"
+    Version = "dev"
+
+    features map[string]string // the settings that change how tests are run; key is the setting name
+    nodeLabels map[string]string // the labels of the deployment the server belongs to; key is the label name
+    featuresMutex sync.Mutex // prevents features and nodeLabels from being read while they are set
+)
+
+// The build of the server and the features it runs tests with.
+type Info struct {
+    Version string `json:"version"` // the release of the server; "dev" if it wasn't set at build time
+    Commit string `json:"commit,omitempty"` // the git commit the server was built from; omitted if unknown
+    CommitTime string `json:"commit_time,omitempty"` // the time of the commit, in RFC 3339; omitted if unknown
+    Modified bool `json:"modified,omitempty"` // true if the working tree had changes that weren't committed
+    GoVersion string `json:"go_version"` // the version of Go the server was built with
+    GOOS string `json:"goos"` // the operating system the server was built for
+    GOARCH string `json:"goarch"` // the architecture the server was built for
+    Features map[string]string `json:"features,omitempty"` // the settings that change how tests are run; key is the setting name
+    Node map[string]string `json:"node,omitempty"` // the labels of the deployment the server belongs to, e.g. site and environment; omitted if none are set
+}
+
+// Sets the settings that change how tests are run. This should be called when the server starts and
+// again whenever one of the settings is reloaded.
+// newFeatures: the settings; key is the setting name, e.g. analysis.ks_test
+func SetFeatures(newFeatures map[string]string) {
+    featuresMutex.Lock()
+    defer featuresMutex.Unlock()
+    features = maps.Clone(newFeatures)
+}
+
+// Sets the labels that identify the deployment the server belongs to, so that the results of a fleet
+// of servers can be told apart without parsing hostnames. This should be called when the server
+// starts.
+// labels: the labels; key is the label name, e.g. site
+func SetNodeLabels(labels map[string]string) {
+    featuresMutex.Lock()
+    defer featuresMutex.Unlock()
+    nodeLabels = maps.Clone(labels)
+}
+
+// Gets the labels that identify the deployment the server belongs to.
+// Returns the labels; key is the label name
+func NodeLabels() map[string]string {
+    featuresMutex.Lock()
+    defer featuresMutex.Unlock()
+    return maps.Clone(nodeLabels)
+}
+
+// Gets the build of the server, the features it is running tests with, and the labels of its
+// deployment.
+// Returns the build info
+func Get() Info {
+    info := build()
+    featuresMutex.Lock()
+    defer featuresMutex.Unlock()
+    info.Features = maps.Clone(features)
+    info.Node = maps.Clone(nodeLabels)
+    return info
+}
+
+// Reads the build of the server, which doesn't change while it runs, once.
+var build = sync.OnceValue(func() Info {
+    info := Info{
+        Version: Version,
+        GoVersion: runtime.Version(),
+        GOOS: runtime.GOOS,
+        GOARCH: runtime.GOARCH,
+    }
+    buildInfo, ok := debug.ReadBuildInfo()
+    if !ok {
+        return info
+    }
+    for _, setting := range buildInfo.Settings {
+        switch setting.Key {
+        case "vcs.revision":
+            info.Commit = setting.Value
+        case "vcs.time":
+            info.CommitTime = setting.Value
+        case "vcs.modified":
+            info.Modified = setting.Value == "true"
+        }
+    }
+    return info
+})
@@ -0,0 +1,207 @@
+// Accounts for the bytes the replay servers send, per replay, per test, and per user, and caps how
+// much each user can be sent in a month. Every replay costs the server egress, and some deployments
+// pay for it, so a user who tests from a script all month can run up a bill.
+package clienthandler
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+
+    "wehe-server/internal/metrics"
+    "wehe-server/internal/resultfile"
+)
+
+const (
+    monthFormat = "2006-01" // format of the month the usage is for
+)
+
+var (
+    replayBytesSent = metrics.NewCounterVec("wehe_replay_bytes_sent_total",
+        "Number of bytes the replay servers sent to clients, by replay.", "replay")
+)
+
+// The bytes sent to each user in the current calendar month (UTC), and the monthly cap per user.
+type BandwidthLedger struct {
+    filename string // where the usage is saved so that it survives restarts; empty to keep it in memory
+    monthlyCap int64 // bytes a user can be sent in a month before its tests are turned away; 0 for no cap
+    mutex sync.Mutex // prevents multiple goroutines from accessing monthlyCap, month, and usage
+    month string // the month the usage is for, formatted with monthFormat
+    usage map[string]int64 // bytes sent to each user this month; key is the user ID
+}
+
+// The usage saved to the usage file.
+type savedUsage struct {
+    Month string `json:"month"` // the month the usage is for, e.g. 2024-05
+    Users map[string]int64 `json:"users"` // bytes sent to each user; key is the user ID
+}
+
+// The usage of the current month, as shown to operators.
+type BandwidthStatus struct {
+    Month string `json:"month"` // the month the usage is for, e.g. 2024-05
+    Users int `json:"users"` // number of users sent anything this month
+    BytesSent int64 `json:"bytes_sent"` // bytes sent to every user this month
+    UsersOverCap int `json:"users_over_cap"` // number of users whose tests are turned away until next month
+    MonthlyCap int64 `json:"monthly_cap"` // bytes a user can be sent in a month; 0 for no cap
+}
+
+// Creates a new BandwidthLedger, loading the usage of the current month if it was saved.
+// filename: where the usage is saved; empty to keep it in memory
+// monthlyCap: bytes a user can be sent in a month; 0 for no cap
+// now: the current time
+// Returns the ledger or any errors
+func NewBandwidthLedger(filename string, monthlyCap int64, now time.Time) (*BandwidthLedger, error) {
+    if monthlyCap < 0 {
+        return nil, fmt.Errorf("Monthly bandwidth cap cannot be negative; got %d", monthlyCap)
+    }
+    ledger := &BandwidthLedger{
+        filename: filename,
+        monthlyCap: monthlyCap,
+        month: now.UTC().Format(monthFormat),
+        usage: make(map[string]int64),
+    }
+    if filename == "" {
+        return ledger, nil
+    }
+    data, err := os.ReadFile(filename)
+    if os.IsNotExist(err) {
+        return ledger, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var saved savedUsage
+    err = json.Unmarshal(data, &saved)
+    if err != nil {
+        return nil, fmt.Errorf("Unable to parse bandwidth usage file %s: %v", filename, err)
+    }
+    // usage of a past month no longer counts against anyone
+    if saved.Month == ledger.month && saved.Users != nil {
+        ledger.usage = saved.Users
+    }
+    return ledger, nil
+}
+
+// Changes the monthly cap. Users already over the new cap are turned away from their next test.
+// monthlyCap: bytes a user can be sent in a month; 0 for no cap
+// Returns an error if the cap is negative
+func (ledger *BandwidthLedger) SetMonthlyCap(monthlyCap int64) error {
+    if monthlyCap < 0 {
+        return fmt.Errorf("Monthly bandwidth cap cannot be negative; got %d", monthlyCap)
+    }
+    ledger.mutex.Lock()
+    defer ledger.mutex.Unlock()
+    ledger.monthlyCap = monthlyCap
+    return nil
+}
+
+// Starts a new month of usage if the month has changed. The mutex must be held.
+// now: the current time
+func (ledger *BandwidthLedger) rollOver(now time.Time) {
+    month := now.UTC().Format(monthFormat)
+    if month != ledger.month {
+        ledger.month = month
+        ledger.usage = make(map[string]int64)
+    }
+}
+
+// Records bytes sent to a user and saves the usage.
+// userID: the user ID of the client
+// numBytes: number of bytes sent
+// now: the current time
+// Returns any errors saving the usage
+func (ledger *BandwidthLedger) Add(userID string, numBytes int64, now time.Time) error {
+    ledger.mutex.Lock()
+    defer ledger.mutex.Unlock()
+    ledger.rollOver(now)
+    ledger.usage[userID] += numBytes
+    return ledger.save()
+}
+
+// Checks if a user has been sent its monthly cap.
+// userID: the user ID of the client
+// now: the current time
+// Returns true if the user is over its cap, and when the cap resets at the start of next month
+func (ledger *BandwidthLedger) OverCap(userID string, now time.Time) (bool, time.Time) {
+    ledger.mutex.Lock()
+    defer ledger.mutex.Unlock()
+    ledger.rollOver(now)
+    utc := now.UTC()
+    nextMonth := time.Date(utc.Year(), utc.Month() + 1, 1, 0, 0, 0, 0, time.UTC)
+    return ledger.monthlyCap > 0 && ledger.usage[userID] >= ledger.monthlyCap, nextMonth
+}
+
+// Gets the usage of the current month.
+// now: the current time
+// Returns the usage
+func (ledger *BandwidthLedger) Status(now time.Time) BandwidthStatus {
+    ledger.mutex.Lock()
+    defer ledger.mutex.Unlock()
+    ledger.rollOver(now)
+    status := BandwidthStatus{
+        Month: ledger.month,
+        Users: len(ledger.usage),
+        MonthlyCap: ledger.monthlyCap,
+    }
+    for _, numBytes := range ledger.usage {
+        status.BytesSent += numBytes
+        if ledger.monthlyCap > 0 && numBytes >= ledger.monthlyCap {
+            status.UsersOverCap++
+        }
+    }
+    return status
+}
+
+// Writes the usage to the usage file, next to it first and then renamed into place, so that a crash
+// never leaves a partly written file, and durably if result files are. The mutex must be held.
+// Returns any errors
+func (ledger *BandwidthLedger) save() error {
+    if ledger.filename == "" {
+        return nil
+    }
+    data, err := json.Marshal(savedUsage{
+        Month: ledger.month,
+        Users: ledger.usage,
+    })
+    if err != nil {
+        return err
+    }
+    return resultfile.Replace(filepath.Dir(ledger.filename), filepath.Base(ledger.filename), data)
+}
+
+// Moves the bytes the replay servers sent during the current replay into the replay, and counts them
+// against the user. Should be called once the replay is over.
+// connectedClients: the connected clients, which hold the bytes sent
+// Returns any errors
+func (clt *Client) CollectBytesSent(connectedClients *ConnectedClients) error {
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return err
+    }
+    numBytes := connectedClients.TakeBytesSent(clt.ReplayKey())
+    if numBytes == 0 {
+        return nil
+    }
+    currentReplay.BytesSent += numBytes
+    replayBytesSent.Add(currentReplay.ReplayName, uint64(numBytes))
+    if bandwidthLedger != nil {
+        err = bandwidthLedger.Add(clt.UserID, numBytes, clk.Now())
+        if err != nil {
+            return fmt.Errorf("Unable to save bandwidth usage: %v", err)
+        }
+    }
+    return nil
+}
+
+// Gets the bytes the replay servers sent during the test.
+// Returns the bytes sent over every replay of the test
+func (clt *Client) BytesSent() int64 {
+    var total int64
+    for _, replayResult := range clt.ReplayResults {
+        total += replayResult.BytesSent
+    }
+    return total
+}
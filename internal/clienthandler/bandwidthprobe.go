@@ -0,0 +1,247 @@
+// Quick bandwidth probes that clients run before a heavy replay. The client asks for a probe on the
+// side channel, connects to a test port, and starts the connection with BandwidthProbeRequest; the
+// server sends a short burst and times it until the client confirms it received every byte. A
+// replay that sends faster on average than the probe measured can't be replayed at its own pace on
+// that link, e.g. a 4K video replay on a 2 Mbps link, so depending on the policy the client is
+// warned or the replay is skipped. The probe is recorded with the test so that analysis can tell a
+// slow link from throttling.
+package clienthandler
+
+import (
+    "fmt"
+    "math"
+    "sync"
+    "time"
+
+    "wehe-server/internal/denials"
+)
+
+const (
+    BandwidthProbeRequest = "WEHE-BANDWIDTH-PROBE" // what the client sends on the test port to start a probe
+    BandwidthProbeWarn = "warn" // replays faster than the link are run, and the client is told
+    BandwidthProbeSkip = "skip" // replays faster than the link are denied
+)
+
+// The result of a bandwidth probe and what it means for the replay the client declared.
+type BandwidthProbeResult struct {
+    Mbps float64 `json:"mbps"` // the rate the burst was delivered at
+    Bytes int64 `json:"bytes"` // bytes sent in the burst
+    DurationMs float64 `json:"duration_ms"` // milliseconds from the start of the burst until the client confirmed it, or until the probe timed out
+    Complete bool `json:"complete"` // false if the probe timed out, in which case the link is slower than Mbps
+    ReplayName string `json:"replay_name"` // the replay the client declared when the probe finished
+    ReplayMbps float64 `json:"replay_mbps"` // the average rate the replay is sent at; 0 if it isn't known
+    Action string `json:"action"` // "ok" if the link is fast enough for the replay, otherwise the policy: "warn" or "skip"
+}
+
+// A probe that a client asked for and hasn't collected yet.
+type pendingProbe struct {
+    claimed bool // true once a connection on a test port is running the probe
+    result *BandwidthProbeResult // the result; nil until the probe finishes
+    done chan struct{} // closed when the probe finishes
+}
+
+// The settings of bandwidth probes and the probes that are running.
+type BandwidthProbes struct {
+    Bytes int64 // bytes sent in each burst
+    Timeout time.Duration // how long a burst can take before the probe is cut off
+    Policy string // what to do when a replay is faster than the link: BandwidthProbeWarn or BandwidthProbeSkip
+    mutex sync.Mutex // prevents multiple goroutines from accessing pending
+    pending map[string]*pendingProbe // the probes clients asked for; key is the normalized replay key of the client
+}
+
+// Creates new BandwidthProbes.
+// numBytes: bytes sent in each burst
+// timeout: how long a burst can take before the probe is cut off
+// policy: what to do when a replay is faster than the link: "warn" or "skip"
+// Returns the probes or any errors
+func NewBandwidthProbes(numBytes int64, timeout time.Duration, policy string) (*BandwidthProbes, error) {
+    if numBytes <= 0 {
+        return nil, fmt.Errorf("Bandwidth probe size must be positive; got %d", numBytes)
+    }
+    if timeout <= 0 {
+        return nil, fmt.Errorf("Bandwidth probe timeout must be positive; got %v", timeout)
+    }
+    if policy != BandwidthProbeWarn && policy != BandwidthProbeSkip {
+        return nil, fmt.Errorf("Unknown bandwidth probe policy %s; choose warn or skip", policy)
+    }
+    return &BandwidthProbes{
+        Bytes: numBytes,
+        Timeout: timeout,
+        Policy: policy,
+        pending: make(map[string]*pendingProbe),
+    }, nil
+}
+
+// Expects a probe from a client on a test port. A probe the client asked for before is replaced.
+// key: the replay key of the client
+func (probes *BandwidthProbes) expect(key string) {
+    probes.mutex.Lock()
+    defer probes.mutex.Unlock()
+    probes.pending[clientKey(key)] = &pendingProbe{done: make(chan struct{})}
+}
+
+// Finds the client that a probe connection on a test port belongs to. Each probe the client asks for
+// can be run by one connection.
+// token: the replay token at the start of the connection; empty if there was none
+// ip: the IP the connection came from
+// Returns the replay key of the client, or false if the client didn't ask for a probe or its probe
+//     is already running
+func (probes *BandwidthProbes) Claim(token string, ip string) (string, bool) {
+    probes.mutex.Lock()
+    defer probes.mutex.Unlock()
+    for _, key := range []string{token, ip} {
+        if key == "" {
+            continue
+        }
+        probe, exists := probes.pending[clientKey(key)]
+        if exists && !probe.claimed {
+            probe.claimed = true
+            return key, true
+        }
+    }
+    return "", false
+}
+
+// Records what a probe connection measured.
+// key: the replay key returned by Claim
+// numBytes: bytes sent in the burst
+// duration: time from the start of the burst until the client confirmed it, or until it was cut off
+// complete: true if the client confirmed that it received the whole burst
+func (probes *BandwidthProbes) Finish(key string, numBytes int64, duration time.Duration, complete bool) {
+    probes.mutex.Lock()
+    defer probes.mutex.Unlock()
+    probe, exists := probes.pending[clientKey(key)]
+    if !exists || probe.result != nil {
+        return
+    }
+    result := &BandwidthProbeResult{
+        Bytes: numBytes,
+        DurationMs: float64(duration) / float64(time.Millisecond),
+        Complete: complete,
+    }
+    if duration > 0 {
+        result.Mbps = float64(numBytes) * 8 / duration.Seconds() / 1000000
+    }
+    probe.result = result
+    close(probe.done)
+}
+
+// Waits for the probe of a client to finish and removes it.
+// key: the replay key of the client
+// wait: how long to wait for a probe that is still running
+// Returns the result, or false if the client didn't ask for a probe or it didn't finish in time
+func (probes *BandwidthProbes) take(key string, wait time.Duration) (BandwidthProbeResult, bool) {
+    probes.mutex.Lock()
+    probe, exists := probes.pending[clientKey(key)]
+    probes.mutex.Unlock()
+    if !exists {
+        return BandwidthProbeResult{}, false
+    }
+
+    timer := time.NewTimer(wait)
+    defer timer.Stop()
+    select {
+    case <-probe.done:
+    case <-timer.C:
+    }
+
+    probes.mutex.Lock()
+    defer probes.mutex.Unlock()
+    if probes.pending[clientKey(key)] == probe {
+        delete(probes.pending, clientKey(key))
+    }
+    if probe.result == nil {
+        return BandwidthProbeResult{}, false
+    }
+    return *probe.result, true
+}
+
+// Forgets the probe of a client, e.g. when its test is over.
+// key: the replay key of the client
+func (probes *BandwidthProbes) cancel(key string) {
+    probes.mutex.Lock()
+    defer probes.mutex.Unlock()
+    delete(probes.pending, clientKey(key))
+}
+
+// Gets ready for the client to run a bandwidth probe on a test port.
+// Returns the bytes the burst will have and the milliseconds it can take, in the format
+//     <bytes>;<timeout ms>, or false if probes are off
+func (clt *Client) StartBandwidthProbe() (string, bool) {
+    if bandwidthProbes == nil {
+        return "", false
+    }
+    bandwidthProbes.expect(clt.ReplayKey())
+    return fmt.Sprintf("%d;%d", bandwidthProbes.Bytes, bandwidthProbes.Timeout.Milliseconds()), true
+}
+
+// Collects the result of the bandwidth probe of the client and compares it with the replay the
+// client declared. The result is kept with the test, and a replay that is faster than the link is
+// denied permission to run if the policy is to skip such replays.
+// replayMbps: the average rate the current replay is sent at; 0 if it isn't known
+// Returns the result, or false if probes are off or the client's probe never finished
+func (clt *Client) FinishBandwidthProbe(replayMbps float64) (BandwidthProbeResult, bool, error) {
+    if bandwidthProbes == nil {
+        return BandwidthProbeResult{}, false, nil
+    }
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return BandwidthProbeResult{}, false, err
+    }
+    result, finished := bandwidthProbes.take(clt.ReplayKey(), bandwidthProbes.Timeout)
+    if !finished {
+        clt.Logger().Warn("Bandwidth probe didn't finish")
+        return BandwidthProbeResult{}, false, nil
+    }
+
+    result.ReplayName = currentReplay.ReplayName
+    result.ReplayMbps = replayMbps
+    result.Action = "ok"
+    // a probe that timed out only shows that the link is slower than what was measured
+    if replayMbps > 0 && (replayMbps > result.Mbps || !result.Complete) {
+        result.Action = bandwidthProbes.Policy
+        clt.addException(PermissionPhase, "LinkSlowerThanReplay")
+    }
+    clt.BandwidthProbe = &result
+    clt.Logger().Info("Bandwidth probe finished", "mbps", result.Mbps, "complete", result.Complete, "replay_mbps", replayMbps, "action", result.Action)
+    return result, true, nil
+}
+
+// Checks if the replay the client declared should be skipped because the bandwidth probe of the
+// client found its link too slow for it. A replay declared after the probe is compared against the
+// probe again, since it may be sent at a different rate.
+// replayName: the replay the client asked to run
+// Returns true if the replay should be skipped
+func (clt *Client) linkTooSlow(replayName string) bool {
+    probe := clt.BandwidthProbe
+    if probe == nil || probe.Action != BandwidthProbeSkip {
+        return false
+    }
+    if probe.ReplayName != replayName {
+        return false
+    }
+    clt.recordDenial(denials.LinkTooSlow, replayName, fmt.Sprintf("probe %.2f Mbps, replay %.2f Mbps", probe.Mbps, probe.ReplayMbps))
+    return true
+}
+
+// Gets the bandwidth probe of the client as it is written to the decision file. The ratio of the
+// faster of the two replays to the probe tells analysis whether a low throughput was all the link
+// could carry.
+// Returns the fields of the probe
+func (clt *Client) bandwidthProbeOutput() map[string]interface{} {
+    probe := clt.BandwidthProbe
+    output := map[string]interface{}{
+        "mbps": probe.Mbps,
+        "bytes": probe.Bytes,
+        "duration_ms": probe.DurationMs,
+        "complete": probe.Complete,
+        "replay_name": probe.ReplayName,
+        "replay_mbps": probe.ReplayMbps,
+        "action": probe.Action,
+    }
+    if clt.Analysis != nil && probe.Mbps > 0 {
+        fastest := math.Max(clt.Analysis.OriginalReplayStats.Average, clt.Analysis.RandomReplayStats.Average)
+        output["xput_ratio"] = fastest / probe.Mbps
+    }
+    return output
+}
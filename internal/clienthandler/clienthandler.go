@@ -1,104 +1,842 @@
 // Handles the logic for receiving and responding to client requests.
-// TODO: implement timeout for client so that connection doesn't keep running forever in the event that client crashes
 package clienthandler
 
 import (
     "encoding/json"
     "fmt"
+    "io"
+    "log/slog"
     "math"
     "net"
     "os"
     "path/filepath"
+    "sort"
     "strconv"
     "strings"
     "sync"
     "time"
 
-    "github.com/shirou/gopsutil/v3/disk"
-    "github.com/shirou/gopsutil/v3/mem"
-    psutilnet "github.com/shirou/gopsutil/v3/net"
-
     "wehe-server/internal/analysis"
+    "wehe-server/internal/anomaly"
+    "wehe-server/internal/anonymize"
+    "wehe-server/internal/artifacts"
+    "wehe-server/internal/buildinfo"
+    "wehe-server/internal/clock"
+    "wehe-server/internal/compat"
+    "wehe-server/internal/denials"
+    "wehe-server/internal/devices"
+    "wehe-server/internal/errorbudget"
+    "wehe-server/internal/errs"
     "wehe-server/internal/geolocation"
+    "wehe-server/internal/maintenance"
+    "wehe-server/internal/notify"
+    "wehe-server/internal/report"
+    "wehe-server/internal/resultfile"
+    "wehe-server/internal/testdata"
 )
 
 const (
-    SamplesPerReplay = 100 //TODO: think ab if this should be in config file - theoretically, all clients should work if this changes
-    Ask4PermissionOkStatus = "0"
+    DefaultSamplesPerReplay = 100 // throughput samples clients are told to take per replay unless the config says otherwise
+    Ask4PermissionOkStatus = "0" // followed by ;<samples per replay>, ;<server time> if the client reads it, ;<UDP replay timeout seconds> if the client reads it, and ;<replay token> if the client sends one
     Ask4PermissionErrorStatus = "1"
     Ask4PermissionUnknownReplayMsg = "1"
     Ask4PermissionIPInUseMsg = "2"
     Ask4PermissionLowResourcesMsg = "3"
     Ask4PermissionResourceRetrievalFailMsg = "4"
+    Ask4PermissionDuplicateTestMsg = "5"
+    Ask4PermissionMaintenanceMsg = "6" // followed by ;<seconds> until the server admits tests again
+    Ask4PermissionUpgradeRequiredMsg = "7" // followed by ;<oldest supported client version>
+    Ask4PermissionServerBusyMsg = "8" // followed by ;<estimated seconds until a replay slot is free>
+    Ask4PermissionLinkTooSlowMsg = "9" // followed by ;<Mbps the bandwidth probe measured>;<average Mbps of the replay>
+    MaxSideChannelRTTSamples = 100 // maximum number of side channel RTT samples stored per test
+    MaxThroughputSamples = 100 * DefaultSamplesPerReplay // maximum number of throughputs or sample times accepted for a replay
+    sendLedgerResolution = 10 * time.Millisecond // bytes sent within this long of each other are combined in the send ledger
+    MinTruncatedReplayDuration = 5 * time.Second // shortest replay a client can ask for; shorter replays have too few samples to analyze
+    MaxExperimentFlagsLen = 256 // longest experiment flags a client can send, in bytes
+)
+
+var (
+    resultsLayout = artifacts.DefaultLayout() // where result files are written in the results directories
+    anonymizer = anonymize.Default() // anonymizes client IPs written to the result files
+    denialLog *denials.Log // records tests that are denied permission to run; nil if denials aren't recorded
+    testReporter *report.Reporter // records finished tests for the daily report; nil if there is no report
+    clk clock.Clock = clock.Real{} // the time source for test timestamps, durations, and waits
+    decisionPolicy = analysis.DefaultPolicy // the thresholds used to decide if a test shows differentiation
+    decisionPolicyMutex sync.Mutex // prevents decisionPolicy from being read while it is reloaded
+    replayGroups *ReplayGroups // groups of replays that must not run at the same time; nil if there are none
+    replayScheduler *ReplayScheduler // limits the number of replays running at the same time; nil if there is no limit
+    dataProfiles *DataProfiles // what is stored about tests by client country; nil if every client is stored the same way
+    verdictNotifier *notify.Notifier // posts verdicts to the mobile backend for push notifications; nil if verdicts aren't posted
+    maintenanceCalendar *maintenance.Calendar // windows during which new tests aren't admitted; nil if there are none
+    resourceMonitor ResourceMonitor = NewResourceSampler(DefaultResourceSampleInterval, DefaultResourceAverageWindow) // reads the load of the server to decide if it can admit a test; its readings fail until it is started
+    fairnessPolicy FairnessPolicy = FirstComeFairness{} // decides which users can start tests when the server is busy
+    bandwidthLedger *BandwidthLedger // the bytes sent to each user this month and their cap; nil if usage isn't tracked per user
+    samplesPerReplay = DefaultSamplesPerReplay // throughput samples clients are told to take per replay unless they ask for another number
+    minSamplesPerReplay = DefaultSamplesPerReplay // fewest throughput samples a client can ask to take per replay
+    maxSamplesPerReplay = DefaultSamplesPerReplay // most throughput samples a client can ask to take per replay
+    resultsStore ResultsStore // stores the results of tests alongside the result files; nil if they are only written to files
+    bandwidthProbes *BandwidthProbes // bandwidth probes that clients run before heavy replays; nil if clients can't run them
+    anomalyDetector *anomaly.Detector // watches the verdicts of the node for signs of a node problem; nil if they aren't watched
+    minThroughputSamples = 0 // fewest throughput samples each replay needs for a test to be decided; 0 for no minimum
 )
 
+// Sets the number of throughput samples clients are told to take per replay. Clients take whatever
+// number they are told, so it can be changed without updating them. Newer clients can ask for
+// another number when they declare a replay, which is kept within the bounds. This should be called
+// before any clients connect.
+// samples: the samples per replay of clients that don't ask for a number
+// minSamples: the fewest samples per replay a client can ask for
+// maxSamples: the most samples per replay a client can ask for
+func SetSamplesPerReplay(samples int, minSamples int, maxSamples int) {
+    samplesPerReplay = samples
+    minSamplesPerReplay = minSamples
+    maxSamplesPerReplay = maxSamples
+}
+
+// Gets the number of throughput samples clients are told to take per replay if they don't ask for
+// another number.
+// Returns the samples per replay
+func SamplesPerReplay() int {
+    return samplesPerReplay
+}
+
+// Parses the number of throughput samples a client asked to take per replay.
+// samples: the number the client sent; 0 or empty to take the number the server picks
+// Returns the number, 0 if the client didn't ask for one, or an error if it isn't a number or is
+//     negative
+func ParseSamplesPerReplay(samples string) (int, error) {
+    if samples == "" {
+        return 0, nil
+    }
+    requested, err := strconv.Atoi(samples)
+    if err != nil {
+        return 0, errs.Malformed(err)
+    }
+    if requested < 0 {
+        return 0, fmt.Errorf("%w: requested %d throughput samples per replay\n", errs.ErrMalformedMessage, requested)
+    }
+    return requested, nil
+}
+
+// Sets the fewest throughput samples each replay of a test needs for the K-S tests to be run on it.
+// Tests with fewer, e.g. because a replay was cut very short, are inconclusive. This should be called
+// before any clients connect.
+// samples: the fewest samples; 0 for no minimum
+func SetMinThroughputSamples(samples int) {
+    minThroughputSamples = samples
+}
+
+// Sets the layout of the result files written for each test. This should be called before any
+// clients connect.
+// layout: the results layout
+func SetResultsLayout(layout *artifacts.Layout) {
+    resultsLayout = layout
+}
+
+// Sets how client IPs are anonymized in the result files. This should be called before any clients
+// connect.
+// anon: the anonymizer
+func SetAnonymizer(anon anonymize.Anonymizer) {
+    anonymizer = anon
+}
+
+// Anonymizes a client IP the way the result files and dashboards show it.
+// ip: the IP of the client
+// Returns the anonymized IP or any errors
+func AnonymizeIP(ip string) (string, error) {
+    return anonymizer.IPString(ip)
+}
+
+// Sets the log that tests denied permission to run are recorded in. This should be called before any
+// clients connect.
+// log: the denial log
+func SetDenialLog(log *denials.Log) {
+    denialLog = log
+}
+
+// Sets the time source used by clients. Tests can use a fake clock to check timestamps and
+// durations deterministically. This should be called before any clients connect.
+// c: the clock
+func SetClock(c clock.Clock) {
+    clk = c
+}
+
+// Sets the reporter that finished tests are recorded with for the daily report. This should be
+// called before any clients connect.
+// reporter: the test reporter
+func SetTestReporter(reporter *report.Reporter) {
+    testReporter = reporter
+}
+
+// Sets the groups of replays that must not run at the same time. This should be called before any
+// clients connect.
+// groups: the replay groups
+func SetReplayGroups(groups *ReplayGroups) {
+    replayGroups = groups
+}
+
+// Sets the scheduler that limits the number of replays running at the same time. This should be
+// called before any clients connect.
+// scheduler: the replay scheduler
+func SetReplayScheduler(scheduler *ReplayScheduler) {
+    replayScheduler = scheduler
+}
+
+// Sets the data-handling profiles that change what is stored about tests by the country of the
+// client. This should be called before any clients connect.
+// profiles: the data-handling profiles
+func SetDataProfiles(profiles *DataProfiles) {
+    dataProfiles = profiles
+}
+
+// Sets the notifier that verdicts are posted with as soon as tests are analyzed. This should be
+// called before any clients connect.
+// notifier: the verdict notifier
+func SetVerdictNotifier(notifier *notify.Notifier) {
+    verdictNotifier = notifier
+}
+
+// Sets the detector that the verdicts of analyzed tests are checked with for signs of a problem with
+// the node. This should be called before any clients connect.
+// detector: the anomaly detector
+func SetAnomalyDetector(detector *anomaly.Detector) {
+    anomalyDetector = detector
+}
+
+// Sets the maintenance windows during which new tests aren't admitted. This should be called before
+// any clients connect.
+// calendar: the maintenance calendar
+func SetMaintenanceCalendar(calendar *maintenance.Calendar) {
+    maintenanceCalendar = calendar
+}
+
+// Sets where the load of the server is read from when deciding if it can admit a test. This should
+// be called before any clients connect.
+// monitor: the resource monitor
+func SetResourceMonitor(monitor ResourceMonitor) {
+    resourceMonitor = monitor
+}
+
+// Sets the policy that decides which users can start tests when the server is busy. This should be
+// called before any clients connect.
+// policy: the fairness policy
+func SetFairnessPolicy(policy FairnessPolicy) {
+    fairnessPolicy = policy
+}
+
+// Sets the ledger that the bytes sent to each user are counted in and that caps their monthly usage.
+// This should be called before any clients connect.
+// ledger: the bandwidth ledger
+func SetBandwidthLedger(ledger *BandwidthLedger) {
+    bandwidthLedger = ledger
+}
+
+// Sets how clients probe their bandwidth before heavy replays. This should be called before any
+// clients connect.
+// probes: the bandwidth probes
+func SetBandwidthProbes(probes *BandwidthProbes) {
+    bandwidthProbes = probes
+}
+
+// Gets how clients probe their bandwidth before heavy replays.
+// Returns the bandwidth probes, or nil if clients can't run them
+func GetBandwidthProbes() *BandwidthProbes {
+    return bandwidthProbes
+}
+
+// Sets the policy used to decide if tests show differentiation. Tests analyzed after the call use the
+// new policy, so it can be called while clients are connected.
+// policy: the decision policy
+func SetDecisionPolicy(policy analysis.DecisionPolicy) {
+    decisionPolicyMutex.Lock()
+    defer decisionPolicyMutex.Unlock()
+    decisionPolicy = policy
+}
+
+// Sets where the results of tests are stored alongside the result files. This should be called
+// before any clients connect.
+// store: the results store
+func SetResultsStore(store ResultsStore) {
+    resultsStore = store
+}
+
+// Gets where the results of tests are stored alongside the result files.
+// Returns the results store, or nil if results are only written to files
+func GetResultsStore() ResultsStore {
+    return resultsStore
+}
+
+// Gets the policy used to decide if tests show differentiation.
+// Returns the decision policy
+func GetDecisionPolicy() analysis.DecisionPolicy {
+    decisionPolicyMutex.Lock()
+    defer decisionPolicyMutex.Unlock()
+    return decisionPolicy
+}
+
 //TODO: move to replay file when that exists
 type ReplayType int
 
+// The numbers are sent by clients in declare ID and declare replay, and are part of the names of the
+// result files of each replay.
 const (
-    Original ReplayType = iota
-    Random
+    Original ReplayType = iota // the traffic of the app
+    Random // the traffic of the app with its payloads randomized
+    BitInverted // the traffic of the app with every payload bit inverted
+    PortChanged // the traffic of the app sent to a different port than the app uses
+    Tunneled // the traffic of the app sent by the client through a VPN tunnel
 )
 
+// The clients running replays. Clients that send a replay token are keyed by the token, and the
+// rest by IP; IPs can be given in any form, as they are normalized so that an IPv6 client is found
+// however its address is written.
 type ConnectedClients struct {
-    clientIPs map[string]string // map of all currently connected client IPs to the replay they want to run
-    mutex sync.Mutex // prevents multiple goroutines from accessing ClientIPs
+    clients map[string]*connectedClient // map of the key of each connected client to the replay it wants to run
+    ips map[string]int // number of connected clients on each normalized IP
+    nextID uint64 // ID given to the next client added
+    mutex sync.Mutex // prevents multiple goroutines from accessing clients and ips
+}
+
+// The replay that a connected client is running and any errors the replay servers encountered while
+// sending it.
+type connectedClient struct {
+    id uint64 // identifies the client to operators without revealing its IP
+    ip string // the normalized IP of the client
+    testID string // the ID of the test the replay is part of; empty if it isn't part of a test
+    replayName string // the name of the replay the client wants to run
+    replayErrors []string // errors that occurred while sending the replay packets
+    replayAborted bool // true if the replay servers stopped sending the replay because of an error
+    requestHashMismatches []int // response sets, starting at 1, whose request from the client didn't match the replay
+    pathMTU *PathMTUReport // the UDP replay packets that were larger than the path MTU to the client; nil if they weren't checked
+    jitter *JitterReport // the jitter the UDP replay servers measured; nil if none measured any
+    sendLedger []SentBytes // bytes the replay servers sent to the client during the current replay
+    bytesSent int64 // bytes the replay servers sent to the client during the current replay that haven't been counted against the user
+    connectedSince time.Time // time the client was granted permission to run the replay
+    replayStart time.Time // time the first replay server started sending the replay; zero until one does
+    maxDuration time.Duration // how long the replay servers send the replay for; 0 to send the whole replay
+    replayTimeout time.Duration // how long the UDP replay servers send the replay for before cutting it off; 0 for the UDP replay timeout
+    logger *slog.Logger // logs with the fields that identify the test of the client
+}
+
+// A client that is running a replay, as shown to operators.
+type ConnectedClientInfo struct {
+    ID uint64 `json:"id"` // identifies the client, e.g. to evict it; IDs aren't reused while the server runs
+    IP string `json:"ip"` // the anonymized IP of the client
+    TestID string `json:"test_id,omitempty"` // the ID of the test the replay is part of; omitted if it isn't part of a test
+    ReplayName string `json:"replay_name"` // the name of the replay the client is running
+    ConnectedSince time.Time `json:"connected_since"` // time the client was granted permission to run the replay
+    ElapsedSeconds float64 `json:"elapsed_seconds"` // time since the client was granted permission to run the replay
+    BytesSent int `json:"bytes_sent"` // bytes the replay servers have sent to the client during the current replay
+}
+
+// Bytes that the replay servers sent to a client. The ledger of bytes sent is used to derive the
+// throughputs of a replay if the client disconnects before sending its own.
+type SentBytes struct {
+    Time time.Time // time the first of the bytes were sent
+    Bytes int // number of bytes sent
 }
 
 func NewConnectedClients() *ConnectedClients {
     return &ConnectedClients{
-        clientIPs: make(map[string]string),
+        clients: make(map[string]*connectedClient),
+        ips: make(map[string]int),
     }
 }
 
+// Gets the key that the replay servers look up a client by. A client that started its replay packets
+// with a replay token is looked up by the token; otherwise, or if no client has the token, it is
+// looked up by the IP the packets came from.
+// token: the replay token at the start of the first replay packet; empty if there was none
+// ip: the IP the replay packets came from
+// Returns the key of the client
+func (connectedClients *ConnectedClients) Resolve(token string, ip string) string {
+    if token != "" && connectedClients.Has(token) {
+        return token
+    }
+    return clientKey(ip)
+}
+
+// Checks if any client on an IP is running a replay, whether it is looked up by IP or by replay
+// token.
+// ip: the IP
+// Returns true if a client on the IP is running a replay; false otherwise
+func (connectedClients *ConnectedClients) HasIP(ip string) bool {
+    return connectedClients.ClientsOnIP(ip) > 0
+}
+
+// Counts the clients on an IP that are running a replay.
+// ip: the IP
+// Returns the number of clients on the IP
+func (connectedClients *ConnectedClients) ClientsOnIP(ip string) int {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    return connectedClients.ips[clientKey(ip)]
+}
+
 // Checks if client is currently running a replay.
-// ip: IP of the client
+// key: the key of the client, from Resolve
 // Returns true if client is running a replay; false otherwise
-func (connectedClients *ConnectedClients) Has(ip string) bool {
+func (connectedClients *ConnectedClients) Has(key string) bool {
     connectedClients.mutex.Lock()
     defer connectedClients.mutex.Unlock()
-    _, exists := connectedClients.clientIPs[ip]
+    _, exists := connectedClients.clients[clientKey(key)]
     return exists
 }
 
 // Gets the replay name that a connected client is currently running.
-// ip: IP of the client
+// key: the key of the client, from Resolve
 // Returns the replay name of the client with the given IP or any errors
-func (connectedClients *ConnectedClients) Get(ip string) (string, error) {
+func (connectedClients *ConnectedClients) Get(key string) (string, error) {
     connectedClients.mutex.Lock()
     defer connectedClients.mutex.Unlock()
-    replayName, exists := connectedClients.clientIPs[ip]
+    client, exists := connectedClients.clients[clientKey(key)]
     if exists {
-        return replayName, nil
+        return client.replayName, nil
     } else {
-        return "", fmt.Errorf("%s is not currently running a replay.\n", ip)
+        return "", fmt.Errorf("%w: %s is not currently running a replay.\n", errs.ErrPermissionDenied, key)
     }
 }
 
-// Adds a client with it starts a replay.
+// Gets a logger for the replay servers whose lines identify the test of a connected client, so that
+// they can be matched with the lines of its side channel.
+// key: the key of the client, from Resolve
+// Returns the logger of the test, or a logger with just the client IP if the client isn't running a
+//     replay
+func (connectedClients *ConnectedClients) Logger(key string) *slog.Logger {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    if !exists {
+        return slog.With("client_ip", key)
+    }
+    return client.logger
+}
+
+// Gets how long the replay servers should send the replay of a connected client for. Clients on small
+// data plans can ask for a shortened replay.
+// key: the key of the client, from Resolve
+// Returns the longest the replay should run, or 0 if the whole replay should be sent
+func (connectedClients *ConnectedClients) MaxDuration(key string) time.Duration {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    if !exists {
+        return 0
+    }
+    return client.maxDuration
+}
+
+// Sets how long the UDP replay servers send the current replay of a client for before cutting it off.
+// key: the key of the client, from Resolve
+// timeout: the timeout of the replay; 0 for the UDP replay timeout
+func (connectedClients *ConnectedClients) SetReplayTimeout(key string, timeout time.Duration) {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    if exists {
+        client.replayTimeout = timeout
+    }
+}
+
+// Gets how long the UDP replay servers send the current replay of a client for before cutting it off.
+// key: the key of the client, from Resolve
+// Returns the timeout of the replay, or 0 if the client isn't running a replay or the replay has the
+//     UDP replay timeout
+func (connectedClients *ConnectedClients) ReplayTimeout(key string) time.Duration {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    if !exists {
+        return 0
+    }
+    return client.replayTimeout
+}
+
+// Lists the clients that are running a replay. IPs are anonymized so that the list can be shown on
+// dashboards.
+// Returns the connected clients, sorted by the time they connected
+func (connectedClients *ConnectedClients) List() []ConnectedClientInfo {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    clients := make([]ConnectedClientInfo, 0, len(connectedClients.clients))
+    now := clk.Now()
+    for _, client := range connectedClients.clients {
+        clients = append(clients, client.info(now))
+    }
+    sort.Slice(clients, func(i, j int) bool {
+        return clients[i].ConnectedSince.Before(clients[j].ConnectedSince)
+    })
+    return clients
+}
+
+// Gets a connected client as shown to operators.
+// now: the current time
+// Returns the client with its IP anonymized
+func (client *connectedClient) info(now time.Time) ConnectedClientInfo {
+    anonIP, err := anonymizer.IPString(client.ip)
+    if err != nil {
+        anonIP = "unknown"
+    }
+    bytesSent := 0
+    for _, sent := range client.sendLedger {
+        bytesSent += sent.Bytes
+    }
+    return ConnectedClientInfo{
+        ID: client.id,
+        IP: anonIP,
+        TestID: client.testID,
+        ReplayName: client.replayName,
+        ConnectedSince: client.connectedSince,
+        ElapsedSeconds: now.Sub(client.connectedSince).Seconds(),
+        BytesSent: bytesSent,
+    }
+}
+
+// Records an error that a replay server encountered while sending replay packets to a client, so
+// that the error can be reported back to the client over the side channel.
+// key: the key of the client, from Resolve
+// err: the error that occurred
+// aborted: true if the replay server stopped sending the replay because of the error
+func (connectedClients *ConnectedClients) AddReplayError(key string, err error, aborted bool) {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    if !exists {
+        return
+    }
+    client.replayErrors = append(client.replayErrors, err.Error())
+    client.replayAborted = client.replayAborted || aborted
+}
+
+// Retrieves and clears the replay errors recorded for a client.
+// key: the key of the client, from Resolve
+// Returns the errors that occurred while sending the replay and true if the replay was aborted
+func (connectedClients *ConnectedClients) TakeReplayErrors(key string) ([]string, bool) {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    if !exists {
+        return nil, false
+    }
+    replayErrors := client.replayErrors
+    aborted := client.replayAborted
+    client.replayErrors = nil
+    client.replayAborted = false
+    return replayErrors, aborted
+}
+
+// Records that the request a client sent before a response set of a TCP replay didn't hash to the
+// request in the replay file.
+// key: the key of the client, from Resolve
+// responseSet: the number of the response set, starting at 1
+func (connectedClients *ConnectedClients) AddRequestHashMismatch(key string, responseSet int) {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    if !exists {
+        return
+    }
+    client.requestHashMismatches = append(client.requestHashMismatches, responseSet)
+}
+
+// Retrieves and clears the request hash mismatches recorded for a client.
+// key: the key of the client, from Resolve
+// Returns the response sets, starting at 1, whose request didn't match the replay
+func (connectedClients *ConnectedClients) TakeRequestHashMismatches(key string) []int {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    if !exists {
+        return nil
+    }
+    mismatches := client.requestHashMismatches
+    client.requestHashMismatches = nil
+    return mismatches
+}
+
+// Records what happened to the packets of a UDP replay that were larger than the path MTU to a client.
+// A replay sent from several ports reports once per port, and the reports are added up.
+// key: the key of the client, from Resolve
+// report: the packets that were too large
+func (connectedClients *ConnectedClients) SetPathMTUReport(key string, report PathMTUReport) {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    if !exists {
+        return
+    }
+    if client.pathMTU != nil {
+        previous := client.pathMTU
+        report.LargestPayload = max(report.LargestPayload, previous.LargestPayload)
+        if previous.PathMTU > 0 && (report.PathMTU == 0 || previous.PathMTU < report.PathMTU) {
+            report.PathMTU = previous.PathMTU
+        }
+        report.Skipped += previous.Skipped
+        report.Clamped += previous.Clamped
+    }
+    client.pathMTU = &report
+}
+
+// Gets the time the replay of a client started, so that the replay servers on different ports pace
+// their packets from the same start. The first server to ask sets it.
+// key: the key of the client, from Resolve
+// now: the time the server asking started sending
+// Returns the start of the replay, or now if the client isn't connected
+func (connectedClients *ConnectedClients) ReplayStart(key string, now time.Time) time.Time {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    if !exists {
+        return now
+    }
+    if client.replayStart.IsZero() {
+        client.replayStart = now
+    }
+    return client.replayStart
+}
+
+// Retrieves and clears the path MTU report recorded for a client.
+// key: the key of the client, from Resolve
+// Returns the report, or nil if the replay packets weren't checked against the path MTU
+func (connectedClients *ConnectedClients) TakePathMTUReport(key string) *PathMTUReport {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    if !exists {
+        return nil
+    }
+    report := client.pathMTU
+    client.pathMTU = nil
+    return report
+}
+
+// Records bytes that a replay server sent to a client. Sends that are close together are combined
+// so that the ledger stays small for replays with many packets.
+// key: the key of the client, from Resolve
+// sentTime: time the bytes were sent
+// numBytes: number of bytes sent
+func (connectedClients *ConnectedClients) RecordSent(key string, sentTime time.Time, numBytes int) {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    if !exists {
+        return
+    }
+    client.bytesSent += int64(numBytes)
+    ledgerLen := len(client.sendLedger)
+    if ledgerLen > 0 && sentTime.Sub(client.sendLedger[ledgerLen - 1].Time) < sendLedgerResolution {
+        client.sendLedger[ledgerLen - 1].Bytes += numBytes
+        return
+    }
+    client.sendLedger = append(client.sendLedger, SentBytes{
+        Time: sentTime,
+        Bytes: numBytes,
+    })
+}
+
+// Retrieves and clears the ledger of bytes sent to a client during the current replay.
+// key: the key of the client, from Resolve
+// Returns the bytes sent, in the order they were sent
+func (connectedClients *ConnectedClients) TakeSendLedger(key string) []SentBytes {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    if !exists {
+        return nil
+    }
+    sendLedger := client.sendLedger
+    client.sendLedger = nil
+    return sendLedger
+}
+
+// Retrieves and clears the number of bytes sent to a client during the current replay. Unlike the
+// send ledger, the count is kept when the client sends its own throughputs.
+// key: the key of the client, from Resolve
+// Returns the number of bytes sent
+func (connectedClients *ConnectedClients) TakeBytesSent(key string) int64 {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    if !exists {
+        return 0
+    }
+    bytesSent := client.bytesSent
+    client.bytesSent = 0
+    return bytesSent
+}
+
+// Gets the number of clients currently running a replay.
+// Returns the number of connected clients
+func (connectedClients *ConnectedClients) Len() int {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    return len(connectedClients.clients)
+}
+
+// Adds a client when it starts a replay.
+// key: the key of the client; its replay token, or its IP if it doesn't send one
 // ip: the IP of the client
+// testID: the ID of the test the replay is part of; empty if it isn't part of a test
 // replayName: the name of the replay that the client would like to run
-func (connectedClients *ConnectedClients) add(ip string, replayName string) {
+// maxDuration: how long the replay should be sent for; 0 to send the whole replay
+// logger: logs with the fields that identify the test of the client
+func (connectedClients *ConnectedClients) add(key string, ip string, testID string, replayName string, maxDuration time.Duration, logger *slog.Logger) {
     connectedClients.mutex.Lock()
     defer connectedClients.mutex.Unlock()
-    connectedClients.clientIPs[ip] = replayName
+    key = clientKey(key)
+    connectedClients.remove(key)
+    connectedClients.nextID++
+    client := &connectedClient{
+        id: connectedClients.nextID,
+        ip: clientKey(ip),
+        testID: testID,
+        replayName: replayName,
+        connectedSince: clk.Now().UTC(),
+        maxDuration: maxDuration,
+        logger: logger,
+    }
+    connectedClients.clients[key] = client
+    connectedClients.ips[client.ip]++
+}
+
+// Gives an IP permission to run a replay outside of a test, so that the replay servers send it the
+// replay, e.g. to check what they send for a replay before it is published.
+// ip: the IP that runs the replay
+// replayName: the name of the replay
+func (connectedClients *ConnectedClients) Grant(ip string, replayName string) {
+    connectedClients.add(ip, ip, "", replayName, 0, slog.With("client_ip", ip, "replay", replayName))
+}
+
+// Takes away the permission given to an IP by Grant.
+// ip: the IP that ran the replay
+func (connectedClients *ConnectedClients) Revoke(ip string) {
+    connectedClients.del(ip)
+}
+
+// Checks if any client was granted its replay before a time, e.g. so that a test port that was
+// removed is kept open until the clients that may have been sent to it are done.
+// t: the time
+// Returns true if a client that is still running a replay was granted it before t
+func (connectedClients *ConnectedClients) GrantedBefore(t time.Time) bool {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    for _, client := range connectedClients.clients {
+        if client.connectedSince.Before(t) {
+            return true
+        }
+    }
+    return false
+}
+
+// Removes clients that were granted their replay longer ago than a test can last. Their side
+// channel connections should have removed them when they closed.
+// maxAge: how long a test can last
+// Returns the IPs of the removed clients
+func (connectedClients *ConnectedClients) ReapStale(maxAge time.Duration) []string {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    var reaped []string
+    now := clk.Now()
+    for key, client := range connectedClients.clients {
+        if now.Sub(client.connectedSince) > maxAge {
+            connectedClients.remove(key)
+            reaped = append(reaped, client.ip)
+        }
+    }
+    return reaped
+}
+
+// Finds the connected clients that match a condition, e.g. so that an operator can pick out a
+// client by its anonymized IP or test ID.
+// match: checks if a client, as shown to operators, is one being looked for
+// Returns the IPs of the matching clients and the clients as shown to operators, in the same order
+func (connectedClients *ConnectedClients) Find(match func(ConnectedClientInfo) bool) ([]string, []ConnectedClientInfo) {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    var ips []string
+    var clients []ConnectedClientInfo
+    now := clk.Now()
+    for _, client := range connectedClients.clients {
+        info := client.info(now)
+        if match(info) {
+            ips = append(ips, client.ip)
+            clients = append(clients, info)
+        }
+    }
+    return ips, clients
+}
+
+// Removes a client that an operator found stuck, so that it can run a replay again. The side
+// channel of the client isn't closed; it fails or times out on its own once the replay servers stop
+// serving the client.
+// id: the ID of the client, from List
+// Returns the removed client and true, or false if no client has the ID
+func (connectedClients *ConnectedClients) Evict(id uint64) (ConnectedClientInfo, bool) {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    for key, client := range connectedClients.clients {
+        if client.id == id {
+            connectedClients.remove(key)
+            return client.info(clk.Now()), true
+        }
+    }
+    return ConnectedClientInfo{}, false
 }
 
 // Removes a client.
-// ip: the IP of the client to remove
-func (connectedClients *ConnectedClients) del(ip string) {
+// key: the key of the client to remove
+func (connectedClients *ConnectedClients) del(key string) {
     connectedClients.mutex.Lock()
     defer connectedClients.mutex.Unlock()
-    delete(connectedClients.clientIPs, ip)
+    connectedClients.remove(clientKey(key))
+}
+
+// Removes a client and its count on its IP. The mutex must be held.
+// key: the normalized key of the client to remove
+func (connectedClients *ConnectedClients) remove(key string) {
+    client, exists := connectedClients.clients[key]
+    if !exists {
+        return
+    }
+    delete(connectedClients.clients, key)
+    connectedClients.ips[client.ip]--
+    if connectedClients.ips[client.ip] <= 0 {
+        delete(connectedClients.ips, client.ip)
+    }
+}
+
+// What happened to the packets of a UDP replay that were larger than the path MTU to the client. The
+// replay servers only learn the path MTU when the packets are sent with the DF bit set.
+type PathMTUReport struct {
+    PathMTU int `json:"path_mtu"` // the smallest path MTU to the client seen during the replay; 0 if no packet was too large
+    LargestPayload int `json:"largest_payload"` // bytes in the largest payload sent
+    Skipped int `json:"skipped"` // packets that weren't sent because they were larger than the path MTU
+    Clamped int `json:"clamped"` // packets that were cut to fit the path MTU
 }
 
 // Information about the data generated from a replay.
 type ReplayResult struct {
-    ReplayID ReplayType // indicates whether replay is the original or random replay
+    ReplayID ReplayType // indicates whether replay is the original, random, or a control replay
     ReplayName string // name of the replay to run
     Throughputs []float64 // throughput samples
     SampleTimes []float64 // list of the number of seconds since start of replay that each throughput sample was captured
     ReplayDuration time.Duration // time it took to run the replay
+    ReplayErrors []string // errors the replay servers encountered while sending the replay packets
+    Aborted bool // true if the replay servers stopped sending the replay because of an error
+    ServerDerivedThroughputs bool // true if the throughputs were derived from the bytes the server sent because the client never sent any
+    ServerThroughputs []float64 // throughputs sampled from the bytes the replay servers sent, kept alongside the throughputs of the client; nil if nothing was sent
+    ServerSampleTimes []float64 // number of seconds since the first byte the replay servers sent at the end of each of ServerThroughputs
+    SamplesPerReplay int // throughput samples the client was told to take during the replay
+    MaxDuration time.Duration // how long the client asked the replay to run for; 0 if the whole replay was run
+    Latencies map[LatencyPhase]LatencySeries // RTTs to the replay port measured by the client; nil if it didn't measure any
+    BytesSent int64 // bytes the replay servers sent to the client during the replay
+    RequestHashMismatches []int // response sets, starting at 1, whose request from the client didn't match the replay; nil if all matched or weren't checked
+    PathMTU *PathMTUReport // the packets of a UDP replay that were larger than the path MTU; nil if they weren't checked
+    Loss map[int]analysis.LossStats // the TCP packets the server sent on each port, from a packet capture; key is the server port. nil if they weren't captured
+    ReplayTimeout time.Duration // how long the UDP replay servers sent the replay for before cutting it off; 0 for TCP replays
+    TimeoutTruncated bool // true if the replay lasts longer than its timeout, so its end was never sent
+    Jitter *JitterReport // the jitter the UDP replay servers measured; nil for TCP replays
+    Provenance *testdata.Provenance // where the traffic of the replay came from; nil if the replay file doesn't say
 }
 
 // Information about a client. Each test gets a Client struct.
@@ -109,13 +847,28 @@ type Client struct {
     TestID int // the ID of the test for the particular user
     IsLastReplay bool // true if this is the last replay of the test; false otherwise
     PublicIP string // public IP of the client retrieved from the test port
+    ReplayToken string // sent by the client at the start of its replays so that the replay servers can tell it apart from other clients on its IP; empty if it doesn't send one
     ClientVersion string // client version number of Wehe
+    ExperimentFlags string // identifies the experiments the client is part of, e.g. A/B flags, as the client sent them; empty if it sent none
+    Capabilities compat.Capabilities // what the client's version sends and expects
     MobileStats map[string]interface{} // information about the client device
+    CountryCode string // two letter code of the country of the client; empty if the client didn't share its location
     StartTime time.Time // time when side channel connection was made
-    Exceptions string // any errors that occurred while running a replay
+    Exceptions *ExceptionLog // any errors that occurred while running the test
     MLabUUID string // globally unique ID for M-Lab
     ReplayResults []ReplayResult // data collected from running a replay TODO: rename this something like ReplayInfo to make less confusing
     Analysis *analysis.AnalysisResults // analysis results of the test
+    AnalysisWindow time.Duration // how much of the start of the replays the analysis compared; 0 if the whole replays were compared
+    VariantResults []VariantResult // comparisons of the control replays against the original replay; nil if the test had none
+    LatencyAnalysis *analysis.LatencyResults // comparison of the RTTs measured during the replays; nil if they weren't compared
+    Localization *analysis.LocalizationResults // comparison of the packets the server retransmitted during the replays; nil if they weren't captured
+    Attempt int // number of times this userID and testID has been submitted; results of attempts after the first are written as <testID>_attempt<Attempt>
+    IsDuplicate bool // true if results for this userID and testID already exist and duplicates are rejected
+    SideChannelRTTs []float64 // round trip times of the side channel measured with pings, in milliseconds
+    BandwidthProbe *BandwidthProbeResult // the bandwidth probe the client ran before its replays; nil if it didn't run one
+    pingSeq int // sequence number of the last ping token sent to the client
+    pingSentTime time.Time // time when the last ping token was sent to the client
+    connectedAt time.Time // StartTime with its monotonic clock reading, used to measure time since the side channel connection was made
 }
 
 // Constructs a new Client.
@@ -128,6 +881,7 @@ type Client struct {
 // mlabUUID: globally unique ID for M-Lab
 // Returns a pointer to a Client
 func NewClient(conn net.Conn, userID string, extraString string, testID int, publicIP string, clientVersion string, mlabUUID string) *Client {
+    connectedAt := clk.Now()
     return &Client{
         Conn: conn,
         UserID: userID,
@@ -135,9 +889,12 @@ func NewClient(conn net.Conn, userID string, extraString string, testID int, pub
         TestID: testID,
         PublicIP: publicIP,
         ClientVersion: clientVersion,
-        StartTime: time.Now().UTC(),
-        Exceptions: "NoExp",
+        Capabilities: compat.For(clientVersion),
+        StartTime: connectedAt.UTC(),
+        connectedAt: connectedAt,
+        Exceptions: &ExceptionLog{},
         MLabUUID: mlabUUID,
+        Attempt: 1,
         ReplayResults: []ReplayResult{},
     }
 }
@@ -150,11 +907,165 @@ func (clt *Client) AddReplay(replayID ReplayType, replayName string, isLastRepla
     replayResult := ReplayResult{
         ReplayID: replayID,
         ReplayName: replayName,
+        SamplesPerReplay: samplesPerReplay,
+    }
+    if replayRegistry != nil {
+        metadata, exists := replayRegistry.Get(replayName)
+        if exists {
+            replayResult.Provenance = metadata.Provenance
+        }
     }
     clt.ReplayResults = append(clt.ReplayResults, replayResult)
     clt.IsLastReplay = isLastReplay
 }
 
+// Shortens the current replay at the request of the client, e.g. for a user with a small data plan.
+// The replay servers stop sending the replay after maxDuration.
+// maxDuration: how long the replay should run for; 0 to run the whole replay
+// Returns any errors
+func (clt *Client) SetMaxReplayDuration(maxDuration time.Duration) error {
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return err
+    }
+    currentReplay.MaxDuration = maxDuration
+    return nil
+}
+
+// Sets the number of throughput samples the client takes during the current replay to the number
+// it asked for, kept between the fewest and the most that the server allows. The replays of a test
+// can take different numbers of samples; the analysis compares them either way.
+// requested: the samples per replay the client asked for; 0 to take the number the server picks
+// Returns any errors
+func (clt *Client) NegotiateSamplesPerReplay(requested int) error {
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return err
+    }
+    if requested == 0 {
+        currentReplay.SamplesPerReplay = samplesPerReplay
+    } else {
+        currentReplay.SamplesPerReplay = min(max(requested, minSamplesPerReplay), maxSamplesPerReplay)
+    }
+    return nil
+}
+
+// Sets how long the UDP replay servers send the current replay for before cutting it off.
+// timeout: the timeout of the replay
+// truncated: true if the replay lasts longer than the timeout
+// Returns any errors
+func (clt *Client) SetReplayTimeout(timeout time.Duration, truncated bool) error {
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return err
+    }
+    currentReplay.ReplayTimeout = timeout
+    currentReplay.TimeoutTruncated = truncated
+    return nil
+}
+
+// Parses the replay duration requested by a client.
+// seconds: the number of seconds the client would like the replay to run for; 0 or empty to run the
+//     whole replay
+// Returns the duration, or an error if it isn't a number or is shorter than
+//     MinTruncatedReplayDuration
+func ParseMaxReplayDuration(seconds string) (time.Duration, error) {
+    if seconds == "" {
+        return 0, nil
+    }
+    secondsFloat, err := strconv.ParseFloat(seconds, 64)
+    if err != nil {
+        return 0, errs.Malformed(err)
+    }
+    maxDuration := time.Duration(secondsFloat * float64(time.Second))
+    if maxDuration == 0 {
+        return 0, nil
+    }
+    if maxDuration < MinTruncatedReplayDuration {
+        return 0, fmt.Errorf("%w: requested replay duration %s is shorter than the minimum of %v\n", errs.ErrMalformedMessage, seconds, MinTruncatedReplayDuration)
+    }
+    return maxDuration, nil
+}
+
+// Parses the experiment flags sent by a client. The server doesn't read the flags; they are written
+// as they were sent with the results of each replay, so that the tests of an experiment that both
+// clients and servers take part in can be told apart downstream.
+// flags: the flags the client sent; empty if it sent none
+// Returns the flags, or an error if they are longer than MaxExperimentFlagsLen
+func ParseExperimentFlags(flags string) (string, error) {
+    if len(flags) > MaxExperimentFlagsLen {
+        return "", fmt.Errorf("%w: experiment flags are %d bytes, longer than the maximum of %d\n", errs.ErrMalformedMessage, len(flags), MaxExperimentFlagsLen)
+    }
+    return flags, nil
+}
+
+// Adds errors that the replay servers encountered while sending the current replay. Errors are also
+// recorded in the client exceptions so that they are written to the replay info.
+// replayErrors: the errors that occurred while sending the replay
+// aborted: true if the replay servers stopped sending the replay because of an error
+// Returns any errors
+func (clt *Client) AddReplayErrors(replayErrors []string, aborted bool) error {
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return err
+    }
+    if len(replayErrors) == 0 {
+        return nil
+    }
+    currentReplay.ReplayErrors = append(currentReplay.ReplayErrors, replayErrors...)
+    currentReplay.Aborted = currentReplay.Aborted || aborted
+    clt.addException(ReplayPhase, "ReplayError: " + strings.Join(replayErrors, "; "))
+    return nil
+}
+
+// Adds the response sets of the current replay whose request from the client didn't match the replay.
+// responseSets: the numbers of the response sets, starting at 1
+// Returns any errors
+func (clt *Client) AddRequestHashMismatches(responseSets []int) error {
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return err
+    }
+    currentReplay.RequestHashMismatches = append(currentReplay.RequestHashMismatches, responseSets...)
+    return nil
+}
+
+// Sets what happened to the packets of the current replay that were larger than the path MTU.
+// report: the report of the replay servers; nil if the packets weren't checked
+// Returns any errors
+func (clt *Client) SetPathMTUReport(report *PathMTUReport) error {
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return err
+    }
+    currentReplay.PathMTU = report
+    return nil
+}
+
+// Sets the TCP packets the server sent during the current replay, which the localization analysis
+// compares between the original and random replays.
+// loss: the packets sent on each port; key is the server port
+// Returns any errors
+func (clt *Client) SetReplayLoss(loss map[int]analysis.LossStats) error {
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return err
+    }
+    currentReplay.Loss = loss
+    return nil
+}
+
+// Gets a logger whose lines identify the test: the user ID, test ID, client IP, and the replay being
+// run, if there is one.
+// Returns the logger
+func (clt *Client) Logger() *slog.Logger {
+    logger := slog.With("user_id", clt.UserID, "test_id", clt.TestID, "client_ip", clt.PublicIP)
+    if len(clt.ReplayResults) > 0 {
+        logger = logger.With("replay", clt.ReplayResults[len(clt.ReplayResults) - 1].ReplayName)
+    }
+    return logger
+}
+
 // Retrieves the replay that was last added.
 // Returns the replay last added, or any errors
 func (clt *Client) GetCurrentReplay() (*ReplayResult, error) {
@@ -165,6 +1076,139 @@ func (clt *Client) GetCurrentReplay() (*ReplayResult, error) {
     return &clt.ReplayResults[len(clt.ReplayResults) - 1], nil
 }
 
+// Gets the test ID used in the names of the result files. This is the test ID, followed by the
+// attempt number if the test has been submitted more than once.
+// Returns the test ID used in result file names
+func (clt *Client) artifactTestID() string {
+    if clt.Attempt <= 1 {
+        return strconv.Itoa(clt.TestID)
+    }
+    return strconv.Itoa(clt.TestID) + "_attempt" + strconv.Itoa(clt.Attempt)
+}
+
+// Checks if results already exist for the userID and testID of the client, which happens when the
+// app resubmits a test, e.g. after crashing. Depending on the policy, the new results are either
+// written as a new attempt so that existing results are not overwritten, or the test is marked as
+// a duplicate so that permission to run it is denied. Note that for results layouts partitioned by
+// date, only resubmissions on the same day are detected.
+// resultsDir: the root directory of the results to look for existing results in
+// policy: "version" to write results as a new attempt, or "reject" to deny the test
+// Returns any errors
+func (clt *Client) CheckDuplicateTest(resultsDir string, policy string) error {
+    originalAttempt := clt.Attempt
+    defer func() {
+        if clt.IsDuplicate {
+            clt.Attempt = originalAttempt
+        }
+    }()
+
+    for clt.Attempt = originalAttempt; ; clt.Attempt++ {
+        exists, err := clt.hasResults(resultsDir)
+        if err != nil {
+            return err
+        }
+        if !exists {
+            return nil
+        }
+        if policy == "reject" {
+            clt.IsDuplicate = true
+            return nil
+        }
+    }
+}
+
+// Checks if any per-replay results have been written for the current attempt of the test.
+// resultsDir: the root directory of the results to look for existing results in
+// Returns true if results exist, or any errors
+func (clt *Client) hasResults(resultsDir string) (bool, error) {
+    for _, kind := range []artifacts.Kind{artifacts.ReplayInfo, artifacts.ClientThroughputs} {
+        for _, replayID := range replayTypes {
+            path, err := clt.artifactPath(resultsDir, kind, replayID)
+            if err != nil {
+                return false, err
+            }
+            _, err = os.Stat(path)
+            if err == nil {
+                return true, nil
+            }
+            if !os.IsNotExist(err) {
+                return false, err
+            }
+        }
+    }
+    return false, nil
+}
+
+// Gets the path of a result file of the test.
+// resultsDir: the root directory of the results
+// kind: the kind of result file
+// replayID: the replay the file belongs to; ignored for files written once per test
+// Returns the path of the result file or any errors
+func (clt *Client) artifactPath(resultsDir string, kind artifacts.Kind, replayID ReplayType) (string, error) {
+    info := artifacts.TestInfo{
+        UserID: clt.UserID,
+        TestID: clt.artifactTestID(),
+        ReplayID: int(replayID),
+        StartTime: clt.StartTime,
+    }
+    return resultsLayout.Path(resultsDir, kind, info)
+}
+
+// A result file of a test that exists on disk.
+type existingArtifact struct {
+    kind artifacts.Kind // the kind of result file
+    replayID ReplayType // the replay the file belongs to, if it is written once per replay
+    perReplay bool // true if the kind of file is written once per replay
+    path string // the path of the file
+}
+
+// Finds the result files that have been written for the test, other than its manifest.
+// resultsDir: the root directory of the results
+// Returns the result files that exist
+func (clt *Client) existingArtifacts(resultsDir string) []existingArtifact {
+    var existing []existingArtifact
+    perTest := []artifacts.Kind{artifacts.SideChannelRTT, artifacts.Decision, artifacts.AnalysisResults}
+    perReplay := []artifacts.Kind{artifacts.ReplayInfo, artifacts.ClientThroughputs, artifacts.ServerThroughputs, artifacts.ClientLatencies}
+    add := func(kind artifacts.Kind, replayID ReplayType, isPerReplay bool) {
+        path, err := clt.artifactPath(resultsDir, kind, replayID)
+        if err != nil {
+            return
+        }
+        _, err = os.Stat(path)
+        if err == nil {
+            existing = append(existing, existingArtifact{kind: kind, replayID: replayID, perReplay: isPerReplay, path: path})
+        }
+    }
+    for _, kind := range perReplay {
+        for _, replayID := range replayTypes {
+            add(kind, replayID, true)
+        }
+    }
+    for _, kind := range perTest {
+        add(kind, Original, false)
+    }
+    return existing
+}
+
+// Writes a result file of the test.
+// resultsDir: the root directory of the results
+// kind: the kind of result file
+// replayID: the replay the file belongs to; ignored for files written once per test
+// contents: the contents of the file to write
+// Returns any errors
+func (clt *Client) writeArtifact(resultsDir string, kind artifacts.Kind, replayID ReplayType, contents string) error {
+    path, err := clt.artifactPath(resultsDir, kind, replayID)
+    if err != nil {
+        return err
+    }
+    err = resultfile.Write(filepath.Dir(path), filepath.Base(path), []byte(contents))
+    if err != nil {
+        return err
+    }
+    clt.saveToResultsStore(kind, replayID, contents)
+    return nil
+}
+
 func (clt *Client) GetMajorVersionNumber() (int, error) {
     num, err := strconv.Atoi(strings.Split(clt.ClientVersion, ".")[0])
 	if err != nil {
@@ -178,7 +1222,7 @@ func (clt *Client) GetMajorVersionNumber() (int, error) {
 // replayNames: names of all replays
 // connectedClientIPs: all the client IPs that are currently connected to the server
 // Returns a status code and information; if status is success, then number of samples per replay
-//    is returned as the info; if status is failure, then failure code is returned as the info;
+//    is returned as the info, followed by the server time for clients that read it; if status is failure, then failure code is returned as the info;
 //    or any errors
 func (clt *Client) Ask4Permission(replayNames []string, connectedClientIPs *ConnectedClients) (string, string, error) {
     currentReplay, err := clt.GetCurrentReplay()
@@ -186,29 +1230,155 @@ func (clt *Client) Ask4Permission(replayNames []string, connectedClientIPs *Conn
         return "", "", err
     }
 
-    // Client can't run replay if replay is not on the server
-    if !clt.replayExists(replayNames, currentReplay.ReplayName) {
-        clt.Exceptions = "UnknownRelplayName"
-        return Ask4PermissionErrorStatus, Ask4PermissionUnknownReplayMsg, nil
+    // Client can't run replay if replay is not on the server
+    if !clt.replayExists(replayNames, currentReplay.ReplayName) {
+        clt.addException(PermissionPhase, "UnknownRelplayName")
+        clt.recordDenial(denials.UnknownReplay, currentReplay.ReplayName, "")
+        return Ask4PermissionErrorStatus, Ask4PermissionUnknownReplayMsg, nil
+    }
+
+    // Don't start new tests during maintenance or while the server is exiting, but let a test that
+    // already ran its first replay run the rest so that its measurement isn't lost.
+    isNewTest := len(clt.ReplayResults) <= 1
+    if isNewTest {
+        draining, until := Draining()
+        if draining {
+            status, info := clt.denyUntil(denials.ShuttingDown, "ShuttingDown", currentReplay.ReplayName, until)
+            return status, info, nil
+        }
+        if maintenanceCalendar != nil {
+            inMaintenance, until := maintenanceCalendar.Active(clk.Now())
+            if inMaintenance {
+                status, info := clt.denyUntil(denials.Maintenance, "Maintenance", currentReplay.ReplayName, until)
+                return status, info, nil
+            }
+        }
+    }
+
+    // Don't start replays on a port that an operator disabled
+    if clt.onDisabledPort(currentReplay.ReplayName) {
+        return Ask4PermissionErrorStatus, Ask4PermissionLowResourcesMsg, nil
+    }
+
+    // Don't run a replay that a bandwidth probe found too fast for the link of the client, since it
+    // would measure the link instead of differentiation
+    if clt.linkTooSlow(currentReplay.ReplayName) {
+        probe := clt.BandwidthProbe
+        return Ask4PermissionErrorStatus, fmt.Sprintf("%s;%.2f;%.2f", Ask4PermissionLinkTooSlowMsg, probe.Mbps, probe.ReplayMbps), nil
+    }
+
+    // Client can't rerun a test that already has results if duplicates are rejected
+    if clt.IsDuplicate {
+        clt.addException(PermissionPhase, "DuplicateTest")
+        clt.recordDenial(denials.DuplicateTest, currentReplay.ReplayName, "")
+        return Ask4PermissionErrorStatus, Ask4PermissionDuplicateTestMsg, nil
+    }
+
+    // Clients that don't send a replay token are looked up by IP, so only one of them can run a
+    // replay per IP at a time. Clients that send one can share an IP, e.g. behind carrier-grade NAT.
+    if connectedClientIPs.Has(clt.ReplayKey()) {
+        clt.addException(PermissionPhase, "NoPermission")
+        clt.recordDenial(denials.IPInUse, currentReplay.ReplayName, "")
+        return Ask4PermissionErrorStatus, Ask4PermissionIPInUseMsg, nil
+    }
+
+    // When the server is busy, leave room for users who haven't tested recently. Only the first
+    // replay of a test is checked so that a test that was let in can finish.
+    if isNewTest && !fairnessPolicy.Admit(clt.UserID, connectedClientIPs.Len(), clk.Now()) {
+        clt.addException(PermissionPhase, "FairShare")
+        clt.recordDenial(denials.FairShare, currentReplay.ReplayName, "")
+        return Ask4PermissionErrorStatus, Ask4PermissionLowResourcesMsg, nil
+    }
+
+    // Users who have been sent their monthly cap can't start new tests until next month
+    if isNewTest && bandwidthLedger != nil {
+        overCap, resetTime := bandwidthLedger.OverCap(clt.UserID, clk.Now())
+        if overCap {
+            status, info := clt.denyUntil(denials.BandwidthCap, "BandwidthCap", currentReplay.ReplayName, resetTime)
+            return status, info, nil
+        }
     }
 
-    // We allow only one client per IP at a time because multiple clients on an IP might affect throughputs
-    if connectedClientIPs.Has(clt.PublicIP) {
-        clt.Exceptions = "NoPermission"
-        return Ask4PermissionErrorStatus, Ask4PermissionIPInUseMsg, nil
+    // Don't run replays while the server is over its error budget, since their measurements
+    // couldn't be trusted; the budget recovers on its own once the failures age out
+    if !errorbudget.Healthy() {
+        clt.addException(PermissionPhase, "OverErrorBudget")
+        clt.recordDenial(denials.OverErrorBudget, currentReplay.ReplayName, "")
+        return Ask4PermissionErrorStatus, Ask4PermissionLowResourcesMsg, nil
     }
 
-    // Don't run replays if server is overloaded (>95% CPU, mem, disk, or >2000 Mbps network)
-    hasResources, err := clt.hasResources(len(connectedClientIPs.clientIPs))
+    // Don't run replays if server is overloaded (mem, disk, or network over the resource thresholds)
+    hasResources, err := clt.hasResources(connectedClientIPs.Len())
     if err != nil {
+        clt.recordDenial(denials.ResourceRetrievalFail, currentReplay.ReplayName, err.Error())
         return Ask4PermissionErrorStatus, Ask4PermissionResourceRetrievalFailMsg, nil
     }
     if !hasResources {
+        clt.recordDenial(denials.LowResources, currentReplay.ReplayName, clt.Exceptions.Last())
         return Ask4PermissionErrorStatus, Ask4PermissionLowResourcesMsg, nil
     }
 
-    connectedClientIPs.add(clt.PublicIP, currentReplay.ReplayName)
-    return Ask4PermissionOkStatus, strconv.Itoa(SamplesPerReplay), nil
+    // Don't run more replays at the same time than the server is set up for. Clients wait in a queue
+    // for a slot, and a test that already ran a replay goes ahead of new tests.
+    if replayScheduler != nil {
+        acquired, estimatedWait := replayScheduler.Acquire(clt, !isNewTest)
+        if !acquired {
+            status, info := clt.denyBusy(currentReplay.ReplayName, estimatedWait)
+            return status, info, nil
+        }
+    }
+
+    // Don't run replays that compete for the same upstream as a replay that is already running, so
+    // that the server's own contention doesn't look like differentiation. Clients see this the
+    // same as an overloaded server, so they retry later.
+    if replayGroups != nil {
+        acquired, busyGroups := replayGroups.Acquire(clt, currentReplay.ReplayName)
+        if !acquired {
+            if replayScheduler != nil {
+                replayScheduler.Release(clt)
+            }
+            clt.addException(PermissionPhase, "ReplayGroupBusy")
+            clt.recordDenial(denials.ReplayGroupBusy, currentReplay.ReplayName, strings.Join(busyGroups, ","))
+            return Ask4PermissionErrorStatus, Ask4PermissionLowResourcesMsg, nil
+        }
+    }
+
+    connectedClientIPs.add(clt.ReplayKey(), clt.PublicIP, strconv.Itoa(clt.TestID), currentReplay.ReplayName, currentReplay.MaxDuration, clt.Logger())
+    if isNewTest {
+        fairnessPolicy.Started(clt.UserID, clk.Now())
+    }
+    info := strconv.Itoa(currentReplay.SamplesPerReplay)
+    if clt.Capabilities.ServerTime {
+        info += ";" + clt.ServerTime()
+    }
+    return Ask4PermissionOkStatus, info, nil
+}
+
+// Records that the client was denied permission to run a replay. Failing to record the denial
+// doesn't affect the test, so errors are only logged.
+// reason: why permission was denied
+// replayName: the replay the client asked to run
+// details: extra information about the denial; can be empty
+func (clt *Client) recordDenial(reason denials.Reason, replayName string, details string) {
+    if denialLog == nil {
+        return
+    }
+    anonIP, err := anonymizer.IPString(clt.PublicIP)
+    if err != nil {
+        anonIP = ""
+    }
+    err = denialLog.Record(denials.Denial{
+        Time: clk.Now().UTC(),
+        TestStartTime: clt.StartTime,
+        Reason: reason,
+        ReplayName: replayName,
+        ClientIP: anonIP,
+        ClientVersion: clt.ClientVersion,
+        Details: details,
+    })
+    if err != nil {
+        clt.Logger().Error("Unable to record denial", "reason", reason, "error", err)
+    }
 }
 
 // Checks if the replay that client would like to run is present on server.
@@ -227,78 +1397,82 @@ func (clt *Client) replayExists(replayNames []string, currentReplayName string)
 // Determines if the server has enough resources to run the replay. Don't deny permission if
 // resources can't be retrieved.
 // numConnectedClients: the number of clients currently connected to the server
-// Returns false if memory > 95% or disk > 95% or network upload > 2000 Mbps; true
-//    otherwise or any errors
+// Returns false if CPU, memory, disk, or network upload is over its resource threshold (by default,
+//    100%, 95%, 95%, and 2000 Mbps); true otherwise or any errors
 func (clt *Client) hasResources(numConnectedClients int) (bool, error) {
-    memUsage, err := mem.VirtualMemory()
+    thresholds := getResourceThresholds()
+    cpuPercent, err := resourceMonitor.CPUPercent()
     if err == nil {
-        fmt.Println("mem:", memUsage.UsedPercent)
-        if memUsage.UsedPercent > 95 {
-            clt.Exceptions = fmt.Sprintf("Server Overloaded with Memory Usage %d%% with %d active connections now ***", memUsage.UsedPercent, numConnectedClients)
+        clt.Logger().Debug("CPU usage", "percent", cpuPercent)
+        if cpuPercent > thresholds.CPUPercent {
+            clt.addException(PermissionPhase, fmt.Sprintf("Server Overloaded with CPU Usage %.2f%% with %d active connections now ***", cpuPercent, numConnectedClients))
             return false, nil
         }
     }
 
-    diskUsage, err := disk.Usage("/")
+    memUsedPercent, err := resourceMonitor.MemoryUsedPercent()
     if err == nil {
-        fmt.Println("disk:", diskUsage.UsedPercent)
-        if diskUsage.UsedPercent > 95 {
-            clt.Exceptions = fmt.Sprintf("Server Overloaded with Disk Usage %d%% with %d active connections now ***", diskUsage.UsedPercent, numConnectedClients)
+        clt.Logger().Debug("Memory usage", "percent", memUsedPercent)
+        if memUsedPercent > thresholds.MemoryPercent {
+            clt.addException(PermissionPhase, fmt.Sprintf("Server Overloaded with Memory Usage %.2f%% with %d active connections now ***", memUsedPercent, numConnectedClients))
             return false, nil
         }
     }
 
-    netUsage, err := psutilnet.IOCounters(false)
+    diskUsedPercent, err := resourceMonitor.DiskUsedPercent()
     if err == nil {
-        bytesSent0 := netUsage[0].BytesSent
-        time.Sleep(1 * time.Second)
-        netUsage, err = psutilnet.IOCounters(false)
-        if err == nil {
-            bytesSent1 := netUsage[0].BytesSent
-            uploadMbps := float64((bytesSent1 - bytesSent0) * 8) / 1000000.0
-            fmt.Println("net:", uploadMbps)
-            if uploadMbps > 2000 {
-                clt.Exceptions = fmt.Sprintf("Server Overloaded with Upload Bandwidth Usage %dMbps with %d active connections now ***", uploadMbps, numConnectedClients)
-                return false, nil
-            }
+        clt.Logger().Debug("Disk usage", "percent", diskUsedPercent)
+        if diskUsedPercent > thresholds.DiskPercent {
+            clt.addException(PermissionPhase, fmt.Sprintf("Server Overloaded with Disk Usage %.2f%% with %d active connections now ***", diskUsedPercent, numConnectedClients))
+            return false, nil
+        }
+    }
+
+    uploadMbps, err := resourceMonitor.UploadMbps()
+    if err == nil {
+        clt.Logger().Debug("Upload bandwidth", "mbps", uploadMbps)
+        if uploadMbps > thresholds.UploadMbps {
+            clt.addException(PermissionPhase, fmt.Sprintf("Server Overloaded with Upload Bandwidth Usage %.2fMbps with %d active connections now ***", uploadMbps, numConnectedClients))
+            return false, nil
         }
     }
 
     return true, nil
 }
 
-// Receives information about the client mobile device, network, and location.
+// Receives information about the client mobile device, network, and location. The local time of the
+// test comes from the coordinates in locationInfo, or from the timeZone in locationInfo (an IANA
+// name such as "America/New_York") when the client didn't share its coordinates.
 // message: json containing the device, network, and location information
 // Returns any errors
 func (clt *Client) ReceiveMobileStats(message string) error {
-    fmt.Println("MOBILE STATS", message)
     var mobileStatsData map[string]interface{}
     err := json.Unmarshal([]byte(message), &mobileStatsData)
     if err != nil {
-        return err
+        return errs.Malformed(err)
     }
 
     locationInfo, ok := mobileStatsData["locationInfo"].(map[string]interface{})
     if !ok {
-        return fmt.Errorf("No 'locationInfo' key in mobile stats JSON, or value is not a dictionary.")
+        return fmt.Errorf("%w: no 'locationInfo' key in mobile stats JSON, or value is not a dictionary.", errs.ErrMalformedMessage)
     }
     latStr, ok := locationInfo["latitude"].(string)
     if !ok {
-        return fmt.Errorf("No 'latitude' key in mobile stats JSON, or value is not a string.")
+        return fmt.Errorf("%w: no 'latitude' key in mobile stats JSON, or value is not a string.", errs.ErrMalformedMessage)
     }
     longStr, ok := locationInfo["longitude"].(string)
     if !ok {
-        return fmt.Errorf("No 'longitude' key in mobile stats JSON, or value is not a string.")
+        return fmt.Errorf("%w: no 'longitude' key in mobile stats JSON, or value is not a string.", errs.ErrMalformedMessage)
     }
     // if location is given, do reverse geocode lookup and get local time
     if latStr != "nil" && longStr != "nil" && latStr != "0.0" && longStr != "0.0" {
         lat, err := strconv.ParseFloat(latStr, 64)
         if err != nil {
-            return err
+            return errs.Malformed(err)
         }
         long, err := strconv.ParseFloat(longStr, 64)
         if err != nil {
-            return err
+            return errs.Malformed(err)
         }
         lat = math.Round(lat * 10) / 10
         long = math.Round(long * 10) / 10
@@ -312,18 +1486,105 @@ func (clt *Client) ReceiveMobileStats(message string) error {
             return err
         }
         locationInfo["country"] = loc.Country
+        clt.CountryCode = loc.CountryCode
         locationInfo["city"] = loc.City
         locationInfo["localTime"] = clt.StartTime.In(timeZoneLocation).Format("2006-01-02 15:04:05-0700")
+        locationInfo["localTimeSource"] = "coordinates"
         locationInfo["latitude"] = lat
         locationInfo["longitude"] = long
+    } else if timeZone, ok := locationInfo["timeZone"].(string); ok && timeZone != "" {
+        // clients without a location still send the IANA name of their time zone, which is enough
+        // for the local time
+        timeZoneLocation, err := time.LoadLocation(timeZone)
+        if err != nil {
+            clt.Logger().Debug("Unknown time zone in mobile stats", "time_zone", timeZone, "error", err)
+        } else {
+            locationInfo["localTime"] = clt.StartTime.In(timeZoneLocation).Format("2006-01-02 15:04:05-0700")
+            locationInfo["localTimeSource"] = "client_time_zone"
+        }
+    }
+
+    // keep the raw model and add the normalized model so that results can be aggregated by device
+    model, ok := mobileStatsData["model"].(string)
+    if ok {
+        mobileStatsData["normalizedModel"] = devices.Normalize(model)
     }
     clt.MobileStats = mobileStatsData
-    fmt.Printf("mobile stats: %v", mobileStatsData)
+    // mobile stats hold the location of the client, so only how many fields it sent is logged
+    clt.Logger().Debug("Received mobile stats", "fields", len(mobileStatsData))
     return nil
 }
 
+// Denies permission to run a test until the server admits the test again. Clients that know about
+// maintenance are told when to come back; the rest are told the server is overloaded so that they
+// retry later.
+// reason: why permission was denied
+// exception: the exception recorded for the test
+// replayName: the replay the client asked to run
+// until: when the server admits tests again
+// Returns the status code and information to send to the client
+func (clt *Client) denyUntil(reason denials.Reason, exception string, replayName string, until time.Time) (string, string) {
+    clt.addException(PermissionPhase, exception)
+    clt.recordDenial(reason, replayName, until.UTC().Format(time.RFC3339))
+    if clt.Capabilities.MaintenanceRetryAfter {
+        retryAfter := int(math.Ceil(until.Sub(clk.Now()).Seconds()))
+        return Ask4PermissionErrorStatus, Ask4PermissionMaintenanceMsg + ";" + strconv.Itoa(retryAfter)
+    }
+    return Ask4PermissionErrorStatus, Ask4PermissionLowResourcesMsg
+}
+
+// Denies a client permission because every replay slot is taken and it couldn't wait for one.
+// Clients that can read the estimated wait are told how long until they can expect a slot; the
+// others see an overloaded server.
+// replayName: the replay the client asked to run
+// estimatedWait: how long the client can expect to wait for a slot
+// Returns the status and information of the response to the client
+func (clt *Client) denyBusy(replayName string, estimatedWait time.Duration) (string, string) {
+    retryAfter := max(int(math.Ceil(estimatedWait.Seconds())), 1)
+    clt.addException(PermissionPhase, "ServerBusy")
+    clt.recordDenial(denials.ServerBusy, replayName, strconv.Itoa(retryAfter))
+    if clt.Capabilities.ServerBusyRetryAfter {
+        return Ask4PermissionErrorStatus, Ask4PermissionServerBusyMsg + ";" + strconv.Itoa(retryAfter)
+    }
+    return Ask4PermissionErrorStatus, Ask4PermissionLowResourcesMsg
+}
+
+// Gets the time on the server's timeline, so that the client can timestamp its samples in the same
+// time as the packet logs of the server instead of by its own clock, which can be off by seconds.
+// The wall clock time lines up samples with the packet logs; the time since the side channel
+// connection was made is read from the monotonic clock, so it isn't thrown off if the wall clock of
+// the server is stepped during the test. The client adds the time it takes to get the response,
+// e.g. half of a side channel RTT, to both.
+// Returns the server time, in the format <unix time in ns>;<ns since the side channel connection was made>
+func (clt *Client) ServerTime() string {
+    now := clk.Now()
+    return strconv.FormatInt(now.UnixNano(), 10) + ";" + strconv.FormatInt(int64(now.Sub(clt.connectedAt)), 10)
+}
+
+// Receives a ping from the client to measure the round trip time of the side channel. The client
+// starts a measurement by sending an empty message, and the server responds with a token. The
+// client then immediately echoes the token back in the next ping, and the server records the time
+// between sending the token and receiving it back as an RTT sample. The server responds to every
+// ping with a new token, so a client wanting n samples sends n + 1 pings.
+// message: empty to start a measurement, or the token received in the response to the last ping
+// Returns the token to send back to the client
+func (clt *Client) ReceivePing(message string) string {
+    now := clk.Now()
+    if message != "" && message == strconv.Itoa(clt.pingSeq) && !clt.pingSentTime.IsZero() {
+        if len(clt.SideChannelRTTs) < MaxSideChannelRTTSamples {
+            rtt := float64(now.Sub(clt.pingSentTime)) / float64(time.Millisecond)
+            clt.SideChannelRTTs = append(clt.SideChannelRTTs, rtt)
+        }
+    }
+
+    clt.pingSeq++
+    clt.pingSentTime = clk.Now()
+    return strconv.Itoa(clt.pingSeq)
+}
+
 // Receives the duration of the replay, throughputs, and the sample times after a replay has been
-// run. Writes throughputs to tempResultsDir/userID/clientXputs/Xput_<userID>_<testID>_<replayID>.json.
+// run. Writes throughputs to the client throughputs file of the results layout (by default,
+// tempResultsDir/userID/clientXputs/Xput_<userID>_<testID>_<replayID>.json).
 // message: the data that has been received from the client
 // resultsDir: the root directory of the results to place the throughputs in
 // Returns any errors
@@ -336,37 +1597,222 @@ func (clt *Client) ReceiveThroughputs(message string, resultsDir string) error {
     // format: <replayDuration>;<[[throughputs],[sampleTimes]]>
     data := strings.Split(message, ";")
     if len(data) < 2 {
-        return fmt.Errorf("Received improperly formatted throughput data: %s\n", message)
+        return fmt.Errorf("%w: received improperly formatted throughput data: %s\n", errs.ErrMalformedMessage, message)
     }
     replayDurationFloat, err := strconv.ParseFloat(data[0], 64)
     if err != nil {
-        return err
+        return errs.Malformed(err)
     }
     currentReplay.ReplayDuration = time.Duration(replayDurationFloat * float64(time.Second))
 
-    var throughputsAndSampleTimes [][]float64
-    err = json.Unmarshal([]byte(data[1]), &throughputsAndSampleTimes)
+    throughputsAndSampleTimes, err := decodeThroughputs(data[1])
     if err != nil {
         return err
     }
-
-    if len(throughputsAndSampleTimes) != 2 {
-        return fmt.Errorf("Received improperly formatted throughput and sample times. 2 items expected, received %d\n", len(throughputsAndSampleTimes))
-    }
     currentReplay.Throughputs = throughputsAndSampleTimes[0]
     currentReplay.SampleTimes = throughputsAndSampleTimes[1]
 
-    // write the throughputs and sample times to file; TODO: move to file writing function
-    throughputDir := filepath.Join(resultsDir, clt.UserID, "clientXputs")
-    filename := "Xput_" + clt.UserID + "_" + strconv.Itoa(clt.TestID) + "_" + strconv.Itoa(int(currentReplay.ReplayID)) + ".json"
+    // write the throughputs and sample times to file
+    err = clt.writeArtifact(resultsDir, artifacts.ClientThroughputs, currentReplay.ReplayID, data[1])
+    if err != nil {
+        return err
+    }
+    return nil
+}
+
+// Decodes the throughputs and sample times sent by the client. The arrays are decoded one value at a
+// time so that a client sending a huge array is stopped once it passes MaxThroughputSamples, rather
+// than after the whole array has been allocated.
+// data: the throughputs and sample times, in the format [[throughputs],[sampleTimes]]
+// Returns the throughputs and the sample times, or an errs.LimitError if either array is too long,
+//     or an error wrapping errs.ErrMalformedMessage if the data isn't two arrays of numbers
+func decodeThroughputs(data string) ([][]float64, error) {
+    throughputsAndSampleTimes, err := decodeThroughputArrays(data)
+    return throughputsAndSampleTimes, errs.Malformed(err)
+}
+
+// Decodes the throughputs and sample times sent by the client, for decodeThroughputs.
+// data: the throughputs and sample times, in the format [[throughputs],[sampleTimes]]
+// Returns the throughputs and the sample times, or any errors
+func decodeThroughputArrays(data string) ([][]float64, error) {
+    decoder := json.NewDecoder(strings.NewReader(data))
+    err := expectJSONDelim(decoder, '[')
+    if err != nil {
+        return nil, err
+    }
+
+    var throughputsAndSampleTimes [][]float64
+    for decoder.More() {
+        if len(throughputsAndSampleTimes) == 2 {
+            return nil, fmt.Errorf("Received improperly formatted throughput and sample times. 2 items expected, received more\n")
+        }
+        err = expectJSONDelim(decoder, '[')
+        if err != nil {
+            return nil, err
+        }
+        values := []float64{}
+        for decoder.More() {
+            if len(values) == MaxThroughputSamples {
+                return nil, &errs.LimitError{Kind: errs.ErrTooManySamples, Limit: MaxThroughputSamples, Message: fmt.Sprintf("more than %d received", MaxThroughputSamples)}
+            }
+            var value float64
+            err = decoder.Decode(&value)
+            if err != nil {
+                return nil, err
+            }
+            values = append(values, value)
+        }
+        err = expectJSONDelim(decoder, ']')
+        if err != nil {
+            return nil, err
+        }
+        throughputsAndSampleTimes = append(throughputsAndSampleTimes, values)
+    }
+    err = expectJSONDelim(decoder, ']')
+    if err != nil {
+        return nil, err
+    }
+    if _, err = decoder.Token(); err != io.EOF {
+        return nil, fmt.Errorf("Received improperly formatted throughput and sample times. Unexpected data after the arrays\n")
+    }
+
+    if len(throughputsAndSampleTimes) != 2 {
+        return nil, fmt.Errorf("Received improperly formatted throughput and sample times. 2 items expected, received %d\n", len(throughputsAndSampleTimes))
+    }
+    return throughputsAndSampleTimes, nil
+}
 
-    err = writeToFile(throughputDir, filename, data[1])
+// Reads the next token of a JSON stream and checks that it is the expected delimiter.
+// decoder: the JSON stream
+// delim: the expected delimiter
+// Returns any errors
+func expectJSONDelim(decoder *json.Decoder, delim json.Delim) error {
+    token, err := decoder.Token()
     if err != nil {
         return err
     }
+    if token != delim {
+        return fmt.Errorf("Received improperly formatted throughput and sample times. Expected %v, received %v\n", delim, token)
+    }
     return nil
 }
 
+// Samples the throughputs of the current replay from the bytes the replay servers sent, so that
+// analyses can check the throughputs the client measured against them. Like the client, the replay
+// is split into as many intervals as the client was told to take samples in. The throughputs are
+// written to the server throughputs file of the results layout (by default,
+// tempResultsDir/userID/serverXputs/serverXput_<userID>_<testID>_<replayID>.json). The TCP servers
+// count bytes once the kernel takes them, not once they are on the wire, so their throughputs run
+// ahead of the client's while the send buffer fills. If the client disconnected before sending its
+// own throughputs, the server throughputs stand in for them, so that the partial test still
+// contributes data, and the exceptions of the client are marked so that the replay info shows where
+// the throughputs came from. Nothing is done if no bytes were sent.
+// connectedClients: the connected clients, which hold the ledger of bytes sent
+// resultsDir: the root directory of the results to place the throughputs in
+// Returns any errors
+func (clt *Client) SampleServerThroughputs(connectedClients *ConnectedClients, resultsDir string) error {
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return err
+    }
+    sendLedger := connectedClients.TakeSendLedger(clt.ReplayKey())
+    if len(sendLedger) == 0 {
+        return nil
+    }
+
+    throughputs, sampleTimes, replayDuration := throughputsFromSendLedger(sendLedger, currentReplay.SamplesPerReplay)
+    currentReplay.ServerThroughputs = throughputs
+    currentReplay.ServerSampleTimes = sampleTimes
+    clientMeasured := len(currentReplay.Throughputs) > 0
+    if !clientMeasured {
+        currentReplay.Throughputs = throughputs
+        currentReplay.SampleTimes = sampleTimes
+        currentReplay.ReplayDuration = replayDuration
+        currentReplay.ServerDerivedThroughputs = true
+        clt.addException(ThroughputsPhase, "ServerDerivedThroughputs")
+    }
+
+    output := map[string]interface{}{
+        "source": "server_send_ledger",
+        "replay_duration": replayDuration.Seconds(),
+        "throughputs": throughputs,
+        "sample_times": sampleTimes,
+        "client_measured": clientMeasured,
+    }
+    jsonOutput, err := json.Marshal(output)
+    if err != nil {
+        return err
+    }
+    return clt.writeArtifact(resultsDir, artifacts.ServerThroughputs, currentReplay.ReplayID, string(jsonOutput))
+}
+
+// Compares the average throughputs the client measured with those sampled from the bytes the
+// replay servers sent. A client whose averages are far from the server's, e.g. several times
+// higher, likely has a bug in how it measures.
+// replay: the replay to compare
+// Returns the averages and their ratio, or nil if the replay doesn't have both
+func serverThroughputComparison(replay ReplayResult) map[string]interface{} {
+    if replay.ServerDerivedThroughputs || len(replay.Throughputs) == 0 || len(replay.ServerThroughputs) == 0 {
+        return nil
+    }
+    clientAverage := floatsMean(replay.Throughputs)
+    serverAverage := floatsMean(replay.ServerThroughputs)
+    comparison := map[string]interface{}{
+        "client_avg_xput": clientAverage,
+        "server_avg_xput": serverAverage,
+    }
+    if serverAverage > 0 {
+        comparison["client_server_ratio"] = clientAverage / serverAverage
+    }
+    return comparison
+}
+
+// Averages a list of numbers.
+// values: the numbers; must not be empty
+// Returns the mean
+func floatsMean(values []float64) float64 {
+    var sum float64
+    for _, value := range values {
+        sum += value
+    }
+    return sum / float64(len(values))
+}
+
+// Splits the bytes sent during a replay into equal intervals and computes the throughput of each.
+// sendLedger: the bytes sent, in the order they were sent; must not be empty
+// numSamples: the number of intervals to split the replay into
+// Returns the throughput of each interval in Mbps, the number of seconds since the start of the
+//     replay at the end of each interval, and the duration of the replay
+func throughputsFromSendLedger(sendLedger []SentBytes, numSamples int) ([]float64, []float64, time.Duration) {
+    startTime := sendLedger[0].Time
+    replayDuration := sendLedger[len(sendLedger) - 1].Time.Sub(startTime)
+    // a replay whose bytes were all sent at once still gets one interval of the ledger's resolution
+    if replayDuration < sendLedgerResolution {
+        replayDuration = sendLedgerResolution
+    }
+    interval := replayDuration / time.Duration(numSamples)
+    if interval <= 0 {
+        interval = 1
+    }
+
+    bytesPerInterval := make([]int, numSamples)
+    for _, sent := range sendLedger {
+        i := int(sent.Time.Sub(startTime) / interval)
+        if i >= numSamples {
+            i = numSamples - 1
+        }
+        bytesPerInterval[i] += sent.Bytes
+    }
+
+    throughputs := make([]float64, numSamples)
+    sampleTimes := make([]float64, numSamples)
+    for i, numBytes := range bytesPerInterval {
+        throughputs[i] = float64(numBytes * 8) / interval.Seconds() / 1000000.0
+        sampleTimes[i] = (time.Duration(i + 1) * interval).Seconds()
+    }
+    return throughputs, sampleTimes, replayDuration
+}
+
 // Receives a request to run additional replays in a test. Request to run the first replay in a
 // test is sent in DeclareID. Replay is checked if it exists on server.
 // replayNames: the names of all replays available to run
@@ -375,27 +1821,19 @@ func (clt *Client) ReceiveThroughputs(message string, resultsDir string) error {
 //    is returned as the info; if status is failure, then failure code is returned as the info;
 //    and any errors
 func (clt *Client) DeclareReplay(replayNames []string, message string) (string, string, error) {
-    // message is <replayID>;<replayName>;<isLastReplay>
+    // message is <replayID>;<replayName>;<isLastReplay>, optionally followed by ;<maxDurationSeconds>
+    // and ;<samplesPerReplay>, either of which can be empty
     pieces := strings.Split(message, ";")
     if len(pieces) < 3 {
-        return "", "", fmt.Errorf("Expected to receive at least 3 pieces from declare replay; only received %d.\n", len(pieces))
+        return "", "", fmt.Errorf("%w: expected to receive at least 3 pieces from declare replay; only received %d.\n", errs.ErrMalformedMessage, len(pieces))
     }
 
-    replayIDInt, err := strconv.Atoi(pieces[0])
+    replayID, err := ParseReplayType(pieces[0])
     if err != nil {
         return "", "", err
     }
-    var replayID ReplayType
-    if replayIDInt == 0 {
-        replayID = Original
-    } else if replayIDInt == 1 {
-        replayID = Random
-    } else {
-        return "", "", fmt.Errorf("Unexpected replay ID: %d; must be 0 (original) or 1 (random)", replayIDInt)
-    }
 
-    //TODO: change client replay files replay names to use _ instead of -, then delete this terrible replace code
-    replayName := strings.Replace(pieces[1], "-", "_", -1)
+    replayName := compat.ReplayName(pieces[1], clt.Capabilities)
 
     isLastReplay, err := strToBool(pieces[2])
     if err != nil {
@@ -403,14 +1841,39 @@ func (clt *Client) DeclareReplay(replayNames []string, message string) (string,
     }
 
     clt.AddReplay(replayID, replayName, isLastReplay)
+    if len(pieces) > 3 {
+        maxDuration, err := ParseMaxReplayDuration(pieces[3])
+        if err != nil {
+            return "", "", err
+        }
+        err = clt.SetMaxReplayDuration(maxDuration)
+        if err != nil {
+            return "", "", err
+        }
+    }
+    if len(pieces) > 4 {
+        requestedSamples, err := ParseSamplesPerReplay(pieces[4])
+        if err != nil {
+            return "", "", err
+        }
+        err = clt.NegotiateSamplesPerReplay(requestedSamples)
+        if err != nil {
+            return "", "", err
+        }
+    }
 
     // Client can't run replay if replay is not on the server
     if !clt.replayExists(replayNames, replayName) {
-        clt.Exceptions = "UnknownRelplayName"
+        clt.addException(PermissionPhase, "UnknownRelplayName")
+        clt.recordDenial(denials.UnknownReplay, replayName, "")
         return Ask4PermissionErrorStatus, Ask4PermissionUnknownReplayMsg, nil
     }
 
-    return Ask4PermissionOkStatus, strconv.Itoa(SamplesPerReplay), nil
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return "", "", err
+    }
+    return Ask4PermissionOkStatus, strconv.Itoa(currentReplay.SamplesPerReplay), nil
 }
 
 // Converts a string to boolean.
@@ -423,90 +1886,356 @@ func strToBool(str string) (bool, error) {
     } else if lowerStr == "false" {
         return false, nil
     } else {
-        return false, fmt.Errorf("Cannot parse '%s' into a bool\n", str)
+        return false, fmt.Errorf("%w: cannot parse '%s' into a bool\n", errs.ErrMalformedMessage, str)
     }
 }
 
 // Analyzes the test by performing a 2 sample KS test on the throughputs of the original and random
-// replays.
+// replays, decides if the test shows differentiation using the decision policy, and writes the
+// decision to disk.
+// resultsDir: the root directory of the results to place the decision in
 // Returns any errors
-func (clt *Client) AnalyzeTest() error {
+func (clt *Client) AnalyzeTest(resultsDir string) error {
     //TODO: rename all AnalyzeTest to 2 sample KS test
     if len(clt.ReplayResults) < 2 {
-        return fmt.Errorf("There needs to be two results to do 2-sample KS test. There are currently %d results.\n", len(clt.ReplayResults))
-    }
-
-    // determine order of replay types
-    var originalReplayIndex int
-    var randomReplayIndex int
-    if clt.ReplayResults[0].ReplayID == Original && clt.ReplayResults[1].ReplayID == Random {
-        originalReplayIndex = 0
-        randomReplayIndex = 1
-    } else if clt.ReplayResults[0].ReplayID == Random && clt.ReplayResults[1].ReplayID == Original {
-        randomReplayIndex = 0
-        originalReplayIndex = 1
-    } else {
-        return fmt.Errorf("Invalid replay types for 2-sample KS test: %v and %v\n", clt.ReplayResults[0].ReplayID, clt.ReplayResults[1].ReplayID)
+        return fmt.Errorf("%w: there needs to be two results to do 2-sample KS test. There are currently %d results.\n", errs.ErrNotEnoughData, len(clt.ReplayResults))
     }
 
-    // do analyses
-    originalReplayStats, err := analysis.NewDataSetStats(clt.ReplayResults[originalReplayIndex].Throughputs)
+    // determine order of replay types; replays other than the original and random replays are
+    // controls that are compared against the original replay on their own
+    originalReplayIndex := clt.replayIndex(Original)
+    randomReplayIndex := clt.replayIndex(Random)
+    if originalReplayIndex < 0 || randomReplayIndex < 0 {
+        return fmt.Errorf("%w: invalid replay types for 2-sample KS test: an original and a random replay are needed, got %v\n", errs.ErrNotEnoughData, clt.replayTypes())
+    }
+
+    // the policy can be reloaded in the middle of the analysis, so the whole test uses one copy
+    policy := GetDecisionPolicy()
+    var err error
+    clt.Analysis, clt.AnalysisWindow, err = compareReplays(clt.ReplayResults[originalReplayIndex], clt.ReplayResults[randomReplayIndex], policy)
     if err != nil {
         return err
     }
-    randomReplayStats, err := analysis.NewDataSetStats(clt.ReplayResults[randomReplayIndex].Throughputs)
+    clt.analyzeLatencies(clt.ReplayResults[originalReplayIndex], clt.ReplayResults[randomReplayIndex])
+    clt.analyzeLoss(clt.ReplayResults[originalReplayIndex], clt.ReplayResults[randomReplayIndex], policy)
+    err = clt.analyzeVariants(originalReplayIndex, policy)
     if err != nil {
         return err
     }
-    area := randomReplayStats.Average - originalReplayStats.Average
 
-    xputMin := analysis.CalculateMinValueOfTwoSlices(originalReplayStats.Data, randomReplayStats.Data)
-    areaOvar := analysis.CalculateArea0Var(originalReplayStats.Average, randomReplayStats.Average)
-    ks2dVal, ks2pVal, err := analysis.KS2Samp(originalReplayStats.Data, randomReplayStats.Data)
+    clt.Logger().Info("Analyzed test", "differentiation", clt.Analysis.Differentiation, "inconclusive", clt.Analysis.Verdict.Inconclusive,
+        "original_samples", clt.Analysis.Samples.OriginalSamples, "random_samples", clt.Analysis.Samples.RandomSamples,
+        "area0var", clt.Analysis.Area0var, "ks2_pval", clt.Analysis.KS2pVal, "ks2_accept_ratio", clt.Analysis.KS2AcceptRatio, "calibration", clt.isCalibration())
+    clt.Logger().Debug("Analysis results", "original_replay", clt.Analysis.OriginalReplayStats,
+        "random_replay", clt.Analysis.RandomReplayStats)
+    err = clt.writeDecisionToFile(resultsDir)
     if err != nil {
         return err
     }
-    dValAvg, pValAvg, ks2AcceptRatio, err := analysis.SampleKS2(originalReplayStats.Data, randomReplayStats.Data, ks2pVal)
+    // calibration tests check the server, not the network of the user, so there is nothing to tell
+    // them, and an inconclusive test has no verdict to tell
+    if clt.isCalibration() || clt.Analysis.Verdict.Inconclusive {
+        return nil
+    }
+    if verdictNotifier != nil {
+        verdictNotifier.Notify(clt.UserID, clt.artifactTestID(), clt.ReplayResults[originalReplayIndex].ReplayName, clt.Analysis.Differentiation)
+    }
+    if anomalyDetector != nil {
+        anomalyDetector.Record(clt.ReplayResults[originalReplayIndex].ReplayName, clt.Analysis.Differentiation)
+    }
+    return nil
+}
+
+// Compares the TCP packets the server retransmitted during the original and random replays to tell
+// throttling apart from congestion. Packets are only captured on some servers and don't change the
+// verdict of the test, so a test without them is left without a localization.
+// original: the original replay
+// random: the random replay
+// policy: the decision policy
+func (clt *Client) analyzeLoss(original ReplayResult, random ReplayResult, policy analysis.DecisionPolicy) {
+    clt.Localization = nil
+    if original.Loss == nil || random.Loss == nil {
+        return
+    }
+    clt.Localization = analysis.Localize(original.Loss, random.Loss, policy)
+    if clt.Localization != nil {
+        clt.Logger().Info("Localized differentiation", "localization", clt.Localization.Result,
+            "original_loss_rate", clt.Localization.Overall.Original.LossRate(), "random_loss_rate", clt.Localization.Overall.Random.LossRate())
+    }
+}
+
+// Compares the throughputs of a replay against those of a control replay with a 2 sample KS test
+// and decides if they show differentiation. If either replay has fewer than minThroughputSamples
+// samples, the K-S tests aren't run and the comparison is inconclusive.
+// replay: the replay, e.g. the original replay
+// control: the replay it is compared against, e.g. the random replay
+// policy: the decision policy
+// Returns the results of the analysis, the window of the replays that was compared (0 if the whole
+//     replays were compared), or any errors
+func compareReplays(replay ReplayResult, control ReplayResult, policy analysis.DecisionPolicy) (*analysis.AnalysisResults, time.Duration, error) {
+    // only compare the part of the replays that both of them ran for
+    replayThroughputs, controlThroughputs, window := matchingWindows(replay, control)
+
+    // checked before the stats are built, since windowing can leave a replay without any samples
+    sampleCheck := analysis.CheckSamples(replayThroughputs, controlThroughputs, minThroughputSamples)
+    if !sampleCheck.Enough {
+        results := inconclusiveComparison(replayThroughputs, controlThroughputs)
+        results.Policy = policy
+        results.Samples = sampleCheck
+        results.Verdict = policy.Decide(results)
+        return results, window, nil
+    }
+
+    // do analyses
+    replayStats, err := analysis.NewDataSetStats(replayThroughputs)
     if err != nil {
-        return err
+        return nil, 0, err
+    }
+    controlStats, err := analysis.NewDataSetStats(controlThroughputs)
+    if err != nil {
+        return nil, 0, err
+    }
+    area := controlStats.Average - replayStats.Average
+
+    xputMin := analysis.CalculateMinValueOfTwoSlices(replayStats.Data, controlStats.Data)
+    areaOvar := analysis.CalculateArea0Var(replayStats.Average, controlStats.Average)
+    ks2dVal, ks2pVal, err := analysis.KS2Samp(replayStats.Data, controlStats.Data)
+    if err != nil {
+        return nil, 0, err
     }
-    clt.Analysis = analysis.NewAnalysisResults(originalReplayStats, randomReplayStats, area, xputMin,
+    dValAvg, pValAvg, ks2AcceptRatio, err := analysis.SampleKS2(replayStats.Data, controlStats.Data, ks2pVal, policy)
+    if err != nil {
+        return nil, 0, err
+    }
+    results := analysis.NewAnalysisResults(replayStats, controlStats, area, xputMin,
         areaOvar, ks2dVal, ks2pVal, dValAvg, pValAvg, ks2AcceptRatio)
+    results.Policy = policy
+    results.Samples = sampleCheck
+    results.Verdict = policy.Decide(results)
+    results.Differentiation = results.Verdict.Differentiation
+    return results, window, nil
+}
 
-    //TODO: write to file
-    fmt.Printf("Analysis results:\n\t%v\n\t%v\n\t%v\n", clt.Analysis.OriginalReplayStats, clt.Analysis.RandomReplayStats, clt.Analysis)
-    return nil
+// Gets the results of a comparison whose replays have too few samples for the K-S tests. The stats
+// of a replay without any samples are left at 0, and the K-S values are left as if no difference was
+// found, since the tests weren't run.
+// replayThroughputs: the throughputs of the replay
+// controlThroughputs: the throughputs of the replay it is compared against
+// Returns the results, without a policy, sample check, or verdict
+func inconclusiveComparison(replayThroughputs []float64, controlThroughputs []float64) *analysis.AnalysisResults {
+    replayStats, err := analysis.NewDataSetStats(replayThroughputs)
+    if err != nil {
+        replayStats = &analysis.DataSetStats{}
+    }
+    controlStats, err := analysis.NewDataSetStats(controlThroughputs)
+    if err != nil {
+        controlStats = &analysis.DataSetStats{}
+    }
+    area := controlStats.Average - replayStats.Average
+    xputMin := 0.0
+    if len(replayStats.Data) + len(controlStats.Data) > 0 {
+        xputMin = analysis.CalculateMinValueOfTwoSlices(replayStats.Data, controlStats.Data)
+    }
+    // with no samples on either side the area test would divide 0 by 0
+    areaOvar := 0.0
+    if replayStats.Average > 0 || controlStats.Average > 0 {
+        areaOvar = analysis.CalculateArea0Var(replayStats.Average, controlStats.Average)
+    }
+    return analysis.NewAnalysisResults(replayStats, controlStats, area, xputMin, areaOvar, 0, 1, 0, 1, 0)
+}
+
+// Checks if the test ran the built-in calibration replays, whose results check the measurement
+// pipeline rather than the network of the client.
+// Returns true if any replay of the test is a calibration replay
+func (clt *Client) isCalibration() bool {
+    for _, replayResult := range clt.ReplayResults {
+        if testdata.IsCalibration(replayResult.ReplayName) {
+            return true
+        }
+    }
+    return false
 }
 
-// Anonymizes an IP address by returning the /24 of an IPv4 address or /48 of an IPv6 address.
-// ipString: the IP address to anonyize
-// Returns the anonyimzed IP address or any errors
-func getAnonIP(ipString string) (string, error) {
-    ip := net.ParseIP(ipString)
-    if ip == nil {
-        return "", fmt.Errorf("%s is not a valid IP address.\n", ipString)
+// Gets the throughputs of two replays over the window that both of them ran for. When the client
+// shortened one or both replays, or the UDP replay timeout cut one off before its end, the longer
+// replay also covers traffic the shorter one never sent, so only the samples taken within the
+// shorter replay are compared.
+// replay1: the first replay
+// replay2: the second replay
+// Returns the throughputs of each replay within the window, and the window, which is 0 if neither
+//     replay was shortened and every sample is returned
+func matchingWindows(replay1 ReplayResult, replay2 ReplayResult) ([]float64, []float64, time.Duration) {
+    var window time.Duration
+    for _, replay := range []ReplayResult{replay1, replay2} {
+        cutoff := replay.MaxDuration
+        if replay.TimeoutTruncated && (cutoff == 0 || replay.ReplayTimeout < cutoff) {
+            cutoff = replay.ReplayTimeout
+        }
+        if cutoff > 0 && (window == 0 || cutoff < window) {
+            window = cutoff
+        }
+    }
+    if window == 0 {
+        return replay1.Throughputs, replay2.Throughputs, 0
+    }
+    return throughputsWithin(replay1, window), throughputsWithin(replay2, window), window
+}
+
+// Gets the throughputs of a replay that were sampled within a window from the start of the replay.
+// replay: the replay
+// window: the length of the window
+// Returns the throughputs sampled within the window
+func throughputsWithin(replay ReplayResult, window time.Duration) []float64 {
+    var throughputs []float64
+    for i, throughput := range replay.Throughputs {
+        if i < len(replay.SampleTimes) && replay.SampleTimes[i] <= window.Seconds() {
+            throughputs = append(throughputs, throughput)
+        }
     }
+    return throughputs
+}
 
-    ipv4 := ip.To4()
-    if ipv4 != nil {
-        mask := net.CIDRMask(24, 32) // /24 mask
-        anonIP := ipv4.Mask(mask)
-        return anonIP.String(), nil
+// Writes the decision of the analysis and the decision policy used to make it to the decision file
+// of the results layout (by default, tempResultsDir/userID/decisions/decision_<userID>_<testID>.json),
+// so that results can be compared against the thresholds they were decided with. The comparisons of
+// latencies and of retransmissions are included if they were measured, and the build of the server
+// always is.
+// resultsDir: the root directory of the results to place the decision in
+// Returns any errors
+func (clt *Client) writeDecisionToFile(resultsDir string) error {
+    output := map[string]interface{}{
+        "differentiation": clt.Analysis.Differentiation,
+        "policy": clt.Analysis.Policy,
+        "verdict": clt.Analysis.Verdict,
+        "area0var": clt.Analysis.Area0var,
+        "ks2_pval": clt.Analysis.KS2pVal,
+        "ks2_accept_ratio": clt.Analysis.KS2AcceptRatio,
+        "original_avg_xput": clt.Analysis.OriginalReplayStats.Average,
+        "random_avg_xput": clt.Analysis.RandomReplayStats.Average,
+        "window_seconds": clt.AnalysisWindow.Seconds(),
+        "samples": clt.Analysis.Samples,
+        "server": buildinfo.Get(),
+    }
+    // a calibration test on a path that isn't throttled should measure about the rate it was sent at
+    if clt.isCalibration() {
+        output["calibration"] = map[string]interface{}{
+            "expected_xput": testdata.CalibrationMbps,
+        }
+    }
+    if clt.VariantResults != nil {
+        output["variants"] = clt.VariantResults
+    }
+    if clt.Localization != nil {
+        output["localization"] = clt.Localization
+    }
+    if clt.BandwidthProbe != nil {
+        output["bandwidth_probe"] = clt.bandwidthProbeOutput()
+    }
+    serverXputs := make(map[string]interface{})
+    for _, replay := range clt.ReplayResults {
+        comparison := serverThroughputComparison(replay)
+        if comparison != nil && (replay.ReplayID == Original || replay.ReplayID == Random) {
+            serverXputs[replay.ReplayID.String()] = comparison
+        }
     }
+    if len(serverXputs) > 0 {
+        output["server_xputs"] = serverXputs
+    }
+    if clt.LatencyAnalysis != nil {
+        output["latency"] = map[string]interface{}{
+            "differentiation": clt.LatencyAnalysis.Differentiation,
+            "median_diff": clt.LatencyAnalysis.MedianDiff,
+            "ks2_pval": clt.LatencyAnalysis.KS2pVal,
+            "original_median_rtt_ms": clt.LatencyAnalysis.OriginalReplayStats.Median,
+            "random_median_rtt_ms": clt.LatencyAnalysis.RandomReplayStats.Median,
+        }
+    }
+    jsonOutput, err := json.Marshal(output)
+    if err != nil {
+        return err
+    }
+    return clt.writeArtifact(resultsDir, artifacts.Decision, Original, string(jsonOutput))
+}
 
-    ipv6 := ip.To16()
-    if ipv6 != nil {
-        mask := net.CIDRMask(48, 128) // /48 mask
-        anonIP := ipv6.Mask(mask)
-        return anonIP.String(), nil
+// Writes the full analysis of the test to the results file of the results layout (by default,
+// tempResultsDir/userID/decisions/results_<userID>_Client_<testID>_1.json). The name and the first
+// twelve fields match the results files that wehe-py3 writes and serves to old clients, in which the
+// test ID is called the history count and the replay ID is called the test ID; the analysis is
+// always of the random replay (replay ID 1) against the original. The rest of the fields hold the
+// analysis that wehe-py3 doesn't store.
+//
+// Fields written to disk:
+// replayName, date (YYYY-MM-DD HH:MM:SS, when the test started, in UTC), userID, extraString,
+//     historyCount (the test ID), testID (always 1)
+// area_test: the area test statistic, i.e. the difference between the average throughputs
+//     relative to the larger of the two
+// ks2_ratio_test: the fraction of the sampled K-S tests that accepted the null hypothesis
+// xput_avg_original, xput_avg_test: the average throughputs of the original and random replays
+// ks2dVal, ks2pVal: the statistic and p-value of the K-S test over all the throughputs
+// area: the difference between the average throughputs of the random and original replays
+// xput_min: the smallest throughput of either replay
+// ks2dVal_avg, ks2pVal_avg: the average statistic and p-value of the sampled K-S tests
+// differentiation: whether the decision policy found differentiation
+// window_seconds: how much of each replay was compared; 0 if all of it was
+// original_stats, random_stats: the throughputs (xputs) of each replay that were analyzed, and
+//     their max, min, average, median, and standard deviation
+//
+// resultsDir: the root directory of the results to place the results file in
+// Returns any errors
+func (clt *Client) WriteResultsToFile(resultsDir string) error {
+    if clt.Analysis == nil {
+        return fmt.Errorf("Test %s of user %s has not been analyzed; there are no results to write", clt.artifactTestID(), clt.UserID)
+    }
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return err
     }
 
-    return "", fmt.Errorf("Unknown IP address type: %s\n", ipString)
+    statsOutput := func(stats *analysis.DataSetStats) map[string]interface{} {
+        return map[string]interface{}{
+            "xputs": stats.Data,
+            "max": stats.Max,
+            "min": stats.Min,
+            "average": stats.Average,
+            "median": stats.Median,
+            "stddev": stats.StandardDeviation,
+        }
+    }
+    output := map[string]interface{}{
+        "replayName": currentReplay.ReplayName,
+        "date": clt.StartTime.UTC().Format("2006-01-02 15:04:05"),
+        "userID": clt.UserID,
+        "extraString": clt.ExtraString,
+        "historyCount": clt.artifactTestID(),
+        "testID": strconv.Itoa(int(Random)),
+        "area_test": clt.Analysis.Area0var,
+        "ks2_ratio_test": clt.Analysis.KS2AcceptRatio,
+        "xput_avg_original": clt.Analysis.OriginalReplayStats.Average,
+        "xput_avg_test": clt.Analysis.RandomReplayStats.Average,
+        "ks2dVal": clt.Analysis.KS2dVal,
+        "ks2pVal": clt.Analysis.KS2pVal,
+        "area": clt.Analysis.Area,
+        "xput_min": clt.Analysis.XPutMin,
+        "ks2dVal_avg": clt.Analysis.DValAvg,
+        "ks2pVal_avg": clt.Analysis.PValAvg,
+        "differentiation": clt.Analysis.Differentiation,
+        "window_seconds": clt.AnalysisWindow.Seconds(),
+        "samples": clt.Analysis.Samples,
+        "original_stats": statsOutput(clt.Analysis.OriginalReplayStats),
+        "random_stats": statsOutput(clt.Analysis.RandomReplayStats),
+    }
+    jsonOutput, err := json.Marshal(output)
+    if err != nil {
+        return err
+    }
+    return clt.writeArtifact(resultsDir, artifacts.AnalysisResults, Random, string(jsonOutput))
 }
 
 // Writes information about the replay to disk in a JSON array. The contents of the file match the
-// format of the old server; therefore some fields may be obsolete. Writes information to
-// tempResultsDir/userID/replayInfo/replayInfo_<userID>_<testID>_<replayID>.json.
+// format of the old server; therefore some fields may be obsolete. Writes information to the replay
+// info file of the results layout (by default,
+// tempResultsDir/userID/replayInfo/replayInfo_<userID>_<testID>_<replayID>.json). The IP and
+// location are stored as the data profile of the client allows.
 //
 // Items written to disk include:
 // 1. Replay start time - this is the time when the server received the client connection, the
@@ -518,10 +2247,10 @@ func getAnonIP(ipString string) (string, error) {
 // 6. Extra string
 // 7. Test ID, as a string
 // 8. Replay ID, as a string
-// 9. Any exceptions (in practice this is always "NoExp", as if there is an exception, the code
-//    does not reach this point, even in the old version of the server)
-// 10. Whether the replay packets finish sending, as a boolean (this is always true, as the code,
-//     even in the old version, does not reach this point if the packets do not successfully send)
+// 9. Any exceptions of the test so far, separated by "; " ("NoExp" if there are none; errors the
+//    replay servers encountered while sending the replay packets are reported here)
+// 10. Whether the replay packets finish sending, as a boolean (false if the replay servers aborted
+//     the replay because of an error)
 // 11. Whether "result;no" and jitter are sent successfully, as a boolean (this is deprecated, so
 //     true is always sent)
 // 12. The iperf rate (this is deprecated, so it is always nil)
@@ -531,6 +2260,34 @@ func getAnonIP(ipString string) (string, error) {
 // 16. The boolean false
 // 17. Version number of the Wehe client
 // 18. A M-Lab globally unique UUID
+// 19. The number of seconds the client asked the replay to run for, as a float (0 if the whole replay
+//     was run)
+// 20. The number of bytes the replay servers sent to the client during the replay, as an int
+// 21. The response sets of a TCP replay, numbered from 1, whose request from the client didn't hash
+//     to the request in the replay file, as an array of ints (null if every request matched, if
+//     the replay is UDP, or if requests aren't checked)
+// 22. The packets of a UDP replay that were larger than the path MTU to the client, as an object with
+//     path_mtu, largest_payload, skipped, and clamped (null if the replay is TCP or packets aren't
+//     sent with the DF bit)
+// 23. The build of the server and the settings it ran the replay with, as an object with version,
+//     commit, commit_time, modified, go_version, goos, goarch, and features
+// 24. The exceptions of the test so far (the same as #9, with more detail), as an object with
+//     exceptions, an array of objects with time, phase, replay_name, and message, and dropped, the
+//     number of exceptions after the first 32 that weren't kept
+// 25. The TCP packets the server sent on each server port, from a packet capture, as an object keyed
+//     by port (null if they weren't captured)
+// 26. The number of seconds the UDP replay servers sent the replay for before cutting it off, as a
+//     float (0 for TCP replays)
+// 27. Whether the replay lasts longer than its timeout, so its end was never sent, as a boolean
+// 28. The jitter the UDP replay servers measured, as an object with sent_packets, send_jitter_ms,
+//     send_delay_min_ms, send_delay_max_ms, send_delay_variation_ms, received_packets, and
+//     receive_jitter_ms (null if the replay is TCP)
+// 29. Where the traffic of the replay came from, as an object with capture_date, capture_location,
+//     and usage_notes, each left out if the replay file doesn't give it (null if the replay file
+//     gives none of them)
+// 30. The number of throughput samples the client was told to take during the replay, as an integer
+// 31. The experiment flags the client sent when it declared the test, as a string, exactly as sent
+//     (empty if it sent none)
 //
 // resultsDir: the root directory of the results to place the replay information in
 // Returns any errors
@@ -542,13 +2299,14 @@ func (clt *Client) WriteReplayInfoToFile(resultsDir string) error {
 
     // convert start time into proper format
     startTimeFormatted := clt.StartTime.Format("2006-01-02 15:04:05")
-    anonIP, err := getAnonIP(clt.PublicIP)
+    profile := clt.dataProfile()
+    anonIP, err := profile.Anonymizer.IPString(clt.PublicIP)
     if err != nil {
         return err
     }
 
     // convert mobile stats into a string
-    mobileStatsString, err := json.Marshal(clt.MobileStats)
+    mobileStatsString, err := json.Marshal(profile.mobileStats(clt.MobileStats))
     if err != nil {
         return err
     }
@@ -563,16 +2321,29 @@ func (clt *Client) WriteReplayInfoToFile(resultsDir string) error {
         clt.ExtraString, // 6
         strconv.Itoa(clt.TestID), // 7
         strconv.Itoa(int(currentReplay.ReplayID)), // 8
-        clt.Exceptions, // 9
-        true, // 10
+        clt.Exceptions.Legacy(), // 9
+        !currentReplay.Aborted, // 10
         true, // 11
         nil, // 12
-        time.Since(clt.StartTime).Seconds(), // 13
+        clk.Since(clt.StartTime).Seconds(), // 13
         strconv.FormatFloat(currentReplay.ReplayDuration.Seconds(), 'f', 9, 64), // 14
         string(mobileStatsString), // 15
         false, // 16
         clt.ClientVersion, // 17
         clt.MLabUUID, // 18
+        currentReplay.MaxDuration.Seconds(), // 19
+        currentReplay.BytesSent, // 20
+        currentReplay.RequestHashMismatches, // 21
+        currentReplay.PathMTU, // 22
+        buildinfo.Get(), // 23
+        clt.Exceptions, // 24
+        currentReplay.Loss, // 25
+        currentReplay.ReplayTimeout.Seconds(), // 26
+        currentReplay.TimeoutTruncated, // 27
+        currentReplay.Jitter, // 28
+        currentReplay.Provenance, // 29
+        currentReplay.SamplesPerReplay, // 30
+        clt.ExperimentFlags, // 31
     }
     jsonArrayOutput, err := json.Marshal(outputItems)
     if err != nil {
@@ -580,37 +2351,155 @@ func (clt *Client) WriteReplayInfoToFile(resultsDir string) error {
     }
 
     // write replay information to disk
-    replayInfoDir := filepath.Join(resultsDir, clt.UserID, "replayInfo")
-    filename := "replayInfo_" + clt.UserID + "_" + strconv.Itoa(clt.TestID) + "_" + strconv.Itoa(int(currentReplay.ReplayID)) + ".json"
-    err = writeToFile(replayInfoDir, filename, string(jsonArrayOutput))
+    err = clt.writeArtifact(resultsDir, artifacts.ReplayInfo, currentReplay.ReplayID, string(jsonArrayOutput))
     if err != nil {
         return err
     }
     return nil
 }
 
-func (clt *Client) CleanUp(connectedClientIPs *ConnectedClients) {
-    fmt.Println("Cleaning up connection to", clt.PublicIP)
-    connectedClientIPs.del(clt.PublicIP)
-}
+// Writes the side channel RTT samples collected during the test and their statistics to the side
+// channel RTT file of the results layout (by default,
+// tempResultsDir/userID/sideChannelRTTs/sideChannelRTT_<userID>_<testID>.json). Nothing is written
+// if the client never measured the RTT or if the data profile of the client doesn't store RTTs.
+// resultsDir: the root directory of the results to place the RTTs in
+// Returns any errors
+func (clt *Client) WriteSideChannelRTTsToFile(resultsDir string) error {
+    if len(clt.SideChannelRTTs) == 0 || !clt.dataProfile().StoreSideChannelRTTs {
+        return nil
+    }
 
-// Write contents to a file. Any missing directories will be created.
-// parentDir: the parent directory of the file
-// filename: the name of the file
-// contents: the contents of the file to write
-func writeToFile(parentDir string, filename string, contents string) error {
-    if err := os.MkdirAll(parentDir, 0755); err != nil {
+    rttStats, err := analysis.NewDataSetStats(clt.SideChannelRTTs)
+    if err != nil {
         return err
     }
 
-    file, err := os.Create(filepath.Join(parentDir, filename))
+    output := map[string]interface{}{
+        "rtts_ms": clt.SideChannelRTTs,
+        "count": len(clt.SideChannelRTTs),
+        "min_ms": rttStats.Min,
+        "max_ms": rttStats.Max,
+        "average_ms": rttStats.Average,
+        "median_ms": rttStats.Median,
+        "stddev_ms": rttStats.StandardDeviation,
+    }
+    jsonOutput, err := json.Marshal(output)
     if err != nil {
         return err
     }
-    defer file.Close()
 
-    if _, err := file.WriteString(contents); err != nil {
+    err = clt.writeArtifact(resultsDir, artifacts.SideChannelRTT, Original, string(jsonOutput))
+    if err != nil {
         return err
     }
     return nil
 }
+
+// Writes the manifest of the test once the test is over, listing the size and checksum of every
+// result file written for it. Failing to write the manifest doesn't affect the client, so errors
+// are only logged.
+// resultsDir: the root directory of the results
+// Returns the path of the manifest relative to resultsDir and the number of result files it lists,
+//     or an empty path if the manifest couldn't be written
+func (clt *Client) WriteManifest(resultsDir string) (string, int) {
+    manifest := artifacts.Manifest{
+        UserID: clt.UserID,
+        TestID: clt.artifactTestID(),
+        StartTime: clt.StartTime,
+        Files: []artifacts.ManifestFile{},
+    }
+    for _, artifact := range clt.existingArtifacts(resultsDir) {
+        err := manifest.Add(resultsDir, artifact.kind, int(artifact.replayID), artifact.path)
+        if err != nil {
+            clt.Logger().Error("Unable to add result file to manifest", "path", artifact.path, "error", err)
+            return "", 0
+        }
+    }
+    jsonOutput, err := json.Marshal(manifest)
+    if err == nil {
+        err = clt.writeArtifact(resultsDir, artifacts.TestManifest, Original, string(jsonOutput))
+    }
+    var manifestPath string
+    if err == nil {
+        manifestPath, err = clt.artifactPath(resultsDir, artifacts.TestManifest, Original)
+    }
+    if err == nil {
+        manifestPath, err = filepath.Rel(resultsDir, manifestPath)
+    }
+    if err != nil {
+        clt.Logger().Error("Unable to write manifest", "error", err)
+        return "", 0
+    }
+    return filepath.ToSlash(manifestPath), len(manifest.Files)
+}
+
+// Records the outcome of the test for the daily report and the error budget once the test is over.
+// Failing to record the test doesn't affect the client, so errors are only logged.
+// testErr: the error that ended the test, or nil if the test ended normally
+func (clt *Client) ReportTest(testErr error) {
+    if testErr != nil {
+        errorbudget.Record(errorbudget.FailedTests, 1)
+    }
+    if testReporter == nil {
+        return
+    }
+
+    record := report.TestRecord{
+        Time: clk.Now().UTC(),
+        Carrier: "unknown",
+        City: "unknown",
+        ClientVersion: clt.ClientVersion,
+        Verdict: report.Incomplete,
+        BytesSent: clt.BytesSent(),
+        Calibration: clt.isCalibration(),
+    }
+    for _, replayResult := range clt.ReplayResults {
+        if replayResult.ReplayID == Original {
+            record.App = replayResult.ReplayName
+        }
+    }
+    // the report only uses as much of the location as the result files store
+    mobileStats := clt.dataProfile().mobileStats(clt.MobileStats)
+    carrier, ok := mobileStats["carrierName"].(string)
+    if ok && carrier != "" {
+        record.Carrier = carrier
+    }
+    locationInfo, ok := mobileStats["locationInfo"].(map[string]interface{})
+    if ok {
+        city, _ := locationInfo["city"].(string)
+        country, _ := locationInfo["country"].(string)
+        if city != "" && country != "" {
+            record.City = city + ", " + country
+        }
+    }
+    if testErr != nil {
+        record.Verdict = report.Failed
+        record.Error = testErr.Error()
+    } else if clt.Analysis != nil {
+        record.Verdict = report.NoDifferentiation
+        if clt.Analysis.Differentiation {
+            record.Verdict = report.Differentiation
+        } else if clt.Analysis.Verdict.Inconclusive {
+            record.Verdict = report.Inconclusive
+        }
+    }
+
+    err := testReporter.Record(record)
+    if err != nil {
+        clt.Logger().Error("Unable to record test for report", "error", err)
+    }
+}
+
+func (clt *Client) CleanUp(connectedClientIPs *ConnectedClients) {
+    clt.Logger().Debug("Cleaning up connection")
+    connectedClientIPs.del(clt.ReplayKey())
+    if replayScheduler != nil {
+        replayScheduler.Release(clt)
+    }
+    if replayGroups != nil {
+        replayGroups.Release(clt)
+    }
+    if bandwidthProbes != nil {
+        bandwidthProbes.cancel(clt.ReplayKey())
+    }
+}
@@ -0,0 +1,268 @@
+// Tests of the decoding of the throughputs sent by clients, which must stop at MaxThroughputSamples
+// without allocating what a huge message asks for, of comparing replays with too few samples, of the
+// samples per replay clients can ask for, of forgetting clients that hold a replay for longer than a
+// test can last, and of waiting for the running tests when the server drains.
+package clienthandler
+
+import (
+    "encoding/json"
+    "errors"
+    "runtime"
+    "strings"
+    "testing"
+    "time"
+
+    "wehe-server/internal/analysis"
+    "wehe-server/internal/clock"
+    "wehe-server/internal/errs"
+)
+
+// Builds a JSON array of numbers.
+// n: the number of values in the array
+// Returns the array
+func numberArray(n int) string {
+    return "[" + strings.TrimSuffix(strings.Repeat("1.5,", n), ",") + "]"
+}
+
+// Gets the bytes a function allocates.
+// f: the function
+// Returns the bytes allocated while it ran
+func allocatedBytes(f func()) uint64 {
+    var before runtime.MemStats
+    var after runtime.MemStats
+    runtime.GC()
+    runtime.ReadMemStats(&before)
+    f()
+    runtime.ReadMemStats(&after)
+    return after.TotalAlloc - before.TotalAlloc
+}
+
+// Checks that arrays past MaxThroughputSamples are rejected with errs.ErrTooManySamples once the limit
+// is passed, and that anything else that isn't two arrays of numbers is malformed.
+func TestDecodeThroughputs(t *testing.T) {
+    tests := []struct {
+        name string
+        data string
+        wantErr error // the kind of the error; nil if the data decodes
+        wantLens [2]int // the lengths of the arrays if the data decodes
+    }{
+        {"empty arrays", "[[],[]]", nil, [2]int{0, 0}},
+        {"at the limit", "[" + numberArray(MaxThroughputSamples) + "," + numberArray(MaxThroughputSamples) + "]", nil, [2]int{MaxThroughputSamples, MaxThroughputSamples}},
+        {"throughputs one past the limit", "[" + numberArray(MaxThroughputSamples + 1) + "," + numberArray(1) + "]", errs.ErrTooManySamples, [2]int{}},
+        {"sample times one past the limit", "[" + numberArray(1) + "," + numberArray(MaxThroughputSamples + 1) + "]", errs.ErrTooManySamples, [2]int{}},
+        {"far past the limit", "[" + numberArray(1000 * MaxThroughputSamples) + ",[]]", errs.ErrTooManySamples, [2]int{}},
+        // the values past the limit aren't numbers, so decoding any of them would make the data
+        // malformed; the limit error shows that decoding stopped at the limit
+        {"garbage past the limit", "[" + strings.TrimSuffix(numberArray(MaxThroughputSamples), "]") + strings.Repeat(",\"x\"", 1000) + "],[]]", errs.ErrTooManySamples, [2]int{}},
+        {"one array", "[" + numberArray(3) + "]", errs.ErrMalformedMessage, [2]int{}},
+        {"three arrays", "[[1],[2],[3]]", errs.ErrMalformedMessage, [2]int{}},
+        {"not numbers", "[[\"a\"],[1]]", errs.ErrMalformedMessage, [2]int{}},
+        {"trailing data", "[[1],[2]][]", errs.ErrMalformedMessage, [2]int{}},
+        {"cut short", "[[1,2],[3", errs.ErrMalformedMessage, [2]int{}},
+    }
+    for _, test := range tests {
+        test := test
+        t.Run(test.name, func(t *testing.T) {
+            var arrays [][]float64
+            var err error
+            allocated := allocatedBytes(func() {
+                arrays, err = decodeThroughputs(test.data)
+            })
+            if test.wantErr == nil {
+                if err != nil {
+                    t.Fatalf("decodeThroughputs() returned %v", err)
+                }
+                if len(arrays[0]) != test.wantLens[0] || len(arrays[1]) != test.wantLens[1] {
+                    t.Errorf("decoded arrays of %d and %d values; want %d and %d", len(arrays[0]), len(arrays[1]), test.wantLens[0], test.wantLens[1])
+                }
+                return
+            }
+            if !errors.Is(err, test.wantErr) {
+                t.Fatalf("decodeThroughputs() returned %v; want %v", err, test.wantErr)
+            }
+            if test.wantErr == errs.ErrTooManySamples {
+                var limitErr *errs.LimitError
+                if !errors.As(err, &limitErr) || limitErr.Limit != MaxThroughputSamples {
+                    t.Errorf("decodeThroughputs() returned %v; want a LimitError with limit %d", err, MaxThroughputSamples)
+                }
+                if arrays != nil {
+                    t.Errorf("decodeThroughputs() returned arrays of %d values with the error", len(arrays))
+                }
+                // what decoding up to the limit allocates depends on the runtime, so this only checks
+                // that the message far past the limit, 40 MB, isn't materialised; the race detector
+                // instruments every allocation, so the check is skipped under it
+                if limit := uint64(8 << 20); !raceEnabled && allocated > limit {
+                    t.Errorf("decoding allocated %d bytes; want at most %d", allocated, limit)
+                }
+            }
+        })
+    }
+}
+
+// Compares replays whose samples the matching window leaves too few of, or none of, and checks that
+// the comparison is inconclusive rather than an error, and that its results can be written as JSON.
+func TestCompareReplaysTooFewSamples(t *testing.T) {
+    SetMinThroughputSamples(3)
+    defer SetMinThroughputSamples(0)
+    full := ReplayResult{
+        Throughputs: []float64{5, 6, 7, 8, 9},
+        SampleTimes: []float64{1, 2, 3, 4, 5},
+    }
+    tests := []struct {
+        name string
+        replay ReplayResult
+        wantSamples [2]int // the samples of the replay and of the control within the window
+    }{
+        {"every sample windowed away", ReplayResult{
+            Throughputs: []float64{1, 2},
+            SampleTimes: []float64{1.5, 2.5},
+            MaxDuration: 500 * time.Millisecond,
+        }, [2]int{0, 0}},
+        {"one sample left", ReplayResult{
+            Throughputs: []float64{1, 2},
+            SampleTimes: []float64{0.5, 2.5},
+            MaxDuration: time.Second,
+        }, [2]int{1, 1}},
+        {"only zero samples", ReplayResult{
+            Throughputs: []float64{0, 0, 0},
+            SampleTimes: []float64{1, 2, 3},
+        }, [2]int{0, 5}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            results, _, err := compareReplays(test.replay, full, analysis.DefaultPolicy)
+            if err != nil {
+                t.Fatalf("compareReplays() returned %v", err)
+            }
+            if !results.Verdict.Inconclusive || results.Differentiation {
+                t.Errorf("Verdict = %+v; want inconclusive without differentiation", results.Verdict)
+            }
+            if results.Samples.OriginalSamples != test.wantSamples[0] || results.Samples.RandomSamples != test.wantSamples[1] {
+                t.Errorf("Samples = %+v; want %d and %d", results.Samples, test.wantSamples[0], test.wantSamples[1])
+            }
+            _, err = json.Marshal(results)
+            if err != nil {
+                t.Errorf("Results can't be written as JSON: %v", err)
+            }
+        })
+    }
+}
+
+// Checks that the samples per replay a client asks for parse as a number that isn't negative, and
+// that empty means the client didn't ask.
+func TestParseSamplesPerReplay(t *testing.T) {
+    tests := []struct {
+        samples string
+        want int
+        wantErr bool
+    }{
+        {"", 0, false},
+        {"0", 0, false},
+        {"10", 10, false},
+        {"250", 250, false},
+        {"-1", 0, true},
+        {"ten", 0, true},
+        {"1.5", 0, true},
+    }
+    for _, test := range tests {
+        got, err := ParseSamplesPerReplay(test.samples)
+        if test.wantErr {
+            if !errors.Is(err, errs.ErrMalformedMessage) {
+                t.Errorf("ParseSamplesPerReplay(%q) returned %d, %v; want an error wrapping %v", test.samples, got, err, errs.ErrMalformedMessage)
+            }
+            continue
+        }
+        if err != nil || got != test.want {
+            t.Errorf("ParseSamplesPerReplay(%q) = %d, %v; want %d", test.samples, got, err, test.want)
+        }
+    }
+}
+
+// Checks that the samples per replay a client asks for are kept between the fewest and the most the
+// server allows, that the server picks the number if the client doesn't ask, and that negotiating
+// fails without a replay to negotiate for.
+func TestNegotiateSamplesPerReplay(t *testing.T) {
+    SetSamplesPerReplay(10, 5, 50)
+    defer SetSamplesPerReplay(DefaultSamplesPerReplay, DefaultSamplesPerReplay, DefaultSamplesPerReplay)
+    tests := []struct {
+        requested int
+        want int
+    }{
+        {0, 10},
+        {1, 5},
+        {5, 5},
+        {20, 20},
+        {50, 50},
+        {51, 50},
+        {100000, 50},
+    }
+    for _, test := range tests {
+        clt := &Client{}
+        clt.AddReplay(Original, "replay", false)
+        err := clt.NegotiateSamplesPerReplay(test.requested)
+        if err != nil {
+            t.Fatalf("NegotiateSamplesPerReplay(%d) returned %v", test.requested, err)
+        }
+        if got := clt.ReplayResults[0].SamplesPerReplay; got != test.want {
+            t.Errorf("NegotiateSamplesPerReplay(%d) set %d samples; want %d", test.requested, got, test.want)
+        }
+    }
+
+    if err := (&Client{}).NegotiateSamplesPerReplay(20); err == nil {
+        t.Error("NegotiateSamplesPerReplay() without a replay returned no error")
+    }
+}
+
+// Advances a fake clock past the longest a test can last and checks that clients holding a replay
+// are forgotten then, and not before.
+func TestReapStale(t *testing.T) {
+    fake := clock.NewFake(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+    SetClock(fake)
+    defer SetClock(clock.Real{})
+    connectedClients := NewConnectedClients()
+    connectedClients.Grant("192.0.2.1", "replay")
+    fake.Advance(time.Minute)
+    connectedClients.Grant("192.0.2.2", "replay")
+
+    fake.Advance(9 * time.Minute)
+    if reaped := connectedClients.ReapStale(10 * time.Minute); len(reaped) != 0 {
+        t.Fatalf("ReapStale() at the limit forgot %v", reaped)
+    }
+    fake.Advance(time.Second)
+    reaped := connectedClients.ReapStale(10 * time.Minute)
+    if len(reaped) != 1 || reaped[0] != "192.0.2.1" {
+        t.Fatalf("ReapStale() past the limit of the first client forgot %v; want [192.0.2.1]", reaped)
+    }
+    if connectedClients.HasIP("192.0.2.1") || !connectedClients.HasIP("192.0.2.2") {
+        t.Error("ReapStale() didn't forget only the first client")
+    }
+}
+
+// Waits for running tests on a fake clock and checks that the wait gives up once the timeout has
+// passed, polling on the clock rather than sleeping for real, and returns right away once no tests
+// are running.
+func TestInFlightWait(t *testing.T) {
+    fake := clock.NewFake(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+    SetClock(fake)
+    defer SetClock(clock.Real{})
+    inFlightTests := NewInFlightTests(t.TempDir())
+    clt := NewClient(nil, "abcdefghij", "", 0, "192.0.2.1", "4.0", "")
+    inFlightTests.Add(clt)
+
+    start := fake.Now()
+    if inFlightTests.Wait(time.Second) {
+        t.Fatal("Wait() returned true with a test still running")
+    }
+    if waited := fake.Since(start); waited < time.Second || waited > time.Second + inFlightPollInterval {
+        t.Errorf("Wait() gave up after %v; want 1s", waited)
+    }
+
+    inFlightTests.Remove(clt)
+    start = fake.Now()
+    if !inFlightTests.Wait(time.Second) {
+        t.Fatal("Wait() returned false with no tests running")
+    }
+    if waited := fake.Since(start); waited != 0 {
+        t.Errorf("Wait() with no tests running waited %v", waited)
+    }
+}
@@ -0,0 +1,70 @@
+// Puts client IPs in one form, so that the IP a client is granted a replay under matches the IP the
+// replay servers see its packets come from. IPv6 addresses can be written many ways, e.g. with
+// upper case hex digits, zeros that could be left out, or a zone, and dual-stack sockets see IPv4
+// clients as IPv4-mapped IPv6 addresses; all of them are turned into the canonical form of the
+// address, with IPv4-mapped addresses turned back into IPv4.
+package clienthandler
+
+import (
+    "fmt"
+    "net"
+    "net/netip"
+)
+
+// Puts an IP in its canonical form.
+// ip: the IP, e.g. 2001:DB8::0:1 or ::ffff:192.0.2.1
+// Returns the canonical IP, e.g. 2001:db8::1 or 192.0.2.1, or an error if ip isn't an IP
+func NormalizeIP(ip string) (string, error) {
+    addr, err := netip.ParseAddr(ip)
+    if err != nil {
+        return "", fmt.Errorf("Invalid IP address %s: %v", ip, err)
+    }
+    return normalizeAddr(addr), nil
+}
+
+// Gets the canonical IP of the address of a connection or a packet.
+// addr: the address, e.g. the remote address of a TCP connection or where a UDP packet came from
+// Returns the canonical IP of the address, or an error if the address doesn't have one
+func AddrIP(addr net.Addr) (string, error) {
+    switch addr := addr.(type) {
+    case *net.TCPAddr:
+        return addrFromIP(addr.IP)
+    case *net.UDPAddr:
+        return addrFromIP(addr.IP)
+    }
+    addrPort, err := netip.ParseAddrPort(addr.String())
+    if err != nil {
+        return "", fmt.Errorf("Unable to get the IP of address %s: %v", addr, err)
+    }
+    return normalizeAddr(addrPort.Addr()), nil
+}
+
+// Gets the canonical form of a net.IP.
+// ip: the IP
+// Returns the canonical IP, or an error if ip is empty or malformed
+func addrFromIP(ip net.IP) (string, error) {
+    addr, ok := netip.AddrFromSlice(ip)
+    if !ok {
+        return "", fmt.Errorf("Invalid IP address %v", ip)
+    }
+    return normalizeAddr(addr), nil
+}
+
+// Gets the canonical form of a netip.Addr.
+// addr: the address
+// Returns the canonical IP
+func normalizeAddr(addr netip.Addr) string {
+    return addr.Unmap().WithZone("").String()
+}
+
+// Gets the key of a client in ConnectedClients. Keys that aren't IPs, e.g. replay tokens, are used as
+// they are, so that they still only match themselves.
+// ip: the IP or replay token of the client
+// Returns the key of the client
+func clientKey(ip string) string {
+    normalized, err := NormalizeIP(ip)
+    if err != nil {
+        return ip
+    }
+    return normalized
+}
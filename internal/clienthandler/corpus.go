@@ -0,0 +1,293 @@
+// Fabricates result trees of synthetic tests, so that whatever reads the results directory (the
+// uploaders, the exporters, the retention janitor, and the aggregate endpoints) can be tried at the
+// scale of a fleet without real user data. Each synthetic test is run through the same code that
+// writes the results of a real test: its throughputs, replay info, decision, results, and manifest
+// files are written with the results layout and anonymizer of the server, and its verdict comes
+// from the decision policy. Client IPs are taken from the documentation ranges (RFC 5737), so a
+// synthetic test can never be mistaken for a real user.
+package clienthandler
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "math/rand"
+    "sort"
+    "strings"
+    "time"
+
+    "wehe-server/internal/artifacts"
+    "wehe-server/internal/clock"
+    "wehe-server/internal/devices"
+    "wehe-server/internal/testdata"
+)
+
+const (
+    corpusUserIDChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+    corpusUserIDLength = 10 // length of a user ID, as generated by the app
+    corpusMinReplaySeconds = 15.0 // shortest synthetic replay
+    corpusMaxReplaySeconds = 45.0 // longest synthetic replay
+    corpusMedianMbps = 20.0 // median throughput of a synthetic client
+    corpusMinThrottle = 0.2 // lowest fraction of its throughput a differentiated original replay gets
+    corpusMaxThrottle = 0.6 // highest fraction of its throughput a differentiated original replay gets
+)
+
+var (
+    // IP ranges reserved for documentation that synthetic clients connect from
+    corpusIPPrefixes = []string{"192.0.2.", "198.51.100.", "203.0.113."}
+
+    // versions of the app synthetic clients run
+    corpusClientVersions = []string{"3.7.4", "3.8.0", "4.0.1", "4.1.0"}
+
+    // devices synthetic clients run on
+    corpusModels = []string{"Pixel 7", "Pixel 8 Pro", "SM-S911B", "SM-A536B", "iPhone14,5", "iPhone15,2", "moto g power (2022)"}
+
+    // places synthetic clients are in, with the carriers they use there
+    corpusLocations = []corpusLocation{
+        {Country: "United States", CountryCode: "US", City: "Boston", Latitude: 42.4, Longitude: -71.1, TimeZone: "America/New_York", Carriers: []string{"Verizon", "T-Mobile", "AT&T"}},
+        {Country: "United States", CountryCode: "US", City: "Seattle", Latitude: 47.6, Longitude: -122.3, TimeZone: "America/Los_Angeles", Carriers: []string{"Verizon", "T-Mobile", "AT&T"}},
+        {Country: "United Kingdom", CountryCode: "GB", City: "London", Latitude: 51.5, Longitude: -0.1, TimeZone: "Europe/London", Carriers: []string{"EE", "Vodafone UK", "O2 - UK"}},
+        {Country: "Germany", CountryCode: "DE", City: "Berlin", Latitude: 52.5, Longitude: 13.4, TimeZone: "Europe/Berlin", Carriers: []string{"Telekom.de", "Vodafone.de", "o2 - de"}},
+        {Country: "India", CountryCode: "IN", City: "Mumbai", Latitude: 19.1, Longitude: 72.9, TimeZone: "Asia/Kolkata", Carriers: []string{"Jio", "Airtel", "Vi India"}},
+        {Country: "Brazil", CountryCode: "BR", City: "Sao Paulo", Latitude: -23.6, Longitude: -46.6, TimeZone: "America/Sao_Paulo", Carriers: []string{"VIVO", "Claro BR", "TIM"}},
+    }
+)
+
+// A place synthetic clients test from.
+type corpusLocation struct {
+    Country string // the name of the country
+    CountryCode string // the two letter code of the country
+    City string // the name of the city
+    Latitude float64 // the latitude of the city, rounded like the server rounds client locations
+    Longitude float64 // the longitude of the city, rounded like the server rounds client locations
+    TimeZone string // the IANA name of the time zone of the city
+    Carriers []string // the mobile carriers of the country
+}
+
+// What a synthetic results corpus looks like.
+type CorpusSettings struct {
+    Users int // number of synthetic users
+    TestsPerUser int // number of tests each user runs
+    DifferentiationRate float64 // fraction of tests whose original replay is throttled, from 0 to 1
+    End time.Time // the tests start in the Days before this time
+    Days int // number of days the tests are spread over
+    Seed int64 // seeds the random choices, so that the same settings make the same corpus
+}
+
+// What was written to a synthetic results corpus.
+type CorpusStats struct {
+    Users int `json:"users"` // number of users written
+    Tests int `json:"tests"` // number of tests written
+    Files int `json:"files"` // number of result files written, not counting manifests
+    Throttled int `json:"throttled"` // number of tests whose original replay was throttled
+    Differentiation int `json:"differentiation"` // number of tests the decision policy found differentiation in
+}
+
+// Writes a corpus of synthetic tests to a results directory. Every test runs an original replay and
+// its random replay, picked from the replays on the server, and is analyzed with the current
+// decision policy. The tests are written as if they had run at their start times, so that layouts
+// partitioned by date spread them over the days of the corpus. This uses the clock of the package,
+// so it must not be called while clients are connected.
+// replays: the replays on the server
+// settings: what the corpus looks like
+// resultsDir: the root directory to write the results in, using the results layout
+// Returns what was written, or any errors
+func GenerateCorpus(replays *testdata.Registry, settings CorpusSettings, resultsDir string) (CorpusStats, error) {
+    var stats CorpusStats
+    originals := corpusOriginalReplays(replays)
+    if len(originals) == 0 {
+        return stats, fmt.Errorf("No replays with a random replay to generate tests from")
+    }
+    random := rand.New(rand.NewSource(settings.Seed))
+    span := time.Duration(settings.Days) * 24 * time.Hour
+    defer SetClock(clk)
+
+    for i := 0; i < settings.Users; i++ {
+        userID := corpusUserID(random)
+        location := corpusLocations[random.Intn(len(corpusLocations))]
+        clientIP := corpusIPPrefixes[random.Intn(len(corpusIPPrefixes))] + fmt.Sprint(1 + random.Intn(254))
+        clientVersion := corpusClientVersions[random.Intn(len(corpusClientVersions))]
+        model := corpusModels[random.Intn(len(corpusModels))]
+        medianMbps := corpusMedianMbps * math.Exp(0.8 * random.NormFloat64())
+
+        // the tests of a user run in order, with the test ID counting up like it does in the app
+        startTimes := make([]time.Time, settings.TestsPerUser)
+        for j := range startTimes {
+            startTimes[j] = settings.End.Add(-time.Duration(random.Int63n(int64(span) + 1)))
+        }
+        sort.Slice(startTimes, func(a, b int) bool {
+            return startTimes[a].Before(startTimes[b])
+        })
+        for testID, startTime := range startTimes {
+            fakeClock := clock.NewFake(startTime)
+            SetClock(fakeClock)
+            clt := NewClient(nil, userID, "0", testID, clientIP, clientVersion, "")
+            clt.CountryCode = location.CountryCode
+            clt.MobileStats = corpusMobileStats(random, location, model, clt.StartTime)
+
+            originalName := originals[random.Intn(len(originals))]
+            replayNames := map[ReplayType]string{
+                Original: originalName,
+                Random: corpusRandomReplayName(originalName),
+            }
+            mbps := medianMbps * math.Exp(0.3 * random.NormFloat64())
+            throttle := 1.0
+            if random.Float64() < settings.DifferentiationRate {
+                throttle = corpusMinThrottle + random.Float64() * (corpusMaxThrottle - corpusMinThrottle)
+                stats.Throttled++
+            }
+            for _, replayID := range []ReplayType{Original, Random} {
+                clt.AddReplay(replayID, replayNames[replayID], replayID == Random)
+                replayMbps := mbps
+                if replayID == Original {
+                    replayMbps *= throttle
+                }
+                err := clt.writeCorpusReplay(random, replayMbps, fakeClock, resultsDir)
+                if err != nil {
+                    return stats, err
+                }
+            }
+
+            err := clt.AnalyzeTest(resultsDir)
+            if err != nil {
+                return stats, err
+            }
+            err = clt.WriteResultsToFile(resultsDir)
+            if err != nil {
+                return stats, err
+            }
+            _, files := clt.WriteManifest(resultsDir)
+            if files == 0 {
+                return stats, fmt.Errorf("Unable to write the manifest of test %d of user %s", testID, userID)
+            }
+            stats.Tests++
+            stats.Files += files
+            if clt.Analysis.Differentiation {
+                stats.Differentiation++
+            }
+        }
+        stats.Users++
+    }
+    return stats, nil
+}
+
+// Fills in the current replay of a synthetic test and writes its throughputs and replay info. The
+// clock is advanced past the end of the replay.
+// random: the source of the random choices
+// mbps: the throughput the replay runs at on average
+// fakeClock: the clock of the test
+// resultsDir: the root directory to write the results in
+// Returns any errors
+func (clt *Client) writeCorpusReplay(random *rand.Rand, mbps float64, fakeClock *clock.Fake, resultsDir string) error {
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return err
+    }
+    seconds := corpusMinReplaySeconds + random.Float64() * (corpusMaxReplaySeconds - corpusMinReplaySeconds)
+    samples := SamplesPerReplay()
+    throughputs := make([]float64, samples)
+    sampleTimes := make([]float64, samples)
+    for i := range throughputs {
+        // each sample varies around the rate of the replay, with an occasional dip
+        sample := mbps * (1 + 0.15 * random.NormFloat64())
+        if random.Float64() < 0.03 {
+            sample *= random.Float64()
+        }
+        throughputs[i] = math.Max(sample, 0.01)
+        sampleTimes[i] = seconds * float64(i + 1) / float64(samples)
+    }
+    currentReplay.Throughputs = throughputs
+    currentReplay.SampleTimes = sampleTimes
+    currentReplay.ReplayDuration = time.Duration(seconds * float64(time.Second))
+    currentReplay.BytesSent = int64(mbps * seconds * 1000000 / 8)
+
+    jsonBytes, err := json.Marshal([][]float64{throughputs, sampleTimes})
+    if err != nil {
+        return err
+    }
+    err = clt.writeArtifact(resultsDir, artifacts.ClientThroughputs, currentReplay.ReplayID, string(jsonBytes))
+    if err != nil {
+        return err
+    }
+    // the app waits a few seconds between replays
+    fakeClock.Advance(currentReplay.ReplayDuration + time.Duration(2 + random.Intn(5)) * time.Second)
+    return clt.WriteReplayInfoToFile(resultsDir)
+}
+
+// Gets the original replays on the server that have a random replay.
+// replays: the replays on the server
+// Returns the names of the original replays, sorted so that the same seed picks the same replays
+func corpusOriginalReplays(replays *testdata.Registry) []string {
+    names := replays.Names()
+    available := make(map[string]bool)
+    for _, name := range names {
+        available[name] = true
+    }
+    var originals []string
+    for _, name := range names {
+        if testdata.IsCalibration(name) || strings.Contains(name, "Random") {
+            continue
+        }
+        if available[corpusRandomReplayName(name)] {
+            originals = append(originals, name)
+        }
+    }
+    sort.Strings(originals)
+    return originals
+}
+
+// Gets the name of the random replay of an original replay, e.g. YoutubeRandom_12122018 for
+// Youtube_12122018.
+// originalName: the name of the original replay
+// Returns the name of the random replay
+func corpusRandomReplayName(originalName string) string {
+    app, date, found := strings.Cut(originalName, "_")
+    if !found {
+        return originalName + "Random"
+    }
+    return app + "Random_" + date
+}
+
+// Makes up a user ID like the ones the app generates.
+// random: the source of the random choices
+// Returns the user ID
+func corpusUserID(random *rand.Rand) string {
+    userID := make([]byte, corpusUserIDLength)
+    for i := range userID {
+        userID[i] = corpusUserIDChars[random.Intn(len(corpusUserIDChars))]
+    }
+    return string(userID)
+}
+
+// Makes up the mobile stats a client in a location would send, in the form the server stores them.
+// random: the source of the random choices
+// location: where the client is
+// model: the device of the client
+// startTime: when the test started
+// Returns the mobile stats
+func corpusMobileStats(random *rand.Rand, location corpusLocation, model string, startTime time.Time) map[string]interface{} {
+    locationInfo := map[string]interface{}{
+        "country": location.Country,
+        "city": location.City,
+        "latitude": location.Latitude,
+        "longitude": location.Longitude,
+        "localTimeSource": "coordinates",
+    }
+    timeZoneLocation, err := time.LoadLocation(location.TimeZone)
+    if err == nil {
+        locationInfo["localTime"] = startTime.In(timeZoneLocation).Format("2006-01-02 15:04:05-0700")
+    }
+    networkType := "WIFI"
+    carrierName := ""
+    if random.Float64() < 0.6 {
+        networkType = "LTE"
+        carrierName = location.Carriers[random.Intn(len(location.Carriers))]
+    }
+    return map[string]interface{}{
+        "locationInfo": locationInfo,
+        "networkType": networkType,
+        "carrierName": carrierName,
+        "model": model,
+        "normalizedModel": devices.Normalize(model),
+    }
+}
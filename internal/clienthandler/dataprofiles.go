@@ -0,0 +1,110 @@
+// Data-handling profiles that change what is stored about a test depending on the country of the
+// client, so that one server can meet the rules of different deployments, e.g. storing coarser
+// locations for clients in the EU.
+package clienthandler
+
+import (
+    "fmt"
+    "strings"
+
+    "wehe-server/internal/anonymize"
+)
+
+type LocationPrecision string // how much of the client location is stored
+
+const (
+    LocationFull LocationPrecision = "full" // coordinates rounded to 0.1 degrees, city, and country
+    LocationCity LocationPrecision = "city" // city and country
+    LocationCountry LocationPrecision = "country" // country only
+    LocationNone LocationPrecision = "none" // no location
+)
+
+// What is stored about the tests of clients in certain countries.
+type DataProfile struct {
+    Name string // name of the profile
+    Countries []string // ISO 3166 two letter codes of the countries the profile applies to
+    Location LocationPrecision // how much of the client location is stored
+    Anonymizer anonymize.Anonymizer // anonymizes client IPs written to the result files
+    StoreSideChannelRTTs bool // true if the side channel RTT file is written
+}
+
+// The data-handling profiles of the server, looked up by the country of the client.
+type DataProfiles struct {
+    byCountry map[string]*DataProfile // the profile of each country; key is the country code
+}
+
+// Creates new DataProfiles.
+// profiles: the profiles; a country can only be in one profile
+// Returns the profiles or an error if a profile is invalid
+func NewDataProfiles(profiles []DataProfile) (*DataProfiles, error) {
+    dataProfiles := &DataProfiles{
+        byCountry: make(map[string]*DataProfile),
+    }
+    for i := range profiles {
+        profile := &profiles[i]
+        switch profile.Location {
+        case LocationFull, LocationCity, LocationCountry, LocationNone:
+        default:
+            return nil, fmt.Errorf("Invalid location precision %q in data profile %s", profile.Location, profile.Name)
+        }
+        for _, country := range profile.Countries {
+            country = strings.ToUpper(strings.TrimSpace(country))
+            other, exists := dataProfiles.byCountry[country]
+            if exists {
+                return nil, fmt.Errorf("Country %s is in data profiles %s and %s", country, other.Name, profile.Name)
+            }
+            dataProfiles.byCountry[country] = profile
+        }
+    }
+    return dataProfiles, nil
+}
+
+// Gets the profile of a client. Clients whose country has no profile, or whose country isn't known
+// because they didn't share their location, are stored with the settings of the rest of the server.
+// Returns the profile of the client
+func (clt *Client) dataProfile() *DataProfile {
+    if dataProfiles != nil {
+        profile, exists := dataProfiles.byCountry[clt.CountryCode]
+        if exists {
+            return profile
+        }
+    }
+    return &DataProfile{
+        Name: "default",
+        Location: LocationFull,
+        Anonymizer: anonymizer,
+        StoreSideChannelRTTs: true,
+    }
+}
+
+// Gets the mobile stats of a client with the location reduced to the precision of the profile. The
+// mobile stats of the client aren't changed.
+// mobileStats: the mobile stats sent by the client
+// Returns the mobile stats to store
+func (profile *DataProfile) mobileStats(mobileStats map[string]interface{}) map[string]interface{} {
+    locationInfo, ok := mobileStats["locationInfo"].(map[string]interface{})
+    if !ok || profile.Location == LocationFull {
+        return mobileStats
+    }
+    stored := make(map[string]interface{}, len(mobileStats))
+    for key, value := range mobileStats {
+        stored[key] = value
+    }
+    if profile.Location == LocationNone {
+        delete(stored, "locationInfo")
+        return stored
+    }
+    storedLocationInfo := make(map[string]interface{}, len(locationInfo))
+    for key, value := range locationInfo {
+        storedLocationInfo[key] = value
+    }
+    delete(storedLocationInfo, "latitude")
+    delete(storedLocationInfo, "longitude")
+    if profile.Location == LocationCountry {
+        // the time zone can narrow the location down to a region; the local time is kept
+        delete(storedLocationInfo, "city")
+        delete(storedLocationInfo, "timeZone")
+    }
+    stored["locationInfo"] = storedLocationInfo
+    return stored
+}
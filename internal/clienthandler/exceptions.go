@@ -0,0 +1,117 @@
+// The exceptions of a test. Every failure is kept, tagged with the phase of the test it happened in,
+// so that a failure late in a test doesn't hide the one that caused it. The replay info still gets
+// the exceptions as one string for readers of the old format.
+package clienthandler
+
+import (
+    "encoding/json"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    MaxExceptions = 32 // exceptions kept per test; later ones are only counted
+    noExceptions = "NoExp" // the legacy exceptions string of a test without exceptions
+)
+
+type ExceptionPhase string // the part of the test an exception happened in
+
+const (
+    PermissionPhase ExceptionPhase = "permission" // while deciding if the client can run a replay
+    ReplayPhase ExceptionPhase = "replay" // while the replay servers sent a replay
+    ThroughputsPhase ExceptionPhase = "throughputs" // while collecting the throughputs of a replay
+)
+
+// An exception of a test.
+type Exception struct {
+    Time time.Time `json:"time"` // when the exception happened
+    Phase ExceptionPhase `json:"phase"` // the part of the test the exception happened in
+    ReplayName string `json:"replay_name,omitempty"` // the replay that was running; omitted if there was none
+    Message string `json:"message"` // what went wrong
+}
+
+// The exceptions of a test, in the order they happened. Safe to use from the side channel and the
+// replay servers at the same time.
+type ExceptionLog struct {
+    exceptions []Exception // the first MaxExceptions exceptions
+    dropped int // exceptions that weren't kept because the log was full
+    mutex sync.Mutex // protects exceptions and dropped
+}
+
+// Adds an exception to the log. Exceptions after the first MaxExceptions are only counted, so
+// the first failures of a test are always kept.
+// exception: the exception
+func (log *ExceptionLog) Add(exception Exception) {
+    log.mutex.Lock()
+    defer log.mutex.Unlock()
+    if len(log.exceptions) >= MaxExceptions {
+        log.dropped++
+        return
+    }
+    log.exceptions = append(log.exceptions, exception)
+}
+
+// Gets the exceptions in the log.
+// Returns a copy of the exceptions, in the order they happened
+func (log *ExceptionLog) List() []Exception {
+    log.mutex.Lock()
+    defer log.mutex.Unlock()
+    return append([]Exception{}, log.exceptions...)
+}
+
+// Gets the message of the last exception in the log.
+// Returns the message, or an empty string if there are no exceptions
+func (log *ExceptionLog) Last() string {
+    log.mutex.Lock()
+    defer log.mutex.Unlock()
+    if len(log.exceptions) == 0 {
+        return ""
+    }
+    return log.exceptions[len(log.exceptions) - 1].Message
+}
+
+// Gets the exceptions in the format of the old server: the messages separated by "; ", or "NoExp"
+// if there are none.
+// Returns the exceptions string
+func (log *ExceptionLog) Legacy() string {
+    log.mutex.Lock()
+    defer log.mutex.Unlock()
+    if len(log.exceptions) == 0 {
+        return noExceptions
+    }
+    messages := make([]string, len(log.exceptions))
+    for i, exception := range log.exceptions {
+        messages[i] = exception.Message
+    }
+    return strings.Join(messages, "; ")
+}
+
+// Encodes the log as an object with the exceptions and the number that were dropped.
+func (log *ExceptionLog) MarshalJSON() ([]byte, error) {
+    log.mutex.Lock()
+    defer log.mutex.Unlock()
+    return json.Marshal(struct {
+        Exceptions []Exception `json:"exceptions"`
+        Dropped int `json:"dropped"`
+    }{
+        Exceptions: append([]Exception{}, log.exceptions...),
+        Dropped: log.dropped,
+    })
+}
+
+// Adds an exception to the test, tagged with the current replay if there is one.
+// phase: the part of the test the exception happened in
+// message: what went wrong
+func (clt *Client) addException(phase ExceptionPhase, message string) {
+    exception := Exception{
+        Time: clk.Now().UTC(),
+        Phase: phase,
+        Message: message,
+    }
+    currentReplay, err := clt.GetCurrentReplay()
+    if err == nil {
+        exception.ReplayName = currentReplay.ReplayName
+    }
+    clt.Exceptions.Add(exception)
+}
@@ -0,0 +1,102 @@
+// Decides which users get to test when the server is busy. Permission is otherwise granted to
+// whoever asks first, so a user who runs tests from a script back to back can keep the server busy
+// and crowd out users who test once in a while.
+package clienthandler
+
+import (
+    "sync"
+    "time"
+)
+
+// Decides if a user can start a test.
+type FairnessPolicy interface {
+    // Decides if a user can start a test.
+    // userID: the user ID of the client
+    // runningReplays: the number of replays running on the server
+    // now: the current time
+    // Returns true if the user can start the test
+    Admit(userID string, runningReplays int, now time.Time) bool
+    // Records that a user was given permission to start a test.
+    // userID: the user ID of the client
+    // now: the current time
+    Started(userID string, now time.Time)
+}
+
+// Admits every test in the order the clients ask, as long as the server has the resources to run
+// it.
+type FirstComeFairness struct{}
+
+func (FirstComeFairness) Admit(userID string, runningReplays int, now time.Time) bool {
+    return true
+}
+
+func (FirstComeFairness) Started(userID string, now time.Time) {}
+
+// Admits every test while the server isn't busy. Once the number of running replays reaches the
+// contention threshold, users who have started many tests recently are turned away, leaving the
+// capacity to users who haven't tested recently.
+type RecentUsageFairness struct {
+    contentionThreshold int // number of running replays at which the server is busy
+    maxRecentTests int // tests a user can have started within the window and still be admitted while the server is busy
+    window time.Duration // how far back the tests of a user are counted
+    mutex sync.Mutex // prevents multiple goroutines from accessing starts and lastSweep
+    starts map[string][]time.Time // when each user started the tests counted against it, oldest first; key is the user ID
+    lastSweep time.Time // when users without recent tests were last forgotten
+}
+
+// Creates a new RecentUsageFairness.
+// contentionThreshold: number of running replays at which the server is busy
+// maxRecentTests: tests a user can have started within the window and still be admitted while the
+//     server is busy
+// window: how far back the tests of a user are counted
+// Returns the fairness policy
+func NewRecentUsageFairness(contentionThreshold int, maxRecentTests int, window time.Duration) *RecentUsageFairness {
+    return &RecentUsageFairness{
+        contentionThreshold: contentionThreshold,
+        maxRecentTests: maxRecentTests,
+        window: window,
+        starts: make(map[string][]time.Time),
+    }
+}
+
+func (fairness *RecentUsageFairness) Admit(userID string, runningReplays int, now time.Time) bool {
+    if runningReplays < fairness.contentionThreshold {
+        return true
+    }
+    fairness.mutex.Lock()
+    defer fairness.mutex.Unlock()
+    return len(fairness.recentStarts(userID, now)) < fairness.maxRecentTests
+}
+
+func (fairness *RecentUsageFairness) Started(userID string, now time.Time) {
+    fairness.mutex.Lock()
+    defer fairness.mutex.Unlock()
+    fairness.starts[userID] = append(fairness.recentStarts(userID, now), now)
+
+    // users who stop testing would otherwise be remembered forever
+    if now.Sub(fairness.lastSweep) > fairness.window {
+        for otherUserID := range fairness.starts {
+            fairness.recentStarts(otherUserID, now)
+        }
+        fairness.lastSweep = now
+    }
+}
+
+// Drops the tests of a user that started before the window. Must be called with the mutex held.
+// userID: the user ID
+// now: the current time
+// Returns when the user started the tests within the window, oldest first
+func (fairness *RecentUsageFairness) recentStarts(userID string, now time.Time) []time.Time {
+    starts := fairness.starts[userID]
+    first := 0
+    for first < len(starts) && now.Sub(starts[first]) > fairness.window {
+        first++
+    }
+    starts = starts[first:]
+    if len(starts) == 0 {
+        delete(fairness.starts, userID)
+    } else {
+        fairness.starts[userID] = starts
+    }
+    return starts
+}
@@ -0,0 +1,220 @@
+// Tracks the tests that are running so that the server can let them finish before it exits, and
+// report what was lost when it exits in the middle of them.
+package clienthandler
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+
+)
+
+const (
+    inFlightPollInterval = 100 * time.Millisecond // how often Wait checks if the running tests have finished
+)
+
+var (
+    drainingUntil time.Time // when the server stops waiting for the running tests to finish; zero until the server starts exiting
+    drainingMutex sync.Mutex // prevents multiple goroutines from accessing drainingUntil
+)
+
+type TestState string // how far a running test has gotten
+
+const (
+    TestDeclared TestState = "declared" // the client declared a replay and hasn't been given permission to run it yet
+    TestReplaying TestState = "replaying" // the client has permission and is running a replay
+    TestReplayDone TestState = "replay_done" // the client sent the throughputs of its replay
+    TestAnalyzing TestState = "analyzing" // the server is analyzing the test
+    TestAnalyzed TestState = "analyzed" // the test has been analyzed
+)
+
+// A running test, as listed in the shutdown report.
+type InFlightTest struct {
+    UserID string `json:"user_id"` // the user ID of the client
+    TestID string `json:"test_id"` // the test ID used in the names of the result files
+    ClientVersion string `json:"client_version"` // client version number of Wehe
+    ReplayName string `json:"replay_name"` // the replay the client was running
+    State TestState `json:"state"` // how far the test had gotten
+    StartTime time.Time `json:"start_time"` // time when side channel connection was made
+    Aborted bool `json:"aborted"` // true if the test was stopped because the server exited
+    Salvaged bool `json:"salvaged"` // true if the test wrote whatever results it had before the server exited
+    Artifacts []string `json:"artifacts"` // the kinds of result files the test wrote
+}
+
+// The tests that are running on the server.
+type InFlightTests struct {
+    resultsDir string // the root directory the tests write their results to
+    mutex sync.Mutex // prevents multiple goroutines from accessing tests, aborting, and finished
+    tests map[*Client]*InFlightTest // the running tests
+    aborting bool // true once Abort has been called
+    finished []InFlightTest // tests that finished after Abort was called
+}
+
+// Creates a new InFlightTests.
+// resultsDir: the root directory the tests write their results to
+// Returns the running tests
+func NewInFlightTests(resultsDir string) *InFlightTests {
+    return &InFlightTests{
+        resultsDir: resultsDir,
+        tests: make(map[*Client]*InFlightTest),
+    }
+}
+
+// Adds a test once the client has declared it.
+// clt: the client running the test
+func (inFlightTests *InFlightTests) Add(clt *Client) {
+    test := &InFlightTest{
+        UserID: clt.UserID,
+        TestID: clt.artifactTestID(),
+        ClientVersion: clt.ClientVersion,
+        State: TestDeclared,
+        StartTime: clt.StartTime,
+    }
+    currentReplay, err := clt.GetCurrentReplay()
+    if err == nil {
+        test.ReplayName = currentReplay.ReplayName
+    }
+    inFlightTests.mutex.Lock()
+    defer inFlightTests.mutex.Unlock()
+    inFlightTests.tests[clt] = test
+}
+
+// Updates how far a test has gotten. This must be called from the goroutine handling the client.
+// clt: the client running the test
+// state: the new state of the test
+func (inFlightTests *InFlightTests) SetState(clt *Client, state TestState) {
+    replayName := ""
+    currentReplay, err := clt.GetCurrentReplay()
+    if err == nil {
+        replayName = currentReplay.ReplayName
+    }
+    inFlightTests.mutex.Lock()
+    defer inFlightTests.mutex.Unlock()
+    test, exists := inFlightTests.tests[clt]
+    if !exists {
+        return
+    }
+    test.State = state
+    test.ReplayName = replayName
+}
+
+// Removes a test once it is over and its results are written. This must be called from the
+// goroutine handling the client.
+// clt: the client running the test
+func (inFlightTests *InFlightTests) Remove(clt *Client) {
+    inFlightTests.mutex.Lock()
+    defer inFlightTests.mutex.Unlock()
+    test, exists := inFlightTests.tests[clt]
+    if !exists {
+        return
+    }
+    delete(inFlightTests.tests, clt)
+    if inFlightTests.aborting {
+        test.Aborted = true
+        test.Salvaged = true
+        test.Artifacts = clt.writtenArtifacts(inFlightTests.resultsDir)
+        inFlightTests.finished = append(inFlightTests.finished, *test)
+    }
+}
+
+// Lists the running tests, oldest first.
+// Returns the running tests
+func (inFlightTests *InFlightTests) List() []InFlightTest {
+    inFlightTests.mutex.Lock()
+    defer inFlightTests.mutex.Unlock()
+    return inFlightTests.list()
+}
+
+// Lists the running tests, oldest first. Must be called with the mutex held.
+// Returns the running tests
+func (inFlightTests *InFlightTests) list() []InFlightTest {
+    tests := make([]InFlightTest, 0, len(inFlightTests.tests))
+    for _, test := range inFlightTests.tests {
+        tests = append(tests, *test)
+    }
+    sort.Slice(tests, func(i, j int) bool {
+        return tests[i].StartTime.Before(tests[j].StartTime)
+    })
+    return tests
+}
+
+// Stops admitting new tests because the server is exiting. Tests that already ran their first
+// replay can still run the rest.
+// until: when the server stops waiting for the running tests to finish; clients that are turned away
+//     are told to come back after it
+func StartDraining(until time.Time) {
+    drainingMutex.Lock()
+    defer drainingMutex.Unlock()
+    drainingUntil = until
+}
+
+// Checks if the server is exiting and no longer admits new tests.
+// Returns true and when the server stops waiting for the running tests if it is exiting
+func Draining() (bool, time.Time) {
+    drainingMutex.Lock()
+    defer drainingMutex.Unlock()
+    return !drainingUntil.IsZero(), drainingUntil
+}
+
+// Waits for the running tests to finish on their own.
+// timeout: how long to wait
+// Returns true if every test finished before the timeout
+func (inFlightTests *InFlightTests) Wait(timeout time.Duration) bool {
+    deadline := clk.Now().Add(timeout)
+    for {
+        inFlightTests.mutex.Lock()
+        remaining := len(inFlightTests.tests)
+        inFlightTests.mutex.Unlock()
+        if remaining == 0 {
+            return true
+        }
+        if !clk.Now().Before(deadline) {
+            return false
+        }
+        clk.Sleep(inFlightPollInterval)
+    }
+}
+
+// Stops the running tests by closing their side channel connections, so that each test writes
+// whatever results it has the same way as when a client disconnects, and waits for them to finish.
+// Tests still running once the grace period is over are reported as not salvaged.
+// grace: how long to wait for the tests to finish
+// Returns every test that was running, oldest first
+func (inFlightTests *InFlightTests) Abort(grace time.Duration) []InFlightTest {
+    inFlightTests.mutex.Lock()
+    inFlightTests.aborting = true
+    for clt := range inFlightTests.tests {
+        clt.Conn.Close()
+    }
+    inFlightTests.mutex.Unlock()
+
+    inFlightTests.Wait(grace)
+
+    inFlightTests.mutex.Lock()
+    defer inFlightTests.mutex.Unlock()
+    tests := append([]InFlightTest{}, inFlightTests.finished...)
+    for _, test := range inFlightTests.list() {
+        test.Aborted = true
+        tests = append(tests, test)
+    }
+    sort.Slice(tests, func(i, j int) bool {
+        return tests[i].StartTime.Before(tests[j].StartTime)
+    })
+    return tests
+}
+
+// Gets the kinds of result files that have been written for the test.
+// resultsDir: the root directory of the results
+// Returns the kinds of the result files that exist
+func (clt *Client) writtenArtifacts(resultsDir string) []string {
+    written := []string{}
+    for _, artifact := range clt.existingArtifacts(resultsDir) {
+        if artifact.perReplay {
+            written = append(written, fmt.Sprintf("%s_%d", artifact.kind, artifact.replayID))
+        } else {
+            written = append(written, string(artifact.kind))
+        }
+    }
+    return written
+}
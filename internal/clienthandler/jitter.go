@@ -0,0 +1,99 @@
+// Jitter of UDP replays, measured by the replay servers. The servers know when each replay packet was
+// scheduled and when it was sent, and when each packet from the client arrived, but not when the
+// client sent its packets or received the replay. The send side shows how evenly the server put the
+// replay on the wire, so that jitter added by the server can be told apart from jitter added by the
+// network, and the receive side shows how evenly the packets of the client arrived.
+package clienthandler
+
+// The jitter of a UDP replay. Jitter is the smoothed mean of the differences between successive
+// packets, as for the interarrival jitter of RFC 3550.
+type JitterReport struct {
+    SentPackets int `json:"sent_packets"` // replay packets whose send time was recorded
+    SendJitterMs float64 `json:"send_jitter_ms"` // jitter of the delay from when each packet was scheduled to when it was sent
+    SendDelayMinMs float64 `json:"send_delay_min_ms"` // the smallest delay from when a packet was scheduled to when it was sent; negative if a packet was sent early with a batch
+    SendDelayMaxMs float64 `json:"send_delay_max_ms"` // the largest delay from when a packet was scheduled to when it was sent
+    SendDelayVariationMs float64 `json:"send_delay_variation_ms"` // the one-way delay variation the server added: the largest delay minus the smallest
+    ReceivedPackets int `json:"received_packets"` // packets received from the client
+    ReceiveJitterMs float64 `json:"receive_jitter_ms"` // jitter of the gaps between the packets received from the client
+}
+
+// Adds up the jitter of two parts of a replay, e.g. the flows sent from two ports. The jitters are
+// averaged, weighted by the packets each part measured them over.
+// other: the jitter of the other part
+// Returns the jitter of both parts
+func (report JitterReport) Merge(other JitterReport) JitterReport {
+    merged := JitterReport{
+        SentPackets: report.SentPackets + other.SentPackets,
+        SendJitterMs: weightedMean(report.SendJitterMs, report.SentPackets, other.SendJitterMs, other.SentPackets),
+        SendDelayMinMs: report.SendDelayMinMs,
+        SendDelayMaxMs: report.SendDelayMaxMs,
+        ReceivedPackets: report.ReceivedPackets + other.ReceivedPackets,
+        ReceiveJitterMs: weightedMean(report.ReceiveJitterMs, report.ReceivedPackets, other.ReceiveJitterMs, other.ReceivedPackets),
+    }
+    if report.SentPackets == 0 {
+        merged.SendDelayMinMs = other.SendDelayMinMs
+        merged.SendDelayMaxMs = other.SendDelayMaxMs
+    } else if other.SentPackets > 0 {
+        merged.SendDelayMinMs = min(report.SendDelayMinMs, other.SendDelayMinMs)
+        merged.SendDelayMaxMs = max(report.SendDelayMaxMs, other.SendDelayMaxMs)
+    }
+    merged.SendDelayVariationMs = merged.SendDelayMaxMs - merged.SendDelayMinMs
+    return merged
+}
+
+// Averages two values, weighted by counts.
+// a: the first value
+// aCount: the weight of the first value
+// b: the second value
+// bCount: the weight of the second value
+// Returns the weighted mean, or 0 if both counts are 0
+func weightedMean(a float64, aCount int, b float64, bCount int) float64 {
+    if aCount + bCount == 0 {
+        return 0
+    }
+    return (a * float64(aCount) + b * float64(bCount)) / float64(aCount + bCount)
+}
+
+// Records the jitter that a replay server measured for a UDP replay. A replay sent from several
+// ports reports once per port, and the reports are added up.
+// key: the key of the client, from Resolve
+// report: the jitter measured by the server
+func (connectedClients *ConnectedClients) AddJitterReport(key string, report JitterReport) {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    if !exists {
+        return
+    }
+    if client.jitter != nil {
+        report = client.jitter.Merge(report)
+    }
+    client.jitter = &report
+}
+
+// Retrieves and clears the jitter recorded for a client.
+// key: the key of the client, from Resolve
+// Returns the jitter, or nil if no UDP replay server measured any
+func (connectedClients *ConnectedClients) TakeJitterReport(key string) *JitterReport {
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    if !exists {
+        return nil
+    }
+    report := client.jitter
+    client.jitter = nil
+    return report
+}
+
+// Sets the jitter of the current replay.
+// report: the jitter measured by the replay servers; nil if the replay is TCP or wasn't sent
+// Returns any errors
+func (clt *Client) SetJitterReport(report *JitterReport) error {
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return err
+    }
+    currentReplay.Jitter = report
+    return nil
+}
@@ -0,0 +1,89 @@
+// Latencies measured by the client to the replay port before, during, and after its replays. The
+// RTTs measured during the original and random replays are compared to find differentiation that
+// delays the traffic of an app without lowering its throughput.
+package clienthandler
+
+import (
+    "encoding/json"
+    "fmt"
+    "strings"
+
+    "wehe-server/internal/analysis"
+    "wehe-server/internal/artifacts"
+    "wehe-server/internal/errs"
+)
+
+type LatencyPhase string // when the client measured a series of RTTs, relative to its replay
+
+const (
+    LatencyBefore LatencyPhase = "before" // before the replay started, as a baseline
+    LatencyDuring LatencyPhase = "during" // while the replay was running
+    LatencyAfter LatencyPhase = "after" // after the replay finished
+)
+
+// A series of RTTs measured by the client.
+type LatencySeries struct {
+    RTTs []float64 `json:"rtts_ms"` // the RTTs, in milliseconds
+    SampleTimes []float64 `json:"sample_times"` // seconds since the start of the phase that each RTT was measured
+}
+
+// Receives a series of RTTs that the client measured to the replay port of its current replay and
+// writes every series of the replay to the client latencies file of the results layout (by default,
+// tempResultsDir/userID/clientLatencies/latency_<userID>_<testID>_<replayID>.json). A series for a
+// phase that was already received replaces it.
+// message: the series, in the format <phase>;[[rtts],[sampleTimes]]
+// resultsDir: the root directory of the results to place the latencies in
+// Returns any errors; the error is an errs.LimitError if either array is longer than
+//     MaxThroughputSamples
+func (clt *Client) ReceiveLatencies(message string, resultsDir string) error {
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return err
+    }
+
+    phase, series, found := strings.Cut(message, ";")
+    if !found {
+        return fmt.Errorf("%w: received improperly formatted latency data: %s\n", errs.ErrMalformedMessage, message)
+    }
+    switch LatencyPhase(phase) {
+    case LatencyBefore, LatencyDuring, LatencyAfter:
+    default:
+        return fmt.Errorf("%w: unknown latency phase: %s\n", errs.ErrMalformedMessage, phase)
+    }
+    rttsAndSampleTimes, err := decodeThroughputs(series)
+    if err != nil {
+        return err
+    }
+    if currentReplay.Latencies == nil {
+        currentReplay.Latencies = make(map[LatencyPhase]LatencySeries)
+    }
+    currentReplay.Latencies[LatencyPhase(phase)] = LatencySeries{
+        RTTs: rttsAndSampleTimes[0],
+        SampleTimes: rttsAndSampleTimes[1],
+    }
+
+    jsonOutput, err := json.Marshal(currentReplay.Latencies)
+    if err != nil {
+        return err
+    }
+    return clt.writeArtifact(resultsDir, artifacts.ClientLatencies, currentReplay.ReplayID, string(jsonOutput))
+}
+
+// Compares the RTTs the client measured during the original and random replays. Latency is only
+// measured by some clients and doesn't change the verdict of the test, so a test without latencies
+// during both replays, or whose latencies can't be compared, is left without a latency analysis.
+// original: the original replay
+// random: the random replay
+func (clt *Client) analyzeLatencies(original ReplayResult, random ReplayResult) {
+    originalSeries, originalOk := original.Latencies[LatencyDuring]
+    randomSeries, randomOk := random.Latencies[LatencyDuring]
+    if !originalOk || !randomOk {
+        return
+    }
+    results, err := analysis.CompareLatencies(originalSeries.RTTs, randomSeries.RTTs, GetDecisionPolicy())
+    if err != nil {
+        clt.Logger().Warn("Unable to compare latencies", "error", err)
+        return
+    }
+    clt.LatencyAnalysis = results
+}
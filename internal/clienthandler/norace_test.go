@@ -0,0 +1,6 @@
+//go:build !race
+
+// Builds without the race detector, where allocation checks are run.
+package clienthandler
+
+const raceEnabled = false // true if the tests were built with the race detector
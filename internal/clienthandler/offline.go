@@ -0,0 +1,162 @@
+// Runs the analysis of a test from the client throughput files it left behind, without a client,
+// so that researchers can reproduce the verdicts of the server from published results.
+package clienthandler
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+
+    "wehe-server/internal/compat"
+)
+
+// Names of client throughput files: Xput_<userID>_<testID>[_attempt<N>]_<replayID>.json
+var throughputsFilenameRegexp = regexp.MustCompile(`^Xput_(.+)_(\d+)(?:_attempt(\d+))?_([01])\.json$`)
+
+// The client throughput files of a test.
+type ThroughputFiles struct {
+    UserID string // the user ID of the client
+    TestID int // the ID of the test
+    Attempt int // the attempt of the test
+    Original string // path of the throughputs of the original replay
+    Random string // path of the throughputs of the random replay
+}
+
+// Finds the client throughput files of every test in a directory and its subdirectories.
+// dir: the directory to search
+// Returns the files of each test that has throughputs for both replays, sorted by user ID and test
+//     ID, or any errors
+func FindThroughputFiles(dir string) ([]ThroughputFiles, error) {
+    tests := make(map[string]*ThroughputFiles)
+    err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if entry.IsDir() {
+            return nil
+        }
+        files, replayID, ok := parseThroughputsFilename(filepath.Base(path))
+        if !ok {
+            return nil
+        }
+        key := fmt.Sprintf("%s_%d_%d", files.UserID, files.TestID, files.Attempt)
+        test, exists := tests[key]
+        if !exists {
+            test = &files
+            tests[key] = test
+        }
+        if replayID == Original {
+            test.Original = path
+        } else {
+            test.Random = path
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    var found []ThroughputFiles
+    for _, test := range tests {
+        if test.Original != "" && test.Random != "" {
+            found = append(found, *test)
+        }
+    }
+    sort.Slice(found, func(i, j int) bool {
+        if found[i].UserID != found[j].UserID {
+            return found[i].UserID < found[j].UserID
+        }
+        if found[i].TestID != found[j].TestID {
+            return found[i].TestID < found[j].TestID
+        }
+        return found[i].Attempt < found[j].Attempt
+    })
+    return found, nil
+}
+
+// Gets the user ID, test ID, attempt, and replay of a client throughputs file from its name.
+// filename: the name of the file, without its directory
+// Returns the test the file belongs to, the replay, and true if the name is of a throughputs file
+func parseThroughputsFilename(filename string) (ThroughputFiles, ReplayType, bool) {
+    match := throughputsFilenameRegexp.FindStringSubmatch(filename)
+    if match == nil {
+        return ThroughputFiles{}, Original, false
+    }
+    testID, err := strconv.Atoi(match[2])
+    if err != nil {
+        return ThroughputFiles{}, Original, false
+    }
+    attempt := 1
+    if match[3] != "" {
+        attempt, err = strconv.Atoi(match[3])
+        if err != nil {
+            return ThroughputFiles{}, Original, false
+        }
+    }
+    replayID := Original
+    if match[4] == "1" {
+        replayID = Random
+    }
+    return ThroughputFiles{
+        UserID: match[1],
+        TestID: testID,
+        Attempt: attempt,
+    }, replayID, true
+}
+
+// Gets the throughput files of a test from the paths of its original and random replay files. The
+// user ID and test ID are taken from the name of the original file if it follows the naming of the
+// server, or are "offline" and 0 if it doesn't.
+// original: path of the throughputs of the original replay
+// random: path of the throughputs of the random replay
+// Returns the throughput files of the test
+func NewThroughputFiles(original string, random string) ThroughputFiles {
+    files, _, ok := parseThroughputsFilename(filepath.Base(original))
+    if !ok {
+        files = ThroughputFiles{
+            UserID: "offline",
+            Attempt: 1,
+        }
+    }
+    files.Original = original
+    files.Random = random
+    return files
+}
+
+// Analyzes a test from its client throughput files with the current decision policy, the same way
+// the server analyzes a test when the client asks for it, and writes the decision file.
+// resultsDir: the root directory to write the decision file in, using the results layout
+// Returns the analyzed test, whose Analysis holds the results, or any errors
+func (files ThroughputFiles) Analyze(resultsDir string) (*Client, error) {
+    clt := NewClient(nil, files.UserID, "", files.TestID, "", compat.UnknownVersion, "")
+    clt.Attempt = files.Attempt
+    for _, replay := range []struct {
+        replayID ReplayType
+        path string
+    }{{Original, files.Original}, {Random, files.Random}} {
+        data, err := os.ReadFile(replay.path)
+        if err != nil {
+            return nil, err
+        }
+        throughputsAndSampleTimes, err := decodeThroughputs(string(data))
+        if err != nil {
+            return nil, fmt.Errorf("Unable to read %s: %v", replay.path, err)
+        }
+        clt.AddReplay(replay.replayID, "", replay.replayID == Random)
+        currentReplay, err := clt.GetCurrentReplay()
+        if err != nil {
+            return nil, err
+        }
+        currentReplay.Throughputs = throughputsAndSampleTimes[0]
+        currentReplay.SampleTimes = throughputsAndSampleTimes[1]
+    }
+
+    err := clt.AnalyzeTest(resultsDir)
+    if err != nil {
+        return nil, err
+    }
+    return clt, nil
+}
@@ -0,0 +1,158 @@
+// Test ports that operators have disabled while the server runs, e.g. because a port conflicts with
+// another service on the machine or is being firewalled for maintenance. Replays that were granted
+// before their port was disabled run to the end. New replays that run on a disabled port are denied,
+// and the replay servers refuse the connections of clients that were granted a replay after the
+// port was disabled. Disabled ports are enabled again when the server restarts.
+package clienthandler
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "wehe-server/internal/denials"
+    "wehe-server/internal/testdata"
+)
+
+var (
+    disabledPorts = make(map[string]PortStatus) // the disabled test ports; key is the port, e.g. tcp/80
+    disabledPortsMutex sync.Mutex // prevents multiple goroutines from accessing disabledPorts
+    replayRegistry *testdata.Registry // looks up the ports and provenance of a replay when it is declared; nil if they aren't looked up
+)
+
+// The state of a test port, as shown to operators.
+type PortStatus struct {
+    Port string `json:"port"` // the protocol and port, e.g. tcp/80
+    Disabled bool `json:"disabled"` // true if new replays can't run on the port
+    DisabledSince time.Time `json:"disabled_since"` // when the port was disabled; zero if it isn't
+    Reason string `json:"reason,omitempty"` // why the operator disabled the port
+}
+
+// Sets the replays that are looked up for the ports they run on, so that replays on a disabled port
+// are denied, and for where their traffic came from, which is written with their results. This should
+// be called before any clients connect.
+// registry: the replays on the server
+func SetReplayRegistry(registry *testdata.Registry) {
+    replayRegistry = registry
+}
+
+// Formats a test port the way it is shown to operators.
+// protocol: tcp or udp
+// port: the port number
+// Returns the port, e.g. tcp/80
+func PortName(protocol string, port int) string {
+    return fmt.Sprintf("%s/%d", protocol, port)
+}
+
+// Disables a test port. Disabling a port that is already disabled keeps the time it was disabled.
+// protocol: tcp or udp
+// port: the port number
+// reason: why the port is disabled; may be empty
+// Returns the state of the port and true if it was enabled before
+func DisablePort(protocol string, port int, reason string) (PortStatus, bool) {
+    disabledPortsMutex.Lock()
+    defer disabledPortsMutex.Unlock()
+    name := PortName(protocol, port)
+    status, alreadyDisabled := disabledPorts[name]
+    if alreadyDisabled {
+        return status, false
+    }
+    status = PortStatus{
+        Port: name,
+        Disabled: true,
+        DisabledSince: clk.Now().UTC(),
+        Reason: reason,
+    }
+    disabledPorts[name] = status
+    return status, true
+}
+
+// Enables a test port that was disabled.
+// protocol: tcp or udp
+// port: the port number
+// Returns the state of the port and true if it was disabled before
+func EnablePort(protocol string, port int) (PortStatus, bool) {
+    disabledPortsMutex.Lock()
+    defer disabledPortsMutex.Unlock()
+    name := PortName(protocol, port)
+    _, wasDisabled := disabledPorts[name]
+    delete(disabledPorts, name)
+    return PortStatus{Port: name}, wasDisabled
+}
+
+// Gets the state of a test port.
+// protocol: tcp or udp
+// port: the port number
+// Returns the state of the port
+func GetPortStatus(protocol string, port int) PortStatus {
+    disabledPortsMutex.Lock()
+    defer disabledPortsMutex.Unlock()
+    name := PortName(protocol, port)
+    status, disabled := disabledPorts[name]
+    if !disabled {
+        return PortStatus{Port: name}
+    }
+    return status
+}
+
+// Checks if a replay can be sent to a client on a test port. A client that was granted its replay
+// before the port was disabled can still use it, so that its replay finishes.
+// key: the key of the client, from Resolve
+// protocol: tcp or udp
+// port: the port the client connected to
+// Returns true if the port is enabled or the client was granted its replay before it was disabled
+func (connectedClients *ConnectedClients) PortOpen(key string, protocol string, port int) bool {
+    status := GetPortStatus(protocol, port)
+    if !status.Disabled {
+        return true
+    }
+    connectedClients.mutex.Lock()
+    defer connectedClients.mutex.Unlock()
+    client, exists := connectedClients.clients[clientKey(key)]
+    return exists && client.connectedSince.Before(status.DisabledSince)
+}
+
+// Gets the disabled ports that a replay runs on. TCP replays whose replay file doesn't declare their
+// ports can't be checked, so the replay servers refuse them once they connect instead.
+// replayName: the name of the replay
+// Returns the disabled ports of the replay, e.g. tcp/80, sorted
+func ReplayDisabledPorts(replayName string) []string {
+    if replayRegistry == nil {
+        return nil
+    }
+    metadata, exists := replayRegistry.Get(replayName)
+    if !exists {
+        return nil
+    }
+    protocol := "udp"
+    if metadata.IsTCP {
+        protocol = "tcp"
+    }
+    disabledPortsMutex.Lock()
+    defer disabledPortsMutex.Unlock()
+    var disabled []string
+    for _, port := range metadata.Ports {
+        name := PortName(protocol, port)
+        if _, exists := disabledPorts[name]; exists {
+            disabled = append(disabled, name)
+        }
+    }
+    sort.Strings(disabled)
+    return disabled
+}
+
+// Checks if the replay the client declared runs on a disabled port, and records the denial if it
+// does. Clients see this the same as an overloaded server, so they retry later.
+// replayName: the replay the client asked to run
+// Returns true if the replay should be denied
+func (clt *Client) onDisabledPort(replayName string) bool {
+    disabled := ReplayDisabledPorts(replayName)
+    if len(disabled) == 0 {
+        return false
+    }
+    clt.addException(PermissionPhase, "PortDisabled")
+    clt.recordDenial(denials.PortDisabled, replayName, strings.Join(disabled, ","))
+    return true
+}
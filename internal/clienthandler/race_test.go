@@ -0,0 +1,6 @@
+//go:build race
+
+// The race detector instruments every allocation, so allocation checks are skipped under it.
+package clienthandler
+
+const raceEnabled = true // true if the tests were built with the race detector
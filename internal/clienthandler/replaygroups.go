@@ -0,0 +1,220 @@
+// Groups of replays that must not run at the same time on the server, e.g. two 4K video replays
+// that would compete for the same upstream link. If replays in a group ran at the same time, the
+// server's own contention could make a test look differentiated.
+package clienthandler
+
+import (
+    "fmt"
+    "path"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// A client holding a group.
+type groupHolder struct {
+    clt *Client // the client holding the group
+    replayName string // the replay the client is running
+}
+
+// A client waiting for the groups of its replay to be free.
+type groupWaiter struct {
+    groupHolder
+    groups []string // the groups the client needs
+    granted chan struct{} // closed once the client holds every group it needs
+}
+
+// Admission control for groups of replays. A client running a replay in a group holds the group
+// until its connection is cleaned up. Clients that need a group that is held wait in a queue and
+// are let in in the order they arrived.
+type ReplayGroups struct {
+    patterns map[string][]string // the replay name patterns of each group; key is the group name
+    wait time.Duration // how long a client waits for its groups before it is denied
+    mutex sync.Mutex // prevents multiple goroutines from accessing holders and waiters
+    holders map[string]groupHolder // the client holding each group; key is the group name
+    waiters []*groupWaiter // clients waiting for their groups, in the order they arrived
+}
+
+// The groups that are held and the number of clients waiting, as shown to operators.
+type ReplayGroupsStatus struct {
+    Running map[string]string `json:"running"` // the replay running in each held group; key is the group name
+    Waiting int `json:"waiting"` // number of clients waiting for a group
+}
+
+// Creates new ReplayGroups.
+// patterns: the replay names in each group; key is the group name. Names can use the wildcards of
+//     path.Match, e.g. Netflix_*
+// wait: how long a client waits for its groups before it is denied; 0 to deny without waiting
+// Returns the replay groups or any errors
+func NewReplayGroups(patterns map[string][]string, wait time.Duration) (*ReplayGroups, error) {
+    for group, groupPatterns := range patterns {
+        for _, pattern := range groupPatterns {
+            _, err := path.Match(pattern, "")
+            if err != nil {
+                return nil, fmt.Errorf("Invalid replay name pattern %s in replay group %s: %v", pattern, group, err)
+            }
+        }
+    }
+    return &ReplayGroups{
+        patterns: patterns,
+        wait: wait,
+        holders: make(map[string]groupHolder),
+    }, nil
+}
+
+// Gets the groups a replay belongs to.
+// replayName: the name of the replay
+// Returns the names of the groups, sorted
+func (replayGroups *ReplayGroups) groupsOf(replayName string) []string {
+    var groups []string
+    for group, patterns := range replayGroups.patterns {
+        for _, pattern := range patterns {
+            matched, _ := path.Match(pattern, replayName)
+            if matched {
+                groups = append(groups, group)
+                break
+            }
+        }
+    }
+    sort.Strings(groups)
+    return groups
+}
+
+// Checks if groups are free for a client: no one holds them and no client that arrived earlier is
+// waiting for them. Must be called with the mutex held.
+// groups: the groups the client needs
+// before: the number of waiters that arrived before the client
+// Returns true if the client can take the groups
+func (replayGroups *ReplayGroups) free(groups []string, before int) bool {
+    for _, group := range groups {
+        if _, held := replayGroups.holders[group]; held {
+            return false
+        }
+        for _, waiter := range replayGroups.waiters[:before] {
+            for _, waiterGroup := range waiter.groups {
+                if waiterGroup == group {
+                    return false
+                }
+            }
+        }
+    }
+    return true
+}
+
+// Waits until a client can run a replay without another replay of the same group running at the
+// same time. Replays that aren't in a group can always run.
+// clt: the client that would like to run the replay
+// replayName: the name of the replay
+// Returns true if the client holds the groups of the replay, or false and the busy groups if the
+//     client waited too long
+func (replayGroups *ReplayGroups) Acquire(clt *Client, replayName string) (bool, []string) {
+    groups := replayGroups.groupsOf(replayName)
+    if len(groups) == 0 {
+        return true, nil
+    }
+
+    holder := groupHolder{
+        clt: clt,
+        replayName: replayName,
+    }
+    replayGroups.mutex.Lock()
+    // a client runs one replay at a time, so the groups of its previous replay are done
+    replayGroups.release(clt)
+    if replayGroups.free(groups, len(replayGroups.waiters)) {
+        for _, group := range groups {
+            replayGroups.holders[group] = holder
+        }
+        replayGroups.mutex.Unlock()
+        return true, nil
+    }
+    waiter := &groupWaiter{
+        groupHolder: holder,
+        groups: groups,
+        granted: make(chan struct{}),
+    }
+    replayGroups.waiters = append(replayGroups.waiters, waiter)
+    replayGroups.mutex.Unlock()
+
+    clt.Logger().Info("Waiting for replay groups", "groups", strings.Join(groups, ", "))
+    timer := time.NewTimer(replayGroups.wait)
+    defer timer.Stop()
+    select {
+    case <-waiter.granted:
+        return true, nil
+    case <-timer.C:
+    }
+
+    replayGroups.mutex.Lock()
+    defer replayGroups.mutex.Unlock()
+    select {
+    case <-waiter.granted:
+        // the groups were handed over just as the wait ran out
+        return true, nil
+    default:
+    }
+    for i, w := range replayGroups.waiters {
+        if w == waiter {
+            replayGroups.waiters = append(replayGroups.waiters[:i], replayGroups.waiters[i + 1:]...)
+            break
+        }
+    }
+    // clients behind this one may have been waiting only because it was ahead of them
+    replayGroups.grantWaiters()
+    return false, groups
+}
+
+// Releases the groups held by a client and lets in the waiting clients whose groups are now free.
+// clt: the client whose connection is done
+func (replayGroups *ReplayGroups) Release(clt *Client) {
+    replayGroups.mutex.Lock()
+    defer replayGroups.mutex.Unlock()
+    replayGroups.release(clt)
+}
+
+// Releases the groups held by a client. Must be called with the mutex held.
+// clt: the client holding the groups
+func (replayGroups *ReplayGroups) release(clt *Client) {
+    released := false
+    for group, holder := range replayGroups.holders {
+        if holder.clt == clt {
+            delete(replayGroups.holders, group)
+            released = true
+        }
+    }
+    if released {
+        replayGroups.grantWaiters()
+    }
+}
+
+// Gives the waiting clients whose groups are free their groups, in the order they arrived. Must be
+// called with the mutex held.
+func (replayGroups *ReplayGroups) grantWaiters() {
+    for i := 0; i < len(replayGroups.waiters); {
+        waiter := replayGroups.waiters[i]
+        if !replayGroups.free(waiter.groups, i) {
+            i++
+            continue
+        }
+        for _, group := range waiter.groups {
+            replayGroups.holders[group] = waiter.groupHolder
+        }
+        close(waiter.granted)
+        replayGroups.waiters = append(replayGroups.waiters[:i], replayGroups.waiters[i + 1:]...)
+    }
+}
+
+// Gets the groups that are held and the number of clients waiting.
+// Returns the status of the replay groups
+func (replayGroups *ReplayGroups) Status() ReplayGroupsStatus {
+    replayGroups.mutex.Lock()
+    defer replayGroups.mutex.Unlock()
+    status := ReplayGroupsStatus{
+        Running: make(map[string]string),
+        Waiting: len(replayGroups.waiters),
+    }
+    for group, holder := range replayGroups.holders {
+        status.Running[group] = holder.replayName
+    }
+    return status
+}
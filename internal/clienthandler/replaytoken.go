@@ -0,0 +1,38 @@
+// Tells apart clients that share a public IP, e.g. behind carrier-grade NAT. A client that asks for
+// one is issued a random replay token when it declares its test, and starts the first packet it sends
+// on each replay port with the token. The replay servers then look up the replay of the client by
+// the token instead of by the IP its packets came from. Clients that don't send a token are still
+// looked up by IP, so only one of them can run a replay per IP at a time.
+package clienthandler
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+)
+
+const (
+    replayTokenBytes = 16 // random bytes in a replay token
+    ReplayTokenLength = 2 * replayTokenBytes // characters in a replay token, which is hex encoded
+)
+
+// Gives the client a new replay token to send at the start of its replays.
+// Returns any errors
+func (clt *Client) IssueReplayToken() error {
+    token := make([]byte, replayTokenBytes)
+    _, err := rand.Read(token)
+    if err != nil {
+        return fmt.Errorf("Unable to generate replay token: %v", err)
+    }
+    clt.ReplayToken = hex.EncodeToString(token)
+    return nil
+}
+
+// Gets the key that the replay servers look up the client by in ConnectedClients.
+// Returns the replay token of the client, or its public IP if it doesn't send one
+func (clt *Client) ReplayKey() string {
+    if clt.ReplayToken != "" {
+        return clt.ReplayToken
+    }
+    return clt.PublicIP
+}
@@ -0,0 +1,128 @@
+// Reads how much of the server's CPU, memory, disk, and upload bandwidth is in use, so that clients can be
+// turned away when the server is too loaded to measure them accurately. Developers can swap in fixed
+// readings so that a laptop never looks overloaded.
+package clienthandler
+
+import (
+    "sync"
+)
+
+// The load at which the server is too busy to admit a test.
+type ResourceThresholds struct {
+    CPUPercent float64 // percent of CPU time spent busy above which tests are turned away
+    MemoryPercent float64 // percent of memory in use above which tests are turned away
+    DiskPercent float64 // percent of the root disk in use above which tests are turned away
+    UploadMbps float64 // upload bandwidth, in Mbps, above which tests are turned away
+}
+
+var (
+    DefaultResourceThresholds = ResourceThresholds{
+        CPUPercent: 100,
+        MemoryPercent: 95,
+        DiskPercent: 95,
+        UploadMbps: 2000,
+    }
+
+    resourceThresholds = DefaultResourceThresholds // the load at which tests are turned away
+    resourceThresholdsMutex sync.Mutex // prevents resourceThresholds from being read while it is reloaded
+)
+
+// Sets the load at which the server is too busy to admit a test. Clients that ask for permission
+// after the call are checked against the new thresholds, so it can be called while clients are
+// connected.
+// thresholds: the resource thresholds
+func SetResourceThresholds(thresholds ResourceThresholds) {
+    resourceThresholdsMutex.Lock()
+    defer resourceThresholdsMutex.Unlock()
+    resourceThresholds = thresholds
+}
+
+// Gets the load at which the server is too busy to admit a test.
+// Returns the resource thresholds
+func getResourceThresholds() ResourceThresholds {
+    resourceThresholdsMutex.Lock()
+    defer resourceThresholdsMutex.Unlock()
+    return resourceThresholds
+}
+
+// One reading of a resource of the server, as shown to operators.
+type ResourceReading struct {
+    Value float64 `json:"value"` // the reading; 0 if it couldn't be taken
+    Threshold float64 `json:"threshold"` // the reading above which tests are turned away
+    Over bool `json:"over"` // true if the reading is above the threshold
+    Error string `json:"error,omitempty"` // why the reading couldn't be taken; such readings never turn tests away
+}
+
+// The resources of the server, checked the same way a client asking for permission is checked.
+type ResourceStatus struct {
+    CPUPercent ResourceReading `json:"cpu_percent"` // percent of CPU time spent busy
+    MemoryPercent ResourceReading `json:"memory_percent"` // percent of memory in use
+    DiskPercent ResourceReading `json:"disk_percent"` // percent of the root disk in use
+    UploadMbps ResourceReading `json:"upload_mbps"` // upload bandwidth in use
+    Admitting bool `json:"admitting"` // true if no reading is over its threshold, so tests are admitted
+}
+
+// Reads the resources of the server and compares them with the thresholds. The readings of the
+// machine are the averages kept by a ResourceSampler, so this returns at once.
+// Returns the status of the resources
+func CurrentResources() ResourceStatus {
+    thresholds := getResourceThresholds()
+    status := ResourceStatus{
+        CPUPercent: newResourceReading(resourceMonitor.CPUPercent, thresholds.CPUPercent),
+        MemoryPercent: newResourceReading(resourceMonitor.MemoryUsedPercent, thresholds.MemoryPercent),
+        DiskPercent: newResourceReading(resourceMonitor.DiskUsedPercent, thresholds.DiskPercent),
+        UploadMbps: newResourceReading(resourceMonitor.UploadMbps, thresholds.UploadMbps),
+    }
+    status.Admitting = !status.CPUPercent.Over && !status.MemoryPercent.Over && !status.DiskPercent.Over && !status.UploadMbps.Over
+    return status
+}
+
+// Takes a reading of a resource.
+// read: takes the reading
+// threshold: the reading above which tests are turned away
+// Returns the reading
+func newResourceReading(read func() (float64, error), threshold float64) ResourceReading {
+    reading := ResourceReading{Threshold: threshold}
+    value, err := read()
+    if err != nil {
+        reading.Error = err.Error()
+        return reading
+    }
+    reading.Value = value
+    reading.Over = value > threshold
+    return reading
+}
+
+// A source of readings of the resources of the server. Each reading returns an error if it can't be
+// taken.
+type ResourceMonitor interface {
+    CPUPercent() (float64, error) // percent of CPU time spent busy
+    MemoryUsedPercent() (float64, error) // percent of memory in use
+    DiskUsedPercent() (float64, error) // percent of the root disk in use
+    UploadMbps() (float64, error) // bandwidth the server is sending at, in Mbps
+}
+
+// Readings that never change, used in developer mode so that tests are admitted no matter what else
+// the machine is doing.
+type FixedResources struct {
+    CPU float64 // percent of CPU time reported as busy
+    Memory float64 // percent of memory reported as in use
+    Disk float64 // percent of the disk reported as in use
+    Upload float64 // upload bandwidth reported, in Mbps
+}
+
+func (fixed FixedResources) CPUPercent() (float64, error) {
+    return fixed.CPU, nil
+}
+
+func (fixed FixedResources) MemoryUsedPercent() (float64, error) {
+    return fixed.Memory, nil
+}
+
+func (fixed FixedResources) DiskUsedPercent() (float64, error) {
+    return fixed.Disk, nil
+}
+
+func (fixed FixedResources) UploadMbps() (float64, error) {
+    return fixed.Upload, nil
+}
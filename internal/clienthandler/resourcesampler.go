@@ -0,0 +1,179 @@
+// Samples the resources of the machine in a background goroutine and keeps rolling averages of them,
+// so that a client asking for permission is checked against the cached averages instantly instead of
+// waiting while the network counters are read twice. CPU use and upload bandwidth are measured from
+// the change in the counters of the machine between two samples, so they are only known from the
+// second sample on.
+package clienthandler
+
+import (
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/shirou/gopsutil/v3/cpu"
+    "github.com/shirou/gopsutil/v3/disk"
+    "github.com/shirou/gopsutil/v3/mem"
+    psutilnet "github.com/shirou/gopsutil/v3/net"
+)
+
+const (
+    DefaultResourceSampleInterval = 1 * time.Second // how often resources are sampled unless the config says otherwise
+    DefaultResourceAverageWindow = 10 * time.Second // how far back the averages go unless the config says otherwise
+)
+
+// The last few samples of a resource, averaged when the resource is read.
+type rollingAverage struct {
+    values []float64 // the samples, oldest overwritten first once full
+    size int // number of samples averaged
+    next int // index in values that the next sample is written to once values is full
+    err error // why the last sample couldn't be taken; nil if it was taken
+}
+
+// Adds a sample, dropping the oldest one if the window is full.
+// value: the sample
+func (average *rollingAverage) add(value float64) {
+    average.err = nil
+    if len(average.values) < average.size {
+        average.values = append(average.values, value)
+        return
+    }
+    average.values[average.next] = value
+    average.next = (average.next + 1) % average.size
+}
+
+// Gets the average of the samples in the window.
+// Returns the average, or an error if the last sample couldn't be taken or there are no samples yet
+func (average *rollingAverage) get() (float64, error) {
+    if average.err != nil {
+        return 0, average.err
+    }
+    if len(average.values) == 0 {
+        return 0, fmt.Errorf("Not sampled yet")
+    }
+    sum := 0.0
+    for _, value := range average.values {
+        sum += value
+    }
+    return sum / float64(len(average.values)), nil
+}
+
+// Reads the resources of the machine the server runs on from rolling averages kept up to date by
+// Start.
+type ResourceSampler struct {
+    interval time.Duration // how often resources are sampled
+    mutex sync.Mutex // prevents the averages and last counters from being read while a sample is taken
+    cpu rollingAverage // percent of CPU time spent busy
+    memory rollingAverage // percent of memory in use
+    disk rollingAverage // percent of the root disk in use
+    upload rollingAverage // bandwidth sent by every interface, in Mbps
+    lastCPU *cpu.TimesStat // the CPU times at the last sample; nil until the first sample
+    lastBytesSent uint64 // the bytes sent by every interface at the last sample
+    lastNetTime time.Time // when lastBytesSent was read; zero until the first sample
+}
+
+// Creates a new ResourceSampler.
+// interval: how often resources are sampled
+// window: how far back the averages go; at least one sample is always averaged
+// Returns the sampler
+func NewResourceSampler(interval time.Duration, window time.Duration) *ResourceSampler {
+    size := max(int(window / interval), 1)
+    return &ResourceSampler{
+        interval: interval,
+        cpu: rollingAverage{size: size},
+        memory: rollingAverage{size: size},
+        disk: rollingAverage{size: size},
+        upload: rollingAverage{size: size},
+    }
+}
+
+// Samples the resources of the machine at every interval. This function should be run in a new
+// thread, as it never returns.
+func (sampler *ResourceSampler) Start() {
+    ticker := time.NewTicker(sampler.interval)
+    defer ticker.Stop()
+    for {
+        sampler.sample()
+        <-ticker.C
+    }
+}
+
+// Takes one sample of every resource.
+func (sampler *ResourceSampler) sample() {
+    memUsage, memErr := mem.VirtualMemory()
+    diskUsage, diskErr := disk.Usage("/")
+    cpuTimes, cpuErr := cpu.Times(false)
+    if cpuErr == nil && len(cpuTimes) == 0 {
+        cpuErr = fmt.Errorf("No CPU times")
+    }
+    netUsage, netErr := psutilnet.IOCounters(false)
+    if netErr == nil && len(netUsage) == 0 {
+        netErr = fmt.Errorf("No network interface counters")
+    }
+    now := clk.Now()
+
+    sampler.mutex.Lock()
+    defer sampler.mutex.Unlock()
+    if memErr == nil {
+        sampler.memory.add(memUsage.UsedPercent)
+    } else {
+        sampler.memory.err = memErr
+    }
+    if diskErr == nil {
+        sampler.disk.add(diskUsage.UsedPercent)
+    } else {
+        sampler.disk.err = diskErr
+    }
+
+    if cpuErr != nil {
+        sampler.cpu.err = cpuErr
+        sampler.lastCPU = nil
+    } else {
+        current := cpuTimes[0]
+        if sampler.lastCPU != nil {
+            total := current.Total() - sampler.lastCPU.Total()
+            idle := (current.Idle + current.Iowait) - (sampler.lastCPU.Idle + sampler.lastCPU.Iowait)
+            if total > 0 {
+                sampler.cpu.add(max((total - idle) / total * 100, 0))
+            }
+        }
+        sampler.lastCPU = &current
+    }
+
+    if netErr != nil {
+        sampler.upload.err = netErr
+        sampler.lastNetTime = time.Time{}
+    } else {
+        bytesSent := netUsage[0].BytesSent
+        elapsed := now.Sub(sampler.lastNetTime).Seconds()
+        // counters that went backwards were reset, e.g. by an interface going away
+        if !sampler.lastNetTime.IsZero() && elapsed > 0 && bytesSent >= sampler.lastBytesSent {
+            sampler.upload.add(float64((bytesSent - sampler.lastBytesSent) * 8) / elapsed / 1000000.0)
+        }
+        sampler.lastBytesSent = bytesSent
+        sampler.lastNetTime = now
+    }
+}
+
+func (sampler *ResourceSampler) CPUPercent() (float64, error) {
+    sampler.mutex.Lock()
+    defer sampler.mutex.Unlock()
+    return sampler.cpu.get()
+}
+
+func (sampler *ResourceSampler) MemoryUsedPercent() (float64, error) {
+    sampler.mutex.Lock()
+    defer sampler.mutex.Unlock()
+    return sampler.memory.get()
+}
+
+func (sampler *ResourceSampler) DiskUsedPercent() (float64, error) {
+    sampler.mutex.Lock()
+    defer sampler.mutex.Unlock()
+    return sampler.disk.get()
+}
+
+func (sampler *ResourceSampler) UploadMbps() (float64, error) {
+    sampler.mutex.Lock()
+    defer sampler.mutex.Unlock()
+    return sampler.upload.get()
+}
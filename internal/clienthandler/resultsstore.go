@@ -0,0 +1,121 @@
+// Stores the results of tests somewhere they can be queried, such as a database, alongside the result
+// files. The store is given the replay info, throughputs, and analysis of a test as their result files
+// are written, so that it holds the same data as the files.
+package clienthandler
+
+import (
+    "time"
+
+    "wehe-server/internal/artifacts"
+)
+
+// Somewhere the results of tests are stored and can be looked up.
+type ResultsStore interface {
+    // Stores the replay info of a replay, adding the test if it isn't stored yet.
+    // test: the test the replay belongs to
+    // replayID: the replay
+    // replayName: the name of the replay
+    // info: the replay info, in the format of the replay info file
+    // Returns any errors
+    SaveReplay(test StoredTest, replayID ReplayType, replayName string, info string) error
+    // Stores the throughputs of a replay.
+    // test: the test the replay belongs to
+    // replayID: the replay
+    // derived: true if the throughputs were sampled from the bytes the server sent rather than sent
+    //     by the client
+    // throughputs: the throughputs and sample times, in the format of the throughput files
+    // Returns any errors
+    SaveThroughputs(test StoredTest, replayID ReplayType, derived bool, throughputs string) error
+    // Stores the analysis of a test, adding the test if it isn't stored yet.
+    // test: the test, with its analysis
+    // results: the full analysis, in the format of the results file
+    // Returns any errors
+    SaveAnalysis(test StoredTest, results string) error
+    // Gets every test of a user, oldest first.
+    // userID: the user
+    // Returns the tests or any errors
+    UserTests(userID string) ([]StoredTest, error)
+    // Gets the latest attempt of a test.
+    // userID: the user who ran the test
+    // testID: the test ID
+    // Returns the test, false if it isn't stored, or any errors
+    Test(userID string, testID int) (StoredTest, bool, error)
+}
+
+// A test as it is kept in a results store.
+type StoredTest struct {
+    UserID string `json:"user_id"` // the 10 character user ID
+    TestID int `json:"test_id"` // the test ID
+    Attempt int `json:"attempt"` // the number of times the test has been submitted
+    StartTime time.Time `json:"start_time"` // when the test started
+    ExtraString string `json:"extra_string"` // the extra string sent by the client
+    ClientVersion string `json:"client_version"` // the version of the client
+    ReplayNames map[ReplayType]string `json:"replay_names"` // the names of the replays run; key is the replay ID
+    Analysis *StoredAnalysis `json:"analysis"` // the outcome of the analysis; nil if the test hasn't been analyzed
+}
+
+// The outcome of the analysis of a test, as it is kept in a results store. The fields are the ones
+// the results file shares with wehe-py3.
+type StoredAnalysis struct {
+    Differentiation bool `json:"differentiation"` // whether the decision policy found differentiation
+    Area0var float64 `json:"area_test"` // the area test statistic
+    KS2AcceptRatio float64 `json:"ks2_ratio_test"` // the fraction of the sampled K-S tests that accepted the null hypothesis
+    KS2dVal float64 `json:"ks2dVal"` // the statistic of the K-S test over all the throughputs
+    KS2pVal float64 `json:"ks2pVal"` // the p-value of the K-S test over all the throughputs
+    OriginalAverage float64 `json:"xput_avg_original"` // the average throughput of the original replay
+    RandomAverage float64 `json:"xput_avg_test"` // the average throughput of the random replay
+}
+
+// Gets the test as it is kept in a results store.
+// Returns the test
+func (clt *Client) StoredTest() StoredTest {
+    test := StoredTest{
+        UserID: clt.UserID,
+        TestID: clt.TestID,
+        Attempt: max(clt.Attempt, 1),
+        StartTime: clt.StartTime,
+        ExtraString: clt.ExtraString,
+        ClientVersion: clt.ClientVersion,
+        ReplayNames: make(map[ReplayType]string),
+    }
+    for _, replay := range clt.ReplayResults {
+        test.ReplayNames[replay.ReplayID] = replay.ReplayName
+    }
+    if clt.Analysis != nil {
+        test.Analysis = &StoredAnalysis{
+            Differentiation: clt.Analysis.Differentiation,
+            Area0var: clt.Analysis.Area0var,
+            KS2AcceptRatio: clt.Analysis.KS2AcceptRatio,
+            KS2dVal: clt.Analysis.KS2dVal,
+            KS2pVal: clt.Analysis.KS2pVal,
+            OriginalAverage: clt.Analysis.OriginalReplayStats.Average,
+            RandomAverage: clt.Analysis.RandomReplayStats.Average,
+        }
+    }
+    return test
+}
+
+// Stores a result file that was just written in the results store, if there is one. The result
+// file has already been written, so a store that can't be reached is logged rather than failing the
+// test.
+// kind: the kind of result file
+// replayID: the replay the file belongs to; ignored for files written once per test
+// contents: the contents of the file
+func (clt *Client) saveToResultsStore(kind artifacts.Kind, replayID ReplayType, contents string) {
+    if resultsStore == nil {
+        return
+    }
+    test := clt.StoredTest()
+    var err error
+    switch kind {
+    case artifacts.ReplayInfo:
+        err = resultsStore.SaveReplay(test, replayID, test.ReplayNames[replayID], contents)
+    case artifacts.ClientThroughputs, artifacts.ServerThroughputs:
+        err = resultsStore.SaveThroughputs(test, replayID, kind == artifacts.ServerThroughputs, contents)
+    case artifacts.AnalysisResults:
+        err = resultsStore.SaveAnalysis(test, contents)
+    }
+    if err != nil {
+        clt.Logger().Error("Unable to store results", "kind", kind, "replay_id", replayID, "error", err)
+    }
+}
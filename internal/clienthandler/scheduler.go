@@ -0,0 +1,245 @@
+// Admission control for the replays of the server. At most a set number of clients run replays at
+// the same time; clients that arrive while every slot is taken wait in a bounded queue, and are
+// told how long they can expect to wait if they can't be let in. A client running a later replay of
+// a test that already ran a replay is let in before clients starting new tests, since the replay it
+// already ran would be wasted if the test couldn't finish.
+package clienthandler
+
+import (
+    "math"
+    "sort"
+    "sync"
+    "time"
+
+    "wehe-server/internal/metrics"
+)
+
+const (
+    initialReplayHold = 2 * time.Minute // how long a client is expected to hold a slot until the first one is released
+    replayHoldWeight = 0.2 // weight of the latest hold time in the moving average of hold times
+)
+
+var (
+    schedulerAdmissions = metrics.NewCounterVec("wehe_replay_scheduler_admissions_total",
+        "Number of requests to run a replay handled by the replay scheduler, by outcome.", "outcome")
+)
+
+// How soon a client waiting for a slot is let in; higher priorities are let in first.
+type schedulerPriority int
+
+const (
+    priorityNewTest schedulerPriority = iota // the first replay of a test
+    priorityContinuingTest // a later replay of a test that already ran a replay
+)
+
+// A client waiting for a slot.
+type schedulerWaiter struct {
+    clt *Client // the client waiting
+    priority schedulerPriority // how soon the client is let in
+    granted chan struct{} // closed once the client holds a slot
+}
+
+// Limits the number of replays running at the same time. A client holds a slot from when it is
+// granted permission until its connection is cleaned up. Waiting clients are let in by priority,
+// then in the order they arrived.
+type ReplayScheduler struct {
+    maxConcurrent int // number of clients that can hold a slot at the same time
+    maxQueue int // number of clients starting new tests that can wait for a slot
+    wait time.Duration // how long a client waits for a slot before it is denied
+    mutex sync.Mutex // prevents multiple goroutines from accessing holders, waiters, and meanHold
+    holders map[*Client]time.Time // when each client holding a slot was let in
+    waiters []*schedulerWaiter // clients waiting for a slot, in the order they are let in
+    meanHold time.Duration // moving average of how long clients hold a slot
+}
+
+// The slots and queue of the replay scheduler, as shown to operators.
+type ReplaySchedulerStatus struct {
+    MaxConcurrent int `json:"max_concurrent"` // number of clients that can run replays at the same time
+    Running int `json:"running"` // number of clients holding a slot
+    Waiting int `json:"waiting"` // number of clients waiting for a slot
+    WaitingContinuing int `json:"waiting_continuing"` // number of waiting clients running a later replay of a test
+    MeanHoldSeconds float64 `json:"mean_hold_seconds"` // moving average of how long clients hold a slot
+    EstimatedWaitSeconds float64 `json:"estimated_wait_seconds"` // how long a new test arriving now can expect to wait
+}
+
+// Creates a new ReplayScheduler.
+// maxConcurrent: number of clients that can run replays at the same time
+// maxQueue: number of clients starting new tests that can wait for a slot; clients running a later
+//     replay of a test can always wait
+// wait: how long a client waits for a slot before it is denied; 0 to deny without waiting
+// Returns the replay scheduler
+func NewReplayScheduler(maxConcurrent int, maxQueue int, wait time.Duration) *ReplayScheduler {
+    return &ReplayScheduler{
+        maxConcurrent: maxConcurrent,
+        maxQueue: maxQueue,
+        wait: wait,
+        holders: make(map[*Client]time.Time),
+        meanHold: initialReplayHold,
+    }
+}
+
+// Waits until a client can run a replay without going over the number of replays that can run at
+// the same time. A client that already holds a slot keeps it.
+// clt: the client that would like to run a replay
+// continuing: true if the client already ran a replay of its test
+// Returns true if the client holds a slot, or false and how long the client can expect to wait for
+//     one if the queue is full or the client waited too long
+func (scheduler *ReplayScheduler) Acquire(clt *Client, continuing bool) (bool, time.Duration) {
+    priority := priorityNewTest
+    if continuing {
+        priority = priorityContinuingTest
+    }
+
+    scheduler.mutex.Lock()
+    if _, holding := scheduler.holders[clt]; holding {
+        scheduler.mutex.Unlock()
+        return true, 0
+    }
+    if len(scheduler.holders) < scheduler.maxConcurrent && len(scheduler.waiters) == 0 {
+        scheduler.holders[clt] = clk.Now()
+        scheduler.mutex.Unlock()
+        schedulerAdmissions.Inc("immediate")
+        return true, 0
+    }
+    position := scheduler.insertPosition(priority)
+    if scheduler.wait == 0 || (priority == priorityNewTest && scheduler.newTestsWaiting() >= scheduler.maxQueue) {
+        estimate := scheduler.estimateWait(position)
+        scheduler.mutex.Unlock()
+        schedulerAdmissions.Inc("queue_full")
+        return false, estimate
+    }
+    waiter := &schedulerWaiter{
+        clt: clt,
+        priority: priority,
+        granted: make(chan struct{}),
+    }
+    scheduler.waiters = append(scheduler.waiters, nil)
+    copy(scheduler.waiters[position + 1:], scheduler.waiters[position:])
+    scheduler.waiters[position] = waiter
+    estimate := scheduler.estimateWait(position)
+    scheduler.mutex.Unlock()
+
+    clt.Logger().Info("Waiting for a replay slot", "queue_position", position + 1, "continuing_test", continuing, "estimated_wait_seconds", math.Ceil(estimate.Seconds()))
+    timer := time.NewTimer(scheduler.wait)
+    defer timer.Stop()
+    select {
+    case <-waiter.granted:
+        schedulerAdmissions.Inc("queued")
+        return true, 0
+    case <-timer.C:
+    }
+
+    scheduler.mutex.Lock()
+    defer scheduler.mutex.Unlock()
+    select {
+    case <-waiter.granted:
+        // the slot was handed over just as the wait ran out
+        schedulerAdmissions.Inc("queued")
+        return true, 0
+    default:
+    }
+    for i, w := range scheduler.waiters {
+        if w == waiter {
+            scheduler.waiters = append(scheduler.waiters[:i], scheduler.waiters[i + 1:]...)
+            position = i
+            break
+        }
+    }
+    schedulerAdmissions.Inc("timeout")
+    return false, scheduler.estimateWait(position)
+}
+
+// Gets where a client joins the queue: behind every waiting client with the same or a higher
+// priority. Must be called with the mutex held.
+// priority: the priority of the client
+// Returns the index in waiters the client would take
+func (scheduler *ReplayScheduler) insertPosition(priority schedulerPriority) int {
+    for i, waiter := range scheduler.waiters {
+        if waiter.priority < priority {
+            return i
+        }
+    }
+    return len(scheduler.waiters)
+}
+
+// Counts the waiting clients starting new tests, which are the ones the queue limit applies to.
+// Must be called with the mutex held.
+// Returns the number of waiting clients starting new tests
+func (scheduler *ReplayScheduler) newTestsWaiting() int {
+    count := 0
+    for _, waiter := range scheduler.waiters {
+        if waiter.priority == priorityNewTest {
+            count++
+        }
+    }
+    return count
+}
+
+// Estimates how long a client at a position in the queue waits for a slot, assuming that each client
+// holds its slot for the average hold time: the client at position i gets the slot that frees up
+// i-th soonest, and every maxConcurrent clients ahead of it add another average hold time. Must be
+// called with the mutex held.
+// position: the number of waiting clients that are let in before the client
+// Returns the estimated wait
+func (scheduler *ReplayScheduler) estimateWait(position int) time.Duration {
+    now := clk.Now()
+    var freeTimes []time.Time
+    for _, admitted := range scheduler.holders {
+        freeTime := admitted.Add(scheduler.meanHold)
+        if freeTime.Before(now) {
+            freeTime = now
+        }
+        freeTimes = append(freeTimes, freeTime)
+    }
+    // slots that aren't held are free now
+    for len(freeTimes) < scheduler.maxConcurrent {
+        freeTimes = append(freeTimes, now)
+    }
+    if len(freeTimes) == 0 {
+        return 0
+    }
+    sort.Slice(freeTimes, func(i, j int) bool {
+        return freeTimes[i].Before(freeTimes[j])
+    })
+    rounds := position / len(freeTimes)
+    freeTime := freeTimes[position % len(freeTimes)].Add(time.Duration(rounds) * scheduler.meanHold)
+    return freeTime.Sub(now)
+}
+
+// Releases the slot held by a client and lets in the waiting clients that now fit.
+// clt: the client whose connection is done
+func (scheduler *ReplayScheduler) Release(clt *Client) {
+    scheduler.mutex.Lock()
+    defer scheduler.mutex.Unlock()
+    admitted, holding := scheduler.holders[clt]
+    if !holding {
+        return
+    }
+    delete(scheduler.holders, clt)
+    hold := clk.Now().Sub(admitted)
+    scheduler.meanHold = time.Duration((1 - replayHoldWeight) * float64(scheduler.meanHold) + replayHoldWeight * float64(hold))
+    for len(scheduler.waiters) > 0 && len(scheduler.holders) < scheduler.maxConcurrent {
+        waiter := scheduler.waiters[0]
+        scheduler.waiters = scheduler.waiters[1:]
+        scheduler.holders[waiter.clt] = clk.Now()
+        close(waiter.granted)
+    }
+}
+
+// Gets the slots that are held, the clients waiting, and how long a new test can expect to wait.
+// Returns the status of the replay scheduler
+func (scheduler *ReplayScheduler) Status() ReplaySchedulerStatus {
+    scheduler.mutex.Lock()
+    defer scheduler.mutex.Unlock()
+    status := ReplaySchedulerStatus{
+        MaxConcurrent: scheduler.maxConcurrent,
+        Running: len(scheduler.holders),
+        Waiting: len(scheduler.waiters),
+        WaitingContinuing: len(scheduler.waiters) - scheduler.newTestsWaiting(),
+        MeanHoldSeconds: scheduler.meanHold.Seconds(),
+    }
+    if len(scheduler.holders) >= scheduler.maxConcurrent {
+        status.EstimatedWaitSeconds = scheduler.estimateWait(len(scheduler.waiters)).Seconds()
+    }
+    return status
+}
@@ -0,0 +1,29 @@
+// What the server stored for a test that the client ended, sent back to the client so that it knows
+// its results were kept and can refer to them later, e.g. when a user reports a problem.
+package clienthandler
+
+// The outcome of a test that has ended.
+type TestSummary struct {
+    TestRef string `json:"test_ref"` // the path of the manifest of the test, relative to the results directory; empty if it couldn't be written
+    Files int `json:"files"` // number of result files stored for the test
+    Replays int `json:"replays"` // number of replays the test declared
+    Analyzed bool `json:"analyzed"` // true if the test was analyzed
+    Verdict string `json:"verdict,omitempty"` // the verdict of the analysis; omitted if the test wasn't analyzed
+}
+
+// Summarizes the test once it has ended.
+// testRef: the path of the manifest of the test, from WriteManifest
+// files: the number of result files listed in the manifest
+// Returns the summary of the test
+func (clt *Client) Summary(testRef string, files int) TestSummary {
+    summary := TestSummary{
+        TestRef: testRef,
+        Files: files,
+        Replays: len(clt.ReplayResults),
+        Analyzed: clt.Analysis != nil,
+    }
+    if clt.Analysis != nil {
+        summary.Verdict = clt.Analysis.Verdict.Verdict
+    }
+    return summary
+}
@@ -0,0 +1,135 @@
+// Control replays beyond the original and random replays, used to find out what a network classifies
+// traffic by. Each control changes one thing about the original replay: a bit-inverted replay keeps
+// the sizes and timing of the packets but not their content, a port-changed replay is sent to
+// another port, and a tunneled replay is hidden inside a VPN. The original replay is still compared
+// against the random replay to decide if the test shows differentiation; each control is then
+// compared against the original replay, and a control that is treated differently shows that the
+// network classifies by what the control changed.
+package clienthandler
+
+import (
+    "fmt"
+    "strconv"
+
+    "wehe-server/internal/analysis"
+    "wehe-server/internal/errs"
+)
+
+var (
+    // every replay type, in the order of their numbers
+    replayTypes = []ReplayType{Original, Random, BitInverted, PortChanged, Tunneled}
+)
+
+// The comparison of a control replay against the original replay of a test.
+type VariantResult struct {
+    ReplayType ReplayType `json:"replay_type"` // the type of the control replay
+    ReplayName string `json:"replay_name"` // the name of the control replay
+    Differentiation bool `json:"differentiation"` // true if the control was treated differently from the original replay
+    Verdict analysis.VerdictResult `json:"verdict"` // the checks of the policy that the decision was made from
+    Area0var float64 `json:"area0var"` // difference between the average throughputs, normalized by the larger average
+    KS2pVal float64 `json:"ks2_pval"` // p-value of the 2-sample K-S test
+    KS2AcceptRatio float64 `json:"ks2_accept_ratio"` // fraction of the resampled K-S tests that agree with the full test
+    OriginalAvgThroughput float64 `json:"original_avg_xput"` // average throughput of the original replay
+    VariantAvgThroughput float64 `json:"variant_avg_xput"` // average throughput of the control replay
+    WindowSeconds float64 `json:"window_seconds"` // seconds of the replays that were compared; 0 if the whole replays were compared
+    Samples analysis.SampleCheck `json:"samples"` // the throughput samples of the original and control replays that were compared
+}
+
+// Parses the replay type sent by a client.
+// replayID: the number of the replay type
+// Returns the replay type or an error if it isn't a known replay type
+func ParseReplayType(replayID string) (ReplayType, error) {
+    replayIDInt, err := strconv.Atoi(replayID)
+    if err != nil {
+        return Original, errs.Malformed(err)
+    }
+    if replayIDInt < 0 || replayIDInt >= len(replayTypes) {
+        return Original, fmt.Errorf("%w: unexpected replay ID: %d; must be 0 (original), 1 (random), 2 (bit inverted), 3 (port changed), or 4 (tunneled)", errs.ErrMalformedMessage, replayIDInt)
+    }
+    return ReplayType(replayIDInt), nil
+}
+
+// Gets the name of a replay type, as written to the result files.
+// Returns the name
+func (replayType ReplayType) String() string {
+    switch replayType {
+    case Original:
+        return "original"
+    case Random:
+        return "random"
+    case BitInverted:
+        return "bit_inverted"
+    case PortChanged:
+        return "port_changed"
+    case Tunneled:
+        return "tunneled"
+    }
+    return strconv.Itoa(int(replayType))
+}
+
+// Encodes a replay type as its name, e.g. in the decision files.
+func (replayType ReplayType) MarshalText() ([]byte, error) {
+    return []byte(replayType.String()), nil
+}
+
+// Finds the first replay of a type in the test.
+// replayType: the type of the replay
+// Returns the index of the replay in ReplayResults, or -1 if the test has no replay of the type
+func (clt *Client) replayIndex(replayType ReplayType) int {
+    for i, replayResult := range clt.ReplayResults {
+        if replayResult.ReplayID == replayType {
+            return i
+        }
+    }
+    return -1
+}
+
+// Gets the types of the replays of the test.
+// Returns the type of each replay, in the order they were run
+func (clt *Client) replayTypes() []ReplayType {
+    types := make([]ReplayType, len(clt.ReplayResults))
+    for i, replayResult := range clt.ReplayResults {
+        types[i] = replayResult.ReplayID
+    }
+    return types
+}
+
+// Compares each control replay of the test against the original replay. A control that was sent
+// more than once is only compared the first time.
+// originalReplayIndex: the index of the original replay in ReplayResults
+// policy: the decision policy
+// Returns any errors
+func (clt *Client) analyzeVariants(originalReplayIndex int, policy analysis.DecisionPolicy) error {
+    clt.VariantResults = nil
+    original := clt.ReplayResults[originalReplayIndex]
+    for _, replayType := range replayTypes {
+        if replayType == Original || replayType == Random {
+            continue
+        }
+        index := clt.replayIndex(replayType)
+        if index < 0 {
+            continue
+        }
+        control := clt.ReplayResults[index]
+        results, window, err := compareReplays(original, control, policy)
+        if err != nil {
+            return fmt.Errorf("Unable to compare the %s replay against the original replay: %v", replayType, err)
+        }
+        clt.VariantResults = append(clt.VariantResults, VariantResult{
+            ReplayType: replayType,
+            ReplayName: control.ReplayName,
+            Differentiation: results.Differentiation,
+            Verdict: results.Verdict,
+            Area0var: results.Area0var,
+            KS2pVal: results.KS2pVal,
+            KS2AcceptRatio: results.KS2AcceptRatio,
+            OriginalAvgThroughput: results.OriginalReplayStats.Average,
+            VariantAvgThroughput: results.RandomReplayStats.Average,
+            WindowSeconds: window.Seconds(),
+            Samples: results.Samples,
+        })
+        clt.Logger().Info("Compared control replay", "replay_type", replayType, "control_replay", control.ReplayName,
+            "differentiation", results.Differentiation, "area0var", results.Area0var, "ks2_pval", results.KS2pVal)
+    }
+    return nil
+}
@@ -0,0 +1,84 @@
+// Provides the time to the rest of the server. Code that paces replays, enforces timeouts, or
+// records timestamps gets the time from a Clock rather than calling the time package directly, so
+// that tests can swap in a Fake clock and check timing deterministically.
+package clock
+
+import (
+    "sync"
+    "time"
+)
+
+// A source of time
+type Clock interface {
+    Now() time.Time // gets the current time
+    Sleep(d time.Duration) // pauses the calling goroutine for a duration; returns immediately if d <= 0
+    Since(t time.Time) time.Duration // gets the time elapsed since t
+}
+
+// The system clock.
+type Real struct{}
+
+func (Real) Now() time.Time {
+    return time.Now()
+}
+
+func (Real) Sleep(d time.Duration) {
+    time.Sleep(d)
+}
+
+func (Real) Since(t time.Time) time.Duration {
+    return time.Since(t)
+}
+
+// A clock that only moves when told to. Sleeping advances the clock by the sleep duration and
+// returns immediately, so code that paces itself with Sleep runs instantly but sees the same times
+// it would with the real clock.
+type Fake struct {
+    now time.Time // the current time of the clock
+    sleeps []time.Duration // durations passed to Sleep, in order
+    mutex sync.Mutex // allows the clock to be shared between goroutines
+}
+
+// Creates a new Fake clock.
+// start: the time the clock starts at
+// Returns the fake clock
+func NewFake(start time.Time) *Fake {
+    return &Fake{
+        now: start,
+    }
+}
+
+func (fake *Fake) Now() time.Time {
+    fake.mutex.Lock()
+    defer fake.mutex.Unlock()
+    return fake.now
+}
+
+func (fake *Fake) Sleep(d time.Duration) {
+    fake.mutex.Lock()
+    defer fake.mutex.Unlock()
+    fake.sleeps = append(fake.sleeps, d)
+    if d > 0 {
+        fake.now = fake.now.Add(d)
+    }
+}
+
+func (fake *Fake) Since(t time.Time) time.Duration {
+    return fake.Now().Sub(t)
+}
+
+// Moves the clock forward, e.g. to simulate time spent waiting on the network.
+// d: how far to move the clock
+func (fake *Fake) Advance(d time.Duration) {
+    fake.mutex.Lock()
+    defer fake.mutex.Unlock()
+    fake.now = fake.now.Add(d)
+}
+
+// Gets the durations passed to Sleep so far, so that tests can check pacing.
+// Returns the sleep durations, in order
+func (fake *Fake) Sleeps() []time.Duration {
+    fake.mutex.Lock()
+    defer fake.mutex.Unlock()
+    return append([]time.Duration(nil), fake.sleeps...)
+}
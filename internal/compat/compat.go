@@ -0,0 +1,211 @@
+// What each range of Wehe client versions sends and expects. The long tail of old clients still
+// running in the wild each need small workarounds; keeping them in one table, instead of as checks
+// scattered through the protocol handlers, makes it clear which clients need what and when a
+// workaround can be removed.
+package compat
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+const (
+    UnknownVersion = "1.0" // the version of clients that don't send their version
+    loopbackIP = "127.0.0.1" // sent by clients that don't know the IP of their test port
+)
+
+// positions of the optional pieces at the end of a declare ID message
+const (
+    declareIDTestPortIP = 6 // the IP of the client as seen by the test port
+    declareIDVersion = 7 // the version of the client
+    declareIDMaxReplayDuration = 8 // the number of seconds the client would like the replay to run for
+    declareIDReplayToken = 9 // true if the client starts its replays with a replay token
+    declareIDSamplesPerReplay = 10 // the number of throughput samples the client would like to take
+    declareIDExperimentFlags = 11 // identifies the experiments the client is part of
+)
+
+// A client version as major.minor.patch.
+type Version [3]int
+
+// Parses a client version. Missing parts are 0 and anything after the digits of a part, e.g. a
+// "-beta" suffix, is ignored.
+// version: the version string, e.g. 4.1.2
+// Returns the version or an error if a part doesn't start with a number
+func ParseVersion(version string) (Version, error) {
+    var parsed Version
+    parts := strings.SplitN(version, ".", len(parsed))
+    for i, part := range parts {
+        digits := part
+        end := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' })
+        if end >= 0 {
+            digits = part[:end]
+        }
+        num, err := strconv.Atoi(digits)
+        if err != nil {
+            return Version{}, fmt.Errorf("Invalid client version %s", version)
+        }
+        parsed[i] = num
+    }
+    return parsed, nil
+}
+
+// Compares two versions.
+// other: the version to compare against
+// Returns true if this version is older than other
+func (version Version) Less(other Version) bool {
+    for i := range version {
+        if version[i] != other[i] {
+            return version[i] < other[i]
+        }
+    }
+    return false
+}
+
+// Formats the version as major.minor.patch.
+// Returns the version string
+func (version Version) String() string {
+    return fmt.Sprintf("%d.%d.%d", version[0], version[1], version[2])
+}
+
+// What a client sends and expects, and which workarounds it needs.
+type Capabilities struct {
+    DashedReplayNames bool // replay names are sent with - instead of _, as in the old replay files
+    LoopbackTestPortIP bool // the client sends 127.0.0.1 as its test port IP when it doesn't know it
+    IPInUseSamplesPerReplay bool // an "IP in use" denial of the old protocol also carries the number of samples per replay
+    StructuredRejections bool // the client can read the JSON reason sent with an error response
+    MaintenanceRetryAfter bool // the client understands the maintenance denial of ask4permission and the retry-after that comes with it
+    ServerTime bool // the client reads the server time that follows the samples per replay in an ask4permission OK
+    ServerBusyRetryAfter bool // the client understands the server busy denial of ask4permission and the estimated wait that comes with it
+    ReplayTimeout bool // the client reads the UDP replay timeout at the end of an ask4permission or declare replay OK and waits that long for the replay
+}
+
+// The capabilities of a range of client versions.
+type shim struct {
+    min Version // oldest version in the range, inclusive
+    max Version // newest version in the range, exclusive; the zero value means there is no newest version
+    capabilities Capabilities // what clients in the range send and expect
+}
+
+// The capabilities of each range of client versions. Ranges must not overlap. Versions that don't
+// fall in any range get the capabilities of the newest range.
+var shims = []shim{
+    // the old protocol, used by clients before 4.0
+    {
+        min: Version{0, 0, 0},
+        max: Version{4, 0, 0},
+        capabilities: Capabilities{
+            DashedReplayNames: true,
+            LoopbackTestPortIP: true,
+            IPInUseSamplesPerReplay: true,
+        },
+    },
+    // the new protocol
+    {
+        min: Version{4, 0, 0},
+        capabilities: Capabilities{
+            DashedReplayNames: true,
+            LoopbackTestPortIP: true,
+            StructuredRejections: true,
+            MaintenanceRetryAfter: true,
+            ServerTime: true,
+            ServerBusyRetryAfter: true,
+            ReplayTimeout: true,
+        },
+    },
+}
+
+// Gets the capabilities of a client version. Versions that can't be parsed are treated as the
+// oldest version so that they get every workaround.
+// version: the version string sent by the client
+// Returns the capabilities of the version
+func For(version string) Capabilities {
+    parsed, err := ParseVersion(version)
+    if err != nil {
+        parsed = Version{}
+    }
+    for _, s := range shims {
+        if !parsed.Less(s.min) && (s.max == Version{} || parsed.Less(s.max)) {
+            return s.capabilities
+        }
+    }
+    return shims[len(shims) - 1].capabilities
+}
+
+// Gets the client version and test port IP from the optional pieces at the end of a declare ID
+// message. Clients that don't send them are treated as UnknownVersion with no test port IP.
+// pieces: the pieces of the declare ID message, split on ;
+// Returns the client version and the test port IP, which is empty if the client didn't send a
+//     usable one
+func DeclareIDExtras(pieces []string) (string, string) {
+    version := UnknownVersion
+    if len(pieces) > declareIDVersion {
+        version = pieces[declareIDVersion]
+    }
+    testPortIP := ""
+    if len(pieces) > declareIDTestPortIP {
+        testPortIP = pieces[declareIDTestPortIP]
+    }
+    if testPortIP == loopbackIP && For(version).LoopbackTestPortIP {
+        testPortIP = ""
+    }
+    return version, testPortIP
+}
+
+// Gets the replay duration requested in the optional pieces at the end of a declare ID message.
+// Clients that don't send it run the whole replay.
+// pieces: the pieces of the declare ID message, split on ;
+// Returns the number of seconds the client would like the replay to run for, or an empty string if
+//     the client didn't ask for a shorter replay
+func DeclareIDMaxReplayDuration(pieces []string) string {
+    if len(pieces) > declareIDMaxReplayDuration {
+        return pieces[declareIDMaxReplayDuration]
+    }
+    return ""
+}
+
+// Gets whether the client asked for a replay token in the optional pieces at the end of a declare ID
+// message. Clients that don't ask are looked up by IP.
+// pieces: the pieces of the declare ID message, split on ;
+// Returns true or false as sent by the client, or an empty string if the client didn't say
+func DeclareIDReplayToken(pieces []string) string {
+    if len(pieces) > declareIDReplayToken {
+        return pieces[declareIDReplayToken]
+    }
+    return ""
+}
+
+// Gets the number of throughput samples requested in the optional pieces at the end of a declare ID
+// message. Clients that don't send it take the number the server picks.
+// pieces: the pieces of the declare ID message, split on ;
+// Returns the number of samples the client would like to take, or an empty string if the client
+//     didn't ask for a number
+func DeclareIDSamplesPerReplay(pieces []string) string {
+    if len(pieces) > declareIDSamplesPerReplay {
+        return pieces[declareIDSamplesPerReplay]
+    }
+    return ""
+}
+
+// Gets the experiment flags in the optional pieces at the end of a declare ID message. The flags
+// can't contain a ;, since the message is split on it.
+// pieces: the pieces of the declare ID message, split on ;
+// Returns the flags, or an empty string if the client didn't send any
+func DeclareIDExperimentFlags(pieces []string) string {
+    if len(pieces) > declareIDExperimentFlags {
+        return pieces[declareIDExperimentFlags]
+    }
+    return ""
+}
+
+// Converts a replay name sent by a client to the name used by the server.
+// replayName: the replay name sent by the client
+// capabilities: the capabilities of the client
+// Returns the server's name for the replay
+func ReplayName(replayName string, capabilities Capabilities) string {
+    if capabilities.DashedReplayNames {
+        //TODO: change client replay files replay names to use _ instead of -, then delete this workaround
+        return strings.Replace(replayName, "-", "_", -1)
+    }
+    return replayName
+}
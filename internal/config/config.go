@@ -3,16 +3,30 @@ package config
 
 import (
     "fmt"
+    "slices"
+    "strings"
 
     "gopkg.in/ini.v1"
+
+    "wehe-server/internal/compat"
+)
+
+const (
+    decisionPolicySectionPrefix = "decision_policy." // prefix of the sections that define decision policies
+    dataProfileSectionPrefix = "data_profile." // prefix of the sections that define data-handling profiles
+)
+
+var (
+    nodeLabelNames = []string{"site", "machine", "operator", "environment"} // keys of the [node] section that are read as node labels
 )
 
 // TODO: should this just be command line args; no need to pass around config file with binary when released
 // Configurations for the Wehe server
 // configs are read in from a .ini config file
 type Config struct {
+    Path string // path the config was read from, so that it can be read again when it is reloaded
     TestsDir string
-    PortNumbersFile string
+    PortNumbersFile string // file listing test ports to listen on besides the ports of the replays; empty if there is none
     HostInfoFilename string
     CACertFilename string
     CACertPrivKeyFilename string
@@ -20,7 +34,151 @@ type Config struct {
     ServerCertPrivKeyFilename string
     TmpResultsDir string
     ResultsDir string
+    DurableResultWrites bool // true if result files are fsynced, renamed into place, and checked after they are written
+    SideChannelPort int // TCP port the side channel listens on
+    OldAnalyzerPort int // TCP port clients older than 4.0 fetch their results from
+    UDPReplayTimeoutSeconds int // seconds a UDP replay runs before it is cut off
+    MaxUDPReplayTimeoutSeconds int // seconds a UDP replay that lasts longer than UDPReplayTimeoutSeconds can be given to run to its end
     UUIDPrefixFile string
+    RunAsUser string // user to switch to once the ports are bound; empty to keep running as the current user
+    RunAsGroup string // group to switch to once the ports are bound; empty to use the primary group of RunAsUser
+    StandbyLockFile string // lock file shared with a standby server; only the holder serves clients. Empty to run alone
+    ReplayErrorPolicy string // what replay servers do when sending a packet fails: "abort" or "continue"
+    ReplayErrorPolicyOverrides map[string]string // per-replay overrides of ReplayErrorPolicy; key is replay name
+    RequestHashCheck string // what TCP replay servers do when the request of a client doesn't match the replay: "strict", "permissive", or "off"
+    UDPDontFragment bool // true if UDP replay packets are sent with the DF bit set so that packets larger than the path MTU aren't fragmented
+    UDPClampToPathMTU bool // true if UDP replay packets larger than the path MTU are cut to fit it instead of being skipped
+    UDPSendBatchSize int // most packets of a UDP flow sent with one system call
+    UDPSendBatchWindowMicroseconds int // how far ahead of its schedule, in microseconds, a UDP packet can be sent in the batch of an earlier packet
+    UDPSocketPerFlow bool // true if each UDP flow is sent from its own socket bound to the replay port
+    DuplicateTestPolicy string // what to do when a userID and testID are submitted again: "version" or "reject"
+    AnonIPv4PrefixLen int // number of leading bits of client IPv4 addresses kept in results and PCAPs
+    AnonIPv6PrefixLen int // number of leading bits of client IPv6 addresses kept in results and PCAPs
+    DenialLogFile string // path of the log that tests denied permission to run are recorded in
+    DenialLogMaxSizeMB int // size in MB the denial log can grow to before it is rotated
+    DenialLogMaxFiles int // number of rotated denial logs to keep
+    ReportEnabled bool // true if a daily report of the tests is written to ResultsDir/report/
+    ReportWebhookURL string // URL the daily report is posted to; empty if the report isn't posted
+    ReportPrivacyEpsilon float64 // privacy budget of the noise added to the report counts; 0 adds no noise
+    ReportMinGroupCount int // groups of tests smaller than this are left out of the report; 0 keeps every group
+    VerdictWebhookURL string // URL a summary of each verdict is posted to; empty if verdicts aren't posted
+    UploadEnabled bool // true if the results of finished tests are uploaded to an object store and deleted locally
+    UploadProvider string // the object store results are uploaded to: "gcs" or "s3"
+    UploadEndpoint string // URL of the S3-compatible store; unused for gcs
+    UploadRegion string // region of the bucket; unused for gcs
+    UploadBucket string // the bucket results are uploaded to
+    UploadPrefix string // prepended to the object key of every test
+    UploadMinAgeMinutes int // minutes after its manifest is written that a test is uploaded
+    UploadIntervalSeconds int // seconds between checks for finished tests
+    UploadMaxMbps float64 // upload bandwidth the uploads can use; 0 for no limit
+    UploadEncryptionKeyFile string // PEM file of the RSA public key uploads are encrypted with; empty to upload them unencrypted
+    ResultsDBDriver string // the database results are also stored in: "sqlite" or "postgres"; empty if they are only written to files
+    ResultsDBSource string // the data source name used to connect to the results database
+    MaintenanceWindows []string // windows during which new tests aren't admitted
+    UpdateSource string // where the update subcommand fetches replays and test ports from; empty if it must be given on the command line
+    ConnectionRatePerSecond float64 // connections per second a source without a replay can open to each replay port; 0 for no limit
+    ConnectionRateBurst int // connections a source without a replay can open at once to each replay port
+    ConnectionRateBanAfter int // rejected connections within a minute that get a source banned from a replay port; 0 never bans
+    ConnectionRateBanSeconds int // seconds a banned source is ignored
+    ResultsLayoutPreset string // the built in layout of the result files
+    ResultsLayoutTemplates map[string]string // templates that override the preset; key is the kind of result file
+    AdminListenAddr string // IP and port the admin API listens on; empty if the admin API is off
+    AdminTokensFile string // path to the file of tokens that can access the admin API
+    AdminAuditLogFile string // path of the log that privileged admin API calls are recorded in
+    DebugCaptureInterface string // interface operators can capture the packets of a client on; empty if captures are off
+    DebugCaptureDir string // directory the packet captures started by operators are written to
+    DebugCaptureMaxSeconds int // the longest a packet capture started by an operator can run
+    DebugCaptureMaxMB int // megabytes of packets a capture started by an operator can hold
+    DecisionPolicy string // name of the decision policy used to decide if tests show differentiation
+    KSTest string // how the K-S tests are run: natively or with scipy, to cross-validate the native p-values
+    MinThroughputSamples int // fewest nonzero throughput samples each replay needs for a test to be decided; 0 for no minimum
+    DecisionPolicies map[string]DecisionPolicy // the decision policies defined in the config file; key is the policy name
+    LossCaptureInterface string // interface the packets of replays are captured on to localize differentiation; empty if they aren't captured
+    ReplayGroups map[string][]string // replay names in each group of replays that must not run at the same time; key is the group name
+    ReplayGroupWaitSeconds int // seconds a client waits for a replay in its group to finish before it is denied
+    SchedulerMaxConcurrentReplays int // number of clients that can run replays at the same time; 0 for no limit
+    SchedulerMaxQueueLength int // number of clients starting new tests that can wait for a replay slot
+    SchedulerMaxWaitSeconds int // seconds a client waits for a replay slot before it is denied
+    FairnessPolicy string // how permission is shared between users when the server is busy; first_come or recent_usage
+    FairnessContentionThreshold int // number of running replays at which the server is busy
+    FairnessMaxRecentTests int // tests a user can have started within the window and still be admitted while the server is busy
+    FairnessWindowHours int // hours back that the tests of a user are counted
+    BandwidthMonthlyUserCapMB int // MB the replay servers can send a user in a calendar month before its tests are turned away; 0 for no cap
+    BandwidthUsageFile string // where the bytes sent to each user this month are saved; empty to keep them in memory
+    BandwidthProbeKB int // KB sent in the bandwidth probe that clients can run before a replay; 0 to turn probes off
+    BandwidthProbeTimeoutMs int // milliseconds a bandwidth probe can take before it is cut off
+    BandwidthProbePolicy string // what to do with a replay that is faster than the probed link: warn or skip
+    MaxCPUPercent float64 // percent of CPU time spent busy above which tests are turned away
+    MaxMemoryPercent float64 // percent of memory in use above which tests are turned away
+    MaxDiskPercent float64 // percent of the root disk in use above which tests are turned away
+    MaxUploadMbps float64 // upload bandwidth, in Mbps, above which tests are turned away
+    ResourceSampleIntervalSeconds int // how often the resources of the server are sampled
+    ResourceAverageWindowSeconds int // how far back the averages of the resources that tests are checked against go
+    LogLevel int // lowest level that is logged, from 1 (wtf) to 5 (debug)
+    LogFormat string // how log lines are written: json or logfmt
+    LogFile string // path of the server log; empty to log to stdout
+    LogMaxSizeMB int // size in MB the server log can grow to before it is rotated
+    LogMaxFiles int // number of rotated server logs to keep
+    NodeLabels map[string]string // labels that identify the deployment the server belongs to, e.g. site; key is the label name, and labels left empty are omitted
+    ReplayLintEnabled bool // true if replays are checked for sensitive content before they are served
+    ReplayLintPatterns map[string]string // regular expressions matching sensitive content; key is the pattern name
+    ReplayLintAllowUnscrubbed []string // replays that are served even if sensitive content is found in them
+    ReplayCacheMaxMB int // MB of payloads the replays kept in memory can take up; 0 for no limit
+    ReplayCachePreload bool // true if every replay is loaded into memory when the server starts
+    ReplayParseBudgetMs int // milliseconds reading and parsing a replay file should take before a warning is logged; 0 for no limit
+    ReplayFileBudgetMB int // MB a replay file can be before a warning is logged; 0 for no limit
+    CalibrationEnabled bool // true if the built-in calibration replays are served
+    SideChannelReadTimeoutSeconds int // seconds the server waits for the next request of a client; 0 waits forever
+    SideChannelWriteTimeoutSeconds int // seconds sending a response to a client can take; 0 for no limit
+    MaxTestSeconds int // seconds a test can last from when the client connects; 0 for no limit
+    MinClientVersion string // oldest client version that can run tests; empty lets every version in
+    SamplesPerReplay int // throughput samples clients are told to take per replay unless they ask for another number
+    MinSamplesPerReplay int // fewest throughput samples a client can ask to take per replay
+    MaxSamplesPerReplay int // most throughput samples a client can ask to take per replay
+    GRPCSideChannelAddr string // IP and port the gRPC side channel listens on; empty if it is off
+    TLSMinVersion string // the oldest TLS version the servers accept, e.g. "1.2"; empty for the Go default
+    TLSCipherSuites []string // names of the cipher suites the servers accept for TLS 1.2 and older; empty for the Go defaults
+    TLSClientCAFile string // PEM certs of the CAs that sign side channel client certs; empty if clients aren't authenticated
+    TLSRequireClientCert bool // true if side channel clients that don't send a cert are refused
+    ShutdownReportDir string // directory the report of the tests running when the server exits is written to
+    ShutdownGoroutineDump bool // true if the stacks of every goroutine are written with the shutdown report
+    ShutdownDrainSeconds int // seconds running tests have to finish on their own after the server is told to exit
+    ShutdownGraceSeconds int // seconds running tests have to write their results when the server exits
+    ErrorBudgetEnabled bool // true if the server stops admitting tests when it goes over an error budget
+    FailedTestsPerHour int // tests that can end in an error per hour before the server is over budget; 0 for no limit
+    PacingViolationsPerHour int // replays that can be sent late per hour before the server is over budget; 0 for no limit
+    CaptureDropsPerHour int // packets that can be dropped from captures per hour before the server is over budget; 0 for no limit
+    PacingToleranceMs int // milliseconds a replay packet can be sent after its scheduled time before it is a pacing violation
+    AnomalyEnabled bool // true if the verdicts of the node are watched for signs of a node problem
+    AnomalyWindowMinutes int // minutes of verdicts that are checked
+    AnomalyMinTests int // the fewest analyzed tests in the window to check them
+    AnomalyMinRate float64 // the share of tests showing differentiation must be at least this to alert
+    AnomalyZThreshold float64 // standard deviations above the baselines the differentiation must be to alert
+    AnomalyBaselineRate float64 // share of tests expected to show differentiation, for apps without a baseline in the baselines file
+    AnomalyBaselinesFile string // daily report, e.g. of the fleet, that the baselines of each app are read from; empty to use the baseline rate for every app
+    AnomalyCheckIntervalSeconds int // how often the verdicts are checked
+    DataProfiles map[string]DataProfile // what is stored about tests by client country; key is the profile name
+}
+
+// Thresholds used to decide if a test shows differentiation, read from a [decision_policy.<name>]
+// section
+type DecisionPolicy struct {
+    Alpha float64 // confidence level of the K-S tests
+    AreaThreshold float64 // area0var must be above this for differentiation
+    KS2pValThreshold float64 // the K-S p-value must be below this for differentiation
+    AcceptRatioThreshold float64 // fraction of resampled K-S tests that must agree with the full test
+    Resamples int // number of resampled K-S tests
+    Verdict string // which thresholds must be crossed for differentiation: all or ks
+}
+
+// What is stored about the tests of clients in certain countries, read from a
+// [data_profile.<name>] section
+type DataProfile struct {
+    Countries []string // two letter codes of the countries the profile applies to
+    Location string // how much of the client location is stored: full, city, country, or none
+    AnonIPv4PrefixLen int // number of leading bits of client IPv4 addresses kept in result files
+    AnonIPv6PrefixLen int // number of leading bits of client IPv6 addresses kept in result files
+    SideChannelRTTs bool // true if side channel RTTs are stored
 }
 
 // Creates a new Config object
@@ -33,6 +191,7 @@ func New(configPath *string) (Config, error) {
     if err != nil {
         return config, err
     }
+    config.Path = *configPath
     defaultSection := configFile.Section("")
 
     config.TestsDir, err = getString(defaultSection, "tests_dir")
@@ -40,10 +199,9 @@ func New(configPath *string) (Config, error) {
         return config, err
     }
 
-    config.PortNumbersFile, err = getString(defaultSection, "port_numbers_file")
-    if err != nil {
-        return config, err
-    }
+    // the test ports also come from the replays, so the port numbers file is only needed for TCP
+    // replays that don't declare their ports
+    config.PortNumbersFile = defaultSection.Key("port_numbers_file").String()
 
     config.HostInfoFilename, err = getString(defaultSection, "host_info_filename")
     if err != nil {
@@ -80,14 +238,751 @@ func New(configPath *string) (Config, error) {
         return config, err
     }
 
+    config.DurableResultWrites, err = getBool(defaultSection, "durable_result_writes")
+    if err != nil {
+        return config, err
+    }
+
     config.UUIDPrefixFile, err = getString(defaultSection, "uuid_prefix_file")
     if err != nil {
         return config, err
     }
 
+    // dropping privileges is optional, so empty values are allowed
+    config.RunAsUser = defaultSection.Key("run_as_user").String()
+    config.RunAsGroup = defaultSection.Key("run_as_group").String()
+
+    // running as a standby pair is optional, so an empty value is allowed
+    config.StandbyLockFile = defaultSection.Key("standby_lock_file").String()
+
+    config.DuplicateTestPolicy, err = getChoice(defaultSection, "duplicate_test_policy", "version", "reject")
+    if err != nil {
+        return config, err
+    }
+
+    config.AnonIPv4PrefixLen, err = getInt(defaultSection, "anon_ipv4_prefix_len", 0, 32)
+    if err != nil {
+        return config, err
+    }
+
+    config.AnonIPv6PrefixLen, err = getInt(defaultSection, "anon_ipv6_prefix_len", 0, 128)
+    if err != nil {
+        return config, err
+    }
+
+    config.DenialLogFile, err = getString(defaultSection, "denial_log_file")
+    if err != nil {
+        return config, err
+    }
+
+    config.DenialLogMaxSizeMB, err = getInt(defaultSection, "denial_log_max_size_mb", 1, 1024)
+    if err != nil {
+        return config, err
+    }
+
+    config.DenialLogMaxFiles, err = getInt(defaultSection, "denial_log_max_files", 0, 100)
+    if err != nil {
+        return config, err
+    }
+
+    networkSection := configFile.Section("network")
+    config.SideChannelPort, err = getInt(networkSection, "side_channel_port", 1, 65535)
+    if err != nil {
+        return config, err
+    }
+
+    config.OldAnalyzerPort, err = getInt(networkSection, "old_analyzer_port", 1, 65535)
+    if err != nil {
+        return config, err
+    }
+    if config.OldAnalyzerPort == config.SideChannelPort {
+        return config, fmt.Errorf("network.old_analyzer_port and network.side_channel_port must be different; both are %d", config.SideChannelPort)
+    }
+
+    config.UDPReplayTimeoutSeconds, err = getInt(networkSection, "udp_replay_timeout_seconds", 1, 600)
+    if err != nil {
+        return config, err
+    }
+
+    config.MaxUDPReplayTimeoutSeconds, err = getInt(networkSection, "max_udp_replay_timeout_seconds", 1, 600)
+    if err != nil {
+        return config, err
+    }
+    if config.MaxUDPReplayTimeoutSeconds < config.UDPReplayTimeoutSeconds {
+        return config, fmt.Errorf("network.max_udp_replay_timeout_seconds (%d) must be at least network.udp_replay_timeout_seconds (%d)", config.MaxUDPReplayTimeoutSeconds, config.UDPReplayTimeoutSeconds)
+    }
+
+    // the default key of the replay error policy section applies to all replays; every other key is
+    // a replay name whose policy overrides the default
+    replayErrorPolicySection := configFile.Section("replay_error_policy")
+    config.ReplayErrorPolicy, err = getChoice(replayErrorPolicySection, "default", "abort", "continue")
+    if err != nil {
+        return config, err
+    }
+    config.ReplayErrorPolicyOverrides = make(map[string]string)
+    for _, replayName := range replayErrorPolicySection.KeyStrings() {
+        if replayName == "default" {
+            continue
+        }
+        config.ReplayErrorPolicyOverrides[replayName], err = getChoice(replayErrorPolicySection, replayName, "abort", "continue")
+        if err != nil {
+            return config, err
+        }
+    }
+
+    config.RequestHashCheck, err = getChoice(configFile.Section("request_hash"), "check", "strict", "permissive", "off")
+    if err != nil {
+        return config, err
+    }
+
+    udpPathMTUSection := configFile.Section("udp_path_mtu")
+    config.UDPDontFragment, err = getBool(udpPathMTUSection, "dont_fragment")
+    if err != nil {
+        return config, err
+    }
+
+    config.UDPClampToPathMTU, err = getBool(udpPathMTUSection, "clamp")
+    if err != nil {
+        return config, err
+    }
+
+    udpSendSection := configFile.Section("udp_send")
+    config.UDPSendBatchSize, err = getInt(udpSendSection, "batch_size", 1, 64)
+    if err != nil {
+        return config, err
+    }
+
+    config.UDPSendBatchWindowMicroseconds, err = getInt(udpSendSection, "batch_window_us", 0, 100000)
+    if err != nil {
+        return config, err
+    }
+
+    config.UDPSocketPerFlow, err = getBool(udpSendSection, "socket_per_flow")
+    if err != nil {
+        return config, err
+    }
+
+    // the preset key of the results layout section is the layout to start from; every other key is
+    // a kind of result file whose path template overrides the one in the preset
+    resultsLayoutSection := configFile.Section("results_layout")
+    config.ResultsLayoutPreset, err = getString(resultsLayoutSection, "preset")
+    if err != nil {
+        return config, err
+    }
+    config.ResultsLayoutTemplates = make(map[string]string)
+    for _, kind := range resultsLayoutSection.KeyStrings() {
+        if kind == "preset" {
+            continue
+        }
+        config.ResultsLayoutTemplates[kind], err = getString(resultsLayoutSection, kind)
+        if err != nil {
+            return config, err
+        }
+    }
+
+    reportSection := configFile.Section("report")
+    config.ReportEnabled, err = getBool(reportSection, "enabled")
+    if err != nil {
+        return config, err
+    }
+    // the webhook is optional, so an empty URL is allowed
+    config.ReportWebhookURL = reportSection.Key("webhook_url").String()
+
+    config.ReportPrivacyEpsilon, err = getFloat(reportSection, "privacy_epsilon", 0, 100)
+    if err != nil {
+        return config, err
+    }
+
+    config.ReportMinGroupCount, err = getInt(reportSection, "min_group_count", 0, 1000000)
+    if err != nil {
+        return config, err
+    }
+
+    connectionRateSection := configFile.Section("connection_rate_limit")
+    config.ConnectionRatePerSecond, err = getFloat(connectionRateSection, "per_second", 0, 10000)
+    if err != nil {
+        return config, err
+    }
+
+    config.ConnectionRateBurst, err = getInt(connectionRateSection, "burst", 1, 10000)
+    if err != nil {
+        return config, err
+    }
+
+    config.ConnectionRateBanAfter, err = getInt(connectionRateSection, "ban_after", 0, 1000000)
+    if err != nil {
+        return config, err
+    }
+
+    config.ConnectionRateBanSeconds, err = getInt(connectionRateSection, "ban_seconds", 0, 86400)
+    if err != nil {
+        return config, err
+    }
+
+    // maintenance windows are optional
+    config.MaintenanceWindows = configFile.Section("maintenance").Key("windows").Strings(",")
+
+    // the update source can also be given on the command line
+    config.UpdateSource = configFile.Section("update").Key("source").String()
+
+    // verdicts are only posted if a URL is set
+    config.VerdictWebhookURL = configFile.Section("verdict_webhook").Key("url").String()
+
+    // the rest of the upload section is only needed when uploads are on
+    uploadSection := configFile.Section("upload")
+    config.UploadEnabled, err = getBool(uploadSection, "enabled")
+    if err != nil {
+        return config, err
+    }
+    if config.UploadEnabled {
+        config.UploadProvider, err = getChoice(uploadSection, "provider", "gcs", "s3")
+        if err != nil {
+            return config, err
+        }
+
+        config.UploadBucket, err = getString(uploadSection, "bucket")
+        if err != nil {
+            return config, err
+        }
+
+        // GCS has a fixed endpoint and no regions
+        if config.UploadProvider == "s3" {
+            config.UploadEndpoint, err = getString(uploadSection, "endpoint")
+            if err != nil {
+                return config, err
+            }
+
+            config.UploadRegion, err = getString(uploadSection, "region")
+            if err != nil {
+                return config, err
+            }
+        }
+
+        config.UploadPrefix = uploadSection.Key("prefix").String()
+
+        config.UploadMinAgeMinutes, err = getInt(uploadSection, "min_age_minutes", 0, 7 * 24 * 60)
+        if err != nil {
+            return config, err
+        }
+
+        config.UploadIntervalSeconds, err = getInt(uploadSection, "interval_seconds", 1, 24 * 3600)
+        if err != nil {
+            return config, err
+        }
+
+        config.UploadMaxMbps, err = getFloat(uploadSection, "max_mbps", 0, 1000000)
+        if err != nil {
+            return config, err
+        }
+
+        config.UploadEncryptionKeyFile = uploadSection.Key("encryption_public_key_file").String()
+    }
+
+    // results are only stored in a database if a driver is set
+    resultsDBSection := configFile.Section("results_db")
+    if resultsDBSection.Key("driver").String() != "" {
+        config.ResultsDBDriver, err = getChoice(resultsDBSection, "driver", "sqlite", "postgres")
+        if err != nil {
+            return config, err
+        }
+
+        config.ResultsDBSource, err = getString(resultsDBSection, "dsn")
+        if err != nil {
+            return config, err
+        }
+    }
+
+    // the admin API is optional; the tokens and audit log are only needed when it is on
+    adminSection := configFile.Section("admin")
+    config.AdminListenAddr = adminSection.Key("listen_addr").String()
+    if config.AdminListenAddr != "" {
+        config.AdminTokensFile, err = getString(adminSection, "tokens_file")
+        if err != nil {
+            return config, err
+        }
+
+        config.AdminAuditLogFile, err = getString(adminSection, "audit_log_file")
+        if err != nil {
+            return config, err
+        }
+
+        // captures are optional; with no interface, operators can't start them
+        config.DebugCaptureInterface = adminSection.Key("capture_interface").String()
+        if config.DebugCaptureInterface != "" {
+            config.DebugCaptureDir, err = getString(adminSection, "capture_dir")
+            if err != nil {
+                return config, err
+            }
+
+            config.DebugCaptureMaxSeconds, err = getInt(adminSection, "capture_max_seconds", 1, 3600)
+            if err != nil {
+                return config, err
+            }
+
+            config.DebugCaptureMaxMB, err = getInt(adminSection, "capture_max_mb", 1, 10000)
+            if err != nil {
+                return config, err
+            }
+        }
+    }
+
+    // each key of the replay lint patterns section is the name of a pattern; with no patterns,
+    // every replay passes
+    replayLintSection := configFile.Section("replay_lint")
+    config.ReplayLintEnabled, err = getBool(replayLintSection, "enabled")
+    if err != nil {
+        return config, err
+    }
+    config.ReplayLintAllowUnscrubbed = replayLintSection.Key("allow_unscrubbed").Strings(",")
+    config.ReplayLintPatterns = make(map[string]string)
+    for _, name := range configFile.Section("replay_lint_patterns").KeyStrings() {
+        config.ReplayLintPatterns[name], err = getString(configFile.Section("replay_lint_patterns"), name)
+        if err != nil {
+            return config, err
+        }
+    }
+
+    replayCacheSection := configFile.Section("replay_cache")
+    config.ReplayCacheMaxMB, err = getInt(replayCacheSection, "max_memory_mb", 0, 1024 * 1024)
+    if err != nil {
+        return config, err
+    }
+
+    config.ReplayCachePreload, err = getBool(replayCacheSection, "preload")
+    if err != nil {
+        return config, err
+    }
+
+    config.ReplayParseBudgetMs, err = getInt(replayCacheSection, "parse_budget_ms", 0, 600000)
+    if err != nil {
+        return config, err
+    }
+
+    config.ReplayFileBudgetMB, err = getInt(replayCacheSection, "file_budget_mb", 0, 1024 * 1024)
+    if err != nil {
+        return config, err
+    }
+
+    config.CalibrationEnabled, err = getBool(configFile.Section("calibration"), "enabled")
+    if err != nil {
+        return config, err
+    }
+
+    sideChannelSection := configFile.Section("side_channel")
+    config.SideChannelReadTimeoutSeconds, err = getInt(sideChannelSection, "read_timeout_seconds", 0, 3600)
+    if err != nil {
+        return config, err
+    }
+
+    config.SideChannelWriteTimeoutSeconds, err = getInt(sideChannelSection, "write_timeout_seconds", 0, 3600)
+    if err != nil {
+        return config, err
+    }
+
+    config.MaxTestSeconds, err = getInt(sideChannelSection, "max_test_seconds", 0, 24 * 3600)
+    if err != nil {
+        return config, err
+    }
+
+    config.SamplesPerReplay, err = getInt(sideChannelSection, "samples_per_replay", 1, 1000)
+    if err != nil {
+        return config, err
+    }
+
+    config.MinSamplesPerReplay, err = getInt(sideChannelSection, "min_samples_per_replay", 2, 1000)
+    if err != nil {
+        return config, err
+    }
+
+    config.MaxSamplesPerReplay, err = getInt(sideChannelSection, "max_samples_per_replay", 2, 1000)
+    if err != nil {
+        return config, err
+    }
+    if config.MinSamplesPerReplay > config.SamplesPerReplay || config.SamplesPerReplay > config.MaxSamplesPerReplay {
+        return config, fmt.Errorf("side_channel.samples_per_replay (%d) must be between side_channel.min_samples_per_replay (%d) and side_channel.max_samples_per_replay (%d)", config.SamplesPerReplay, config.MinSamplesPerReplay, config.MaxSamplesPerReplay)
+    }
+
+    config.MinClientVersion = sideChannelSection.Key("min_client_version").String()
+    if config.MinClientVersion != "" {
+        _, err = compat.ParseVersion(config.MinClientVersion)
+        if err != nil {
+            return config, err
+        }
+    }
+
+    // the gRPC side channel is optional
+    config.GRPCSideChannelAddr = configFile.Section("grpc_side_channel").Key("listen_addr").String()
+
+    // every TLS setting is optional; the Go defaults are used for the ones left empty
+    tlsSection := configFile.Section("tls")
+    if tlsSection.Key("min_version").String() != "" {
+        config.TLSMinVersion, err = getChoice(tlsSection, "min_version", "1.0", "1.1", "1.2", "1.3")
+        if err != nil {
+            return config, err
+        }
+    }
+    config.TLSCipherSuites = tlsSection.Key("cipher_suites").Strings(",")
+    config.TLSClientCAFile = tlsSection.Key("client_ca_file").String()
+    config.TLSRequireClientCert, err = getBool(tlsSection, "require_client_cert")
+    if err != nil {
+        return config, err
+    }
+
+    shutdownSection := configFile.Section("shutdown")
+    config.ShutdownReportDir, err = getString(shutdownSection, "report_dir")
+    if err != nil {
+        return config, err
+    }
+
+    config.ShutdownGoroutineDump, err = getBool(shutdownSection, "goroutine_dump")
+    if err != nil {
+        return config, err
+    }
+
+    config.ShutdownDrainSeconds, err = getInt(shutdownSection, "drain_seconds", 0, 3600)
+    if err != nil {
+        return config, err
+    }
+
+    config.ShutdownGraceSeconds, err = getInt(shutdownSection, "grace_seconds", 0, 300)
+    if err != nil {
+        return config, err
+    }
+
+    errorBudgetSection := configFile.Section("error_budget")
+    config.ErrorBudgetEnabled, err = getBool(errorBudgetSection, "enabled")
+    if err != nil {
+        return config, err
+    }
+
+    config.FailedTestsPerHour, err = getInt(errorBudgetSection, "failed_tests_per_hour", 0, 1000000)
+    if err != nil {
+        return config, err
+    }
+
+    config.PacingViolationsPerHour, err = getInt(errorBudgetSection, "pacing_violations_per_hour", 0, 1000000)
+    if err != nil {
+        return config, err
+    }
+
+    config.CaptureDropsPerHour, err = getInt(errorBudgetSection, "capture_drops_per_hour", 0, 1000000000)
+    if err != nil {
+        return config, err
+    }
+
+    config.PacingToleranceMs, err = getInt(errorBudgetSection, "pacing_tolerance_ms", 1, 60000)
+    if err != nil {
+        return config, err
+    }
+
+    anomalySection := configFile.Section("anomaly")
+    config.AnomalyEnabled, err = getBool(anomalySection, "enabled")
+    if err != nil {
+        return config, err
+    }
+
+    config.AnomalyWindowMinutes, err = getInt(anomalySection, "window_minutes", 1, 7 * 24 * 60)
+    if err != nil {
+        return config, err
+    }
+
+    config.AnomalyMinTests, err = getInt(anomalySection, "min_tests", 1, 100000)
+    if err != nil {
+        return config, err
+    }
+
+    config.AnomalyMinRate, err = getFloat(anomalySection, "min_rate", 0, 1)
+    if err != nil {
+        return config, err
+    }
+
+    config.AnomalyZThreshold, err = getFloat(anomalySection, "z_threshold", 0, 100)
+    if err != nil {
+        return config, err
+    }
+
+    config.AnomalyBaselineRate, err = getFloat(anomalySection, "baseline_rate", 0, 1)
+    if err != nil {
+        return config, err
+    }
+
+    config.AnomalyBaselinesFile = anomalySection.Key("baselines_file").String()
+
+    config.AnomalyCheckIntervalSeconds, err = getInt(anomalySection, "check_interval_seconds", 1, 3600)
+    if err != nil {
+        return config, err
+    }
+
+    // the wait_seconds key of the replay groups section is how long clients wait for their group;
+    // every other key is a group name whose value is a comma separated list of replay names
+    replayGroupsSection := configFile.Section("replay_groups")
+    config.ReplayGroupWaitSeconds, err = getInt(replayGroupsSection, "wait_seconds", 0, 300)
+    if err != nil {
+        return config, err
+    }
+    config.ReplayGroups = make(map[string][]string)
+    for _, group := range replayGroupsSection.KeyStrings() {
+        if group == "wait_seconds" {
+            continue
+        }
+        replayNames := replayGroupsSection.Key(group).Strings(",")
+        if len(replayNames) == 0 {
+            return config, fmt.Errorf("Replay group %s has no replays", group)
+        }
+        config.ReplayGroups[group] = replayNames
+    }
+
+    schedulerSection := configFile.Section("scheduler")
+    config.SchedulerMaxConcurrentReplays, err = getInt(schedulerSection, "max_concurrent_replays", 0, 100000)
+    if err != nil {
+        return config, err
+    }
+
+    config.SchedulerMaxQueueLength, err = getInt(schedulerSection, "max_queue_length", 0, 100000)
+    if err != nil {
+        return config, err
+    }
+
+    config.SchedulerMaxWaitSeconds, err = getInt(schedulerSection, "max_wait_seconds", 0, 300)
+    if err != nil {
+        return config, err
+    }
+
+    fairnessSection := configFile.Section("fairness")
+    config.FairnessPolicy, err = getChoice(fairnessSection, "policy", "first_come", "recent_usage")
+    if err != nil {
+        return config, err
+    }
+
+    config.FairnessContentionThreshold, err = getInt(fairnessSection, "contention_threshold", 0, 100000)
+    if err != nil {
+        return config, err
+    }
+
+    config.FairnessMaxRecentTests, err = getInt(fairnessSection, "max_recent_tests", 1, 100000)
+    if err != nil {
+        return config, err
+    }
+
+    config.FairnessWindowHours, err = getInt(fairnessSection, "window_hours", 1, 24 * 30)
+    if err != nil {
+        return config, err
+    }
+
+    bandwidthSection := configFile.Section("bandwidth")
+    config.BandwidthMonthlyUserCapMB, err = getInt(bandwidthSection, "monthly_user_cap_mb", 0, 1000000)
+    if err != nil {
+        return config, err
+    }
+
+    config.BandwidthUsageFile = bandwidthSection.Key("usage_file").String()
+
+    config.BandwidthProbeKB, err = getInt(bandwidthSection, "probe_kb", 0, 100 * 1024)
+    if err != nil {
+        return config, err
+    }
+
+    config.BandwidthProbeTimeoutMs, err = getInt(bandwidthSection, "probe_timeout_ms", 100, 60000)
+    if err != nil {
+        return config, err
+    }
+
+    config.BandwidthProbePolicy, err = getChoice(bandwidthSection, "probe_policy", "warn", "skip")
+    if err != nil {
+        return config, err
+    }
+
+    resourcesSection := configFile.Section("resources")
+    config.MaxCPUPercent, err = getFloat(resourcesSection, "max_cpu_percent", 0, 100)
+    if err != nil {
+        return config, err
+    }
+
+    config.MaxMemoryPercent, err = getFloat(resourcesSection, "max_memory_percent", 0, 100)
+    if err != nil {
+        return config, err
+    }
+
+    config.MaxDiskPercent, err = getFloat(resourcesSection, "max_disk_percent", 0, 100)
+    if err != nil {
+        return config, err
+    }
+
+    config.MaxUploadMbps, err = getFloat(resourcesSection, "max_upload_mbps", 0, 1000000)
+    if err != nil {
+        return config, err
+    }
+
+    config.ResourceSampleIntervalSeconds, err = getInt(resourcesSection, "sample_interval_seconds", 1, 3600)
+    if err != nil {
+        return config, err
+    }
+
+    config.ResourceAverageWindowSeconds, err = getInt(resourcesSection, "average_window_seconds", config.ResourceSampleIntervalSeconds, 86400)
+    if err != nil {
+        return config, err
+    }
+
+    loggingSection := configFile.Section("logging")
+    config.LogLevel, err = getLogLevel(loggingSection, "level")
+    if err != nil {
+        return config, err
+    }
+
+    config.LogFormat, err = getChoice(loggingSection, "format", "json", "logfmt")
+    if err != nil {
+        return config, err
+    }
+
+    config.LogFile = loggingSection.Key("file").String()
+
+    config.LogMaxSizeMB, err = getInt(loggingSection, "max_size_mb", 1, 10240)
+    if err != nil {
+        return config, err
+    }
+
+    config.LogMaxFiles, err = getInt(loggingSection, "max_files", 0, 100)
+    if err != nil {
+        return config, err
+    }
+
+    // node labels are optional, and only the ones that are set are added to telemetry
+    config.NodeLabels = make(map[string]string)
+    for _, name := range nodeLabelNames {
+        value := strings.TrimSpace(configFile.Section("node").Key(name).String())
+        if value != "" {
+            config.NodeLabels[name] = value
+        }
+    }
+
+    // each [decision_policy.<name>] section defines a policy; the policy key of the analysis section
+    // picks the one that is used
+    config.DecisionPolicies = make(map[string]DecisionPolicy)
+    for _, section := range configFile.Sections() {
+        name, found := strings.CutPrefix(section.Name(), decisionPolicySectionPrefix)
+        if !found {
+            continue
+        }
+        policy, err := getDecisionPolicy(section)
+        if err != nil {
+            return config, fmt.Errorf("%s in %s section", err, section.Name())
+        }
+        config.DecisionPolicies[name] = policy
+    }
+    // each [data_profile.<name>] section defines a profile for the countries it lists; clients of
+    // other countries are stored with the settings of the default section
+    config.DataProfiles = make(map[string]DataProfile)
+    for _, section := range configFile.Sections() {
+        name, found := strings.CutPrefix(section.Name(), dataProfileSectionPrefix)
+        if !found {
+            continue
+        }
+        profile, err := getDataProfile(section)
+        if err != nil {
+            return config, fmt.Errorf("%s in %s section", err, section.Name())
+        }
+        config.DataProfiles[name] = profile
+    }
+
+    policyNames := make([]string, 0, len(config.DecisionPolicies))
+    for name := range config.DecisionPolicies {
+        policyNames = append(policyNames, name)
+    }
+    slices.Sort(policyNames)
+    config.DecisionPolicy, err = getChoice(configFile.Section("analysis"), "policy", policyNames...)
+    if err != nil {
+        return config, err
+    }
+
+    config.KSTest, err = getChoice(configFile.Section("analysis"), "ks_test", "native", "scipy")
+    if err != nil {
+        return config, err
+    }
+
+    config.MinThroughputSamples, err = getInt(configFile.Section("analysis"), "min_throughput_samples", 0, 1000)
+    if err != nil {
+        return config, err
+    }
+
+    // capturing the packets of replays is optional
+    config.LossCaptureInterface = configFile.Section("analysis").Key("loss_capture_interface").String()
+
     return config, nil
 }
 
+// Gets the thresholds of a decision policy from the config file.
+// section: the [decision_policy.<name>] section of the ini file
+// Returns the decision policy or an error
+func getDecisionPolicy(section *ini.Section) (DecisionPolicy, error) {
+    policy := DecisionPolicy{}
+    var err error
+
+    policy.Alpha, err = getFloat(section, "alpha", 0, 1)
+    if err != nil {
+        return policy, err
+    }
+
+    policy.AreaThreshold, err = getFloat(section, "area_threshold", 0, 1)
+    if err != nil {
+        return policy, err
+    }
+
+    policy.KS2pValThreshold, err = getFloat(section, "ks2_pval_threshold", 0, 1)
+    if err != nil {
+        return policy, err
+    }
+
+    policy.AcceptRatioThreshold, err = getFloat(section, "accept_ratio_threshold", 0, 1)
+    if err != nil {
+        return policy, err
+    }
+
+    policy.Resamples, err = getInt(section, "resamples", 1, 10000)
+    if err != nil {
+        return policy, err
+    }
+
+    policy.Verdict, err = getChoice(section, "verdict", "all", "ks")
+    if err != nil {
+        return policy, err
+    }
+    return policy, nil
+}
+
+// Gets what is stored about the tests of a data-handling profile from the config file.
+// section: the [data_profile.<name>] section of the ini file
+// Returns the data profile or an error
+func getDataProfile(section *ini.Section) (DataProfile, error) {
+    profile := DataProfile{}
+    var err error
+
+    profile.Countries = section.Key("countries").Strings(",")
+    if len(profile.Countries) == 0 {
+        return profile, fmt.Errorf("No value read from countries key")
+    }
+
+    profile.Location, err = getChoice(section, "location", "full", "city", "country", "none")
+    if err != nil {
+        return profile, err
+    }
+
+    profile.AnonIPv4PrefixLen, err = getInt(section, "anon_ipv4_prefix_len", 0, 32)
+    if err != nil {
+        return profile, err
+    }
+
+    profile.AnonIPv6PrefixLen, err = getInt(section, "anon_ipv6_prefix_len", 0, 128)
+    if err != nil {
+        return profile, err
+    }
+
+    profile.SideChannelRTTs, err = getBool(section, "side_channel_rtts")
+    if err != nil {
+        return profile, err
+    }
+    return profile, nil
+}
+
 // Gets a string from the config file.
 // section: the section of the ini file that contains the key
 // keyStr: the key
@@ -126,10 +1021,29 @@ func getLogLevel(section *ini.Section, keyStr string) (int, error) {
     case "debug":
         return 5, nil
     default:
-        return -1, fmt.Errorf("%s is not a log level. Choose from ui, wtf, error, warn, info, or debug.", val)
+        return -1, fmt.Errorf("%s is not a log level. Choose from wtf, error, warn, info, or debug.", val)
     }
 }
 
+// Gets a string from the config file that must be one of a fixed set of values.
+// section: the section of the ini file that contains the key
+// keyStr: the key
+// choices: the values that are allowed
+// Returns the value of the key or an error
+func getChoice(section *ini.Section, keyStr string, choices ...string) (string, error) {
+    val, err := getString(section, keyStr)
+    if err != nil {
+        return "", err
+    }
+
+    for _, choice := range choices {
+        if val == choice {
+            return val, nil
+        }
+    }
+    return "", fmt.Errorf("%s is not a valid value for %s. Choose from %s.", val, keyStr, strings.Join(choices, ", "))
+}
+
 // Gets an integer from the config file.
 // section: the section of the ini file that contains the key
 // keyStr: the key
@@ -151,6 +1065,27 @@ func getInt(section *ini.Section, keyStr string, low int, high int) (int, error)
     return val, nil
 }
 
+// Gets a floating point number from the config file.
+// section: the section of the ini file that contains the key
+// keyStr: the key
+// low: the lower bounds (inclusive) that the value should not go below
+// high: the upper bounds (inclusive) that the value should not go above
+// Returns the value or an error
+func getFloat(section *ini.Section, keyStr string, low float64, high float64) (float64, error) {
+    key, err := section.GetKey(keyStr)
+    if err != nil {
+        return -1, err
+    }
+    val, err := key.Float64()
+    if err != nil {
+        return -1, fmt.Errorf("%s in %s key", err, keyStr)
+    }
+    if val < low || val > high {
+        return -1, fmt.Errorf("%v is not a valid number for %s. Must be between %v and %v inclusive.", val, keyStr, low, high)
+    }
+    return val, nil
+}
+
 // Gets a boolean from the config file.
 // section: the section of the ini file that contains the key
 // keyStr: the key
@@ -0,0 +1,130 @@
+// A small web dashboard for operators of standalone deployments, served on the admin port. The
+// page and its scripts are embedded in the binary and contain no data; the page asks for a
+// read-only admin token and uses it to poll the data endpoint for the live connections, recent
+// tests, verdict ratios, and the health of the server.
+package dashboard
+
+import (
+    "embed"
+    "encoding/json"
+    "fmt"
+    "io/fs"
+    "net/http"
+    "sync"
+    "time"
+
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/report"
+)
+
+const (
+    healthSampleInterval = time.Minute // how often the health of the server is sampled for the graphs
+    maxHealthSamples = 24 * 60 // number of health samples kept; one day at one sample per minute
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+// The health of the server at one point in time.
+type healthSample struct {
+    Time time.Time `json:"time"` // when the sample was taken
+    Health report.NodeHealth `json:"health"` // the health of the server
+}
+
+// Everything shown on the dashboard.
+type data struct {
+    Time time.Time `json:"time"` // when the data was gathered
+    Connections []clienthandler.ConnectedClientInfo `json:"connections"` // clients running a replay
+    RecentTests []report.TestRecord `json:"recent_tests"` // the most recent tests, newest first; empty if tests aren't recorded
+    Today report.Counts `json:"today"` // outcomes of the tests that finished today (UTC)
+    Health []healthSample `json:"health"` // health of the server over time, oldest first
+}
+
+// Gathers the data shown on the dashboard.
+type Dashboard struct {
+    connectedClients *clienthandler.ConnectedClients // the clients running a replay
+    reporter *report.Reporter // the recorder of finished tests; nil if tests aren't recorded
+    healthDir string // a directory on the disk whose usage is shown
+    healthMutex sync.Mutex // prevents multiple goroutines from accessing health
+    health []healthSample // health of the server over time, oldest first
+}
+
+// Creates a new Dashboard.
+// connectedClients: the clients running a replay
+// reporter: the recorder of finished tests; nil if tests aren't recorded
+// healthDir: a directory on the disk whose usage is shown, e.g. the results directory
+// Returns the dashboard
+func New(connectedClients *clienthandler.ConnectedClients, reporter *report.Reporter, healthDir string) *Dashboard {
+    return &Dashboard{
+        connectedClients: connectedClients,
+        reporter: reporter,
+        healthDir: healthDir,
+    }
+}
+
+// Samples the health of the server every minute for the graphs. Does not return.
+func (dashboard *Dashboard) SampleHealth() {
+    for {
+        sample := healthSample{
+            Time: time.Now().UTC(),
+            Health: report.CurrentHealth(dashboard.healthDir),
+        }
+        dashboard.healthMutex.Lock()
+        dashboard.health = append(dashboard.health, sample)
+        if len(dashboard.health) > maxHealthSamples {
+            dashboard.health = dashboard.health[len(dashboard.health) - maxHealthSamples:]
+        }
+        dashboard.healthMutex.Unlock()
+        time.Sleep(healthSampleInterval)
+    }
+}
+
+// Gathers the current data of the dashboard.
+// Returns the data
+func (dashboard *Dashboard) gather() data {
+    current := data{
+        Time: time.Now().UTC(),
+        Connections: dashboard.connectedClients.List(),
+        RecentTests: []report.TestRecord{},
+    }
+    if dashboard.reporter != nil {
+        current.RecentTests, current.Today = dashboard.reporter.Recent()
+    }
+    dashboard.healthMutex.Lock()
+    current.Health = append([]healthSample{}, dashboard.health...)
+    dashboard.healthMutex.Unlock()
+    return current
+}
+
+// Gets the handler of the data endpoint, which responds with the current data as JSON. The handler
+// should only be served behind a read-only token.
+// Returns the handler
+func (dashboard *Dashboard) DataHandler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+            return
+        }
+        jsonData, err := json.Marshal(dashboard.gather())
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Cache-Control", "no-store")
+        w.Write(jsonData)
+    })
+}
+
+// Gets the handler of the page and its scripts. The files contain no data, so they can be served
+// without a token.
+// prefix: the path the files are served under, e.g. /dashboard/
+// Returns the handler
+func StaticHandler(prefix string) http.Handler {
+    static, err := fs.Sub(staticFiles, "static")
+    if err != nil {
+        // the files are embedded at build time, so this can only happen if the embed is broken
+        panic(fmt.Sprintf("Dashboard files are missing: %v", err))
+    }
+    return http.StripPrefix(prefix, http.FileServer(http.FS(static)))
+}
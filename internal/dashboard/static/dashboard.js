@@ -0,0 +1,152 @@
+// Polls the data endpoint of the dashboard with a read-only admin token and renders the data.
+(function() {
+    "use strict";
+
+    var refreshInterval = 10000; // milliseconds between updates
+    var tokenKey = "weheAdminToken"; // where the token is kept for the browser session
+    var verdicts = ["differentiation", "no_differentiation", "incomplete", "failed"];
+    var timer = null;
+
+    function $(id) {
+        return document.getElementById(id);
+    }
+
+    // Creates a table row with a cell for each value.
+    function row(values) {
+        var tr = document.createElement("tr");
+        values.forEach(function(value) {
+            var td = document.createElement("td");
+            td.textContent = value;
+            tr.appendChild(td);
+        });
+        return tr;
+    }
+
+    function formatTime(time) {
+        return new Date(time).toLocaleTimeString();
+    }
+
+    function formatBytes(bytes) {
+        var units = ["B", "KB", "MB", "GB"];
+        var i = 0;
+        while (bytes >= 1000 && i < units.length - 1) {
+            bytes /= 1000;
+            i++;
+        }
+        return bytes.toFixed(i === 0 ? 0 : 1) + " " + units[i];
+    }
+
+    function renderVerdicts(today) {
+        var bar = $("verdicts");
+        var legend = $("verdict-legend");
+        bar.textContent = "";
+        legend.textContent = today.tests + " tests";
+        verdicts.forEach(function(verdict) {
+            var count = today[verdict] || 0;
+            if (today.tests > 0 && count > 0) {
+                var part = document.createElement("div");
+                part.className = verdict;
+                part.style.width = (100 * count / today.tests) + "%";
+                part.title = verdict.replace("_", " ") + ": " + count;
+                bar.appendChild(part);
+            }
+            var swatch = document.createElement("span");
+            swatch.className = "legend " + verdict;
+            legend.appendChild(swatch);
+            legend.appendChild(document.createTextNode(verdict.replace("_", " ") + ": " + count));
+        });
+    }
+
+    function renderTable(id, rows) {
+        var body = $(id);
+        body.textContent = "";
+        rows.forEach(function(values) {
+            body.appendChild(row(values));
+        });
+    }
+
+    // Draws a line graph of values scaled between 0 and max.
+    function renderGraph(name, values, max, format) {
+        var svg = $("graph-" + name);
+        svg.textContent = "";
+        $("value-" + name).textContent = values.length ? format(values[values.length - 1]) : "";
+        if (values.length < 2) {
+            return;
+        }
+        max = Math.max(max, Math.max.apply(null, values));
+        var points = values.map(function(value, i) {
+            var x = 300 * i / (values.length - 1);
+            var y = 100 - (max > 0 ? 100 * value / max : 0);
+            return x.toFixed(1) + "," + y.toFixed(1);
+        });
+        var line = document.createElementNS("http://www.w3.org/2000/svg", "polyline");
+        line.setAttribute("points", points.join(" "));
+        svg.appendChild(line);
+    }
+
+    function render(data) {
+        $("updated").textContent = "Updated " + formatTime(data.time);
+        renderVerdicts(data.today);
+
+        $("connection-count").textContent = data.connections.length;
+        renderTable("connections", data.connections.map(function(c) {
+            return [c.ip, c.replay_name, formatTime(c.connected_since), formatBytes(c.bytes_sent)];
+        }));
+        renderTable("recent-tests", data.recent_tests.map(function(t) {
+            return [formatTime(t.time), t.app, t.carrier, t.city, t.client_version, t.verdict.replace("_", " ")];
+        }));
+
+        var health = data.health.map(function(sample) { return sample.health; });
+        renderGraph("load", health.map(function(h) { return h.load1; }), 1, function(v) { return v.toFixed(2); });
+        renderGraph("memory", health.map(function(h) { return h.memory_used_percent; }), 100, function(v) { return v.toFixed(1) + "%"; });
+        renderGraph("disk", health.map(function(h) { return h.disk_used_percent; }), 100, function(v) { return v.toFixed(1) + "%"; });
+    }
+
+    function showLogin(message) {
+        clearTimeout(timer);
+        $("dashboard").hidden = true;
+        $("logout").hidden = true;
+        $("login").hidden = false;
+        $("login-error").textContent = message || "";
+    }
+
+    function refresh() {
+        var token = sessionStorage.getItem(tokenKey);
+        if (!token) {
+            showLogin();
+            return;
+        }
+        fetch("data", {headers: {"Authorization": "Bearer " + token}}).then(function(response) {
+            if (response.status === 401 || response.status === 403) {
+                sessionStorage.removeItem(tokenKey);
+                showLogin("The token was not accepted.");
+                return;
+            }
+            if (!response.ok) {
+                throw new Error(response.statusText);
+            }
+            return response.json().then(function(data) {
+                $("login").hidden = true;
+                $("dashboard").hidden = false;
+                $("logout").hidden = false;
+                render(data);
+                timer = setTimeout(refresh, refreshInterval);
+            });
+        }).catch(function(err) {
+            $("updated").textContent = "Update failed: " + err.message;
+            timer = setTimeout(refresh, refreshInterval);
+        });
+    }
+
+    $("login").addEventListener("submit", function(event) {
+        event.preventDefault();
+        sessionStorage.setItem(tokenKey, $("token").value);
+        $("token").value = "";
+        refresh();
+    });
+    $("logout").addEventListener("click", function() {
+        sessionStorage.removeItem(tokenKey);
+        showLogin();
+    });
+    refresh();
+})();
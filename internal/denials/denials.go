@@ -0,0 +1,170 @@
+// Records the tests that were denied permission to run. Each denial is appended as one JSON object
+// per line to a log file that is rotated when it gets too big, so that maintainers can tell whether
+// clients are turned away because the server is at capacity or because of client bugs, such as
+// clients asking for replays that don't exist.
+package denials
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "os"
+    "sync"
+    "time"
+
+    "wehe-server/internal/logging"
+)
+
+// The reason a test was denied permission to run
+type Reason string
+
+const (
+    UnknownReplay Reason = "unknown_replay" // the replay is not on the server
+    DuplicateTest Reason = "duplicate_test" // results already exist for the test and duplicates are rejected
+    IPInUse Reason = "ip_in_use" // another client on the same IP is running a replay
+    LowResources Reason = "low_resources" // the server is overloaded
+    ResourceRetrievalFail Reason = "resource_retrieval_fail" // the server load could not be retrieved
+    ReplayGroupBusy Reason = "replay_group_busy" // another replay in the same replay group ran for too long
+    OverErrorBudget Reason = "over_error_budget" // the server has had too many failures in the last hour to be trusted
+    Maintenance Reason = "maintenance" // the server is in a maintenance window
+    FairShare Reason = "fair_share" // the server is busy and the user has run many tests recently
+    ShuttingDown Reason = "shutting_down" // the server is exiting and waiting for the running tests to finish
+    BandwidthCap Reason = "bandwidth_cap" // the user has been sent its monthly cap of bytes
+    ServerBusy Reason = "server_busy" // every replay slot was taken and the queue was full or the client waited too long
+    LinkTooSlow Reason = "link_too_slow" // a bandwidth probe found the link of the client too slow for the replay
+    PortDisabled Reason = "port_disabled" // an operator disabled a port the replay runs on
+)
+
+// A test that was denied permission to run.
+type Denial struct {
+    Time time.Time `json:"time"` // when permission was denied
+    TestStartTime time.Time `json:"test_start_time"` // when the client connected to the side channel
+    Reason Reason `json:"reason"` // why permission was denied
+    ReplayName string `json:"replay_name"` // the replay the client asked to run
+    ClientIP string `json:"client_ip"` // the anonymized public IP of the client
+    ClientVersion string `json:"client_version"` // the version of the Wehe client
+    Details string `json:"details,omitempty"` // extra information, e.g. which resource is overloaded
+}
+
+// Counts of denials over a period of time.
+type Summary struct {
+    Total int `json:"total"` // number of denials
+    First time.Time `json:"first"` // time of the earliest denial
+    Last time.Time `json:"last"` // time of the latest denial
+    ByReason map[Reason]int `json:"by_reason"` // number of denials for each reason
+    ByReplay map[string]map[Reason]int `json:"by_replay"` // number of denials for each replay, then for each reason
+}
+
+// A rotating log of denials. The current log file is filename; when it grows past maxBytes, it is
+// rotated like the server log, keeping at most maxFiles old files.
+type Log struct {
+    file *logging.RotatingFile // the log file and its rotated files
+    mutex sync.Mutex // prevents denials from being recorded while the log is summarized
+}
+
+// Creates a new Log, appending to the log file if it already exists.
+// filename: path of the log file; missing directories are created
+// maxBytes: size in bytes the log file can grow to before it is rotated
+// maxFiles: number of rotated log files to keep
+// Returns the log or any errors
+func New(filename string, maxBytes int64, maxFiles int) (*Log, error) {
+    if maxBytes <= 0 {
+        return nil, fmt.Errorf("Denial log size must be positive; got %d", maxBytes)
+    }
+    if maxFiles < 0 {
+        return nil, fmt.Errorf("Number of rotated denial logs cannot be negative; got %d", maxFiles)
+    }
+    file, err := logging.NewRotatingFile(filename, maxBytes, maxFiles)
+    if err != nil {
+        return nil, err
+    }
+    return &Log{file: file}, nil
+}
+
+// Appends a denial to the log, rotating the log first if it is full. If the log can't be rotated,
+// the denial is still appended to the current log file.
+// denial: the denial to record
+// Returns any errors
+func (log *Log) Record(denial Denial) error {
+    line, err := json.Marshal(denial)
+    if err != nil {
+        return err
+    }
+    line = append(line, '\n')
+
+    log.mutex.Lock()
+    defer log.mutex.Unlock()
+    _, err = log.file.Write(line)
+    return err
+}
+
+// Summarizes the denials recorded during a period of time, including denials in the rotated log
+// files.
+// since: only denials at or after this time are counted; the zero time counts all denials
+// until: only denials before this time are counted; the zero time counts denials up to now
+// Returns the summary or any errors
+func (log *Log) Summary(since time.Time, until time.Time) (Summary, error) {
+    summary := Summary{
+        ByReason: make(map[Reason]int),
+        ByReplay: make(map[string]map[Reason]int),
+    }
+
+    log.mutex.Lock()
+    defer log.mutex.Unlock()
+    for _, filename := range log.file.Filenames() {
+        err := summarizeFile(filename, since, until, &summary)
+        if err != nil {
+            return Summary{}, err
+        }
+    }
+    return summary, nil
+}
+
+// Adds the denials in a log file to a summary. Lines that can't be parsed, such as a line cut off
+// by a crash, are skipped.
+// filename: the log file to read
+// since: only denials at or after this time are counted
+// until: only denials before this time are counted, unless it is the zero time
+// summary: the summary to add the denials to
+// Returns any errors
+func summarizeFile(filename string, since time.Time, until time.Time, summary *Summary) error {
+    file, err := os.Open(filename)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil
+        }
+        return err
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        var denial Denial
+        err = json.Unmarshal(scanner.Bytes(), &denial)
+        if err != nil || denial.Time.Before(since) || (!until.IsZero() && !denial.Time.Before(until)) {
+            continue
+        }
+        summary.Total++
+        if summary.First.IsZero() || denial.Time.Before(summary.First) {
+            summary.First = denial.Time
+        }
+        if denial.Time.After(summary.Last) {
+            summary.Last = denial.Time
+        }
+        summary.ByReason[denial.Reason]++
+        _, exists := summary.ByReplay[denial.ReplayName]
+        if !exists {
+            summary.ByReplay[denial.ReplayName] = make(map[Reason]int)
+        }
+        summary.ByReplay[denial.ReplayName][denial.Reason]++
+    }
+    return scanner.Err()
+}
+
+// Closes the log file.
+// Returns any errors
+func (log *Log) Close() error {
+    log.mutex.Lock()
+    defer log.mutex.Unlock()
+    return log.file.Close()
+}
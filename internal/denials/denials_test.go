@@ -0,0 +1,69 @@
+// Tests of the denial log, which must keep recording denials when it can't be rotated.
+package denials
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// Blocks the rotation of a denial log with a directory where the rotated file goes, and checks that
+// denials are still recorded, and that the log rotates once the directory is gone.
+func TestRecordAfterFailedRotation(t *testing.T) {
+    filename := filepath.Join(t.TempDir(), "denials.log")
+    log, err := New(filename, 200, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer log.Close()
+    // a file can't be renamed over a directory that isn't empty
+    err = os.MkdirAll(filepath.Join(filename + ".1", "blocked"), 0755)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    denial := Denial{
+        Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+        Reason: IPInUse,
+        ReplayName: "Youtube_12122018",
+        ClientIP: "192.0.2.0",
+    }
+    for i := 0; i < 5; i++ {
+        err = log.Record(denial)
+        if err != nil {
+            t.Fatalf("Record() %d returned %v", i, err)
+        }
+    }
+    summary := Summary{
+        ByReason: make(map[Reason]int),
+        ByReplay: make(map[string]map[Reason]int),
+    }
+    err = summarizeFile(filename, time.Time{}, time.Time{}, &summary)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if summary.Total != 5 {
+        t.Errorf("Log file holds %d denials after rotation failed; want 5", summary.Total)
+    }
+
+    err = os.RemoveAll(filename + ".1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = log.Record(denial)
+    if err != nil {
+        t.Fatalf("Record() after the rotation was unblocked returned %v", err)
+    }
+    info, err := os.Stat(filename + ".1")
+    if err != nil || !info.Mode().IsRegular() {
+        t.Fatalf("Log wasn't rotated once the rotation was unblocked: %v", err)
+    }
+    summary, err = log.Summary(time.Time{}, time.Time{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if summary.Total != 6 {
+        t.Errorf("Summary() counted %d denials after rotating; want 6", summary.Total)
+    }
+}
@@ -0,0 +1,119 @@
+// Normalizes the free-form device model strings sent by clients, e.g. "SM-G991B" and "Galaxy S21"
+// are both normalized to "Samsung Galaxy S21", so that results can be aggregated by device. The
+// mapping is read from a data file that ships with the server and is reloaded automatically when
+// the file changes, so new devices can be added without restarting the server.
+package devices
+
+import (
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    deviceModelsPath = "res/devices/deviceModels.json"
+    reloadCheckInterval = time.Minute // how often the data file is checked for changes
+)
+
+var (
+    models map[string]string // map of lowercase raw model strings to normalized model names
+    modTime time.Time // modification time of the data file when it was last loaded
+    lastCheck time.Time // time the data file was last checked for changes
+    mutex sync.RWMutex // prevents the mapping from being read while it is reloaded
+)
+
+// Loads the device model mapping from the data file. This should be run once before any clients
+// connect.
+// Returns any errors
+func Init() error {
+    return Reload()
+}
+
+// Reloads the device model mapping from the data file. The data file maps each normalized model
+// name to the raw model strings that clients send for it; matching ignores case and surrounding
+// whitespace. If the file can't be loaded, the previous mapping is kept.
+// Returns any errors
+func Reload() error {
+    info, err := os.Stat(deviceModelsPath)
+    if err != nil {
+        return err
+    }
+    data, err := os.ReadFile(deviceModelsPath)
+    if err != nil {
+        return err
+    }
+
+    var aliases map[string][]string
+    err = json.Unmarshal(data, &aliases)
+    if err != nil {
+        return fmt.Errorf("Unable to parse %s: %v", deviceModelsPath, err)
+    }
+
+    newModels := make(map[string]string)
+    for normalized, rawModels := range aliases {
+        // the normalized name is an alias of itself so that clients already sending it match
+        for _, raw := range append(rawModels, normalized) {
+            key := normalizeKey(raw)
+            existing, exists := newModels[key]
+            if exists && existing != normalized {
+                return fmt.Errorf("%s in %s maps to both %s and %s", raw, deviceModelsPath, existing, normalized)
+            }
+            newModels[key] = normalized
+        }
+    }
+
+    mutex.Lock()
+    defer mutex.Unlock()
+    models = newModels
+    modTime = info.ModTime()
+    lastCheck = time.Now()
+    return nil
+}
+
+// Reloads the mapping if the data file has changed since it was loaded. The file is checked at most
+// once per reloadCheckInterval.
+func reloadIfChanged() {
+    mutex.Lock()
+    if time.Since(lastCheck) < reloadCheckInterval {
+        mutex.Unlock()
+        return
+    }
+    lastCheck = time.Now()
+    loadedModTime := modTime
+    mutex.Unlock()
+
+    info, err := os.Stat(deviceModelsPath)
+    if err != nil || info.ModTime().Equal(loadedModTime) {
+        return
+    }
+    err = Reload()
+    if err != nil {
+        slog.Error("Unable to reload device models", "error", err)
+    }
+}
+
+// Gets the normalized name of a device model.
+// raw: the device model sent by the client
+// Returns the normalized model name, or the trimmed raw model if the model is not in the mapping
+func Normalize(raw string) string {
+    reloadIfChanged()
+
+    mutex.RLock()
+    defer mutex.RUnlock()
+    normalized, exists := models[normalizeKey(raw)]
+    if exists {
+        return normalized
+    }
+    return strings.TrimSpace(raw)
+}
+
+// Gets the key used to look up a model in the mapping.
+// raw: the device model
+// Returns the lowercase model without surrounding whitespace
+func normalizeKey(raw string) string {
+    return strings.ToLower(strings.TrimSpace(raw))
+}
@@ -0,0 +1,236 @@
+// Tracks how often the server fails at its job, e.g. tests that end in errors or replays that can't
+// be sent on schedule, against hourly budgets. A node over budget is producing measurements that
+// can't be trusted, so it marks itself unhealthy and stops admitting tests until the rates recover.
+package errorbudget
+
+import (
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+
+    "wehe-server/internal/clock"
+)
+
+const (
+    Window = time.Hour // the period the budgets are for; events older than this no longer count
+)
+
+type Kind string // a kind of event that counts against a budget
+
+const (
+    FailedTests Kind = "failed_tests" // tests that ended because of an error
+    PacingViolations Kind = "pacing_violations" // replays that had a packet sent later than its schedule allows
+    CaptureDrops Kind = "capture_drops" // packets the kernel dropped from a packet capture
+)
+
+var (
+    defaultTracker *Tracker // the tracker used by the package functions; nil if budgets aren't tracked
+    defaultTrackerMutex sync.Mutex // prevents multiple goroutines from accessing defaultTracker
+)
+
+// A number of events that happened at the same time.
+type event struct {
+    time time.Time // when the events happened
+    count int // number of events
+}
+
+// Counts events against hourly budgets. A kind of event goes over budget once it happens more than
+// its budget within the last hour, and only comes back within budget once the count falls to half
+// the budget, so that a node near its budget doesn't flap between healthy and unhealthy.
+type Tracker struct {
+    budgets map[Kind]int // the most events of each kind allowed per hour; kinds without a budget are not limited
+    pacingTolerance time.Duration // how late a replay packet can be sent before it is a pacing violation
+    clk clock.Clock // the time source for event times
+    mutex sync.Mutex // prevents multiple goroutines from accessing events and exceeded
+    events map[Kind][]event // the events of each kind in the last hour, oldest first
+    exceeded map[Kind]bool // kinds that are over budget
+}
+
+// The state of the budgets, as shown to operators.
+type Status struct {
+    Healthy bool `json:"healthy"` // true if every kind is within budget
+    Exceeded []Kind `json:"exceeded"` // the kinds that are over budget, sorted
+    Counts map[Kind]int `json:"counts"` // the number of events of each kind in the last hour
+    Budgets map[Kind]int `json:"budgets"` // the budget of each kind
+}
+
+// Creates a new Tracker.
+// budgets: the most events of each kind allowed per hour; kinds that aren't in the map, or have a
+//     budget of 0 or less, are not limited
+// pacingTolerance: how late a replay packet can be sent before it is a pacing violation
+// clk: the time source for event times
+// Returns the tracker
+func New(budgets map[Kind]int, pacingTolerance time.Duration, clk clock.Clock) *Tracker {
+    tracker := &Tracker{
+        budgets: make(map[Kind]int),
+        pacingTolerance: pacingTolerance,
+        clk: clk,
+        events: make(map[Kind][]event),
+        exceeded: make(map[Kind]bool),
+    }
+    for kind, budget := range budgets {
+        if budget > 0 {
+            tracker.budgets[kind] = budget
+        }
+    }
+    return tracker
+}
+
+// Sets the tracker used by the package functions.
+// tracker: the tracker; nil to stop tracking budgets
+func SetTracker(tracker *Tracker) {
+    defaultTrackerMutex.Lock()
+    defer defaultTrackerMutex.Unlock()
+    defaultTracker = tracker
+}
+
+// Gets the tracker used by the package functions.
+// Returns the tracker or nil if budgets aren't tracked
+func getTracker() *Tracker {
+    defaultTrackerMutex.Lock()
+    defer defaultTrackerMutex.Unlock()
+    return defaultTracker
+}
+
+// Records events with the tracker set by SetTracker. Does nothing if no tracker is set.
+// kind: the kind of the events
+// count: the number of events
+func Record(kind Kind, count int) {
+    tracker := getTracker()
+    if tracker != nil {
+        tracker.Record(kind, count)
+    }
+}
+
+// Checks if the node is within every budget of the tracker set by SetTracker.
+// Returns true if it is or if no tracker is set
+func Healthy() bool {
+    tracker := getTracker()
+    return tracker == nil || tracker.Healthy()
+}
+
+// Checks if a replay packet was sent late enough to be a pacing violation with the tolerance of the
+// tracker set by SetTracker.
+// lateBy: how long after its scheduled time the packet was sent
+// Returns true if the packet was too late; false if it wasn't or if no tracker is set
+func IsPacingViolation(lateBy time.Duration) bool {
+    tracker := getTracker()
+    return tracker != nil && lateBy > tracker.pacingTolerance
+}
+
+// Records events.
+// kind: the kind of the events
+// count: the number of events
+func (tracker *Tracker) Record(kind Kind, count int) {
+    if count <= 0 {
+        return
+    }
+    tracker.mutex.Lock()
+    defer tracker.mutex.Unlock()
+    tracker.events[kind] = append(tracker.events[kind], event{
+        time: tracker.clk.Now(),
+        count: count,
+    })
+    tracker.update()
+}
+
+// Checks if the node is within every budget.
+// Returns true if no kind is over budget
+func (tracker *Tracker) Healthy() bool {
+    tracker.mutex.Lock()
+    defer tracker.mutex.Unlock()
+    tracker.update()
+    return len(tracker.exceeded) == 0
+}
+
+// Drops events older than the window and updates which kinds are over budget. Must be called with
+// the mutex held.
+func (tracker *Tracker) update() {
+    cutoff := tracker.clk.Now().Add(-Window)
+    for kind, events := range tracker.events {
+        i := 0
+        for i < len(events) && !events[i].time.After(cutoff) {
+            i++
+        }
+        tracker.events[kind] = events[i:]
+    }
+
+    for kind, budget := range tracker.budgets {
+        count := tracker.count(kind)
+        if !tracker.exceeded[kind] && count > budget {
+            tracker.exceeded[kind] = true
+            slog.Error("Error budget exceeded; not admitting new tests", "kind", kind, "count", count, "window", Window, "budget", budget)
+        } else if tracker.exceeded[kind] && count <= budget / 2 {
+            delete(tracker.exceeded, kind)
+            slog.Info("Error budget recovered", "kind", kind, "count", count, "window", Window, "budget", budget)
+        }
+    }
+}
+
+// Counts the events of a kind in the window. Must be called with the mutex held.
+// kind: the kind of the events
+// Returns the number of events
+func (tracker *Tracker) count(kind Kind) int {
+    total := 0
+    for _, e := range tracker.events[kind] {
+        total += e.count
+    }
+    return total
+}
+
+// Gets the state of the budgets.
+// Returns the status of the budgets
+func (tracker *Tracker) Status() Status {
+    tracker.mutex.Lock()
+    defer tracker.mutex.Unlock()
+    tracker.update()
+    status := Status{
+        Healthy: len(tracker.exceeded) == 0,
+        Exceeded: []Kind{},
+        Counts: make(map[Kind]int),
+        Budgets: make(map[Kind]int),
+    }
+    for _, kind := range []Kind{FailedTests, PacingViolations, CaptureDrops} {
+        status.Counts[kind] = tracker.count(kind)
+    }
+    for kind, budget := range tracker.budgets {
+        status.Budgets[kind] = budget
+    }
+    for kind := range tracker.exceeded {
+        status.Exceeded = append(status.Exceeded, kind)
+    }
+    sort.Slice(status.Exceeded, func(i, j int) bool {
+        return status.Exceeded[i] < status.Exceeded[j]
+    })
+    return status
+}
+
+// Serves the readiness of the node: 200 if it is within every budget and is admitting tests, or 503
+// if it isn't. The body lists the kinds that are over budget, and nothing about clients, so load
+// balancers and health checkers can call it without a token.
+// Returns the handler
+func (tracker *Tracker) ReadinessHandler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+            return
+        }
+        status := tracker.Status()
+        jsonResponse, err := json.Marshal(struct {
+            Ready bool `json:"ready"`
+            Exceeded []Kind `json:"exceeded"`
+        }{status.Healthy, status.Exceeded})
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        if !status.Healthy {
+            w.WriteHeader(http.StatusServiceUnavailable)
+        }
+        w.Write(jsonResponse)
+    })
+}
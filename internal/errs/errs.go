@@ -0,0 +1,75 @@
+// Kinds of errors shared by the side channels, the replay servers, and the analysis. Errors wrap the
+// kind they belong to, so that callers can branch on it with errors.Is instead of matching error
+// messages, and so that the side channels can map each kind to the response code the client gets.
+package errs
+
+import (
+    "errors"
+    "fmt"
+)
+
+var (
+    ErrMalformedMessage = errors.New("Malformed message") // a message from the client couldn't be parsed
+    ErrMessageTooLarge = errors.New("Message too large") // a message from the client is longer than its opcode allows
+    ErrTooManySamples = errors.New("Too many throughput samples") // an array of throughputs or sample times is longer than a replay can have
+    ErrUnknownReplay = errors.New("Unknown replay") // the replay the client asked for isn't on the server
+    ErrPermissionDenied = errors.New("Permission denied") // the client asked for something it wasn't given permission for
+    ErrClientTooOld = errors.New("Client too old") // the client is older than the oldest supported version
+    ErrNoTest = errors.New("No test") // the request needs a test that was never declared or has ended
+    ErrNotEnoughData = errors.New("Not enough data") // the test doesn't have the replays or samples needed to analyze it
+    ErrClientGone = errors.New("Client disconnected") // the client closed its connection
+    ErrTimedOut = errors.New("Client timed out") // the client didn't respond in time
+)
+
+// every kind of error, in the order Kind checks them
+var kinds = []error{
+    ErrMessageTooLarge,
+    ErrTooManySamples,
+    ErrMalformedMessage,
+    ErrUnknownReplay,
+    ErrPermissionDenied,
+    ErrClientTooOld,
+    ErrNoTest,
+    ErrNotEnoughData,
+    ErrClientGone,
+    ErrTimedOut,
+}
+
+// An error caused by the client going over a limit, such as the size of a message or the number of
+// samples in a replay. The limit is sent back to the client so that it can tell what to cut.
+type LimitError struct {
+    Kind error // the kind of the error, ErrMessageTooLarge or ErrTooManySamples
+    Limit int // the limit the client went over
+    Message string // what went over the limit
+}
+
+func (err *LimitError) Error() string {
+    return fmt.Sprintf("%v: %s", err.Kind, err.Message)
+}
+
+func (err *LimitError) Unwrap() error {
+    return err.Kind
+}
+
+// Gets the kind of an error.
+// err: the error
+// Returns the kind the error wraps, or nil if it doesn't wrap one
+func Kind(err error) error {
+    for _, kind := range kinds {
+        if errors.Is(err, kind) {
+            return kind
+        }
+    }
+    return nil
+}
+
+// Marks an error caused by a message from the client that couldn't be parsed. Errors that already
+// have a kind keep it.
+// err: the error; may be nil
+// Returns the error wrapping ErrMalformedMessage, or nil if err is nil
+func Malformed(err error) error {
+    if err == nil || Kind(err) != nil {
+        return err
+    }
+    return fmt.Errorf("%w: %w", ErrMalformedMessage, err)
+}
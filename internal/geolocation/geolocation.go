@@ -6,8 +6,10 @@
 package geolocation
 
 import (
+    "embed"
     "encoding/csv"
     "encoding/json"
+    "io"
     "math"
     "os"
     "strconv"
@@ -20,6 +22,10 @@ const (
     countryMappingPath = "res/geolocation/countryMapping.json"
 )
 
+// a dozen large cities on every continent, used in developer mode instead of the geonames data
+//go:embed fixture
+var fixtureFiles embed.FS
+
 var tree *kdtree.Tree // the tree that allows us to find the closest city efficiently
 
 type Location struct {
@@ -27,6 +33,7 @@ type Location struct {
     Longitude float64 // longitude of the location
     City string // city name of the location
     Country string // country name of the location
+    CountryCode string // ISO 3166 two letter code of the country of the location
     TimeZone string // IANA name of the time zone location is located in
 }
 
@@ -34,45 +41,76 @@ type Location struct {
 // once.
 // Returns any errors
 func Init() error {
-    locations, err := getLocations()
+    countryMappingFile, err := os.Open(countryMappingPath)
     if err != nil {
         return err
     }
+    defer countryMappingFile.Close()
 
-    tree = kdtree.New(locations, false)
-    return nil
+    geoDBFile, err := os.Open(geoDBPath)
+    if err != nil {
+        return err
+    }
+    defer geoDBFile.Close()
+
+    return initTree(countryMappingFile, geoDBFile)
 }
 
-// Gets the city information from the data file.
-// Returns a list of locations or any errors
-func getLocations() (locations, error) {
-    // open and read in the JSON country code to country name map
-    countryMappingFile, err := os.Open(countryMappingPath)
+// Initializes the K-d tree with the small set of cities embedded in the server instead of the data
+// file, so that developers can run the server without the geonames data. Every location resolves to
+// the nearest of these cities, so results are deterministic but coarse. This should be run only once,
+// instead of Init.
+// Returns any errors
+func InitFixture() error {
+    countryMappingFile, err := fixtureFiles.Open("fixture/countryMapping.json")
     if err != nil {
-        return nil, err
+        return err
     }
     defer countryMappingFile.Close()
 
-    var countryMappingData map[string]string
-    err = json.NewDecoder(countryMappingFile).Decode(&countryMappingData)
+    geoDBFile, err := fixtureFiles.Open("fixture/geoData.csv")
     if err != nil {
-        return nil, err
+        return err
     }
+    defer geoDBFile.Close()
 
-    // open and read in the city data from the csv
-    geoDBFile, err := os.Open(geoDBPath)
+    return initTree(countryMappingFile, geoDBFile)
+}
+
+// Initializes the K-d tree with the given city data.
+// countryMappingFile: JSON map of two letter country codes to country names
+// geoDBFile: CSV of cities, one per line as latitude,longitude,time zone,country code,city
+// Returns any errors
+func initTree(countryMappingFile io.Reader, geoDBFile io.Reader) error {
+    locations, err := getLocations(countryMappingFile, geoDBFile)
+    if err != nil {
+        return err
+    }
+
+    tree = kdtree.New(locations, false)
+    return nil
+}
+
+// Gets the city information from the data file.
+// countryMappingFile: JSON map of two letter country codes to country names
+// geoDBFile: CSV of cities
+// Returns a list of locations or any errors
+func getLocations(countryMappingFile io.Reader, geoDBFile io.Reader) (locations, error) {
+    // read in the JSON country code to country name map
+    var countryMappingData map[string]string
+    err := json.NewDecoder(countryMappingFile).Decode(&countryMappingData)
     if err != nil {
         return nil, err
     }
-    defer geoDBFile.Close()
 
+    // read in the city data from the csv
     var locations locations
     reader := csv.NewReader(geoDBFile)
     // loop through each city
     for {
         locationSlice, err := reader.Read()
         if err != nil {
-            if err.Error() == "EOF" {
+            if err == io.EOF {
                 break
             }
             return nil, err
@@ -90,6 +128,7 @@ func getLocations() (locations, error) {
             Longitude: long,
             City: locationSlice[4],
             Country: countryMappingData[locationSlice[3]], // convert 2 letter country code to country name
+            CountryCode: locationSlice[3],
             TimeZone: locationSlice[2],
         }
         locations = append(locations, location)
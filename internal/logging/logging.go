@@ -0,0 +1,278 @@
+// Sets up the structured logger of the server. Each line is written as JSON or logfmt with a level,
+// and lines about a test carry fields that identify it, such as the user ID, test ID, replay, and
+// client IP, so that every line of a test can be found among those of every other test running at
+// the same time. Every line also carries the labels of the deployment the server belongs to. Lines
+// are written to stdout or to a log file that is rotated when it gets too big.
+package logging
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "sync"
+)
+
+// The log levels, numbered as they are read from the config file.
+const (
+    WTF = 1 // something that should never happen
+    Error = 2
+    Warn = 3
+    Info = 4
+    Debug = 5
+)
+
+const (
+    levelWTF = slog.LevelError + 4 // slog level of lines about things that should never happen
+)
+
+var (
+    currentLevel = &slog.LevelVar{} // the lowest level that is logged, which can change while the server runs
+)
+
+// Converts a log level read from the config file to a slog level.
+// level: the level, from WTF to Debug
+// Returns the slog level or an error if the level is unknown
+func toSlogLevel(level int) (slog.Level, error) {
+    switch level {
+    case WTF:
+        return levelWTF, nil
+    case Error:
+        return slog.LevelError, nil
+    case Warn:
+        return slog.LevelWarn, nil
+    case Info:
+        return slog.LevelInfo, nil
+    case Debug:
+        return slog.LevelDebug, nil
+    default:
+        return 0, fmt.Errorf("Unknown log level %d", level)
+    }
+}
+
+// Sets up the default slog logger, which the rest of the server logs with.
+// level: the lowest level that is logged, from WTF to Debug
+// format: json or logfmt
+// filename: path of the log file; empty to log to stdout
+// maxBytes: size in bytes the log file can grow to before it is rotated
+// maxFiles: number of rotated log files to keep
+// nodeLabels: labels of the deployment the server belongs to, added to every line under "node"; key
+//     is the label name
+// Returns the log file, which should be closed when the server exits, or any errors
+func Init(level int, format string, filename string, maxBytes int64, maxFiles int, nodeLabels map[string]string) (io.Closer, error) {
+    slogLevel, err := toSlogLevel(level)
+    if err != nil {
+        return nil, err
+    }
+
+    var output io.WriteCloser = nopCloser{os.Stdout}
+    if filename != "" {
+        output, err = NewRotatingFile(filename, maxBytes, maxFiles)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    currentLevel.Set(slogLevel)
+    options := &slog.HandlerOptions{
+        Level: currentLevel,
+        ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+            if attr.Key == slog.LevelKey && attr.Value.Any() == levelWTF {
+                attr.Value = slog.StringValue("WTF")
+            }
+            return attr
+        },
+    }
+    var handler slog.Handler
+    switch format {
+    case "json":
+        handler = slog.NewJSONHandler(output, options)
+    case "logfmt":
+        handler = slog.NewTextHandler(output, options)
+    default:
+        output.Close()
+        return nil, fmt.Errorf("Unknown log format %s; choose json or logfmt", format)
+    }
+    if len(nodeLabels) > 0 {
+        names := make([]string, 0, len(nodeLabels))
+        for name := range nodeLabels {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        labels := make([]any, len(names))
+        for i, name := range names {
+            labels[i] = slog.String(name, nodeLabels[name])
+        }
+        handler = handler.WithAttrs([]slog.Attr{slog.Group("node", labels...)})
+    }
+    slog.SetDefault(slog.New(handler))
+    return output, nil
+}
+
+// Changes the lowest level that is logged without setting up the logger again.
+// level: the level, from WTF to Debug
+// Returns an error if the level is unknown
+func SetLevel(level int) error {
+    slogLevel, err := toSlogLevel(level)
+    if err != nil {
+        return err
+    }
+    currentLevel.Set(slogLevel)
+    return nil
+}
+
+// Lets stdout be used as the log output without it being closed.
+type nopCloser struct {
+    io.Writer
+}
+
+func (nopCloser) Close() error {
+    return nil
+}
+
+// A log file that is rotated when it grows too big, used for the server log and the denial log. The
+// current log file is filename; when it grows past maxBytes, it is renamed to filename.1,
+// filename.1 is renamed to filename.2, and so on, keeping at most maxFiles old files. A rotation
+// that fails leaves the current log file open, so that lines are never lost because of it.
+type RotatingFile struct {
+    filename string // path of the current log file
+    maxBytes int64 // size the current log file can grow to before it is rotated
+    maxFiles int // number of rotated log files to keep
+    file *os.File // the current log file
+    size int64 // size of the current log file
+    mutex sync.Mutex // prevents multiple goroutines from writing to the file at the same time
+}
+
+// Creates a new RotatingFile, appending to the log file if it already exists.
+// filename: path of the log file; missing directories are created
+// maxBytes: size in bytes the log file can grow to before it is rotated
+// maxFiles: number of rotated log files to keep
+// Returns the log file or any errors
+func NewRotatingFile(filename string, maxBytes int64, maxFiles int) (*RotatingFile, error) {
+    if maxBytes <= 0 {
+        return nil, fmt.Errorf("Log file size must be positive; got %d", maxBytes)
+    }
+    if maxFiles < 0 {
+        return nil, fmt.Errorf("Number of rotated log files cannot be negative; got %d", maxFiles)
+    }
+    rotating := &RotatingFile{
+        filename: filename,
+        maxBytes: maxBytes,
+        maxFiles: maxFiles,
+    }
+    err := rotating.open()
+    if err != nil {
+        return nil, err
+    }
+    return rotating, nil
+}
+
+// Opens the current log file for appending.
+// Returns any errors
+func (rotating *RotatingFile) open() error {
+    err := os.MkdirAll(filepath.Dir(rotating.filename), os.ModePerm)
+    if err != nil {
+        return err
+    }
+    file, err := os.OpenFile(rotating.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    info, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return err
+    }
+    rotating.file = file
+    rotating.size = info.Size()
+    return nil
+}
+
+// Appends a line to the log file, rotating the file first if it is full. The handlers write each
+// line with one call, so lines are never split between files.
+// line: the line
+// Returns the number of bytes written and any errors
+func (rotating *RotatingFile) Write(line []byte) (int, error) {
+    rotating.mutex.Lock()
+    defer rotating.mutex.Unlock()
+    if rotating.size > 0 && rotating.size + int64(len(line)) > rotating.maxBytes {
+        err := rotating.rotate()
+        if err != nil {
+            if rotating.file == nil {
+                return 0, err
+            }
+            // the logger can't log its own errors, so they go to stderr; the line still goes to the
+            // current log file, which keeps growing until a rotation succeeds
+            fmt.Fprintln(os.Stderr, "Unable to rotate log file:", err)
+        }
+    }
+    n, err := rotating.file.Write(line)
+    rotating.size += int64(n)
+    return n, err
+}
+
+// Moves the current log file to filename.1, shifting older log files up by one and deleting the
+// oldest, then starts a new log file. If a file can't be moved, the current log file is opened again
+// so that lines can still be written. The mutex must be held.
+// Returns any errors; file is nil afterwards only if no log file could be opened
+func (rotating *RotatingFile) rotate() error {
+    err := rotating.file.Close()
+    rotating.file = nil
+    if err != nil {
+        return errors.Join(err, rotating.open())
+    }
+
+    err = rotating.shift()
+    if err != nil && !os.IsNotExist(err) {
+        return errors.Join(err, rotating.open())
+    }
+    return rotating.open()
+}
+
+// Moves the current log file and the rotated log files up by one, deleting the oldest. The current
+// log file must be closed.
+// Returns any errors
+func (rotating *RotatingFile) shift() error {
+    if rotating.maxFiles == 0 {
+        return os.Remove(rotating.filename)
+    }
+    for i := rotating.maxFiles - 1; i >= 1; i-- {
+        err := os.Rename(rotating.rotatedFilename(i), rotating.rotatedFilename(i + 1))
+        if err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+    return os.Rename(rotating.filename, rotating.rotatedFilename(1))
+}
+
+// Gets the paths of the current log file and of every rotated log file that may exist, newest first.
+// Returns the paths
+func (rotating *RotatingFile) Filenames() []string {
+    filenames := []string{rotating.filename}
+    for i := 1; i <= rotating.maxFiles; i++ {
+        filenames = append(filenames, rotating.rotatedFilename(i))
+    }
+    return filenames
+}
+
+// Gets the path of a rotated log file.
+// i: how many rotations ago the file was the current log file
+// Returns the path of the rotated log file
+func (rotating *RotatingFile) rotatedFilename(i int) string {
+    return rotating.filename + "." + strconv.Itoa(i)
+}
+
+// Closes the log file.
+// Returns any errors
+func (rotating *RotatingFile) Close() error {
+    rotating.mutex.Lock()
+    defer rotating.mutex.Unlock()
+    if rotating.file == nil {
+        return nil
+    }
+    return rotating.file.Close()
+}
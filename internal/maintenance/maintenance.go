@@ -0,0 +1,180 @@
+// A calendar of maintenance windows, during which the server refuses new tests but lets the tests
+// that are already running finish. Operators can drain a node ahead of an upgrade by scheduling a
+// window instead of stopping the server in the middle of live measurements.
+package maintenance
+
+import (
+    "fmt"
+    "strings"
+    "time"
+)
+
+const (
+    weeklyTimeFormat = "15:04" // format of the times of weekly windows
+    maxLookahead = 7 * 24 * time.Hour // furthest past the current time that back to back windows are followed to find when maintenance ends
+)
+
+var weekdays = map[string]time.Weekday{
+    "sun": time.Sunday,
+    "mon": time.Monday,
+    "tue": time.Tuesday,
+    "wed": time.Wednesday,
+    "thu": time.Thursday,
+    "fri": time.Friday,
+    "sat": time.Saturday,
+}
+
+// A period during which the server doesn't admit new tests. A window either happens once, between
+// two times, or every week, on a day of the week between two times of day in UTC.
+type Window struct {
+    spec string // the window as written in the config file
+    weekly bool // true if the window repeats every week
+    start time.Time // start of a one-time window
+    end time.Time // end of a one-time window
+    weekday time.Weekday // day of the week a weekly window starts on
+    startOfDay time.Duration // time after midnight UTC that a weekly window starts
+    length time.Duration // how long a weekly window lasts
+}
+
+// Parses a maintenance window. A one-time window is written as two RFC 3339 times separated by /,
+// e.g. 2026-10-20T02:00:00Z/2026-10-20T04:00:00Z. A weekly window is written as a day of the week
+// and two times of day in UTC, e.g. Sun 02:00-04:00; a window that ends at an earlier time than it
+// starts ends on the next day.
+// spec: the window
+// Returns the window or an error if it can't be parsed
+func ParseWindow(spec string) (Window, error) {
+    spec = strings.TrimSpace(spec)
+    window := Window{
+        spec: spec,
+    }
+    startStr, endStr, isOnce := strings.Cut(spec, "/")
+    if isOnce {
+        var err error
+        window.start, err = time.Parse(time.RFC3339, startStr)
+        if err != nil {
+            return Window{}, fmt.Errorf("Invalid start of maintenance window %s: %v", spec, err)
+        }
+        window.end, err = time.Parse(time.RFC3339, endStr)
+        if err != nil {
+            return Window{}, fmt.Errorf("Invalid end of maintenance window %s: %v", spec, err)
+        }
+        if !window.end.After(window.start) {
+            return Window{}, fmt.Errorf("Maintenance window %s ends before it starts", spec)
+        }
+        return window, nil
+    }
+
+    day, times, found := strings.Cut(spec, " ")
+    weekday, isWeekday := weekdays[strings.ToLower(day)]
+    if !found || !isWeekday {
+        return Window{}, fmt.Errorf("Maintenance window %s is neither <start>/<end> nor <day> HH:MM-HH:MM", spec)
+    }
+    startStr, endStr, found = strings.Cut(strings.TrimSpace(times), "-")
+    if !found {
+        return Window{}, fmt.Errorf("Maintenance window %s has no end time", spec)
+    }
+    startTime, err := time.Parse(weeklyTimeFormat, startStr)
+    if err != nil {
+        return Window{}, fmt.Errorf("Invalid start of maintenance window %s: %v", spec, err)
+    }
+    endTime, err := time.Parse(weeklyTimeFormat, endStr)
+    if err != nil {
+        return Window{}, fmt.Errorf("Invalid end of maintenance window %s: %v", spec, err)
+    }
+    window.weekly = true
+    window.weekday = weekday
+    window.startOfDay = time.Duration(startTime.Hour()) * time.Hour + time.Duration(startTime.Minute()) * time.Minute
+    window.length = endTime.Sub(startTime)
+    if window.length <= 0 {
+        window.length += 24 * time.Hour
+    }
+    return window, nil
+}
+
+func (window Window) String() string {
+    return window.spec
+}
+
+// Gets the occurrence of the window that contains a time.
+// now: the time
+// Returns true and the end of the occurrence if the time is in the window
+func (window Window) activeAt(now time.Time) (bool, time.Time) {
+    if !window.weekly {
+        return !now.Before(window.start) && now.Before(window.end), window.end
+    }
+    now = now.UTC()
+    midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+    daysBack := (int(now.Weekday()) - int(window.weekday) + 7) % 7
+    start := midnight.AddDate(0, 0, -daysBack).Add(window.startOfDay)
+    if start.After(now) {
+        start = start.AddDate(0, 0, -7)
+    }
+    end := start.Add(window.length)
+    return now.Before(end), end
+}
+
+// The maintenance windows of the server.
+type Calendar struct {
+    windows []Window // the windows, in the order they are configured
+}
+
+// The maintenance state of the server, as shown to operators.
+type Status struct {
+    InMaintenance bool `json:"in_maintenance"` // true if the server is refusing new tests
+    Until *time.Time `json:"until,omitempty"` // when the current maintenance ends; nil if the server isn't in maintenance
+    Windows []string `json:"windows"` // the configured windows
+}
+
+// Creates a new Calendar.
+// specs: the windows, in the formats accepted by ParseWindow
+// Returns the calendar or an error if a window can't be parsed
+func NewCalendar(specs []string) (*Calendar, error) {
+    calendar := &Calendar{}
+    for _, spec := range specs {
+        window, err := ParseWindow(spec)
+        if err != nil {
+            return nil, err
+        }
+        calendar.windows = append(calendar.windows, window)
+    }
+    return calendar, nil
+}
+
+// Checks if a time is in a maintenance window. Windows that overlap or touch are treated as one, so
+// that the end returned is when the server admits tests again.
+// now: the time
+// Returns true and the end of the maintenance if the time is in a window
+func (calendar *Calendar) Active(now time.Time) (bool, time.Time) {
+    inMaintenance := false
+    until := now
+    for extended := true; extended && until.Sub(now) < maxLookahead; {
+        extended = false
+        for _, window := range calendar.windows {
+            active, end := window.activeAt(until)
+            if active && end.After(until) {
+                inMaintenance = true
+                until = end
+                extended = true
+            }
+        }
+    }
+    return inMaintenance, until
+}
+
+// Gets the maintenance state of the server.
+// now: the current time
+// Returns the status of the calendar
+func (calendar *Calendar) Status(now time.Time) Status {
+    status := Status{
+        Windows: []string{},
+    }
+    inMaintenance, until := calendar.Active(now)
+    if inMaintenance {
+        status.InMaintenance = true
+        status.Until = &until
+    }
+    for _, window := range calendar.windows {
+        status.Windows = append(status.Windows, window.String())
+    }
+    return status
+}
@@ -0,0 +1,238 @@
+// Counts events on the server and exposes the counts in the Prometheus text format, so that the
+// server can be monitored without adding a metrics library. Counters and gauges register themselves
+// when they are created and are served by Handler.
+package metrics
+
+import (
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+)
+
+var (
+    registryMutex sync.Mutex // prevents multiple goroutines from accessing registry
+    registry []metric // every counter and gauge that has been created, in the order they were created
+    constLabels string // labels added to every series, rendered as name="value" pairs each followed by a comma
+)
+
+// A counter or gauge that can be served by Handler.
+type metric interface {
+    writeText(w io.Writer) error
+}
+
+// Adds a metric to the registry so that it is served by Handler.
+// m: the metric
+func register(m metric) {
+    registryMutex.Lock()
+    defer registryMutex.Unlock()
+    registry = append(registry, m)
+}
+
+// Sets labels that are added to every series, e.g. the site of the server, so that the metrics of a
+// fleet of servers can be told apart once they are scraped into one place. This should be called
+// before the metrics are served.
+// labels: the labels; key is the label name
+func SetConstLabels(labels map[string]string) {
+    names := make([]string, 0, len(labels))
+    for name := range labels {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    var rendered strings.Builder
+    for _, name := range names {
+        fmt.Fprintf(&rendered, "%s=\"%s\",", name, escapeLabelValue(labels[name]))
+    }
+    registryMutex.Lock()
+    defer registryMutex.Unlock()
+    constLabels = rendered.String()
+}
+
+// Gets the labels added to every series.
+// Returns the labels, rendered as name="value" pairs each followed by a comma
+func getConstLabels() string {
+    registryMutex.Lock()
+    defer registryMutex.Unlock()
+    return constLabels
+}
+
+// A count of events broken down by the value of one label, e.g. TLS handshake failures by cause.
+type CounterVec struct {
+    name string // name of the metric
+    help string // description of the metric
+    label string // name of the label the counts are broken down by
+    mutex sync.Mutex // prevents multiple goroutines from accessing counts
+    counts map[string]uint64 // number of events for each label value
+}
+
+// Creates a new CounterVec and registers it so that it is served by Handler.
+// name: name of the metric, e.g. wehe_side_channel_tls_handshake_failures_total
+// help: description of the metric
+// label: name of the label the counts are broken down by
+// Returns the counter
+func NewCounterVec(name string, help string, label string) *CounterVec {
+    counter := &CounterVec{
+        name: name,
+        help: help,
+        label: label,
+        counts: make(map[string]uint64),
+    }
+    register(counter)
+    return counter
+}
+
+// Counts an event.
+// labelValue: the value of the label of the event
+func (counter *CounterVec) Inc(labelValue string) {
+    counter.mutex.Lock()
+    defer counter.mutex.Unlock()
+    counter.counts[labelValue]++
+}
+
+// Counts a number of events at once, e.g. the bytes of a replay.
+// labelValue: the value of the label of the events
+// n: the number of events
+func (counter *CounterVec) Add(labelValue string, n uint64) {
+    counter.mutex.Lock()
+    defer counter.mutex.Unlock()
+    counter.counts[labelValue] += n
+}
+
+// Gets the current counts.
+// Returns a copy of the number of events for each label value
+func (counter *CounterVec) Snapshot() map[string]uint64 {
+    counter.mutex.Lock()
+    defer counter.mutex.Unlock()
+    snapshot := make(map[string]uint64, len(counter.counts))
+    for labelValue, count := range counter.counts {
+        snapshot[labelValue] = count
+    }
+    return snapshot
+}
+
+// Writes the counter in the Prometheus text format.
+// w: where the counter is written
+// Returns any errors
+func (counter *CounterVec) writeText(w io.Writer) error {
+    snapshot := counter.Snapshot()
+    labelValues := make([]string, 0, len(snapshot))
+    for labelValue := range snapshot {
+        labelValues = append(labelValues, labelValue)
+    }
+    sort.Strings(labelValues)
+    labels := getConstLabels()
+
+    _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+    if err != nil {
+        return err
+    }
+    for _, labelValue := range labelValues {
+        _, err = fmt.Fprintf(w, "%s{%s%s=\"%s\"} %d\n", counter.name, labels, counter.label, escapeLabelValue(labelValue), snapshot[labelValue])
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// A value that goes up and down broken down by the value of one label, e.g. the size of each replay
+// file.
+type GaugeVec struct {
+    name string // name of the metric
+    help string // description of the metric
+    label string // name of the label the values are broken down by
+    mutex sync.Mutex // prevents multiple goroutines from accessing values
+    values map[string]float64 // the value for each label value
+}
+
+// Creates a new GaugeVec and registers it so that it is served by Handler.
+// name: name of the metric, e.g. wehe_replay_file_bytes
+// help: description of the metric
+// label: name of the label the values are broken down by
+// Returns the gauge
+func NewGaugeVec(name string, help string, label string) *GaugeVec {
+    gauge := &GaugeVec{
+        name: name,
+        help: help,
+        label: label,
+        values: make(map[string]float64),
+    }
+    register(gauge)
+    return gauge
+}
+
+// Sets the value for a label value.
+// labelValue: the value of the label
+// value: the new value
+func (gauge *GaugeVec) Set(labelValue string, value float64) {
+    gauge.mutex.Lock()
+    defer gauge.mutex.Unlock()
+    gauge.values[labelValue] = value
+}
+
+// Writes the gauge in the Prometheus text format.
+// w: where the gauge is written
+// Returns any errors
+func (gauge *GaugeVec) writeText(w io.Writer) error {
+    gauge.mutex.Lock()
+    labelValues := make([]string, 0, len(gauge.values))
+    snapshot := make(map[string]float64, len(gauge.values))
+    for labelValue, value := range gauge.values {
+        labelValues = append(labelValues, labelValue)
+        snapshot[labelValue] = value
+    }
+    gauge.mutex.Unlock()
+    sort.Strings(labelValues)
+    labels := getConstLabels()
+
+    _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", gauge.name, gauge.help, gauge.name)
+    if err != nil {
+        return err
+    }
+    for _, labelValue := range labelValues {
+        _, err = fmt.Fprintf(w, "%s{%s%s=\"%s\"} %g\n", gauge.name, labels, gauge.label, escapeLabelValue(labelValue), snapshot[labelValue])
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Escapes a label value for the Prometheus text format.
+// value: the label value
+// Returns the escaped value
+func escapeLabelValue(value string) string {
+    return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Writes every registered counter and gauge in the Prometheus text format.
+// w: where the metrics are written
+// Returns any errors
+func WriteText(w io.Writer) error {
+    registryMutex.Lock()
+    registered := append([]metric(nil), registry...)
+    registryMutex.Unlock()
+
+    for _, m := range registered {
+        err := m.writeText(w)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Gets a handler that serves every registered counter and gauge in the Prometheus text format.
+// Returns the handler
+func Handler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+        err := WriteText(w)
+        if err != nil {
+            slog.Warn("Unable to write metrics", "error", err)
+        }
+    })
+}
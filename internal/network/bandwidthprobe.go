@@ -0,0 +1,59 @@
+// Sends the bursts of bandwidth probes that clients run on a test port before heavy replays.
+package network
+
+import (
+    "crypto/rand"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+
+    "wehe-server/internal/clienthandler"
+)
+
+const (
+    bandwidthProbeChunkSize = 64 * 1024 // bytes written to the connection at a time during a burst
+)
+
+// Sends the burst of a bandwidth probe and times it until the client confirms that it received every
+// byte by sending one byte back. The burst is random so that compression on the path can't make the
+// link look faster than it is. Probes that no client asked for are dropped.
+// conn: the connection to the client
+// token: the replay token at the start of the connection; empty if there was none
+// clientIP: the IP of the client
+func (tcpServer TCPServer) runBandwidthProbe(conn net.Conn, token string, clientIP string) {
+    probes := clienthandler.GetBandwidthProbes()
+    if probes == nil {
+        return
+    }
+    clientKey, claimed := probes.Claim(token, clientIP)
+    if !claimed {
+        tcpServer.handleTCPError(clientIP, fmt.Errorf("Got a bandwidth probe that no client asked for"))
+        return
+    }
+
+    chunk := make([]byte, bandwidthProbeChunkSize)
+    _, err := rand.Read(chunk)
+    if err != nil {
+        tcpServer.handleTCPError(clientKey, fmt.Errorf("Unable to generate bandwidth probe: %v", err))
+        probes.Finish(clientKey, 0, 0, false)
+        return
+    }
+
+    startTime := tcpServer.Clock.Now()
+    conn.SetDeadline(startTime.Add(probes.Timeout))
+    var sent int64
+    for sent < probes.Bytes && err == nil {
+        var n int
+        n, err = conn.Write(chunk[:min(int64(len(chunk)), probes.Bytes - sent)])
+        sent += int64(n)
+    }
+    if err == nil {
+        _, err = io.ReadFull(conn, make([]byte, 1))
+    }
+    elapsed := tcpServer.Clock.Since(startTime)
+    if err != nil {
+        slog.Info("Bandwidth probe cut off", "port", tcpServer.Port, "bytes", sent, "error", err)
+    }
+    probes.Finish(clientKey, sent, elapsed, err == nil)
+}
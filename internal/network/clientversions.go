@@ -0,0 +1,39 @@
+// Turns away clients that are too old to be tested, telling them to upgrade, rather than testing
+// them with a protocol or replays the server no longer supports.
+package network
+
+import (
+    "fmt"
+
+    "wehe-server/internal/compat"
+    "wehe-server/internal/errs"
+    "wehe-server/internal/metrics"
+)
+
+var (
+    upgradesRequired = metrics.NewCounterVec("wehe_side_channel_upgrades_required_total",
+        "Number of clients told to upgrade because they are older than the minimum supported version, by client version.", "client_version")
+)
+
+// Checks if a client is older than the minimum supported version. Versions that can't be parsed
+// are treated as the oldest version, as they are by compat.For.
+// clientVersion: the version string sent by the client
+// Returns true if the client must upgrade before it can be tested
+func (sideChannel SideChannel) requiresUpgrade(clientVersion string) bool {
+    if sideChannel.MinClientVersion == (compat.Version{}) {
+        return false
+    }
+    version, err := compat.ParseVersion(clientVersion)
+    if err != nil {
+        version = compat.Version{}
+    }
+    return version.Less(sideChannel.MinClientVersion)
+}
+
+// Counts a client that was told to upgrade and builds the error that ends its connection.
+// clientVersion: the version string sent by the client
+// Returns the error
+func (sideChannel SideChannel) upgradeRequiredError(clientVersion string) error {
+    upgradesRequired.Inc(clientVersion)
+    return fmt.Errorf("%w: client version %s is older than the minimum supported version %s; told the client to upgrade", errs.ErrClientTooOld, clientVersion, sideChannel.MinClientVersion)
+}
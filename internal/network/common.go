@@ -1,5 +1,84 @@
 package network
 
+import (
+    "fmt"
+    "log/slog"
+
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/metrics"
+    "wehe-server/internal/testdata"
+)
+
 const (
     timing = true
 )
+
+var (
+    portViolations = metrics.NewCounterVec("wehe_replay_port_violations_total",
+        "Number of connections or first packets rejected because the replay granted to the client doesn't run on the port, by port.", "port")
+)
+
+// What a replay server does when sending a replay packet to the client fails
+type ReplayErrorPolicy string
+
+const (
+    AbortOnError ReplayErrorPolicy = "abort" // stop the replay and notify the client
+    ContinueOnError ReplayErrorPolicy = "continue" // skip the packet and keep sending the replay
+)
+
+// The replay error policies for all replays.
+type ReplayErrorPolicies struct {
+    Default ReplayErrorPolicy // policy used for replays without an override
+    Overrides map[string]ReplayErrorPolicy // per-replay policies; key is the replay name
+}
+
+// Gets the replay error policy for a replay.
+// replayName: the name of the replay
+// Returns the policy that applies to the replay
+func (policies ReplayErrorPolicies) get(replayName string) ReplayErrorPolicy {
+    policy, exists := policies.Overrides[replayName]
+    if exists {
+        return policy
+    }
+    return policies.Default
+}
+
+// Checks that the replay a client was granted runs on the port the client connected to, e.g. that a
+// client granted a UDP replay isn't replaying it over a TCP port. Mismatches are logged and counted
+// as protocol violations.
+// replays: the replays on the server
+// replayName: the name of the replay the client was granted
+// protocol: tcp or udp
+// port: the port the client connected to
+// logger: logs with the fields that identify the test of the client
+// Returns true if the replay can be run on the port
+func checkReplayPort(replays *testdata.Cache, replayName string, protocol string, port int, logger *slog.Logger) bool {
+    metadata, exists := replays.Metadata(replayName)
+    if !exists {
+        // the replay is gone, which loading it reports
+        return true
+    }
+    if metadata.AllowsPort(protocol == "tcp", port) {
+        return true
+    }
+    portViolations.Inc(fmt.Sprintf("%s/%d", protocol, port))
+    logger.Warn("Protocol violation: granted replay doesn't run on this port", "protocol", protocol, "port", port, "replay_is_tcp", metadata.IsTCP)
+    return false
+}
+
+// Checks that the port a client connected to wasn't disabled after the client was granted its
+// replay. Refused replays are recorded as aborted, so that the client finds out over the side
+// channel instead of waiting for packets that never come.
+// connectedClients: the clients running a replay
+// clientKey: the key of the client, from Resolve
+// protocol: tcp or udp
+// port: the port the client connected to
+// Returns true if the replay can be sent on the port
+func checkPortEnabled(connectedClients *clienthandler.ConnectedClients, clientKey string, protocol string, port int) bool {
+    if connectedClients.PortOpen(clientKey, protocol, port) {
+        return true
+    }
+    connectedClients.Logger(clientKey).Info("Refused replay on a disabled port", "protocol", protocol, "port", port)
+    connectedClients.AddReplayError(clientKey, fmt.Errorf("%s is disabled", clienthandler.PortName(protocol, port)), true)
+    return false
+}
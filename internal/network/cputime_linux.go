@@ -0,0 +1,21 @@
+//go:build linux
+
+// CPU time of the server process on Linux, read with getrusage.
+package network
+
+import (
+    "syscall"
+    "time"
+)
+
+// Gets the CPU time the process has used in user and kernel mode, which includes the system calls
+// that send replay packets.
+// Returns the CPU time, or 0 if it can't be read
+func processCPUTime() time.Duration {
+    var usage syscall.Rusage
+    err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+    if err != nil {
+        return 0
+    }
+    return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+// Stand-in for the CPU time of the server process on platforms other than Linux.
+package network
+
+import (
+    "time"
+)
+
+// Returns 0, since the CPU time of the process is only read on Linux.
+func processCPUTime() time.Duration {
+    return 0
+}
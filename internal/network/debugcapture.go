@@ -0,0 +1,271 @@
+// Packet captures of single clients, started by an operator through the admin API to debug a client
+// that misbehaves in production. Only the packets to and from the client are kept, with its IP
+// anonymized, and every capture stops on its own once it reaches its time or size limit, so a
+// forgotten capture can't fill the disk.
+package network
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/google/gopacket"
+    "github.com/google/gopacket/layers"
+
+    "wehe-server/internal/anonymize"
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/pcapfile"
+)
+
+const (
+    debugCaptureSnapLen = 65535 // bytes of each packet kept; large enough for packets coalesced by the NIC
+    maxFinishedDebugCaptures = 20 // finished captures listed in the admin API
+)
+
+// Why a debug capture stopped.
+const (
+    debugCaptureTimeLimit = "time_limit" // the capture ran for as long as it was allowed to
+    debugCaptureSizeLimit = "size_limit" // the capture file reached its size limit
+    debugCaptureStopped = "stopped" // an operator stopped the capture
+    debugCaptureEnded = "ended" // the capture ran out of packets, e.g. a PCAP file given as the interface
+)
+
+// Where debug captures are written and how big they can get.
+type DebugCaptureSettings struct {
+    Interface string // the interface to capture packets on, or file:<path> to read the packets of a PCAP file
+    Dir string // the directory the capture files are written to
+    MaxDuration time.Duration // the longest a capture can run
+    MaxBytes int64 // bytes of packets a capture file can hold
+}
+
+// A debug capture, as shown to operators.
+type DebugCaptureInfo struct {
+    ID uint64 `json:"id"` // identifies the capture, e.g. to stop it
+    ClientID uint64 `json:"client_id"` // the ID of the client in the connected clients
+    IP string `json:"ip"` // the anonymized IP of the client
+    TestID string `json:"test_id,omitempty"` // the test the client was running when the capture started
+    File string `json:"file"` // the path of the capture file
+    Started time.Time `json:"started"` // when the capture started
+    Until time.Time `json:"until"` // when the capture stops if it doesn't reach its size limit first
+    Stopped time.Time `json:"stopped"` // when the capture stopped; zero while it runs
+    StopReason string `json:"stop_reason,omitempty"` // why the capture stopped; empty while it runs
+    Packets int `json:"packets"` // packets written to the capture file
+    Bytes int64 `json:"bytes"` // bytes of packets written to the capture file
+}
+
+// A running debug capture.
+type debugCapture struct {
+    info DebugCaptureInfo // the capture as shown to operators; protected by the mutex of DebugCaptures
+    clientIP net.IP // the IP whose packets are captured
+    handle captureHandle // the socket the packets are captured from
+    timer *time.Timer // stops the capture at its time limit
+}
+
+// Starts, stops, and lists debug captures.
+type DebugCaptures struct {
+    settings DebugCaptureSettings
+    anonymizer anonymize.Anonymizer // anonymizes the IPs in the captured packets
+    nextID uint64 // ID given to the next capture
+    active map[uint64]*debugCapture // the running captures; key is the capture ID
+    finished []DebugCaptureInfo // the most recent captures that stopped, oldest first
+    mutex sync.Mutex // protects nextID, active, finished, and the info of the running captures
+}
+
+// Creates a new DebugCaptures.
+// settings: where captures are written and how big they can get
+// anonymizer: anonymizes the IPs in the captured packets
+// Returns the debug captures
+func NewDebugCaptures(settings DebugCaptureSettings, anonymizer anonymize.Anonymizer) *DebugCaptures {
+    return &DebugCaptures{
+        settings: settings,
+        anonymizer: anonymizer,
+        active: make(map[uint64]*debugCapture),
+    }
+}
+
+// Starts capturing the packets to and from a connected client. Only one capture of a client can run
+// at a time.
+// clientIP: the IP of the client
+// client: the client as shown to operators
+// duration: how long to capture for; 0 or longer than the maximum captures for the maximum
+// Returns the capture or any errors
+func (debugCaptures *DebugCaptures) Start(clientIP string, client clienthandler.ConnectedClientInfo, duration time.Duration) (DebugCaptureInfo, error) {
+    ip := net.ParseIP(clientIP)
+    if ip == nil {
+        return DebugCaptureInfo{}, fmt.Errorf("Invalid client IP")
+    }
+    if duration <= 0 || duration > debugCaptures.settings.MaxDuration {
+        duration = debugCaptures.settings.MaxDuration
+    }
+
+    debugCaptures.mutex.Lock()
+    defer debugCaptures.mutex.Unlock()
+    for _, running := range debugCaptures.active {
+        if running.clientIP.Equal(ip) {
+            return DebugCaptureInfo{}, fmt.Errorf("Client %d is already being captured by capture %d", client.ID, running.info.ID)
+        }
+    }
+
+    err := os.MkdirAll(debugCaptures.settings.Dir, os.ModePerm)
+    if err != nil {
+        return DebugCaptureInfo{}, err
+    }
+    debugCaptures.nextID++
+    now := time.Now().UTC()
+    filename := filepath.Join(debugCaptures.settings.Dir, fmt.Sprintf("%s_%d.pcap", now.Format("20060102T150405Z"), debugCaptures.nextID))
+    writer, err := pcapfile.CreateLive(filename, debugCaptureSnapLen, layers.LinkTypeEthernet)
+    if err != nil {
+        return DebugCaptureInfo{}, err
+    }
+    handle, err := openCapture(debugCaptures.settings.Interface)
+    if err != nil {
+        writer.Close()
+        return DebugCaptureInfo{}, err
+    }
+
+    capture := &debugCapture{
+        info: DebugCaptureInfo{
+            ID: debugCaptures.nextID,
+            ClientID: client.ID,
+            IP: client.IP,
+            TestID: client.TestID,
+            File: writer.Path(),
+            Started: now,
+            Until: now.Add(duration),
+        },
+        clientIP: ip,
+        handle: handle,
+    }
+    debugCaptures.active[capture.info.ID] = capture
+    capture.timer = time.AfterFunc(duration, func() {
+        debugCaptures.stop(capture.info.ID, debugCaptureTimeLimit)
+    })
+    go debugCaptures.run(capture, writer)
+    slog.Info("Started debug capture", "capture_id", capture.info.ID, "client_id", client.ID, "test_id", client.TestID, "file", writer.Path(), "duration", duration)
+    return capture.info, nil
+}
+
+// Stops a running capture.
+// id: the ID of the capture
+// Returns the capture or any errors
+func (debugCaptures *DebugCaptures) Stop(id uint64) (DebugCaptureInfo, error) {
+    info, stopped := debugCaptures.stop(id, debugCaptureStopped)
+    if !stopped {
+        return DebugCaptureInfo{}, fmt.Errorf("No debug capture with ID %d is running", id)
+    }
+    return info, nil
+}
+
+// Lists the running captures and the most recent ones that stopped.
+// Returns the captures, newest first
+func (debugCaptures *DebugCaptures) List() []DebugCaptureInfo {
+    debugCaptures.mutex.Lock()
+    defer debugCaptures.mutex.Unlock()
+    captures := append([]DebugCaptureInfo{}, debugCaptures.finished...)
+    for _, capture := range debugCaptures.active {
+        captures = append(captures, capture.info)
+    }
+    sort.Slice(captures, func(i, j int) bool {
+        return captures[i].ID > captures[j].ID
+    })
+    return captures
+}
+
+// Stops a running capture by closing its socket; the capture goroutine finishes the file.
+// id: the ID of the capture
+// reason: why the capture is stopped
+// Returns the capture and true, or false if the capture isn't running
+func (debugCaptures *DebugCaptures) stop(id uint64, reason string) (DebugCaptureInfo, bool) {
+    debugCaptures.mutex.Lock()
+    defer debugCaptures.mutex.Unlock()
+    capture, exists := debugCaptures.active[id]
+    if !exists {
+        return DebugCaptureInfo{}, false
+    }
+    if capture.info.StopReason == "" {
+        capture.info.StopReason = reason
+        capture.timer.Stop()
+        capture.handle.Close()
+    }
+    return capture.info, true
+}
+
+// Writes the packets of the client of a capture to its file until the capture is stopped or reaches
+// a limit. This function should be run in a new thread, as it does not return until the capture
+// stops.
+// capture: the capture
+// writer: writes the packets to the compressed capture file, and its index once the capture stops
+func (debugCaptures *DebugCaptures) run(capture *debugCapture, writer *pcapfile.Writer) {
+    var err error
+    for {
+        var data []byte
+        var captureInfo gopacket.CaptureInfo
+        data, captureInfo, err = capture.handle.ReadPacketData()
+        if err != nil {
+            break
+        }
+        if !isPacketOf(data, capture.clientIP) {
+            continue
+        }
+        debugCaptures.mutex.Lock()
+        full := capture.info.Bytes + int64(len(data)) > debugCaptures.settings.MaxBytes
+        debugCaptures.mutex.Unlock()
+        if full {
+            debugCaptures.stop(capture.info.ID, debugCaptureSizeLimit)
+            break
+        }
+        err = writer.WritePacket(captureInfo, debugCaptures.anonymizer.Packet(data, layers.LinkTypeEthernet))
+        if err != nil {
+            debugCaptures.stop(capture.info.ID, fmt.Sprintf("error: %v", err))
+            break
+        }
+        debugCaptures.mutex.Lock()
+        capture.info.Packets++
+        capture.info.Bytes += int64(len(data))
+        debugCaptures.mutex.Unlock()
+    }
+    index, closeErr := writer.Close()
+    if closeErr != nil {
+        slog.Error("Unable to finish debug capture file", "capture_id", capture.info.ID, "file", writer.Path(), "error", closeErr)
+    }
+
+    debugCaptures.mutex.Lock()
+    defer debugCaptures.mutex.Unlock()
+    if capture.info.StopReason == "" {
+        capture.info.StopReason = debugCaptureEnded
+        if !errors.Is(err, io.EOF) {
+            capture.info.StopReason = fmt.Sprintf("error: %v", err)
+        }
+        capture.timer.Stop()
+        capture.handle.Close()
+    }
+    capture.info.Stopped = time.Now().UTC()
+    delete(debugCaptures.active, capture.info.ID)
+    debugCaptures.finished = append(debugCaptures.finished, capture.info)
+    if len(debugCaptures.finished) > maxFinishedDebugCaptures {
+        debugCaptures.finished = debugCaptures.finished[len(debugCaptures.finished) - maxFinishedDebugCaptures:]
+    }
+    slog.Info("Stopped debug capture", "capture_id", capture.info.ID, "reason", capture.info.StopReason, "packets", capture.info.Packets, "bytes", capture.info.Bytes, "compressed_bytes", index.CompressedBytes)
+}
+
+// Checks if a captured packet was sent to or from an IP.
+// data: the packet, starting at its Ethernet header
+// ip: the IP
+// Returns true if the packet is an IP packet with ip as its source or destination
+func isPacketOf(data []byte, ip net.IP) bool {
+    packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+    switch network := packet.NetworkLayer().(type) {
+    case *layers.IPv4:
+        return network.SrcIP.Equal(ip) || network.DstIP.Equal(ip)
+    case *layers.IPv6:
+        return network.SrcIP.Equal(ip) || network.DstIP.Equal(ip)
+    }
+    return false
+}
@@ -0,0 +1,111 @@
+// Maps the kinds of errors in errs to what the side channels send the client when a request fails,
+// so that every request that fails for the same reason gets the same response whichever handler it
+// failed in.
+package network
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strings"
+
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/errs"
+)
+
+const (
+    tlsUserCanceled = "tls: user canceled" // the message of the alert clients close the side channel with
+)
+
+var (
+    // the status code of gRPC calls that fail with each kind of error; calls that fail with errors
+    // of no kind are Internal
+    grpcCodes = map[error]codes.Code{
+        errs.ErrMalformedMessage: codes.InvalidArgument,
+        errs.ErrMessageTooLarge: codes.ResourceExhausted,
+        errs.ErrTooManySamples: codes.ResourceExhausted,
+        errs.ErrUnknownReplay: codes.NotFound,
+        errs.ErrPermissionDenied: codes.PermissionDenied,
+        errs.ErrClientTooOld: codes.FailedPrecondition,
+        errs.ErrNoTest: codes.NotFound,
+        errs.ErrNotEnoughData: codes.FailedPrecondition,
+        errs.ErrClientGone: codes.Canceled,
+        errs.ErrTimedOut: codes.DeadlineExceeded,
+    }
+
+    // the reason sent in the rejections of the binary side channel for each kind of limit
+    rejectionReasons = map[error]string{
+        errs.ErrMessageTooLarge: rejectionMessageTooLarge,
+        errs.ErrTooManySamples: rejectionTooManySamples,
+    }
+)
+
+// Gets the status code of a gRPC call that failed.
+// err: the error the call failed with
+// Returns the status code of the kind of the error, or Internal if it has no kind
+func grpcCode(err error) codes.Code {
+    code, exists := grpcCodes[errs.Kind(err)]
+    if !exists {
+        return codes.Internal
+    }
+    return code
+}
+
+// Converts the error a gRPC call failed with into the status the client gets.
+// err: the error the call failed with
+// Returns the status error
+func grpcError(err error) error {
+    return status.Error(grpcCode(err), strings.TrimSpace(err.Error()))
+}
+
+// Gets the response code of a binary side channel request that failed.
+// err: the error the request failed with
+// Returns upgradeRequiredResponse if the client is too old, or errorResponse otherwise
+func errorResponseCode(err error) responseCode {
+    if errors.Is(err, errs.ErrClientTooOld) {
+        return upgradeRequiredResponse
+    }
+    return errorResponse
+}
+
+// Tells the client that its request failed. Requests that went over a limit are rejected with the
+// limit, and clients that are too old are told the oldest supported version; other requests get a
+// plain error response. Errors are only logged since the request already failed.
+// clt: the client handler that made the request
+// err: the error the request failed with
+func (sideChannel SideChannel) sendError(clt *clienthandler.Client, err error) {
+    var limitErr *errs.LimitError
+    if errors.As(err, &limitErr) {
+        sideChannel.sendRejection(clt, rejectionReasons[limitErr.Kind], limitErr.Limit)
+        return
+    }
+    respCode := errorResponseCode(err)
+    message := ""
+    if respCode == upgradeRequiredResponse {
+        message = sideChannel.MinClientVersion.String()
+    }
+    sendErr := sideChannel.sendResponse(clt, respCode, message)
+    if sendErr != nil {
+        clt.Logger().Error("Unable to send error response to client", "error", sendErr)
+    }
+}
+
+// Marks a read error caused by the client closing its side channel connection. Clients close the
+// connection either plainly or with the TLS user canceled alert, which crypto/tls only exposes
+// through its message.
+// err: the error of a read from the client
+// Returns the error wrapping errs.ErrClientGone if the client closed the connection, or err
+func disconnected(err error) error {
+    if errors.Is(err, io.EOF) {
+        return fmt.Errorf("%w: %w", errs.ErrClientGone, err)
+    }
+    var opErr *net.OpError
+    if errors.As(err, &opErr) && opErr.Op == "remote error" && opErr.Err != nil && opErr.Err.Error() == tlsUserCanceled {
+        return fmt.Errorf("%w: %w", errs.ErrClientGone, err)
+    }
+    return err
+}
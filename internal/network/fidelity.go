@@ -0,0 +1,314 @@
+// Runs a replay through the replay servers over loopback and compares what they send with the replay
+// file, which holds the sizes, timing, and order of the server packets of the source packet capture.
+// Replay authors can check a new replay this way before it is published to clients, to catch a
+// replay that the servers send differently from how it was recorded.
+package network
+
+import (
+    "bytes"
+    "errors"
+    "math"
+    "net"
+    "os"
+    "slices"
+    "time"
+
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/testdata"
+)
+
+const (
+    fidelityClientIP = "127.0.0.1" // the IP the replay is run from
+    fidelitySlack = 10 * time.Second // how long past the last scheduled packet the client waits for the rest of the replay
+    fidelityReadBuffer = 8 * 1024 * 1024 // bytes of UDP receive buffer, so that bursts of the replay aren't dropped on loopback
+)
+
+// How closely what the replay servers sent matches the replay file.
+type FidelityReport struct {
+    ReplayName string `json:"replay_name"` // the name of the replay
+    IsTCP bool `json:"is_tcp"` // true if the replay is TCP
+    ExpectedPackets int `json:"expected_packets"` // packets the replay file schedules
+    ExpectedBytes int `json:"expected_bytes"` // bytes in the payloads of those packets
+    ReceivedBytes int `json:"received_bytes"` // bytes received from the replay server
+    MissingPackets int `json:"missing_packets"` // scheduled packets that never arrived
+    UnexpectedPackets int `json:"unexpected_packets"` // UDP packets that match no packet of the replay file; always 0 for TCP
+    OutOfOrderPackets int `json:"out_of_order_packets"` // UDP packets that arrived after a later packet of their flow; always 0 for TCP
+    ContentMismatch bool `json:"content_mismatch"` // true if the TCP bytes received differ from the payloads of the replay file
+    AfterTimeout int `json:"after_timeout"` // UDP packets scheduled after the timeout of the replay, which the servers stop sending around, so they aren't checked
+    TimingErrorMeanMs float64 `json:"timing_error_mean_ms"` // how late packets arrived on average, in ms; negative if they were early
+    TimingErrorP95Ms float64 `json:"timing_error_p95_ms"` // 95th percentile of how far off schedule packets arrived, in ms
+    TimingErrorMaxMs float64 `json:"timing_error_max_ms"` // the furthest off schedule a packet arrived, in ms
+    CPUMs float64 `json:"cpu_ms"` // CPU time the server process used to run the replay, including the loopback client, in ms; 0 if it can't be measured
+    CPUMsPerGbit float64 `json:"cpu_ms_per_gbit"` // CPUMs for each Gbit received, to compare how much CPU different UDP send options use
+    ReplayErrors []string `json:"replay_errors,omitempty"` // errors the replay server ran into while sending the replay
+    Passed bool `json:"passed"` // true if every packet arrived in order, unchanged, and within the tolerance of its schedule
+}
+
+// Runs a replay through a replay server over loopback and compares what the server sends with the
+// replay file. The server runs the same code that serves clients, except that requests aren't checked
+// against their hashes, since the replay files don't have the requests.
+// replays: the replays to check the replay from
+// replayName: the name of the replay
+// tolerance: how far off schedule the 95th percentile of packets can arrive for the replay to pass
+// Returns the report or any errors
+func CheckFidelity(replays *testdata.Cache, replayName string, tolerance time.Duration) (FidelityReport, error) {
+    replayInfo, err := replays.Get(replayName)
+    if err != nil {
+        return FidelityReport{}, err
+    }
+    connectedClients := clienthandler.NewConnectedClients()
+    connectedClients.Grant(fidelityClientIP, replayName)
+    defer connectedClients.Revoke(fidelityClientIP)
+
+    report := FidelityReport{
+        ReplayName: replayName,
+        IsTCP: replayInfo.IsTCP,
+    }
+    var timingErrors []time.Duration
+    cpuStart := processCPUTime()
+    if replayInfo.IsTCP {
+        timingErrors, err = checkTCPFidelity(connectedClients, replays, replayInfo, &report)
+    } else {
+        // the server checks that the replay runs on its port, so it is given a port of the replay,
+        // though it listens on any free port. Only the flows of that port are sent and checked.
+        port := 0
+        metadata, exists := replays.Metadata(replayName)
+        if exists && len(metadata.ServerEndpoints) > 0 {
+            port = metadata.ServerEndpoints[0].Port
+        }
+        // the replay is checked with the timeout a client that can wait for long replays gets
+        timeout, _ := udpReplayTimeoutFor(metadata.Duration, 0, true)
+        connectedClients.SetReplayTimeout(fidelityClientIP, timeout)
+        timingErrors, err = checkUDPFidelity(connectedClients, replays, replayInfo, port, &report)
+    }
+    if err != nil {
+        return report, err
+    }
+    report.CPUMs = milliseconds(processCPUTime() - cpuStart)
+    if report.ReceivedBytes > 0 {
+        report.CPUMsPerGbit = report.CPUMs / (float64(report.ReceivedBytes) * 8 / 1e9)
+    }
+    report.addTimingErrors(timingErrors)
+    report.ReplayErrors, _ = connectedClients.TakeReplayErrors(fidelityClientIP)
+    report.Passed = report.MissingPackets == 0 && report.UnexpectedPackets == 0 &&
+        report.OutOfOrderPackets == 0 && !report.ContentMismatch && len(report.ReplayErrors) == 0 &&
+        report.TimingErrorP95Ms <= float64(tolerance) / float64(time.Millisecond)
+    return report, nil
+}
+
+// Runs a TCP replay like a client: sends each request, then reads the response before sending the
+// next request. Requests are zeros of the length of the request in the replay file.
+// connectedClients: the clients the server sends replays to, which includes the loopback client
+// replays: the replays the server sends the replay from
+// replayInfo: the replay
+// report: the report to add the sizes and content of the replay to
+// Returns how late each packet arrived, or any errors
+func checkTCPFidelity(connectedClients *clienthandler.ConnectedClients, replays *testdata.Cache, replayInfo testdata.ReplayInfo, report *FidelityReport) ([]time.Duration, error) {
+    listener, err := net.Listen("tcp", fidelityClientIP + ":0")
+    if err != nil {
+        return nil, err
+    }
+    defer listener.Close()
+    server := NewTCPServer(fidelityClientIP, listener.Addr().(*net.TCPAddr).Port, connectedClients, ReplayErrorPolicies{Default: AbortOnError}, NoRequestHashCheck, replays)
+    go func() {
+        conn, err := listener.Accept()
+        if err != nil {
+            return
+        }
+        server.handleConnection(conn)
+    }()
+
+    conn, err := net.Dial("tcp", listener.Addr().String())
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    var timingErrors []time.Duration
+    buffer := make([]byte, 65536)
+    for i, response := range replayInfo.Responses {
+        responseSet := response.(testdata.TCPResponseSet)
+        // the end of each packet in the bytes of the response
+        var expected []byte
+        ends := make([]int, len(responseSet.Packets))
+        var lastTimestamp time.Duration
+        for j, packet := range responseSet.Packets {
+            expected = packet.Payload.AppendTo(expected)
+            ends[j] = len(expected)
+            lastTimestamp = max(lastTimestamp, packet.Timestamp)
+        }
+        report.ExpectedPackets += len(responseSet.Packets)
+        report.ExpectedBytes += len(expected)
+
+        _, err = conn.Write(make([]byte, responseSet.RequestLength))
+        if err != nil {
+            return nil, err
+        }
+        responseStartTime := time.Now().Add(responseSet.ThinkTime)
+        conn.SetReadDeadline(responseStartTime.Add(lastTimestamp + fidelitySlack))
+
+        // a packet has arrived once every byte up to its end has
+        received := make([]byte, 0, len(expected))
+        arrived := 0
+        for len(received) < len(expected) {
+            n, err := conn.Read(buffer)
+            arrivalTime := time.Now()
+            received = append(received, buffer[:n]...)
+            for arrived < len(ends) && len(received) >= ends[arrived] {
+                timingErrors = append(timingErrors, arrivalTime.Sub(responseStartTime.Add(responseSet.Packets[arrived].Timestamp)))
+                arrived++
+            }
+            if err != nil {
+                break
+            }
+        }
+        report.ReceivedBytes += len(received)
+        report.MissingPackets += len(responseSet.Packets) - arrived
+        report.ContentMismatch = report.ContentMismatch || !bytes.Equal(received, expected)
+
+        if arrived < len(responseSet.Packets) {
+            // the server stopped sending, so the rest of the replay is missing
+            for _, rest := range replayInfo.Responses[i + 1:] {
+                restSet := rest.(testdata.TCPResponseSet)
+                report.ExpectedPackets += len(restSet.Packets)
+                report.MissingPackets += len(restSet.Packets)
+                for _, packet := range restSet.Packets {
+                    report.ExpectedBytes += packet.Payload.Len()
+                }
+            }
+            break
+        }
+    }
+    return timingErrors, nil
+}
+
+// Runs a UDP replay like a client: sends one packet to start the replay, then receives packets until
+// every packet of the replay has arrived or the replay should have ended. Each packet received is
+// matched with the first packet of the replay file with the same payload that hasn't been matched.
+// connectedClients: the clients the server sends replays to, which includes the loopback client
+// replays: the replays the server sends the replay from
+// replayInfo: the replay
+// port: the port of the replay that the server pretends to listen on
+// report: the report to add the sizes and order of the replay to
+// Returns how late each packet arrived, or any errors
+func checkUDPFidelity(connectedClients *clienthandler.ConnectedClients, replays *testdata.Cache, replayInfo testdata.ReplayInfo, port int, report *FidelityReport) ([]time.Duration, error) {
+    serverConn, err := listenUDP(fidelityClientIP + ":0")
+    if err != nil {
+        return nil, err
+    }
+    defer serverConn.Close()
+    server := NewUDPServer(fidelityClientIP, port, connectedClients, ReplayErrorPolicies{Default: AbortOnError}, UDPPathMTU{}, replays)
+
+    clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(fidelityClientIP)})
+    if err != nil {
+        return nil, err
+    }
+    defer clientConn.Close()
+    err = clientConn.SetReadBuffer(fidelityReadBuffer)
+    if err != nil {
+        return nil, err
+    }
+    serverDone := make(chan struct{})
+    go func() {
+        defer close(serverDone)
+        buffer := make([]byte, 4096)
+        n, addr, err := serverConn.ReadFrom(buffer)
+        if err != nil {
+            return
+        }
+        server.handleConnection(serverConn, addr, buffer[:n])
+    }()
+
+    // the servers stop sending around the timeout of the replay, so packets scheduled after it aren't checked
+    replayTimeout := replayTimeoutOf(connectedClients, fidelityClientIP)
+    var expected []testdata.UDPPacket
+    payloadIndexes := make(map[string][]int) // the expected packets with each payload, in the order they are scheduled
+    var lastTimestamp time.Duration
+    for _, response := range udpPacketsForPort(replayInfo.Responses, port) {
+        packet := response.(testdata.UDPPacket)
+        if packet.Timestamp > replayTimeout {
+            report.AfterTimeout++
+            continue
+        }
+        payload := string(packet.Payload.AppendTo(nil))
+        payloadIndexes[payload] = append(payloadIndexes[payload], len(expected))
+        expected = append(expected, packet)
+        report.ExpectedBytes += len(payload)
+        lastTimestamp = max(lastTimestamp, packet.Timestamp)
+    }
+    report.ExpectedPackets = len(expected)
+
+    _, err = clientConn.WriteTo([]byte{0}, serverConn.LocalAddr())
+    if err != nil {
+        return nil, err
+    }
+    startTime := time.Now()
+    clientConn.SetReadDeadline(startTime.Add(lastTimestamp + fidelitySlack))
+
+    var timingErrors []time.Duration
+    lastArrived := make(map[string]int) // the latest scheduled packet of each flow that has arrived
+    arrived := 0
+    buffer := make([]byte, 65536)
+    for arrived < len(expected) {
+        n, _, err := clientConn.ReadFrom(buffer)
+        if errors.Is(err, os.ErrDeadlineExceeded) {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        arrivalTime := time.Now()
+        report.ReceivedBytes += n
+        indexes := payloadIndexes[string(buffer[:n])]
+        if len(indexes) == 0 {
+            report.UnexpectedPackets++
+            continue
+        }
+        index := indexes[0]
+        payloadIndexes[string(buffer[:n])] = indexes[1:]
+        arrived++
+
+        packet := expected[index]
+        timingErrors = append(timingErrors, arrivalTime.Sub(startTime.Add(packet.Timestamp)))
+        last, exists := lastArrived[packet.CSPair]
+        if exists && index < last {
+            report.OutOfOrderPackets++
+        } else {
+            lastArrived[packet.CSPair] = index
+        }
+    }
+    report.MissingPackets = len(expected) - arrived
+
+    // the server can still be sending packets that never arrived, which would fail once its socket
+    // is closed
+    select {
+    case <-serverDone:
+    case <-time.After(fidelitySlack):
+    }
+    return timingErrors, nil
+}
+
+// Adds how far off schedule the packets of the replay arrived to the report.
+// timingErrors: how late each packet arrived; negative if it was early
+func (report *FidelityReport) addTimingErrors(timingErrors []time.Duration) {
+    if len(timingErrors) == 0 {
+        return
+    }
+    var sum time.Duration
+    absErrors := make([]time.Duration, len(timingErrors))
+    for i, timingError := range timingErrors {
+        sum += timingError
+        absErrors[i] = timingError.Abs()
+    }
+    slices.Sort(absErrors)
+    report.TimingErrorMeanMs = milliseconds(sum / time.Duration(len(timingErrors)))
+    report.TimingErrorP95Ms = milliseconds(absErrors[int(math.Ceil(0.95 * float64(len(absErrors)))) - 1])
+    report.TimingErrorMaxMs = milliseconds(absErrors[len(absErrors) - 1])
+}
+
+// Converts a duration to milliseconds.
+// d: the duration
+// Returns the number of milliseconds
+func milliseconds(d time.Duration) float64 {
+    return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,708 @@
+// Serves the side channel over gRPC as an alternative to the binary side channel protocol, so that
+// new clients and integration tests can use stubs generated from proto/sidechannel.proto instead of
+// framing opcodes by hand. Tests run through the same clienthandler logic, connected clients, and
+// result files as tests on the binary side channel. A test spans several calls, so each test gets a
+// token when it is declared; a test ends once it is analyzed, when a call of the test fails, or
+// when its client stops calling.
+package network
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/tls"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/m-lab/uuid"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/credentials"
+    "google.golang.org/grpc/keepalive"
+    "google.golang.org/grpc/peer"
+    "google.golang.org/grpc/status"
+
+    "wehe-server/internal/analysis"
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/compat"
+    "wehe-server/internal/errs"
+    "wehe-server/internal/shutdown"
+    "wehe-server/internal/sidechannelpb"
+)
+
+const (
+    grpcTestTokenBytes = 16 // random bytes in a test token
+    grpcIdleTimeout = 5 * time.Minute // how long a test can go without a call when the side channel has no read timeout
+    grpcKeepaliveTime = time.Minute // how long a connection can be idle before the server pings the client
+    grpcKeepaliveTimeout = 20 * time.Second // how long the server waits for the client to answer a ping
+    grpcAnalyzingState = "analyzing" // the state streamed while a test is analyzed
+)
+
+// The side channel served over gRPC.
+type GRPCSideChannel struct {
+    sidechannelpb.UnimplementedSideChannelServer
+    Addr string // IP and port the gRPC side channel listens on
+    sideChannel SideChannel // the binary side channel, whose replays, clients, and results are shared
+    conns *grpcConns // the connections to the gRPC side channel
+    tests map[string]*grpcTest // the running tests; key is the test token
+    mutex sync.Mutex // protects tests
+}
+
+// A test run over the gRPC side channel.
+type grpcTest struct {
+    token string // identifies the test in the calls of the client
+    clt *clienthandler.Client // the client running the test
+    lastCall time.Time // when the client last called
+    ended bool // true once the test has ended and its results are written
+    mutex sync.Mutex // lets one call of the test run at a time
+}
+
+// Creates a new GRPCSideChannel. The binary side channel must already have its timeouts and minimum
+// client version set.
+// sideChannel: the binary side channel
+// addr: IP and port to listen on
+// Returns the gRPC side channel
+func NewGRPCSideChannel(sideChannel SideChannel, addr string) *GRPCSideChannel {
+    return &GRPCSideChannel{
+        Addr: addr,
+        sideChannel: sideChannel,
+        conns: &grpcConns{byAddr: make(map[string]*grpcConn)},
+        tests: make(map[string]*grpcTest),
+    }
+}
+
+// Binds the gRPC side channel port. TLS is added by the gRPC server, so the listener hands out the
+// TCP connections, which the M-Lab UUIDs of the tests are read from.
+// Returns the listener or any errors
+func (grpcSideChannel *GRPCSideChannel) Listen() (net.Listener, error) {
+    listener, err := net.Listen("tcp", grpcSideChannel.Addr)
+    if err != nil {
+        return nil, err
+    }
+    return &grpcListener{Listener: listener, conns: grpcSideChannel.conns}, nil
+}
+
+// Serves the gRPC side channel.
+// listener: the listener returned by Listen
+// tlsConfig: the TLS config of the side channel
+// errChan: channel used to communicate errors back to the main thread
+func (grpcSideChannel *GRPCSideChannel) StartServer(listener net.Listener, tlsConfig *tls.Config, errChan chan<- error) {
+    server := grpc.NewServer(
+        grpc.Creds(credentials.NewTLS(tlsConfig)),
+        grpc.KeepaliveParams(keepalive.ServerParameters{Time: grpcKeepaliveTime, Timeout: grpcKeepaliveTimeout}),
+    )
+    sidechannelpb.RegisterSideChannelServer(server, grpcSideChannel)
+
+    slog.Info("Listening on gRPC side channel", "addr", grpcSideChannel.Addr)
+    err := server.Serve(listener)
+    if errors.Is(err, net.ErrClosed) {
+        // the listener is closed when the server starts draining before it exits
+        slog.Info("Stopped listening on gRPC side channel", "addr", grpcSideChannel.Addr)
+        return
+    }
+    errChan <- err
+}
+
+// Ends tests whose client stopped calling, or that have run longer than a test can last, the same
+// way a test on the binary side channel ends when its client disconnects. This function should be
+// run in a new thread, as it never returns.
+func (grpcSideChannel *GRPCSideChannel) ReapIdleTests() {
+    idleTimeout := grpcSideChannel.sideChannel.Timeouts.Read
+    if idleTimeout == 0 {
+        idleTimeout = grpcIdleTimeout
+    }
+    maxTest := grpcSideChannel.sideChannel.Timeouts.MaxTest
+    for range time.Tick(reapInterval) {
+        grpcSideChannel.mutex.Lock()
+        tests := make([]*grpcTest, 0, len(grpcSideChannel.tests))
+        for _, test := range grpcSideChannel.tests {
+            tests = append(tests, test)
+        }
+        grpcSideChannel.mutex.Unlock()
+
+        now := grpcSideChannel.sideChannel.Clock.Now()
+        for _, test := range tests {
+            // a test with a call in progress isn't idle; calls whose client is gone are ended by
+            // the keepalive pings
+            if !test.mutex.TryLock() {
+                continue
+            }
+            if err := test.expired(now, idleTimeout, maxTest); err != nil {
+                grpcSideChannel.end(test, err)
+            }
+            test.mutex.Unlock()
+        }
+    }
+}
+
+// Checks if a test should be ended because its client stopped calling or it has run longer than a
+// test can last. The test must be locked.
+// now: the current time
+// idleTimeout: how long the client can go between calls
+// maxTest: how long a test can last; 0 for no limit
+// Returns an error wrapping errs.ErrTimedOut if the test should be ended, or nil
+func (test *grpcTest) expired(now time.Time, idleTimeout time.Duration, maxTest time.Duration) error {
+    if now.Sub(test.lastCall) > idleTimeout {
+        return fmt.Errorf("%w between calls (idle timeout %v)", errs.ErrTimedOut, idleTimeout)
+    }
+    if maxTest > 0 && now.Sub(test.clt.StartTime) > maxTest {
+        return fmt.Errorf("%w before finishing the test (max test duration %v)", errs.ErrTimedOut, maxTest)
+    }
+    return nil
+}
+
+// Declares a test and its first replay.
+func (grpcSideChannel *GRPCSideChannel) DeclareTest(ctx context.Context, req *sidechannelpb.DeclareTestRequest) (*sidechannelpb.DeclareTestResponse, error) {
+    defer shutdown.RecoverPanic()
+    conn, err := grpcSideChannel.conns.fromContext(ctx)
+    if err != nil {
+        return nil, grpcError(err)
+    }
+    replayID, err := grpcReplayType(req.GetReplayType())
+    if err != nil {
+        return nil, grpcError(err)
+    }
+    maxDuration, err := clienthandler.ParseMaxReplayDuration(formatSeconds(req.GetMaxDurationSeconds()))
+    if err != nil {
+        return nil, grpcError(err)
+    }
+    requestedSamples, err := clienthandler.ParseSamplesPerReplay(strconv.Itoa(int(req.GetSamplesPerReplay())))
+    if err != nil {
+        return nil, grpcError(err)
+    }
+    experimentFlags, err := clienthandler.ParseExperimentFlags(req.GetExperimentFlags())
+    if err != nil {
+        return nil, grpcError(err)
+    }
+    publicIP, err := clientTestPortIP(req.GetTestPortIp(), conn)
+    if err != nil {
+        return nil, grpcError(err)
+    }
+    if conn.uuidErr != nil {
+        return nil, grpcError(conn.uuidErr)
+    }
+    token, err := newGRPCTestToken()
+    if err != nil {
+        return nil, grpcError(err)
+    }
+
+    clientVersion := req.GetClientVersion()
+    test := &grpcTest{
+        token: token,
+        lastCall: grpcSideChannel.sideChannel.Clock.Now(),
+    }
+    testConn := grpcTestConn{Conn: conn, close: func() {
+        grpcSideChannel.abort(test)
+    }}
+    clt := clienthandler.NewClient(testConn, req.GetUserId(), req.GetExtraString(), int(req.GetTestId()), publicIP, clientVersion, conn.mlabUUID)
+    clt.ExperimentFlags = experimentFlags
+    // gRPC clients read the structured fields of every response
+    clt.Capabilities.MaintenanceRetryAfter = true
+    clt.Capabilities.ServerTime = true
+    clt.AddReplay(replayID, compat.ReplayName(req.GetReplayName(), clt.Capabilities), req.GetIsLastReplay())
+    clt.SetMaxReplayDuration(maxDuration)
+    clt.NegotiateSamplesPerReplay(requestedSamples)
+    if req.GetWantsReplayToken() {
+        err = clt.IssueReplayToken()
+        if err != nil {
+            return nil, grpcError(err)
+        }
+    }
+    test.clt = clt
+
+    if grpcSideChannel.sideChannel.requiresUpgrade(clientVersion) {
+        err = grpcSideChannel.sideChannel.upgradeRequiredError(clientVersion)
+        handleSideChannelError(clt.Logger(), err)
+        return nil, status.Errorf(grpcCode(err), "Client must upgrade to %s or newer", grpcSideChannel.sideChannel.MinClientVersion)
+    }
+    err = clt.CheckDuplicateTest(grpcSideChannel.sideChannel.TmpResultsDir, grpcSideChannel.sideChannel.DuplicateTestPolicy)
+    if err != nil {
+        handleSideChannelError(clt.Logger(), err)
+        return nil, grpcError(err)
+    }
+
+    grpcSideChannel.sideChannel.InFlightTests.Add(clt)
+    grpcSideChannel.mutex.Lock()
+    grpcSideChannel.tests[token] = test
+    grpcSideChannel.mutex.Unlock()
+    clt.Logger().Info("Client connected", "client_version", clt.ClientVersion, "mlab_uuid", clt.MLabUUID, "transport", "grpc")
+    return &sidechannelpb.DeclareTestResponse{TestToken: token, ReplayToken: clt.ReplayToken}, nil
+}
+
+// Declares the next replay of a test.
+func (grpcSideChannel *GRPCSideChannel) DeclareReplay(ctx context.Context, req *sidechannelpb.DeclareReplayRequest) (*sidechannelpb.DeclareReplayResponse, error) {
+    defer shutdown.RecoverPanic()
+    test, err := grpcSideChannel.startCall(req.GetTestToken())
+    if err != nil {
+        return nil, err
+    }
+    defer test.mutex.Unlock()
+
+    replayID, err := grpcReplayType(req.GetReplayType())
+    if err != nil {
+        return nil, grpcSideChannel.fail(test, err)
+    }
+    // the declare replay message of the binary protocol
+    message := fmt.Sprintf("%d;%s;%t;%s;%d", replayID, req.GetReplayName(), req.GetIsLastReplay(), formatSeconds(req.GetMaxDurationSeconds()), req.GetSamplesPerReplay())
+    replayStatus, info, err := test.clt.DeclareReplay(grpcSideChannel.sideChannel.Replays.Names(), message)
+    if err != nil {
+        return nil, grpcSideChannel.fail(test, err)
+    }
+    grpcSideChannel.sideChannel.InFlightTests.SetState(test.clt, clienthandler.TestDeclared)
+    var replayTimeout time.Duration
+    if replayStatus == clienthandler.Ask4PermissionOkStatus {
+        grpcSideChannel.sideChannel.startLossCapture(test.clt)
+        replayTimeout, err = grpcSideChannel.sideChannel.negotiateReplayTimeout(test.clt)
+        if err != nil {
+            return nil, grpcSideChannel.fail(test, err)
+        }
+    }
+    permission, err := grpcPermission(replayStatus, info)
+    if err != nil {
+        return nil, grpcSideChannel.fail(test, err)
+    }
+    permission.ReplayTimeoutSeconds = replayTimeout.Seconds()
+    return &sidechannelpb.DeclareReplayResponse{Permission: permission}, nil
+}
+
+// Asks to run the current replay of a test.
+func (grpcSideChannel *GRPCSideChannel) Ask4Permission(ctx context.Context, req *sidechannelpb.Ask4PermissionRequest) (*sidechannelpb.Ask4PermissionResponse, error) {
+    defer shutdown.RecoverPanic()
+    test, err := grpcSideChannel.startCall(req.GetTestToken())
+    if err != nil {
+        return nil, err
+    }
+    defer test.mutex.Unlock()
+
+    replayStatus, info, err := test.clt.Ask4Permission(grpcSideChannel.sideChannel.Replays.Names(), grpcSideChannel.sideChannel.ConnectedClients)
+    if err != nil {
+        return nil, grpcSideChannel.fail(test, err)
+    }
+    var replayTimeout time.Duration
+    if replayStatus == clienthandler.Ask4PermissionOkStatus {
+        grpcSideChannel.sideChannel.InFlightTests.SetState(test.clt, clienthandler.TestReplaying)
+        grpcSideChannel.sideChannel.startLossCapture(test.clt)
+        replayTimeout, err = grpcSideChannel.sideChannel.negotiateReplayTimeout(test.clt)
+        if err != nil {
+            return nil, grpcSideChannel.fail(test, err)
+        }
+    }
+    permission, err := grpcPermission(replayStatus, info)
+    if err != nil {
+        return nil, grpcSideChannel.fail(test, err)
+    }
+    permission.ReplayTimeoutSeconds = replayTimeout.Seconds()
+    return &sidechannelpb.Ask4PermissionResponse{Permission: permission}, nil
+}
+
+// Receives the throughputs of the current replay of a test and writes its replay info.
+func (grpcSideChannel *GRPCSideChannel) SubmitThroughputs(stream sidechannelpb.SideChannel_SubmitThroughputsServer) error {
+    defer shutdown.RecoverPanic()
+    chunk, err := stream.Recv()
+    if err != nil {
+        return err
+    }
+    test, err := grpcSideChannel.startCall(chunk.GetTestToken())
+    if err != nil {
+        return err
+    }
+    defer test.mutex.Unlock()
+
+    replayDuration := chunk.GetReplayDurationSeconds()
+    throughputs := []float64{}
+    sampleTimes := []float64{}
+    for {
+        throughputs = append(throughputs, chunk.GetThroughputs()...)
+        sampleTimes = append(sampleTimes, chunk.GetSampleTimes()...)
+        if len(throughputs) > clienthandler.MaxThroughputSamples || len(sampleTimes) > clienthandler.MaxThroughputSamples {
+            err = &errs.LimitError{Kind: errs.ErrTooManySamples, Limit: clienthandler.MaxThroughputSamples, Message: fmt.Sprintf("more than %d received", clienthandler.MaxThroughputSamples)}
+            return grpcSideChannel.fail(test, err)
+        }
+        chunk, err = stream.Recv()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return grpcSideChannel.fail(test, fmt.Errorf("%w: %w", errs.ErrClientGone, err))
+        }
+    }
+
+    sideChannel := grpcSideChannel.sideChannel
+    err = sideChannel.collectReplayErrors(test.clt)
+    if err != nil {
+        return grpcSideChannel.fail(test, err)
+    }
+    err = sideChannel.collectReplayLoss(test.clt)
+    if err != nil {
+        return grpcSideChannel.fail(test, err)
+    }
+    // the throughputs message of the binary protocol
+    throughputsAndSampleTimes, err := json.Marshal([][]float64{throughputs, sampleTimes})
+    if err != nil {
+        return grpcSideChannel.fail(test, errs.Malformed(err))
+    }
+    err = test.clt.ReceiveThroughputs(formatSeconds(replayDuration) + ";" + string(throughputsAndSampleTimes), sideChannel.TmpResultsDir)
+    if err != nil {
+        return grpcSideChannel.fail(test, err)
+    }
+    // kept alongside the throughputs of the client to check them against
+    err = test.clt.SampleServerThroughputs(sideChannel.ConnectedClients, sideChannel.TmpResultsDir)
+    if err != nil {
+        return grpcSideChannel.fail(test, err)
+    }
+    err = test.clt.WriteReplayInfoToFile(sideChannel.TmpResultsDir)
+    if err != nil {
+        return grpcSideChannel.fail(test, err)
+    }
+    sideChannel.InFlightTests.SetState(test.clt, clienthandler.TestReplayDone)
+
+    currentReplay, err := test.clt.GetCurrentReplay()
+    if err != nil {
+        return grpcSideChannel.fail(test, err)
+    }
+    return stream.SendAndClose(&sidechannelpb.SubmitThroughputsResponse{
+        Aborted: currentReplay.Aborted,
+        ReplayErrors: currentReplay.ReplayErrors,
+    })
+}
+
+// Analyzes a test, streams the result, and ends the test.
+func (grpcSideChannel *GRPCSideChannel) AnalyzeTest(req *sidechannelpb.AnalyzeTestRequest, stream sidechannelpb.SideChannel_AnalyzeTestServer) error {
+    defer shutdown.RecoverPanic()
+    test, err := grpcSideChannel.startCall(req.GetTestToken())
+    if err != nil {
+        return err
+    }
+    defer test.mutex.Unlock()
+
+    sideChannel := grpcSideChannel.sideChannel
+    sideChannel.InFlightTests.SetState(test.clt, clienthandler.TestAnalyzing)
+    err = stream.Send(&sidechannelpb.AnalyzeTestUpdate{Update: &sidechannelpb.AnalyzeTestUpdate_State{State: grpcAnalyzingState}})
+    if err != nil {
+        return grpcSideChannel.fail(test, fmt.Errorf("%w: %w", errs.ErrClientGone, err))
+    }
+    err = test.clt.AnalyzeTest(sideChannel.TmpResultsDir)
+    if err == nil {
+        err = test.clt.WriteResultsToFile(sideChannel.TmpResultsDir)
+    }
+    if err == nil {
+        err = test.clt.WriteSideChannelRTTsToFile(sideChannel.TmpResultsDir)
+    }
+    if err != nil {
+        return grpcSideChannel.fail(test, err)
+    }
+    sideChannel.InFlightTests.SetState(test.clt, clienthandler.TestAnalyzed)
+
+    analysisResults := test.clt.Analysis
+    err = stream.Send(&sidechannelpb.AnalyzeTestUpdate{Update: &sidechannelpb.AnalyzeTestUpdate_Result{Result: &sidechannelpb.AnalysisResult{
+        Area0Var: analysisResults.Area0var,
+        Ks2PVal: analysisResults.KS2pVal,
+        OriginalAvgThroughput: analysisResults.OriginalReplayStats.Average,
+        RandomAvgThroughput: analysisResults.RandomReplayStats.Average,
+        Differentiation: analysisResults.Differentiation,
+        Policy: analysisResults.Policy.Name,
+        Verdict: &sidechannelpb.Verdict{
+            Name: analysisResults.Verdict.Verdict,
+            AreaAboveThreshold: analysisResults.Verdict.Checks.AreaAboveThreshold,
+            Ks2PValBelowThreshold: analysisResults.Verdict.Checks.KS2pValBelowThreshold,
+            AcceptRatioMet: analysisResults.Verdict.Checks.AcceptRatioMet,
+            Inconclusive: analysisResults.Verdict.Inconclusive,
+        },
+        Variants: grpcVariantResults(test.clt),
+        Localization: grpcLocalization(test.clt.Localization),
+    }}})
+    summary := grpcSideChannel.end(test, nil)
+    if err != nil {
+        return err
+    }
+    return stream.Send(&sidechannelpb.AnalyzeTestUpdate{Update: &sidechannelpb.AnalyzeTestUpdate_Summary{Summary: grpcTestSummary(summary)}})
+}
+
+// Ends a test that the client won't analyze.
+func (grpcSideChannel *GRPCSideChannel) EndTest(ctx context.Context, req *sidechannelpb.EndTestRequest) (*sidechannelpb.TestSummary, error) {
+    defer shutdown.RecoverPanic()
+    test, err := grpcSideChannel.startCall(req.GetTestToken())
+    if err != nil {
+        return nil, err
+    }
+    defer test.mutex.Unlock()
+    summary := grpcSideChannel.end(test, nil)
+    test.clt.Logger().Info("Client ended test", "test_ref", summary.TestRef, "analyzed", summary.Analyzed, "transport", "grpc")
+    return grpcTestSummary(summary), nil
+}
+
+// Starts a call of a test. Calls of a test run one at a time; the caller must unlock the test when
+// the call is done.
+// token: the token of the test
+// Returns the locked test, or an error if there is no running test with the token
+func (grpcSideChannel *GRPCSideChannel) startCall(token string) (*grpcTest, error) {
+    grpcSideChannel.mutex.Lock()
+    test, exists := grpcSideChannel.tests[token]
+    grpcSideChannel.mutex.Unlock()
+    if !exists {
+        return nil, grpcError(fmt.Errorf("%w with this token; was it declared, or has it ended?", errs.ErrNoTest))
+    }
+    test.mutex.Lock()
+    if test.ended {
+        test.mutex.Unlock()
+        return nil, grpcError(fmt.Errorf("%w: the test has ended", errs.ErrNoTest))
+    }
+    test.lastCall = grpcSideChannel.sideChannel.Clock.Now()
+    return test, nil
+}
+
+// Ends a test whose call failed, as the binary side channel does when a request fails. The test
+// must be locked.
+// test: the test
+// err: the error that failed the call
+// Returns the error to send to the client, with the status code of the kind of err
+func (grpcSideChannel *GRPCSideChannel) fail(test *grpcTest, err error) error {
+    grpcSideChannel.end(test, err)
+    return grpcError(err)
+}
+
+// Ends a test, writing its manifest, recording it in the daily report, and freeing its client IP.
+// The test must be locked; ending a test that has already ended does nothing.
+// test: the test
+// testErr: the error that ended the test, or nil if the test ended normally
+// Returns what was stored for the test; empty if the test had already ended
+func (grpcSideChannel *GRPCSideChannel) end(test *grpcTest, testErr error) clienthandler.TestSummary {
+    if test.ended {
+        return clienthandler.TestSummary{}
+    }
+    test.ended = true
+    grpcSideChannel.mutex.Lock()
+    delete(grpcSideChannel.tests, test.token)
+    grpcSideChannel.mutex.Unlock()
+
+    if testErr != nil {
+        handleSideChannelError(test.clt.Logger(), testErr)
+    }
+    sideChannel := grpcSideChannel.sideChannel
+    summary := sideChannel.finalizeTest(test.clt, testErr)
+    test.clt.CleanUp(sideChannel.ConnectedClients)
+    sideChannel.InFlightTests.Remove(test.clt)
+    return summary
+}
+
+// Ends a test that the server is stopping because it is exiting.
+// test: the test
+func (grpcSideChannel *GRPCSideChannel) abort(test *grpcTest) {
+    test.mutex.Lock()
+    defer test.mutex.Unlock()
+    grpcSideChannel.end(test, errors.New("Test stopped because the server is exiting"))
+}
+
+// Converts a replay type of the gRPC side channel. The numbers of the replay types are the same as
+// in the binary protocol.
+// replayType: the replay type sent by the client
+// Returns the replay type or an error if it isn't a known replay type
+func grpcReplayType(replayType sidechannelpb.ReplayType) (clienthandler.ReplayType, error) {
+    return clienthandler.ParseReplayType(strconv.Itoa(int(replayType)))
+}
+
+// Converts the comparisons of the control replays of a test against its original replay.
+// clt: the test
+// Returns the comparisons
+func grpcVariantResults(clt *clienthandler.Client) []*sidechannelpb.VariantResult {
+    var variants []*sidechannelpb.VariantResult
+    for _, variant := range clt.VariantResults {
+        variants = append(variants, &sidechannelpb.VariantResult{
+            ReplayType: sidechannelpb.ReplayType(variant.ReplayType),
+            ReplayName: variant.ReplayName,
+            Differentiation: variant.Differentiation,
+            Area0Var: variant.Area0var,
+            Ks2PVal: variant.KS2pVal,
+            OriginalAvgThroughput: variant.OriginalAvgThroughput,
+            VariantAvgThroughput: variant.VariantAvgThroughput,
+        })
+    }
+    return variants
+}
+
+// Converts what was stored for a test that has ended.
+// summary: the summary of the test
+// Returns the summary
+func grpcTestSummary(summary clienthandler.TestSummary) *sidechannelpb.TestSummary {
+    return &sidechannelpb.TestSummary{
+        TestRef: summary.TestRef,
+        Files: int32(summary.Files),
+        Replays: int32(summary.Replays),
+        Analyzed: summary.Analyzed,
+        Verdict: summary.Verdict,
+    }
+}
+
+// Converts the comparison of the packets the server retransmitted during the replays of a test.
+// localization: the comparison; nil if the packets weren't captured
+// Returns the comparison, or nil if there is none
+func grpcLocalization(localization *analysis.LocalizationResults) *sidechannelpb.Localization {
+    if localization == nil {
+        return nil
+    }
+    result := &sidechannelpb.Localization{
+        Result: localization.Result,
+        Overall: grpcPortLoss(localization.Overall),
+    }
+    for _, portLoss := range localization.Ports {
+        result.Ports = append(result.Ports, grpcPortLoss(portLoss))
+    }
+    return result
+}
+
+// Converts the comparison of the packets retransmitted on one port.
+// portLoss: the comparison
+// Returns the comparison
+func grpcPortLoss(portLoss analysis.PortLoss) *sidechannelpb.PortLoss {
+    return &sidechannelpb.PortLoss{
+        Port: int32(portLoss.Port),
+        OriginalLossRate: portLoss.Original.LossRate(),
+        RandomLossRate: portLoss.Random.LossRate(),
+        LossDiff: portLoss.LossDiff,
+        PVal: portLoss.PVal,
+        Differentiation: portLoss.Differentiation,
+        OriginalRttMs: portLoss.Original.RTTMeanMs,
+        RandomRttMs: portLoss.Random.RTTMeanMs,
+    }
+}
+
+// Converts the status and information returned by Ask4Permission or DeclareReplay.
+// replayStatus: the status, Ask4PermissionOkStatus or Ask4PermissionErrorStatus
+// info: the information; <samples per replay>[;<unix time in ns>;<ns since connecting>] if
+//     permission was granted, or <failure code>[;<seconds until retry>] if it wasn't
+// Returns the permission or any errors
+func grpcPermission(replayStatus string, info string) (*sidechannelpb.Permission, error) {
+    pieces := strings.Split(info, ";")
+    values := make([]int64, len(pieces))
+    for i, piece := range pieces {
+        value, err := strconv.ParseInt(piece, 10, 64)
+        if err != nil {
+            return nil, fmt.Errorf("Unable to parse permission info %s: %v", info, err)
+        }
+        values[i] = value
+    }
+
+    permission := &sidechannelpb.Permission{}
+    if replayStatus == clienthandler.Ask4PermissionOkStatus {
+        permission.Granted = true
+        permission.SamplesPerReplay = int32(values[0])
+        if len(values) == 3 {
+            permission.ServerTimeUnixNs = values[1]
+            permission.NsSinceDeclare = values[2]
+        }
+        return permission, nil
+    }
+    permission.Denial = sidechannelpb.Denial(values[0])
+    if (permission.Denial == sidechannelpb.Denial_MAINTENANCE || permission.Denial == sidechannelpb.Denial_SERVER_BUSY) && len(values) > 1 {
+        permission.RetryAfterSeconds = int32(values[1])
+    }
+    return permission, nil
+}
+
+// Formats seconds the way the binary protocol sends them.
+// seconds: the seconds
+// Returns the seconds as a string
+func formatSeconds(seconds float64) string {
+    return strconv.FormatFloat(seconds, 'f', -1, 64)
+}
+
+// Creates a token that identifies a test in the calls of its client.
+// Returns the token or any errors
+func newGRPCTestToken() (string, error) {
+    token := make([]byte, grpcTestTokenBytes)
+    _, err := rand.Read(token)
+    if err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(token), nil
+}
+
+// The connection of a gRPC test as the in flight tests see it. A gRPC connection can carry several
+// tests, so closing it ends the test instead of the connection.
+type grpcTestConn struct {
+    net.Conn // the connection the test was declared on
+    close func() // ends the test
+}
+
+// Ends the test in the background, since it may be closed while the in flight tests are locked.
+func (conn grpcTestConn) Close() error {
+    go conn.close()
+    return nil
+}
+
+// The open connections to the gRPC side channel, so that calls can find the connection they came in
+// on.
+type grpcConns struct {
+    byAddr map[string]*grpcConn // key is the remote address of the connection
+    mutex sync.Mutex // protects byAddr
+}
+
+// A connection to the gRPC side channel.
+type grpcConn struct {
+    *net.TCPConn
+    mlabUUID string // globally unique ID of the connection for M-Lab
+    uuidErr error // the error reading mlabUUID, if any
+    conns *grpcConns // the open connections, which the connection leaves when it is closed
+}
+
+// Closes the connection and forgets it.
+func (conn *grpcConn) Close() error {
+    conn.conns.mutex.Lock()
+    delete(conn.conns.byAddr, conn.RemoteAddr().String())
+    conn.conns.mutex.Unlock()
+    return conn.TCPConn.Close()
+}
+
+// Finds the connection a call came in on.
+// ctx: the context of the call
+// Returns the connection or an error if it isn't open
+func (conns *grpcConns) fromContext(ctx context.Context) (*grpcConn, error) {
+    callPeer, ok := peer.FromContext(ctx)
+    if !ok {
+        return nil, errors.New("Call has no peer")
+    }
+    conns.mutex.Lock()
+    defer conns.mutex.Unlock()
+    conn, exists := conns.byAddr[callPeer.Addr.String()]
+    if !exists {
+        return nil, fmt.Errorf("No connection from %s", callPeer.Addr)
+    }
+    return conn, nil
+}
+
+// Hands the connections to the gRPC side channel to the gRPC server, keeping track of them.
+type grpcListener struct {
+    net.Listener
+    conns *grpcConns // the open connections
+}
+
+// Accepts a connection and reads its M-Lab UUID.
+func (listener *grpcListener) Accept() (net.Conn, error) {
+    conn, err := listener.Listener.Accept()
+    if err != nil {
+        return nil, err
+    }
+    tcpConn, ok := conn.(*net.TCPConn)
+    if !ok {
+        conn.Close()
+        return nil, errors.New("gRPC side channel expected a TCP connection")
+    }
+    mlabUUID, uuidErr := uuid.FromTCPConn(tcpConn)
+    grpcConn := &grpcConn{
+        TCPConn: tcpConn,
+        mlabUUID: mlabUUID,
+        uuidErr: uuidErr,
+        conns: listener.conns,
+    }
+    listener.conns.mutex.Lock()
+    listener.conns.byAddr[conn.RemoteAddr().String()] = grpcConn
+    listener.conns.mutex.Unlock()
+    return grpcConn, nil
+}
@@ -0,0 +1,102 @@
+// Classifies failed TLS handshakes on the side channel. Networks that block or tamper with TLS to
+// the measurement server are worth knowing about, so each failure is counted by its cause.
+package network
+
+import (
+    "crypto/tls"
+    "errors"
+    "io"
+    "log/slog"
+    "net"
+    "strings"
+    "syscall"
+    "time"
+
+    "wehe-server/internal/metrics"
+)
+
+const (
+    tlsHandshakeTimeout = 30 * time.Second // time the client has to finish the TLS handshake of the side channel
+)
+
+// Causes of failed TLS handshakes
+const (
+    handshakeTimeout = "timeout" // the client didn't finish the handshake in time
+    handshakeClosed = "closed" // the connection was closed before the handshake finished
+    handshakeReset = "reset" // the connection was reset during the handshake
+    handshakeCertRejected = "cert_rejected" // the client didn't accept the server certificate
+    handshakeProtocolVersion = "protocol_version" // the client and server have no TLS version in common
+    handshakeNoSharedCipher = "no_shared_cipher" // the client and server have no cipher suite in common
+    handshakeNotTLS = "not_tls" // the client sent something other than a TLS handshake
+    handshakeAlert = "alert" // the client aborted the handshake with another TLS alert
+    handshakeOther = "other" // any other error
+)
+
+var tlsHandshakeFailures = metrics.NewCounterVec("wehe_side_channel_tls_handshake_failures_total",
+    "Number of side channel TLS handshakes that failed, by cause.", "cause")
+
+// Gets the number of side channel TLS handshakes that have failed for each cause.
+// Returns the number of failures; key is the cause
+func TLSHandshakeFailures() map[string]uint64 {
+    return tlsHandshakeFailures.Snapshot()
+}
+
+// Finishes the TLS handshake of a side channel connection, counting the cause if it fails.
+// conn: the client side channel connection
+// Returns any errors
+func handshake(conn net.Conn) error {
+    tlsConn, ok := conn.(*tls.Conn)
+    if !ok {
+        return nil
+    }
+    err := tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+    if err != nil {
+        return err
+    }
+    err = tlsConn.Handshake()
+    if err != nil {
+        cause := handshakeFailureCause(err)
+        tlsHandshakeFailures.Inc(cause)
+        slog.Info("Side channel TLS handshake failed", "client", conn.RemoteAddr(), "cause", cause, "error", err)
+        return err
+    }
+    return tlsConn.SetDeadline(time.Time{})
+}
+
+// Classifies why a TLS handshake failed.
+// err: the error returned by the handshake
+// Returns the cause of the failure
+func handshakeFailureCause(err error) string {
+    var netErr net.Error
+    if errors.As(err, &netErr) && netErr.Timeout() {
+        return handshakeTimeout
+    }
+    if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+        return handshakeClosed
+    }
+    if errors.Is(err, syscall.ECONNRESET) {
+        return handshakeReset
+    }
+
+    // crypto/tls only reports alerts from the client and problems found by the server as messages
+    message := err.Error()
+    if strings.Contains(message, "remote error") {
+        switch {
+        case strings.Contains(message, "certificate"): // bad, unsupported, revoked, expired, or unknown certificate, or unknown CA
+            return handshakeCertRejected
+        case strings.Contains(message, "protocol version"):
+            return handshakeProtocolVersion
+        default:
+            return handshakeAlert
+        }
+    }
+    switch {
+    case strings.Contains(message, "unsupported versions"):
+        return handshakeProtocolVersion
+    case strings.Contains(message, "no cipher suite supported"):
+        return handshakeNoSharedCipher
+    case strings.Contains(message, "does not look like a TLS handshake"):
+        return handshakeNotTLS
+    }
+    return handshakeOther
+}
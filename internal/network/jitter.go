@@ -0,0 +1,80 @@
+// Measures the jitter of UDP replays on the replay servers.
+package network
+
+import (
+    "math"
+    "time"
+
+    "wehe-server/internal/clienthandler"
+)
+
+const (
+    jitterGain = 16 // each difference moves the jitter by 1/16 of its distance from it, as in RFC 3550
+)
+
+// Smooths the differences between successive values of a series of packets, e.g. how late each
+// packet was sent, into one jitter, as for the interarrival jitter of RFC 3550. Not safe for
+// concurrent use.
+type jitterEstimator struct {
+    packets int // packets added to the series
+    jitter float64 // the smoothed mean of the differences, in seconds
+    last float64 // the value of the last packet, in seconds
+    min float64 // the smallest value, in seconds
+    max float64 // the largest value, in seconds
+}
+
+// Adds the value of the next packet of the series.
+// value: the value of the packet
+func (estimator *jitterEstimator) add(value time.Duration) {
+    seconds := value.Seconds()
+    if estimator.packets == 0 {
+        estimator.min = seconds
+        estimator.max = seconds
+    } else {
+        difference := math.Abs(seconds - estimator.last)
+        estimator.jitter += (difference - estimator.jitter) / jitterGain
+        estimator.min = math.Min(estimator.min, seconds)
+        estimator.max = math.Max(estimator.max, seconds)
+    }
+    estimator.last = seconds
+    estimator.packets++
+}
+
+// Measures the jitter of packets arriving from a client, from the gaps between them. The client sends
+// no timestamps, so the gaps are compared with each other instead of with when the packets were sent.
+// Not safe for concurrent use.
+type arrivalJitter struct {
+    lastArrival time.Time // when the last packet arrived; zero until one does
+    gaps jitterEstimator // the gaps between successive packets
+}
+
+// Adds a packet that arrived from the client.
+// arrival: when the packet arrived
+func (arrivals *arrivalJitter) add(arrival time.Time) {
+    if !arrivals.lastArrival.IsZero() {
+        arrivals.gaps.add(arrival.Sub(arrivals.lastArrival))
+    }
+    arrivals.lastArrival = arrival
+}
+
+// Builds the jitter report of a replay.
+// sendDelays: the delays from when each packet was scheduled to when it was sent
+// arrivals: the packets that arrived from the client
+// Returns the report
+func newJitterReport(sendDelays jitterEstimator, arrivals arrivalJitter) clienthandler.JitterReport {
+    report := clienthandler.JitterReport{
+        SentPackets: sendDelays.packets,
+        SendJitterMs: sendDelays.jitter * 1000,
+        ReceiveJitterMs: arrivals.gaps.jitter * 1000,
+    }
+    if sendDelays.packets > 0 {
+        report.SendDelayMinMs = sendDelays.min * 1000
+        report.SendDelayMaxMs = sendDelays.max * 1000
+        report.SendDelayVariationMs = (sendDelays.max - sendDelays.min) * 1000
+    }
+    // the first packet has no gap before it
+    if !arrivals.lastArrival.IsZero() {
+        report.ReceivedPackets = arrivals.gaps.packets + 1
+    }
+    return report
+}
@@ -0,0 +1,265 @@
+// Captures the TCP packets of each replay to count the packets the server retransmitted to the client
+// and the RTTs of the packets it didn't, for the localization analysis that tells throttling apart
+// from congestion. One capture of the interface runs for the whole life of the server, since live
+// captures can't be opened once the server has switched to run_as_user; its packets are handed to
+// the replays running at the time by the IP of their client. Nothing is written to disk.
+package network
+
+import (
+    "net"
+    "slices"
+    "sync"
+    "time"
+
+    "github.com/google/gopacket"
+    "github.com/google/gopacket/layers"
+
+    "wehe-server/internal/analysis"
+    "wehe-server/internal/clienthandler"
+)
+
+const (
+    maxPendingSegments = 65536 // segments of a connection waiting for their ACK; later segments get no RTT
+)
+
+// A segment sent by the server that hasn't been acknowledged yet.
+type pendingSegment struct {
+    end uint32 // the sequence number after the last byte of the segment
+    sentTime time.Time // when the segment was captured
+}
+
+// The packets of one TCP connection of a replay.
+type lossConnection struct {
+    serverPort int // the port of the replay server
+    started bool // true once the server has sent a segment with a payload
+    highestEnd uint32 // the sequence number after the last byte the server has sent
+    pending []pendingSegment // segments waiting for their ACK, in the order they were sent
+    stats analysis.LossStats // the packets of the connection; RTTMeanMs is only set when stats are taken
+    rttSumMs float64 // sum of the RTTs measured, in milliseconds
+}
+
+// Counts a segment with a payload that the server sent. A segment that ends at or before the highest
+// sequence number sent so far is a retransmission; ACKs of segments sent before it can't tell which
+// copy they acknowledge, so those segments get no RTT (Karn's algorithm).
+// seq: the sequence number of the segment
+// length: bytes in the payload of the segment
+// timestamp: when the segment was captured
+func (conn *lossConnection) sent(seq uint32, length int, timestamp time.Time) {
+    conn.stats.DataPackets++
+    end := seq + uint32(length)
+    if conn.started && int32(end - conn.highestEnd) <= 0 {
+        conn.stats.Retransmissions++
+        conn.pending = conn.pending[:0]
+        return
+    }
+    conn.started = true
+    conn.highestEnd = end
+    if len(conn.pending) < maxPendingSegments {
+        conn.pending = append(conn.pending, pendingSegment{end: end, sentTime: timestamp})
+    }
+}
+
+// Takes an RTT sample from an ACK of the client. Only the last segment an ACK covers is sampled, so
+// that delayed ACKs don't add samples for every segment they acknowledge.
+// ack: the acknowledgement number
+// timestamp: when the ACK was captured
+func (conn *lossConnection) acked(ack uint32, timestamp time.Time) {
+    covered := 0
+    for covered < len(conn.pending) && int32(ack - conn.pending[covered].end) >= 0 {
+        covered++
+    }
+    if covered == 0 {
+        return
+    }
+    conn.stats.RTTSamples++
+    conn.rttSumMs += milliseconds(timestamp.Sub(conn.pending[covered - 1].sentTime))
+    conn.pending = conn.pending[covered:]
+}
+
+// The packets captured for the replay of one client.
+type lossCapture struct {
+    connections map[int]*lossConnection // the TCP connections of the replay; key is the client port
+}
+
+// Captures the packets of the replays of every client.
+type LossCaptures struct {
+    handle captureHandle // the capture of the interface
+    ignoredPorts []int // server ports whose packets aren't replays, e.g. the side channel
+    active map[string]*lossCapture // the captures of the replays running; key is the IP of the client
+    mutex sync.Mutex // protects active
+}
+
+// Opens the capture used to measure the packets of replays. This should be called before the server
+// switches to run_as_user.
+// iface: the interface to capture packets on, or file:<path> to read the packets of a PCAP file
+// ignoredPorts: server ports whose packets aren't replays, e.g. the side channel port
+// Returns the captures or any errors
+func NewLossCaptures(iface string, ignoredPorts []int) (*LossCaptures, error) {
+    handle, err := openCapture(iface)
+    if err != nil {
+        return nil, err
+    }
+    return &LossCaptures{
+        handle: handle,
+        ignoredPorts: ignoredPorts,
+        active: make(map[string]*lossCapture),
+    }, nil
+}
+
+// Reads packets from the interface and hands them to the replays they belong to. This function
+// should be run in a new thread, as it does not return until the capture fails or runs out of packets.
+func (lossCaptures *LossCaptures) Run() {
+    for {
+        data, captureInfo, err := lossCaptures.handle.ReadPacketData()
+        if err != nil {
+            return
+        }
+        lossCaptures.add(data, captureInfo.Timestamp)
+    }
+}
+
+// Starts measuring the packets of the replay of a client. A measurement of the client that was
+// never stopped is thrown away.
+// clientIP: the IP of the client
+func (lossCaptures *LossCaptures) Start(clientIP string) {
+    ip := net.ParseIP(clientIP)
+    if ip == nil {
+        return
+    }
+    lossCaptures.mutex.Lock()
+    defer lossCaptures.mutex.Unlock()
+    lossCaptures.active[ip.String()] = &lossCapture{
+        connections: make(map[int]*lossConnection),
+    }
+}
+
+// Stops measuring the packets of the replay of a client.
+// clientIP: the IP of the client
+// Returns the packets the server sent on each port during the replay; key is the server port. nil if
+//     the replay wasn't being measured.
+func (lossCaptures *LossCaptures) Stop(clientIP string) map[int]analysis.LossStats {
+    ip := net.ParseIP(clientIP)
+    if ip == nil {
+        return nil
+    }
+    lossCaptures.mutex.Lock()
+    capture, exists := lossCaptures.active[ip.String()]
+    delete(lossCaptures.active, ip.String())
+    lossCaptures.mutex.Unlock()
+    if !exists {
+        return nil
+    }
+
+    byPort := make(map[int]analysis.LossStats)
+    rttSumsMs := make(map[int]float64)
+    for _, conn := range capture.connections {
+        stats := byPort[conn.serverPort]
+        stats.DataPackets += conn.stats.DataPackets
+        stats.Retransmissions += conn.stats.Retransmissions
+        stats.RTTSamples += conn.stats.RTTSamples
+        byPort[conn.serverPort] = stats
+        rttSumsMs[conn.serverPort] += conn.rttSumMs
+    }
+    for port, stats := range byPort {
+        if stats.RTTSamples > 0 {
+            stats.RTTMeanMs = rttSumsMs[port] / float64(stats.RTTSamples)
+            byPort[port] = stats
+        }
+    }
+    return byPort
+}
+
+// Hands a captured packet to the replay of its client, if the client is running one.
+// data: the packet, starting at its Ethernet header
+// timestamp: when the packet was captured
+func (lossCaptures *LossCaptures) add(data []byte, timestamp time.Time) {
+    // most of the time no replay is measured, so packets aren't decoded for nothing
+    lossCaptures.mutex.Lock()
+    measuring := len(lossCaptures.active) > 0
+    lossCaptures.mutex.Unlock()
+    if !measuring {
+        return
+    }
+    packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+    var srcIP net.IP
+    var dstIP net.IP
+    // the payload length comes from the IP header, since the capture can cut packets short
+    var tcpLength int
+    switch network := packet.NetworkLayer().(type) {
+    case *layers.IPv4:
+        srcIP, dstIP = network.SrcIP, network.DstIP
+        tcpLength = int(network.Length) - int(network.IHL) * 4
+    case *layers.IPv6:
+        srcIP, dstIP = network.SrcIP, network.DstIP
+        tcpLength = int(network.Length)
+    default:
+        return
+    }
+    tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+    if !ok {
+        return
+    }
+
+    lossCaptures.mutex.Lock()
+    defer lossCaptures.mutex.Unlock()
+    fromClient := true
+    capture, exists := lossCaptures.active[srcIP.String()]
+    if !exists {
+        fromClient = false
+        capture, exists = lossCaptures.active[dstIP.String()]
+        if !exists {
+            return
+        }
+    }
+    serverPort, clientPort := int(tcp.DstPort), int(tcp.SrcPort)
+    if !fromClient {
+        serverPort, clientPort = clientPort, serverPort
+    }
+    if slices.Contains(lossCaptures.ignoredPorts, serverPort) {
+        return
+    }
+    conn, exists := capture.connections[clientPort]
+    if !exists {
+        conn = &lossConnection{serverPort: serverPort}
+        capture.connections[clientPort] = conn
+    }
+    if fromClient {
+        if tcp.ACK {
+            conn.acked(tcp.Ack, timestamp)
+        }
+        return
+    }
+    payloadLength := tcpLength - int(tcp.DataOffset) * 4
+    if payloadLength > 0 {
+        conn.sent(tcp.Seq, payloadLength, timestamp)
+    }
+}
+
+// Starts measuring the packets of the replay a client is about to run, if the server measures them.
+// Packets are matched to clients by IP, so replays of clients that share an IP aren't measured.
+// clt: the client
+func (sideChannel SideChannel) startLossCapture(clt *clienthandler.Client) {
+    if sideChannel.LossCaptures == nil {
+        return
+    }
+    if sideChannel.ConnectedClients.ClientsOnIP(clt.PublicIP) > 1 {
+        clt.Logger().Info("Not measuring loss of replay since another client shares its IP")
+        return
+    }
+    sideChannel.LossCaptures.Start(clt.PublicIP)
+}
+
+// Stops measuring the packets of the current replay of a client and adds them to the replay. A
+// replay that wasn't being measured is left as it is.
+// clt: the client
+// Returns any errors
+func (sideChannel SideChannel) collectReplayLoss(clt *clienthandler.Client) error {
+    if sideChannel.LossCaptures == nil {
+        return nil
+    }
+    loss := sideChannel.LossCaptures.Stop(clt.PublicIP)
+    if loss == nil {
+        return nil
+    }
+    return clt.SetReplayLoss(loss)
+}
@@ -4,20 +4,19 @@ package network
 import (
     "crypto/tls"
     "fmt"
+    "log/slog"
+    "net"
     "net/http"
     "net/url"
     "strconv"
     "sync"
+    "time"
 
     "wehe-server/internal/clienthandler"
 )
 
-const (
-    analyzerHTTPSPort = 56566
-)
-
 var (
-    // TODO: if old client does not make get results http request, clients will be stuck in here forever
+    // tests of clients that never make the get results request are removed by ReapStaleClients
     unanalyzedTests = &analysisServerClient{
         clients: make(map[string]*clienthandler.Client),
     }
@@ -52,21 +51,43 @@ func (asc *analysisServerClient) deleteClient(userID string, testID string) {
     delete(asc.clients, userID + testID)
 }
 
+// Removes the tests that started too long ago for their results to still be fetched.
+// now: the current time
+// ttl: how long after a test starts its results are kept
+// Returns the number of tests removed
+func (asc *analysisServerClient) reapStale(now time.Time, ttl time.Duration) int {
+    asc.mutex.Lock()
+    defer asc.mutex.Unlock()
+    reaped := 0
+    for key, client := range asc.clients {
+        if now.Sub(client.StartTime) > ttl {
+            delete(asc.clients, key)
+            reaped++
+        }
+    }
+    return reaped
+}
+
+// Binds the port of the old HTTPS analyzer server, so that it can be bound before the server drops
+// its privileges.
+// port: the TCP port clients older than 4.0 fetch their results from
+// Returns the listener or any errors
+func ListenOldAnalyzerServer(port int) (net.Listener, error) {
+    return net.Listen("tcp", fmt.Sprintf(":%d", port))
+}
+
 // Starts the old HTTPS analyzer server.
-// cert: TLS cert to be used for the server
+// listener: the listener returned by ListenOldAnalyzerServer
+// tlsConfig: the TLS config of the server
 // errChan: error channel to return errors
-func StartOldAnalyzerServer(cert tls.Certificate, errChan chan<- error) {
+func StartOldAnalyzerServer(listener net.Listener, tlsConfig *tls.Config, errChan chan<- error) {
     http.HandleFunc("/Results", oldHandleRequest)
 
-    fmt.Println("Listening on old analysis server", analyzerHTTPSPort)
-    tlsConfig := &tls.Config{
-        Certificates: []tls.Certificate{cert},
-    }
+    slog.Info("Listening on old analysis server", "addr", listener.Addr())
     server := &http.Server{
-        Addr: fmt.Sprintf(":%d", analyzerHTTPSPort),
         TLSConfig: tlsConfig,
     }
-    err := server.ListenAndServeTLS("", "")
+    err := server.ServeTLS(listener, "", "")
     errChan <- err
 }
 
@@ -76,6 +97,7 @@ func StartOldAnalyzerServer(cert tls.Certificate, errChan chan<- error) {
 // w: HTTP output channel
 // r: the HTTP request
 func oldHandleRequest(w http.ResponseWriter, r *http.Request) {
+    recordOldAnalyzerRequest(r.Method)
     if r.Method == http.MethodPost {
         oldAnalyzeTest(w, r)
     } else if r.Method == http.MethodGet {
@@ -116,7 +138,7 @@ func getFormValue(w http.ResponseWriter, queryParams url.Values, key string) (st
 // w: HTTP output channel
 // r: the HTTP request
 func oldGetResult(w http.ResponseWriter, r *http.Request) {
-    fmt.Println("GET path:", r.URL.Path, "GET query:", r.URL.RawQuery)
+    slog.Debug("Old analysis server request", "path", r.URL.Path)
 
     w.WriteHeader(http.StatusOK)
 
@@ -149,47 +171,64 @@ func oldGetResult(w http.ResponseWriter, r *http.Request) {
 
     testID, err := strconv.Atoi(testIDStr)
     if err != nil {
-        fmt.Println(err)
+        slog.Debug("Invalid test ID in old analysis server request", "error", err)
         w.Write([]byte("{\"success\": false, \"error\": \"%v\"}"))
         return
     }
 
-    // Gets the client object that contains the results
-    clt, exists := unanalyzedTests.getClient(userID, historyCountStr)
+    // Gets the test that contains the results
+    test, exists := oldStoredTest(userID, historyCountStr)
     if !exists {
         w.Write([]byte("{\"success\": false, \"error\": \"No result found\"}"))
         return
     }
 
-    var replay clienthandler.ReplayResult
-    found := false
     // The old client makes a result request for a specific replay (later versions of the old
     // server will make a request for the random replay). Note that "testID" in this section is
     // equivalent to the replay ID in the new server. Test ID in the new server is equivalent to
     // historyCount in the old server.
-    for _, r := range clt.ReplayResults {
-        if testID == int(r.ReplayID) {
-            replay = r
-            found = true
-            break
-        }
-    }
-
+    replayName, found := test.ReplayNames[clienthandler.ReplayType(testID)]
     if !found {
         w.Write([]byte("{\"success\": false, \"error\": \"No result found\"}"))
         return
     }
 
-    if clt.Analysis == nil {
+    if test.Analysis == nil {
         w.Write([]byte("{\"success\": false, \"error\": \"No result found\"}"))
         return
     }
 
-    dateFormatted := clt.StartTime.Format("2006-01-02 15:04:05")
+    dateFormatted := test.StartTime.Format("2006-01-02 15:04:05")
 
-    result := fmt.Sprintf("{\"success\": true, \"response\": {\"replayName\": \"%s\", \"date\": \"%s\", \"userID\": \"%s\", \"extraString\": \"%s\", \"historyCount\": \"%s\", \"testID\": \"%s\", \"area_test\": \"%f\", \"ks2_ratio_test\": \"%f\", \"xput_avg_original\": \"%f\", \"xput_avg_test\": \"%f\", \"ks2dVal\": \"%f\", \"ks2pVal\": \"%f\"}}", replay.ReplayName, dateFormatted, userID, clt.ExtraString, historyCountStr, testIDStr, clt.Analysis.Area0var, clt.Analysis.KS2AcceptRatio, clt.Analysis.OriginalReplayStats.Average, clt.Analysis.RandomReplayStats.Average, clt.Analysis.KS2dVal, clt.Analysis.KS2pVal)
-    fmt.Println("sending:", result)
+    result := fmt.Sprintf("{\"success\": true, \"response\": {\"replayName\": \"%s\", \"date\": \"%s\", \"userID\": \"%s\", \"extraString\": \"%s\", \"historyCount\": \"%s\", \"testID\": \"%s\", \"area_test\": \"%f\", \"ks2_ratio_test\": \"%f\", \"xput_avg_original\": \"%f\", \"xput_avg_test\": \"%f\", \"ks2dVal\": \"%f\", \"ks2pVal\": \"%f\"}}", replayName, dateFormatted, userID, test.ExtraString, historyCountStr, testIDStr, test.Analysis.Area0var, test.Analysis.KS2AcceptRatio, test.Analysis.OriginalAverage, test.Analysis.RandomAverage, test.Analysis.KS2dVal, test.Analysis.KS2pVal)
+    slog.Debug("Sending old analysis result", "replay", replayName, "bytes", len(result))
     w.Write([]byte(result))
 
     unanalyzedTests.deleteClient(userID, historyCountStr)
 }
+
+// Gets the test an old client asks for the results of. Tests are kept in memory until their results
+// are fetched, unless results are stored in a database, in which case they are looked up there.
+// userID: the user ID of the client
+// historyCount: the test ID, as sent by the client
+// Returns the test and true if it was found
+func oldStoredTest(userID string, historyCount string) (clienthandler.StoredTest, bool) {
+    clt, exists := unanalyzedTests.getClient(userID, historyCount)
+    if exists {
+        return clt.StoredTest(), true
+    }
+    resultsStore := clienthandler.GetResultsStore()
+    if resultsStore == nil {
+        return clienthandler.StoredTest{}, false
+    }
+    testID, err := strconv.Atoi(historyCount)
+    if err != nil {
+        return clienthandler.StoredTest{}, false
+    }
+    test, exists, err := resultsStore.Test(userID, testID)
+    if err != nil {
+        slog.Error("Unable to look up test in the results database", "user_id", userID, "test_id", testID, "error", err)
+        return clienthandler.StoredTest{}, false
+    }
+    return test, exists
+}
@@ -0,0 +1,122 @@
+// Counts how much the old protocol of Wehe clients < v4.0 is still used, so that maintainers can
+// tell when the 0x30 side channel path, the hardcoded server mapping, and the analyzer server on
+// port 56566 can be removed.
+package network
+
+import (
+    "log/slog"
+    "sync"
+    "time"
+
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/metrics"
+)
+
+const (
+    sunsetReportInterval = 24 * time.Hour // how often the old protocol usage is logged
+    unknownCountry = "unknown" // country label of clients that didn't share their location
+)
+
+var (
+    oldProtocolReplaysByVersion = metrics.NewCounterVec("wehe_old_protocol_replays_total",
+        "Number of replays run over the old side channel protocol, by client version.", "client_version")
+    oldProtocolReplaysByName = metrics.NewCounterVec("wehe_old_protocol_replays_by_replay_total",
+        "Number of replays run over the old side channel protocol, by replay.", "replay")
+    oldProtocolReplaysByCountry = metrics.NewCounterVec("wehe_old_protocol_replays_by_country_total",
+        "Number of replays run over the old side channel protocol, by client country code.", "country")
+    oldAnalyzerRequests = metrics.NewCounterVec("wehe_old_analyzer_requests_total",
+        "Number of requests made to the old analyzer server, by HTTP method.", "method")
+
+    oldProtocolStarted = time.Now() // when counting started
+    oldProtocolLastSeen = &lastSeen{} // when the old protocol was last used
+)
+
+// The times the parts of the old protocol were last used.
+type lastSeen struct {
+    mutex sync.Mutex // prevents multiple goroutines from accessing the times
+    sideChannel time.Time // last replay over the old side channel; zero if there hasn't been one
+    analyzer time.Time // last request to the old analyzer server; zero if there hasn't been one
+}
+
+// Old protocol usage since the server started.
+type OldProtocolReport struct {
+    Since time.Time `json:"since"` // when counting started
+    Replays uint64 `json:"replays"` // number of replays run over the old side channel, each of which was sent the hardcoded server mapping
+    AnalyzerRequests uint64 `json:"analyzer_requests"` // number of requests made to the old analyzer server
+    LastSideChannel *time.Time `json:"last_side_channel,omitempty"` // last replay over the old side channel; omitted if there hasn't been one
+    LastAnalyzer *time.Time `json:"last_analyzer,omitempty"` // last request to the old analyzer server; omitted if there hasn't been one
+    ByClientVersion map[string]uint64 `json:"by_client_version"` // replays by client version
+    ByReplay map[string]uint64 `json:"by_replay"` // replays by replay name
+    ByCountry map[string]uint64 `json:"by_country"` // replays by client country code
+}
+
+// Counts a replay run over the old side channel. Should be called once the mobile stats of the
+// replay are received, as that is when the country of the client is known.
+// clt: the client running the replay
+// replayName: the name of the replay
+func recordOldProtocolReplay(clt *clienthandler.Client, replayName string) {
+    country := clt.CountryCode
+    if country == "" {
+        country = unknownCountry
+    }
+    oldProtocolReplaysByVersion.Inc(clt.ClientVersion)
+    oldProtocolReplaysByName.Inc(replayName)
+    oldProtocolReplaysByCountry.Inc(country)
+
+    oldProtocolLastSeen.mutex.Lock()
+    defer oldProtocolLastSeen.mutex.Unlock()
+    oldProtocolLastSeen.sideChannel = time.Now()
+}
+
+// Counts a request made to the old analyzer server.
+// method: the HTTP method of the request
+func recordOldAnalyzerRequest(method string) {
+    oldAnalyzerRequests.Inc(method)
+
+    oldProtocolLastSeen.mutex.Lock()
+    defer oldProtocolLastSeen.mutex.Unlock()
+    oldProtocolLastSeen.analyzer = time.Now()
+}
+
+// Gets the old protocol usage since the server started.
+// Returns the usage
+func OldProtocolUsage() OldProtocolReport {
+    report := OldProtocolReport{
+        Since: oldProtocolStarted,
+        ByClientVersion: oldProtocolReplaysByVersion.Snapshot(),
+        ByReplay: oldProtocolReplaysByName.Snapshot(),
+        ByCountry: oldProtocolReplaysByCountry.Snapshot(),
+    }
+    for _, count := range report.ByClientVersion {
+        report.Replays += count
+    }
+    for _, count := range oldAnalyzerRequests.Snapshot() {
+        report.AnalyzerRequests += count
+    }
+
+    oldProtocolLastSeen.mutex.Lock()
+    defer oldProtocolLastSeen.mutex.Unlock()
+    if !oldProtocolLastSeen.sideChannel.IsZero() {
+        last := oldProtocolLastSeen.sideChannel
+        report.LastSideChannel = &last
+    }
+    if !oldProtocolLastSeen.analyzer.IsZero() {
+        last := oldProtocolLastSeen.analyzer
+        report.LastAnalyzer = &last
+    }
+    return report
+}
+
+// Logs the old protocol usage once a day. A day without a line reporting any replays or analyzer
+// requests is a sign that the old protocol is no longer used. This function should be run in a new
+// thread, as it never returns.
+func ReportOldProtocolUsage() {
+    for range time.Tick(sunsetReportInterval) {
+        report := OldProtocolUsage()
+        slog.Info("Old protocol usage since the server started", "since", report.Since,
+            "replays", report.Replays, "analyzer_requests", report.AnalyzerRequests,
+            "last_side_channel", report.LastSideChannel, "last_analyzer", report.LastAnalyzer,
+            "by_client_version", report.ByClientVersion, "by_replay", report.ByReplay,
+            "by_country", report.ByCountry)
+    }
+}
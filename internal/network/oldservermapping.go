@@ -0,0 +1,217 @@
+// Generates the server mapping sent to Wehe clients < v4.0
+package network
+
+import (
+    "encoding/json"
+    "fmt"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+
+    "wehe-server/internal/testdata"
+)
+
+const (
+    // The TCP part of the server mapping of the old server. Unlike UDP replays, TCP replay files do
+    // not contain the original server IPs and ports, so these are used as the TCP servers that old
+    // clients may ask for. Entries whose port is not listening are left out of the mapping sent to
+    // clients.
+    legacyTCPServerMapping = "{'': {'00000': ['', 34081]}, '002.021.034.145': {'00443': ['', 443]}, '003.162.003.119': {'00443': ['', 443]}, '008.249.245.246': {'00080': ['', 80]}, '008.252.208.244': {'00443': ['', 443]}, '013.225.025.052': {'00443': ['', 443]}, '017.253.011.202': {'00080': ['', 80]}, '018.002.192.002': {'00443': ['', 443]}, '018.032.197.018': {'00443': ['', 443]}, '018.160.041.126': {'00443': ['', 443]}, '023.015.179.224': {'00443': ['', 443]}, '023.033.029.087': {'00443': ['', 443]}, '023.040.060.072': {'00443': ['', 443]}, '023.040.060.146': {'00443': ['', 443]}, '023.040.060.160': {'00443': ['', 443]}, '023.197.180.251': {'00443': ['', 443]}, '035.241.016.093': {'00443': ['', 443]}, '045.057.062.168': {'00443': ['', 443]}, '052.223.227.060': {'00443': ['', 443]}, '052.223.227.181': {'00443': ['', 443]}, '065.158.047.083': {'00080': ['', 80]}, '074.125.172.072': {'00443': ['', 443]}, '082.216.034.026': {'00443': ['', 443]}, '082.216.034.032': {'00443': ['', 443]}, '093.017.156.102': {'00443': ['', 443]}, '139.104.212.047': {'00443': ['', 443]}, '147.160.181.042': {'00443': ['', 443]}, '151.101.118.248': {'00443': ['', 443]}, '151.101.248.246': {'00080': ['', 80]}, '151.101.250.109': {'00443': ['', 443]}, '157.240.245.063': {'00443': ['', 443]}, '172.217.129.041': {'00443': ['', 443]}, '188.065.126.005': {'00443': ['', 443]}, '192.229.210.163': {'00443': ['', 443]}, '192.229.221.012': {'00443': ['', 443]}, '208.085.042.032': {'00080': ['', 80]}, '208.111.190.109': {'00443': ['', 443]}, '2606:2800:21f:dc2:1fe1:23fc:954:1461': {'00443': ['', 443]}, '2606:4700::6811:164b': {'00081': ['', 81], '01194': ['', 1194], '06881': ['', 6881], '08443': ['', 8443], '05061': ['', 5061], '00465': ['', 465], '00995': ['', 995], '08080': ['', 8080], '00443': ['', 443], '00080': ['', 80], '00993': ['', 993], '00853': ['', 853], '01701': ['', 1701]}}"
+)
+
+// Old clients look up the original server IP and port of their replay in the server mapping to find
+// out which port on this server to send the replay to. The mapping is sent as a Python dictionary
+// literal of the form {'tcp': {<server IP>: {<server port>: ['', <port on this server>]}},
+// 'udp': {...}}, where IPv4 addresses have each octet padded to 3 digits and ports are padded to 5
+// digits. This is the mapping of one protocol; key is the padded server IP, then the padded server
+// port, and the value is the port on this server.
+type serverMapping map[string]map[string]int
+
+// Generates the server mapping for old clients from the replays in the registry and the ports
+// that are listening, so that the mapping never points clients at replays or ports that the server
+// doesn't have. The mapping is cached until the replays or the ports change.
+type oldServerMappingCache struct {
+    replays *testdata.Registry // the replays on the server
+    tcpPorts []int // TCP ports that replay servers are listening on
+    udpPorts []int // UDP ports that replay servers are listening on
+    mapping string // the cached mapping
+    replaysVersion int // the version of the replays that the cached mapping was generated from
+    mutex sync.Mutex // protects tcpPorts, udpPorts, and the cached mapping
+}
+
+// Creates a new oldServerMappingCache.
+// replays: the replays on the server
+// tcpPorts: TCP ports that replay servers are listening on
+// udpPorts: UDP ports that replay servers are listening on
+// Returns the mapping cache
+func newOldServerMappingCache(replays *testdata.Registry, tcpPorts []int, udpPorts []int) *oldServerMappingCache {
+    return &oldServerMappingCache{
+        replays: replays,
+        tcpPorts: tcpPorts,
+        udpPorts: udpPorts,
+        replaysVersion: -1,
+    }
+}
+
+// Changes the ports that replay servers are listening on; the mapping is generated again the next
+// time it is needed.
+// tcpPorts: TCP ports that replay servers are listening on
+// udpPorts: UDP ports that replay servers are listening on
+func (cache *oldServerMappingCache) setPorts(tcpPorts []int, udpPorts []int) {
+    cache.mutex.Lock()
+    defer cache.mutex.Unlock()
+    cache.tcpPorts = tcpPorts
+    cache.udpPorts = udpPorts
+    cache.replaysVersion = -1
+}
+
+// Gets the server mapping, generating it if the replays changed since it was last generated.
+// Returns the server mapping or any errors
+func (cache *oldServerMappingCache) get() (string, error) {
+    cache.mutex.Lock()
+    defer cache.mutex.Unlock()
+    version := cache.replays.Version()
+    if version == cache.replaysVersion {
+        return cache.mapping, nil
+    }
+
+    mapping, err := cache.generate()
+    if err != nil {
+        return "", err
+    }
+    cache.mapping = mapping
+    cache.replaysVersion = version
+    return mapping, nil
+}
+
+// Generates the server mapping. TCP entries come from the old server mapping and UDP entries come
+// from the original servers of the UDP replays; entries for ports that aren't listening are left out.
+// Returns the server mapping or any errors
+func (cache *oldServerMappingCache) generate() (string, error) {
+    tcpMapping, err := parseLegacyMapping(legacyTCPServerMapping)
+    if err != nil {
+        return "", err
+    }
+
+    mapping := map[string]serverMapping{
+        "tcp": make(serverMapping),
+        "udp": make(serverMapping),
+    }
+
+    tcpListening := portSet(cache.tcpPorts)
+    for ip, ports := range tcpMapping {
+        for paddedPort, port := range ports {
+            // the empty IP entry is a placeholder of the old server that is kept as is
+            if ip == "" || tcpListening[port] {
+                mapping["tcp"].add(ip, paddedPort, port)
+            }
+        }
+    }
+
+    udpListening := portSet(cache.udpPorts)
+    for _, replay := range cache.replays.All() {
+        if replay.IsTCP {
+            continue
+        }
+        for _, endpoint := range replay.ServerEndpoints {
+            if udpListening[endpoint.Port] {
+                mapping["udp"].add(padIP(endpoint.IP), zfill(strconv.Itoa(endpoint.Port), 5), endpoint.Port)
+            }
+        }
+    }
+
+    return "{'tcp': " + mapping["tcp"].String() + ", 'udp': " + mapping["udp"].String() + "}", nil
+}
+
+// Adds an entry to the mapping.
+// ip: the padded IP of the original server
+// paddedPort: the padded port of the original server
+// port: the port on this server
+func (mapping serverMapping) add(ip string, paddedPort string, port int) {
+    _, exists := mapping[ip]
+    if !exists {
+        mapping[ip] = make(map[string]int)
+    }
+    mapping[ip][paddedPort] = port
+}
+
+// Formats the mapping of one protocol as a Python dictionary literal, sorted by IP and port.
+// Returns the formatted mapping
+func (mapping serverMapping) String() string {
+    var ips []string
+    for ip := range mapping {
+        ips = append(ips, ip)
+    }
+    sort.Strings(ips)
+
+    var ipEntries []string
+    for _, ip := range ips {
+        var paddedPorts []string
+        for paddedPort := range mapping[ip] {
+            paddedPorts = append(paddedPorts, paddedPort)
+        }
+        sort.Strings(paddedPorts)
+
+        var portEntries []string
+        for _, paddedPort := range paddedPorts {
+            portEntries = append(portEntries, fmt.Sprintf("'%s': ['', %d]", paddedPort, mapping[ip][paddedPort]))
+        }
+        ipEntries = append(ipEntries, fmt.Sprintf("'%s': {%s}", ip, strings.Join(portEntries, ", ")))
+    }
+    return "{" + strings.Join(ipEntries, ", ") + "}"
+}
+
+// Parses the mapping of one protocol from a Python dictionary literal.
+// pythonMapping: the mapping in the form {<server IP>: {<server port>: ['', <port>]}}
+// Returns the parsed mapping or any errors
+func parseLegacyMapping(pythonMapping string) (serverMapping, error) {
+    var rawMapping map[string]map[string][]interface{}
+    err := json.Unmarshal([]byte(strings.ReplaceAll(pythonMapping, "'", "\"")), &rawMapping)
+    if err != nil {
+        return nil, err
+    }
+
+    mapping := make(serverMapping)
+    for ip, ports := range rawMapping {
+        for paddedPort, value := range ports {
+            if len(value) != 2 {
+                return nil, fmt.Errorf("Invalid server mapping entry for %s:%s", ip, paddedPort)
+            }
+            port, ok := value[1].(float64)
+            if !ok {
+                return nil, fmt.Errorf("Invalid server mapping port for %s:%s", ip, paddedPort)
+            }
+            mapping.add(ip, paddedPort, int(port))
+        }
+    }
+    return mapping, nil
+}
+
+// Pads each octet of an IPv4 address to 3 digits, the format used by the old server mapping. IPv6
+// addresses are returned unchanged.
+// ip: the IP address to pad
+// Returns the padded IP address
+func padIP(ip string) string {
+    parsedIP := net.ParseIP(ip)
+    if parsedIP == nil || parsedIP.To4() == nil {
+        return ip
+    }
+    var octets []string
+    for _, octet := range parsedIP.To4() {
+        octets = append(octets, fmt.Sprintf("%03d", octet))
+    }
+    return strings.Join(octets, ".")
+}
+
+// Converts a list of ports into a set.
+// ports: the ports
+// Returns the set of ports
+func portSet(ports []int) map[int]bool {
+    set := make(map[int]bool)
+    for _, port := range ports {
+        set[port] = true
+    }
+    return set
+}
@@ -0,0 +1,161 @@
+// Tests of the server mapping sent to old clients, which must only point them at ports the replay
+// servers are listening on.
+package network
+
+import (
+    "encoding/json"
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "wehe-server/internal/testdata"
+)
+
+// Writes a UDP replay with one packet to each of its original servers.
+// t: the test
+// testsDir: the directory containing a directory for each replay
+// replayName: the name of the replay
+// servers: the original servers of the replay, as <IP>.<port>
+func writeUDPReplay(t *testing.T, testsDir string, replayName string, servers []string) {
+    replayFileInfo := testdata.ReplayFileInfo{ReplayName: replayName}
+    for i, server := range servers {
+        replayFileInfo.Packets = append(replayFileInfo.Packets, testdata.UDPReplayFilePacket{
+            CSPair: fmt.Sprintf("10.0.0.1.%d-%s", 50000 + i, server),
+            Timestamp: float64(i) / 10,
+            Payload: "00",
+        })
+    }
+    writeReplayFile(t, testsDir, replayFileInfo)
+}
+
+// Writes a replay file to the directory of its replay.
+// t: the test
+// testsDir: the directory containing a directory for each replay
+// replayFileInfo: the contents of the replay file
+func writeReplayFile(t *testing.T, testsDir string, replayFileInfo testdata.ReplayFileInfo) {
+    data, err := json.Marshal(replayFileInfo)
+    if err != nil {
+        t.Fatal(err)
+    }
+    replayName := replayFileInfo.ReplayName
+    err = os.MkdirAll(filepath.Join(testsDir, replayName), 0755)
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = os.WriteFile(filepath.Join(testsDir, replayName, replayName + ".pcap_server_all.json"), data, 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Parses the server mapping sent to old clients.
+// t: the test
+// mapping: the mapping, a Python dictionary literal
+// Returns the port on this server of each entry; key is the protocol, then the padded IP, then the
+// padded port
+func parseServerMapping(t *testing.T, mapping string) map[string]serverMapping {
+    var rawMapping map[string]map[string]map[string][]interface{}
+    err := json.Unmarshal([]byte(strings.ReplaceAll(mapping, "'", "\"")), &rawMapping)
+    if err != nil {
+        t.Fatalf("Mapping %s isn't a valid dictionary: %v", mapping, err)
+    }
+    parsed := make(map[string]serverMapping)
+    for protocol, entries := range rawMapping {
+        parsed[protocol] = make(serverMapping)
+        for ip, ports := range entries {
+            for paddedPort, value := range ports {
+                if len(value) != 2 || value[0] != "" {
+                    t.Fatalf("Invalid %s entry for %s:%s: %v", protocol, ip, paddedPort, value)
+                }
+                parsed[protocol].add(ip, paddedPort, int(value[1].(float64)))
+            }
+        }
+    }
+    return parsed
+}
+
+// Opens UDP replay listeners on free ports and writes a replay whose original servers use those
+// ports and one port nothing listens on, then checks that the mapping holds exactly the replay
+// servers that are listening and the legacy TCP servers on the listening TCP ports.
+func TestOldServerMappingMatchesListeners(t *testing.T) {
+    var udpPorts []int
+    for i := 0; i < 2; i++ {
+        conn, err := UDPServer{IP: "127.0.0.1"}.Listen()
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer conn.Close()
+        udpPorts = append(udpPorts, conn.LocalAddr().(*net.UDPAddr).Port)
+    }
+    closedConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    closedPort := closedConn.LocalAddr().(*net.UDPAddr).Port
+    closedConn.Close()
+
+    testsDir := t.TempDir()
+    writeUDPReplay(t, testsDir, "udpReplay", []string{
+        fmt.Sprintf("8.8.4.4.%d", udpPorts[0]),
+        fmt.Sprintf("2001:db8::1.%d", udpPorts[1]),
+        fmt.Sprintf("1.2.3.4.%d", closedPort),
+    })
+    replays, err := testdata.NewRegistry(testsDir, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // the TCP ports of the fixture, which aren't opened since the legacy mapping uses well-known ports
+    tcpPorts := []int{80, 443, 8443}
+    cache := newOldServerMappingCache(replays, tcpPorts, udpPorts)
+    mapping, err := cache.get()
+    if err != nil {
+        t.Fatal(err)
+    }
+    parsed := parseServerMapping(t, mapping)
+
+    wantUDP := serverMapping{}
+    wantUDP.add("008.008.004.004", zfill(fmt.Sprint(udpPorts[0]), 5), udpPorts[0])
+    wantUDP.add("2001:db8::1", zfill(fmt.Sprint(udpPorts[1]), 5), udpPorts[1])
+    if parsed["udp"].String() != wantUDP.String() {
+        t.Errorf("UDP mapping = %s; want %s", parsed["udp"], wantUDP)
+    }
+
+    legacy, err := parseLegacyMapping(legacyTCPServerMapping)
+    if err != nil {
+        t.Fatal(err)
+    }
+    listening := portSet(tcpPorts)
+    for ip, ports := range legacy {
+        for paddedPort, port := range ports {
+            _, inMapping := parsed["tcp"][ip][paddedPort]
+            if (ip == "" || listening[port]) != inMapping {
+                t.Errorf("TCP entry %s:%s for port %d: in mapping %t, listening %t", ip, paddedPort, port, inMapping, listening[port])
+            }
+        }
+    }
+    for ip, ports := range parsed["tcp"] {
+        for paddedPort, port := range ports {
+            if ip != "" && !listening[port] {
+                t.Errorf("TCP entry %s:%s points at port %d, which isn't listening", ip, paddedPort, port)
+            }
+        }
+    }
+
+    // once a listener goes away, its entries go with it
+    cache.setPorts([]int{443}, udpPorts[:1])
+    mapping, err = cache.get()
+    if err != nil {
+        t.Fatal(err)
+    }
+    parsed = parseServerMapping(t, mapping)
+    if len(parsed["udp"]) != 1 || parsed["udp"]["008.008.004.004"] == nil {
+        t.Errorf("UDP mapping after closing port %d = %s; want only 008.008.004.004", udpPorts[1], parsed["udp"])
+    }
+    if parsed["tcp"]["008.249.245.246"] != nil || parsed["tcp"]["002.021.034.145"] == nil {
+        t.Errorf("TCP mapping after closing port 80 = %s; want the port 443 entries only", parsed["tcp"])
+    }
+}
@@ -5,6 +5,7 @@ import (
     "crypto/tls"
     "fmt"
     "io"
+    "log/slog"
     "net"
     "strconv"
     "strings"
@@ -12,17 +13,12 @@ import (
     "github.com/m-lab/uuid"
 
     "wehe-server/internal/clienthandler"
+    "wehe-server/internal/compat"
+    "wehe-server/internal/errs"
 )
 
 const (
-    // This list contains the information for all the replays supported by the old server
-    // This needs to be modified if new replays are added to the old server
-    serverMapping = "{'tcp': {'': {'00000': ['', 34081]}, '002.021.034.145': {'00443': ['', 443]}, '003.162.003.119': {'00443': ['', 443]}, '008.249.245.246': {'00080': ['', 80]}, '008.252.208.244': {'00443': ['', 443]}, '013.225.025.052': {'00443': ['', 443]}, '017.253.011.202': {'00080': ['', 80]}, '018.002.192.002': {'00443': ['', 443]}, '018.032.197.018': {'00443': ['', 443]}, '018.160.041.126': {'00443': ['', 443]}, '023.015.179.224': {'00443': ['', 443]}, '023.033.029.087': {'00443': ['', 443]}, '023.040.060.072': {'00443': ['', 443]}, '023.040.060.146': {'00443': ['', 443]}, '023.040.060.160': {'00443': ['', 443]}, '023.197.180.251': {'00443': ['', 443]}, '035.241.016.093': {'00443': ['', 443]}, '045.057.062.168': {'00443': ['', 443]}, '052.223.227.060': {'00443': ['', 443]}, '052.223.227.181': {'00443': ['', 443]}, '065.158.047.083': {'00080': ['', 80]}, '074.125.172.072': {'00443': ['', 443]}, '082.216.034.026': {'00443': ['', 443]}, '082.216.034.032': {'00443': ['', 443]}, '093.017.156.102': {'00443': ['', 443]}, '139.104.212.047': {'00443': ['', 443]}, '147.160.181.042': {'00443': ['', 443]}, '151.101.118.248': {'00443': ['', 443]}, '151.101.248.246': {'00080': ['', 80]}, '151.101.250.109': {'00443': ['', 443]}, '157.240.245.063': {'00443': ['', 443]}, '172.217.129.041': {'00443': ['', 443]}, '188.065.126.005': {'00443': ['', 443]}, '192.229.210.163': {'00443': ['', 443]}, '192.229.221.012': {'00443': ['', 443]}, '208.085.042.032': {'00080': ['', 80]}, '208.111.190.109': {'00443': ['', 443]}, '2606:2800:21f:dc2:1fe1:23fc:954:1461': {'00443': ['', 443]}, '2606:4700::6811:164b': {'00081': ['', 81], '01194': ['', 1194], '06881': ['', 6881], '08443': ['', 8443], '05061': ['', 5061], '00465': ['', 465], '00995': ['', 995], '08080': ['', 8080], '00443': ['', 443], '00080': ['', 80], '00993': ['', 993], '00853': ['', 853], '01701': ['', 1701]}}, 'udp': {'010.110.049.082': {'63308': ['', 63308]}, '010.110.063.089': {'49882': ['', 49882]}, '010.110.089.150': {'62065': ['', 62065]}, '023.089.015.050': {'05004': ['', 5004]}, '052.112.077.144': {'03480': ['', 3480]}, '054.215.072.028': {'08801': ['', 8801]}, '066.022.214.035': {'50002': ['', 50002]}, '104.044.195.124': {'03478': ['', 3478]}, '142.250.082.217': {'03478': ['', 3478]}, '144.195.033.064': {'08801': ['', 8801]}, '157.240.245.008': {'00443': ['', 443]}, '157.240.245.062': {'03478': ['', 3478]}, '170.133.130.181': {'09000': ['', 9000]}, '2001:4860:4864:5::111': {'19305': ['', 19305]}}}"
-)
-
-var (
-    // List of UDP replays
-    udpSenderCount = []string{"DiscordRandom-06052024", "Discord-06052024", "FacebookVideoRandom-06052024", "FacebookVideo-06052024", "GoogleMeetRandom-04282020", "GoogleMeetRandom-05062024", "GoogleMeet-04282020", "GoogleMeet-05062024", "MicrosoftTeamRandom-04282020", "MicrosoftTeamRandom-05152024", "MicrosoftTeam-04282020", "MicrosoftTeam-05152024", "SkypeRandom-06172024", "SkypeRandom-12122018", "Skype-06172024", "Skype-12122018", "WebexRandom-04282020", "WebexRandom-05152024", "Webex-04282020", "Webex-05152024", "WhatsAppRandom-04112019", "WhatsAppRandom-06072024", "WhatsApp-04112019", "WhatsApp-06072024", "ZoomRandom-04282020", "ZoomRandom-05062024", "Zoom-04282020", "Zoom-05062024"}
+    oldMaxMessageSize = 1 << 24 - 1 // largest message accepted for requests without their own limit, the same as the new protocol allows
 )
 
 // Main function for handling old side channel connections.
@@ -30,12 +26,27 @@ var (
 // first4Bytes: the first 4 bytes of the declare ID data length, which was read to determine that
 //     the client uses the old protocol
 // Returns any errors
-func (sideChannel SideChannel) handleOldSideChannel(conn net.Conn, first4Bytes []byte) error {
+func (sideChannel SideChannel) handleOldSideChannel(conn net.Conn, first4Bytes []byte) (err error) {
     clt, err := sideChannel.oldDeclareID(conn, first4Bytes)
     if err != nil {
         return err
     }
-    defer clt.CleanUp(sideChannel.ConnectedClients)
+    // clt is swapped below for the client of the test's earlier replays, which is the one holding the
+    // replay slot and groups
+    defer func() {
+        clt.CleanUp(sideChannel.ConnectedClients)
+    }()
+    // old clients run each replay of a test on a separate connection, so the test is over once the
+    // last replay is done or when any replay fails
+    defer func() {
+        if err != nil {
+            sideChannel.deriveMissingThroughputs(clt)
+        }
+        if err != nil || clt.IsLastReplay {
+            clt.WriteManifest(sideChannel.TmpResultsDir)
+            clt.ReportTest(err)
+        }
+    }()
 
     // if this is the second or subsequent replay, a client object should already exist; use that
     // object instead of the one passed into this function
@@ -49,11 +60,17 @@ func (sideChannel SideChannel) handleOldSideChannel(conn net.Conn, first4Bytes [
         client.AddReplay(currentReplay.ReplayID, currentReplay.ReplayName, clt.IsLastReplay)
         clt = client
     } else {
+        err = clt.CheckDuplicateTest(sideChannel.TmpResultsDir, sideChannel.DuplicateTestPolicy)
+        if err != nil {
+            return err
+        }
         unanalyzedTests.addClient(clt)
     }
+    sideChannel.InFlightTests.Add(clt)
+    defer sideChannel.InFlightTests.Remove(clt)
 
     // Receive server side changes (no longer used)
-    _, err = sideChannel.oldReadRequest(clt.Conn)
+    _, err = sideChannel.oldReadRequest(clt.Conn, oldMaxMessageSize)
     if err != nil {
         return err
     }
@@ -75,11 +92,20 @@ func (sideChannel SideChannel) handleOldSideChannel(conn net.Conn, first4Bytes [
     if err != nil {
         return err
     }
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return err
+    }
+    recordOldProtocolReplay(clt, currentReplay.ReplayName)
 
     // start tcp dump
 
     // Send server mapping
-    err = sideChannel.oldSendResponse(clt.Conn, serverMapping)
+    mapping, err := sideChannel.oldServerMapping.get()
+    if err != nil {
+        return err
+    }
+    err = sideChannel.oldSendResponse(clt.Conn, mapping)
     if err != nil {
         return err
     }
@@ -101,6 +127,7 @@ func (sideChannel SideChannel) handleOldSideChannel(conn net.Conn, first4Bytes [
     if err != nil {
         return err
     }
+    sideChannel.InFlightTests.SetState(clt, clienthandler.TestReplayDone)
 
     // Send OK
     err = sideChannel.oldSendResponse(clt.Conn, "OK")
@@ -109,7 +136,7 @@ func (sideChannel SideChannel) handleOldSideChannel(conn net.Conn, first4Bytes [
     }
 
     // Receive Result;No
-    _, err = sideChannel.oldReadRequest(clt.Conn)
+    _, err = sideChannel.oldReadRequest(clt.Conn, oldMaxMessageSize)
     if err != nil {
         return err
     }
@@ -118,10 +145,18 @@ func (sideChannel SideChannel) handleOldSideChannel(conn net.Conn, first4Bytes [
 
     // Analysis
     if clt.IsLastReplay {
-        err = clt.AnalyzeTest()
+        err = clt.AnalyzeTest(sideChannel.TmpResultsDir)
+        if err != nil {
+            return err
+        }
+        err = clt.WriteResultsToFile(sideChannel.TmpResultsDir)
         if err != nil {
             return err
         }
+        // the results request is answered from the results database, so the test needn't be kept
+        if clienthandler.GetResultsStore() != nil {
+            unanalyzedTests.deleteClient(clt.UserID, strconv.Itoa(clt.TestID))
+        }
     }
 
     return nil
@@ -144,7 +179,7 @@ func (sideChannel SideChannel) oldDeclareID(conn net.Conn, first4Bytes []byte) (
         return nil, err
     }
 
-    fmt.Printf("We should read %d bytes %v %d\n", dataLength, dataLengthBytes, len(dataLengthBytes))
+    slog.Debug("Reading declare ID", "bytes", dataLength, "client", conn.RemoteAddr())
 
     // read in the number of bytes specified by the first read
     buffer := make([]byte, dataLength)
@@ -155,14 +190,14 @@ func (sideChannel SideChannel) oldDeclareID(conn net.Conn, first4Bytes []byte) (
 
     pieces := strings.Split(string(buffer), ";")
     if len(pieces) < 6 {
-        return nil, fmt.Errorf("Expected to receive at least 6 pieces from declare ID; only received %d.\n", len(pieces))
+        return nil, fmt.Errorf("%w: expected to receive at least 6 pieces from declare ID; only received %d.\n", errs.ErrMalformedMessage, len(pieces))
     }
 
     userID := pieces[0]
 
     replayIDInt, err := strconv.Atoi(pieces[1])
     if err != nil {
-        return nil, err
+        return nil, errs.Malformed(err)
     }
     var replayID clienthandler.ReplayType
     if replayIDInt == 0 {
@@ -170,16 +205,16 @@ func (sideChannel SideChannel) oldDeclareID(conn net.Conn, first4Bytes []byte) (
     } else if replayIDInt == 1 {
         replayID = clienthandler.Random
     } else {
-        return nil, fmt.Errorf("Unexpected replay ID: %d; must be 0 (original) or 1 (random)", replayIDInt)
+        return nil, fmt.Errorf("%w: unexpected replay ID: %d; must be 0 (original) or 1 (random)", errs.ErrMalformedMessage, replayIDInt)
     }
 
-    //TODO: change client replay files replay names to use _ instead of -, then delete this terrible replace code
-    replayName := strings.Replace(pieces[2], "-", "_", -1)
+    clientVersion, testPortIP := compat.DeclareIDExtras(pieces)
+    replayName := compat.ReplayName(pieces[2], compat.For(clientVersion))
 
     extraString := pieces[3]
     testID, err := strconv.Atoi(pieces[4])
     if err != nil {
-        return nil, err
+        return nil, errs.Malformed(err)
     }
     isLastReplay, err := strToBool(pieces[5])
     if err != nil {
@@ -187,20 +222,11 @@ func (sideChannel SideChannel) oldDeclareID(conn net.Conn, first4Bytes []byte) (
     }
 
     // Some ISPs may give clients multiple IPs - one for each port. We want to use the test port
-    // as the client's public IP. Client may send us an IP, which is the IP of the client using
-    // the test port. If client does not provide us with an IP, or if the IP provided is 127.0.0.1,
-    // then we just use the side channel IP of the clienthandler.
-    publicIP, err := getClientPublicIP(conn)
+    // as the client's public IP.
+    publicIP, err := clientTestPortIP(testPortIP, conn)
     if err != nil {
         return nil, err
     }
-    clientVersion := "1.0"
-    if len(pieces) > 6 {
-        if pieces[6] != "127.0.0.1" {
-            publicIP = pieces[6]
-        }
-        clientVersion = pieces[7]
-    }
 
     tlsConn, ok := conn.(*tls.Conn)
     if !ok {
@@ -218,7 +244,15 @@ func (sideChannel SideChannel) oldDeclareID(conn net.Conn, first4Bytes []byte) (
     clt := clienthandler.NewClient(conn, userID, extraString, testID, publicIP, clientVersion, mlabUUID)
     clt.AddReplay(replayID, replayName, isLastReplay)
 
-    fmt.Println(clt)
+    // old clients don't read anything until they ask for permission, so the denial is sent now and
+    // read as the answer to that request
+    if sideChannel.requiresUpgrade(clientVersion) {
+        denial := strings.Join([]string{"0", clienthandler.Ask4PermissionUpgradeRequiredMsg, sideChannel.MinClientVersion.String()}, ";")
+        sideChannel.oldSendResponse(conn, denial)
+        return nil, sideChannel.upgradeRequiredError(clientVersion)
+    }
+
+    clt.Logger().Debug("Declared ID over the old protocol", "replay_id", replayID, "client_version", clientVersion)
     return clt, nil
 }
 
@@ -232,7 +266,7 @@ func strToBool(str string) (bool, error) {
     } else if lowerStr == "false" {
         return false, nil
     } else {
-        return false, fmt.Errorf("Cannot parse '%s' into a bool\n", str)
+        return false, fmt.Errorf("%w: cannot parse '%s' into a bool\n", errs.ErrMalformedMessage, str)
     }
 }
 
@@ -240,18 +274,23 @@ func strToBool(str string) (bool, error) {
 // conn: the client connection
 // Returns the client IP or any erros
 func getClientPublicIP(conn net.Conn) (string, error) {
-    remoteAddr := conn.RemoteAddr().String()
-
-    host, _, err := net.SplitHostPort(remoteAddr)
-    if err != nil {
-        return "", err
-    }
+    return clienthandler.AddrIP(conn.RemoteAddr())
+}
 
-    ip := net.ParseIP(host)
-    if ip == nil {
-        return "", fmt.Errorf("invalid IP address: %s", host)
+// Gets the IP the replay servers see the packets of a client come from. Some ISPs may give clients
+// multiple IPs - one for each port - so the client may send the IP it has on the test port. If the
+// client does not provide us with a usable IP, then we just use the side channel IP.
+// testPortIP: the IP the client sent; empty if it didn't send one
+// conn: the side channel connection of the client
+// Returns the normalized IP of the client or any errors
+func clientTestPortIP(testPortIP string, conn net.Conn) (string, error) {
+    if testPortIP != "" {
+        publicIP, err := clienthandler.NormalizeIP(testPortIP)
+        if err == nil {
+            return publicIP, nil
+        }
     }
-    return ip.String(), nil
+    return getClientPublicIP(conn)
 }
 
 // Determines if the client can run a replay.
@@ -261,7 +300,7 @@ func getClientPublicIP(conn net.Conn) (string, error) {
 // clt: the client handler that made the request
 // Returns any errors
 func (sideChannel SideChannel) oldAsk4Permission(clt *clienthandler.Client) error {
-    status, info, err := clt.Ask4Permission(sideChannel.ReplayNames, sideChannel.ConnectedClients)
+    status, info, err := clt.Ask4Permission(sideChannel.Replays.Names(), sideChannel.ConnectedClients)
     if err != nil {
         return err
     }
@@ -269,10 +308,17 @@ func (sideChannel SideChannel) oldAsk4Permission(clt *clienthandler.Client) erro
     var permissionSlice []string
     if status == clienthandler.Ask4PermissionOkStatus {
         permissionSlice = []string{"1", sideChannel.IP, info}
+        sideChannel.InFlightTests.SetState(clt, clienthandler.TestReplaying)
+        sideChannel.startLossCapture(clt)
+        // old clients can't be told a longer timeout, so long replays are only marked as truncated
+        _, err = sideChannel.negotiateReplayTimeout(clt)
+        if err != nil {
+            return err
+        }
     } else {
         permissionSlice = []string{"0", info}
-        if info == clienthandler.Ask4PermissionIPInUseMsg {
-            permissionSlice = append(permissionSlice, strconv.Itoa(clienthandler.SamplesPerReplay))
+        if info == clienthandler.Ask4PermissionIPInUseMsg && clt.Capabilities.IPInUseSamplesPerReplay {
+            permissionSlice = append(permissionSlice, strconv.Itoa(clienthandler.SamplesPerReplay()))
         }
     }
 
@@ -282,7 +328,7 @@ func (sideChannel SideChannel) oldAsk4Permission(clt *clienthandler.Client) erro
     }
 
     if status != clienthandler.Ask4PermissionOkStatus {
-        return fmt.Errorf("Replay permission issue\n")
+        return fmt.Errorf("%w: replay permission issue\n", errs.ErrPermissionDenied)
     }
     return nil
 }
@@ -292,14 +338,14 @@ func (sideChannel SideChannel) oldAsk4Permission(clt *clienthandler.Client) erro
 // conn: the client connection
 // Returns any errors
 func (sideChannel SideChannel) oldReceiveIperf(conn net.Conn) error {
-    data, err := sideChannel.oldReadRequest(conn)
+    data, err := sideChannel.oldReadRequest(conn, oldMaxMessageSize)
     if err != nil {
         return err
     }
 
     iperfStatus := strings.Split(data, ";")[0]
     if iperfStatus == "WillSendIperf" {
-        _, err = sideChannel.oldReadRequest(conn)
+        _, err = sideChannel.oldReadRequest(conn, oldMaxMessageSize)
         if err != nil {
             return err
         }
@@ -311,14 +357,14 @@ func (sideChannel SideChannel) oldReceiveIperf(conn net.Conn) error {
 // clt: the client handler that made the request
 // Returns any errors
 func (sideChannel SideChannel) oldReceiveMobileStats(clt *clienthandler.Client) error {
-    data, err := sideChannel.oldReadRequest(clt.Conn)
+    data, err := sideChannel.oldReadRequest(clt.Conn, oldMaxMessageSize)
     if err != nil {
         return err
     }
 
     mobileStatsStatus := strings.Split(data, ";")[0]
     if mobileStatsStatus == "WillSendMobileStats" {
-        mobileStats, err := sideChannel.oldReadRequest(clt.Conn)
+        mobileStats, err := sideChannel.oldReadRequest(clt.Conn, oldMaxMessageSize)
         if err != nil {
             return err
         }
@@ -342,10 +388,9 @@ func (sideChannel SideChannel) oldSendUDPSenderCount(clt *clienthandler.Client)
     }
 
     // if replay is UDP, send "1"
-    for _, replayName := range udpSenderCount {
-        if replayName == currentReplay.ReplayName {
-            return sideChannel.oldSendResponse(clt.Conn, "1")
-        }
+    replay, exists := sideChannel.Replays.Get(currentReplay.ReplayName)
+    if exists && !replay.IsTCP {
+        return sideChannel.oldSendResponse(clt.Conn, "1")
     }
 
     // if replay is TCP, send "0"
@@ -357,14 +402,14 @@ func (sideChannel SideChannel) oldSendUDPSenderCount(clt *clienthandler.Client)
 // conn: the client connection
 // Returns the replay duration (in seconds) or any errors
 func (sideChannel SideChannel) oldReceiveDone(conn net.Conn) (string, error) {
-    data, err := sideChannel.oldReadRequest(conn)
+    data, err := sideChannel.oldReadRequest(conn, oldMaxMessageSize)
     if err != nil {
         return "", err
     }
 
     dataPieces := strings.Split(data, ";")
     if len(dataPieces) < 2 {
-        return "", fmt.Errorf("Old side channel DONE expected to receive 2 pieces of data; received %d\n", len(dataPieces))
+        return "", fmt.Errorf("%w: old side channel DONE expected to receive 2 pieces of data; received %d\n", errs.ErrMalformedMessage, len(dataPieces))
     }
 
     // dataPieces[1] is the replay duration in seconds
@@ -378,20 +423,37 @@ func (sideChannel SideChannel) oldReceiveDone(conn net.Conn) (string, error) {
 // replayDuration: the time it took for the replay to run in seconds
 // Returns any errors
 func (sideChannel SideChannel) oldReceiveThroughputs(clt *clienthandler.Client, replayDuration string) error {
-    throughputsAndSampleTimes, err := sideChannel.oldReadRequest(clt.Conn)
+    throughputsAndSampleTimes, err := sideChannel.oldReadRequest(clt.Conn, maxThroughputsMessageSize)
     if err != nil {
         return err
     }
 
-    return clt.ReceiveThroughputs(replayDuration + ";" + throughputsAndSampleTimes, sideChannel.TmpResultsDir)
+    // old clients can't be notified of replay errors, but the errors are still recorded
+    err = sideChannel.collectReplayErrors(clt)
+    if err != nil {
+        return err
+    }
+    err = sideChannel.collectReplayLoss(clt)
+    if err != nil {
+        return err
+    }
+
+    err = clt.ReceiveThroughputs(replayDuration + ";" + throughputsAndSampleTimes, sideChannel.TmpResultsDir)
+    if err != nil {
+        return err
+    }
+    // kept alongside the throughputs of the client to check them against
+    return clt.SampleServerThroughputs(sideChannel.ConnectedClients, sideChannel.TmpResultsDir)
 }
 
 // Receives data from the client. The old protocol receives data with two reads. The first read is
 // the length of the message to be received in bytes, formatted to be a string that is ten
-// characters long. The second read contains the actual data.
+// characters long. The second read contains the actual data, which is not read if it is longer than
+// maxLength.
 // conn: the client connection
+// maxLength: the largest message accepted, in bytes
 // Returns the message read or any errors
-func (sideChannel SideChannel) oldReadRequest(conn net.Conn) (string, error) {
+func (sideChannel SideChannel) oldReadRequest(conn net.Conn, maxLength int) (string, error) {
     // read in 10 bytes of data, which contains the message length
     dataLengthBytes := make([]byte, 10)
     _, err := io.ReadFull(conn, dataLengthBytes)
@@ -402,8 +464,9 @@ func (sideChannel SideChannel) oldReadRequest(conn net.Conn) (string, error) {
     if err != nil {
         return "", err
     }
-
-    fmt.Printf("We should read %d bytes %v %d\n", dataLength, dataLengthBytes, len(dataLengthBytes))
+    if dataLength < 0 || dataLength > maxLength {
+        return "", &errs.LimitError{Kind: errs.ErrMessageTooLarge, Limit: maxLength, Message: fmt.Sprintf("message is %d bytes; limit is %d bytes", dataLength, maxLength)}
+    }
 
     // read in the number of bytes specified by the first read
     buffer := make([]byte, dataLength)
@@ -412,7 +475,8 @@ func (sideChannel SideChannel) oldReadRequest(conn net.Conn) (string, error) {
         return "", err
     }
 
-    fmt.Printf("Read %d bytes from client: %s\n", len(buffer), string(buffer))
+    // the request can hold what the client measured, so only its size is logged
+    slog.Debug("Read request from client", "bytes", len(buffer), "client", conn.RemoteAddr())
     return string(buffer), nil
 }
 
@@ -423,7 +487,7 @@ func (sideChannel SideChannel) oldReadRequest(conn net.Conn) (string, error) {
 // message: the message to send to the client
 // Returns any errors
 func (sideChannel SideChannel) oldSendResponse(conn net.Conn, message string) error {
-    fmt.Println("Sending to client:", message)
+    slog.Debug("Sending response to client", "bytes", len(message), "client", conn.RemoteAddr())
     messageLengthStr := strconv.Itoa(len(message))
     messageLengthStrPadded := zfill(messageLengthStr, 10)
     _, err := conn.Write([]byte(messageLengthStrPadded))
@@ -431,7 +495,6 @@ func (sideChannel SideChannel) oldSendResponse(conn net.Conn, message string) er
         return err
     }
 
-    fmt.Printf("Sending %s bytes\n", messageLengthStrPadded)
     _, err = conn.Write([]byte(message))
     if err != nil {
         return err
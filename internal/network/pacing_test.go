@@ -0,0 +1,209 @@
+// Tests of the pacing of TCP and UDP replays and of the UDP session timeout, run on a fake clock so
+// that the times packets are sent at can be checked exactly without waiting for them.
+package network
+
+import (
+    "bytes"
+    "io"
+    "net"
+    "slices"
+    "strconv"
+    "testing"
+    "time"
+
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/clock"
+    "wehe-server/internal/testdata"
+)
+
+var (
+    fakeStart = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) // when the fake clocks of the tests start
+)
+
+// Loads the replays of a tests directory.
+// t: the test
+// testsDir: the directory containing a directory for each replay
+// Returns the replays
+func loadReplays(t *testing.T, testsDir string) *testdata.Cache {
+    registry, err := testdata.NewRegistry(testsDir, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return testdata.NewCache(registry, 0, testdata.LoadBudget{})
+}
+
+// Checks the times in the send ledger of a client.
+// t: the test
+// connectedClients: the clients running a replay
+// clientKey: the key of the client
+// want: the times the bytes should have been sent, as offsets from fakeStart
+func checkSendTimes(t *testing.T, connectedClients *clienthandler.ConnectedClients, clientKey string, want []time.Duration) {
+    var sendTimes []time.Duration
+    for _, sent := range connectedClients.TakeSendLedger(clientKey) {
+        sendTimes = append(sendTimes, sent.Time.Sub(fakeStart))
+    }
+    if !slices.Equal(sendTimes, want) {
+        t.Errorf("packets sent at %v; want %v", sendTimes, want)
+    }
+}
+
+// Runs a TCP replay whose response starts after a think time and checks that each packet is slept
+// for until its timestamp, relative to the start of the response.
+func TestTCPReplayPacing(t *testing.T) {
+    request := "GET /video HTTP/1.1\r\n\r\n"
+    testsDir := t.TempDir()
+    writeReplayFile(t, testsDir, testdata.ReplayFileInfo{
+        ReplayName: "tcpReplay",
+        IsTCP: true,
+        ResponseSets: []testdata.ResponseSet{{
+            RequestLength: len(request),
+            ThinkTime: 0.5,
+            Packets: []testdata.TCPReplayFilePacket{
+                {Timestamp: 0, Payload: "aa"},
+                {Timestamp: 0.25, Payload: "bbbb"},
+                {Timestamp: 1, Payload: "cc"},
+            },
+        }},
+    })
+    listener, err := TCPServer{IP: "127.0.0.1"}.Listen()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+    fake := clock.NewFake(fakeStart)
+    connectedClients := clienthandler.NewConnectedClients()
+    connectedClients.Grant("127.0.0.1", "tcpReplay")
+    server := TCPServer{
+        IP: "127.0.0.1",
+        Port: listener.Addr().(*net.TCPAddr).Port,
+        IPReplayNameMapping: connectedClients,
+        RequestHashCheck: NoRequestHashCheck,
+        Replays: loadReplays(t, testsDir),
+        Clock: fake,
+    }
+    go func() {
+        conn, err := listener.Accept()
+        if err == nil {
+            server.handleConnection(conn)
+        }
+    }()
+
+    conn, err := net.Dial("tcp", listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+    _, err = conn.Write([]byte(request))
+    if err != nil {
+        t.Fatal(err)
+    }
+    // the server closes the connection once the replay is sent
+    received, err := io.ReadAll(conn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(received, []byte{0xaa, 0xbb, 0xbb, 0xcc}) {
+        t.Errorf("received %x; want aabbbbcc", received)
+    }
+    wantSleeps := []time.Duration{500 * time.Millisecond, 250 * time.Millisecond, 750 * time.Millisecond}
+    if !slices.Equal(fake.Sleeps(), wantSleeps) {
+        t.Errorf("slept %v; want %v", fake.Sleeps(), wantSleeps)
+    }
+    checkSendTimes(t, connectedClients, "127.0.0.1", []time.Duration{500 * time.Millisecond, 750 * time.Millisecond, 1500 * time.Millisecond})
+}
+
+// Sends a UDP replay with one flow and checks that each packet is slept for until its timestamp,
+// relative to the start of the replay.
+func TestUDPReplayPacing(t *testing.T) {
+    receiver, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer receiver.Close()
+    serverConn, err := UDPServer{IP: "127.0.0.1"}.Listen()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer serverConn.Close()
+    port := serverConn.LocalAddr().(*net.UDPAddr).Port
+
+    csPair := "10.0.0.1.50000-1.2.3.4." + strconv.Itoa(port)
+    testsDir := t.TempDir()
+    writeReplayFile(t, testsDir, testdata.ReplayFileInfo{
+        ReplayName: "udpReplay",
+        Packets: []testdata.UDPReplayFilePacket{
+            {CSPair: csPair, Timestamp: 0, Payload: "01"},
+            {CSPair: csPair, Timestamp: 0.1, Payload: "02"},
+            {CSPair: csPair, Timestamp: 0.3, Payload: "03"},
+        },
+    })
+    replays := loadReplays(t, testsDir)
+    replayInfo, err := replays.Get("udpReplay")
+    if err != nil {
+        t.Fatal(err)
+    }
+    fake := clock.NewFake(fakeStart)
+    connectedClients := clienthandler.NewConnectedClients()
+    connectedClients.Grant("127.0.0.1", "udpReplay")
+    server := UDPServer{
+        IP: "127.0.0.1",
+        Port: port,
+        IPReplayNameMapping: connectedClients,
+        Replays: replays,
+        Clock: fake,
+        sessions: newUDPSessions(fake),
+    }
+    session, started := server.sessions.received(receiver.LocalAddr(), "127.0.0.1", "127.0.0.1")
+    if !started {
+        t.Fatal("received() didn't start a session")
+    }
+
+    err = server.sendPackets(serverConn, session, replayInfo.Responses, fake.Now(), true, AbortOnError)
+    if err != nil {
+        t.Fatal(err)
+    }
+    receiver.SetReadDeadline(time.Now().Add(10 * time.Second))
+    buffer := make([]byte, 16)
+    for want := byte(1); want <= 3; want++ {
+        n, _, err := receiver.ReadFrom(buffer)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if n != 1 || buffer[0] != want {
+            t.Errorf("received %x; want %02x", buffer[:n], want)
+        }
+    }
+    wantSleeps := []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond}
+    if !slices.Equal(fake.Sleeps(), wantSleeps) {
+        t.Errorf("slept %v; want %v", fake.Sleeps(), wantSleeps)
+    }
+    checkSendTimes(t, connectedClients, "127.0.0.1", []time.Duration{0, 100 * time.Millisecond, 300 * time.Millisecond})
+}
+
+// Checks that a UDP session is stopped once its replay has run past its timeout and the grace period,
+// and not before.
+func TestUDPSessionTimeout(t *testing.T) {
+    fake := clock.NewFake(fakeStart)
+    sessions := newUDPSessions(fake)
+    addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 50000}
+    session, _ := sessions.received(addr, "127.0.0.1", "127.0.0.1")
+    sessions.setReplay(session, "udpReplay", 10, 30 * time.Second)
+    connected := func(string) bool {
+        return true
+    }
+
+    fake.Advance(30 * time.Second + udpSessionGrace)
+    if reaped := sessions.reap(connected); len(reaped) != 0 {
+        t.Fatalf("session reaped at its timeout plus the grace period")
+    }
+    fake.Advance(time.Millisecond)
+    if reaped := sessions.reap(connected); len(reaped) != 1 || reaped[0] != session {
+        t.Fatalf("session not reaped past its timeout plus the grace period")
+    }
+    select {
+    case <-session.stop:
+    default:
+        t.Error("reaped session wasn't stopped")
+    }
+}
@@ -4,22 +4,46 @@
 package network
 
 import (
-    "os"
-    "path/filepath"
+    "log/slog"
+    "strings"
 
     "github.com/google/gopacket"
     "github.com/google/gopacket/layers"
-    "github.com/google/gopacket/pcapgo"
+
+    "wehe-server/internal/anonymize"
+    "wehe-server/internal/errorbudget"
+    "wehe-server/internal/pcapfile"
+)
+
+const (
+    captureFilePrefix = "file:" // interfaces named file:<path> read packets from a PCAP file instead of capturing them live
 )
 
+// A source of captured packets. Live captures are only supported on Linux (see
+// packetcapture_linux.go); other platforms fall back to a capture that never sees any packets, so
+// the server still builds and runs there for development.
+type captureHandle interface {
+    gopacket.PacketDataSource
+    Close()
+}
+
+// A capture handle that can tell how many packets the kernel dropped because the capture couldn't
+// keep up.
+type dropCounter interface {
+    droppedPackets() (int, error)
+}
+
 type PacketCapture struct {
     iface string // the interface to listen to
-    handle *pcapgo.EthernetHandle // the socket to capture packets
+    handle captureHandle // the socket to capture packets
     packets []gopacket.Packet // list of packets captured
 }
 
+// Creates a new PacketCapture.
+// iface: the interface to capture packets on, or file:<path> to read the packets of a PCAP file
+// Returns the packet capture or any errors
 func NewPacketCapture(iface string) (*PacketCapture, error) {
-    handle, err := pcapgo.NewEthernetHandle(iface)
+    handle, err := openCapture(iface)
     if err != nil {
         return nil, err
     }
@@ -29,6 +53,17 @@ func NewPacketCapture(iface string) (*PacketCapture, error) {
     }, nil
 }
 
+// Opens a capture of an interface, or of a PCAP file if the interface is file:<path>.
+// iface: the interface to capture packets on, or file:<path> to read the packets of a PCAP file
+// Returns the capture handle or any errors
+func openCapture(iface string) (captureHandle, error) {
+    path, isFile := strings.CutPrefix(iface, captureFilePrefix)
+    if isFile {
+        return openCaptureFile(path)
+    }
+    return openLiveCapture(iface)
+}
+
 // Captures packets. This function should be run in a new thread, as it does not return until
 // StopPacketCapture is called.
 func (packetCapture *PacketCapture) StartPacketCapture() {
@@ -39,39 +74,48 @@ func (packetCapture *PacketCapture) StartPacketCapture() {
     }
 }
 
-// Stops capturing packets.
+// Stops capturing packets. Packets the kernel dropped count against the error budget, since the
+// capture is missing part of what was sent.
 func (packetCapture *PacketCapture) StopPacketCapture() {
+    counter, ok := packetCapture.handle.(dropCounter)
+    if ok {
+        dropped, err := counter.droppedPackets()
+        if err != nil {
+            slog.Warn("Unable to get the packets dropped by the capture", "interface", packetCapture.iface, "error", err)
+        } else {
+            errorbudget.Record(errorbudget.CaptureDrops, dropped)
+        }
+    }
     packetCapture.handle.Close()
 }
 
-// Write captured packets to PCAP file.
-// filename: the output PCAP filename that the packets should be written to
-// Returns any errors
-func (packetCapture *PacketCapture) WriteToPcap(filename string) error {
-    // make sure all directories of output path exists
-    dir := filepath.Dir(filename)
-    err := os.MkdirAll(dir, os.ModePerm)
+// Opens a PCAP file, plain or zstd-compressed, to read packets from as if they were being captured.
+// path: the path of the PCAP file
+// Returns the capture handle or any errors
+func openCaptureFile(path string) (captureHandle, error) {
+    reader, err := pcapfile.Open(path)
     if err != nil {
-        return err
-    }
-
-    file, err := os.Create(filename)
-    if err != nil {
-        return err
+        return nil, err
     }
-    defer file.Close()
+    return reader, nil
+}
 
-    pcapWriter := pcapgo.NewWriter(file)
-    err = pcapWriter.WriteFileHeader(1600, layers.LinkTypeEthernet)
+// Writes the captured packets to a zstd-compressed PCAP file with an index next to it. The IPs in
+// the packets are anonymized so that the PCAP doesn't leak full client addresses.
+// filename: the PCAP filename that the packets should be written to; .zst is added to it
+// anonymizer: anonymizes the IPs in the packets
+// Returns the index of the file or any errors
+func (packetCapture *PacketCapture) WriteToPcap(filename string, anonymizer anonymize.Anonymizer) (pcapfile.Index, error) {
+    writer, err := pcapfile.Create(filename, 1600, layers.LinkTypeEthernet)
     if err != nil {
-        return err
+        return pcapfile.Index{}, err
     }
-    // write packets to file
     for _, packet := range packetCapture.packets {
-        err = pcapWriter.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
+        err = writer.WritePacket(packet.Metadata().CaptureInfo, anonymizer.Packet(packet.Data(), layers.LinkTypeEthernet))
         if err != nil {
-            return err
+            writer.Close()
+            return pcapfile.Index{}, err
         }
     }
-    return nil
+    return writer.Close()
 }
@@ -0,0 +1,34 @@
+//go:build linux
+
+// Live packet captures on Linux, which use AF_PACKET sockets.
+package network
+
+import (
+    "github.com/google/gopacket/pcapgo"
+)
+
+// Opens a socket that captures the packets of an interface.
+// iface: the interface to capture packets on
+// Returns the capture handle or any errors
+func openLiveCapture(iface string) (captureHandle, error) {
+    handle, err := pcapgo.NewEthernetHandle(iface)
+    if err != nil {
+        return nil, err
+    }
+    return liveCapture{handle}, nil
+}
+
+// A live capture of an interface.
+type liveCapture struct {
+    *pcapgo.EthernetHandle
+}
+
+// Gets the number of packets the kernel dropped from the capture since this was last called.
+// Returns the number of dropped packets or any errors
+func (capture liveCapture) droppedPackets() (int, error) {
+    stats, err := capture.Stats()
+    if err != nil {
+        return 0, err
+    }
+    return int(stats.Drops), nil
+}
@@ -0,0 +1,44 @@
+//go:build !linux
+
+// Stand-in for live packet captures on platforms other than Linux, where pcapgo can't capture
+// packets. Developers can still build and run the server on macOS and Windows; their captures are
+// empty, or read from a PCAP file with file:<path>.
+package network
+
+import (
+    "io"
+    "log/slog"
+    "sync"
+
+    "github.com/google/gopacket"
+)
+
+// A capture that sees no packets. Reads block until the capture is closed.
+type noopCapture struct {
+    closed chan struct{} // closed when the capture is closed
+    closeOnce sync.Once // makes sure closed is only closed once
+}
+
+// Opens a capture that sees no packets, since live captures are only supported on Linux.
+// iface: the interface that would have been captured
+// Returns the capture handle
+func openLiveCapture(iface string) (captureHandle, error) {
+    slog.Warn("Live packet captures are only supported on Linux; the capture will be empty", "interface", iface)
+    return &noopCapture{
+        closed: make(chan struct{}),
+    }, nil
+}
+
+// Waits until the capture is closed.
+// Returns io.EOF once the capture is closed
+func (capture *noopCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+    <-capture.closed
+    return nil, gopacket.CaptureInfo{}, io.EOF
+}
+
+// Closes the capture.
+func (capture *noopCapture) Close() {
+    capture.closeOnce.Do(func() {
+        close(capture.closed)
+    })
+}
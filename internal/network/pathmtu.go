@@ -0,0 +1,65 @@
+// Handles UDP replay packets that are larger than the path MTU to the client. Fragments of a large
+// packet that a network drops look the same as throttling in the results, so the UDP replay servers
+// can send packets with the DF bit set, which makes the kernel refuse to send packets larger than
+// the path MTU it learned from ICMP instead of fragmenting them.
+package network
+
+import (
+    "net"
+
+    "wehe-server/internal/metrics"
+)
+
+const (
+    ipv4HeaderLen = 20 // bytes in an IPv4 header without options
+    ipv6HeaderLen = 40 // bytes in an IPv6 header without extension headers
+    udpHeaderLen = 8 // bytes in a UDP header
+)
+
+var (
+    udpPathMTUEvents = metrics.NewCounterVec("wehe_udp_path_mtu_events_total",
+        "Number of UDP replay packets larger than the path MTU to the client, by what was done with them (skipped or clamped).", "event")
+)
+
+// What the UDP replay servers do about packets larger than the path MTU to the client.
+type UDPPathMTU struct {
+    DontFragment bool // true if packets are sent with the DF bit set, so that they aren't fragmented
+    Clamp bool // true if packets larger than the path MTU are cut to fit it; false to skip them
+}
+
+// Gets the largest UDP payload that fits in a path MTU.
+// addr: the client IP and port
+// mtu: the path MTU to the client
+// Returns the largest payload, in bytes
+func maxUDPPayload(addr net.Addr, mtu int) int {
+    headerLen := ipv4HeaderLen + udpHeaderLen
+    udpAddr, ok := addr.(*net.UDPAddr)
+    if ok && udpAddr.IP.To4() == nil {
+        headerLen = ipv6HeaderLen + udpHeaderLen
+    }
+    return mtu - headerLen
+}
+
+// Sends a packet that the kernel refused to send because it is larger than the path MTU to the
+// client. The packet is cut to fit the path MTU if the server clamps packets, or skipped otherwise.
+// flow: the flow the packet belongs to
+// payload: the payload of the packet
+// Returns the number of bytes sent, which is 0 if the packet was skipped, or any errors
+func (session *udpFlowSession) sendOversized(flow *udpFlow, payload []byte) (int, error) {
+    mtu, err := pathMTU(session.addr)
+    if err != nil {
+        return 0, err
+    }
+    if flow.pathMTU == 0 || mtu < flow.pathMTU {
+        flow.pathMTU = mtu
+    }
+    maxPayload := maxUDPPayload(session.addr, mtu)
+    if !session.server.PathMTU.Clamp || maxPayload <= 0 || maxPayload >= len(payload) {
+        flow.skipped++
+        udpPathMTUEvents.Inc("skipped")
+        return 0, nil
+    }
+    flow.clamped++
+    udpPathMTUEvents.Inc("clamped")
+    return flow.writer.write(payload[:maxPayload])
+}
@@ -0,0 +1,76 @@
+//go:build linux
+
+// Path MTU discovery for UDP replays on Linux, which uses the IP_MTU_DISCOVER and IP_MTU socket
+// options.
+package network
+
+import (
+    "errors"
+    "net"
+    "syscall"
+)
+
+// Makes a UDP socket send packets with the DF bit set, so that packets larger than the path MTU
+// fail to send with EMSGSIZE instead of being fragmented.
+// conn: the UDP socket
+// Returns any errors
+func setDontFragment(conn net.PacketConn) error {
+    udpConn, ok := conn.(*net.UDPConn)
+    if !ok {
+        return errors.New("Path MTU discovery needs a UDP socket")
+    }
+    rawConn, err := udpConn.SyscallConn()
+    if err != nil {
+        return err
+    }
+    var sockErr error
+    err = rawConn.Control(func(fd uintptr) {
+        sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+        // sockets bound to an IPv4 address have no IPv6 options
+        syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+    })
+    if err != nil {
+        return err
+    }
+    return sockErr
+}
+
+// Checks if sending a packet failed because it is larger than the path MTU.
+// err: the error returned by the send
+// Returns true if the packet was too large
+func isMessageTooBig(err error) bool {
+    return errors.Is(err, syscall.EMSGSIZE)
+}
+
+// Gets the path MTU to a client that the kernel has learned. The kernel keeps one path MTU per
+// destination, so it can be read from a socket connected to the client without sending anything.
+// addr: the client IP and port
+// Returns the path MTU or any errors
+func pathMTU(addr net.Addr) (int, error) {
+    udpAddr, ok := addr.(*net.UDPAddr)
+    if !ok {
+        return 0, errors.New("Path MTU can only be read for UDP addresses")
+    }
+    conn, err := net.DialUDP("udp", nil, udpAddr)
+    if err != nil {
+        return 0, err
+    }
+    defer conn.Close()
+    rawConn, err := conn.SyscallConn()
+    if err != nil {
+        return 0, err
+    }
+    var mtu int
+    var sockErr error
+    err = rawConn.Control(func(fd uintptr) {
+        if udpAddr.IP.To4() != nil {
+            mtu, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU)
+        } else {
+            mtu, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU)
+        }
+    })
+    if err != nil {
+        return 0, err
+    }
+    return mtu, sockErr
+}
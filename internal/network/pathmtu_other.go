@@ -0,0 +1,30 @@
+//go:build !linux
+
+// Stand-in for path MTU discovery on platforms other than Linux. UDP replay packets are sent without
+// the DF bit, so packets larger than the path MTU are fragmented as before.
+package network
+
+import (
+    "errors"
+    "log/slog"
+    "net"
+)
+
+// Leaves a UDP socket as it is, since the DF bit is only set on Linux.
+// conn: the UDP socket
+// Returns nil
+func setDontFragment(conn net.PacketConn) error {
+    slog.Warn("Path MTU discovery is only supported on Linux; UDP replay packets will be fragmented")
+    return nil
+}
+
+// Returns false, since packets are never refused for being larger than the path MTU without the DF
+// bit.
+func isMessageTooBig(err error) bool {
+    return false
+}
+
+// Returns an error, since the path MTU is only read on Linux.
+func pathMTU(addr net.Addr) (int, error) {
+    return 0, errors.New("Path MTU discovery is only supported on Linux")
+}
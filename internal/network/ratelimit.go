@@ -0,0 +1,152 @@
+// Limits how fast sources can open connections to the replay ports. Scanners that hit the replay
+// ports otherwise make the server look up a replay and log an error for every stray connection.
+// Clients that have permission to run a replay are never limited.
+package network
+
+import (
+    "fmt"
+    "log/slog"
+    "sync"
+    "time"
+
+    "wehe-server/internal/clock"
+    "wehe-server/internal/metrics"
+)
+
+const (
+    banCountWindow = time.Minute // rejected connections are counted over this long when deciding to ban a source
+    maxTrackedSources = 10000 // sources tracked per port before idle ones are forgotten
+)
+
+var (
+    rateLimitedConnections = metrics.NewCounterVec("wehe_replay_connections_rate_limited_total",
+        "Number of connections or first packets to the replay ports dropped by the rate limit, by port.", "port")
+    bannedSources = metrics.NewCounterVec("wehe_replay_source_bans_total",
+        "Number of sources temporarily banned from the replay ports, by port.", "port")
+
+    connectionRateLimit ConnectionRateLimit // how fast each source can connect to every replay port; off until set
+    connectionRateLimitMutex sync.Mutex // prevents connectionRateLimit from being read while it is reloaded
+)
+
+// How fast each source can open connections to a replay port.
+type ConnectionRateLimit struct {
+    PerSecond float64 // connections a source can open per second on average; 0 turns the limit off
+    Burst int // connections a source can open at once before the rate applies
+    BanAfter int // rejected connections within a minute that get a source banned; 0 never bans
+    BanDuration time.Duration // how long a banned source is ignored
+}
+
+// Sets how fast each source can open connections to every replay port. The limiters of the replay
+// servers use the new limit from their next connection, so it can be called while the servers run.
+// limit: how fast each source can connect
+func SetConnectionRateLimit(limit ConnectionRateLimit) {
+    connectionRateLimitMutex.Lock()
+    defer connectionRateLimitMutex.Unlock()
+    connectionRateLimit = limit
+}
+
+// Gets how fast each source can open connections to every replay port.
+// Returns the limit
+func getConnectionRateLimit() ConnectionRateLimit {
+    connectionRateLimitMutex.Lock()
+    defer connectionRateLimitMutex.Unlock()
+    return connectionRateLimit
+}
+
+// The connection budget of one source.
+type sourceLimit struct {
+    tokens float64 // connections the source can open right now
+    updated time.Time // when tokens was last refilled
+    rejected int // connections rejected since rejectedSince
+    rejectedSince time.Time // start of the period rejected is counted over
+    bannedUntil time.Time // when the ban of the source ends; zero if it isn't banned
+}
+
+// A token bucket for each source that connects to a replay port.
+type connectionLimiter struct {
+    port string // the protocol and port being limited, e.g. tcp/443, used as the metrics label
+    clk clock.Clock // the time source used to refill the buckets
+    mutex sync.Mutex // prevents multiple goroutines from accessing sources
+    sources map[string]*sourceLimit // the budget of each source; key is the source IP
+}
+
+// Creates a new connectionLimiter, which limits sources by the limit set with SetConnectionRateLimit.
+// protocol: tcp or udp
+// port: the port being limited
+// clk: the time source used to refill the buckets
+// Returns the limiter
+func newConnectionLimiter(protocol string, port int, clk clock.Clock) *connectionLimiter {
+    return &connectionLimiter{
+        port: fmt.Sprintf("%s/%d", protocol, port),
+        clk: clk,
+        sources: make(map[string]*sourceLimit),
+    }
+}
+
+// Checks if a source can open a connection, and takes a token from its bucket if it can. Sources
+// that keep getting rejected are banned, and banned sources are rejected without using tokens.
+// Does nothing and allows every connection if the limiter is nil or the limit is off.
+// ip: the IP of the source
+// Returns true if the connection should be handled
+func (limiter *connectionLimiter) allow(ip string) bool {
+    limit := getConnectionRateLimit()
+    if limiter == nil || limit.PerSecond <= 0 {
+        return true
+    }
+    now := limiter.clk.Now()
+    limiter.mutex.Lock()
+    defer limiter.mutex.Unlock()
+
+    source, exists := limiter.sources[ip]
+    if !exists {
+        if len(limiter.sources) >= maxTrackedSources {
+            limiter.forgetIdle(limit, now)
+        }
+        source = &sourceLimit{
+            tokens: float64(limit.Burst),
+            updated: now,
+        }
+        limiter.sources[ip] = source
+    }
+    if now.Before(source.bannedUntil) {
+        rateLimitedConnections.Inc(limiter.port)
+        return false
+    }
+
+    source.tokens += now.Sub(source.updated).Seconds() * limit.PerSecond
+    if source.tokens > float64(limit.Burst) {
+        source.tokens = float64(limit.Burst)
+    }
+    source.updated = now
+    if source.tokens >= 1 {
+        source.tokens--
+        return true
+    }
+
+    rateLimitedConnections.Inc(limiter.port)
+    if now.Sub(source.rejectedSince) > banCountWindow {
+        source.rejected = 0
+        source.rejectedSince = now
+    }
+    source.rejected++
+    if limit.BanAfter > 0 && source.rejected >= limit.BanAfter {
+        source.bannedUntil = now.Add(limit.BanDuration)
+        source.rejected = 0
+        bannedSources.Inc(limiter.port)
+        slog.Warn("Banned source after too many connections", "ip", ip, "port", limiter.port, "duration", limit.BanDuration)
+    }
+    return false
+}
+
+// Forgets sources that aren't banned and whose buckets have refilled, since they are treated the
+// same as sources that have never connected. Must be called with the mutex held.
+// limit: how fast each source can connect
+// now: the current time
+func (limiter *connectionLimiter) forgetIdle(limit ConnectionRateLimit, now time.Time) {
+    refillTime := time.Duration(float64(limit.Burst) / limit.PerSecond * float64(time.Second))
+    for ip, source := range limiter.sources {
+        if now.After(source.bannedUntil) && now.Sub(source.updated) > refillTime {
+            delete(limiter.sources, ip)
+        }
+    }
+}
@@ -0,0 +1,93 @@
+// Lets UDP replays that last longer than the UDP replay timeout run to their end. When a client is
+// granted a replay, the side channel looks up how long the replay lasts and, if the client can wait
+// for it, gives the replay a longer timeout, up to the most the config allows. The client is told the
+// timeout so that it measures the whole replay. A replay that is still cut off before its end is
+// marked as truncated, so that the analysis only compares the part both replays sent.
+package network
+
+import (
+    "strconv"
+    "time"
+
+    "wehe-server/internal/clienthandler"
+)
+
+const (
+    replayTimeoutMargin = 2 * time.Second // added to the length of a replay so that its last packets aren't cut off by scheduling delays
+)
+
+var (
+    maxUDPReplayTimeout = DefaultUDPReplayTimeout // the longest timeout a UDP replay can be given
+)
+
+// Sets the longest timeout a UDP replay can be given when it lasts longer than the UDP replay
+// timeout. This should be called before the replay servers start.
+// timeout: the longest timeout; no longer than the UDP replay timeout to never extend it
+func SetMaxUDPReplayTimeout(timeout time.Duration) {
+    maxUDPReplayTimeout = timeout
+}
+
+// Picks how long a UDP replay is sent for before it is cut off.
+// duration: how long the replay lasts; 0 if unknown
+// maxDuration: how long the client asked the replay to run for; 0 to run the whole replay
+// extendable: true if the client can wait for a replay longer than the UDP replay timeout
+// Returns the timeout of the replay, and true if the replay is cut off before its end
+func udpReplayTimeoutFor(duration time.Duration, maxDuration time.Duration, extendable bool) (time.Duration, bool) {
+    if maxDuration > 0 && (duration == 0 || maxDuration < duration) {
+        duration = maxDuration
+    }
+    if duration <= udpReplayTimeout {
+        return udpReplayTimeout, false
+    }
+    if !extendable || maxUDPReplayTimeout <= udpReplayTimeout {
+        return udpReplayTimeout, true
+    }
+    timeout := min(duration + replayTimeoutMargin, maxUDPReplayTimeout)
+    return timeout, timeout < duration
+}
+
+// Gets how long the UDP replay of a client is sent for before it is cut off.
+// connectedClients: the clients running replays
+// clientKey: the key of the client, from Resolve
+// Returns the timeout of the replay
+func replayTimeoutOf(connectedClients *clienthandler.ConnectedClients, clientKey string) time.Duration {
+    timeout := connectedClients.ReplayTimeout(clientKey)
+    if timeout == 0 {
+        return udpReplayTimeout
+    }
+    return timeout
+}
+
+// Gives the replay a client was just granted its timeout. TCP replays aren't cut off, so they get
+// none.
+// clt: the client
+// Returns the timeout of the replay, which is 0 for TCP replays, or any errors
+func (sideChannel SideChannel) negotiateReplayTimeout(clt *clienthandler.Client) (time.Duration, error) {
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        return 0, err
+    }
+    metadata, exists := sideChannel.Replays.Get(currentReplay.ReplayName)
+    if !exists || metadata.IsTCP {
+        sideChannel.ConnectedClients.SetReplayTimeout(clt.ReplayKey(), 0)
+        return 0, nil
+    }
+    timeout, truncated := udpReplayTimeoutFor(metadata.Duration, currentReplay.MaxDuration, clt.Capabilities.ReplayTimeout)
+    if truncated {
+        clt.Logger().Warn("Replay is longer than its timeout and will be cut off", "replay_duration", metadata.Duration, "replay_timeout", timeout)
+    }
+    sideChannel.ConnectedClients.SetReplayTimeout(clt.ReplayKey(), timeout)
+    return timeout, clt.SetReplayTimeout(timeout, truncated)
+}
+
+// Gets the part of an OK response to ask4permission or declare replay that tells the client the
+// timeout of its replay.
+// clt: the client
+// timeout: the timeout of the replay; 0 for TCP replays
+// Returns ;<timeout seconds>, or nothing if the client doesn't read it
+func replayTimeoutInfo(clt *clienthandler.Client, timeout time.Duration) string {
+    if !clt.Capabilities.ReplayTimeout {
+        return ""
+    }
+    return ";" + strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64)
+}
@@ -0,0 +1,63 @@
+// Reads the replay tokens that clients put at the start of their replays, so that the replay servers
+// can tell apart clients that share a public IP. A client that asked for a token when it declared
+// its test starts the first packet it sends on each replay port with WEHETOKEN: and its token. The
+// header isn't part of the replay, so it is cut off before the packet is compared with the replay.
+package network
+
+import (
+    "bytes"
+    "io"
+    "net"
+
+    "wehe-server/internal/clienthandler"
+)
+
+const (
+    replayTokenMagic = "WEHETOKEN:" // starts the replay token header
+    replayTokenHeaderLength = len(replayTokenMagic) + clienthandler.ReplayTokenLength // bytes in the replay token header
+)
+
+// Splits the replay token header off the first packet of a replay.
+// packet: the first packet the client sent on a replay port
+// Returns the replay token and the rest of the packet, or an empty token and the whole packet if the
+//     packet doesn't start with a replay token header
+func splitReplayToken(packet []byte) (string, []byte) {
+    if len(packet) < replayTokenHeaderLength || !bytes.HasPrefix(packet, []byte(replayTokenMagic)) {
+        return "", packet
+    }
+    return string(packet[len(replayTokenMagic):replayTokenHeaderLength]), packet[replayTokenHeaderLength:]
+}
+
+// Reads the rest of a replay token header that was split across TCP segments. Nothing more is read
+// if the bytes read so far can't be the start of a header.
+// conn: the connection to the client
+// received: the bytes read from the connection so far
+// Returns the bytes read from the connection so far, including the whole header if the client sent
+//     one, or any errors
+func readReplayTokenHeader(conn net.Conn, received []byte) ([]byte, error) {
+    if len(received) >= replayTokenHeaderLength {
+        return received, nil
+    }
+    prefixLength := min(len(received), len(replayTokenMagic))
+    if !bytes.Equal(received[:prefixLength], []byte(replayTokenMagic[:prefixLength])) {
+        return received, nil
+    }
+    header := make([]byte, replayTokenHeaderLength)
+    copy(header, received)
+    _, err := io.ReadFull(conn, header[len(received):])
+    if err != nil {
+        return nil, err
+    }
+    return header, nil
+}
+
+// Gets the part of an OK response to ask4permission or declare replay that gives the client its
+// replay token.
+// clt: the client
+// Returns ;<replay token>, or nothing if the client didn't ask for one
+func replayTokenInfo(clt *clienthandler.Client) string {
+    if clt.ReplayToken == "" {
+        return ""
+    }
+    return ";" + clt.ReplayToken
+}
@@ -0,0 +1,53 @@
+// Checks the requests that clients send during TCP replays against the requests in the replay
+// files. The TCP replay servers otherwise only count the bytes of each request, so a middlebox
+// that rewrites the requests, or a client running the wrong replay, would go unnoticed.
+package network
+
+import (
+    "crypto/sha1"
+    "encoding/hex"
+    "fmt"
+    "log/slog"
+
+    "wehe-server/internal/metrics"
+)
+
+var (
+    requestHashMismatches = metrics.NewCounterVec("wehe_request_hash_mismatches_total",
+        "Number of TCP replay requests that didn't match the request in the replay file, by replay.", "replay")
+)
+
+// What a TCP replay server does when the request of a client doesn't match the replay
+type RequestHashCheck string
+
+const (
+    StrictRequestHash RequestHashCheck = "strict" // stop the replay and notify the client
+    PermissiveRequestHash RequestHashCheck = "permissive" // record the mismatch and keep sending the replay
+    NoRequestHashCheck RequestHashCheck = "off" // don't check the requests
+)
+
+// Checks the request a client sent before a response set of a TCP replay. Mismatches are logged,
+// counted, and recorded so that they are written to the replay info of the replay.
+// clientKey: the key of the client, from Resolve
+// request: the bytes the client sent before the response set
+// requestHash: the hex SHA-1 hash of the request in the replay file; empty if the replay file has none
+// replayName: the name of the replay
+// responseSet: the number of the response set, starting at 1
+// logger: logs with the fields that identify the test of the client
+// Returns an error if the request doesn't match and the check is strict
+func (tcpServer TCPServer) checkRequest(clientKey string, request []byte, requestHash string, replayName string, responseSet int, logger *slog.Logger) error {
+    if tcpServer.RequestHashCheck == NoRequestHashCheck || requestHash == "" {
+        return nil
+    }
+    hash := sha1.Sum(request)
+    if hex.EncodeToString(hash[:]) == requestHash {
+        return nil
+    }
+    requestHashMismatches.Inc(replayName)
+    tcpServer.IPReplayNameMapping.AddRequestHashMismatch(clientKey, responseSet)
+    logger.Warn("Request from client doesn't match the replay", "response", responseSet, "bytes", len(request), "check", tcpServer.RequestHashCheck)
+    if tcpServer.RequestHashCheck == StrictRequestHash {
+        return fmt.Errorf("Request before response %d doesn't match the replay", responseSet)
+    }
+    return nil
+}
@@ -6,19 +6,36 @@ import (
     "crypto/tls"
     "encoding/binary"
     "encoding/json"
+    "errors"
     "fmt"
     "io"
+    "log/slog"
     "net"
     "strconv"
     "strings"
 
     "github.com/m-lab/uuid"
 
+    "wehe-server/internal/analysis"
     "wehe-server/internal/clienthandler"
+    "wehe-server/internal/clock"
+    "wehe-server/internal/compat"
+    "wehe-server/internal/errs"
+    "wehe-server/internal/shutdown"
+    "wehe-server/internal/testdata"
 )
 
 const (
-    port = 55556
+    DefaultSideChannelPort = 55556 // the port clients connect to the side channel on unless the config says otherwise
+    maxThroughputsMessageSize = 1 << 20 // largest throughputs message accepted, in bytes; fits MaxThroughputSamples of each array
+)
+
+var (
+    // the largest message accepted for opcodes that have a limit below the 24-bit maximum, in bytes
+    maxMessageSizes = map[opcode]uint32{
+        throughputs: maxThroughputsMessageSize,
+        latencies: maxThroughputsMessageSize,
+    }
 )
 
 type opcode byte // request type from the client
@@ -32,6 +49,12 @@ const (
     throughputs
     declareReplay
     analyzeTest
+    ping
+    replayStatus
+    decisionPolicy
+    latencies
+    endTest // ends the test, whether or not it was analyzed; the connection closes after the response
+    bandwidthProbe // starts a bandwidth probe on a test port, or collects its result
 )
 
 type responseCode byte // code representing the status of a response back to the client
@@ -39,135 +62,282 @@ type responseCode byte // code representing the status of a response back to the
 const (
     okResponse responseCode = iota
     errorResponse
+    upgradeRequiredResponse // the client is too old to be tested; the message is the oldest supported version
+)
+
+const (
+    rejectionMessageTooLarge = "message_too_large" // the message is longer than its opcode allows; limit is in bytes
+    rejectionTooManySamples = "too_many_samples" // an array of throughputs or sample times is too long; limit is in samples
 )
 
+// Why a request was rejected, sent as the message of an error response so that the client can tell
+// an oversized request apart from other errors
+type rejection struct {
+    Reason string `json:"reason"`
+    Limit int `json:"limit"`
+}
+
 // Channel that allows client to notify server which replay it would like to run in addition to
 // exchanging metadata, like carrier name, GPS info.
 type SideChannel struct {
     IP string // IP server should listen on
     Port int // TCP port server should listen on
-    ReplayNames []string // names of all the replays
+    Replays *testdata.Registry // all the replays on the server
     ConnectedClients *clienthandler.ConnectedClients // connected clients to the side channel
+    InFlightTests *clienthandler.InFlightTests // the tests that are running, for the shutdown report
     TmpResultsDir string // the directory to write temporary files to
     ResultsDir string // the directory to write permanent results to
+    DuplicateTestPolicy string // what to do when a userID and testID are submitted again: "version" or "reject"
+    Timeouts SideChannelTimeouts // how long clients have to respond before they are disconnected
+    Clock clock.Clock // the time source the deadlines of connections are set from
+    MinClientVersion compat.Version // clients older than this are told to upgrade; the zero value lets every client in
+    LossCaptures *LossCaptures // measures the packets the server retransmits during each replay; nil if they aren't measured
+    oldServerMapping *oldServerMappingCache // server mapping sent to clients using the old protocol
 }
 
-func NewSideChannel(ip string, replayNames []string, uuidPrefixFile string, tmpResultsDir string, resultsDir string) (SideChannel, error) {
+func NewSideChannel(ip string, replays *testdata.Registry, tcpPorts []int, udpPorts []int, uuidPrefixFile string, tmpResultsDir string, resultsDir string, duplicateTestPolicy string) (SideChannel, error) {
     err := uuid.SetUUIDPrefixFile(uuidPrefixFile)
     if err != nil {
         return SideChannel{}, err
     }
     return SideChannel{
         IP: ip,
-        Port: port,
-        ReplayNames: replayNames,
+        Port: DefaultSideChannelPort,
+        Replays: replays,
         ConnectedClients: clienthandler.NewConnectedClients(),
+        InFlightTests: clienthandler.NewInFlightTests(tmpResultsDir),
         TmpResultsDir: tmpResultsDir,
         ResultsDir: resultsDir,
+        DuplicateTestPolicy: duplicateTestPolicy,
+        Clock: clock.Real{},
+        oldServerMapping: newOldServerMappingCache(replays, tcpPorts, udpPorts),
     }, nil
 }
 
+// Changes the test ports offered to clients using the old protocol, e.g. after the port numbers file
+// is reloaded.
+// tcpPorts: TCP ports that replay servers are listening on
+// udpPorts: UDP ports that replay servers are listening on
+func (sideChannel SideChannel) SetReplayPorts(tcpPorts []int, udpPorts []int) {
+    sideChannel.oldServerMapping.setPorts(tcpPorts, udpPorts)
+}
+
+// Binds the side channel port. Binding is separate from serving so that the port can be bound
+// before the server drops its privileges.
+// tlsConfig: the TLS config of the side channel
+// Returns the TLS listener or any errors
+func (sideChannel SideChannel) Listen(tlsConfig *tls.Config) (net.Listener, error) {
+    return tls.Listen("tcp", net.JoinHostPort(sideChannel.IP, strconv.Itoa(sideChannel.Port)), tlsConfig)
+}
+
 // Starts the side channel server and listen for client connections.
-// cert: the server cert
+// listener: the listener returned by Listen
 // errChan: channel used to communicate errors back to the main thread
-func (sideChannel SideChannel) StartServer(cert tls.Certificate, errChan chan<- error) {
-    tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
-    listener, err := tls.Listen("tcp", fmt.Sprintf("%s:%d", sideChannel.IP, sideChannel.Port), tlsConfig)
-    if err != nil {
-        errChan <- err
-        return
-    }
+func (sideChannel SideChannel) StartServer(listener net.Listener, errChan chan<- error) {
     defer listener.Close()
 
-    fmt.Println("Listening on side channel", sideChannel.Port)
+    slog.Info("Listening on side channel", "port", sideChannel.Port)
     // get connections from clients
     for {
         conn, err := listener.Accept()
+        if errors.Is(err, net.ErrClosed) {
+            // the listener is closed when the server starts draining before it exits
+            slog.Info("Stopped listening on side channel", "port", sideChannel.Port)
+            return
+        }
         if err != nil {
             //TODO: figure out what should happen if connection can't be accepted
-            fmt.Println("Error accepting connection:", err)
+            slog.Error("Error accepting connection", "protocol", "side channel", "port", sideChannel.Port, "error", err)
             continue
         }
 
         go sideChannel.handleConnection(conn)
     }
-
-    errChan <- nil
 }
 
 // Handles a side channel connection from a clienthandler.
 // conn: the client side channel connection
 func (sideChannel SideChannel) handleConnection(conn net.Conn) {
+    defer shutdown.RecoverPanic()
     defer conn.Close()
+    err := handshake(conn)
+    if err != nil {
+        return
+    }
+    // nothing on the connection can go past the end of the test
+    connectedAt := sideChannel.Clock.Now()
+    conn.SetDeadline(sideChannel.Timeouts.deadline(connectedAt, 0, connectedAt))
     var clt *clienthandler.Client
-    // TODO: add feature that forces user to upgrade if their version is too old
+    var testErr error // the error that ended the test, if any
+    testEnded := false // true once the client has ended the test itself
 
     for {
+        // lines are tagged with the test once the client has said which test it is running
+        logger := slog.With("remote_addr", conn.RemoteAddr().String())
+        if clt != nil {
+            logger = clt.Logger()
+        }
+        conn.SetReadDeadline(sideChannel.Timeouts.deadline(sideChannel.Clock.Now(), sideChannel.Timeouts.Read, connectedAt))
         op, first4Bytes, message, err := sideChannel.readRequest(conn)
+        err = disconnected(sideChannel.Timeouts.explain(err))
+        if errors.Is(err, errs.ErrMessageTooLarge) && clt != nil {
+            // the message was never read, so the connection can't be used after rejecting it
+            sideChannel.sendError(clt, err)
+        }
         if err != nil {
             // when client disconnects, an error is thrown, but that isn't really an error
-            if err != io.EOF && !strings.Contains(err.Error(), "tls: user canceled") {
-                handleSideChannelError(err)
+            if !errors.Is(err, errs.ErrClientGone) {
+                handleSideChannelError(logger, err)
+                testErr = err
             }
             break
         }
-        fmt.Println("Got opcode:", op)
+        logger.Debug("Got opcode", "opcode", op)
 
         if clt == nil && op != oldDeclareID && op != receiveID {
-            handleSideChannelError(fmt.Errorf("Client is nil. Was test ever requested?\n"))
+            handleSideChannelError(logger, fmt.Errorf("%w: client is nil. Was test ever requested?\n", errs.ErrNoTest))
             break
         }
 
         switch op {
         case oldDeclareID:
+            // the old protocol reads on its own, so its reads are only limited by the length of the test
+            conn.SetReadDeadline(sideChannel.Timeouts.deadline(sideChannel.Clock.Now(), 0, connectedAt))
             err = sideChannel.handleOldSideChannel(conn, first4Bytes)
         case receiveID:
             clt, err = sideChannel.receiveID(conn, message)
             if err == nil {
-                defer clt.CleanUp(sideChannel.ConnectedClients)
+                sideChannel.InFlightTests.Add(clt)
+                // endTest cleans up before it acknowledges the end of the test, so that the client can
+                // start its next test right away; cleaning up again could forget that test
+                endedClient := clt
+                defer func() {
+                    if !testEnded {
+                        endedClient.CleanUp(sideChannel.ConnectedClients)
+                        sideChannel.InFlightTests.Remove(endedClient)
+                    }
+                }()
             }
         case ask4permission:
             err = sideChannel.ask4Permission(clt)
         case mobileStats:
             err = sideChannel.receiveMobileStats(clt, message)
         case throughputs:
-            err = sideChannel.receiveThroughputs(clt, message)
+            err = sideChannel.collectReplayErrors(clt)
+            if err == nil {
+                err = sideChannel.collectReplayLoss(clt)
+            }
+            if err == nil {
+                err = sideChannel.receiveThroughputs(clt, message)
+            }
+            if err == nil {
+                // kept alongside the throughputs of the client to check them against
+                err = clt.SampleServerThroughputs(sideChannel.ConnectedClients, sideChannel.TmpResultsDir)
+            }
             if err == nil {
                 err = clt.WriteReplayInfoToFile(sideChannel.TmpResultsDir)
             }
+            if err == nil {
+                sideChannel.InFlightTests.SetState(clt, clienthandler.TestReplayDone)
+            }
         case declareReplay:
             err = sideChannel.declareReplay(clt, message)
         case analyzeTest:
+            sideChannel.InFlightTests.SetState(clt, clienthandler.TestAnalyzing)
             err = sideChannel.analyzeTest(clt)
-            /*if err != nil {
-                break
+            if err == nil {
+                err = clt.WriteResultsToFile(sideChannel.TmpResultsDir)
             }
-            err = clt.WriteResultsToFile()
             if err == nil {
-                err = clt.WriteReplayInfoToFile(sideChannel.TmpResultsDir)
-            }*/
+                err = clt.WriteSideChannelRTTsToFile(sideChannel.TmpResultsDir)
+            }
+            if err == nil {
+                sideChannel.InFlightTests.SetState(clt, clienthandler.TestAnalyzed)
+            }
+        case ping:
+            err = sideChannel.ping(clt, message)
+        case replayStatus:
+            err = sideChannel.replayStatus(clt)
+        case decisionPolicy:
+            err = sideChannel.sendDecisionPolicy(clt)
+        case latencies:
+            err = sideChannel.receiveLatencies(clt, message)
+        case endTest:
+            testEnded = true
+            err = sideChannel.endTest(clt)
+        case bandwidthProbe:
+            err = sideChannel.bandwidthProbe(clt, message)
         default:
-            err = fmt.Errorf("Unknown side channel opcode: %d\n", op)
+            err = fmt.Errorf("%w: unknown side channel opcode: %d\n", errs.ErrMalformedMessage, op)
         }
 
         if err != nil {
-            handleSideChannelError(err)
+            if clt != nil {
+                logger = clt.Logger()
+            }
+            err = sideChannel.Timeouts.explain(err)
+            handleSideChannelError(logger, err)
+            testErr = err
             break
         }
+        if testEnded {
+            break
+        }
+    }
+
+    // clients using the old protocol are handled by the old side channel, and tests that the client
+    // ended have already been finalized
+    if clt != nil && !testEnded {
+        sideChannel.finalizeTest(clt, testErr)
     }
 }
 
+// Finalizes a test that is over: derives the throughputs that the client didn't send, writes the
+// manifest of the test so that its results can be uploaded, and records the test in the daily
+// report.
+// clt: the client
+// testErr: the error that ended the test, or nil if the test ended normally
+// Returns what was stored for the test
+func (sideChannel SideChannel) finalizeTest(clt *clienthandler.Client, testErr error) clienthandler.TestSummary {
+    sideChannel.deriveMissingThroughputs(clt)
+    testRef, files := clt.WriteManifest(sideChannel.TmpResultsDir)
+    clt.ReportTest(testErr)
+    return clt.Summary(testRef, files)
+}
+
+// Ends a test at the request of the client, whether or not the client analyzed it, and sends back
+// what was stored for the test so that the client knows its results were kept. A client that skips
+// the analysis no longer leaves its test open until the connection times out.
+// clt: the client handler that made the request
+// Returns any errors
+func (sideChannel SideChannel) endTest(clt *clienthandler.Client) error {
+    summary := sideChannel.finalizeTest(clt, nil)
+    clt.CleanUp(sideChannel.ConnectedClients)
+    sideChannel.InFlightTests.Remove(clt)
+    clt.Logger().Info("Client ended test", "test_ref", summary.TestRef, "analyzed", summary.Analyzed)
+    jsonBytes, err := json.Marshal(summary)
+    if err != nil {
+        return err
+    }
+    return sideChannel.sendResponse(clt, okResponse, string(jsonBytes))
+}
+
 // Handles errors thrown by a side channel connection.
+// logger: logs with the fields that identify the connection or its test
 // err: the error that was thrown
-func handleSideChannelError(err error) {
-    // TODO: this should be logged to error file
-    fmt.Println("Side channel error:", err)
+func handleSideChannelError(logger *slog.Logger, err error) {
+    logger.Error("Side channel error", "error", err)
 }
 
 // Reads a request from the client. First, an 8-bit opcode and 24-bit big-endian unsigned message
-// length is read. Using this length, the acutal message is then read.
+// length is read. Using this length, the acutal message is then read. Messages longer than the
+// limit of their opcode are not read.
 // conn: the connection to the client
-// Returns the opcode, first 4 bytes read (if old protocol), message read, and any errors
+// Returns the opcode, first 4 bytes read (if old protocol), message read, and any errors; the error
+//     is an errs.LimitError if the message is too long
+// Messages carry no nonce or timestamp. TLS already stops captured messages from being replayed
+// into another connection, and since messages aren't signed, whoever replays one could rewrite a
+// nonce or timestamp as easily as the rest of it, so checking them here would protect nothing.
 func (sideChannel SideChannel) readRequest(conn net.Conn) (opcode, []byte, string, error) {
     // get opcode and size of message
     opcodeAndDataLength := make([]byte, 4)
@@ -183,6 +353,10 @@ func (sideChannel SideChannel) readRequest(conn net.Conn) (opcode, []byte, strin
     }
     opcodeAndDataLength[0] = 0 // zero out first byte so that 24-bit length can be read with Uint32
     dataLength := binary.BigEndian.Uint32(opcodeAndDataLength)
+    maxSize, hasLimit := maxMessageSizes[op]
+    if hasLimit && dataLength > maxSize {
+        return op, nil, "", &errs.LimitError{Kind: errs.ErrMessageTooLarge, Limit: int(maxSize), Message: fmt.Sprintf("opcode %d message is %d bytes; limit is %d bytes", op, dataLength, maxSize)}
+    }
 
     // get the message
     message := make([]byte, dataLength)
@@ -201,6 +375,7 @@ func (sideChannel SideChannel) readRequest(conn net.Conn) (opcode, []byte, strin
 func (sideChannel SideChannel) sendResponse(clt *clienthandler.Client, respCode responseCode, message string) error {
     messageBytes := []byte(message)
     messageLength := len(messageBytes) + 1
+    clt.Conn.SetWriteDeadline(sideChannel.Timeouts.deadline(sideChannel.Clock.Now(), sideChannel.Timeouts.Write, clt.StartTime))
 
     // send size of message
     messageLengthBytes := make([]byte, 4)
@@ -231,7 +406,7 @@ func (sideChannel SideChannel) sendResponse(clt *clienthandler.Client, respCode
 // Returns the message or any errors
 func getMessage(buffer []byte, n int) (string, error) {
     if len(buffer) < 2 {
-        return "", fmt.Errorf("Cannot get message from side channel buffer; buffer too short\n")
+        return "", fmt.Errorf("%w: cannot get message from side channel buffer; buffer too short\n", errs.ErrMalformedMessage)
     }
     return string(buffer[1:n]), nil
 }
@@ -243,31 +418,42 @@ func getMessage(buffer []byte, n int) (string, error) {
 func (sideChannel SideChannel) receiveID(conn net.Conn, message string) (*clienthandler.Client, error) {
     pieces := strings.Split(message, ";")
     if len(pieces) < 6 {
-        return nil, fmt.Errorf("Expected to receive at least 6 pieces from declare ID; only received %d.\n", len(pieces))
+        return nil, fmt.Errorf("%w: expected to receive at least 6 pieces from declare ID; only received %d.\n", errs.ErrMalformedMessage, len(pieces))
     }
 
     userID := pieces[0]
 
-    replayIDInt, err := strconv.Atoi(pieces[1])
+    replayID, err := clienthandler.ParseReplayType(pieces[1])
     if err != nil {
         return nil, err
     }
-    var replayID clienthandler.ReplayType
-    if replayIDInt == 0 {
-        replayID = clienthandler.Original
-    } else if replayIDInt == 1 {
-        replayID = clienthandler.Random
-    } else {
-        return nil, fmt.Errorf("Unexpected replay ID: %d; must be 0 (original) or 1 (random)", replayIDInt)
-    }
 
-    //TODO: change client replay files replay names to use _ instead of -, then delete this terrible replace code
-    replayName := strings.Replace(pieces[2], "-", "_", -1)
+    clientVersion, testPortIP := compat.DeclareIDExtras(pieces)
+    replayName := compat.ReplayName(pieces[2], compat.For(clientVersion))
+    maxDuration, err := clienthandler.ParseMaxReplayDuration(compat.DeclareIDMaxReplayDuration(pieces))
+    if err != nil {
+        return nil, err
+    }
+    requestedSamples, err := clienthandler.ParseSamplesPerReplay(compat.DeclareIDSamplesPerReplay(pieces))
+    if err != nil {
+        return nil, err
+    }
+    experimentFlags, err := clienthandler.ParseExperimentFlags(compat.DeclareIDExperimentFlags(pieces))
+    if err != nil {
+        return nil, err
+    }
+    wantsReplayToken := false
+    if tokenPiece := compat.DeclareIDReplayToken(pieces); tokenPiece != "" {
+        wantsReplayToken, err = strToBool(tokenPiece)
+        if err != nil {
+            return nil, err
+        }
+    }
 
     extraString := pieces[3]
     testID, err := strconv.Atoi(pieces[4])
     if err != nil {
-        return nil, err
+        return nil, errs.Malformed(err)
     }
     isLastReplay, err := strToBool(pieces[5])
     if err != nil {
@@ -275,20 +461,11 @@ func (sideChannel SideChannel) receiveID(conn net.Conn, message string) (*client
     }
 
     // Some ISPs may give clients multiple IPs - one for each port. We want to use the test port
-    // as the client's public IP. Client may send us an IP, which is the IP of the client using
-    // the test port. If client does not provide us with an IP, or if the IP provided is 127.0.0.1,
-    // then we just use the side channel IP of the clienthandler.
-    publicIP, err := getClientPublicIP(conn)
+    // as the client's public IP.
+    publicIP, err := clientTestPortIP(testPortIP, conn)
     if err != nil {
         return nil, err
     }
-    clientVersion := "1.0"
-    if len(pieces) > 6 {
-        if pieces[6] != "127.0.0.1" {
-            publicIP = pieces[6]
-        }
-        clientVersion = pieces[7]
-    }
 
     tlsConn, ok := conn.(*tls.Conn)
     if !ok {
@@ -304,9 +481,30 @@ func (sideChannel SideChannel) receiveID(conn net.Conn, message string) (*client
     }
 
     clt := clienthandler.NewClient(conn, userID, extraString, testID, publicIP, clientVersion, mlabUUID)
+    clt.ExperimentFlags = experimentFlags
     clt.AddReplay(replayID, replayName, isLastReplay)
+    clt.SetMaxReplayDuration(maxDuration)
+    clt.NegotiateSamplesPerReplay(requestedSamples)
+    if wantsReplayToken {
+        err = clt.IssueReplayToken()
+        if err != nil {
+            return nil, err
+        }
+    }
 
-    fmt.Println(clt)
+    // the client reads this in place of the response to its next request
+    if sideChannel.requiresUpgrade(clientVersion) {
+        err = sideChannel.upgradeRequiredError(clientVersion)
+        sideChannel.sendError(clt, err)
+        return nil, err
+    }
+
+    err = clt.CheckDuplicateTest(sideChannel.TmpResultsDir, sideChannel.DuplicateTestPolicy)
+    if err != nil {
+        return nil, err
+    }
+
+    clt.Logger().Info("Client connected", "client_version", clt.ClientVersion, "mlab_uuid", clt.MLabUUID)
     return clt, nil
 }
 
@@ -314,10 +512,19 @@ func (sideChannel SideChannel) receiveID(conn net.Conn, message string) (*client
 // clt: the client handler that made the request
 // Returns any errors
 func (sideChannel SideChannel) ask4Permission(clt *clienthandler.Client) error {
-    status, info, err := clt.Ask4Permission(sideChannel.ReplayNames, sideChannel.ConnectedClients)
+    status, info, err := clt.Ask4Permission(sideChannel.Replays.Names(), sideChannel.ConnectedClients)
     if err != nil {
         return err
     }
+    if status == clienthandler.Ask4PermissionOkStatus {
+        sideChannel.InFlightTests.SetState(clt, clienthandler.TestReplaying)
+        sideChannel.startLossCapture(clt)
+        timeout, err := sideChannel.negotiateReplayTimeout(clt)
+        if err != nil {
+            return err
+        }
+        info += replayTimeoutInfo(clt, timeout) + replayTokenInfo(clt)
+    }
     resp := status + ";" + info
     err = sideChannel.sendResponse(clt, okResponse, resp)
     if err != nil {
@@ -333,7 +540,7 @@ func (sideChannel SideChannel) ask4Permission(clt *clienthandler.Client) error {
 func (sideChannel SideChannel) receiveMobileStats(clt *clienthandler.Client, message string) error {
     err := clt.ReceiveMobileStats(message)
     if err != nil {
-        sideChannel.sendResponse(clt, errorResponse, "")
+        sideChannel.sendError(clt, err)
         return err
     }
     err = sideChannel.sendResponse(clt, okResponse, "")
@@ -350,7 +557,7 @@ func (sideChannel SideChannel) receiveMobileStats(clt *clienthandler.Client, mes
 func (sideChannel SideChannel) receiveThroughputs(clt *clienthandler.Client, message string) error {
     err := clt.ReceiveThroughputs(message, sideChannel.TmpResultsDir)
     if err != nil {
-        sideChannel.sendResponse(clt, errorResponse, "")
+        sideChannel.sendError(clt, err)
         return err
     }
     err = sideChannel.sendResponse(clt, okResponse, "")
@@ -360,15 +567,57 @@ func (sideChannel SideChannel) receiveThroughputs(clt *clienthandler.Client, mes
     return nil
 }
 
+// Receives a series of RTTs the client measured to the replay port before, during, or after its
+// current replay.
+// clt: the client handler that made the request
+// message: the data received from the client
+// Returns any errors
+func (sideChannel SideChannel) receiveLatencies(clt *clienthandler.Client, message string) error {
+    err := clt.ReceiveLatencies(message, sideChannel.TmpResultsDir)
+    if err != nil {
+        sideChannel.sendError(clt, err)
+        return err
+    }
+    return sideChannel.sendResponse(clt, okResponse, "")
+}
+
+// Tells the client that its request was rejected for being too large. Clients that can't read the
+// reason get a plain error response. Errors are only logged since the request already failed.
+// clt: the client handler that made the request
+// reason: why the request was rejected
+// limit: the limit the request went over
+func (sideChannel SideChannel) sendRejection(clt *clienthandler.Client, reason string, limit int) {
+    if !clt.Capabilities.StructuredRejections {
+        sideChannel.sendResponse(clt, errorResponse, "")
+        return
+    }
+    jsonBytes, err := json.Marshal(rejection{Reason: reason, Limit: limit})
+    if err == nil {
+        err = sideChannel.sendResponse(clt, errorResponse, string(jsonBytes))
+    }
+    if err != nil {
+        clt.Logger().Error("Unable to send rejection to client", "reason", reason, "error", err)
+    }
+}
+
 // Receives request to run an additional replay and determines if that replay is allowed to run.
 // clt: the client handler that made the request
 // message: the data received from the client
 // Returns any errors
 func (sideChannel SideChannel) declareReplay(clt *clienthandler.Client, message string) error {
-    status, info, err := clt.DeclareReplay(sideChannel.ReplayNames, message)
+    status, info, err := clt.DeclareReplay(sideChannel.Replays.Names(), message)
     if err != nil {
         return err
     }
+    sideChannel.InFlightTests.SetState(clt, clienthandler.TestDeclared)
+    if status == clienthandler.Ask4PermissionOkStatus {
+        sideChannel.startLossCapture(clt)
+        timeout, err := sideChannel.negotiateReplayTimeout(clt)
+        if err != nil {
+            return err
+        }
+        info += replayTimeoutInfo(clt, timeout) + replayTokenInfo(clt)
+    }
     resp := status + ";" + info
     err = sideChannel.sendResponse(clt, okResponse, resp)
     if err != nil {
@@ -377,21 +626,193 @@ func (sideChannel SideChannel) declareReplay(clt *clienthandler.Client, message
     return nil
 }
 
+// Runs a bandwidth probe for the client in two steps. On "start", the server expects a probe on a
+// test port and tells the client the size of the burst and how long it can take, as
+// <bytes>;<timeout ms>, followed by ;<replay token> if the client asked for one, since the probe
+// starts with the token like a replay does. Once the client has received the burst, on "result", the server compares the
+// probe with the replay the client declared and sends the result as JSON. If probes are off or the
+// probe didn't finish, an error response is sent, and the client can run the test without a probe.
+// clt: the client handler that made the request
+// message: "start" or "result"
+// Returns any errors
+func (sideChannel SideChannel) bandwidthProbe(clt *clienthandler.Client, message string) error {
+    switch message {
+    case "start":
+        info, enabled := clt.StartBandwidthProbe()
+        if !enabled {
+            return sideChannel.sendResponse(clt, errorResponse, "")
+        }
+        return sideChannel.sendResponse(clt, okResponse, info + replayTokenInfo(clt))
+    case "result":
+        currentReplay, err := clt.GetCurrentReplay()
+        if err != nil {
+            sideChannel.sendError(clt, err)
+            return err
+        }
+        metadata, _ := sideChannel.Replays.Get(currentReplay.ReplayName)
+        result, finished, err := clt.FinishBandwidthProbe(metadata.AverageMbps())
+        if err != nil {
+            sideChannel.sendError(clt, err)
+            return err
+        }
+        if !finished {
+            return sideChannel.sendResponse(clt, errorResponse, "")
+        }
+        jsonBytes, err := json.Marshal(result)
+        if err != nil {
+            return err
+        }
+        return sideChannel.sendResponse(clt, okResponse, string(jsonBytes))
+    default:
+        return fmt.Errorf("%w: unknown bandwidth probe request: %s\n", errs.ErrMalformedMessage, message)
+    }
+}
+
+// Responds to a ping from the client so that the round trip time of the side channel can be
+// measured.
+// clt: the client handler that made the request
+// message: empty, or the token received in the response to the previous ping
+// Returns any errors
+func (sideChannel SideChannel) ping(clt *clienthandler.Client, message string) error {
+    token := clt.ReceivePing(message)
+    err := sideChannel.sendResponse(clt, okResponse, token)
+    if err != nil {
+        return err
+    }
+    return nil
+}
+
+// Sends the decision policy the server uses to decide if tests show differentiation, so that the
+// client can show the methodology behind its results.
+// clt: the client handler that made the request
+// Returns any errors
+func (sideChannel SideChannel) sendDecisionPolicy(clt *clienthandler.Client) error {
+    jsonBytes, err := json.Marshal(clienthandler.GetDecisionPolicy())
+    if err != nil {
+        sideChannel.sendError(clt, err)
+        return err
+    }
+    err = sideChannel.sendResponse(clt, okResponse, string(jsonBytes))
+    if err != nil {
+        return err
+    }
+    return nil
+}
+
+// Moves the errors that the replay servers encountered while sending the current replay, the
+// requests that didn't match the replay, the packets that didn't fit the path MTU, the jitter they
+// measured, and the bytes they sent, into the client.
+// clt: the client handler running the replay
+// Returns any errors
+func (sideChannel SideChannel) collectReplayErrors(clt *clienthandler.Client) error {
+    replayErrors, aborted := sideChannel.ConnectedClients.TakeReplayErrors(clt.ReplayKey())
+    err := clt.AddReplayErrors(replayErrors, aborted)
+    if err != nil {
+        return err
+    }
+    err = clt.AddRequestHashMismatches(sideChannel.ConnectedClients.TakeRequestHashMismatches(clt.ReplayKey()))
+    if err != nil {
+        return err
+    }
+    err = clt.SetPathMTUReport(sideChannel.ConnectedClients.TakePathMTUReport(clt.ReplayKey()))
+    if err != nil {
+        return err
+    }
+    err = clt.SetJitterReport(sideChannel.ConnectedClients.TakeJitterReport(clt.ReplayKey()))
+    if err != nil {
+        return err
+    }
+    return clt.CollectBytesSent(sideChannel.ConnectedClients)
+}
+
+// Saves throughputs derived from the bytes the server sent if the client disconnected before sending
+// the throughputs of its current replay, so that the partial test still contributes data. Errors
+// are only logged since the client is already gone.
+// clt: the client handler whose connection ended
+func (sideChannel SideChannel) deriveMissingThroughputs(clt *clienthandler.Client) {
+    // the bytes of a replay the client disconnected during still count against the user
+    err := clt.CollectBytesSent(sideChannel.ConnectedClients)
+    if err != nil {
+        handleSideChannelError(clt.Logger(), err)
+    }
+    err = sideChannel.collectReplayLoss(clt)
+    if err != nil {
+        handleSideChannelError(clt.Logger(), err)
+    }
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil || len(currentReplay.Throughputs) > 0 {
+        return
+    }
+    err = clt.SampleServerThroughputs(sideChannel.ConnectedClients, sideChannel.TmpResultsDir)
+    if err == nil && currentReplay.ServerDerivedThroughputs {
+        err = clt.WriteReplayInfoToFile(sideChannel.TmpResultsDir)
+    }
+    if err != nil {
+        handleSideChannelError(clt.Logger(), fmt.Errorf("Unable to derive throughputs from the server: %v", err))
+    }
+}
+
+// The status of a replay sent back to the client
+type ReplayStatusResult struct {
+    Aborted bool `json:"aborted"`
+    Errors []string `json:"errors"`
+}
+
+// Notifies the client of any errors that the replay servers encountered while sending the current
+// replay, so that the client doesn't have to wait for a timeout to find out that a replay failed.
+// clt: the client handler that made the request
+// Returns any errors
+func (sideChannel SideChannel) replayStatus(clt *clienthandler.Client) error {
+    err := sideChannel.collectReplayErrors(clt)
+    if err != nil {
+        sideChannel.sendError(clt, err)
+        return err
+    }
+    currentReplay, err := clt.GetCurrentReplay()
+    if err != nil {
+        sideChannel.sendError(clt, err)
+        return err
+    }
+
+    result := ReplayStatusResult{
+        Aborted: currentReplay.Aborted,
+        Errors: currentReplay.ReplayErrors,
+    }
+    if result.Errors == nil {
+        result.Errors = []string{}
+    }
+    jsonBytes, err := json.Marshal(result)
+    if err != nil {
+        return err
+    }
+
+    err = sideChannel.sendResponse(clt, okResponse, string(jsonBytes))
+    if err != nil {
+        return err
+    }
+    return nil
+}
+
 // The stats to send back to the client for a 2-sample KS test analysis
 type KS2Result struct {
     Area0var float64 `json:"Area0Var"`
     KS2pVal float64 `json:"KS2pVal"`
     OriginalAvgThroughput float64 `json:"OriginalAvgThroughput"`
     RandomAvgThroughput float64 `json:"RandomAvgThroughput"`
+    Differentiation bool `json:"Differentiation"`
+    Policy string `json:"Policy"`
+    Verdict analysis.VerdictResult `json:"Verdict"` // the checks of the policy that the decision was made from
+    Variants []clienthandler.VariantResult `json:"Variants,omitempty"` // the control replays compared against the original replay
+    Localization *analysis.LocalizationResults `json:"Localization,omitempty"` // whether packets the server retransmitted point to throttling or congestion; omitted if they weren't captured
 }
 
 // Performs a 2-sample KS test.
 // clt: the client handler that made the request
 // Returns any errors
 func (sideChannel SideChannel) analyzeTest(clt *clienthandler.Client) error {
-    err := clt.AnalyzeTest()
+    err := clt.AnalyzeTest(sideChannel.TmpResultsDir)
     if err != nil {
-        sideChannel.sendResponse(clt, errorResponse, "")
+        sideChannel.sendError(clt, err)
         return err
     }
     ks2Result := KS2Result{
@@ -399,6 +820,11 @@ func (sideChannel SideChannel) analyzeTest(clt *clienthandler.Client) error {
         KS2pVal: clt.Analysis.KS2pVal,
         OriginalAvgThroughput: clt.Analysis.OriginalReplayStats.Average,
         RandomAvgThroughput: clt.Analysis.RandomReplayStats.Average,
+        Differentiation: clt.Analysis.Differentiation,
+        Policy: clt.Analysis.Policy.Name,
+        Verdict: clt.Analysis.Verdict,
+        Variants: clt.VariantResults,
+        Localization: clt.Localization,
     }
     jsonBytes, err := json.Marshal(ks2Result)
     if err != nil {
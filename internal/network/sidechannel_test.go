@@ -0,0 +1,133 @@
+// Tests of the length limits of side channel messages, which must be checked before the message is
+// read so that a client can't make the server allocate whatever it declares.
+package network
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net"
+    "runtime"
+    "testing"
+
+    "wehe-server/internal/errs"
+)
+
+// Gets the bytes a function allocates.
+// f: the function
+// Returns the bytes allocated while it ran
+func allocatedBytes(f func()) uint64 {
+    var before runtime.MemStats
+    var after runtime.MemStats
+    runtime.GC()
+    runtime.ReadMemStats(&before)
+    f()
+    runtime.ReadMemStats(&after)
+    return after.TotalAlloc - before.TotalAlloc
+}
+
+// Checks that messages longer than the limit of their opcode are rejected with
+// errs.ErrMessageTooLarge after only their header is read.
+func TestReadRequestLimits(t *testing.T) {
+    tests := []struct {
+        name string
+        op opcode
+        length uint32 // the length declared in the header
+        wantErr bool // true if the message is too long
+    }{
+        {"throughputs at the limit", throughputs, maxThroughputsMessageSize, false},
+        {"throughputs one past the limit", throughputs, maxThroughputsMessageSize + 1, true},
+        {"throughputs at the 24-bit maximum", throughputs, 1 << 24 - 1, true},
+        {"latencies one past the limit", latencies, maxThroughputsMessageSize + 1, true},
+        {"opcode without a limit", ask4permission, 16, false},
+    }
+    for _, test := range tests {
+        test := test
+        t.Run(test.name, func(t *testing.T) {
+            client, server := net.Pipe()
+            defer client.Close()
+            defer server.Close()
+            header := make([]byte, 4)
+            binary.BigEndian.PutUint32(header, test.length)
+            header[0] = byte(test.op)
+            go func() {
+                _, err := client.Write(header)
+                if err == nil && !test.wantErr {
+                    client.Write(make([]byte, test.length))
+                }
+            }()
+
+            var op opcode
+            var message string
+            var err error
+            allocated := allocatedBytes(func() {
+                op, _, message, err = SideChannel{}.readRequest(server)
+            })
+            if !test.wantErr {
+                if err != nil || op != test.op || len(message) != int(test.length) {
+                    t.Fatalf("readRequest() = %d, %d bytes, %v; want %d, %d bytes", op, len(message), err, test.op, test.length)
+                }
+                return
+            }
+            if !errors.Is(err, errs.ErrMessageTooLarge) {
+                t.Fatalf("readRequest() returned %v; want %v", err, errs.ErrMessageTooLarge)
+            }
+            var limitErr *errs.LimitError
+            if !errors.As(err, &limitErr) || limitErr.Limit != maxThroughputsMessageSize {
+                t.Errorf("readRequest() returned %v; want a LimitError with limit %d", err, maxThroughputsMessageSize)
+            }
+            if allocated > 64 << 10 {
+                t.Errorf("rejecting the message allocated %d bytes; want at most %d", allocated, 64 << 10)
+            }
+        })
+    }
+}
+
+// Checks that old protocol messages longer than the limit, or with a negative length, are rejected
+// with errs.ErrMessageTooLarge after only their length is read.
+func TestOldReadRequestLimits(t *testing.T) {
+    const maxLength = 1 << 16
+    tests := []struct {
+        name string
+        length string // the 10 character length sent before the message
+        wantErr bool // true if the message is too long
+    }{
+        {"at the limit", fmt.Sprintf("%010d", maxLength), false},
+        {"one past the limit", fmt.Sprintf("%010d", maxLength + 1), true},
+        {"largest length", "9999999999", true},
+        {"negative length", "-000000001", true},
+    }
+    for _, test := range tests {
+        test := test
+        t.Run(test.name, func(t *testing.T) {
+            client, server := net.Pipe()
+            defer client.Close()
+            defer server.Close()
+            go func() {
+                _, err := client.Write([]byte(test.length))
+                if err == nil && !test.wantErr {
+                    client.Write(make([]byte, maxLength))
+                }
+            }()
+
+            var message string
+            var err error
+            allocated := allocatedBytes(func() {
+                message, err = SideChannel{}.oldReadRequest(server, maxLength)
+            })
+            if !test.wantErr {
+                if err != nil || len(message) != maxLength {
+                    t.Fatalf("oldReadRequest() = %d bytes, %v; want %d bytes", len(message), err, maxLength)
+                }
+                return
+            }
+            var limitErr *errs.LimitError
+            if !errors.As(err, &limitErr) || limitErr.Kind != errs.ErrMessageTooLarge || limitErr.Limit != maxLength {
+                t.Fatalf("oldReadRequest() returned %v; want a LimitError of %v with limit %d", err, errs.ErrMessageTooLarge, maxLength)
+            }
+            if allocated > 64 << 10 {
+                t.Errorf("rejecting the message allocated %d bytes; want at most %d", allocated, 64 << 10)
+            }
+        })
+    }
+}
@@ -3,12 +3,18 @@ package network
 
 
 import (
+    "bytes"
+    "errors"
     "fmt"
+    "log/slog"
     "net"
+    "strconv"
     "strings"
-    "time"
 
     "wehe-server/internal/clienthandler"
+    "wehe-server/internal/clock"
+    "wehe-server/internal/errorbudget"
+    "wehe-server/internal/shutdown"
     "wehe-server/internal/testdata"
 )
 
@@ -16,44 +22,70 @@ type TCPServer struct {
     IP string // IP that the server should listen on
     Port int // TCP port that the server should listen on
     IPReplayNameMapping *clienthandler.ConnectedClients // map of client IPs that are connected to the side channel to the replay name client wants to run
+    ErrorPolicies ReplayErrorPolicies // what to do when sending a replay packet fails
+    RequestHashCheck RequestHashCheck // what to do when the request of a client doesn't match the replay
+    Replays *testdata.Cache // the replays, shared with the other replay servers
+    Clock clock.Clock // the time source used to pace the replay packets
+    limiter *connectionLimiter // limits how fast sources without a replay can connect, by the limit set with SetConnectionRateLimit
 }
 
-func NewTCPServer(ip string, port int, ipReplayNameMapping *clienthandler.ConnectedClients) TCPServer {
+func NewTCPServer(ip string, port int, ipReplayNameMapping *clienthandler.ConnectedClients, errorPolicies ReplayErrorPolicies, requestHashCheck RequestHashCheck, replays *testdata.Cache) TCPServer {
     return TCPServer{
         IP: ip,
         Port: port,
         IPReplayNameMapping: ipReplayNameMapping,
+        ErrorPolicies: errorPolicies,
+        RequestHashCheck: requestHashCheck,
+        Replays: replays,
+        Clock: clock.Real{},
+        limiter: newConnectionLimiter("tcp", port, clock.Real{}),
     }
 }
 
+// Binds the TCP port of the server. Binding is separate from serving so that all ports, including
+// privileged ones, can be bound before the server drops its privileges.
+// Returns the listener or any errors
+func (tcpServer TCPServer) Listen() (net.Listener, error) {
+    return net.Listen("tcp", net.JoinHostPort(tcpServer.IP, strconv.Itoa(tcpServer.Port)))
+}
+
 // Start a TCP server and listen for connections.
+// listener: the listener returned by Listen
 // errChan: channel to allow errors to be returned to the main thread
-func (tcpServer TCPServer) StartServer(errChan chan<- error) {
-    listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", tcpServer.IP, tcpServer.Port))
-    if err != nil {
-        errChan <- err
-        return
-    }
+func (tcpServer TCPServer) StartServer(listener net.Listener, errChan chan<- error) {
     defer listener.Close()
 
-    fmt.Println("Listening on TCP", tcpServer.Port)
+    slog.Info("Listening on TCP", "port", tcpServer.Port)
     // get connections from clients
     for {
         conn, err := listener.Accept()
+        if errors.Is(err, net.ErrClosed) {
+            // the listener is closed when the port is no longer a test port
+            slog.Info("Stopped listening on TCP", "port", tcpServer.Port)
+            return
+        }
         if err != nil {
             //TODO: figure out what to do if connection can't be accepted
-            fmt.Println("Error accepting connection:", err)
+            slog.Error("Error accepting connection", "protocol", "tcp", "port", tcpServer.Port, "error", err)
+            continue
+        }
+
+        // connections from sources without a replay are dropped quietly once they come too fast, and
+        // all of them are dropped once the server is draining so that only running tests are served
+        draining, _ := clienthandler.Draining()
+        clientIP, err := clienthandler.AddrIP(conn.RemoteAddr())
+        if err == nil && !tcpServer.IPReplayNameMapping.HasIP(clientIP) && (draining || !tcpServer.limiter.allow(clientIP)) {
+            conn.Close()
             continue
         }
 
         //TODO: figure out what to do when this errors and how to wait for error without blocking
         go tcpServer.handleConnection(conn)
     }
-
-    errChan <- nil
 }
 
 func (tcpServer TCPServer) handleConnection(conn net.Conn) {
+    defer shutdown.RecoverPanic()
     defer conn.Close()
 
     //TODO: figure this out https://github.com/NEU-SNS/wehe-py3/blob/master/src/replay_server.py#L324
@@ -63,78 +95,139 @@ func (tcpServer TCPServer) handleConnection(conn net.Conn) {
     // reads GET request to WHATSMYIPMAN or the first packet of the replay from client
     numBytes, err := conn.Read(buffer)
     if err != nil {
-        tcpServer.handleTCPError(fmt.Errorf("Unable to read buffer from connection: %v", err))
+        tcpServer.handleTCPError(conn.RemoteAddr().String(), fmt.Errorf("Unable to read buffer from connection: %v", err))
         return
     }
 
-    addr, ok := conn.RemoteAddr().(*net.TCPAddr)
-    if !ok {
-        tcpServer.handleTCPError(fmt.Errorf("Unable to get client IP."))
+    clientIP, err := clienthandler.AddrIP(conn.RemoteAddr())
+    if err != nil {
+        tcpServer.handleTCPError(conn.RemoteAddr().String(), fmt.Errorf("Unable to get client IP: %v", err))
         return
     }
-    clientIP := addr.IP.String()
 
     // TODO: probably should compare bytes instead of converting to string
     // return client IP address if it asks for it
     if strings.HasPrefix(string(buffer), "GET /WHATSMYIPMAN") || strings.HasPrefix(string(buffer), "WHATSMYIPMAN") {
         _, err = conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n" + clientIP))
         if err != nil {
-            tcpServer.handleTCPError(err)
+            tcpServer.handleTCPError(clientIP, err)
         }
         return
     }
 
-    replayName, err := tcpServer.IPReplayNameMapping.Get(clientIP)
+    // clients that share an IP start their replay with a replay token that says which client they are
+    received, err := readReplayTokenHeader(conn, buffer[:numBytes])
+    if err != nil {
+        tcpServer.handleTCPError(clientIP, fmt.Errorf("Unable to read replay token: %v", err))
+        return
+    }
+    token, firstRequest := splitReplayToken(received)
+    if bytes.HasPrefix(firstRequest, []byte(clienthandler.BandwidthProbeRequest)) {
+        tcpServer.runBandwidthProbe(conn, token, clientIP)
+        return
+    }
+    clientKey := tcpServer.IPReplayNameMapping.Resolve(token, clientIP)
+    logger := tcpServer.IPReplayNameMapping.Logger(clientKey)
+
+    replayName, err := tcpServer.IPReplayNameMapping.Get(clientKey)
     if err != nil {
-        tcpServer.handleTCPError(err)
+        tcpServer.handleTCPError(clientKey, err)
+        return
+    }
+    if !checkReplayPort(tcpServer.Replays, replayName, "tcp", tcpServer.Port, logger) {
+        return
+    }
+    if !checkPortEnabled(tcpServer.IPReplayNameMapping, clientKey, "tcp", tcpServer.Port) {
         return
     }
 
     // get the replay packets and info
-    replayInfo, err := testdata.ParseReplayJSON(replayName)
+    replayInfo, err := tcpServer.Replays.Get(replayName)
     if err != nil {
-        tcpServer.handleTCPError(err)
+        tcpServer.handleReplayError(clientKey, err, true)
         return
     }
+    errorPolicy := tcpServer.ErrorPolicies.get(replayName)
+    // clients on small data plans can ask for a shorter replay, which stops once it has run this long
+    maxDuration := tcpServer.IPReplayNameMapping.MaxDuration(clientKey)
+    replayStartTime := tcpServer.Clock.Now()
+    paceViolated := false // true once a packet of the replay was sent too late
 
     // each response set contains packets that should be sent after server receives a certain number of bytes from client
-    // TODO: add hash checking?
+    request := append([]byte(nil), firstRequest...)
     for i, response := range replayInfo.Responses {
         responseSet := response.(testdata.TCPResponseSet)
-        for {
-            if numBytes >= responseSet.RequestLength {
-                break
-            }
+        for len(request) < responseSet.RequestLength {
             nBytes, err := conn.Read(buffer)
             if err != nil {
-                tcpServer.handleTCPError(err)
+                // nothing more can be sent if the client can't be read from, regardless of policy
+                tcpServer.handleReplayError(clientKey, err, true)
                 return
             }
-            fmt.Printf("Received %d bytes from client.\n", nBytes)
-            numBytes += nBytes
+            logger.Debug("Received bytes from client", "bytes", nBytes)
+            request = append(request, buffer[:nBytes]...)
         }
-        numBytes = 0
+        err = tcpServer.checkRequest(clientKey, request[:responseSet.RequestLength], responseSet.RequestHash, replayName, i + 1, logger)
+        if err != nil {
+            tcpServer.handleReplayError(clientKey, err, true)
+            return
+        }
+        // bytes read past the end of the request belong to the next request
+        request = append(request[:0], request[responseSet.RequestLength:]...)
 
-        startTime := time.Now()
+        // the response starts after the time the original server took to process the request, and
+        // each packet is sent relative to the start of the response
+        responseStartTime := tcpServer.Clock.Now().Add(responseSet.ThinkTime)
+        var payload []byte
         // send each packet in the response set
         for _, packet := range responseSet.Packets {
-            if !tcpServer.IPReplayNameMapping.Has(clientIP) {
+            if !tcpServer.IPReplayNameMapping.Has(clientKey) {
+                return
+            }
+            if maxDuration > 0 && responseStartTime.Add(packet.Timestamp).Sub(replayStartTime) > maxDuration {
+                logger.Info("Replay truncated as requested by the client", "max_duration", maxDuration)
                 return
             }
+            scheduledTime := responseStartTime.Add(packet.Timestamp)
             if timing {
-                time.Sleep(startTime.Add(packet.Timestamp).Sub(time.Now()))
+                tcpServer.Clock.Sleep(scheduledTime.Sub(tcpServer.Clock.Now()))
             }
 
-            fmt.Printf("Sending response to packet %d at %s\n", i + 1, packet.Timestamp)
-            _, err = conn.Write(packet.Payload)
+            logger.Debug("Sending response", "response", i + 1, "timestamp", packet.Timestamp)
+            payload = packet.Payload.AppendTo(payload[:0])
+            sentTime := tcpServer.Clock.Now()
+            // a replay counts once against the budget however many of its packets are late
+            if timing && !paceViolated && errorbudget.IsPacingViolation(sentTime.Sub(scheduledTime)) {
+                paceViolated = true
+                errorbudget.Record(errorbudget.PacingViolations, 1)
+            }
+            n, err := conn.Write(payload)
+            // record what was sent so that the server can sample its own throughputs
+            tcpServer.IPReplayNameMapping.RecordSent(clientKey, sentTime, n)
             if err != nil {
-                tcpServer.handleTCPError(err)
-                return
+                if errorPolicy == AbortOnError {
+                    tcpServer.handleReplayError(clientKey, err, true)
+                    return
+                }
+                tcpServer.handleReplayError(clientKey, err, false)
             }
         }
     }
 }
 
-func (tcpServer TCPServer) handleTCPError(err error) {
-    fmt.Println("TCP connection error:", err)
+// Handles errors thrown by a TCP connection.
+// clientKey: the key of the client from Resolve, its IP, or its address if the IP isn't known
+// err: the error that was thrown
+func (tcpServer TCPServer) handleTCPError(clientKey string, err error) {
+    tcpServer.IPReplayNameMapping.Logger(clientKey).Error("TCP connection error", "port", tcpServer.Port, "error", err)
+}
+
+// Handles errors that occur while running a replay. The error is recorded so that it can be
+// reported to the client over the side channel.
+// clientKey: the key of the client running the replay, from Resolve
+// err: the error that was thrown
+// aborted: true if the replay is stopped because of the error
+func (tcpServer TCPServer) handleReplayError(clientKey string, err error, aborted bool) {
+    tcpServer.handleTCPError(clientKey, err)
+    tcpServer.IPReplayNameMapping.AddReplayError(clientKey, fmt.Errorf("TCP port %d: %v", tcpServer.Port, err), aborted)
 }
@@ -0,0 +1,74 @@
+// Gives up on side channel clients that stop responding. A client that crashes or loses its network
+// in the middle of a test would otherwise keep its side channel connection open, and its IP would
+// keep its replay, forever.
+package network
+
+import (
+    "errors"
+    "fmt"
+    "log/slog"
+    "os"
+    "time"
+
+    "wehe-server/internal/errs"
+)
+
+const (
+    reapInterval = time.Minute // how often stale clients are looked for
+    unanalyzedTestTTL = 30 * time.Minute // how long after an old protocol test starts its results are kept for the client to fetch
+)
+
+// How long side channel clients have to respond. A zero duration is no limit.
+type SideChannelTimeouts struct {
+    Read time.Duration // how long the server waits for the next request of a client
+    Write time.Duration // how long sending a response to a client can take
+    MaxTest time.Duration // how long a test can last from when the client connects
+}
+
+// Gets the deadline of the next read or write on a side channel connection. Reads and writes never
+// go past the end of the test.
+// now: the current time
+// timeout: how long the read or write can take; 0 for no limit
+// testStart: when the client connected
+// Returns the deadline, or the zero time if there is no limit
+func (timeouts SideChannelTimeouts) deadline(now time.Time, timeout time.Duration, testStart time.Time) time.Time {
+    var deadline time.Time
+    if timeout > 0 {
+        deadline = now.Add(timeout)
+    }
+    if timeouts.MaxTest > 0 {
+        testEnd := testStart.Add(timeouts.MaxTest)
+        if deadline.IsZero() || testEnd.Before(deadline) {
+            deadline = testEnd
+        }
+    }
+    return deadline
+}
+
+// Explains a side channel error caused by a client that ran out of time.
+// err: the error of a read or write
+// Returns the error, wrapped with errs.ErrTimedOut and the limits the client went over if it timed out
+func (timeouts SideChannelTimeouts) explain(err error) error {
+    if !errors.Is(err, os.ErrDeadlineExceeded) {
+        return err
+    }
+    return fmt.Errorf("%w (read timeout %v, write timeout %v, max test duration %v): %w", errs.ErrTimedOut, timeouts.Read, timeouts.Write, timeouts.MaxTest, err)
+}
+
+// Forgets clients that have held a replay for longer than a test can last, and results of old
+// protocol tests that were never fetched. Their connections are closed by the deadlines, so these
+// entries only linger if a connection was never cleaned up. This function should be run in a new
+// thread, as it never returns.
+func (sideChannel SideChannel) ReapStaleClients() {
+    for range time.Tick(reapInterval) {
+        if sideChannel.Timeouts.MaxTest > 0 {
+            for _, ip := range sideChannel.ConnectedClients.ReapStale(sideChannel.Timeouts.MaxTest) {
+                slog.Warn("Forgot client that held a replay longer than a test can last", "client_ip", ip)
+            }
+        }
+        reaped := unanalyzedTests.reapStale(sideChannel.Clock.Now(), unanalyzedTestTTL)
+        if reaped > 0 {
+            slog.Warn("Forgot old protocol tests whose results were never fetched", "tests", reaped)
+        }
+    }
+}
@@ -0,0 +1,132 @@
+// Tests of the deadlines of side channel connections and of ending idle gRPC tests, run on a fake
+// clock so that a test that runs past its limits can be simulated without waiting for it.
+package network
+
+import (
+    "errors"
+    "net"
+    "testing"
+    "strings"
+    "time"
+
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/clock"
+    "wehe-server/internal/errs"
+)
+
+// Advances a fake clock through a test and checks that reads get the read timeout until the end of
+// the test is closer, and never go past it.
+func TestSideChannelDeadline(t *testing.T) {
+    timeouts := SideChannelTimeouts{
+        Read: 30 * time.Second,
+        Write: 10 * time.Second,
+        MaxTest: time.Minute,
+    }
+    fake := clock.NewFake(fakeStart)
+    connectedAt := fake.Now()
+    testEnd := connectedAt.Add(time.Minute)
+
+    tests := []struct {
+        name string
+        advance time.Duration // how far the clock moves before the deadline is set
+        timeout time.Duration // the timeout of the read or write
+        want time.Time // the deadline
+    }{
+        {"read at the start", 0, timeouts.Read, connectedAt.Add(30 * time.Second)},
+        {"connection at the start", 0, 0, testEnd},
+        {"read before the end is near", 20 * time.Second, timeouts.Read, connectedAt.Add(50 * time.Second)},
+        {"read near the end", 20 * time.Second, timeouts.Read, testEnd},
+        {"write near the end", 0, timeouts.Write, connectedAt.Add(50 * time.Second)},
+        {"read past the end", time.Minute, timeouts.Read, testEnd},
+    }
+    for _, test := range tests {
+        fake.Advance(test.advance)
+        got := timeouts.deadline(fake.Now(), test.timeout, connectedAt)
+        if !got.Equal(test.want) {
+            t.Errorf("%s: deadline at %v; want %v", test.name, got.Sub(connectedAt), test.want.Sub(connectedAt))
+        }
+    }
+
+    unlimited := SideChannelTimeouts{}
+    if deadline := unlimited.deadline(fake.Now(), 0, connectedAt); !deadline.IsZero() {
+        t.Errorf("deadline without limits = %v; want none", deadline)
+    }
+}
+
+// Simulates a client that connected longer ago than a test can last and checks that its next read
+// times out right away with an error wrapping errs.ErrTimedOut.
+func TestSideChannelTimeoutExplained(t *testing.T) {
+    timeouts := SideChannelTimeouts{
+        Read: time.Minute,
+        MaxTest: time.Minute,
+    }
+    // the fake clock catches up with the real one, so the end of the test has really passed
+    connectedAt := time.Now().Add(-2 * time.Minute)
+    fake := clock.NewFake(connectedAt)
+    fake.Advance(2 * time.Minute)
+    client, server := net.Pipe()
+    defer client.Close()
+    defer server.Close()
+
+    server.SetReadDeadline(timeouts.deadline(fake.Now(), timeouts.Read, connectedAt))
+    _, err := server.Read(make([]byte, 1))
+    err = timeouts.explain(err)
+    if !errors.Is(err, errs.ErrTimedOut) {
+        t.Fatalf("read past the end of the test returned %v; want %v", err, errs.ErrTimedOut)
+    }
+    if err = timeouts.explain(errors.New("connection reset")); errors.Is(err, errs.ErrTimedOut) {
+        t.Errorf("explain() of an error that isn't a timeout returned %v", err)
+    }
+}
+
+// Runs a gRPC test on a fake clock and checks that it is only ended once its client goes longer than
+// the idle timeout between calls, that each call puts that off, and that calls don't keep a test
+// going past the max test duration.
+func TestGRPCTestExpired(t *testing.T) {
+    const idleTimeout = 30 * time.Second
+    const maxTest = time.Minute
+    fake := clock.NewFake(fakeStart)
+    grpcSideChannel := NewGRPCSideChannel(SideChannel{Clock: fake}, "")
+    test := &grpcTest{
+        token: "token",
+        clt: &clienthandler.Client{StartTime: fake.Now()},
+        lastCall: fake.Now(),
+    }
+    grpcSideChannel.tests[test.token] = test
+
+    // calls the test the way a handler does
+    call := func() {
+        called, err := grpcSideChannel.startCall(test.token)
+        if err != nil {
+            t.Fatal(err)
+        }
+        called.mutex.Unlock()
+    }
+
+    fake.Advance(idleTimeout)
+    if err := test.expired(fake.Now(), idleTimeout, maxTest); err != nil {
+        t.Fatalf("expired() at the idle timeout returned %v", err)
+    }
+    call()
+    if !test.lastCall.Equal(fake.Now()) {
+        t.Errorf("startCall() set the last call to %v; want %v", test.lastCall.Sub(fakeStart), fake.Now().Sub(fakeStart))
+    }
+    fake.Advance(idleTimeout)
+    if err := test.expired(fake.Now(), idleTimeout, maxTest); err != nil {
+        t.Fatalf("expired() a full idle timeout after a call returned %v", err)
+    }
+    fake.Advance(time.Second)
+    err := test.expired(fake.Now(), idleTimeout, maxTest)
+    if !errors.Is(err, errs.ErrTimedOut) || !strings.Contains(err.Error(), "idle timeout") {
+        t.Fatalf("expired() past the idle timeout returned %v; want an idle timeout", err)
+    }
+
+    call()
+    err = test.expired(fake.Now(), idleTimeout, maxTest)
+    if !errors.Is(err, errs.ErrTimedOut) || !strings.Contains(err.Error(), "max test duration") {
+        t.Fatalf("expired() past the max test duration returned %v; want a max test duration timeout", err)
+    }
+    if err = test.expired(fake.Now(), idleTimeout, 0); err != nil {
+        t.Errorf("expired() without a max test duration returned %v", err)
+    }
+}
@@ -0,0 +1,103 @@
+// Builds the TLS configs of the servers from the TLS settings of the config file, so that deployments
+// can require a minimum TLS version, limit the cipher suites, and authenticate side channel clients
+// with certificates.
+package network
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "os"
+    "strings"
+)
+
+var (
+    // the TLS versions that can be required; key is the version as written in the config file
+    tlsVersions = map[string]uint16{
+        "1.0": tls.VersionTLS10,
+        "1.1": tls.VersionTLS11,
+        "1.2": tls.VersionTLS12,
+        "1.3": tls.VersionTLS13,
+    }
+)
+
+// The TLS settings shared by the servers.
+type TLSSettings struct {
+    MinVersion uint16 // the oldest TLS version accepted; 0 for the Go default
+    CipherSuites []uint16 // the cipher suites accepted for TLS 1.2 and older; nil for the Go defaults
+    ClientCAs *x509.CertPool // the CAs side channel client certs must be signed by; nil if clients aren't authenticated
+    RequireClientCert bool // true if side channel clients without a cert are refused, false if only certs that are sent are checked
+}
+
+// Creates the TLS settings of the servers.
+// minVersion: the oldest TLS version accepted, e.g. "1.2"; empty for the Go default
+// cipherSuites: the names of the cipher suites accepted for TLS 1.2 and older, e.g.
+//     TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256; empty for the Go defaults
+// clientCAFile: the path to the PEM certs of the CAs that sign side channel client certs; empty if
+//     clients aren't authenticated
+// requireClientCert: true to refuse side channel clients that don't send a cert
+// Returns the settings or any errors
+func NewTLSSettings(minVersion string, cipherSuites []string, clientCAFile string, requireClientCert bool) (TLSSettings, error) {
+    var settings TLSSettings
+    if minVersion != "" {
+        version, exists := tlsVersions[minVersion]
+        if !exists {
+            return TLSSettings{}, fmt.Errorf("Unknown TLS version %s", minVersion)
+        }
+        settings.MinVersion = version
+    }
+
+    if len(cipherSuites) > 0 {
+        suiteIDs := make(map[string]uint16)
+        for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+            suiteIDs[suite.Name] = suite.ID
+        }
+        for _, name := range cipherSuites {
+            name = strings.TrimSpace(name)
+            id, exists := suiteIDs[name]
+            if !exists {
+                return TLSSettings{}, fmt.Errorf("Unknown cipher suite %s", name)
+            }
+            // Go doesn't allow the TLS 1.3 cipher suites to be chosen
+            if strings.HasPrefix(name, "TLS_AES_") || strings.HasPrefix(name, "TLS_CHACHA20_") {
+                return TLSSettings{}, fmt.Errorf("Cipher suite %s is only used by TLS 1.3, whose cipher suites can't be configured", name)
+            }
+            settings.CipherSuites = append(settings.CipherSuites, id)
+        }
+    }
+
+    if clientCAFile != "" {
+        caCerts, err := os.ReadFile(clientCAFile)
+        if err != nil {
+            return TLSSettings{}, err
+        }
+        settings.ClientCAs = x509.NewCertPool()
+        if !settings.ClientCAs.AppendCertsFromPEM(caCerts) {
+            return TLSSettings{}, fmt.Errorf("No PEM certs found in %s", clientCAFile)
+        }
+        settings.RequireClientCert = requireClientCert
+    } else if requireClientCert {
+        return TLSSettings{}, fmt.Errorf("Client certs can't be required without a client CA file")
+    }
+    return settings, nil
+}
+
+// Builds the TLS config of a server.
+// cert: the server cert
+// authenticateClients: true to check client certs against the client CAs, for the side channels
+// Returns the TLS config
+func (settings TLSSettings) ServerConfig(cert tls.Certificate, authenticateClients bool) *tls.Config {
+    tlsConfig := &tls.Config{
+        Certificates: []tls.Certificate{cert},
+        MinVersion: settings.MinVersion,
+        CipherSuites: settings.CipherSuites,
+    }
+    if authenticateClients && settings.ClientCAs != nil {
+        tlsConfig.ClientCAs = settings.ClientCAs
+        tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+        if settings.RequireClientCert {
+            tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+        }
+    }
+    return tlsConfig
+}
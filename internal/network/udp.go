@@ -2,61 +2,126 @@
 package network
 
 import (
+    "errors"
     "fmt"
+    "log/slog"
     "net"
+    "strconv"
     "strings"
     "time"
 
     "wehe-server/internal/clienthandler"
+    "wehe-server/internal/clock"
+    "wehe-server/internal/shutdown"
     "wehe-server/internal/testdata"
 )
 
 const (
-    udpReplayTimeout = 40 * time.Second // each UDP replay is limited to 45 seconds so that user doesn't have to wait forever
+    DefaultUDPReplayTimeout = 40 * time.Second // how long a UDP replay runs unless the config says otherwise
 )
 
+var (
+    udpReplayTimeout = DefaultUDPReplayTimeout // each UDP replay is cut off after this long so that the user doesn't have to wait forever
+)
+
+// Sets how long a UDP replay runs before it is cut off. This should be called before the replay
+// servers start.
+// timeout: the longest a UDP replay runs
+func SetUDPReplayTimeout(timeout time.Duration) {
+    udpReplayTimeout = timeout
+}
+
 type UDPServer struct {
     IP string // IP that the server should listen on
     Port int // UDP port that the server should listen on
-    ConnectedIPs map[string]struct{} // set of IPs of the connected clients TODO: does this need mutex??? probably
     IPReplayNameMapping *clienthandler.ConnectedClients // map of client IPs that are connected to the side channel to the replay name client wants to run
+    ErrorPolicies ReplayErrorPolicies // what to do when sending a replay packet fails
+    PathMTU UDPPathMTU // what to do about replay packets larger than the path MTU to the client
+    Replays *testdata.Cache // the replays, shared with the other replay servers
+    Clock clock.Clock // the time source used to pace the replay packets
+    limiter *connectionLimiter // limits how fast sources without a replay can send first packets, by the limit set with SetConnectionRateLimit
+    sessions *udpSessions // the replays being sent; key is the client IP and port
+    closed chan struct{} // closed by Close to stop ReapSessions
 }
 
-func NewUDPServer(ip string, port int, ipReplayNameMapping *clienthandler.ConnectedClients) UDPServer {
+func NewUDPServer(ip string, port int, ipReplayNameMapping *clienthandler.ConnectedClients, errorPolicies ReplayErrorPolicies, pathMTU UDPPathMTU, replays *testdata.Cache) UDPServer {
     return UDPServer{
         IP: ip,
         Port: port,
-        ConnectedIPs: make(map[string]struct{}),
         IPReplayNameMapping: ipReplayNameMapping,
+        ErrorPolicies: errorPolicies,
+        PathMTU: pathMTU,
+        Replays: replays,
+        Clock: clock.Real{},
+        limiter: newConnectionLimiter("udp", port, clock.Real{}),
+        sessions: newUDPSessions(clock.Real{}),
+        closed: make(chan struct{}),
     }
 }
 
-// Start a UDP server and listen for packets.
-// errChan: channel to allow errors to be returned to the main thread
-func (udpServer UDPServer) StartServer(errChan chan<- error) {
-    conn, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", udpServer.IP, udpServer.Port))
+// Stops the server once its port is no longer a test port. The server must have been created by
+// NewUDPServer, and Close must be called only once.
+// conn: the UDP connection returned by Listen
+// Returns any errors
+func (udpServer UDPServer) Close(conn net.PacketConn) error {
+    close(udpServer.closed)
+    return conn.Close()
+}
+
+// Binds the UDP port of the server. Binding is separate from serving so that all ports, including
+// privileged ones, can be bound before the server drops its privileges.
+// Returns the UDP connection or any errors
+func (udpServer UDPServer) Listen() (net.PacketConn, error) {
+    conn, err := listenUDP(net.JoinHostPort(udpServer.IP, strconv.Itoa(udpServer.Port)))
     if err != nil {
-        errChan <- err
-        return
+        return nil, err
+    }
+    if udpServer.PathMTU.DontFragment {
+        err = setDontFragment(conn)
+        if err != nil {
+            conn.Close()
+            return nil, fmt.Errorf("Unable to set the DF bit on UDP port %d: %v", udpServer.Port, err)
+        }
     }
+    return conn, nil
+}
+
+// Start a UDP server and listen for packets.
+// conn: the UDP connection returned by Listen
+// errChan: channel to allow errors to be returned to the main thread
+func (udpServer UDPServer) StartServer(conn net.PacketConn, errChan chan<- error) {
     defer conn.Close()
 
-    fmt.Println("Listening on UDP", udpServer.Port)
+    slog.Info("Listening on UDP", "port", udpServer.Port)
     // get connection from clients
     for {
          buffer := make([]byte, 4096)
 
         numBytes, addr, err := conn.ReadFrom(buffer)
+        if errors.Is(err, net.ErrClosed) {
+            // the socket is closed when the port is no longer a test port
+            slog.Info("Stopped listening on UDP", "port", udpServer.Port)
+            return
+        }
         if err != nil {
             //TODO: should handle failed test instead of terminating program
             errChan <- err
             return
         }
 
+        // packets from sources without a replay are dropped quietly once they come too fast, and all
+        // of them are dropped once the server is draining so that only running tests are served
+        draining, _ := clienthandler.Draining()
+        clientIP, err := clienthandler.AddrIP(addr)
+        if err != nil {
+            continue
+        }
+        if !udpServer.IPReplayNameMapping.HasIP(clientIP) && (draining || !udpServer.limiter.allow(clientIP)) {
+            continue
+        }
+
         go udpServer.handleConnection(conn, addr, buffer[:numBytes])
     }
-
-    errChan <- nil
 }
 
 // Handles a UDP connection.
@@ -64,84 +129,95 @@ func (udpServer UDPServer) StartServer(errChan chan<- error) {
 // addr: the client IP and port
 // buffer: the content received from the client
 func (udpServer UDPServer) handleConnection(conn net.PacketConn, addr net.Addr, buffer []byte) {
+    defer shutdown.RecoverPanic()
     //TODO: figure this out https://github.com/NEU-SNS/wehe-py3/blob/master/src/replay_server.py#L324
 
-    clientIP := strings.Split(addr.String(), ":")[0]
+    clientIP, err := clienthandler.AddrIP(addr)
+    if err != nil {
+        udpServer.handleUDPError(addr.String(), err)
+        return
+    }
     // TODO: probably should compare bytes instead of converting buffer to string
     // return client IP address if it asks for it
     if strings.HasPrefix(string(buffer), "WHATSMYIPMAN") {
         _, err := conn.WriteTo([]byte(clientIP), addr)
         if err != nil {
-            udpServer.handleUDPError(err)
+            udpServer.handleUDPError(clientIP, err)
         }
         return
     }
 
-    _, exists := udpServer.ConnectedIPs[clientIP]
-    if !exists {
-        udpServer.ConnectedIPs[clientIP] = struct{}{}
-        defer delete(udpServer.ConnectedIPs, clientIP)
-
-        replayName, err := udpServer.IPReplayNameMapping.Get(clientIP)
-        if err != nil {
-            udpServer.handleUDPError(err)
-            return
+    // the first packet from a client address starts its replay; the rest are only logged. Clients
+    // that share an IP start the first packet with a replay token that says which client they are.
+    token, _ := splitReplayToken(buffer)
+    clientKey := udpServer.IPReplayNameMapping.Resolve(token, clientIP)
+    session, started := udpServer.sessions.received(addr, clientIP, clientKey)
+    if !started {
+        if session != nil {
+            clientKey = session.clientKey
         }
+        udpServer.IPReplayNameMapping.Logger(clientKey).Debug("Received bytes from client", "bytes", len(buffer), "new_port", session == nil)
+        return
+    }
+    defer udpServer.sessions.end(session)
 
-        // TODO: optimize so that replays can stay in ram for more than 1 client
-        replayInfo, err := testdata.ParseReplayJSON(replayName)
-        if err != nil {
-            udpServer.handleUDPError(err)
-            return
-        }
-        err = udpServer.sendPackets(conn, addr, clientIP, replayInfo.Responses, time.Now(), true) //TODO fix timing once replay files are read in
-        if err != nil {
-            udpServer.handleUDPError(err)
-            return
-        }
-    } else {
-        fmt.Printf("Received %d bytes from client.\n", len(buffer))
+    replayName, err := udpServer.IPReplayNameMapping.Get(clientKey)
+    if err != nil {
+        udpServer.handleUDPError(clientKey, err)
+        return
+    }
+    if !checkReplayPort(udpServer.Replays, replayName, "udp", udpServer.Port, udpServer.IPReplayNameMapping.Logger(clientKey)) {
+        return
+    }
+    if !checkPortEnabled(udpServer.IPReplayNameMapping, clientKey, "udp", udpServer.Port) {
+        return
+    }
+
+    replayInfo, err := udpServer.Replays.Get(replayName)
+    if err != nil {
+        udpServer.handleReplayError(clientKey, err, true)
+        return
+    }
+    // the other flows of the replay are sent by the servers on their own ports, and every server
+    // paces its flows from the time the first of them started
+    packets := udpPacketsForPort(replayInfo.Responses, udpServer.Port)
+    udpServer.sessions.setReplay(session, replayName, len(packets), replayTimeoutOf(udpServer.IPReplayNameMapping, clientKey))
+    errorPolicy := udpServer.ErrorPolicies.get(replayName)
+    startTime := udpServer.IPReplayNameMapping.ReplayStart(clientKey, udpServer.Clock.Now())
+    err = udpServer.sendPackets(conn, session, packets, startTime, true, errorPolicy)
+    if err != nil {
+        udpServer.handleReplayError(clientKey, err, true)
+        return
     }
 }
 
 // Handles errors thrown by a UDP connection.
+// clientKey: the key of the client from Resolve, its IP, or its address if the IP isn't known
+// err: the error that was thrown
+func (udpServer UDPServer) handleUDPError(clientKey string, err error) {
+    udpServer.IPReplayNameMapping.Logger(clientKey).Error("UDP connection error", "port", udpServer.Port, "error", err)
+}
+
+// Handles errors that occur while running a replay. The error is recorded so that it can be
+// reported to the client over the side channel.
+// clientKey: the key of the client running the replay, from Resolve
 // err: the error that was thrown
-func (udpServer UDPServer) handleUDPError(err error) {
-    fmt.Println("UDP conection error:", err)
+// aborted: true if the replay is stopped because of the error
+func (udpServer UDPServer) handleReplayError(clientKey string, err error, aborted bool) {
+    udpServer.handleUDPError(clientKey, err)
+    udpServer.IPReplayNameMapping.AddReplayError(clientKey, fmt.Errorf("UDP port %d: %v", udpServer.Port, err), aborted)
 }
 
-// Sends UDP packets to the client.
+// Sends UDP packets to the client. Each flow of the packets is sent concurrently by its own
+// goroutine.
 // conn: UDP connection to client
-// addr: the client IP and port
+// session: the session of the client address the replay is sent to
 // packets: the packets to send to the client
 // startTime: the start time of the replay (time when first packet received from client)
 // timing: true if packets should be sent at their timestamps; false otherwise
-// Returns any errors
-func (udpServer UDPServer) sendPackets(conn net.PacketConn, addr net.Addr, clientIP string, packets []testdata.Response, startTime time.Time, timing bool) error {
-    packetLen := len(packets)
-    for i, p := range packets {
-        // check to make sure client is still connected to server before continuing
-        if !udpServer.IPReplayNameMapping.Has(clientIP) {
-            break
-        }
-        packet := p.(testdata.UDPPacket)
-        // replays stop after a certain amount of time so that user doesn't have to wait too long
-        elapsedTime := time.Now().Sub(startTime)
-        if elapsedTime > udpReplayTimeout {
-            break
-        }
-
-        // allows packets to be sent at the time of the timestamp
-        if timing {
-            time.Sleep(startTime.Add(packet.Timestamp).Sub(time.Now()))
-        }
-
-        fmt.Printf("Sending packet %d/%d at %s\n", i + 1, packetLen, packet.Timestamp)
-        _, err := conn.WriteTo(packet.Payload, addr)
-        if err != nil {
-            return err
-        }
-    }
-
-    return nil
+// errorPolicy: whether to stop sending or skip a packet if it fails to send
+// Returns any errors that stop the replay
+func (udpServer UDPServer) sendPackets(conn net.PacketConn, session *udpSession, packets []testdata.Response, startTime time.Time, timing bool, errorPolicy ReplayErrorPolicy) error {
+    flowSession := newUDPFlowSession(udpServer, conn, session, packets, startTime, timing, errorPolicy)
+    return flowSession.run()
 }
@@ -0,0 +1,364 @@
+// Sends the flows of a UDP replay concurrently, like the UDP sender of wehe-py3.
+package network
+
+import (
+    "errors"
+    "net"
+    "sync"
+    "time"
+
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/errorbudget"
+    "wehe-server/internal/shutdown"
+    "wehe-server/internal/testdata"
+)
+
+// The packets of one flow (c_s_pair) of a UDP replay, which are sent by their own goroutine.
+type udpFlow struct {
+    csPair string // the client & server of the flow in the original packet capture
+    packets []testdata.UDPPacket // the packets of the flow, in the order they are sent
+    packetsSent int // number of packets of the flow that have been sent
+    bytesSent int // number of bytes of the flow that have been sent
+    largestPayload int // bytes in the largest payload of the flow that was sent
+    pathMTU int // the smallest path MTU to the client seen by the flow; 0 if no packet was too large
+    skipped int // packets of the flow that weren't sent because they were larger than the path MTU
+    clamped int // packets of the flow that were cut to fit the path MTU
+    sendDelays jitterEstimator // the delays from when each packet of the flow was scheduled to when it was sent
+    writer *udpFlowWriter // sends the packets of the flow
+}
+
+// A UDP replay being sent to a client. Each flow of the replay is sent by its own goroutine and
+// paced by its own timestamps, so a slow or bursty flow doesn't delay the others. The session stops
+// every flow once one of them fails under the abort policy, and adds up the stats of the flows once
+// they are done.
+type udpFlowSession struct {
+    server UDPServer // the server sending the replay
+    conn net.PacketConn // UDP connection to client
+    udpSession *udpSession // the session of the client address, which stops the replay if it times out
+    addr net.Addr // the client IP and port
+    clientKey string // the key of the client running the replay, from Resolve
+    startTime time.Time // the start time of the replay (time when first packet received from client)
+    timing bool // true if packets should be sent at their timestamps; false otherwise
+    errorPolicy ReplayErrorPolicy // whether to stop sending or skip a packet if it fails to send
+    maxDuration time.Duration // packets scheduled after this long are not sent; 0 to send the whole replay
+    timeout time.Duration // the replay is cut off this long after it starts
+    flows []*udpFlow // the flows of the replay, in the order they first appear in the replay
+    stop chan struct{} // closed to stop every flow
+    stopOnce sync.Once // makes sure stop is only closed once
+    paceViolated sync.Once // counts the replay against the pacing budget once, however many of its packets are late
+    err error // the error that stopped the replay, if any
+}
+
+// Creates a session to send a UDP replay, splitting the packets of the replay into their flows.
+// server: the server sending the replay
+// conn: UDP connection to client
+// udpSession: the session of the client address the replay is sent to
+// packets: the packets of the replay
+// startTime: the start time of the replay
+// timing: true if packets should be sent at their timestamps; false otherwise
+// errorPolicy: whether to stop sending or skip a packet if it fails to send
+// Returns the session
+func newUDPFlowSession(server UDPServer, conn net.PacketConn, udpSession *udpSession, packets []testdata.Response, startTime time.Time, timing bool, errorPolicy ReplayErrorPolicy) *udpFlowSession {
+    session := &udpFlowSession{
+        server: server,
+        conn: conn,
+        udpSession: udpSession,
+        addr: udpSession.addr,
+        clientKey: udpSession.clientKey,
+        startTime: startTime,
+        timing: timing,
+        errorPolicy: errorPolicy,
+        maxDuration: server.IPReplayNameMapping.MaxDuration(udpSession.clientKey),
+        timeout: replayTimeoutOf(server.IPReplayNameMapping, udpSession.clientKey),
+        stop: make(chan struct{}),
+    }
+    flowsByCSPair := make(map[string]*udpFlow)
+    for _, p := range packets {
+        packet := p.(testdata.UDPPacket)
+        flow, exists := flowsByCSPair[packet.CSPair]
+        if !exists {
+            flow = &udpFlow{csPair: packet.CSPair}
+            flowsByCSPair[packet.CSPair] = flow
+            session.flows = append(session.flows, flow)
+        }
+        flow.packets = append(flow.packets, packet)
+    }
+    return session
+}
+
+// Gets the packets of a UDP replay that the replay server on a port sends. Like the UDP servers of
+// wehe-py3, each server sends the flows (c_s_pairs) whose original server was on its port, so that
+// an app that talked to several server ports, e.g. Zoom, is replayed from those ports. A replay with
+// no flow on the port is sent whole, e.g. when the server listens on a port the replay doesn't
+// declare.
+// packets: the packets of the replay
+// port: the port of the replay server
+// Returns the packets to send from the port
+func udpPacketsForPort(packets []testdata.Response, port int) []testdata.Response {
+    var forPort []testdata.Response
+    for _, p := range packets {
+        if p.(testdata.UDPPacket).ServerPort == port {
+            forPort = append(forPort, p)
+        }
+    }
+    if len(forPort) == 0 {
+        return packets
+    }
+    return forPort
+}
+
+// Sends every flow of the replay and waits for them to finish.
+// Returns the error that stopped the replay, if any
+func (session *udpFlowSession) run() error {
+    for _, flow := range session.flows {
+        flow.writer = newUDPFlowWriter(session.conn, session.addr, session.server.PathMTU.DontFragment)
+        if flow.writer.ownsConn {
+            go session.receive(flow.writer.conn)
+        }
+    }
+    var wg sync.WaitGroup
+    for _, flow := range session.flows {
+        wg.Add(1)
+        go func(flow *udpFlow) {
+            defer shutdown.RecoverPanic()
+            defer wg.Done()
+            session.sendFlow(flow)
+        }(flow)
+    }
+    wg.Wait()
+    for _, flow := range session.flows {
+        flow.writer.close()
+    }
+
+    packetsSent, bytesSent := session.stats()
+    session.server.IPReplayNameMapping.Logger(session.clientKey).Debug("Sent UDP replay", "packets", packetsSent, "bytes", bytesSent, "flows", len(session.flows), "port", session.server.Port)
+    if session.server.PathMTU.DontFragment {
+        session.server.IPReplayNameMapping.SetPathMTUReport(session.clientKey, session.pathMTUReport())
+    }
+    session.server.IPReplayNameMapping.AddJitterReport(session.clientKey, session.jitterReport())
+    return session.err
+}
+
+// Sends the packets of one flow at their timestamps. Packets due within the batch window of a packet
+// are sent with it in one batch. Stops early if the client disconnects, the replay runs too long, or
+// another flow stops the replay.
+// flow: the flow to send
+func (session *udpFlowSession) sendFlow(flow *udpFlow) {
+    server := session.server
+    packetLen := len(flow.packets)
+    batchSize := 1
+    if flow.writer.batch != nil {
+        batchSize = udpSendOptions.BatchSize
+    }
+    payloads := make([][]byte, batchSize)
+    for i := 0; i < packetLen; {
+        packet := flow.packets[i]
+        // check to make sure client is still connected to server before continuing
+        if session.stopped() || !server.IPReplayNameMapping.Has(session.clientKey) {
+            return
+        }
+        // replays stop after a certain amount of time so that user doesn't have to wait too long
+        elapsedTime := server.Clock.Since(session.startTime)
+        if elapsedTime > session.timeout {
+            return
+        }
+        // clients on small data plans can ask for a shorter replay; every flow stops at the same
+        // point of the schedule so the shortened replay keeps the mix of the full one
+        if session.maxDuration > 0 && packet.Timestamp > session.maxDuration {
+            return
+        }
+
+        // allows packets to be sent at the time of the timestamp
+        scheduledTime := session.startTime.Add(packet.Timestamp)
+        if session.timing {
+            server.Clock.Sleep(scheduledTime.Sub(server.Clock.Now()))
+            if session.stopped() {
+                return
+            }
+        }
+
+        // the packets after this one that are due soon enough are sent early, with this one
+        end := i + 1
+        for end < packetLen && end - i < batchSize {
+            next := flow.packets[end]
+            if session.timing && next.Timestamp - packet.Timestamp > udpSendOptions.BatchWindow {
+                break
+            }
+            if session.maxDuration > 0 && next.Timestamp > session.maxDuration {
+                break
+            }
+            end++
+        }
+        batch := payloads[:end - i]
+        for j := range batch {
+            batch[j] = flow.packets[i + j].Payload.AppendTo(batch[j][:0])
+        }
+        sentTime := server.Clock.Now()
+        if session.timing && errorbudget.IsPacingViolation(sentTime.Sub(scheduledTime)) {
+            session.paceViolated.Do(func() {
+                errorbudget.Record(errorbudget.PacingViolations, 1)
+            })
+        }
+        var ok bool
+        if len(batch) == 1 {
+            ok = session.sendPacket(flow, batch[0], sentTime)
+        } else {
+            ok = session.sendBatch(flow, batch, sentTime)
+        }
+        if !ok {
+            return
+        }
+        if session.timing {
+            for _, sent := range flow.packets[i:end] {
+                flow.sendDelays.add(sentTime.Sub(session.startTime.Add(sent.Timestamp)))
+            }
+        }
+        i = end
+    }
+}
+
+// Sends one packet of a flow. Packets larger than the path MTU are clamped or skipped, and other
+// failures are handled under the error policy of the replay.
+// flow: the flow the packet belongs to
+// payload: the payload of the packet
+// sentTime: the time the packet is sent
+// Returns false if the replay was stopped because the packet failed to send
+func (session *udpFlowSession) sendPacket(flow *udpFlow, payload []byte, sentTime time.Time) bool {
+    server := session.server
+    n, err := flow.writer.write(payload)
+    if err != nil && server.PathMTU.DontFragment && isMessageTooBig(err) {
+        n, err = session.sendOversized(flow, payload)
+    }
+    // record what was sent so that the server can sample its own throughputs
+    server.IPReplayNameMapping.RecordSent(session.clientKey, sentTime, n)
+    if err != nil {
+        if session.errorPolicy == AbortOnError {
+            session.abort(err)
+            return false
+        }
+        server.handleReplayError(session.clientKey, err, false)
+        return true
+    }
+    if n == 0 && len(payload) > 0 {
+        // skipped for being larger than the path MTU
+        return true
+    }
+    session.countSent(flow, n)
+    return true
+}
+
+// Sends several packets of a flow with one system call. A packet that fails to send is sent again
+// on its own, so that it is handled like any other packet that fails, and the rest of the batch is
+// sent after it.
+// flow: the flow the packets belong to
+// payloads: the payloads of the packets
+// sentTime: the time the packets are sent
+// Returns false if the replay was stopped because a packet failed to send
+func (session *udpFlowSession) sendBatch(flow *udpFlow, payloads [][]byte, sentTime time.Time) bool {
+    server := session.server
+    for len(payloads) > 0 {
+        sent, err := flow.writer.writeBatch(payloads)
+        for _, payload := range payloads[:sent] {
+            server.IPReplayNameMapping.RecordSent(session.clientKey, sentTime, len(payload))
+            session.countSent(flow, len(payload))
+        }
+        if err == nil {
+            return true
+        }
+        if !session.sendPacket(flow, payloads[sent], sentTime) {
+            return false
+        }
+        payloads = payloads[sent + 1:]
+    }
+    return true
+}
+
+// Adds a packet that was sent to the stats of its flow and of the UDP session.
+// flow: the flow the packet belongs to
+// numBytes: the number of bytes sent
+func (session *udpFlowSession) countSent(flow *udpFlow, numBytes int) {
+    flow.packetsSent++
+    flow.bytesSent += numBytes
+    flow.largestPayload = max(flow.largestPayload, numBytes)
+    session.server.sessions.sent(session.udpSession, numBytes)
+}
+
+// Counts the packets the client sends during the replay that arrive on the socket of a flow, which
+// the kernel delivers there instead of to the socket of the server. Returns once the socket is
+// closed.
+// conn: the socket of the flow
+func (session *udpFlowSession) receive(conn net.PacketConn) {
+    defer shutdown.RecoverPanic()
+    buffer := make([]byte, 4096)
+    for {
+        _, _, err := conn.ReadFrom(buffer)
+        if errors.Is(err, net.ErrClosed) {
+            return
+        }
+        // a connected socket reports ICMP errors from the client on the next read
+        if err != nil {
+            continue
+        }
+        session.server.sessions.received(session.addr, session.udpSession.clientIP, session.clientKey)
+    }
+}
+
+// Stops every flow because one of them failed. Only the first error is kept.
+// err: the error that stopped the replay
+func (session *udpFlowSession) abort(err error) {
+    session.stopOnce.Do(func() {
+        session.err = err
+        close(session.stop)
+    })
+}
+
+// Returns true if a flow has stopped the replay or its UDP session has ended
+func (session *udpFlowSession) stopped() bool {
+    select {
+    case <-session.stop:
+        return true
+    case <-session.udpSession.stop:
+        return true
+    default:
+        return false
+    }
+}
+
+// Adds up the packets of the flows that were larger than the path MTU. Should only be called once
+// every flow is done.
+// Returns the path MTU report of the replay
+func (session *udpFlowSession) pathMTUReport() clienthandler.PathMTUReport {
+    var report clienthandler.PathMTUReport
+    for _, flow := range session.flows {
+        report.LargestPayload = max(report.LargestPayload, flow.largestPayload)
+        if flow.pathMTU > 0 && (report.PathMTU == 0 || flow.pathMTU < report.PathMTU) {
+            report.PathMTU = flow.pathMTU
+        }
+        report.Skipped += flow.skipped
+        report.Clamped += flow.clamped
+    }
+    return report
+}
+
+// Adds up the jitter of the flows and of the packets the client sent. Should only be called once
+// every flow is done.
+// Returns the jitter report of the replay
+func (session *udpFlowSession) jitterReport() clienthandler.JitterReport {
+    report := newJitterReport(jitterEstimator{}, session.server.sessions.arrivals(session.udpSession))
+    for _, flow := range session.flows {
+        report = report.Merge(newJitterReport(flow.sendDelays, arrivalJitter{}))
+    }
+    return report
+}
+
+// Adds up the stats of the flows. Should only be called once every flow is done.
+// Returns the number of packets and bytes sent in all flows
+func (session *udpFlowSession) stats() (int, int) {
+    packetsSent := 0
+    bytesSent := 0
+    for _, flow := range session.flows {
+        packetsSent += flow.packetsSent
+        bytesSent += flow.bytesSent
+    }
+    return packetsSent, bytesSent
+}
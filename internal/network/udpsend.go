@@ -0,0 +1,185 @@
+// Hands the packets of UDP replays to the kernel. Sending every packet with its own system call
+// limits how fast high-bitrate replays, such as video, can be sent, and late packets skew their
+// pacing. Packets of a flow that are due within a short window of each other can instead be sent
+// together with one system call (sendmmsg on Linux), and each flow can be sent from its own socket
+// bound to the replay port, so that flows don't contend for the socket of the server.
+package network
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "net"
+    "time"
+
+    "golang.org/x/net/ipv4"
+    "golang.org/x/net/ipv6"
+)
+
+const (
+    MaxUDPBatchSize = 64 // most packets sent with one system call
+)
+
+// How the UDP replay servers send packets.
+type UDPSendOptions struct {
+    BatchSize int // most packets of a flow sent with one system call; 1 sends every packet on its own
+    BatchWindow time.Duration // how far ahead of its schedule a packet can be sent to join the batch of an earlier packet
+    SocketPerFlow bool // true to send each flow from its own socket bound to the replay port
+}
+
+var (
+    udpSendOptions = UDPSendOptions{BatchSize: 1} // how UDP replay packets are sent
+)
+
+// Sets how the UDP replay servers send packets. This should be called before the replay ports are
+// bound, since sockets per flow need the replay ports to be bound with SO_REUSEPORT. Sockets per
+// flow are turned off on platforms that don't support them, so that every flow is sent from the
+// socket of the server and the replay ports are bound as usual.
+// options: how packets are sent
+func SetUDPSendOptions(options UDPSendOptions) {
+    options.BatchSize = min(max(options.BatchSize, 1), MaxUDPBatchSize)
+    if options.SocketPerFlow && !socketPerFlowSupported {
+        slog.Warn("Sockets per UDP flow are only supported on Linux; sending every flow from the socket of the server")
+        options.SocketPerFlow = false
+    }
+    udpSendOptions = options
+}
+
+// Sends several packets with one system call.
+type batchWriter interface {
+    WriteBatch(messages []ipv4.Message, flags int) (int, error)
+}
+
+// Sends the packets of one flow of a UDP replay, from the socket of the server or from a socket of
+// its own connected to the client.
+type udpFlowWriter struct {
+    conn net.PacketConn // the socket the packets are sent from
+    addr net.Addr // the client IP and port; nil if conn is connected to the client
+    ownsConn bool // true if conn was opened for the flow and is closed with it
+    batch batchWriter // sends several packets of the flow with one system call
+    messages []ipv4.Message // reused between batches so that sending doesn't allocate
+}
+
+// Creates the writer of a flow. With sockets per flow, the flow gets its own socket bound to the
+// port of the server and connected to the client; if that fails, the flow is sent from the socket
+// of the server.
+// conn: the socket of the server
+// addr: the client IP and port
+// dontFragment: true if packets are sent with the DF bit set
+// Returns the writer
+func newUDPFlowWriter(conn net.PacketConn, addr net.Addr, dontFragment bool) *udpFlowWriter {
+    writer := &udpFlowWriter{
+        conn: conn,
+        addr: addr,
+    }
+    if udpSendOptions.SocketPerFlow {
+        flowConn, err := dialFlowSocket(conn.LocalAddr(), addr, dontFragment)
+        if err != nil {
+            slog.Warn("Unable to open a socket for a UDP flow; sending it from the socket of the server", "error", err)
+        } else {
+            writer.conn = flowConn
+            writer.addr = nil
+            writer.ownsConn = true
+        }
+    }
+    if udpSendOptions.BatchSize > 1 {
+        writer.batch = newBatchWriter(writer.conn)
+        writer.messages = make([]ipv4.Message, udpSendOptions.BatchSize)
+        for i := range writer.messages {
+            writer.messages[i].Buffers = make([][]byte, 1)
+        }
+    }
+    return writer
+}
+
+// Sends one packet.
+// payload: the payload of the packet
+// Returns the number of bytes sent or any errors
+func (writer *udpFlowWriter) write(payload []byte) (int, error) {
+    if writer.addr == nil {
+        return writer.conn.(*net.UDPConn).Write(payload)
+    }
+    return writer.conn.WriteTo(payload, writer.addr)
+}
+
+// Sends several packets with one system call where the platform supports it.
+// payloads: the payloads of the packets, at most the batch size
+// Returns the number of packets sent, which is less than len(payloads) if a packet failed, and the
+//     error of the packet that failed
+func (writer *udpFlowWriter) writeBatch(payloads [][]byte) (int, error) {
+    messages := writer.messages[:len(payloads)]
+    for i, payload := range payloads {
+        messages[i].Buffers[0] = payload
+        messages[i].Addr = writer.addr
+    }
+    sent := 0
+    for sent < len(messages) {
+        n, err := writer.batch.WriteBatch(messages[sent:], 0)
+        sent += max(n, 0)
+        if err != nil {
+            return sent, err
+        }
+        if n <= 0 {
+            return sent, fmt.Errorf("Sent no packets of a batch of %d", len(messages) - sent)
+        }
+    }
+    return sent, nil
+}
+
+// Closes the socket of the flow if it has its own.
+func (writer *udpFlowWriter) close() {
+    if writer.ownsConn {
+        writer.conn.Close()
+    }
+}
+
+// Wraps a UDP socket to send batches of packets.
+// conn: the UDP socket
+// Returns the batch writer
+func newBatchWriter(conn net.PacketConn) batchWriter {
+    udpAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+    if ok && udpAddr.IP.To4() == nil && !udpAddr.IP.IsUnspecified() {
+        return ipv6.NewPacketConn(conn)
+    }
+    return ipv4.NewPacketConn(conn)
+}
+
+// Binds a UDP socket of a replay server, with SO_REUSEPORT if flows are sent from their own sockets
+// so that those sockets can be bound to the same port.
+// address: the IP and port to bind
+// Returns the socket or any errors
+func listenUDP(address string) (net.PacketConn, error) {
+    if !udpSendOptions.SocketPerFlow {
+        return net.ListenPacket("udp", address)
+    }
+    listenConfig := net.ListenConfig{Control: reusePort}
+    return listenConfig.ListenPacket(context.Background(), "udp", address)
+}
+
+// Opens the socket of a flow, bound to the port of the server and connected to the client. The
+// kernel delivers the packets of the client to the most specific socket, so the packets the client
+// sends during the replay arrive on this socket rather than the socket of the server.
+// localAddr: the IP and port of the server
+// addr: the client IP and port
+// dontFragment: true if packets are sent with the DF bit set
+// Returns the socket or any errors
+func dialFlowSocket(localAddr net.Addr, addr net.Addr, dontFragment bool) (net.PacketConn, error) {
+    dialer := net.Dialer{
+        LocalAddr: localAddr,
+        Control: reusePort,
+    }
+    conn, err := dialer.Dial("udp", addr.String())
+    if err != nil {
+        return nil, err
+    }
+    udpConn := conn.(*net.UDPConn)
+    if dontFragment {
+        err = setDontFragment(udpConn)
+        if err != nil {
+            udpConn.Close()
+            return nil, err
+        }
+    }
+    return udpConn, nil
+}
+
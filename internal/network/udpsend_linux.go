@@ -0,0 +1,32 @@
+//go:build linux
+
+// SO_REUSEPORT for the sockets of UDP flows on Linux.
+package network
+
+import (
+    "syscall"
+
+    "golang.org/x/sys/unix"
+)
+
+const (
+    socketPerFlowSupported = true // SO_REUSEPORT lets the sockets of flows share the replay port
+)
+
+// Sets SO_REUSEPORT on a socket before it is bound, so that the socket of the server and the sockets
+// of its flows can share a port. The kernel only lets sockets of the same user share a port, so
+// flows can't get their own sockets once the server has switched to run_as_user from root.
+// network: the network of the socket
+// address: the address the socket is bound to
+// rawConn: the socket
+// Returns any errors
+func reusePort(network string, address string, rawConn syscall.RawConn) error {
+    var sockErr error
+    err := rawConn.Control(func(fd uintptr) {
+        sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+    })
+    if err != nil {
+        return err
+    }
+    return sockErr
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+// Stand-in for SO_REUSEPORT on platforms other than Linux, where UDP flows are always sent from the
+// socket of the server.
+package network
+
+import (
+    "errors"
+    "syscall"
+)
+
+const (
+    socketPerFlowSupported = false // flows are always sent from the socket of the server
+)
+
+// Returns an error, since sockets per flow are only supported on Linux.
+func reusePort(network string, address string, rawConn syscall.RawConn) error {
+    return errors.New("Sockets per UDP flow are only supported on Linux")
+}
@@ -0,0 +1,251 @@
+// Tracks the UDP replays that a UDP server is sending. UDP has no connections, so a session starts
+// with the first packet from a client address and lasts until its replay is sent, it runs past the
+// UDP replay timeout, or the client leaves the side channel.
+package network
+
+import (
+    "log/slog"
+    "net"
+    "sort"
+    "sync"
+    "time"
+
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/clock"
+)
+
+const (
+    udpSessionReapInterval = 5 * time.Second // how often sessions are checked for timeouts
+    udpSessionGrace = 5 * time.Second // how long past the timeout of its replay a session can run before it is stopped
+)
+
+// A UDP replay being sent to a client address.
+type udpSession struct {
+    key string // the client IP and port, which identifies the session
+    addr net.Addr // the client IP and port the replay is sent to
+    clientIP string // the IP of the client
+    clientKey string // the key of the client, from Resolve
+    port int // the port of the client
+    startTime time.Time // when the first packet from the client was received
+    stop chan struct{} // closed to stop sending the replay
+    stopOnce sync.Once // makes sure stop is only closed once
+
+    // the fields below are guarded by the mutex of the udpSessions the session is in
+    replayName string // the name of the replay; empty until the replay is found
+    timeout time.Duration // how long the replay runs before it is cut off; 0 for the UDP replay timeout until the replay is found
+    totalPackets int // number of packets in the replay
+    packetsSent int // number of packets of the replay that have been sent
+    bytesSent int // number of bytes of the replay that have been sent
+    packetsReceived int // number of packets received from the client
+    lastReceived time.Time // when the last packet from the client was received
+    arrivals arrivalJitter // the gaps between the packets received from the client
+}
+
+// Stops sending the replay of the session.
+func (session *udpSession) close() {
+    session.stopOnce.Do(func() {
+        close(session.stop)
+    })
+}
+
+// A UDP replay being sent, as shown to operators.
+type UDPSessionInfo struct {
+    IP string `json:"ip"` // the anonymized IP of the client
+    Port int `json:"port"` // the port of the client
+    ReplayName string `json:"replay_name"` // the name of the replay being sent
+    StartTime time.Time `json:"start_time"` // when the first packet from the client was received
+    TotalPackets int `json:"total_packets"` // number of packets in the replay
+    PacketsSent int `json:"packets_sent"` // number of packets of the replay that have been sent
+    BytesSent int `json:"bytes_sent"` // number of bytes of the replay that have been sent
+    PacketsReceived int `json:"packets_received"` // number of packets received from the client
+    LastReceived time.Time `json:"last_received"` // when the last packet from the client was received
+}
+
+// The UDP replays being sent by a UDP server; key is the client IP and port.
+type udpSessions struct {
+    clk clock.Clock // the time source used for timeouts
+    mutex sync.Mutex // prevents multiple goroutines from accessing sessions
+    sessions map[string]*udpSession // the sessions of the server
+    byClient map[string]*udpSession // the session of each client; key is the key of the client
+}
+
+// Creates a new set of UDP sessions.
+// clk: the time source used for timeouts
+// Returns the sessions
+func newUDPSessions(clk clock.Clock) *udpSessions {
+    return &udpSessions{
+        clk: clk,
+        sessions: make(map[string]*udpSession),
+        byClient: make(map[string]*udpSession),
+    }
+}
+
+// Records a packet received from a client, starting a session if the client address doesn't have one.
+// A client can only run one replay at a time, so packets from another port of a client that already
+// has a session don't start a second one.
+// addr: the client IP and port
+// clientIP: the IP of the client
+// clientKey: the key of the client, from Resolve
+// Returns the session of the address and true if the session was just started, or nil and false if
+//     the packet belongs to another session of the client
+func (sessions *udpSessions) received(addr net.Addr, clientIP string, clientKey string) (*udpSession, bool) {
+    sessions.mutex.Lock()
+    defer sessions.mutex.Unlock()
+    now := sessions.clk.Now()
+    key := addr.String()
+    port := 0
+    udpAddr, ok := addr.(*net.UDPAddr)
+    if ok {
+        port = udpAddr.Port
+    }
+    session, exists := sessions.sessions[key]
+    if exists {
+        session.packetsReceived++
+        session.lastReceived = now
+        session.arrivals.add(now)
+        return session, false
+    }
+    if _, exists := sessions.byClient[clientKey]; exists {
+        return nil, false
+    }
+    session = &udpSession{
+        key: key,
+        addr: addr,
+        clientIP: clientIP,
+        clientKey: clientKey,
+        port: port,
+        startTime: now,
+        stop: make(chan struct{}),
+        packetsReceived: 1,
+        lastReceived: now,
+    }
+    session.arrivals.add(now)
+    sessions.sessions[key] = session
+    sessions.byClient[clientKey] = session
+    return session, true
+}
+
+// Records the replay that a session is sending.
+// session: the session
+// replayName: the name of the replay
+// totalPackets: number of packets in the replay
+// timeout: how long the replay runs before it is cut off
+func (sessions *udpSessions) setReplay(session *udpSession, replayName string, totalPackets int, timeout time.Duration) {
+    sessions.mutex.Lock()
+    defer sessions.mutex.Unlock()
+    session.replayName = replayName
+    session.totalPackets = totalPackets
+    session.timeout = timeout
+}
+
+// Records a packet of the replay that was sent.
+// session: the session sending the replay
+// numBytes: number of bytes in the packet
+func (sessions *udpSessions) sent(session *udpSession, numBytes int) {
+    sessions.mutex.Lock()
+    defer sessions.mutex.Unlock()
+    session.packetsSent++
+    session.bytesSent += numBytes
+}
+
+// Gets the gaps between the packets a session has received from the client so far.
+// session: the session
+// Returns a copy of the gaps
+func (sessions *udpSessions) arrivals(session *udpSession) arrivalJitter {
+    sessions.mutex.Lock()
+    defer sessions.mutex.Unlock()
+    return session.arrivals
+}
+
+// Ends a session, stopping its replay if it is still being sent.
+// session: the session to end
+func (sessions *udpSessions) end(session *udpSession) {
+    sessions.mutex.Lock()
+    defer sessions.mutex.Unlock()
+    sessions.remove(session)
+}
+
+// Removes a session. The mutex must be held.
+// session: the session to remove
+func (sessions *udpSessions) remove(session *udpSession) {
+    session.close()
+    if sessions.sessions[session.key] == session {
+        delete(sessions.sessions, session.key)
+    }
+    if sessions.byClient[session.clientKey] == session {
+        delete(sessions.byClient, session.clientKey)
+    }
+}
+
+// Stops the sessions whose replay has run past its timeout, and the sessions of clients that are no
+// longer connected to the side channel.
+// connected: reports whether a client, by its key, is connected to the side channel
+// Returns the sessions that were stopped
+func (sessions *udpSessions) reap(connected func(ip string) bool) []*udpSession {
+    sessions.mutex.Lock()
+    defer sessions.mutex.Unlock()
+    var reaped []*udpSession
+    for _, session := range sessions.sessions {
+        timeout := session.timeout
+        if timeout == 0 {
+            timeout = udpReplayTimeout
+        }
+        if sessions.clk.Since(session.startTime) > timeout + udpSessionGrace || !connected(session.clientKey) {
+            sessions.remove(session)
+            reaped = append(reaped, session)
+        }
+    }
+    return reaped
+}
+
+// Lists the sessions. IPs are anonymized so that the list can be shown on dashboards.
+// Returns the sessions, sorted by the time they started
+func (sessions *udpSessions) list() []UDPSessionInfo {
+    sessions.mutex.Lock()
+    defer sessions.mutex.Unlock()
+    infos := make([]UDPSessionInfo, 0, len(sessions.sessions))
+    for _, session := range sessions.sessions {
+        anonIP, err := clienthandler.AnonymizeIP(session.clientIP)
+        if err != nil {
+            anonIP = "unknown"
+        }
+        infos = append(infos, UDPSessionInfo{
+            IP: anonIP,
+            Port: session.port,
+            ReplayName: session.replayName,
+            StartTime: session.startTime,
+            TotalPackets: session.totalPackets,
+            PacketsSent: session.packetsSent,
+            BytesSent: session.bytesSent,
+            PacketsReceived: session.packetsReceived,
+            LastReceived: session.lastReceived,
+        })
+    }
+    sort.Slice(infos, func(i, j int) bool {
+        return infos[i].StartTime.Before(infos[j].StartTime)
+    })
+    return infos
+}
+
+// Stops sessions that time out or whose client leaves the side channel. This function should be
+// run in a new thread, as it only returns once the server is closed.
+func (udpServer UDPServer) ReapSessions() {
+    ticker := time.NewTicker(udpSessionReapInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-udpServer.closed:
+            return
+        case <-ticker.C:
+        }
+        for _, session := range udpServer.sessions.reap(udpServer.IPReplayNameMapping.Has) {
+            slog.Warn("Stopped UDP replay that outlived its client or the replay timeout", "port", udpServer.Port, "client_ip", session.clientIP)
+        }
+    }
+}
+
+// Lists the UDP replays the server is sending.
+// Returns the sessions of the server, sorted by the time they started
+func (udpServer UDPServer) Sessions() []UDPSessionInfo {
+    return udpServer.sessions.list()
+}
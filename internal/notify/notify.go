@@ -0,0 +1,143 @@
+// Posts a short summary of each verdict to the Wehe mobile backend as soon as a test is analyzed, so
+// that the backend can send the client a push notification instead of the client polling for its
+// result. User IDs are never posted; the backend gets a keyed hash of the user ID, which it can
+// compute for its own users with the same key.
+package notify
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "time"
+
+    "wehe-server/internal/report"
+    "wehe-server/internal/retry"
+)
+
+const (
+    webhookTimeout = 10 * time.Second // how long a post can take before it is given up on
+    queueSize = 1000 // summaries waiting to be posted; more are dropped so that analysis never waits on the backend
+)
+
+var (
+    // summaries are dropped after a few attempts so that one outage doesn't hold up the whole queue
+    postPolicy = retry.Policy{
+        Operation: "verdict_webhook",
+        MaxAttempts: 3,
+        InitialDelay: 2 * time.Second,
+        MaxDelay: 30 * time.Second,
+        Jitter: 0.5,
+    }
+)
+
+// The summary of a verdict posted to the backend.
+type Summary struct {
+    UserIDHash string `json:"user_id_hash"` // HMAC-SHA256 of the user ID, in hex
+    TestID string `json:"test_id"` // the ID of the test, including the attempt if the test was submitted more than once
+    App string `json:"app"` // the name of the original replay of the test
+    Verdict report.Verdict `json:"verdict"` // differentiation or no_differentiation
+    Time time.Time `json:"time"` // when the test was analyzed
+}
+
+// Posts verdict summaries to a webhook in the background.
+type Notifier struct {
+    url string // URL the summaries are posted to
+    key []byte // key of the hash of the user IDs
+    queue chan Summary // summaries waiting to be posted
+    client http.Client // posts the summaries
+}
+
+// Creates a new Notifier. Start must be called for summaries to be posted.
+// url: URL the summaries are posted to as JSON
+// key: key of the hash of the user IDs, shared with the backend
+// Returns the notifier
+func New(url string, key []byte) *Notifier {
+    return &Notifier{
+        url: url,
+        key: key,
+        queue: make(chan Summary, queueSize),
+        client: http.Client{Timeout: webhookTimeout},
+    }
+}
+
+// Hashes a user ID so that it can be posted without revealing it.
+// userID: the user ID
+// Returns the HMAC-SHA256 of the user ID, in hex
+func (notifier *Notifier) HashUserID(userID string) string {
+    mac := hmac.New(sha256.New, notifier.key)
+    mac.Write([]byte(userID))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Queues the summary of a verdict to be posted. Never blocks; if the backend has fallen too far
+// behind, the summary is dropped and the client falls back to polling for its result.
+// userID: the user ID of the client
+// testID: the ID of the test
+// app: the name of the original replay of the test
+// differentiation: true if the test shows differentiation
+func (notifier *Notifier) Notify(userID string, testID string, app string, differentiation bool) {
+    summary := Summary{
+        UserIDHash: notifier.HashUserID(userID),
+        TestID: testID,
+        App: app,
+        Verdict: report.NoDifferentiation,
+        Time: time.Now().UTC(),
+    }
+    if differentiation {
+        summary.Verdict = report.Differentiation
+    }
+    select {
+    case notifier.queue <- summary:
+    default:
+        slog.Warn("Verdict webhook queue is full; dropping verdict", "test_id", testID)
+    }
+}
+
+// Posts the queued summaries, one at a time, retrying each a few times if the backend fails. This
+// function should be run in a new thread, as it never returns.
+func (notifier *Notifier) Start() {
+    for summary := range notifier.queue {
+        jsonSummary, err := json.Marshal(summary)
+        if err != nil {
+            slog.Error("Unable to encode verdict summary", "error", err)
+            continue
+        }
+        err = postPolicy.Do(context.Background(), func(ctx context.Context) error {
+            return notifier.post(ctx, jsonSummary)
+        })
+        if err != nil {
+            slog.Warn("Unable to post verdict", "test_id", summary.TestID, "error", err)
+        }
+    }
+}
+
+// Posts a summary to the webhook. Requests that the backend rejects aren't retried.
+// ctx: cancels the post
+// jsonSummary: the summary, in JSON
+// Returns any errors
+func (notifier *Notifier) post(ctx context.Context, jsonSummary []byte) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, notifier.url, bytes.NewReader(jsonSummary))
+    if err != nil {
+        return retry.Permanent(err)
+    }
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := notifier.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        err = fmt.Errorf("Verdict webhook returned status %s", resp.Status)
+        if !retry.Retryable(resp.StatusCode) {
+            return retry.Permanent(err)
+        }
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,226 @@
+// PCAP files written by the server, compressed with zstd. Captures of video replays are large and
+// were most of what the server stored, and PCAPs compress well, so they are written as
+// <name>.pcap.zst with a small JSON index next to them, <name>.pcap.zst.idx.json, which holds the
+// packet count, times, and byte totals of the capture so that they can be shown without
+// decompressing it. Readers open plain and compressed PCAPs alike. PCAPs of tests are result files, so
+// they and their indexes are written durably if the config says so.
+package pcapfile
+
+import (
+    "encoding/json"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "github.com/google/gopacket"
+    "github.com/google/gopacket/layers"
+    "github.com/google/gopacket/pcapgo"
+    "github.com/klauspost/compress/zstd"
+
+    "wehe-server/internal/resultfile"
+)
+
+const (
+    CompressedSuffix = ".zst" // added to the name of compressed PCAPs
+    IndexSuffix = ".idx.json" // added to the name of a compressed PCAP for the name of its index
+)
+
+// What a PCAP file holds, written next to it so that it can be shown without reading the packets.
+type Index struct {
+    Packets int `json:"packets"` // packets in the capture
+    First time.Time `json:"first,omitempty"` // when the first packet was captured; zero if there are none
+    Last time.Time `json:"last,omitempty"` // when the last packet was captured; zero if there are none
+    DurationSeconds float64 `json:"duration_seconds"` // seconds from the first packet to the last
+    Bytes int64 `json:"bytes"` // bytes of the packets on the wire
+    CapturedBytes int64 `json:"captured_bytes"` // bytes of the packets kept in the capture, which are cut to the snap length
+    CompressedBytes int64 `json:"compressed_bytes"` // size of the compressed PCAP file
+}
+
+// Adds a packet to the index.
+// captureInfo: the capture info of the packet
+func (index *Index) add(captureInfo gopacket.CaptureInfo) {
+    if index.Packets == 0 {
+        index.First = captureInfo.Timestamp
+    }
+    index.Last = captureInfo.Timestamp
+    index.DurationSeconds = index.Last.Sub(index.First).Seconds()
+    index.Packets++
+    index.Bytes += int64(captureInfo.Length)
+    index.CapturedBytes += int64(captureInfo.CaptureLength)
+}
+
+// Gets the path of the index of a compressed PCAP.
+// path: the path of the compressed PCAP
+// Returns the path of its index
+func IndexPath(path string) string {
+    return path + IndexSuffix
+}
+
+// Reads the index of a compressed PCAP.
+// path: the path of the compressed PCAP
+// Returns the index, or an error if it has none, e.g. because it is still being written
+func ReadIndex(path string) (Index, error) {
+    data, err := os.ReadFile(IndexPath(path))
+    if err != nil {
+        return Index{}, err
+    }
+    var index Index
+    err = json.Unmarshal(data, &index)
+    if err != nil {
+        return Index{}, err
+    }
+    return index, nil
+}
+
+// Writes packets to a compressed PCAP and its index. Not safe for concurrent use.
+type Writer struct {
+    path string // the path of the compressed PCAP
+    file *resultfile.File // the compressed PCAP
+    encoder *zstd.Encoder // compresses what is written to file
+    pcapWriter *pcapgo.Writer // writes the packets to encoder
+    index Index // what has been written
+}
+
+// Creates a compressed PCAP of a test, which is written the way the config says result files are
+// written. The PCAP, and then its index, are kept once the PCAP is closed.
+// path: the path of the PCAP, without .zst, which is added; missing directories are created
+// snapLen: the most bytes of each packet that are kept
+// linkType: the link type of the packets
+// Returns the writer or any errors
+func Create(path string, snapLen uint32, linkType layers.LinkType) (*Writer, error) {
+    file, err := resultfile.Create(path + CompressedSuffix)
+    if err != nil {
+        return nil, err
+    }
+    return newWriter(file, snapLen, linkType)
+}
+
+// Creates a compressed PCAP that is written in place, so that it can be read while it is written,
+// e.g. a debug capture. The index is written once the PCAP is closed.
+// path: the path of the PCAP, without .zst, which is added; missing directories are created
+// snapLen: the most bytes of each packet that are kept
+// linkType: the link type of the packets
+// Returns the writer or any errors
+func CreateLive(path string, snapLen uint32, linkType layers.LinkType) (*Writer, error) {
+    file, err := resultfile.CreateInPlace(path + CompressedSuffix)
+    if err != nil {
+        return nil, err
+    }
+    return newWriter(file, snapLen, linkType)
+}
+
+// Starts a compressed PCAP in a file.
+// file: the file of the compressed PCAP, which is closed if this fails
+// snapLen: the most bytes of each packet that are kept
+// linkType: the link type of the packets
+// Returns the writer or any errors
+func newWriter(file *resultfile.File, snapLen uint32, linkType layers.LinkType) (*Writer, error) {
+    // packets are captured as they arrive, so the default level keeps up with them where the better
+    // levels might not
+    encoder, err := zstd.NewWriter(file, zstd.WithEncoderConcurrency(1))
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
+    pcapWriter := pcapgo.NewWriter(encoder)
+    err = pcapWriter.WriteFileHeader(snapLen, linkType)
+    if err != nil {
+        encoder.Close()
+        file.Close()
+        return nil, err
+    }
+    return &Writer{
+        path: file.Path(),
+        file: file,
+        encoder: encoder,
+        pcapWriter: pcapWriter,
+    }, nil
+}
+
+// Gets the path of the compressed PCAP.
+// Returns the path, ending in .pcap.zst
+func (writer *Writer) Path() string {
+    return writer.path
+}
+
+// Writes a packet.
+// captureInfo: the capture info of the packet
+// data: the packet
+// Returns any errors
+func (writer *Writer) WritePacket(captureInfo gopacket.CaptureInfo, data []byte) error {
+    err := writer.pcapWriter.WritePacket(captureInfo, data)
+    if err != nil {
+        return err
+    }
+    writer.index.add(captureInfo)
+    return nil
+}
+
+// Finishes the compressed PCAP and writes its index.
+// Returns the index or any errors
+func (writer *Writer) Close() (Index, error) {
+    err := writer.encoder.Close()
+    if err != nil {
+        writer.file.Close()
+        return Index{}, err
+    }
+    writer.index.CompressedBytes = writer.file.Size()
+    err = writer.file.Close()
+    if err != nil {
+        return Index{}, err
+    }
+    data, err := json.Marshal(writer.index)
+    if err != nil {
+        return Index{}, err
+    }
+    err = resultfile.Write(filepath.Dir(writer.path), filepath.Base(IndexPath(writer.path)), data)
+    if err != nil {
+        return Index{}, err
+    }
+    return writer.index, nil
+}
+
+// Reads the packets of a plain or compressed PCAP. A compressed PCAP that is still being written
+// ends partway through, which is reported as io.ErrUnexpectedEOF, as for a plain PCAP that ends in
+// the middle of a packet.
+type Reader struct {
+    *pcapgo.Reader
+    file *os.File // the PCAP
+    decoder *zstd.Decoder // decompresses file; nil if the PCAP isn't compressed
+}
+
+// Opens a PCAP, decompressing it if its name ends in .zst.
+// path: the path of the PCAP
+// Returns the reader or any errors
+func Open(path string) (*Reader, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    reader := &Reader{file: file}
+    var input io.Reader = file
+    if strings.HasSuffix(path, CompressedSuffix) {
+        reader.decoder, err = zstd.NewReader(file, zstd.WithDecoderConcurrency(1))
+        if err != nil {
+            file.Close()
+            return nil, err
+        }
+        input = reader.decoder
+    }
+    reader.Reader, err = pcapgo.NewReader(input)
+    if err != nil {
+        reader.Close()
+        return nil, err
+    }
+    return reader, nil
+}
+
+// Closes the PCAP.
+func (reader *Reader) Close() {
+    if reader.decoder != nil {
+        reader.decoder.Close()
+    }
+    reader.file.Close()
+}
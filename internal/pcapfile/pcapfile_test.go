@@ -0,0 +1,140 @@
+// Tests for compressed PCAP files.
+package pcapfile
+
+import (
+    "errors"
+    "io"
+    "math/rand"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/google/gopacket"
+    "github.com/google/gopacket/layers"
+)
+
+// Writes packets to a compressed PCAP and checks that they read back along with the index.
+func TestWriteAndRead(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "captures", "test.pcap")
+    writer, err := Create(path, 1600, layers.LinkTypeEthernet)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if writer.Path() != path + CompressedSuffix {
+        t.Fatalf("Path() = %s; want %s", writer.Path(), path + CompressedSuffix)
+    }
+    start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+    packets := [][]byte{make([]byte, 60), make([]byte, 1500), make([]byte, 100)}
+    for i, packet := range packets {
+        packet[0] = byte(i)
+        captureInfo := gopacket.CaptureInfo{
+            Timestamp: start.Add(time.Duration(i) * time.Second),
+            CaptureLength: len(packet),
+            Length: len(packet) + 10,
+        }
+        err = writer.WritePacket(captureInfo, packet)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    index, err := writer.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if index.Packets != 3 || index.CapturedBytes != 1660 || index.Bytes != 1690 || index.DurationSeconds != 2 {
+        t.Errorf("index = %+v; want 3 packets, 1660 captured bytes, 1690 bytes, 2 seconds", index)
+    }
+    if !index.First.Equal(start) || !index.Last.Equal(start.Add(2 * time.Second)) {
+        t.Errorf("index runs from %v to %v; want %v to %v", index.First, index.Last, start, start.Add(2 * time.Second))
+    }
+    info, err := os.Stat(writer.Path())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if index.CompressedBytes != info.Size() || info.Size() >= index.CapturedBytes {
+        t.Errorf("compressed bytes = %d, file size = %d; want equal and less than %d", index.CompressedBytes, info.Size(), index.CapturedBytes)
+    }
+
+    readIndex, err := ReadIndex(writer.Path())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if readIndex.Packets != index.Packets || readIndex.Bytes != index.Bytes || !readIndex.Last.Equal(index.Last) {
+        t.Errorf("ReadIndex() = %+v; want %+v", readIndex, index)
+    }
+
+    reader, err := Open(writer.Path())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer reader.Close()
+    if reader.LinkType() != layers.LinkTypeEthernet || reader.Snaplen() != 1600 {
+        t.Errorf("link type %v, snap length %d; want %v, 1600", reader.LinkType(), reader.Snaplen(), layers.LinkTypeEthernet)
+    }
+    for i, packet := range packets {
+        data, captureInfo, err := reader.ReadPacketData()
+        if err != nil {
+            t.Fatalf("packet %d: %v", i, err)
+        }
+        if len(data) != len(packet) || data[0] != byte(i) || captureInfo.Length != len(packet) + 10 {
+            t.Errorf("packet %d: got %d bytes starting with %d, length %d", i, len(data), data[0], captureInfo.Length)
+        }
+    }
+    _, _, err = reader.ReadPacketData()
+    if err != io.EOF {
+        t.Errorf("after the last packet: got %v; want EOF", err)
+    }
+}
+
+// Checks that a compressed PCAP that is cut short, as one that is still being written is, ends with
+// io.ErrUnexpectedEOF and has no index.
+func TestReadTruncated(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "test.pcap")
+    writer, err := Create(path, 1600, layers.LinkTypeEthernet)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // random packets don't compress, so the capture spans many zstd blocks
+    random := rand.New(rand.NewSource(1))
+    for i := 0; i < 5000; i++ {
+        packet := make([]byte, 200)
+        random.Read(packet)
+        err = writer.WritePacket(gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(packet), Length: len(packet)}, packet)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    _, err = writer.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    data, err := os.ReadFile(writer.Path())
+    if err != nil {
+        t.Fatal(err)
+    }
+    truncated := filepath.Join(t.TempDir(), "truncated.pcap" + CompressedSuffix)
+    err = os.WriteFile(truncated, data[:len(data) / 2], 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, err = ReadIndex(truncated)
+    if err == nil {
+        t.Error("ReadIndex() of a capture without an index succeeded")
+    }
+    reader, err := Open(truncated)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer reader.Close()
+    for {
+        _, _, err = reader.ReadPacketData()
+        if err != nil {
+            break
+        }
+    }
+    if !errors.Is(err, io.ErrUnexpectedEOF) {
+        t.Errorf("truncated capture ended with %v; want %v", err, io.ErrUnexpectedEOF)
+    }
+}
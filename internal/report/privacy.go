@@ -0,0 +1,105 @@
+// Differential privacy for the grouped counts of the daily report, so that per-carrier and per-city
+// statistics can be published straight from the server without revealing whether any one client ran
+// a test.
+package report
+
+import (
+    "crypto/rand"
+    "encoding/binary"
+    "fmt"
+    "math"
+)
+
+// How the counts of a report are protected before the report is written or posted.
+type Privacy struct {
+    Epsilon float64 `json:"epsilon"` // privacy budget of the Laplace noise added to the test counts; 0 adds no noise
+    MinCount int `json:"min_count"` // groups with fewer tests than this are left out of the report; 0 keeps every group
+}
+
+// Checks that the privacy settings are usable.
+// Returns any errors
+func (privacy Privacy) validate() error {
+    if privacy.Epsilon < 0 || math.IsNaN(privacy.Epsilon) || math.IsInf(privacy.Epsilon, 0) {
+        return fmt.Errorf("Report privacy epsilon must be a non-negative number; got %v", privacy.Epsilon)
+    }
+    if privacy.MinCount < 0 {
+        return fmt.Errorf("Report minimum group count can't be negative; got %d", privacy.MinCount)
+    }
+    return nil
+}
+
+// Returns true if the settings change the report
+func (privacy Privacy) enabled() bool {
+    return privacy.Epsilon > 0 || privacy.MinCount > 0
+}
+
+// Adds noise to the test counts of a report and removes the groups with too few tests.
+//
+// Each test is counted once in the total and once in each grouping (app, carrier, city, and client
+// version), so adding or removing a test changes one verdict count in each of the five tables by 1.
+// Laplace noise with a scale of 5 / epsilon is added to every verdict count so that the whole report
+// is epsilon-differentially private; the number of tests and the error rate are then computed from
+// the noisy counts. Groups are suppressed based on their noisy number of tests, since suppressing
+// based on the true number would reveal it.
+// report: the report to protect
+func (privacy Privacy) apply(report *Report) {
+    report.Privacy = &privacy
+    if privacy.Epsilon > 0 {
+        scale := float64(countTables) / privacy.Epsilon
+        report.Total.addNoise(scale)
+        report.Calibration.addNoise(scale)
+        for _, groups := range report.groupings() {
+            for _, counts := range groups {
+                counts.addNoise(scale)
+            }
+        }
+    }
+    if privacy.MinCount > 0 {
+        for _, groups := range report.groupings() {
+            for key, counts := range groups {
+                if counts.Tests < privacy.MinCount {
+                    delete(groups, key)
+                }
+            }
+        }
+    }
+}
+
+// most tables a test is counted in: the total and each grouping of the report; a calibration test is
+// only counted in the calibration counts
+const countTables = 5
+
+// Adds Laplace noise to each verdict count, then recomputes the number of tests and the error rate.
+// Noisy counts are rounded and kept non-negative.
+// scale: the scale of the noise
+func (counts *Counts) addNoise(scale float64) {
+    noisy := func(count int) int {
+        return max(0, int(math.Round(float64(count) + laplaceNoise(scale))))
+    }
+    counts.Differentiation = noisy(counts.Differentiation)
+    counts.NoDifferentiation = noisy(counts.NoDifferentiation)
+    counts.Inconclusive = noisy(counts.Inconclusive)
+    counts.Incomplete = noisy(counts.Incomplete)
+    counts.Failed = noisy(counts.Failed)
+    counts.Tests = counts.Differentiation + counts.NoDifferentiation + counts.Inconclusive + counts.Incomplete + counts.Failed
+    counts.ErrorRate = 0
+    if counts.Tests > 0 {
+        counts.ErrorRate = float64(counts.Failed) / float64(counts.Tests)
+    }
+}
+
+// Draws noise from a Laplace distribution centered at 0. The randomness comes from crypto/rand since
+// predictable noise could be subtracted back out.
+// scale: the scale of the distribution
+// Returns the noise
+func laplaceNoise(scale float64) float64 {
+    var randomBytes [8]byte
+    _, err := rand.Read(randomBytes[:])
+    if err != nil {
+        // crypto/rand only fails if the OS has no source of randomness, in which case nothing is safe
+        panic(err)
+    }
+    // uniform in (-0.5, 0.5), excluding the endpoints so that the log is finite
+    uniform := (float64(binary.BigEndian.Uint64(randomBytes[:]) >> 11) + 0.5) / (1 << 53) - 0.5
+    return -scale * math.Copysign(1, uniform) * math.Log(1 - 2 * math.Abs(uniform))
+}
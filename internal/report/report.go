@@ -0,0 +1,479 @@
+// Generates a daily summary of the tests run on the server, for research deployments that don't have
+// a pipeline to process the results. Every finished test is recorded in a JSON lines file for the
+// day; once the day is over, the records are summarized into a report with the number of tests run,
+// the verdicts by app, carrier, and city, the error rates, and the health of the server. The report is
+// written to the report directory as JSON and HTML and, optionally, posted to a webhook.
+package report
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "html/template"
+    "log/slog"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/shirou/gopsutil/v3/disk"
+    "github.com/shirou/gopsutil/v3/host"
+    "github.com/shirou/gopsutil/v3/load"
+    "github.com/shirou/gopsutil/v3/mem"
+
+    "wehe-server/internal/buildinfo"
+    "wehe-server/internal/denials"
+    "wehe-server/internal/resultfile"
+    "wehe-server/internal/retry"
+)
+
+const (
+    dateFormat = "2006-01-02"
+    webhookTimeout = 30 * time.Second
+    maxRecentRecords = 50 // number of the most recent tests kept in memory
+)
+
+var (
+    // the report is only posted once a day, so the backend gets a while to come back
+    webhookPolicy = retry.Policy{
+        Operation: "report_webhook",
+        MaxAttempts: 5,
+        InitialDelay: 10 * time.Second,
+        MaxDelay: 5 * time.Minute,
+        Jitter: 0.5,
+    }
+)
+
+// The outcome of a test
+type Verdict string
+
+const (
+    Differentiation Verdict = "differentiation" // the original replay was treated differently from the random replay
+    NoDifferentiation Verdict = "no_differentiation" // no difference between the replays was detected
+    Incomplete Verdict = "incomplete" // the test ended before it was analyzed
+    Inconclusive Verdict = "inconclusive" // a replay had too few throughput samples to decide
+    Failed Verdict = "failed" // the test ended because of an error
+)
+
+// A test that has finished.
+type TestRecord struct {
+    Time time.Time `json:"time"` // when the test finished
+    App string `json:"app"` // the name of the original replay of the test
+    Carrier string `json:"carrier"` // the carrier of the client, or "unknown"
+    City string `json:"city"` // the city and country of the client, or "unknown"
+    ClientVersion string `json:"client_version"` // the version of the Wehe client
+    Verdict Verdict `json:"verdict"` // the outcome of the test
+    Error string `json:"error,omitempty"` // the error that ended the test, if any
+    BytesSent int64 `json:"bytes_sent"` // bytes the replay servers sent to the client over every replay of the test
+    Calibration bool `json:"calibration,omitempty"` // true if the test ran the calibration replays; counted apart from every other test
+}
+
+// Number of tests with each outcome.
+type Counts struct {
+    Tests int `json:"tests"` // number of tests
+    Differentiation int `json:"differentiation"` // number of tests that detected differentiation
+    NoDifferentiation int `json:"no_differentiation"` // number of tests that didn't detect differentiation
+    Incomplete int `json:"incomplete"` // number of tests that ended before being analyzed
+    Inconclusive int `json:"inconclusive"` // number of tests with too few throughput samples to decide
+    Failed int `json:"failed"` // number of tests that ended because of an error
+    ErrorRate float64 `json:"error_rate"` // fraction of tests that failed
+}
+
+// Adds a test to the counts.
+// verdict: the outcome of the test
+func (counts *Counts) add(verdict Verdict) {
+    counts.Tests++
+    switch verdict {
+    case Differentiation:
+        counts.Differentiation++
+    case NoDifferentiation:
+        counts.NoDifferentiation++
+    case Incomplete:
+        counts.Incomplete++
+    case Inconclusive:
+        counts.Inconclusive++
+    case Failed:
+        counts.Failed++
+    }
+    counts.ErrorRate = float64(counts.Failed) / float64(counts.Tests)
+}
+
+// The health of the server when the report was generated. Values that can't be retrieved are left
+// as 0.
+type NodeHealth struct {
+    Hostname string `json:"hostname"` // name of the server
+    Labels map[string]string `json:"labels,omitempty"` // labels of the deployment the server belongs to, e.g. site; omitted if none are set
+    UptimeHours float64 `json:"uptime_hours"` // number of hours since the server booted
+    Load1 float64 `json:"load1"` // 1 minute load average
+    Load15 float64 `json:"load15"` // 15 minute load average
+    MemoryUsedPercent float64 `json:"memory_used_percent"` // percentage of memory in use
+    DiskUsedPercent float64 `json:"disk_used_percent"` // percentage of the disk holding the reports in use
+}
+
+// A summary of the tests run on one day.
+type Report struct {
+    Date string `json:"date"` // the UTC day summarized, as YYYY-MM-DD
+    GeneratedAt time.Time `json:"generated_at"` // when the report was generated
+    Total Counts `json:"total"` // outcomes of all tests other than calibration tests
+    ByApp map[string]*Counts `json:"by_app"` // outcomes of the tests of each app
+    ByCarrier map[string]*Counts `json:"by_carrier"` // outcomes of the tests on each carrier
+    ByCity map[string]*Counts `json:"by_city"` // outcomes of the tests in each city
+    ByClientVersion map[string]*Counts `json:"by_client_version"` // outcomes of the tests of each client version
+    Privacy *Privacy `json:"privacy,omitempty"` // how the counts were protected; nil if they are exact
+    Calibration Counts `json:"calibration"` // outcomes of the calibration tests, which should never show differentiation
+    Denials *denials.Summary `json:"denials,omitempty"` // tests denied permission to run; nil if denials aren't recorded
+    Health NodeHealth `json:"health"` // health of the server
+}
+
+// Gets the groupings of the tests in the report.
+// Returns the counts of each group of each grouping
+func (report *Report) groupings() []map[string]*Counts {
+    return []map[string]*Counts{report.ByApp, report.ByCarrier, report.ByCity, report.ByClientVersion}
+}
+
+// Records finished tests and generates the daily reports.
+type Reporter struct {
+    dir string // directory the records and reports are written to
+    webhookURL string // URL the reports are posted to; empty if reports aren't posted
+    denialLog *denials.Log // log of denied tests to include in the reports; can be nil
+    privacy Privacy // how the counts of the reports are protected
+    mutex sync.Mutex // prevents multiple goroutines from writing records at the same time
+    recent []TestRecord // the most recent tests, oldest first
+    today Counts // outcomes of the tests that finished today, UTC
+    todayDate string // the UTC day today counts, as YYYY-MM-DD
+}
+
+// Creates a new Reporter.
+// dir: directory the records and reports are written to; missing directories are created
+// webhookURL: URL the reports are posted to as JSON; empty to only write the reports to disk
+// denialLog: log of denied tests to include in the reports; nil to leave denials out
+// privacy: how the counts of the reports are protected; the zero value publishes exact counts
+// Returns the reporter or any errors
+func New(dir string, webhookURL string, denialLog *denials.Log, privacy Privacy) (*Reporter, error) {
+    err := privacy.validate()
+    if err != nil {
+        return nil, err
+    }
+    err = os.MkdirAll(filepath.Join(dir, "records"), os.ModePerm)
+    if err != nil {
+        return nil, err
+    }
+    return &Reporter{
+        dir: dir,
+        webhookURL: webhookURL,
+        denialLog: denialLog,
+        privacy: privacy,
+    }, nil
+}
+
+// Gets the path of the file containing the records of the tests that finished on a day.
+// day: the day
+// Returns the path of the records file
+func (reporter *Reporter) recordsFilename(day time.Time) string {
+    return filepath.Join(reporter.dir, "records", day.UTC().Format(dateFormat) + ".jsonl")
+}
+
+// Records a finished test.
+// record: the test to record
+// Returns any errors
+func (reporter *Reporter) Record(record TestRecord) error {
+    line, err := json.Marshal(record)
+    if err != nil {
+        return err
+    }
+    line = append(line, '\n')
+
+    reporter.mutex.Lock()
+    defer reporter.mutex.Unlock()
+    reporter.recent = append(reporter.recent, record)
+    if len(reporter.recent) > maxRecentRecords {
+        reporter.recent = reporter.recent[len(reporter.recent) - maxRecentRecords:]
+    }
+    date := record.Time.UTC().Format(dateFormat)
+    if date != reporter.todayDate {
+        reporter.today = Counts{}
+        reporter.todayDate = date
+    }
+    if !record.Calibration {
+        reporter.today.add(record.Verdict)
+    }
+
+    file, err := os.OpenFile(reporter.recordsFilename(record.Time), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    _, err = file.Write(line)
+    return err
+}
+
+// Gets the tests that finished recently, for live views of the server. Unlike the daily report, the
+// counts are exact since they are only shown to operators.
+// Returns the most recent tests, newest first, and the outcomes of the tests that finished today
+//     (UTC) since the server started
+func (reporter *Reporter) Recent() ([]TestRecord, Counts) {
+    reporter.mutex.Lock()
+    defer reporter.mutex.Unlock()
+    recent := make([]TestRecord, len(reporter.recent))
+    for i, record := range reporter.recent {
+        recent[len(recent) - 1 - i] = record
+    }
+    today := Counts{}
+    if reporter.todayDate == time.Now().UTC().Format(dateFormat) {
+        today = reporter.today
+    }
+    return recent, today
+}
+
+// Generates a report every day shortly after midnight UTC for the day that just ended. Errors are
+// printed rather than returned so that a failed report doesn't stop the next one. Does not return.
+func (reporter *Reporter) Start() {
+    for {
+        now := time.Now().UTC()
+        tomorrow := time.Date(now.Year(), now.Month(), now.Day() + 1, 0, 0, 0, 0, time.UTC)
+        // wait an extra minute so that tests finishing right at midnight are recorded
+        time.Sleep(tomorrow.Add(time.Minute).Sub(now))
+
+        err := reporter.Publish(tomorrow.AddDate(0, 0, -1))
+        if err != nil {
+            slog.Error("Unable to publish daily report", "error", err)
+        }
+    }
+}
+
+// Generates the report of a day, writes it to the report directory as <date>.json and <date>.html,
+// and posts it to the webhook if one is configured.
+// day: the day to report on
+// Returns any errors
+func (reporter *Reporter) Publish(day time.Time) error {
+    report, err := reporter.Generate(day)
+    if err != nil {
+        return err
+    }
+
+    jsonReport, err := json.MarshalIndent(report, "", "  ")
+    if err != nil {
+        return err
+    }
+    err = resultfile.Write(reporter.dir, report.Date + ".json", jsonReport)
+    if err != nil {
+        return err
+    }
+
+    var htmlReport bytes.Buffer
+    err = htmlTemplate.Execute(&htmlReport, report)
+    if err != nil {
+        return err
+    }
+    err = resultfile.Write(reporter.dir, report.Date + ".html", htmlReport.Bytes())
+    if err != nil {
+        return err
+    }
+
+    if reporter.webhookURL == "" {
+        return nil
+    }
+    return webhookPolicy.Do(context.Background(), func(ctx context.Context) error {
+        return postWebhook(ctx, reporter.webhookURL, jsonReport)
+    })
+}
+
+// Summarizes the tests that finished on a day. If privacy settings are configured, noise is added to
+// the counts and small groups are left out.
+// day: the day to report on
+// Returns the report or any errors
+func (reporter *Reporter) Generate(day time.Time) (Report, error) {
+    start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+    report := Report{
+        Date: start.Format(dateFormat),
+        GeneratedAt: time.Now().UTC(),
+        ByApp: make(map[string]*Counts),
+        ByCarrier: make(map[string]*Counts),
+        ByCity: make(map[string]*Counts),
+        ByClientVersion: make(map[string]*Counts),
+        Health: CurrentHealth(reporter.dir),
+    }
+
+    reporter.mutex.Lock()
+    records, err := readRecords(reporter.recordsFilename(start))
+    reporter.mutex.Unlock()
+    if err != nil {
+        return Report{}, err
+    }
+    for _, record := range records {
+        // calibration tests check the server, so they would skew the counts of real tests
+        if record.Calibration {
+            report.Calibration.add(record.Verdict)
+            continue
+        }
+        report.Total.add(record.Verdict)
+        addTo(report.ByApp, record.App, record.Verdict)
+        addTo(report.ByCarrier, record.Carrier, record.Verdict)
+        addTo(report.ByCity, record.City, record.Verdict)
+        addTo(report.ByClientVersion, record.ClientVersion, record.Verdict)
+    }
+    if reporter.privacy.enabled() {
+        reporter.privacy.apply(&report)
+    }
+
+    if reporter.denialLog != nil {
+        denialSummary, err := reporter.denialLog.Summary(start, start.AddDate(0, 0, 1))
+        if err != nil {
+            return Report{}, err
+        }
+        report.Denials = &denialSummary
+    }
+    return report, nil
+}
+
+// Adds a test to the counts of a group of tests.
+// groups: the counts of each group
+// key: the group the test belongs to
+// verdict: the outcome of the test
+func addTo(groups map[string]*Counts, key string, verdict Verdict) {
+    counts, exists := groups[key]
+    if !exists {
+        counts = &Counts{}
+        groups[key] = counts
+    }
+    counts.add(verdict)
+}
+
+// Reads the test records in a file. Lines that can't be parsed are skipped.
+// filename: the records file
+// Returns the records, or any errors
+func readRecords(filename string) ([]TestRecord, error) {
+    file, err := os.Open(filename)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, err
+    }
+    defer file.Close()
+
+    var records []TestRecord
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        var record TestRecord
+        err = json.Unmarshal(scanner.Bytes(), &record)
+        if err != nil {
+            continue
+        }
+        records = append(records, record)
+    }
+    return records, scanner.Err()
+}
+
+// Gets the current health of the server.
+// dir: a directory on the disk whose usage should be reported
+// Returns the health of the server
+func CurrentHealth(dir string) NodeHealth {
+    var health NodeHealth
+    health.Hostname, _ = os.Hostname()
+    health.Labels = buildinfo.NodeLabels()
+    uptime, err := host.Uptime()
+    if err == nil {
+        health.UptimeHours = float64(uptime) / 3600
+    }
+    loadAvg, err := load.Avg()
+    if err == nil {
+        health.Load1 = loadAvg.Load1
+        health.Load15 = loadAvg.Load15
+    }
+    memUsage, err := mem.VirtualMemory()
+    if err == nil {
+        health.MemoryUsedPercent = memUsage.UsedPercent
+    }
+    diskUsage, err := disk.Usage(dir)
+    if err == nil {
+        health.DiskUsedPercent = diskUsage.UsedPercent
+    }
+    return health
+}
+
+// Posts a report to a webhook. Requests that the webhook rejects aren't retried.
+// ctx: cancels the post
+// url: the URL of the webhook
+// jsonReport: the report, in JSON
+// Returns any errors
+func postWebhook(ctx context.Context, url string, jsonReport []byte) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonReport))
+    if err != nil {
+        return retry.Permanent(err)
+    }
+    req.Header.Set("Content-Type", "application/json")
+    client := http.Client{Timeout: webhookTimeout}
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        err = fmt.Errorf("Report webhook returned status %s", resp.Status)
+        if !retry.Retryable(resp.StatusCode) {
+            return retry.Permanent(err)
+        }
+        return err
+    }
+    return nil
+}
+
+// Gets the keys of a group of counts, sorted, so that the HTML tables are in a stable order.
+// groups: the counts of each group
+// Returns the sorted keys
+func sortedKeys(groups map[string]*Counts) []string {
+    var keys []string
+    for key := range groups {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+    "sortedKeys": sortedKeys,
+    "percent": func(fraction float64) string { return fmt.Sprintf("%.1f%%", fraction * 100) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Wehe report {{.Date}}</title></head>
+<body>
+<h1>Wehe tests on {{.Date}} (UTC)</h1>
+<p>Generated at {{.GeneratedAt.Format "2006-01-02 15:04:05"}} UTC on {{.Health.Hostname}}.</p>
+{{with .Privacy}}<p>To protect the privacy of clients,{{if gt .Epsilon 0.0}} random noise (epsilon = {{.Epsilon}}) was added to the test counts{{end}}{{if and (gt .Epsilon 0.0) (gt .MinCount 0)}} and{{end}}{{if gt .MinCount 0}} groups with fewer than {{.MinCount}} tests are not shown{{end}}.</p>
+{{end}}{{define "counts"}}<table border="1">
+<tr><th></th><th>Tests</th><th>Differentiation</th><th>No differentiation</th><th>Inconclusive</th><th>Incomplete</th><th>Failed</th><th>Error rate</th></tr>
+{{range $key := sortedKeys .}}{{with index $ $key}}<tr><td>{{$key}}</td><td>{{.Tests}}</td><td>{{.Differentiation}}</td><td>{{.NoDifferentiation}}</td><td>{{.Inconclusive}}</td><td>{{.Incomplete}}</td><td>{{.Failed}}</td><td>{{percent .ErrorRate}}</td></tr>
+{{end}}{{end}}</table>{{end}}
+<h2>Total</h2>
+<p>{{.Total.Tests}} tests: {{.Total.Differentiation}} differentiation, {{.Total.NoDifferentiation}} no differentiation, {{.Total.Inconclusive}} inconclusive, {{.Total.Incomplete}} incomplete, {{.Total.Failed}} failed ({{percent .Total.ErrorRate}} error rate).</p>
+<h2>By app</h2>
+{{template "counts" .ByApp}}
+<h2>By carrier</h2>
+{{template "counts" .ByCarrier}}
+<h2>By city</h2>
+{{template "counts" .ByCity}}
+<h2>By client version</h2>
+{{template "counts" .ByClientVersion}}
+{{if .Calibration.Tests}}<h2>Calibration</h2>
+<p>{{.Calibration.Tests}} calibration tests: {{.Calibration.Differentiation}} differentiation, {{.Calibration.NoDifferentiation}} no differentiation, {{.Calibration.Inconclusive}} inconclusive, {{.Calibration.Incomplete}} incomplete, {{.Calibration.Failed}} failed. Calibration tests send the same traffic in both replays, so differentiation points to a problem with the measurements rather than the network.</p>
+{{end}}{{with .Denials}}<h2>Denied tests</h2>
+<p>{{.Total}} tests were denied permission to run.</p>
+<table border="1">
+<tr><th>Reason</th><th>Denials</th></tr>
+{{range $reason, $count := .ByReason}}<tr><td>{{$reason}}</td><td>{{$count}}</td></tr>
+{{end}}</table>{{end}}
+<h2>Server health</h2>
+<table border="1">
+<tr><td>Uptime</td><td>{{printf "%.1f" .Health.UptimeHours}} hours</td></tr>
+<tr><td>Load (1 min / 15 min)</td><td>{{printf "%.2f" .Health.Load1}} / {{printf "%.2f" .Health.Load15}}</td></tr>
+<tr><td>Memory used</td><td>{{printf "%.1f" .Health.MemoryUsedPercent}}%</td></tr>
+<tr><td>Disk used</td><td>{{printf "%.1f" .Health.DiskUsedPercent}}%</td></tr>
+</table>
+</body>
+</html>
+`))
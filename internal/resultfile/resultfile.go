@@ -0,0 +1,365 @@
+// How result files are written: the per-test results, the PCAPs of tests, the daily reports, the
+// shutdown reports, and the bandwidth usage file. By default, a result file is written in place and
+// left to the page cache, so a power loss or kernel crash soon after a test can lose the file or leave
+// it empty or cut short. Durable writes write each file to a temporary file next to it, fsync it, read
+// it back to check its hash, rename it into place, and fsync the directory, so that a result file is
+// either whole or not there at all once the write returns.
+//
+// Durable writes cost two fsyncs per file, so their cost is the flush latency of the disk rather than
+// the size of the file. The writebench subcommand measures both ways on the disk of a server, e.g.
+// wehe-server writebench -c res/config/config.ini. As a rough guide, a plain write of a few KB takes
+// tens of microseconds, while a durable one takes about 1-5 ms on an SSD with a power loss protected
+// cache and 10-30 ms on a spinning disk or a network block device. A test writes about 10 result
+// files, so durable writes add up to a few hundred milliseconds to the end of a test on slow disks,
+// spent on the goroutine of the side channel of that test only.
+package resultfile
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "fmt"
+    "hash"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "time"
+)
+
+var (
+    durable = false // true if result files are fsynced, renamed into place, and checked after they are written
+)
+
+// Sets whether result files are written durably. This should be called before any clients connect.
+// isDurable: true to fsync, rename into place, and check each result file after it is written
+func SetDurable(isDurable bool) {
+    durable = isDurable
+}
+
+// Writes a result file the way the config says. Any missing directories are created.
+// parentDir: the parent directory of the file
+// filename: the name of the file
+// contents: the contents of the file to write
+// Returns any errors
+func Write(parentDir string, filename string, contents []byte) error {
+    if durable {
+        return writeViaTemp(parentDir, filename, contents, true)
+    }
+    return writeInPlace(parentDir, filename, contents)
+}
+
+// Replaces a file that is rewritten while the server runs, such as the bandwidth usage file, which
+// must never be left partly written since it is read back when the server starts. The contents are
+// always written next to the file and renamed over it; they are also fsynced and checked if the config
+// says that result files are written durably. Any missing directories are created.
+// parentDir: the parent directory of the file
+// filename: the name of the file
+// contents: the contents of the file to write
+// Returns any errors
+func Replace(parentDir string, filename string, contents []byte) error {
+    return writeViaTemp(parentDir, filename, contents, durable)
+}
+
+// Writes contents to a file in place. Any missing directories are created.
+// parentDir: the parent directory of the file
+// filename: the name of the file
+// contents: the contents of the file to write
+// Returns any errors
+func writeInPlace(parentDir string, filename string, contents []byte) error {
+    if err := os.MkdirAll(parentDir, 0755); err != nil {
+        return err
+    }
+
+    file, err := os.Create(filepath.Join(parentDir, filename))
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    if _, err := file.Write(contents); err != nil {
+        return err
+    }
+    return nil
+}
+
+// Writes a file to a temporary file in the same directory and renames it over the file. If the write
+// is durable, the temporary file is fsynced and read back and checked against the hash of the
+// contents before the rename, and the directory is fsynced after it so that the rename is kept; a
+// file that fails the check is never renamed into place. Any missing directories are created.
+// parentDir: the parent directory of the file
+// filename: the name of the file
+// contents: the contents of the file to write
+// isDurable: true to write the file so that it survives a power loss once this returns
+// Returns any errors
+func writeViaTemp(parentDir string, filename string, contents []byte, isDurable bool) error {
+    file, err := create(parentDir, filename, true, isDurable)
+    if err != nil {
+        return err
+    }
+    _, err = file.Write(contents)
+    if err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+// A result file that is written bit by bit, such as a PCAP. If it is written durably, it is written
+// to a temporary file next to it that is renamed into place when it is closed, so it only shows up
+// under its own name once it is whole. Not safe for concurrent use.
+type File struct {
+    path string // the path of the file
+    file *os.File // the file being written; the temporary file if viaTemp is true
+    viaTemp bool // true if the file is written to a temporary file that is renamed into place
+    durable bool // true if the temporary file is fsynced and checked before it is renamed
+    hash hash.Hash // the SHA-256 hash of what has been written; nil if durable is false
+    size int64 // the bytes written so far
+    failed bool // true if a write failed, so the temporary file mustn't be renamed into place
+}
+
+// Creates a result file that is written the way the config says. Any missing directories are
+// created. The file must be closed for it to be kept.
+// path: the path of the file
+// Returns the file or any errors
+func Create(path string) (*File, error) {
+    return create(filepath.Dir(path), filepath.Base(path), durable, durable)
+}
+
+// Creates a file that is written in place whatever the config says, for files that are read while
+// they are written, such as debug captures, which a temporary file would hide until they are done.
+// Any missing directories are created.
+// path: the path of the file
+// Returns the file or any errors
+func CreateInPlace(path string) (*File, error) {
+    return create(filepath.Dir(path), filepath.Base(path), false, false)
+}
+
+// Creates a file in place or as a temporary file next to it.
+// parentDir: the parent directory of the file
+// filename: the name of the file
+// viaTemp: true to write to a temporary file that is renamed into place when the file is closed
+// isDurable: true to fsync and check the temporary file before it is renamed; needs viaTemp
+// Returns the file or any errors
+func create(parentDir string, filename string, viaTemp bool, isDurable bool) (*File, error) {
+    if err := os.MkdirAll(parentDir, 0755); err != nil {
+        return nil, err
+    }
+    resultFile := &File{
+        path: filepath.Join(parentDir, filename),
+        viaTemp: viaTemp,
+        durable: isDurable,
+    }
+    var err error
+    if viaTemp {
+        resultFile.file, err = os.CreateTemp(parentDir, "." + filename + "-")
+    } else {
+        resultFile.file, err = os.Create(resultFile.path)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if isDurable {
+        resultFile.hash = sha256.New()
+    }
+    return resultFile, nil
+}
+
+// Gets the path the file is kept at once it is closed.
+// Returns the path
+func (resultFile *File) Path() string {
+    return resultFile.path
+}
+
+// Gets the bytes written to the file so far.
+// Returns the size of the file
+func (resultFile *File) Size() int64 {
+    return resultFile.size
+}
+
+// Writes to the file.
+// data: the bytes to write
+// Returns the number of bytes written and any errors
+func (resultFile *File) Write(data []byte) (int, error) {
+    n, err := resultFile.file.Write(data)
+    resultFile.size += int64(n)
+    if resultFile.hash != nil {
+        resultFile.hash.Write(data[:n])
+    }
+    if err != nil {
+        resultFile.failed = true
+    }
+    return n, err
+}
+
+// Finishes the file. A file written via a temporary file is renamed into place, after it is fsynced
+// and checked if it is written durably; if a write failed or the check fails, the temporary file is
+// removed instead.
+// Returns any errors
+func (resultFile *File) Close() error {
+    if !resultFile.viaTemp {
+        return resultFile.file.Close()
+    }
+    tmpFilename := resultFile.file.Name()
+    renamed := false
+    defer func() {
+        if !renamed {
+            os.Remove(tmpFilename)
+        }
+    }()
+    var err error
+    if resultFile.durable {
+        err = resultFile.file.Sync()
+    }
+    closeErr := resultFile.file.Close()
+    if err != nil {
+        return err
+    }
+    if closeErr != nil {
+        return closeErr
+    }
+    if resultFile.failed {
+        return fmt.Errorf("Result file %s wasn't kept since a write to it failed", resultFile.path)
+    }
+    // CreateTemp makes the file readable only by the server, unlike os.Create
+    err = os.Chmod(tmpFilename, 0644)
+    if err != nil {
+        return err
+    }
+
+    if resultFile.durable {
+        // the read is likely served from the page cache, so this catches writes that were cut short or
+        // mangled on the way to the file system rather than a disk that lies about its flushes
+        err = resultFile.check(tmpFilename)
+        if err != nil {
+            return err
+        }
+    }
+
+    err = os.Rename(tmpFilename, resultFile.path)
+    if err != nil {
+        return err
+    }
+    renamed = true
+    if resultFile.durable {
+        return syncDir(filepath.Dir(resultFile.path))
+    }
+    return nil
+}
+
+// Reads back a written file and checks it against the hash of what was written.
+// tmpFilename: the path the file was written to
+// Returns an error if the file doesn't match or can't be read
+func (resultFile *File) check(tmpFilename string) error {
+    written, err := os.Open(tmpFilename)
+    if err != nil {
+        return err
+    }
+    defer written.Close()
+    writtenHash := sha256.New()
+    numBytes, err := io.Copy(writtenHash, written)
+    if err != nil {
+        return err
+    }
+    wantHash := resultFile.hash.Sum(nil)
+    gotHash := writtenHash.Sum(nil)
+    if !bytes.Equal(wantHash, gotHash) {
+        return fmt.Errorf("Result file %s doesn't match what was written: read %d bytes with SHA-256 %x; wrote %d bytes with SHA-256 %x",
+            resultFile.path, numBytes, gotHash, resultFile.size, wantHash)
+    }
+    return nil
+}
+
+// Flushes a directory to disk, so that files created in or renamed into it are kept after a power
+// loss.
+// dir: the directory
+// Returns any errors
+func syncDir(dir string) error {
+    dirFile, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer dirFile.Close()
+    return dirFile.Sync()
+}
+
+// How long it took to write result files one way.
+type WriteTimings struct {
+    Files int `json:"files"` // the number of files written
+    Median time.Duration `json:"median"` // the median time to write a file
+    P99 time.Duration `json:"p99"` // the 99th percentile time to write a file
+    FilesPerSecond float64 `json:"files_per_second"` // the files written per second, one after another
+}
+
+// Measures how long result files take to write in place and durably, by writing files of the same
+// size both ways in a new directory, which is removed afterwards.
+// dir: the directory to write in; should be on the same disk as the results directories
+// files: the number of files to write each way
+// size: the size of each file in bytes
+// Returns the timings of plain writes, the timings of durable writes, or any errors
+func Benchmark(dir string, files int, size int) (WriteTimings, WriteTimings, error) {
+    if files < 1 || size < 0 {
+        return WriteTimings{}, WriteTimings{}, fmt.Errorf("Write benchmark needs at least 1 file and a size of at least 0 bytes; got %d files of %d bytes", files, size)
+    }
+    err := os.MkdirAll(dir, 0755)
+    if err != nil {
+        return WriteTimings{}, WriteTimings{}, err
+    }
+    benchDir, err := os.MkdirTemp(dir, ".writebench-")
+    if err != nil {
+        return WriteTimings{}, WriteTimings{}, err
+    }
+    defer os.RemoveAll(benchDir)
+
+    contents := bytes.Repeat([]byte("x"), size)
+    plain, err := timeWrites(benchDir, "plain", files, contents, writeInPlace)
+    if err != nil {
+        return WriteTimings{}, WriteTimings{}, err
+    }
+    durable, err := timeWrites(benchDir, "durable", files, contents, writeDurably)
+    if err != nil {
+        return WriteTimings{}, WriteTimings{}, err
+    }
+    return plain, durable, nil
+}
+
+// Writes a file durably, whatever the config says.
+// parentDir: the parent directory of the file
+// filename: the name of the file
+// contents: the contents of the file to write
+// Returns any errors
+func writeDurably(parentDir string, filename string, contents []byte) error {
+    return writeViaTemp(parentDir, filename, contents, true)
+}
+
+// Times writing a number of files one after another.
+// dir: the directory to write in
+// prefix: the start of the name of each file
+// files: the number of files to write
+// contents: the contents of each file
+// write: writes a file
+// Returns the timings or any errors
+func timeWrites(dir string, prefix string, files int, contents []byte, write func(string, string, []byte) error) (WriteTimings, error) {
+    durations := make([]time.Duration, files)
+    var total time.Duration
+    for i := range durations {
+        start := time.Now()
+        err := write(dir, fmt.Sprintf("%s_%d.json", prefix, i), contents)
+        if err != nil {
+            return WriteTimings{}, err
+        }
+        durations[i] = time.Since(start)
+        total += durations[i]
+    }
+    sort.Slice(durations, func(i int, j int) bool {
+        return durations[i] < durations[j]
+    })
+    timings := WriteTimings{
+        Files: files,
+        Median: durations[files / 2],
+        P99: durations[(files - 1) * 99 / 100],
+    }
+    if total > 0 {
+        timings.FilesPerSecond = float64(files) / total.Seconds()
+    }
+    return timings, nil
+}
@@ -0,0 +1,148 @@
+// Tests and benchmarks of writing result files in place and durably.
+package resultfile
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// Sets whether result files are written durably for the rest of a test.
+// tb: the test or benchmark
+// isDurable: true to write result files durably
+func setDurable(tb testing.TB, isDurable bool) {
+    old := durable
+    SetDurable(isDurable)
+    tb.Cleanup(func() {
+        SetDurable(old)
+    })
+}
+
+// Lists the names of the files in a directory.
+// t: the test
+// dir: the directory
+// Returns the names of the files
+func listDir(t *testing.T, dir string) []string {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var names []string
+    for _, entry := range entries {
+        names = append(names, entry.Name())
+    }
+    return names
+}
+
+// Writes files with Write, Replace, and Create both ways and checks that they hold what was written,
+// are readable by everyone, and leave no temporary files behind.
+func TestWrite(t *testing.T) {
+    contents := []byte("{\"throughputs\": [1.5, 2.5]}")
+    for _, isDurable := range []bool{false, true} {
+        t.Run(fmt.Sprintf("durable=%t", isDurable), func(t *testing.T) {
+            setDurable(t, isDurable)
+            dir := filepath.Join(t.TempDir(), "results", "user")
+
+            err := Write(dir, "written.json", contents)
+            if err != nil {
+                t.Fatal(err)
+            }
+            err = Replace(dir, "replaced.json", []byte("old"))
+            if err != nil {
+                t.Fatal(err)
+            }
+            err = Replace(dir, "replaced.json", contents)
+            if err != nil {
+                t.Fatal(err)
+            }
+            file, err := Create(filepath.Join(dir, "created.json"))
+            if err != nil {
+                t.Fatal(err)
+            }
+            for i := 0; i < len(contents); i += 5 {
+                _, err = file.Write(contents[i:min(i + 5, len(contents))])
+                if err != nil {
+                    t.Fatal(err)
+                }
+            }
+            if file.Size() != int64(len(contents)) {
+                t.Errorf("Size() = %d; want %d", file.Size(), len(contents))
+            }
+            err = file.Close()
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            for _, filename := range []string{"created.json", "replaced.json", "written.json"} {
+                path := filepath.Join(dir, filename)
+                written, err := os.ReadFile(path)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if !bytes.Equal(written, contents) {
+                    t.Errorf("%s holds %q; want %q", filename, written, contents)
+                }
+                info, err := os.Stat(path)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if info.Mode().Perm() & 0044 != 0044 {
+                    t.Errorf("%s has mode %v; want it readable by everyone", filename, info.Mode())
+                }
+            }
+            if names := listDir(t, dir); len(names) != 3 {
+                t.Errorf("Directory holds %v; want only the three files", names)
+            }
+        })
+    }
+}
+
+// Checks that a durable file only shows up under its own name once it is closed.
+func TestCreateDurableHiddenUntilClosed(t *testing.T) {
+    setDurable(t, true)
+    dir := t.TempDir()
+    path := filepath.Join(dir, "capture.pcap.zst")
+    file, err := Create(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = file.Write([]byte("packets"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := os.Stat(path); !os.IsNotExist(err) {
+        t.Errorf("%s exists before it is closed", path)
+    }
+    err = file.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if names := listDir(t, dir); len(names) != 1 || names[0] != "capture.pcap.zst" {
+        t.Errorf("Directory holds %v after the file is closed; want only capture.pcap.zst", names)
+    }
+}
+
+// Measures writing a result file in place and durably, for files the size of a small results file
+// and of a large one. The durable times depend on the flush latency of the disk the temporary
+// directory is on.
+func BenchmarkWriteResultFile(b *testing.B) {
+    for _, isDurable := range []bool{false, true} {
+        for _, size := range []int{4 << 10, 256 << 10} {
+            b.Run(fmt.Sprintf("durable=%t/size=%dKB", isDurable, size >> 10), func(b *testing.B) {
+                setDurable(b, isDurable)
+                dir := b.TempDir()
+                contents := bytes.Repeat([]byte("x"), size)
+                b.SetBytes(int64(size))
+                b.ResetTimer()
+                for i := 0; i < b.N; i++ {
+                    err := Write(dir, fmt.Sprintf("result_%d.json", i % 100), contents)
+                    if err != nil {
+                        b.Fatal(err)
+                    }
+                }
+            })
+        }
+    }
+}
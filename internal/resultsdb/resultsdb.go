@@ -0,0 +1,271 @@
+// Stores the results of tests in a SQLite or PostgreSQL database, so that they can be queried (e.g.
+// every test of a user) instead of searched for in the result files. The replay info, throughputs,
+// and analysis of a test are stored in the format of their result files, next to the columns needed
+// to look tests up and to answer the results requests of old clients. The same SQL is used for both
+// databases, so only types and statements that both understand are used.
+package resultsdb
+
+import (
+    "database/sql"
+    "fmt"
+    "time"
+
+    _ "github.com/lib/pq"
+    _ "github.com/mattn/go-sqlite3"
+
+    "wehe-server/internal/clienthandler"
+)
+
+const (
+    timeFormat = "2006-01-02 15:04:05.000000" // format of the start times, which sorts like the times it holds
+)
+
+var (
+    // the names the database/sql drivers are registered under; key is the name used in the config file
+    driverNames = map[string]string{
+        "sqlite": "sqlite3",
+        "postgres": "postgres",
+    }
+
+    // creates the tables if they don't exist
+    schema = []string{
+        `CREATE TABLE IF NOT EXISTS tests (
+            user_id TEXT NOT NULL,
+            test_id INTEGER NOT NULL,
+            attempt INTEGER NOT NULL,
+            start_time TEXT NOT NULL,
+            extra_string TEXT NOT NULL,
+            client_version TEXT NOT NULL,
+            analyzed BOOLEAN NOT NULL DEFAULT FALSE,
+            differentiation BOOLEAN NOT NULL DEFAULT FALSE,
+            area_test DOUBLE PRECISION NOT NULL DEFAULT 0,
+            ks2_ratio_test DOUBLE PRECISION NOT NULL DEFAULT 0,
+            ks2_dval DOUBLE PRECISION NOT NULL DEFAULT 0,
+            ks2_pval DOUBLE PRECISION NOT NULL DEFAULT 0,
+            xput_avg_original DOUBLE PRECISION NOT NULL DEFAULT 0,
+            xput_avg_test DOUBLE PRECISION NOT NULL DEFAULT 0,
+            results TEXT,
+            PRIMARY KEY (user_id, test_id, attempt)
+        )`,
+        `CREATE INDEX IF NOT EXISTS tests_start_time ON tests (start_time)`,
+        `CREATE TABLE IF NOT EXISTS replays (
+            user_id TEXT NOT NULL,
+            test_id INTEGER NOT NULL,
+            attempt INTEGER NOT NULL,
+            replay_id INTEGER NOT NULL,
+            replay_name TEXT NOT NULL,
+            info TEXT NOT NULL,
+            PRIMARY KEY (user_id, test_id, attempt, replay_id)
+        )`,
+        `CREATE TABLE IF NOT EXISTS throughputs (
+            user_id TEXT NOT NULL,
+            test_id INTEGER NOT NULL,
+            attempt INTEGER NOT NULL,
+            replay_id INTEGER NOT NULL,
+            derived BOOLEAN NOT NULL,
+            xputs TEXT NOT NULL,
+            PRIMARY KEY (user_id, test_id, attempt, replay_id, derived)
+        )`,
+    }
+)
+
+const (
+    // adds a test, or updates what is known about it before it is analyzed
+    upsertTest = `INSERT INTO tests (user_id, test_id, attempt, start_time, extra_string, client_version)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        ON CONFLICT (user_id, test_id, attempt) DO UPDATE SET
+            start_time = excluded.start_time,
+            extra_string = excluded.extra_string,
+            client_version = excluded.client_version`
+
+    // adds a test with its analysis, or adds the analysis to a test
+    upsertAnalysis = `INSERT INTO tests (user_id, test_id, attempt, start_time, extra_string, client_version,
+            analyzed, differentiation, area_test, ks2_ratio_test, ks2_dval, ks2_pval, xput_avg_original, xput_avg_test, results)
+        VALUES ($1, $2, $3, $4, $5, $6, TRUE, $7, $8, $9, $10, $11, $12, $13, $14)
+        ON CONFLICT (user_id, test_id, attempt) DO UPDATE SET
+            analyzed = TRUE,
+            differentiation = excluded.differentiation,
+            area_test = excluded.area_test,
+            ks2_ratio_test = excluded.ks2_ratio_test,
+            ks2_dval = excluded.ks2_dval,
+            ks2_pval = excluded.ks2_pval,
+            xput_avg_original = excluded.xput_avg_original,
+            xput_avg_test = excluded.xput_avg_test,
+            results = excluded.results`
+
+    upsertReplay = `INSERT INTO replays (user_id, test_id, attempt, replay_id, replay_name, info)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        ON CONFLICT (user_id, test_id, attempt, replay_id) DO UPDATE SET
+            replay_name = excluded.replay_name,
+            info = excluded.info`
+
+    upsertThroughputs = `INSERT INTO throughputs (user_id, test_id, attempt, replay_id, derived, xputs)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        ON CONFLICT (user_id, test_id, attempt, replay_id, derived) DO UPDATE SET
+            xputs = excluded.xputs`
+
+    testColumns = `user_id, test_id, attempt, start_time, extra_string, client_version, analyzed,
+        differentiation, area_test, ks2_ratio_test, ks2_dval, ks2_pval, xput_avg_original, xput_avg_test`
+)
+
+// A database the results of tests are stored in. It implements clienthandler.ResultsStore.
+type Store struct {
+    db *sql.DB // the connections to the database
+}
+
+// Connects to a results database, creating its tables if they don't exist.
+// driver: the database, "sqlite" or "postgres"
+// dataSource: the path of the database file for SQLite, or the connection string for PostgreSQL
+// Returns the store or any errors
+func Open(driver string, dataSource string) (*Store, error) {
+    driverName, exists := driverNames[driver]
+    if !exists {
+        return nil, fmt.Errorf("Unknown results database driver %s", driver)
+    }
+    db, err := sql.Open(driverName, dataSource)
+    if err != nil {
+        return nil, err
+    }
+    // SQLite allows one writer at a time; writers on other connections would fail instead of waiting
+    if driver == "sqlite" {
+        db.SetMaxOpenConns(1)
+    }
+    for _, statement := range schema {
+        _, err = db.Exec(statement)
+        if err != nil {
+            db.Close()
+            return nil, fmt.Errorf("Unable to create the tables of the results database: %v", err)
+        }
+    }
+    return &Store{db: db}, nil
+}
+
+// Closes the connections to the database.
+// Returns any errors
+func (store *Store) Close() error {
+    return store.db.Close()
+}
+
+func (store *Store) SaveReplay(test clienthandler.StoredTest, replayID clienthandler.ReplayType, replayName string, info string) error {
+    tx, err := store.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    _, err = tx.Exec(upsertTest, test.UserID, test.TestID, test.Attempt, test.StartTime.UTC().Format(timeFormat), test.ExtraString, test.ClientVersion)
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec(upsertReplay, test.UserID, test.TestID, test.Attempt, int(replayID), replayName, info)
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func (store *Store) SaveThroughputs(test clienthandler.StoredTest, replayID clienthandler.ReplayType, derived bool, throughputs string) error {
+    _, err := store.db.Exec(upsertThroughputs, test.UserID, test.TestID, test.Attempt, int(replayID), derived, throughputs)
+    return err
+}
+
+func (store *Store) SaveAnalysis(test clienthandler.StoredTest, results string) error {
+    if test.Analysis == nil {
+        return fmt.Errorf("Test %d of user %s has not been analyzed", test.TestID, test.UserID)
+    }
+    analysis := test.Analysis
+    _, err := store.db.Exec(upsertAnalysis, test.UserID, test.TestID, test.Attempt, test.StartTime.UTC().Format(timeFormat), test.ExtraString, test.ClientVersion,
+        analysis.Differentiation, analysis.Area0var, analysis.KS2AcceptRatio, analysis.KS2dVal, analysis.KS2pVal, analysis.OriginalAverage, analysis.RandomAverage, results)
+    return err
+}
+
+func (store *Store) UserTests(userID string) ([]clienthandler.StoredTest, error) {
+    rows, err := store.db.Query(`SELECT ` + testColumns + ` FROM tests WHERE user_id = $1 ORDER BY start_time, test_id, attempt`, userID)
+    if err != nil {
+        return nil, err
+    }
+    tests, err := scanTests(rows)
+    if err != nil {
+        return nil, err
+    }
+
+    // the replays of every test of the user are read at once rather than once per test
+    rows, err = store.db.Query(`SELECT test_id, attempt, replay_id, replay_name FROM replays WHERE user_id = $1`, userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    byTest := make(map[[2]int]*clienthandler.StoredTest)
+    for i := range tests {
+        byTest[[2]int{tests[i].TestID, tests[i].Attempt}] = &tests[i]
+    }
+    for rows.Next() {
+        var testID, attempt, replayID int
+        var replayName string
+        err = rows.Scan(&testID, &attempt, &replayID, &replayName)
+        if err != nil {
+            return nil, err
+        }
+        test, exists := byTest[[2]int{testID, attempt}]
+        if exists {
+            test.ReplayNames[clienthandler.ReplayType(replayID)] = replayName
+        }
+    }
+    return tests, rows.Err()
+}
+
+func (store *Store) Test(userID string, testID int) (clienthandler.StoredTest, bool, error) {
+    rows, err := store.db.Query(`SELECT ` + testColumns + ` FROM tests WHERE user_id = $1 AND test_id = $2 ORDER BY attempt DESC LIMIT 1`, userID, testID)
+    if err != nil {
+        return clienthandler.StoredTest{}, false, err
+    }
+    tests, err := scanTests(rows)
+    if err != nil || len(tests) == 0 {
+        return clienthandler.StoredTest{}, false, err
+    }
+    test := tests[0]
+
+    rows, err = store.db.Query(`SELECT replay_id, replay_name FROM replays WHERE user_id = $1 AND test_id = $2 AND attempt = $3`, userID, testID, test.Attempt)
+    if err != nil {
+        return clienthandler.StoredTest{}, false, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var replayID int
+        var replayName string
+        err = rows.Scan(&replayID, &replayName)
+        if err != nil {
+            return clienthandler.StoredTest{}, false, err
+        }
+        test.ReplayNames[clienthandler.ReplayType(replayID)] = replayName
+    }
+    return test, true, rows.Err()
+}
+
+// Reads tests selected with testColumns, and closes the rows.
+// rows: the selected tests
+// Returns the tests or any errors
+func scanTests(rows *sql.Rows) ([]clienthandler.StoredTest, error) {
+    defer rows.Close()
+    var tests []clienthandler.StoredTest
+    for rows.Next() {
+        var test clienthandler.StoredTest
+        var startTime string
+        var analyzed bool
+        var analysis clienthandler.StoredAnalysis
+        err := rows.Scan(&test.UserID, &test.TestID, &test.Attempt, &startTime, &test.ExtraString, &test.ClientVersion, &analyzed,
+            &analysis.Differentiation, &analysis.Area0var, &analysis.KS2AcceptRatio, &analysis.KS2dVal, &analysis.KS2pVal, &analysis.OriginalAverage, &analysis.RandomAverage)
+        if err != nil {
+            return nil, err
+        }
+        test.StartTime, err = time.Parse(timeFormat, startTime)
+        if err != nil {
+            return nil, err
+        }
+        test.ReplayNames = make(map[clienthandler.ReplayType]string)
+        if analyzed {
+            test.Analysis = &analysis
+        }
+        tests = append(tests, test)
+    }
+    return tests, rows.Err()
+}
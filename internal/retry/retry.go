@@ -0,0 +1,148 @@
+// Retries operations that talk to other services, such as posting to a webhook or uploading results,
+// with exponential backoff and jitter, so that every outbound subsystem fails the same way and its
+// failures show up in the same metrics. The jitter keeps a fleet of servers that lost a service at
+// the same time from all retrying at once when it comes back.
+package retry
+
+import (
+    "context"
+    "errors"
+    "log/slog"
+    "math/rand"
+    "net/http"
+    "time"
+
+    "wehe-server/internal/metrics"
+)
+
+var (
+    attempts = metrics.NewCounterVec("wehe_outbound_attempts_total",
+        "Number of attempts of operations that talk to other services, by operation.", "operation")
+    retries = metrics.NewCounterVec("wehe_outbound_retries_total",
+        "Number of failed attempts of operations that talk to other services that were retried, by operation.", "operation")
+    failures = metrics.NewCounterVec("wehe_outbound_failures_total",
+        "Number of operations that talk to other services that were given up on, by operation.", "operation")
+)
+
+// How an operation is retried.
+type Policy struct {
+    Operation string // names the operation in the logs and metrics, e.g. verdict_webhook
+    MaxAttempts int // times the operation is tried before it is given up on; 0 to retry until the context is done
+    InitialDelay time.Duration // wait before the first retry; doubles for each retry after
+    MaxDelay time.Duration // longest wait between attempts; 0 for no limit
+    Jitter float64 // fraction of each wait that is random, from 0 to 1
+}
+
+// An error that retrying won't fix.
+type permanentError struct {
+    err error // the error of the attempt
+}
+
+func (permanent permanentError) Error() string {
+    return permanent.err.Error()
+}
+
+func (permanent permanentError) Unwrap() error {
+    return permanent.err
+}
+
+// Marks an error as one that retrying won't fix, e.g. a request that the service rejected, so that
+// the operation is given up on at once.
+// err: the error of the attempt
+// Returns the marked error, which unwraps to err; nil if err is nil
+func Permanent(err error) error {
+    if err == nil {
+        return nil
+    }
+    return permanentError{err: err}
+}
+
+// Checks if an error was marked as one that retrying won't fix.
+// err: the error
+// Returns true if err or an error it wraps was marked by Permanent
+func IsPermanent(err error) bool {
+    var permanent permanentError
+    return errors.As(err, &permanent)
+}
+
+// Checks if an HTTP request that failed with a status may succeed if it is sent again. Server errors,
+// timeouts, and rate limits may go away; other client errors won't.
+// statusCode: the status of the response
+// Returns true if the request should be retried
+func Retryable(statusCode int) bool {
+    return statusCode >= 500 || statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests
+}
+
+// Gets how long to wait before the next attempt.
+// failed: failed attempts of the operation so far, starting at 1
+// Returns the wait, with its jitter
+func (policy Policy) Delay(failed int) time.Duration {
+    delay := policy.InitialDelay
+    for i := 1; i < failed; i++ {
+        if policy.MaxDelay > 0 && delay >= policy.MaxDelay {
+            break
+        }
+        // stop doubling long before the wait could overflow
+        if delay > time.Duration(1) << 60 {
+            break
+        }
+        delay *= 2
+    }
+    if policy.MaxDelay > 0 {
+        delay = min(delay, policy.MaxDelay)
+    }
+    jitter := min(max(policy.Jitter, 0), 1)
+    return delay - time.Duration(jitter * rand.Float64() * float64(delay))
+}
+
+// Records the outcome of an attempt and works out whether to try again. Do calls this itself; it is
+// exported for operations that schedule their own retries, e.g. on their next pass, instead of
+// waiting for them.
+// err: the error of the attempt; nil if it succeeded
+// failed: failed attempts of the operation so far, including this one if it failed
+// Returns how long to wait before the next attempt, and true if the operation should be tried again
+func (policy Policy) Record(err error, failed int) (time.Duration, bool) {
+    attempts.Inc(policy.Operation)
+    if err == nil {
+        return 0, false
+    }
+    if IsPermanent(err) || (policy.MaxAttempts > 0 && failed >= policy.MaxAttempts) {
+        failures.Inc(policy.Operation)
+        return 0, false
+    }
+    retries.Inc(policy.Operation)
+    return policy.Delay(failed), true
+}
+
+// Runs an operation until it succeeds, fails with a permanent error, runs out of attempts, or the
+// context is done. Each failure is logged.
+// ctx: stops the retries once it is done; it is also passed to the operation
+// operation: the operation; its errors can be marked with Permanent to stop the retries
+// Returns nil if the operation succeeded, otherwise the error of its last attempt
+func (policy Policy) Do(ctx context.Context, operation func(ctx context.Context) error) error {
+    for failed := 1; ; failed++ {
+        err := ctx.Err()
+        if err != nil {
+            return err
+        }
+        err = operation(ctx)
+        delay, again := policy.Record(err, failed)
+        if err == nil {
+            return nil
+        }
+        if !again {
+            slog.Warn("Giving up on operation", "operation", policy.Operation, "attempt", failed, "error", err)
+            return err
+        }
+        slog.Warn("Operation failed; retrying", "operation", policy.Operation, "attempt", failed, "retry_in", delay, "error", err)
+
+        timer := time.NewTimer(delay)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            failures.Inc(policy.Operation)
+            return err
+        case <-timer.C:
+        }
+    }
+}
@@ -0,0 +1,203 @@
+// Writes a report when the server exits, cleanly or because of a panic, listing the tests that were
+// running, how far they had gotten, and whether their results were salvaged. The report, and an
+// optional dump of every goroutine, show after an incident how many measurements were lost and
+// which part of the server failed.
+package shutdown
+
+import (
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "runtime"
+    "runtime/debug"
+    "sync"
+    "time"
+
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/resultfile"
+)
+
+const (
+    maxGoroutineDumpSize = 64 << 20 // largest goroutine dump written, in bytes
+)
+
+var (
+    defaultReporter *Reporter // the reporter used by RecoverPanic; nil if reports aren't written
+    defaultReporterMutex sync.Mutex // prevents multiple goroutines from accessing defaultReporter
+)
+
+// The report written when the server exits.
+type Report struct {
+    Time time.Time `json:"time"` // when the server exited
+    StartTime time.Time `json:"start_time"` // when the server started
+    Cause string `json:"cause"` // why the server exited, e.g. the signal received or the error or panic that stopped it
+    Panic bool `json:"panic"` // true if the server exited because of a panic
+    Stack string `json:"stack,omitempty"` // the stack of the goroutine that panicked
+    InFlightTests []clienthandler.InFlightTest `json:"in_flight_tests"` // the tests that were running, oldest first
+    Salvaged int `json:"salvaged"` // number of running tests that wrote their results
+    Lost int `json:"lost"` // number of running tests that didn't write their results
+    GoroutineDumpFile string `json:"goroutine_dump_file,omitempty"` // the file the stacks of every goroutine were written to
+}
+
+// Writes the report when the server exits. Only the first report is written, since a panic during
+// a clean exit would otherwise overwrite the report of the exit.
+type Reporter struct {
+    dir string // the directory reports are written to
+    goroutineDump bool // true if the stacks of every goroutine are written with the report
+    drain time.Duration // how long running tests have to finish on their own after the server is told to exit
+    grace time.Duration // how long running tests have to write their results on a clean exit
+    inFlightTests *clienthandler.InFlightTests // the tests that are running
+    startTime time.Time // when the server started
+    once sync.Once // makes sure only one report is written
+}
+
+// Creates a new Reporter.
+// dir: the directory reports are written to
+// goroutineDump: true to write the stacks of every goroutine with the report
+// drain: how long running tests have to finish on their own after the server is told to exit
+// grace: how long running tests have to write their results on a clean exit
+// inFlightTests: the tests that are running
+// Returns the reporter
+func New(dir string, goroutineDump bool, drain time.Duration, grace time.Duration, inFlightTests *clienthandler.InFlightTests) *Reporter {
+    return &Reporter{
+        dir: dir,
+        goroutineDump: goroutineDump,
+        drain: drain,
+        grace: grace,
+        inFlightTests: inFlightTests,
+        startTime: time.Now().UTC(),
+    }
+}
+
+// Sets the reporter used by RecoverPanic.
+// reporter: the reporter; nil to stop writing reports on panics
+func SetReporter(reporter *Reporter) {
+    defaultReporterMutex.Lock()
+    defer defaultReporterMutex.Unlock()
+    defaultReporter = reporter
+}
+
+// Writes a crash report if the calling goroutine is panicking, then continues the panic so that the
+// server still crashes. A panic in any goroutine stops the whole server, so this should be deferred
+// at the start of every goroutine that handles clients.
+func RecoverPanic() {
+    recovered := recover()
+    if recovered == nil {
+        return
+    }
+    defaultReporterMutex.Lock()
+    reporter := defaultReporter
+    defaultReporterMutex.Unlock()
+    if reporter != nil {
+        reporter.Crash(recovered, debug.Stack())
+    }
+    panic(recovered)
+}
+
+// Stops the running tests, gives them the grace period to write their results, and writes the
+// report. Used when the server exits without panicking.
+// cause: why the server is exiting
+func (reporter *Reporter) Shutdown(cause string) {
+    reporter.once.Do(func() {
+        slog.Info("Shutting down; waiting for running tests to write their results", "cause", cause, "grace", reporter.grace)
+        tests := reporter.inFlightTests.Abort(reporter.grace)
+        reporter.write(Report{
+            Cause: cause,
+            InFlightTests: tests,
+        })
+    })
+}
+
+// Stops admitting new tests and waits for the running tests to finish on their own before shutting
+// down, so that a deploy or restart doesn't cut off the measurements in progress. Tests still running
+// after the drain period are stopped by Shutdown. The caller must have already stopped accepting
+// side channel connections.
+// cause: why the server is exiting
+// interrupt: receiving from it stops the wait early, e.g. when an operator sends a second signal
+func (reporter *Reporter) Drain(cause string, interrupt <-chan os.Signal) {
+    if reporter.drain > 0 {
+        slog.Info("Draining; waiting for running tests to finish", "cause", cause, "drain", reporter.drain)
+        clienthandler.StartDraining(time.Now().Add(reporter.drain))
+        drained := make(chan bool, 1)
+        go func() {
+            drained <- reporter.inFlightTests.Wait(reporter.drain)
+        }()
+        select {
+        case finished := <-drained:
+            if finished {
+                slog.Info("Every running test finished")
+            }
+        case sig := <-interrupt:
+            slog.Info("Received a signal while draining; stopping the running tests", "signal", sig)
+        }
+    }
+    reporter.Shutdown(cause)
+}
+
+// Writes the report of a panic. The running tests are listed as they were; they aren't given time to
+// write their results, since the state of the server can't be trusted after a panic.
+// recovered: the value the goroutine panicked with
+// stack: the stack of the goroutine that panicked
+func (reporter *Reporter) Crash(recovered interface{}, stack []byte) {
+    reporter.once.Do(func() {
+        reporter.write(Report{
+            Cause: fmt.Sprint("panic: ", recovered),
+            Panic: true,
+            Stack: string(stack),
+            InFlightTests: reporter.inFlightTests.List(),
+        })
+    })
+}
+
+// Fills in the rest of the report and writes it, along with the goroutine dump if it is on, to
+// <dir>/shutdown_<time>.json. Errors are only logged, since the server is exiting anyway.
+// report: the report, with the cause and the running tests filled in
+func (reporter *Reporter) write(report Report) {
+    report.Time = time.Now().UTC()
+    report.StartTime = reporter.startTime
+    for _, test := range report.InFlightTests {
+        if test.Salvaged {
+            report.Salvaged++
+        } else {
+            report.Lost++
+        }
+    }
+
+    timestamp := report.Time.Format("20060102T150405Z")
+    if reporter.goroutineDump {
+        report.GoroutineDumpFile = filepath.Join(reporter.dir, "goroutines_" + timestamp + ".txt")
+        err := resultfile.Write(reporter.dir, filepath.Base(report.GoroutineDumpFile), goroutineStacks())
+        if err != nil {
+            slog.Error("Unable to write goroutine dump", "error", err)
+            report.GoroutineDumpFile = ""
+        }
+    }
+
+    jsonReport, err := json.MarshalIndent(report, "", "  ")
+    if err != nil {
+        slog.Error("Unable to write shutdown report", "error", err)
+        return
+    }
+    reportFile := filepath.Join(reporter.dir, "shutdown_" + timestamp + ".json")
+    err = resultfile.Write(reporter.dir, filepath.Base(reportFile), jsonReport)
+    if err != nil {
+        slog.Error("Unable to write shutdown report", "error", err)
+        return
+    }
+    slog.Info("Shutdown report written", "file", reportFile, "running_tests", len(report.InFlightTests), "salvaged", report.Salvaged, "lost", report.Lost)
+}
+
+// Gets the stacks of every goroutine.
+// Returns the stacks, in the same format as an unrecovered panic prints them
+func goroutineStacks() []byte {
+    buffer := make([]byte, 1 << 20)
+    for {
+        n := runtime.Stack(buffer, true)
+        if n < len(buffer) || len(buffer) >= maxGoroutineDumpSize {
+            return buffer[:n]
+        }
+        buffer = make([]byte, 2 * len(buffer))
+    }
+}
@@ -0,0 +1,5 @@
+// The messages and service of the gRPC side channel, generated from proto/sidechannel.proto with
+// protoc, protoc-gen-go, and protoc-gen-go-grpc.
+package sidechannelpb
+
+//go:generate protoc -I ../../proto --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative sidechannel.proto
@@ -0,0 +1,2131 @@
+// The gRPC side channel of the Wehe server, an alternative to the binary side channel protocol. A
+// test is declared with DeclareTest, which returns a token that every other call of the test
+// carries. The replays themselves still run on the replay ports. A call that fails ends the test,
+// and its status code says why: InvalidArgument for a request that couldn't be parsed,
+// ResourceExhausted for one over a limit, NotFound for an unknown test, PermissionDenied for a
+// replay that wasn't allowed, FailedPrecondition for a client that must upgrade or a test that
+// can't be analyzed, Canceled or DeadlineExceeded for a client that went away or ran out of time,
+// and Internal for anything else. Run go generate ./internal/sidechannelpb after changing this file
+// to regenerate the Go code.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.34.2
+// 	protoc        (unknown)
+// source: sidechannel.proto
+
+package sidechannelpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// The type of replay.
+type ReplayType int32
+
+const (
+	ReplayType_ORIGINAL     ReplayType = 0 // the traffic of the app
+	ReplayType_RANDOM       ReplayType = 1 // the traffic of the app with its payloads randomized
+	ReplayType_BIT_INVERTED ReplayType = 2 // the traffic of the app with every payload bit inverted
+	ReplayType_PORT_CHANGED ReplayType = 3 // the traffic of the app sent to a different port than the app uses
+	ReplayType_TUNNELED     ReplayType = 4 // the traffic of the app sent by the client through a VPN tunnel
+)
+
+// Enum value maps for ReplayType.
+var (
+	ReplayType_name = map[int32]string{
+		0: "ORIGINAL",
+		1: "RANDOM",
+		2: "BIT_INVERTED",
+		3: "PORT_CHANGED",
+		4: "TUNNELED",
+	}
+	ReplayType_value = map[string]int32{
+		"ORIGINAL":     0,
+		"RANDOM":       1,
+		"BIT_INVERTED": 2,
+		"PORT_CHANGED": 3,
+		"TUNNELED":     4,
+	}
+)
+
+func (x ReplayType) Enum() *ReplayType {
+	p := new(ReplayType)
+	*p = x
+	return p
+}
+
+func (x ReplayType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ReplayType) Descriptor() protoreflect.EnumDescriptor {
+	return file_sidechannel_proto_enumTypes[0].Descriptor()
+}
+
+func (ReplayType) Type() protoreflect.EnumType {
+	return &file_sidechannel_proto_enumTypes[0]
+}
+
+func (x ReplayType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ReplayType.Descriptor instead.
+func (ReplayType) EnumDescriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{0}
+}
+
+// Why permission to run a replay was denied. The numbers match the failure codes of the binary
+// protocol.
+type Denial int32
+
+const (
+	Denial_DENIAL_UNSPECIFIED      Denial = 0 // permission was granted
+	Denial_UNKNOWN_REPLAY          Denial = 1 // the replay isn't on the server
+	Denial_IP_IN_USE               Denial = 2 // another client on the same IP is running a replay
+	Denial_LOW_RESOURCES           Denial = 3 // the server is busy; try again later
+	Denial_RESOURCE_RETRIEVAL_FAIL Denial = 4 // the server couldn't check its resources; try again later
+	Denial_DUPLICATE_TEST          Denial = 5 // the test was already run and duplicates are rejected
+	Denial_MAINTENANCE             Denial = 6 // the server isn't admitting tests until retry_after_seconds have passed
+	// 7 is the upgrade required denial of the binary protocol, which gRPC clients get as a
+	// FailedPrecondition error instead
+	Denial_SERVER_BUSY Denial = 8 // every replay slot is taken; one is expected to be free in retry_after_seconds
+)
+
+// Enum value maps for Denial.
+var (
+	Denial_name = map[int32]string{
+		0: "DENIAL_UNSPECIFIED",
+		1: "UNKNOWN_REPLAY",
+		2: "IP_IN_USE",
+		3: "LOW_RESOURCES",
+		4: "RESOURCE_RETRIEVAL_FAIL",
+		5: "DUPLICATE_TEST",
+		6: "MAINTENANCE",
+		8: "SERVER_BUSY",
+	}
+	Denial_value = map[string]int32{
+		"DENIAL_UNSPECIFIED":      0,
+		"UNKNOWN_REPLAY":          1,
+		"IP_IN_USE":               2,
+		"LOW_RESOURCES":           3,
+		"RESOURCE_RETRIEVAL_FAIL": 4,
+		"DUPLICATE_TEST":          5,
+		"MAINTENANCE":             6,
+		"SERVER_BUSY":             8,
+	}
+)
+
+func (x Denial) Enum() *Denial {
+	p := new(Denial)
+	*p = x
+	return p
+}
+
+func (x Denial) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Denial) Descriptor() protoreflect.EnumDescriptor {
+	return file_sidechannel_proto_enumTypes[1].Descriptor()
+}
+
+func (Denial) Type() protoreflect.EnumType {
+	return &file_sidechannel_proto_enumTypes[1]
+}
+
+func (x Denial) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Denial.Descriptor instead.
+func (Denial) EnumDescriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{1}
+}
+
+type DeclareTestRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	UserId             string     `protobuf:"bytes,1,opt,name=user_id,json=userId,proto3" json:"user_id,omitempty"`                                                  // the 10 character user ID
+	TestId             int32      `protobuf:"varint,2,opt,name=test_id,json=testId,proto3" json:"test_id,omitempty"`                                                 // the ID of the test for the user
+	ReplayType         ReplayType `protobuf:"varint,3,opt,name=replay_type,json=replayType,proto3,enum=wehe.sidechannel.v1.ReplayType" json:"replay_type,omitempty"` // the type of the first replay
+	ReplayName         string     `protobuf:"bytes,4,opt,name=replay_name,json=replayName,proto3" json:"replay_name,omitempty"`                                      // the name of the first replay
+	IsLastReplay       bool       `protobuf:"varint,5,opt,name=is_last_replay,json=isLastReplay,proto3" json:"is_last_replay,omitempty"`                             // true if the first replay is the only replay of the test
+	ClientVersion      string     `protobuf:"bytes,6,opt,name=client_version,json=clientVersion,proto3" json:"client_version,omitempty"`                             // the version of the client
+	ExtraString        string     `protobuf:"bytes,7,opt,name=extra_string,json=extraString,proto3" json:"extra_string,omitempty"`                                   // extra information; the number of attempts the client made to reach M-Lab
+	TestPortIp         string     `protobuf:"bytes,8,opt,name=test_port_ip,json=testPortIp,proto3" json:"test_port_ip,omitempty"`                                    // the public IP the client has on the replay ports; empty to use the IP of the call
+	MaxDurationSeconds float64    `protobuf:"fixed64,9,opt,name=max_duration_seconds,json=maxDurationSeconds,proto3" json:"max_duration_seconds,omitempty"`          // how long the replay should run for; 0 to run the whole replay
+	WantsReplayToken   bool       `protobuf:"varint,10,opt,name=wants_replay_token,json=wantsReplayToken,proto3" json:"wants_replay_token,omitempty"`                // true if the client starts the first packet on each replay port with a replay token
+	SamplesPerReplay   int32      `protobuf:"varint,11,opt,name=samples_per_replay,json=samplesPerReplay,proto3" json:"samples_per_replay,omitempty"`                // the number of throughput samples the client would like to take during the first replay; 0 to take the number the server picks
+	ExperimentFlags    string     `protobuf:"bytes,12,opt,name=experiment_flags,json=experimentFlags,proto3" json:"experiment_flags,omitempty"`                      // identifies the experiments the client is part of, e.g. A/B flags; written with the results of each replay as sent
+}
+
+func (x *DeclareTestRequest) Reset() {
+	*x = DeclareTestRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DeclareTestRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeclareTestRequest) ProtoMessage() {}
+
+func (x *DeclareTestRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeclareTestRequest.ProtoReflect.Descriptor instead.
+func (*DeclareTestRequest) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *DeclareTestRequest) GetUserId() string {
+	if x != nil {
+		return x.UserId
+	}
+	return ""
+}
+
+func (x *DeclareTestRequest) GetTestId() int32 {
+	if x != nil {
+		return x.TestId
+	}
+	return 0
+}
+
+func (x *DeclareTestRequest) GetReplayType() ReplayType {
+	if x != nil {
+		return x.ReplayType
+	}
+	return ReplayType_ORIGINAL
+}
+
+func (x *DeclareTestRequest) GetReplayName() string {
+	if x != nil {
+		return x.ReplayName
+	}
+	return ""
+}
+
+func (x *DeclareTestRequest) GetIsLastReplay() bool {
+	if x != nil {
+		return x.IsLastReplay
+	}
+	return false
+}
+
+func (x *DeclareTestRequest) GetClientVersion() string {
+	if x != nil {
+		return x.ClientVersion
+	}
+	return ""
+}
+
+func (x *DeclareTestRequest) GetExtraString() string {
+	if x != nil {
+		return x.ExtraString
+	}
+	return ""
+}
+
+func (x *DeclareTestRequest) GetTestPortIp() string {
+	if x != nil {
+		return x.TestPortIp
+	}
+	return ""
+}
+
+func (x *DeclareTestRequest) GetMaxDurationSeconds() float64 {
+	if x != nil {
+		return x.MaxDurationSeconds
+	}
+	return 0
+}
+
+func (x *DeclareTestRequest) GetWantsReplayToken() bool {
+	if x != nil {
+		return x.WantsReplayToken
+	}
+	return false
+}
+
+func (x *DeclareTestRequest) GetSamplesPerReplay() int32 {
+	if x != nil {
+		return x.SamplesPerReplay
+	}
+	return 0
+}
+
+func (x *DeclareTestRequest) GetExperimentFlags() string {
+	if x != nil {
+		return x.ExperimentFlags
+	}
+	return ""
+}
+
+type DeclareTestResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	TestToken   string `protobuf:"bytes,1,opt,name=test_token,json=testToken,proto3" json:"test_token,omitempty"`       // identifies the test in the other calls
+	ReplayToken string `protobuf:"bytes,2,opt,name=replay_token,json=replayToken,proto3" json:"replay_token,omitempty"` // sent after WEHETOKEN: at the start of the first packet on each replay port; set if asked for
+}
+
+func (x *DeclareTestResponse) Reset() {
+	*x = DeclareTestResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DeclareTestResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeclareTestResponse) ProtoMessage() {}
+
+func (x *DeclareTestResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeclareTestResponse.ProtoReflect.Descriptor instead.
+func (*DeclareTestResponse) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *DeclareTestResponse) GetTestToken() string {
+	if x != nil {
+		return x.TestToken
+	}
+	return ""
+}
+
+func (x *DeclareTestResponse) GetReplayToken() string {
+	if x != nil {
+		return x.ReplayToken
+	}
+	return ""
+}
+
+type DeclareReplayRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	TestToken          string     `protobuf:"bytes,1,opt,name=test_token,json=testToken,proto3" json:"test_token,omitempty"`                                         // the token returned by DeclareTest
+	ReplayType         ReplayType `protobuf:"varint,2,opt,name=replay_type,json=replayType,proto3,enum=wehe.sidechannel.v1.ReplayType" json:"replay_type,omitempty"` // the type of the replay
+	ReplayName         string     `protobuf:"bytes,3,opt,name=replay_name,json=replayName,proto3" json:"replay_name,omitempty"`                                      // the name of the replay
+	IsLastReplay       bool       `protobuf:"varint,4,opt,name=is_last_replay,json=isLastReplay,proto3" json:"is_last_replay,omitempty"`                             // true if this is the last replay of the test
+	MaxDurationSeconds float64    `protobuf:"fixed64,5,opt,name=max_duration_seconds,json=maxDurationSeconds,proto3" json:"max_duration_seconds,omitempty"`          // how long the replay should run for; 0 to run the whole replay
+	SamplesPerReplay   int32      `protobuf:"varint,6,opt,name=samples_per_replay,json=samplesPerReplay,proto3" json:"samples_per_replay,omitempty"`                 // the number of throughput samples the client would like to take; 0 to take the number the server picks
+}
+
+func (x *DeclareReplayRequest) Reset() {
+	*x = DeclareReplayRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DeclareReplayRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeclareReplayRequest) ProtoMessage() {}
+
+func (x *DeclareReplayRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeclareReplayRequest.ProtoReflect.Descriptor instead.
+func (*DeclareReplayRequest) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *DeclareReplayRequest) GetTestToken() string {
+	if x != nil {
+		return x.TestToken
+	}
+	return ""
+}
+
+func (x *DeclareReplayRequest) GetReplayType() ReplayType {
+	if x != nil {
+		return x.ReplayType
+	}
+	return ReplayType_ORIGINAL
+}
+
+func (x *DeclareReplayRequest) GetReplayName() string {
+	if x != nil {
+		return x.ReplayName
+	}
+	return ""
+}
+
+func (x *DeclareReplayRequest) GetIsLastReplay() bool {
+	if x != nil {
+		return x.IsLastReplay
+	}
+	return false
+}
+
+func (x *DeclareReplayRequest) GetMaxDurationSeconds() float64 {
+	if x != nil {
+		return x.MaxDurationSeconds
+	}
+	return 0
+}
+
+func (x *DeclareReplayRequest) GetSamplesPerReplay() int32 {
+	if x != nil {
+		return x.SamplesPerReplay
+	}
+	return 0
+}
+
+type DeclareReplayResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Permission *Permission `protobuf:"bytes,1,opt,name=permission,proto3" json:"permission,omitempty"` // denied if the replay isn't on the server
+}
+
+func (x *DeclareReplayResponse) Reset() {
+	*x = DeclareReplayResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DeclareReplayResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeclareReplayResponse) ProtoMessage() {}
+
+func (x *DeclareReplayResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeclareReplayResponse.ProtoReflect.Descriptor instead.
+func (*DeclareReplayResponse) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *DeclareReplayResponse) GetPermission() *Permission {
+	if x != nil {
+		return x.Permission
+	}
+	return nil
+}
+
+type Ask4PermissionRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	TestToken string `protobuf:"bytes,1,opt,name=test_token,json=testToken,proto3" json:"test_token,omitempty"` // the token returned by DeclareTest
+}
+
+func (x *Ask4PermissionRequest) Reset() {
+	*x = Ask4PermissionRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Ask4PermissionRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Ask4PermissionRequest) ProtoMessage() {}
+
+func (x *Ask4PermissionRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Ask4PermissionRequest.ProtoReflect.Descriptor instead.
+func (*Ask4PermissionRequest) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Ask4PermissionRequest) GetTestToken() string {
+	if x != nil {
+		return x.TestToken
+	}
+	return ""
+}
+
+type Ask4PermissionResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Permission *Permission `protobuf:"bytes,1,opt,name=permission,proto3" json:"permission,omitempty"` // whether the replay can run
+}
+
+func (x *Ask4PermissionResponse) Reset() {
+	*x = Ask4PermissionResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Ask4PermissionResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Ask4PermissionResponse) ProtoMessage() {}
+
+func (x *Ask4PermissionResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Ask4PermissionResponse.ProtoReflect.Descriptor instead.
+func (*Ask4PermissionResponse) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Ask4PermissionResponse) GetPermission() *Permission {
+	if x != nil {
+		return x.Permission
+	}
+	return nil
+}
+
+// Whether a replay can run.
+type Permission struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Granted              bool    `protobuf:"varint,1,opt,name=granted,proto3" json:"granted,omitempty"`                                                          // true if the replay can run
+	SamplesPerReplay     int32   `protobuf:"varint,2,opt,name=samples_per_replay,json=samplesPerReplay,proto3" json:"samples_per_replay,omitempty"`              // the number of throughput samples to measure; set if granted
+	ServerTimeUnixNs     int64   `protobuf:"varint,3,opt,name=server_time_unix_ns,json=serverTimeUnixNs,proto3" json:"server_time_unix_ns,omitempty"`            // the time of the server; set if granted by Ask4Permission
+	NsSinceDeclare       int64   `protobuf:"varint,4,opt,name=ns_since_declare,json=nsSinceDeclare,proto3" json:"ns_since_declare,omitempty"`                    // nanoseconds since the test was declared; set if granted by Ask4Permission
+	Denial               Denial  `protobuf:"varint,5,opt,name=denial,proto3,enum=wehe.sidechannel.v1.Denial" json:"denial,omitempty"`                            // why permission was denied; set if not granted
+	RetryAfterSeconds    int32   `protobuf:"varint,6,opt,name=retry_after_seconds,json=retryAfterSeconds,proto3" json:"retry_after_seconds,omitempty"`           // seconds until the server admits tests again; set for MAINTENANCE and SERVER_BUSY
+	ReplayTimeoutSeconds float64 `protobuf:"fixed64,7,opt,name=replay_timeout_seconds,json=replayTimeoutSeconds,proto3" json:"replay_timeout_seconds,omitempty"` // seconds the replay is sent for before it is cut off; set if granted a UDP replay
+}
+
+func (x *Permission) Reset() {
+	*x = Permission{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Permission) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Permission) ProtoMessage() {}
+
+func (x *Permission) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Permission.ProtoReflect.Descriptor instead.
+func (*Permission) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Permission) GetGranted() bool {
+	if x != nil {
+		return x.Granted
+	}
+	return false
+}
+
+func (x *Permission) GetSamplesPerReplay() int32 {
+	if x != nil {
+		return x.SamplesPerReplay
+	}
+	return 0
+}
+
+func (x *Permission) GetServerTimeUnixNs() int64 {
+	if x != nil {
+		return x.ServerTimeUnixNs
+	}
+	return 0
+}
+
+func (x *Permission) GetNsSinceDeclare() int64 {
+	if x != nil {
+		return x.NsSinceDeclare
+	}
+	return 0
+}
+
+func (x *Permission) GetDenial() Denial {
+	if x != nil {
+		return x.Denial
+	}
+	return Denial_DENIAL_UNSPECIFIED
+}
+
+func (x *Permission) GetRetryAfterSeconds() int32 {
+	if x != nil {
+		return x.RetryAfterSeconds
+	}
+	return 0
+}
+
+func (x *Permission) GetReplayTimeoutSeconds() float64 {
+	if x != nil {
+		return x.ReplayTimeoutSeconds
+	}
+	return 0
+}
+
+// Part of the throughputs of a replay. The chunks of a replay are joined in order.
+type ThroughputsChunk struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	TestToken             string    `protobuf:"bytes,1,opt,name=test_token,json=testToken,proto3" json:"test_token,omitempty"`                                         // the token returned by DeclareTest; only read from the first chunk
+	ReplayDurationSeconds float64   `protobuf:"fixed64,2,opt,name=replay_duration_seconds,json=replayDurationSeconds,proto3" json:"replay_duration_seconds,omitempty"` // how long the replay took; only read from the first chunk
+	Throughputs           []float64 `protobuf:"fixed64,3,rep,packed,name=throughputs,proto3" json:"throughputs,omitempty"`                                             // the throughputs, in Mbps
+	SampleTimes           []float64 `protobuf:"fixed64,4,rep,packed,name=sample_times,json=sampleTimes,proto3" json:"sample_times,omitempty"`                          // the seconds since the start of the replay that each throughput was measured
+}
+
+func (x *ThroughputsChunk) Reset() {
+	*x = ThroughputsChunk{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ThroughputsChunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ThroughputsChunk) ProtoMessage() {}
+
+func (x *ThroughputsChunk) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ThroughputsChunk.ProtoReflect.Descriptor instead.
+func (*ThroughputsChunk) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ThroughputsChunk) GetTestToken() string {
+	if x != nil {
+		return x.TestToken
+	}
+	return ""
+}
+
+func (x *ThroughputsChunk) GetReplayDurationSeconds() float64 {
+	if x != nil {
+		return x.ReplayDurationSeconds
+	}
+	return 0
+}
+
+func (x *ThroughputsChunk) GetThroughputs() []float64 {
+	if x != nil {
+		return x.Throughputs
+	}
+	return nil
+}
+
+func (x *ThroughputsChunk) GetSampleTimes() []float64 {
+	if x != nil {
+		return x.SampleTimes
+	}
+	return nil
+}
+
+type SubmitThroughputsResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Aborted      bool     `protobuf:"varint,1,opt,name=aborted,proto3" json:"aborted,omitempty"`                              // true if the replay servers stopped sending the replay because of an error
+	ReplayErrors []string `protobuf:"bytes,2,rep,name=replay_errors,json=replayErrors,proto3" json:"replay_errors,omitempty"` // the errors the replay servers encountered while sending the replay
+}
+
+func (x *SubmitThroughputsResponse) Reset() {
+	*x = SubmitThroughputsResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[8]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SubmitThroughputsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubmitThroughputsResponse) ProtoMessage() {}
+
+func (x *SubmitThroughputsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[8]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubmitThroughputsResponse.ProtoReflect.Descriptor instead.
+func (*SubmitThroughputsResponse) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *SubmitThroughputsResponse) GetAborted() bool {
+	if x != nil {
+		return x.Aborted
+	}
+	return false
+}
+
+func (x *SubmitThroughputsResponse) GetReplayErrors() []string {
+	if x != nil {
+		return x.ReplayErrors
+	}
+	return nil
+}
+
+type AnalyzeTestRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	TestToken string `protobuf:"bytes,1,opt,name=test_token,json=testToken,proto3" json:"test_token,omitempty"` // the token returned by DeclareTest
+}
+
+func (x *AnalyzeTestRequest) Reset() {
+	*x = AnalyzeTestRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[9]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AnalyzeTestRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AnalyzeTestRequest) ProtoMessage() {}
+
+func (x *AnalyzeTestRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[9]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AnalyzeTestRequest.ProtoReflect.Descriptor instead.
+func (*AnalyzeTestRequest) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *AnalyzeTestRequest) GetTestToken() string {
+	if x != nil {
+		return x.TestToken
+	}
+	return ""
+}
+
+type AnalyzeTestUpdate struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Types that are assignable to Update:
+	//	*AnalyzeTestUpdate_State
+	//	*AnalyzeTestUpdate_Result
+	//	*AnalyzeTestUpdate_Summary
+	Update isAnalyzeTestUpdate_Update `protobuf_oneof:"update"`
+}
+
+func (x *AnalyzeTestUpdate) Reset() {
+	*x = AnalyzeTestUpdate{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[10]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AnalyzeTestUpdate) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AnalyzeTestUpdate) ProtoMessage() {}
+
+func (x *AnalyzeTestUpdate) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[10]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AnalyzeTestUpdate.ProtoReflect.Descriptor instead.
+func (*AnalyzeTestUpdate) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{10}
+}
+
+func (m *AnalyzeTestUpdate) GetUpdate() isAnalyzeTestUpdate_Update {
+	if m != nil {
+		return m.Update
+	}
+	return nil
+}
+
+func (x *AnalyzeTestUpdate) GetState() string {
+	if x, ok := x.GetUpdate().(*AnalyzeTestUpdate_State); ok {
+		return x.State
+	}
+	return ""
+}
+
+func (x *AnalyzeTestUpdate) GetResult() *AnalysisResult {
+	if x, ok := x.GetUpdate().(*AnalyzeTestUpdate_Result); ok {
+		return x.Result
+	}
+	return nil
+}
+
+func (x *AnalyzeTestUpdate) GetSummary() *TestSummary {
+	if x, ok := x.GetUpdate().(*AnalyzeTestUpdate_Summary); ok {
+		return x.Summary
+	}
+	return nil
+}
+
+type isAnalyzeTestUpdate_Update interface {
+	isAnalyzeTestUpdate_Update()
+}
+
+type AnalyzeTestUpdate_State struct {
+	State string `protobuf:"bytes,1,opt,name=state,proto3,oneof"` // what the server is doing, e.g. analyzing
+}
+
+type AnalyzeTestUpdate_Result struct {
+	Result *AnalysisResult `protobuf:"bytes,2,opt,name=result,proto3,oneof"` // the result
+}
+
+type AnalyzeTestUpdate_Summary struct {
+	Summary *TestSummary `protobuf:"bytes,3,opt,name=summary,proto3,oneof"` // what was stored for the test, sent last once the test has ended
+}
+
+func (*AnalyzeTestUpdate_State) isAnalyzeTestUpdate_Update() {}
+
+func (*AnalyzeTestUpdate_Result) isAnalyzeTestUpdate_Update() {}
+
+func (*AnalyzeTestUpdate_Summary) isAnalyzeTestUpdate_Update() {}
+
+type EndTestRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	TestToken string `protobuf:"bytes,1,opt,name=test_token,json=testToken,proto3" json:"test_token,omitempty"` // the token returned by DeclareTest
+}
+
+func (x *EndTestRequest) Reset() {
+	*x = EndTestRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[11]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *EndTestRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EndTestRequest) ProtoMessage() {}
+
+func (x *EndTestRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[11]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EndTestRequest.ProtoReflect.Descriptor instead.
+func (*EndTestRequest) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *EndTestRequest) GetTestToken() string {
+	if x != nil {
+		return x.TestToken
+	}
+	return ""
+}
+
+// What the server stored for a test that has ended.
+type TestSummary struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	TestRef  string `protobuf:"bytes,1,opt,name=test_ref,json=testRef,proto3" json:"test_ref,omitempty"` // the path of the manifest of the test in the results; empty if it couldn't be written
+	Files    int32  `protobuf:"varint,2,opt,name=files,proto3" json:"files,omitempty"`                   // number of result files stored for the test
+	Replays  int32  `protobuf:"varint,3,opt,name=replays,proto3" json:"replays,omitempty"`               // number of replays the test declared
+	Analyzed bool   `protobuf:"varint,4,opt,name=analyzed,proto3" json:"analyzed,omitempty"`             // true if the test was analyzed
+	Verdict  string `protobuf:"bytes,5,opt,name=verdict,proto3" json:"verdict,omitempty"`                // the verdict of the analysis; empty if the test wasn't analyzed
+}
+
+func (x *TestSummary) Reset() {
+	*x = TestSummary{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[12]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *TestSummary) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TestSummary) ProtoMessage() {}
+
+func (x *TestSummary) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[12]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TestSummary.ProtoReflect.Descriptor instead.
+func (*TestSummary) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *TestSummary) GetTestRef() string {
+	if x != nil {
+		return x.TestRef
+	}
+	return ""
+}
+
+func (x *TestSummary) GetFiles() int32 {
+	if x != nil {
+		return x.Files
+	}
+	return 0
+}
+
+func (x *TestSummary) GetReplays() int32 {
+	if x != nil {
+		return x.Replays
+	}
+	return 0
+}
+
+func (x *TestSummary) GetAnalyzed() bool {
+	if x != nil {
+		return x.Analyzed
+	}
+	return false
+}
+
+func (x *TestSummary) GetVerdict() string {
+	if x != nil {
+		return x.Verdict
+	}
+	return ""
+}
+
+// The result of the 2-sample K-S test of a test.
+type AnalysisResult struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Area0Var              float64          `protobuf:"fixed64,1,opt,name=area0var,proto3" json:"area0var,omitempty"`
+	Ks2PVal               float64          `protobuf:"fixed64,2,opt,name=ks2_p_val,json=ks2PVal,proto3" json:"ks2_p_val,omitempty"`
+	OriginalAvgThroughput float64          `protobuf:"fixed64,3,opt,name=original_avg_throughput,json=originalAvgThroughput,proto3" json:"original_avg_throughput,omitempty"`
+	RandomAvgThroughput   float64          `protobuf:"fixed64,4,opt,name=random_avg_throughput,json=randomAvgThroughput,proto3" json:"random_avg_throughput,omitempty"`
+	Differentiation       bool             `protobuf:"varint,5,opt,name=differentiation,proto3" json:"differentiation,omitempty"`
+	Policy                string           `protobuf:"bytes,6,opt,name=policy,proto3" json:"policy,omitempty"`             // the name of the decision policy that decided the result
+	Verdict               *Verdict         `protobuf:"bytes,7,opt,name=verdict,proto3" json:"verdict,omitempty"`           // the checks of the policy that the decision was made from
+	Variants              []*VariantResult `protobuf:"bytes,8,rep,name=variants,proto3" json:"variants,omitempty"`         // the control replays of the test compared against the original replay
+	Localization          *Localization    `protobuf:"bytes,9,opt,name=localization,proto3" json:"localization,omitempty"` // whether the packets the server retransmitted point to throttling or congestion; unset if they weren't captured
+}
+
+func (x *AnalysisResult) Reset() {
+	*x = AnalysisResult{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[13]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AnalysisResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AnalysisResult) ProtoMessage() {}
+
+func (x *AnalysisResult) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[13]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AnalysisResult.ProtoReflect.Descriptor instead.
+func (*AnalysisResult) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *AnalysisResult) GetArea0Var() float64 {
+	if x != nil {
+		return x.Area0Var
+	}
+	return 0
+}
+
+func (x *AnalysisResult) GetKs2PVal() float64 {
+	if x != nil {
+		return x.Ks2PVal
+	}
+	return 0
+}
+
+func (x *AnalysisResult) GetOriginalAvgThroughput() float64 {
+	if x != nil {
+		return x.OriginalAvgThroughput
+	}
+	return 0
+}
+
+func (x *AnalysisResult) GetRandomAvgThroughput() float64 {
+	if x != nil {
+		return x.RandomAvgThroughput
+	}
+	return 0
+}
+
+func (x *AnalysisResult) GetDifferentiation() bool {
+	if x != nil {
+		return x.Differentiation
+	}
+	return false
+}
+
+func (x *AnalysisResult) GetPolicy() string {
+	if x != nil {
+		return x.Policy
+	}
+	return ""
+}
+
+func (x *AnalysisResult) GetVerdict() *Verdict {
+	if x != nil {
+		return x.Verdict
+	}
+	return nil
+}
+
+func (x *AnalysisResult) GetVariants() []*VariantResult {
+	if x != nil {
+		return x.Variants
+	}
+	return nil
+}
+
+func (x *AnalysisResult) GetLocalization() *Localization {
+	if x != nil {
+		return x.Localization
+	}
+	return nil
+}
+
+// The comparison of the TCP packets the server retransmitted during the original and random replays.
+// The original replay losing more packets points to throttling; both replays losing packets alike
+// points to congestion.
+type Localization struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Result  string      `protobuf:"bytes,1,opt,name=result,proto3" json:"result,omitempty"`   // throttling, congestion, or none
+	Overall *PortLoss   `protobuf:"bytes,2,opt,name=overall,proto3" json:"overall,omitempty"` // all ports together; port is 0
+	Ports   []*PortLoss `protobuf:"bytes,3,rep,name=ports,proto3" json:"ports,omitempty"`     // each server port of the replays
+}
+
+func (x *Localization) Reset() {
+	*x = Localization{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[14]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Localization) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Localization) ProtoMessage() {}
+
+func (x *Localization) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[14]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Localization.ProtoReflect.Descriptor instead.
+func (*Localization) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *Localization) GetResult() string {
+	if x != nil {
+		return x.Result
+	}
+	return ""
+}
+
+func (x *Localization) GetOverall() *PortLoss {
+	if x != nil {
+		return x.Overall
+	}
+	return nil
+}
+
+func (x *Localization) GetPorts() []*PortLoss {
+	if x != nil {
+		return x.Ports
+	}
+	return nil
+}
+
+type PortLoss struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Port             int32   `protobuf:"varint,1,opt,name=port,proto3" json:"port,omitempty"`
+	OriginalLossRate float64 `protobuf:"fixed64,2,opt,name=original_loss_rate,json=originalLossRate,proto3" json:"original_loss_rate,omitempty"` // fraction of the packets of the original replay that were retransmitted
+	RandomLossRate   float64 `protobuf:"fixed64,3,opt,name=random_loss_rate,json=randomLossRate,proto3" json:"random_loss_rate,omitempty"`       // fraction of the packets of the random replay that were retransmitted
+	LossDiff         float64 `protobuf:"fixed64,4,opt,name=loss_diff,json=lossDiff,proto3" json:"loss_diff,omitempty"`                           // (original loss rate - random loss rate) / larger loss rate
+	PVal             float64 `protobuf:"fixed64,5,opt,name=p_val,json=pVal,proto3" json:"p_val,omitempty"`                                       // p-value of the one-sided test that the original replay lost more packets
+	Differentiation  bool    `protobuf:"varint,6,opt,name=differentiation,proto3" json:"differentiation,omitempty"`
+	OriginalRttMs    float64 `protobuf:"fixed64,7,opt,name=original_rtt_ms,json=originalRttMs,proto3" json:"original_rtt_ms,omitempty"`
+	RandomRttMs      float64 `protobuf:"fixed64,8,opt,name=random_rtt_ms,json=randomRttMs,proto3" json:"random_rtt_ms,omitempty"`
+}
+
+func (x *PortLoss) Reset() {
+	*x = PortLoss{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[15]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PortLoss) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PortLoss) ProtoMessage() {}
+
+func (x *PortLoss) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[15]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PortLoss.ProtoReflect.Descriptor instead.
+func (*PortLoss) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *PortLoss) GetPort() int32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *PortLoss) GetOriginalLossRate() float64 {
+	if x != nil {
+		return x.OriginalLossRate
+	}
+	return 0
+}
+
+func (x *PortLoss) GetRandomLossRate() float64 {
+	if x != nil {
+		return x.RandomLossRate
+	}
+	return 0
+}
+
+func (x *PortLoss) GetLossDiff() float64 {
+	if x != nil {
+		return x.LossDiff
+	}
+	return 0
+}
+
+func (x *PortLoss) GetPVal() float64 {
+	if x != nil {
+		return x.PVal
+	}
+	return 0
+}
+
+func (x *PortLoss) GetDifferentiation() bool {
+	if x != nil {
+		return x.Differentiation
+	}
+	return false
+}
+
+func (x *PortLoss) GetOriginalRttMs() float64 {
+	if x != nil {
+		return x.OriginalRttMs
+	}
+	return 0
+}
+
+func (x *PortLoss) GetRandomRttMs() float64 {
+	if x != nil {
+		return x.RandomRttMs
+	}
+	return 0
+}
+
+// The comparison of a control replay, such as a bit-inverted replay, against the original replay. A
+// control that is treated differently from the original replay shows that the network classifies
+// traffic by what the control changed.
+type VariantResult struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ReplayType            ReplayType `protobuf:"varint,1,opt,name=replay_type,json=replayType,proto3,enum=wehe.sidechannel.v1.ReplayType" json:"replay_type,omitempty"`
+	ReplayName            string     `protobuf:"bytes,2,opt,name=replay_name,json=replayName,proto3" json:"replay_name,omitempty"`
+	Differentiation       bool       `protobuf:"varint,3,opt,name=differentiation,proto3" json:"differentiation,omitempty"` // true if the control was treated differently from the original replay
+	Area0Var              float64    `protobuf:"fixed64,4,opt,name=area0var,proto3" json:"area0var,omitempty"`
+	Ks2PVal               float64    `protobuf:"fixed64,5,opt,name=ks2_p_val,json=ks2PVal,proto3" json:"ks2_p_val,omitempty"`
+	OriginalAvgThroughput float64    `protobuf:"fixed64,6,opt,name=original_avg_throughput,json=originalAvgThroughput,proto3" json:"original_avg_throughput,omitempty"`
+	VariantAvgThroughput  float64    `protobuf:"fixed64,7,opt,name=variant_avg_throughput,json=variantAvgThroughput,proto3" json:"variant_avg_throughput,omitempty"`
+}
+
+func (x *VariantResult) Reset() {
+	*x = VariantResult{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[16]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *VariantResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VariantResult) ProtoMessage() {}
+
+func (x *VariantResult) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[16]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VariantResult.ProtoReflect.Descriptor instead.
+func (*VariantResult) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *VariantResult) GetReplayType() ReplayType {
+	if x != nil {
+		return x.ReplayType
+	}
+	return ReplayType_ORIGINAL
+}
+
+func (x *VariantResult) GetReplayName() string {
+	if x != nil {
+		return x.ReplayName
+	}
+	return ""
+}
+
+func (x *VariantResult) GetDifferentiation() bool {
+	if x != nil {
+		return x.Differentiation
+	}
+	return false
+}
+
+func (x *VariantResult) GetArea0Var() float64 {
+	if x != nil {
+		return x.Area0Var
+	}
+	return 0
+}
+
+func (x *VariantResult) GetKs2PVal() float64 {
+	if x != nil {
+		return x.Ks2PVal
+	}
+	return 0
+}
+
+func (x *VariantResult) GetOriginalAvgThroughput() float64 {
+	if x != nil {
+		return x.OriginalAvgThroughput
+	}
+	return 0
+}
+
+func (x *VariantResult) GetVariantAvgThroughput() float64 {
+	if x != nil {
+		return x.VariantAvgThroughput
+	}
+	return 0
+}
+
+// How the decision policy reached its decision: which of its thresholds were crossed, and the
+// verdict that combined them.
+type Verdict struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Name                  string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"` // the verdict of the policy, e.g. all or ks
+	AreaAboveThreshold    bool   `protobuf:"varint,2,opt,name=area_above_threshold,json=areaAboveThreshold,proto3" json:"area_above_threshold,omitempty"`
+	Ks2PValBelowThreshold bool   `protobuf:"varint,3,opt,name=ks2_p_val_below_threshold,json=ks2PValBelowThreshold,proto3" json:"ks2_p_val_below_threshold,omitempty"`
+	AcceptRatioMet        bool   `protobuf:"varint,4,opt,name=accept_ratio_met,json=acceptRatioMet,proto3" json:"accept_ratio_met,omitempty"`
+	Inconclusive          bool   `protobuf:"varint,5,opt,name=inconclusive,proto3" json:"inconclusive,omitempty"` // true if a replay had too few throughput samples to decide; differentiation is then false
+}
+
+func (x *Verdict) Reset() {
+	*x = Verdict{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sidechannel_proto_msgTypes[17]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Verdict) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Verdict) ProtoMessage() {}
+
+func (x *Verdict) ProtoReflect() protoreflect.Message {
+	mi := &file_sidechannel_proto_msgTypes[17]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Verdict.ProtoReflect.Descriptor instead.
+func (*Verdict) Descriptor() ([]byte, []int) {
+	return file_sidechannel_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *Verdict) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Verdict) GetAreaAboveThreshold() bool {
+	if x != nil {
+		return x.AreaAboveThreshold
+	}
+	return false
+}
+
+func (x *Verdict) GetKs2PValBelowThreshold() bool {
+	if x != nil {
+		return x.Ks2PValBelowThreshold
+	}
+	return false
+}
+
+func (x *Verdict) GetAcceptRatioMet() bool {
+	if x != nil {
+		return x.AcceptRatioMet
+	}
+	return false
+}
+
+func (x *Verdict) GetInconclusive() bool {
+	if x != nil {
+		return x.Inconclusive
+	}
+	return false
+}
+
+var File_sidechannel_proto protoreflect.FileDescriptor
+
+var file_sidechannel_proto_rawDesc = []byte{
+	0x0a, 0x11, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x12, 0x13, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68,
+	0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x22, 0xf4, 0x03, 0x0a, 0x12, 0x44, 0x65, 0x63,
+	0x6c, 0x61, 0x72, 0x65, 0x54, 0x65, 0x73, 0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x17, 0x0a, 0x07, 0x75, 0x73, 0x65, 0x72, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x06, 0x75, 0x73, 0x65, 0x72, 0x49, 0x64, 0x12, 0x17, 0x0a, 0x07, 0x74, 0x65, 0x73, 0x74,
+	0x5f, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x06, 0x74, 0x65, 0x73, 0x74, 0x49,
+	0x64, 0x12, 0x40, 0x0a, 0x0b, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x5f, 0x74, 0x79, 0x70, 0x65,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1f, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69,
+	0x64, 0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x52, 0x65, 0x70,
+	0x6c, 0x61, 0x79, 0x54, 0x79, 0x70, 0x65, 0x52, 0x0a, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x54,
+	0x79, 0x70, 0x65, 0x12, 0x1f, 0x0a, 0x0b, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x5f, 0x6e, 0x61,
+	0x6d, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79,
+	0x4e, 0x61, 0x6d, 0x65, 0x12, 0x24, 0x0a, 0x0e, 0x69, 0x73, 0x5f, 0x6c, 0x61, 0x73, 0x74, 0x5f,
+	0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x18, 0x05, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0c, 0x69, 0x73,
+	0x4c, 0x61, 0x73, 0x74, 0x52, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x12, 0x25, 0x0a, 0x0e, 0x63, 0x6c,
+	0x69, 0x65, 0x6e, 0x74, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x06, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x0d, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f,
+	0x6e, 0x12, 0x21, 0x0a, 0x0c, 0x65, 0x78, 0x74, 0x72, 0x61, 0x5f, 0x73, 0x74, 0x72, 0x69, 0x6e,
+	0x67, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x65, 0x78, 0x74, 0x72, 0x61, 0x53, 0x74,
+	0x72, 0x69, 0x6e, 0x67, 0x12, 0x20, 0x0a, 0x0c, 0x74, 0x65, 0x73, 0x74, 0x5f, 0x70, 0x6f, 0x72,
+	0x74, 0x5f, 0x69, 0x70, 0x18, 0x08, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x74, 0x65, 0x73, 0x74,
+	0x50, 0x6f, 0x72, 0x74, 0x49, 0x70, 0x12, 0x30, 0x0a, 0x14, 0x6d, 0x61, 0x78, 0x5f, 0x64, 0x75,
+	0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x73, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x18, 0x09,
+	0x20, 0x01, 0x28, 0x01, 0x52, 0x12, 0x6d, 0x61, 0x78, 0x44, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x53, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x12, 0x2c, 0x0a, 0x12, 0x77, 0x61, 0x6e, 0x74,
+	0x73, 0x5f, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x5f, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x18, 0x0a,
+	0x20, 0x01, 0x28, 0x08, 0x52, 0x10, 0x77, 0x61, 0x6e, 0x74, 0x73, 0x52, 0x65, 0x70, 0x6c, 0x61,
+	0x79, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x12, 0x2c, 0x0a, 0x12, 0x73, 0x61, 0x6d, 0x70, 0x6c, 0x65,
+	0x73, 0x5f, 0x70, 0x65, 0x72, 0x5f, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x18, 0x0b, 0x20, 0x01,
+	0x28, 0x05, 0x52, 0x10, 0x73, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x73, 0x50, 0x65, 0x72, 0x52, 0x65,
+	0x70, 0x6c, 0x61, 0x79, 0x12, 0x29, 0x0a, 0x10, 0x65, 0x78, 0x70, 0x65, 0x72, 0x69, 0x6d, 0x65,
+	0x6e, 0x74, 0x5f, 0x66, 0x6c, 0x61, 0x67, 0x73, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0f,
+	0x65, 0x78, 0x70, 0x65, 0x72, 0x69, 0x6d, 0x65, 0x6e, 0x74, 0x46, 0x6c, 0x61, 0x67, 0x73, 0x22,
+	0x57, 0x0a, 0x13, 0x44, 0x65, 0x63, 0x6c, 0x61, 0x72, 0x65, 0x54, 0x65, 0x73, 0x74, 0x52, 0x65,
+	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x1d, 0x0a, 0x0a, 0x74, 0x65, 0x73, 0x74, 0x5f, 0x74,
+	0x6f, 0x6b, 0x65, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x74, 0x65, 0x73, 0x74,
+	0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x12, 0x21, 0x0a, 0x0c, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x5f,
+	0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x72, 0x65, 0x70,
+	0x6c, 0x61, 0x79, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x22, 0x9e, 0x02, 0x0a, 0x14, 0x44, 0x65, 0x63,
+	0x6c, 0x61, 0x72, 0x65, 0x52, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x12, 0x1d, 0x0a, 0x0a, 0x74, 0x65, 0x73, 0x74, 0x5f, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x74, 0x65, 0x73, 0x74, 0x54, 0x6f, 0x6b, 0x65, 0x6e,
+	0x12, 0x40, 0x0a, 0x0b, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x5f, 0x74, 0x79, 0x70, 0x65, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1f, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64,
+	0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x52, 0x65, 0x70, 0x6c,
+	0x61, 0x79, 0x54, 0x79, 0x70, 0x65, 0x52, 0x0a, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x54, 0x79,
+	0x70, 0x65, 0x12, 0x1f, 0x0a, 0x0b, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x5f, 0x6e, 0x61, 0x6d,
+	0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x4e,
+	0x61, 0x6d, 0x65, 0x12, 0x24, 0x0a, 0x0e, 0x69, 0x73, 0x5f, 0x6c, 0x61, 0x73, 0x74, 0x5f, 0x72,
+	0x65, 0x70, 0x6c, 0x61, 0x79, 0x18, 0x04, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0c, 0x69, 0x73, 0x4c,
+	0x61, 0x73, 0x74, 0x52, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x12, 0x30, 0x0a, 0x14, 0x6d, 0x61, 0x78,
+	0x5f, 0x64, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x73, 0x65, 0x63, 0x6f, 0x6e, 0x64,
+	0x73, 0x18, 0x05, 0x20, 0x01, 0x28, 0x01, 0x52, 0x12, 0x6d, 0x61, 0x78, 0x44, 0x75, 0x72, 0x61,
+	0x74, 0x69, 0x6f, 0x6e, 0x53, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x12, 0x2c, 0x0a, 0x12, 0x73,
+	0x61, 0x6d, 0x70, 0x6c, 0x65, 0x73, 0x5f, 0x70, 0x65, 0x72, 0x5f, 0x72, 0x65, 0x70, 0x6c, 0x61,
+	0x79, 0x18, 0x06, 0x20, 0x01, 0x28, 0x05, 0x52, 0x10, 0x73, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x73,
+	0x50, 0x65, 0x72, 0x52, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x22, 0x58, 0x0a, 0x15, 0x44, 0x65, 0x63,
+	0x6c, 0x61, 0x72, 0x65, 0x52, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
+	0x73, 0x65, 0x12, 0x3f, 0x0a, 0x0a, 0x70, 0x65, 0x72, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1f, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69,
+	0x64, 0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x65, 0x72,
+	0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x0a, 0x70, 0x65, 0x72, 0x6d, 0x69, 0x73, 0x73,
+	0x69, 0x6f, 0x6e, 0x22, 0x36, 0x0a, 0x15, 0x41, 0x73, 0x6b, 0x34, 0x50, 0x65, 0x72, 0x6d, 0x69,
+	0x73, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1d, 0x0a, 0x0a,
+	0x74, 0x65, 0x73, 0x74, 0x5f, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x09, 0x74, 0x65, 0x73, 0x74, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x22, 0x59, 0x0a, 0x16, 0x41,
+	0x73, 0x6b, 0x34, 0x50, 0x65, 0x72, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x65, 0x73,
+	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x3f, 0x0a, 0x0a, 0x70, 0x65, 0x72, 0x6d, 0x69, 0x73, 0x73,
+	0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1f, 0x2e, 0x77, 0x65, 0x68, 0x65,
+	0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e,
+	0x50, 0x65, 0x72, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x0a, 0x70, 0x65, 0x72, 0x6d,
+	0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0xc8, 0x02, 0x0a, 0x0a, 0x50, 0x65, 0x72, 0x6d, 0x69,
+	0x73, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x18, 0x0a, 0x07, 0x67, 0x72, 0x61, 0x6e, 0x74, 0x65, 0x64,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x67, 0x72, 0x61, 0x6e, 0x74, 0x65, 0x64, 0x12,
+	0x2c, 0x0a, 0x12, 0x73, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x73, 0x5f, 0x70, 0x65, 0x72, 0x5f, 0x72,
+	0x65, 0x70, 0x6c, 0x61, 0x79, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x10, 0x73, 0x61, 0x6d,
+	0x70, 0x6c, 0x65, 0x73, 0x50, 0x65, 0x72, 0x52, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x12, 0x2d, 0x0a,
+	0x13, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x5f, 0x75, 0x6e, 0x69,
+	0x78, 0x5f, 0x6e, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x10, 0x73, 0x65, 0x72, 0x76,
+	0x65, 0x72, 0x54, 0x69, 0x6d, 0x65, 0x55, 0x6e, 0x69, 0x78, 0x4e, 0x73, 0x12, 0x28, 0x0a, 0x10,
+	0x6e, 0x73, 0x5f, 0x73, 0x69, 0x6e, 0x63, 0x65, 0x5f, 0x64, 0x65, 0x63, 0x6c, 0x61, 0x72, 0x65,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0e, 0x6e, 0x73, 0x53, 0x69, 0x6e, 0x63, 0x65, 0x44,
+	0x65, 0x63, 0x6c, 0x61, 0x72, 0x65, 0x12, 0x33, 0x0a, 0x06, 0x64, 0x65, 0x6e, 0x69, 0x61, 0x6c,
+	0x18, 0x05, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1b, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69,
+	0x64, 0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x44, 0x65, 0x6e,
+	0x69, 0x61, 0x6c, 0x52, 0x06, 0x64, 0x65, 0x6e, 0x69, 0x61, 0x6c, 0x12, 0x2e, 0x0a, 0x13, 0x72,
+	0x65, 0x74, 0x72, 0x79, 0x5f, 0x61, 0x66, 0x74, 0x65, 0x72, 0x5f, 0x73, 0x65, 0x63, 0x6f, 0x6e,
+	0x64, 0x73, 0x18, 0x06, 0x20, 0x01, 0x28, 0x05, 0x52, 0x11, 0x72, 0x65, 0x74, 0x72, 0x79, 0x41,
+	0x66, 0x74, 0x65, 0x72, 0x53, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x12, 0x34, 0x0a, 0x16, 0x72,
+	0x65, 0x70, 0x6c, 0x61, 0x79, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x6f, 0x75, 0x74, 0x5f, 0x73, 0x65,
+	0x63, 0x6f, 0x6e, 0x64, 0x73, 0x18, 0x07, 0x20, 0x01, 0x28, 0x01, 0x52, 0x14, 0x72, 0x65, 0x70,
+	0x6c, 0x61, 0x79, 0x54, 0x69, 0x6d, 0x65, 0x6f, 0x75, 0x74, 0x53, 0x65, 0x63, 0x6f, 0x6e, 0x64,
+	0x73, 0x22, 0xae, 0x01, 0x0a, 0x10, 0x54, 0x68, 0x72, 0x6f, 0x75, 0x67, 0x68, 0x70, 0x75, 0x74,
+	0x73, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x12, 0x1d, 0x0a, 0x0a, 0x74, 0x65, 0x73, 0x74, 0x5f, 0x74,
+	0x6f, 0x6b, 0x65, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x74, 0x65, 0x73, 0x74,
+	0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x12, 0x36, 0x0a, 0x17, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x5f,
+	0x64, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x73, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x01, 0x52, 0x15, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x44, 0x75,
+	0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x53, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x12, 0x20, 0x0a,
+	0x0b, 0x74, 0x68, 0x72, 0x6f, 0x75, 0x67, 0x68, 0x70, 0x75, 0x74, 0x73, 0x18, 0x03, 0x20, 0x03,
+	0x28, 0x01, 0x52, 0x0b, 0x74, 0x68, 0x72, 0x6f, 0x75, 0x67, 0x68, 0x70, 0x75, 0x74, 0x73, 0x12,
+	0x21, 0x0a, 0x0c, 0x73, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x18,
+	0x04, 0x20, 0x03, 0x28, 0x01, 0x52, 0x0b, 0x73, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x54, 0x69, 0x6d,
+	0x65, 0x73, 0x22, 0x5a, 0x0a, 0x19, 0x53, 0x75, 0x62, 0x6d, 0x69, 0x74, 0x54, 0x68, 0x72, 0x6f,
+	0x75, 0x67, 0x68, 0x70, 0x75, 0x74, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12,
+	0x18, 0x0a, 0x07, 0x61, 0x62, 0x6f, 0x72, 0x74, 0x65, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x08,
+	0x52, 0x07, 0x61, 0x62, 0x6f, 0x72, 0x74, 0x65, 0x64, 0x12, 0x23, 0x0a, 0x0d, 0x72, 0x65, 0x70,
+	0x6c, 0x61, 0x79, 0x5f, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09,
+	0x52, 0x0c, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x73, 0x22, 0x33,
+	0x0a, 0x12, 0x41, 0x6e, 0x61, 0x6c, 0x79, 0x7a, 0x65, 0x54, 0x65, 0x73, 0x74, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x12, 0x1d, 0x0a, 0x0a, 0x74, 0x65, 0x73, 0x74, 0x5f, 0x74, 0x6f, 0x6b,
+	0x65, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x74, 0x65, 0x73, 0x74, 0x54, 0x6f,
+	0x6b, 0x65, 0x6e, 0x22, 0xb2, 0x01, 0x0a, 0x11, 0x41, 0x6e, 0x61, 0x6c, 0x79, 0x7a, 0x65, 0x54,
+	0x65, 0x73, 0x74, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x12, 0x16, 0x0a, 0x05, 0x73, 0x74, 0x61,
+	0x74, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x48, 0x00, 0x52, 0x05, 0x73, 0x74, 0x61, 0x74,
+	0x65, 0x12, 0x3d, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x23, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68, 0x61,
+	0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x41, 0x6e, 0x61, 0x6c, 0x79, 0x73, 0x69, 0x73,
+	0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x48, 0x00, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74,
+	0x12, 0x3c, 0x0a, 0x07, 0x73, 0x75, 0x6d, 0x6d, 0x61, 0x72, 0x79, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x20, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68, 0x61,
+	0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x54, 0x65, 0x73, 0x74, 0x53, 0x75, 0x6d, 0x6d,
+	0x61, 0x72, 0x79, 0x48, 0x00, 0x52, 0x07, 0x73, 0x75, 0x6d, 0x6d, 0x61, 0x72, 0x79, 0x42, 0x08,
+	0x0a, 0x06, 0x75, 0x70, 0x64, 0x61, 0x74, 0x65, 0x22, 0x2f, 0x0a, 0x0e, 0x45, 0x6e, 0x64, 0x54,
+	0x65, 0x73, 0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1d, 0x0a, 0x0a, 0x74, 0x65,
+	0x73, 0x74, 0x5f, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09,
+	0x74, 0x65, 0x73, 0x74, 0x54, 0x6f, 0x6b, 0x65, 0x6e, 0x22, 0x8e, 0x01, 0x0a, 0x0b, 0x54, 0x65,
+	0x73, 0x74, 0x53, 0x75, 0x6d, 0x6d, 0x61, 0x72, 0x79, 0x12, 0x19, 0x0a, 0x08, 0x74, 0x65, 0x73,
+	0x74, 0x5f, 0x72, 0x65, 0x66, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x74, 0x65, 0x73,
+	0x74, 0x52, 0x65, 0x66, 0x12, 0x14, 0x0a, 0x05, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x05, 0x52, 0x05, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x12, 0x18, 0x0a, 0x07, 0x72, 0x65,
+	0x70, 0x6c, 0x61, 0x79, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x07, 0x72, 0x65, 0x70,
+	0x6c, 0x61, 0x79, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x61, 0x6e, 0x61, 0x6c, 0x79, 0x7a, 0x65, 0x64,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x61, 0x6e, 0x61, 0x6c, 0x79, 0x7a, 0x65, 0x64,
+	0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x64, 0x69, 0x63, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x07, 0x76, 0x65, 0x72, 0x64, 0x69, 0x63, 0x74, 0x22, 0xb5, 0x03, 0x0a, 0x0e, 0x41,
+	0x6e, 0x61, 0x6c, 0x79, 0x73, 0x69, 0x73, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x1a, 0x0a,
+	0x08, 0x61, 0x72, 0x65, 0x61, 0x30, 0x76, 0x61, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x01, 0x52,
+	0x08, 0x61, 0x72, 0x65, 0x61, 0x30, 0x76, 0x61, 0x72, 0x12, 0x1a, 0x0a, 0x09, 0x6b, 0x73, 0x32,
+	0x5f, 0x70, 0x5f, 0x76, 0x61, 0x6c, 0x18, 0x02, 0x20, 0x01, 0x28, 0x01, 0x52, 0x07, 0x6b, 0x73,
+	0x32, 0x50, 0x56, 0x61, 0x6c, 0x12, 0x36, 0x0a, 0x17, 0x6f, 0x72, 0x69, 0x67, 0x69, 0x6e, 0x61,
+	0x6c, 0x5f, 0x61, 0x76, 0x67, 0x5f, 0x74, 0x68, 0x72, 0x6f, 0x75, 0x67, 0x68, 0x70, 0x75, 0x74,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x01, 0x52, 0x15, 0x6f, 0x72, 0x69, 0x67, 0x69, 0x6e, 0x61, 0x6c,
+	0x41, 0x76, 0x67, 0x54, 0x68, 0x72, 0x6f, 0x75, 0x67, 0x68, 0x70, 0x75, 0x74, 0x12, 0x32, 0x0a,
+	0x15, 0x72, 0x61, 0x6e, 0x64, 0x6f, 0x6d, 0x5f, 0x61, 0x76, 0x67, 0x5f, 0x74, 0x68, 0x72, 0x6f,
+	0x75, 0x67, 0x68, 0x70, 0x75, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x01, 0x52, 0x13, 0x72, 0x61,
+	0x6e, 0x64, 0x6f, 0x6d, 0x41, 0x76, 0x67, 0x54, 0x68, 0x72, 0x6f, 0x75, 0x67, 0x68, 0x70, 0x75,
+	0x74, 0x12, 0x28, 0x0a, 0x0f, 0x64, 0x69, 0x66, 0x66, 0x65, 0x72, 0x65, 0x6e, 0x74, 0x69, 0x61,
+	0x74, 0x69, 0x6f, 0x6e, 0x18, 0x05, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0f, 0x64, 0x69, 0x66, 0x66,
+	0x65, 0x72, 0x65, 0x6e, 0x74, 0x69, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x16, 0x0a, 0x06, 0x70,
+	0x6f, 0x6c, 0x69, 0x63, 0x79, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x70, 0x6f, 0x6c,
+	0x69, 0x63, 0x79, 0x12, 0x36, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x64, 0x69, 0x63, 0x74, 0x18, 0x07,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x1c, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65,
+	0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x56, 0x65, 0x72, 0x64, 0x69,
+	0x63, 0x74, 0x52, 0x07, 0x76, 0x65, 0x72, 0x64, 0x69, 0x63, 0x74, 0x12, 0x3e, 0x0a, 0x08, 0x76,
+	0x61, 0x72, 0x69, 0x61, 0x6e, 0x74, 0x73, 0x18, 0x08, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x22, 0x2e,
+	0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c,
+	0x2e, 0x76, 0x31, 0x2e, 0x56, 0x61, 0x72, 0x69, 0x61, 0x6e, 0x74, 0x52, 0x65, 0x73, 0x75, 0x6c,
+	0x74, 0x52, 0x08, 0x76, 0x61, 0x72, 0x69, 0x61, 0x6e, 0x74, 0x73, 0x12, 0x45, 0x0a, 0x0c, 0x6c,
+	0x6f, 0x63, 0x61, 0x6c, 0x69, 0x7a, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x09, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x21, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68, 0x61,
+	0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x6f, 0x63, 0x61, 0x6c, 0x69, 0x7a, 0x61,
+	0x74, 0x69, 0x6f, 0x6e, 0x52, 0x0c, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x69, 0x7a, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x22, 0x94, 0x01, 0x0a, 0x0c, 0x4c, 0x6f, 0x63, 0x61, 0x6c, 0x69, 0x7a, 0x61, 0x74,
+	0x69, 0x6f, 0x6e, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x37, 0x0a, 0x07, 0x6f,
+	0x76, 0x65, 0x72, 0x61, 0x6c, 0x6c, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x77,
+	0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e,
+	0x76, 0x31, 0x2e, 0x50, 0x6f, 0x72, 0x74, 0x4c, 0x6f, 0x73, 0x73, 0x52, 0x07, 0x6f, 0x76, 0x65,
+	0x72, 0x61, 0x6c, 0x6c, 0x12, 0x33, 0x0a, 0x05, 0x70, 0x6f, 0x72, 0x74, 0x73, 0x18, 0x03, 0x20,
+	0x03, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65, 0x63,
+	0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x6f, 0x72, 0x74, 0x4c, 0x6f,
+	0x73, 0x73, 0x52, 0x05, 0x70, 0x6f, 0x72, 0x74, 0x73, 0x22, 0x9e, 0x02, 0x0a, 0x08, 0x50, 0x6f,
+	0x72, 0x74, 0x4c, 0x6f, 0x73, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x70, 0x6f, 0x72, 0x74, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x05, 0x52, 0x04, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x2c, 0x0a, 0x12, 0x6f, 0x72,
+	0x69, 0x67, 0x69, 0x6e, 0x61, 0x6c, 0x5f, 0x6c, 0x6f, 0x73, 0x73, 0x5f, 0x72, 0x61, 0x74, 0x65,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x01, 0x52, 0x10, 0x6f, 0x72, 0x69, 0x67, 0x69, 0x6e, 0x61, 0x6c,
+	0x4c, 0x6f, 0x73, 0x73, 0x52, 0x61, 0x74, 0x65, 0x12, 0x28, 0x0a, 0x10, 0x72, 0x61, 0x6e, 0x64,
+	0x6f, 0x6d, 0x5f, 0x6c, 0x6f, 0x73, 0x73, 0x5f, 0x72, 0x61, 0x74, 0x65, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x01, 0x52, 0x0e, 0x72, 0x61, 0x6e, 0x64, 0x6f, 0x6d, 0x4c, 0x6f, 0x73, 0x73, 0x52, 0x61,
+	0x74, 0x65, 0x12, 0x1b, 0x0a, 0x09, 0x6c, 0x6f, 0x73, 0x73, 0x5f, 0x64, 0x69, 0x66, 0x66, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x01, 0x52, 0x08, 0x6c, 0x6f, 0x73, 0x73, 0x44, 0x69, 0x66, 0x66, 0x12,
+	0x13, 0x0a, 0x05, 0x70, 0x5f, 0x76, 0x61, 0x6c, 0x18, 0x05, 0x20, 0x01, 0x28, 0x01, 0x52, 0x04,
+	0x70, 0x56, 0x61, 0x6c, 0x12, 0x28, 0x0a, 0x0f, 0x64, 0x69, 0x66, 0x66, 0x65, 0x72, 0x65, 0x6e,
+	0x74, 0x69, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x06, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0f, 0x64,
+	0x69, 0x66, 0x66, 0x65, 0x72, 0x65, 0x6e, 0x74, 0x69, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x26,
+	0x0a, 0x0f, 0x6f, 0x72, 0x69, 0x67, 0x69, 0x6e, 0x61, 0x6c, 0x5f, 0x72, 0x74, 0x74, 0x5f, 0x6d,
+	0x73, 0x18, 0x07, 0x20, 0x01, 0x28, 0x01, 0x52, 0x0d, 0x6f, 0x72, 0x69, 0x67, 0x69, 0x6e, 0x61,
+	0x6c, 0x52, 0x74, 0x74, 0x4d, 0x73, 0x12, 0x22, 0x0a, 0x0d, 0x72, 0x61, 0x6e, 0x64, 0x6f, 0x6d,
+	0x5f, 0x72, 0x74, 0x74, 0x5f, 0x6d, 0x73, 0x18, 0x08, 0x20, 0x01, 0x28, 0x01, 0x52, 0x0b, 0x72,
+	0x61, 0x6e, 0x64, 0x6f, 0x6d, 0x52, 0x74, 0x74, 0x4d, 0x73, 0x22, 0xc2, 0x02, 0x0a, 0x0d, 0x56,
+	0x61, 0x72, 0x69, 0x61, 0x6e, 0x74, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x40, 0x0a, 0x0b,
+	0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x5f, 0x74, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x0e, 0x32, 0x1f, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68, 0x61,
+	0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x52, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x54, 0x79,
+	0x70, 0x65, 0x52, 0x0a, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x54, 0x79, 0x70, 0x65, 0x12, 0x1f,
+	0x0a, 0x0b, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x0a, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x4e, 0x61, 0x6d, 0x65, 0x12,
+	0x28, 0x0a, 0x0f, 0x64, 0x69, 0x66, 0x66, 0x65, 0x72, 0x65, 0x6e, 0x74, 0x69, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0f, 0x64, 0x69, 0x66, 0x66, 0x65, 0x72,
+	0x65, 0x6e, 0x74, 0x69, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x1a, 0x0a, 0x08, 0x61, 0x72, 0x65,
+	0x61, 0x30, 0x76, 0x61, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x01, 0x52, 0x08, 0x61, 0x72, 0x65,
+	0x61, 0x30, 0x76, 0x61, 0x72, 0x12, 0x1a, 0x0a, 0x09, 0x6b, 0x73, 0x32, 0x5f, 0x70, 0x5f, 0x76,
+	0x61, 0x6c, 0x18, 0x05, 0x20, 0x01, 0x28, 0x01, 0x52, 0x07, 0x6b, 0x73, 0x32, 0x50, 0x56, 0x61,
+	0x6c, 0x12, 0x36, 0x0a, 0x17, 0x6f, 0x72, 0x69, 0x67, 0x69, 0x6e, 0x61, 0x6c, 0x5f, 0x61, 0x76,
+	0x67, 0x5f, 0x74, 0x68, 0x72, 0x6f, 0x75, 0x67, 0x68, 0x70, 0x75, 0x74, 0x18, 0x06, 0x20, 0x01,
+	0x28, 0x01, 0x52, 0x15, 0x6f, 0x72, 0x69, 0x67, 0x69, 0x6e, 0x61, 0x6c, 0x41, 0x76, 0x67, 0x54,
+	0x68, 0x72, 0x6f, 0x75, 0x67, 0x68, 0x70, 0x75, 0x74, 0x12, 0x34, 0x0a, 0x16, 0x76, 0x61, 0x72,
+	0x69, 0x61, 0x6e, 0x74, 0x5f, 0x61, 0x76, 0x67, 0x5f, 0x74, 0x68, 0x72, 0x6f, 0x75, 0x67, 0x68,
+	0x70, 0x75, 0x74, 0x18, 0x07, 0x20, 0x01, 0x28, 0x01, 0x52, 0x14, 0x76, 0x61, 0x72, 0x69, 0x61,
+	0x6e, 0x74, 0x41, 0x76, 0x67, 0x54, 0x68, 0x72, 0x6f, 0x75, 0x67, 0x68, 0x70, 0x75, 0x74, 0x22,
+	0xd7, 0x01, 0x0a, 0x07, 0x56, 0x65, 0x72, 0x64, 0x69, 0x63, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x6e,
+	0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12,
+	0x30, 0x0a, 0x14, 0x61, 0x72, 0x65, 0x61, 0x5f, 0x61, 0x62, 0x6f, 0x76, 0x65, 0x5f, 0x74, 0x68,
+	0x72, 0x65, 0x73, 0x68, 0x6f, 0x6c, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52, 0x12, 0x61,
+	0x72, 0x65, 0x61, 0x41, 0x62, 0x6f, 0x76, 0x65, 0x54, 0x68, 0x72, 0x65, 0x73, 0x68, 0x6f, 0x6c,
+	0x64, 0x12, 0x38, 0x0a, 0x19, 0x6b, 0x73, 0x32, 0x5f, 0x70, 0x5f, 0x76, 0x61, 0x6c, 0x5f, 0x62,
+	0x65, 0x6c, 0x6f, 0x77, 0x5f, 0x74, 0x68, 0x72, 0x65, 0x73, 0x68, 0x6f, 0x6c, 0x64, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x08, 0x52, 0x15, 0x6b, 0x73, 0x32, 0x50, 0x56, 0x61, 0x6c, 0x42, 0x65, 0x6c,
+	0x6f, 0x77, 0x54, 0x68, 0x72, 0x65, 0x73, 0x68, 0x6f, 0x6c, 0x64, 0x12, 0x28, 0x0a, 0x10, 0x61,
+	0x63, 0x63, 0x65, 0x70, 0x74, 0x5f, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x5f, 0x6d, 0x65, 0x74, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0e, 0x61, 0x63, 0x63, 0x65, 0x70, 0x74, 0x52, 0x61, 0x74,
+	0x69, 0x6f, 0x4d, 0x65, 0x74, 0x12, 0x22, 0x0a, 0x0c, 0x69, 0x6e, 0x63, 0x6f, 0x6e, 0x63, 0x6c,
+	0x75, 0x73, 0x69, 0x76, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0c, 0x69, 0x6e, 0x63,
+	0x6f, 0x6e, 0x63, 0x6c, 0x75, 0x73, 0x69, 0x76, 0x65, 0x2a, 0x58, 0x0a, 0x0a, 0x52, 0x65, 0x70,
+	0x6c, 0x61, 0x79, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0c, 0x0a, 0x08, 0x4f, 0x52, 0x49, 0x47, 0x49,
+	0x4e, 0x41, 0x4c, 0x10, 0x00, 0x12, 0x0a, 0x0a, 0x06, 0x52, 0x41, 0x4e, 0x44, 0x4f, 0x4d, 0x10,
+	0x01, 0x12, 0x10, 0x0a, 0x0c, 0x42, 0x49, 0x54, 0x5f, 0x49, 0x4e, 0x56, 0x45, 0x52, 0x54, 0x45,
+	0x44, 0x10, 0x02, 0x12, 0x10, 0x0a, 0x0c, 0x50, 0x4f, 0x52, 0x54, 0x5f, 0x43, 0x48, 0x41, 0x4e,
+	0x47, 0x45, 0x44, 0x10, 0x03, 0x12, 0x0c, 0x0a, 0x08, 0x54, 0x55, 0x4e, 0x4e, 0x45, 0x4c, 0x45,
+	0x44, 0x10, 0x04, 0x2a, 0xa9, 0x01, 0x0a, 0x06, 0x44, 0x65, 0x6e, 0x69, 0x61, 0x6c, 0x12, 0x16,
+	0x0a, 0x12, 0x44, 0x45, 0x4e, 0x49, 0x41, 0x4c, 0x5f, 0x55, 0x4e, 0x53, 0x50, 0x45, 0x43, 0x49,
+	0x46, 0x49, 0x45, 0x44, 0x10, 0x00, 0x12, 0x12, 0x0a, 0x0e, 0x55, 0x4e, 0x4b, 0x4e, 0x4f, 0x57,
+	0x4e, 0x5f, 0x52, 0x45, 0x50, 0x4c, 0x41, 0x59, 0x10, 0x01, 0x12, 0x0d, 0x0a, 0x09, 0x49, 0x50,
+	0x5f, 0x49, 0x4e, 0x5f, 0x55, 0x53, 0x45, 0x10, 0x02, 0x12, 0x11, 0x0a, 0x0d, 0x4c, 0x4f, 0x57,
+	0x5f, 0x52, 0x45, 0x53, 0x4f, 0x55, 0x52, 0x43, 0x45, 0x53, 0x10, 0x03, 0x12, 0x1b, 0x0a, 0x17,
+	0x52, 0x45, 0x53, 0x4f, 0x55, 0x52, 0x43, 0x45, 0x5f, 0x52, 0x45, 0x54, 0x52, 0x49, 0x45, 0x56,
+	0x41, 0x4c, 0x5f, 0x46, 0x41, 0x49, 0x4c, 0x10, 0x04, 0x12, 0x12, 0x0a, 0x0e, 0x44, 0x55, 0x50,
+	0x4c, 0x49, 0x43, 0x41, 0x54, 0x45, 0x5f, 0x54, 0x45, 0x53, 0x54, 0x10, 0x05, 0x12, 0x0f, 0x0a,
+	0x0b, 0x4d, 0x41, 0x49, 0x4e, 0x54, 0x45, 0x4e, 0x41, 0x4e, 0x43, 0x45, 0x10, 0x06, 0x12, 0x0f,
+	0x0a, 0x0b, 0x53, 0x45, 0x52, 0x56, 0x45, 0x52, 0x5f, 0x42, 0x55, 0x53, 0x59, 0x10, 0x08, 0x32,
+	0xe4, 0x04, 0x0a, 0x0b, 0x53, 0x69, 0x64, 0x65, 0x43, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x12,
+	0x60, 0x0a, 0x0b, 0x44, 0x65, 0x63, 0x6c, 0x61, 0x72, 0x65, 0x54, 0x65, 0x73, 0x74, 0x12, 0x27,
+	0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65,
+	0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x44, 0x65, 0x63, 0x6c, 0x61, 0x72, 0x65, 0x54, 0x65, 0x73, 0x74,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x28, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73,
+	0x69, 0x64, 0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x44, 0x65,
+	0x63, 0x6c, 0x61, 0x72, 0x65, 0x54, 0x65, 0x73, 0x74, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x12, 0x66, 0x0a, 0x0d, 0x44, 0x65, 0x63, 0x6c, 0x61, 0x72, 0x65, 0x52, 0x65, 0x70, 0x6c,
+	0x61, 0x79, 0x12, 0x29, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68,
+	0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x44, 0x65, 0x63, 0x6c, 0x61, 0x72, 0x65,
+	0x52, 0x65, 0x70, 0x6c, 0x61, 0x79, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x2a, 0x2e,
+	0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c,
+	0x2e, 0x76, 0x31, 0x2e, 0x44, 0x65, 0x63, 0x6c, 0x61, 0x72, 0x65, 0x52, 0x65, 0x70, 0x6c, 0x61,
+	0x79, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x69, 0x0a, 0x0e, 0x41, 0x73, 0x6b,
+	0x34, 0x50, 0x65, 0x72, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x2a, 0x2e, 0x77, 0x65,
+	0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76,
+	0x31, 0x2e, 0x41, 0x73, 0x6b, 0x34, 0x50, 0x65, 0x72, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x2b, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73,
+	0x69, 0x64, 0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x41, 0x73,
+	0x6b, 0x34, 0x50, 0x65, 0x72, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x12, 0x6c, 0x0a, 0x11, 0x53, 0x75, 0x62, 0x6d, 0x69, 0x74, 0x54, 0x68,
+	0x72, 0x6f, 0x75, 0x67, 0x68, 0x70, 0x75, 0x74, 0x73, 0x12, 0x25, 0x2e, 0x77, 0x65, 0x68, 0x65,
+	0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e,
+	0x54, 0x68, 0x72, 0x6f, 0x75, 0x67, 0x68, 0x70, 0x75, 0x74, 0x73, 0x43, 0x68, 0x75, 0x6e, 0x6b,
+	0x1a, 0x2e, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68, 0x61, 0x6e,
+	0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x75, 0x62, 0x6d, 0x69, 0x74, 0x54, 0x68, 0x72,
+	0x6f, 0x75, 0x67, 0x68, 0x70, 0x75, 0x74, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x28, 0x01, 0x12, 0x60, 0x0a, 0x0b, 0x41, 0x6e, 0x61, 0x6c, 0x79, 0x7a, 0x65, 0x54, 0x65, 0x73,
+	0x74, 0x12, 0x27, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68, 0x61,
+	0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x41, 0x6e, 0x61, 0x6c, 0x79, 0x7a, 0x65, 0x54,
+	0x65, 0x73, 0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x26, 0x2e, 0x77, 0x65, 0x68,
+	0x65, 0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31,
+	0x2e, 0x41, 0x6e, 0x61, 0x6c, 0x79, 0x7a, 0x65, 0x54, 0x65, 0x73, 0x74, 0x55, 0x70, 0x64, 0x61,
+	0x74, 0x65, 0x30, 0x01, 0x12, 0x50, 0x0a, 0x07, 0x45, 0x6e, 0x64, 0x54, 0x65, 0x73, 0x74, 0x12,
+	0x23, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e,
+	0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x45, 0x6e, 0x64, 0x54, 0x65, 0x73, 0x74, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x1a, 0x20, 0x2e, 0x77, 0x65, 0x68, 0x65, 0x2e, 0x73, 0x69, 0x64, 0x65,
+	0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x76, 0x31, 0x2e, 0x54, 0x65, 0x73, 0x74, 0x53,
+	0x75, 0x6d, 0x6d, 0x61, 0x72, 0x79, 0x42, 0x24, 0x5a, 0x22, 0x77, 0x65, 0x68, 0x65, 0x2d, 0x73,
+	0x65, 0x72, 0x76, 0x65, 0x72, 0x2f, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x73,
+	0x69, 0x64, 0x65, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_sidechannel_proto_rawDescOnce sync.Once
+	file_sidechannel_proto_rawDescData = file_sidechannel_proto_rawDesc
+)
+
+func file_sidechannel_proto_rawDescGZIP() []byte {
+	file_sidechannel_proto_rawDescOnce.Do(func() {
+		file_sidechannel_proto_rawDescData = protoimpl.X.CompressGZIP(file_sidechannel_proto_rawDescData)
+	})
+	return file_sidechannel_proto_rawDescData
+}
+
+var file_sidechannel_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_sidechannel_proto_msgTypes = make([]protoimpl.MessageInfo, 18)
+var file_sidechannel_proto_goTypes = []any{
+	(ReplayType)(0),                   // 0: wehe.sidechannel.v1.ReplayType
+	(Denial)(0),                       // 1: wehe.sidechannel.v1.Denial
+	(*DeclareTestRequest)(nil),        // 2: wehe.sidechannel.v1.DeclareTestRequest
+	(*DeclareTestResponse)(nil),       // 3: wehe.sidechannel.v1.DeclareTestResponse
+	(*DeclareReplayRequest)(nil),      // 4: wehe.sidechannel.v1.DeclareReplayRequest
+	(*DeclareReplayResponse)(nil),     // 5: wehe.sidechannel.v1.DeclareReplayResponse
+	(*Ask4PermissionRequest)(nil),     // 6: wehe.sidechannel.v1.Ask4PermissionRequest
+	(*Ask4PermissionResponse)(nil),    // 7: wehe.sidechannel.v1.Ask4PermissionResponse
+	(*Permission)(nil),                // 8: wehe.sidechannel.v1.Permission
+	(*ThroughputsChunk)(nil),          // 9: wehe.sidechannel.v1.ThroughputsChunk
+	(*SubmitThroughputsResponse)(nil), // 10: wehe.sidechannel.v1.SubmitThroughputsResponse
+	(*AnalyzeTestRequest)(nil),        // 11: wehe.sidechannel.v1.AnalyzeTestRequest
+	(*AnalyzeTestUpdate)(nil),         // 12: wehe.sidechannel.v1.AnalyzeTestUpdate
+	(*EndTestRequest)(nil),            // 13: wehe.sidechannel.v1.EndTestRequest
+	(*TestSummary)(nil),               // 14: wehe.sidechannel.v1.TestSummary
+	(*AnalysisResult)(nil),            // 15: wehe.sidechannel.v1.AnalysisResult
+	(*Localization)(nil),              // 16: wehe.sidechannel.v1.Localization
+	(*PortLoss)(nil),                  // 17: wehe.sidechannel.v1.PortLoss
+	(*VariantResult)(nil),             // 18: wehe.sidechannel.v1.VariantResult
+	(*Verdict)(nil),                   // 19: wehe.sidechannel.v1.Verdict
+}
+var file_sidechannel_proto_depIdxs = []int32{
+	0,  // 0: wehe.sidechannel.v1.DeclareTestRequest.replay_type:type_name -> wehe.sidechannel.v1.ReplayType
+	0,  // 1: wehe.sidechannel.v1.DeclareReplayRequest.replay_type:type_name -> wehe.sidechannel.v1.ReplayType
+	8,  // 2: wehe.sidechannel.v1.DeclareReplayResponse.permission:type_name -> wehe.sidechannel.v1.Permission
+	8,  // 3: wehe.sidechannel.v1.Ask4PermissionResponse.permission:type_name -> wehe.sidechannel.v1.Permission
+	1,  // 4: wehe.sidechannel.v1.Permission.denial:type_name -> wehe.sidechannel.v1.Denial
+	15, // 5: wehe.sidechannel.v1.AnalyzeTestUpdate.result:type_name -> wehe.sidechannel.v1.AnalysisResult
+	14, // 6: wehe.sidechannel.v1.AnalyzeTestUpdate.summary:type_name -> wehe.sidechannel.v1.TestSummary
+	19, // 7: wehe.sidechannel.v1.AnalysisResult.verdict:type_name -> wehe.sidechannel.v1.Verdict
+	18, // 8: wehe.sidechannel.v1.AnalysisResult.variants:type_name -> wehe.sidechannel.v1.VariantResult
+	16, // 9: wehe.sidechannel.v1.AnalysisResult.localization:type_name -> wehe.sidechannel.v1.Localization
+	17, // 10: wehe.sidechannel.v1.Localization.overall:type_name -> wehe.sidechannel.v1.PortLoss
+	17, // 11: wehe.sidechannel.v1.Localization.ports:type_name -> wehe.sidechannel.v1.PortLoss
+	0,  // 12: wehe.sidechannel.v1.VariantResult.replay_type:type_name -> wehe.sidechannel.v1.ReplayType
+	2,  // 13: wehe.sidechannel.v1.SideChannel.DeclareTest:input_type -> wehe.sidechannel.v1.DeclareTestRequest
+	4,  // 14: wehe.sidechannel.v1.SideChannel.DeclareReplay:input_type -> wehe.sidechannel.v1.DeclareReplayRequest
+	6,  // 15: wehe.sidechannel.v1.SideChannel.Ask4Permission:input_type -> wehe.sidechannel.v1.Ask4PermissionRequest
+	9,  // 16: wehe.sidechannel.v1.SideChannel.SubmitThroughputs:input_type -> wehe.sidechannel.v1.ThroughputsChunk
+	11, // 17: wehe.sidechannel.v1.SideChannel.AnalyzeTest:input_type -> wehe.sidechannel.v1.AnalyzeTestRequest
+	13, // 18: wehe.sidechannel.v1.SideChannel.EndTest:input_type -> wehe.sidechannel.v1.EndTestRequest
+	3,  // 19: wehe.sidechannel.v1.SideChannel.DeclareTest:output_type -> wehe.sidechannel.v1.DeclareTestResponse
+	5,  // 20: wehe.sidechannel.v1.SideChannel.DeclareReplay:output_type -> wehe.sidechannel.v1.DeclareReplayResponse
+	7,  // 21: wehe.sidechannel.v1.SideChannel.Ask4Permission:output_type -> wehe.sidechannel.v1.Ask4PermissionResponse
+	10, // 22: wehe.sidechannel.v1.SideChannel.SubmitThroughputs:output_type -> wehe.sidechannel.v1.SubmitThroughputsResponse
+	12, // 23: wehe.sidechannel.v1.SideChannel.AnalyzeTest:output_type -> wehe.sidechannel.v1.AnalyzeTestUpdate
+	14, // 24: wehe.sidechannel.v1.SideChannel.EndTest:output_type -> wehe.sidechannel.v1.TestSummary
+	19, // [19:25] is the sub-list for method output_type
+	13, // [13:19] is the sub-list for method input_type
+	13, // [13:13] is the sub-list for extension type_name
+	13, // [13:13] is the sub-list for extension extendee
+	0,  // [0:13] is the sub-list for field type_name
+}
+
+func init() { file_sidechannel_proto_init() }
+func file_sidechannel_proto_init() {
+	if File_sidechannel_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_sidechannel_proto_msgTypes[0].Exporter = func(v any, i int) any {
+			switch v := v.(*DeclareTestRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[1].Exporter = func(v any, i int) any {
+			switch v := v.(*DeclareTestResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[2].Exporter = func(v any, i int) any {
+			switch v := v.(*DeclareReplayRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[3].Exporter = func(v any, i int) any {
+			switch v := v.(*DeclareReplayResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[4].Exporter = func(v any, i int) any {
+			switch v := v.(*Ask4PermissionRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[5].Exporter = func(v any, i int) any {
+			switch v := v.(*Ask4PermissionResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[6].Exporter = func(v any, i int) any {
+			switch v := v.(*Permission); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[7].Exporter = func(v any, i int) any {
+			switch v := v.(*ThroughputsChunk); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[8].Exporter = func(v any, i int) any {
+			switch v := v.(*SubmitThroughputsResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[9].Exporter = func(v any, i int) any {
+			switch v := v.(*AnalyzeTestRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[10].Exporter = func(v any, i int) any {
+			switch v := v.(*AnalyzeTestUpdate); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[11].Exporter = func(v any, i int) any {
+			switch v := v.(*EndTestRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[12].Exporter = func(v any, i int) any {
+			switch v := v.(*TestSummary); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[13].Exporter = func(v any, i int) any {
+			switch v := v.(*AnalysisResult); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[14].Exporter = func(v any, i int) any {
+			switch v := v.(*Localization); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[15].Exporter = func(v any, i int) any {
+			switch v := v.(*PortLoss); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[16].Exporter = func(v any, i int) any {
+			switch v := v.(*VariantResult); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sidechannel_proto_msgTypes[17].Exporter = func(v any, i int) any {
+			switch v := v.(*Verdict); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	file_sidechannel_proto_msgTypes[10].OneofWrappers = []any{
+		(*AnalyzeTestUpdate_State)(nil),
+		(*AnalyzeTestUpdate_Result)(nil),
+		(*AnalyzeTestUpdate_Summary)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_sidechannel_proto_rawDesc,
+			NumEnums:      2,
+			NumMessages:   18,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_sidechannel_proto_goTypes,
+		DependencyIndexes: file_sidechannel_proto_depIdxs,
+		EnumInfos:         file_sidechannel_proto_enumTypes,
+		MessageInfos:      file_sidechannel_proto_msgTypes,
+	}.Build()
+	File_sidechannel_proto = out.File
+	file_sidechannel_proto_rawDesc = nil
+	file_sidechannel_proto_goTypes = nil
+	file_sidechannel_proto_depIdxs = nil
+}
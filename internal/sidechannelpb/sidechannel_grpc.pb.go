@@ -0,0 +1,332 @@
+// The gRPC side channel of the Wehe server, an alternative to the binary side channel protocol. A
+// test is declared with DeclareTest, which returns a token that every other call of the test
+// carries. The replays themselves still run on the replay ports. A call that fails ends the test,
+// and its status code says why: InvalidArgument for a request that couldn't be parsed,
+// ResourceExhausted for one over a limit, NotFound for an unknown test, PermissionDenied for a
+// replay that wasn't allowed, FailedPrecondition for a client that must upgrade or a test that
+// can't be analyzed, Canceled or DeadlineExceeded for a client that went away or ran out of time,
+// and Internal for anything else. Run go generate ./internal/sidechannelpb after changing this file
+// to regenerate the Go code.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: sidechannel.proto
+
+package sidechannelpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	SideChannel_DeclareTest_FullMethodName       = "/wehe.sidechannel.v1.SideChannel/DeclareTest"
+	SideChannel_DeclareReplay_FullMethodName     = "/wehe.sidechannel.v1.SideChannel/DeclareReplay"
+	SideChannel_Ask4Permission_FullMethodName    = "/wehe.sidechannel.v1.SideChannel/Ask4Permission"
+	SideChannel_SubmitThroughputs_FullMethodName = "/wehe.sidechannel.v1.SideChannel/SubmitThroughputs"
+	SideChannel_AnalyzeTest_FullMethodName       = "/wehe.sidechannel.v1.SideChannel/AnalyzeTest"
+	SideChannel_EndTest_FullMethodName           = "/wehe.sidechannel.v1.SideChannel/EndTest"
+)
+
+// SideChannelClient is the client API for SideChannel service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type SideChannelClient interface {
+	// Declares a test and its first replay.
+	DeclareTest(ctx context.Context, in *DeclareTestRequest, opts ...grpc.CallOption) (*DeclareTestResponse, error)
+	// Declares the next replay of a test.
+	DeclareReplay(ctx context.Context, in *DeclareReplayRequest, opts ...grpc.CallOption) (*DeclareReplayResponse, error)
+	// Asks to run the current replay of a test.
+	Ask4Permission(ctx context.Context, in *Ask4PermissionRequest, opts ...grpc.CallOption) (*Ask4PermissionResponse, error)
+	// Sends the throughputs the client measured during the current replay, in one or more chunks.
+	SubmitThroughputs(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[ThroughputsChunk, SubmitThroughputsResponse], error)
+	// Analyzes a test. The state of the analysis is streamed, followed by the result, and the test
+	// ends, after which what was stored for it is sent.
+	AnalyzeTest(ctx context.Context, in *AnalyzeTestRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[AnalyzeTestUpdate], error)
+	// Ends a test that the client won't analyze, and returns what was stored for it.
+	EndTest(ctx context.Context, in *EndTestRequest, opts ...grpc.CallOption) (*TestSummary, error)
+}
+
+type sideChannelClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSideChannelClient(cc grpc.ClientConnInterface) SideChannelClient {
+	return &sideChannelClient{cc}
+}
+
+func (c *sideChannelClient) DeclareTest(ctx context.Context, in *DeclareTestRequest, opts ...grpc.CallOption) (*DeclareTestResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeclareTestResponse)
+	err := c.cc.Invoke(ctx, SideChannel_DeclareTest_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sideChannelClient) DeclareReplay(ctx context.Context, in *DeclareReplayRequest, opts ...grpc.CallOption) (*DeclareReplayResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeclareReplayResponse)
+	err := c.cc.Invoke(ctx, SideChannel_DeclareReplay_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sideChannelClient) Ask4Permission(ctx context.Context, in *Ask4PermissionRequest, opts ...grpc.CallOption) (*Ask4PermissionResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Ask4PermissionResponse)
+	err := c.cc.Invoke(ctx, SideChannel_Ask4Permission_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sideChannelClient) SubmitThroughputs(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[ThroughputsChunk, SubmitThroughputsResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &SideChannel_ServiceDesc.Streams[0], SideChannel_SubmitThroughputs_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ThroughputsChunk, SubmitThroughputsResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type SideChannel_SubmitThroughputsClient = grpc.ClientStreamingClient[ThroughputsChunk, SubmitThroughputsResponse]
+
+func (c *sideChannelClient) AnalyzeTest(ctx context.Context, in *AnalyzeTestRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[AnalyzeTestUpdate], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &SideChannel_ServiceDesc.Streams[1], SideChannel_AnalyzeTest_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[AnalyzeTestRequest, AnalyzeTestUpdate]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type SideChannel_AnalyzeTestClient = grpc.ServerStreamingClient[AnalyzeTestUpdate]
+
+func (c *sideChannelClient) EndTest(ctx context.Context, in *EndTestRequest, opts ...grpc.CallOption) (*TestSummary, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TestSummary)
+	err := c.cc.Invoke(ctx, SideChannel_EndTest_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SideChannelServer is the server API for SideChannel service.
+// All implementations must embed UnimplementedSideChannelServer
+// for forward compatibility.
+type SideChannelServer interface {
+	// Declares a test and its first replay.
+	DeclareTest(context.Context, *DeclareTestRequest) (*DeclareTestResponse, error)
+	// Declares the next replay of a test.
+	DeclareReplay(context.Context, *DeclareReplayRequest) (*DeclareReplayResponse, error)
+	// Asks to run the current replay of a test.
+	Ask4Permission(context.Context, *Ask4PermissionRequest) (*Ask4PermissionResponse, error)
+	// Sends the throughputs the client measured during the current replay, in one or more chunks.
+	SubmitThroughputs(grpc.ClientStreamingServer[ThroughputsChunk, SubmitThroughputsResponse]) error
+	// Analyzes a test. The state of the analysis is streamed, followed by the result, and the test
+	// ends, after which what was stored for it is sent.
+	AnalyzeTest(*AnalyzeTestRequest, grpc.ServerStreamingServer[AnalyzeTestUpdate]) error
+	// Ends a test that the client won't analyze, and returns what was stored for it.
+	EndTest(context.Context, *EndTestRequest) (*TestSummary, error)
+	mustEmbedUnimplementedSideChannelServer()
+}
+
+// UnimplementedSideChannelServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedSideChannelServer struct{}
+
+func (UnimplementedSideChannelServer) DeclareTest(context.Context, *DeclareTestRequest) (*DeclareTestResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeclareTest not implemented")
+}
+func (UnimplementedSideChannelServer) DeclareReplay(context.Context, *DeclareReplayRequest) (*DeclareReplayResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeclareReplay not implemented")
+}
+func (UnimplementedSideChannelServer) Ask4Permission(context.Context, *Ask4PermissionRequest) (*Ask4PermissionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Ask4Permission not implemented")
+}
+func (UnimplementedSideChannelServer) SubmitThroughputs(grpc.ClientStreamingServer[ThroughputsChunk, SubmitThroughputsResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method SubmitThroughputs not implemented")
+}
+func (UnimplementedSideChannelServer) AnalyzeTest(*AnalyzeTestRequest, grpc.ServerStreamingServer[AnalyzeTestUpdate]) error {
+	return status.Errorf(codes.Unimplemented, "method AnalyzeTest not implemented")
+}
+func (UnimplementedSideChannelServer) EndTest(context.Context, *EndTestRequest) (*TestSummary, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method EndTest not implemented")
+}
+func (UnimplementedSideChannelServer) mustEmbedUnimplementedSideChannelServer() {}
+func (UnimplementedSideChannelServer) testEmbeddedByValue()                     {}
+
+// UnsafeSideChannelServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SideChannelServer will
+// result in compilation errors.
+type UnsafeSideChannelServer interface {
+	mustEmbedUnimplementedSideChannelServer()
+}
+
+func RegisterSideChannelServer(s grpc.ServiceRegistrar, srv SideChannelServer) {
+	// If the following call pancis, it indicates UnimplementedSideChannelServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&SideChannel_ServiceDesc, srv)
+}
+
+func _SideChannel_DeclareTest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeclareTestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SideChannelServer).DeclareTest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SideChannel_DeclareTest_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SideChannelServer).DeclareTest(ctx, req.(*DeclareTestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SideChannel_DeclareReplay_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeclareReplayRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SideChannelServer).DeclareReplay(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SideChannel_DeclareReplay_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SideChannelServer).DeclareReplay(ctx, req.(*DeclareReplayRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SideChannel_Ask4Permission_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Ask4PermissionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SideChannelServer).Ask4Permission(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SideChannel_Ask4Permission_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SideChannelServer).Ask4Permission(ctx, req.(*Ask4PermissionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SideChannel_SubmitThroughputs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(SideChannelServer).SubmitThroughputs(&grpc.GenericServerStream[ThroughputsChunk, SubmitThroughputsResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type SideChannel_SubmitThroughputsServer = grpc.ClientStreamingServer[ThroughputsChunk, SubmitThroughputsResponse]
+
+func _SideChannel_AnalyzeTest_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(AnalyzeTestRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SideChannelServer).AnalyzeTest(m, &grpc.GenericServerStream[AnalyzeTestRequest, AnalyzeTestUpdate]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type SideChannel_AnalyzeTestServer = grpc.ServerStreamingServer[AnalyzeTestUpdate]
+
+func _SideChannel_EndTest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EndTestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SideChannelServer).EndTest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SideChannel_EndTest_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SideChannelServer).EndTest(ctx, req.(*EndTestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// SideChannel_ServiceDesc is the grpc.ServiceDesc for SideChannel service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var SideChannel_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "wehe.sidechannel.v1.SideChannel",
+	HandlerType: (*SideChannelServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "DeclareTest",
+			Handler:    _SideChannel_DeclareTest_Handler,
+		},
+		{
+			MethodName: "DeclareReplay",
+			Handler:    _SideChannel_DeclareReplay_Handler,
+		},
+		{
+			MethodName: "Ask4Permission",
+			Handler:    _SideChannel_Ask4Permission_Handler,
+		},
+		{
+			MethodName: "EndTest",
+			Handler:    _SideChannel_EndTest_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SubmitThroughputs",
+			Handler:       _SideChannel_SubmitThroughputs_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "AnalyzeTest",
+			Handler:       _SideChannel_AnalyzeTest_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "sidechannel.proto",
+}
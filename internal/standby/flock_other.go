@@ -0,0 +1,32 @@
+//go:build !unix
+
+// Platforms without flock, such as Windows, can't run a standby pair. The server still builds there
+// for development, but fails to start if standby_lock_file is set.
+package standby
+
+import (
+    "fmt"
+    "os"
+    "runtime"
+)
+
+// Reports that the lock isn't supported.
+// file: the lock file
+// Returns an error
+func tryLock(file *os.File) (bool, error) {
+    return false, fmt.Errorf("Standby pairs are not supported on %s", runtime.GOOS)
+}
+
+// Reports that the lock isn't supported.
+// file: the lock file
+// Returns an error
+func lock(file *os.File) error {
+    return fmt.Errorf("Standby pairs are not supported on %s", runtime.GOOS)
+}
+
+// Does nothing, since the lock can never be taken.
+// file: the lock file
+// Returns nil
+func unlock(file *os.File) error {
+    return nil
+}
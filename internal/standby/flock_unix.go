@@ -0,0 +1,34 @@
+//go:build unix
+
+// The leader lock on Unix, which is an exclusive flock.
+package standby
+
+import (
+    "os"
+    "syscall"
+)
+
+// Takes the lock if no other process holds it.
+// file: the lock file
+// Returns true if the lock was taken, false if another process holds it, or any errors
+func tryLock(file *os.File) (bool, error) {
+    err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+    if err == syscall.EWOULDBLOCK {
+        return false, nil
+    }
+    return err == nil, err
+}
+
+// Waits until the lock can be taken and takes it.
+// file: the lock file
+// Returns any errors
+func lock(file *os.File) error {
+    return syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+}
+
+// Releases the lock.
+// file: the lock file
+// Returns any errors
+func unlock(file *os.File) error {
+    return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
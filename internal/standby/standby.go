@@ -0,0 +1,65 @@
+// Lets two server processes run as a warm standby pair. Both processes load their replays,
+// certificates, and configuration at startup, but only the process holding the leader lock binds the
+// ports and serves clients. The lock is an exclusive flock on a shared file; the kernel releases it
+// when the leader exits for any reason, including a crash, so the standby takes over the ports as
+// soon as the leader is gone. Both processes share the same results directories, so results written
+// by the old leader are kept.
+package standby
+
+import (
+    "fmt"
+    "log/slog"
+    "os"
+    "strconv"
+)
+
+// The lock held by the leader of a standby pair.
+type Lock struct {
+    file *os.File // the open lock file; the lock is held for as long as it is open
+}
+
+// Waits until this process is the leader of its standby pair. Blocks for as long as another process
+// holds the lock. The lock file must be on a filesystem that supports flock, such as a local disk;
+// network filesystems may not release the lock when a process on another machine dies.
+// filename: path of the lock file shared by the pair; it is created if it doesn't exist
+// Returns the lock, which should be held until the process exits, or any errors
+func AcquireLeadership(filename string) (*Lock, error) {
+    file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+    if err != nil {
+        return nil, err
+    }
+
+    // try without blocking first so that the wait is only reported when there is a leader
+    locked, err := tryLock(file)
+    if err == nil && !locked {
+        leaderPID, _ := os.ReadFile(filename)
+        slog.Info("Another server is the leader; waiting as standby", "leader_pid", string(leaderPID), "lock_file", filename)
+        err = lock(file)
+    }
+    if err != nil {
+        file.Close()
+        return nil, fmt.Errorf("Unable to lock %s: %s", filename, err)
+    }
+
+    // record who the leader is so that operators and the standby can see it
+    err = file.Truncate(0)
+    if err == nil {
+        _, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+    }
+    if err != nil {
+        slog.Warn("Unable to write pid to leader lock file", "error", err)
+    }
+    slog.Info("This server is the leader")
+    return &Lock{file: file}, nil
+}
+
+// Gives up leadership so that the standby can take over.
+// Returns any errors
+func (lock *Lock) Release() error {
+    err := unlock(lock.file)
+    if err != nil {
+        lock.file.Close()
+        return err
+    }
+    return lock.file.Close()
+}
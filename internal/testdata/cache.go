@@ -0,0 +1,347 @@
+// Keeps replays in memory so that they are only read from disk once. The replays that were used
+// least recently are dropped when the cache goes over its memory budget.
+package testdata
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "log/slog"
+    "os"
+    "sort"
+    "sync"
+    "time"
+
+    "wehe-server/internal/errs"
+    "wehe-server/internal/metrics"
+)
+
+var (
+    cacheLookups = metrics.NewCounterVec("wehe_replay_cache_lookups_total",
+        "Number of times a replay was gotten from the replay cache, by whether it was already in memory (hit) or had to be read from disk (miss).", "result")
+    cacheEvictions = metrics.NewCounterVec("wehe_replay_cache_evictions_total",
+        "Number of times a replay was dropped from the replay cache to stay within its memory budget, by replay.", "replay")
+    replayParseSeconds = metrics.NewGaugeVec("wehe_replay_parse_seconds",
+        "Seconds it took to read and parse a replay file the last time it was loaded, by replay.", "replay")
+    replayFileBytes = metrics.NewGaugeVec("wehe_replay_file_bytes",
+        "Size of a replay file the last time it was loaded, by replay.", "replay")
+    cachePayloadBytes = metrics.NewGaugeVec("wehe_replay_cache_payload_bytes",
+        "Payload bytes of the cached replays, by whether they are the bytes kept in memory (stored) or the bytes the replays would take up without sharing payloads (total).", "kind")
+)
+
+// How long loading a replay should take and how big a replay file should be. Replays that go over
+// are still served, but a warning is logged so that operators can find the replay files behind
+// slow tests and memory growth.
+type LoadBudget struct {
+    ParseTime time.Duration // how long reading and parsing a replay file should take; 0 for no limit
+    FileBytes int64 // how big a replay file should be; 0 for no limit
+}
+
+// The bytes of a packet. Payloads are shared between all the replays in a Cache: identical payloads
+// are stored once, and so are payloads that are the bitwise inverse of each other, since random
+// replays are made by inverting every byte of the original replay.
+type Payload struct {
+    data []byte // the stored bytes, shared with other payloads
+    inverted bool // true if the payload is the bitwise inverse of data
+}
+
+// Gets the number of bytes in the payload.
+// Returns the length of the payload
+func (payload Payload) Len() int {
+    return len(payload.data)
+}
+
+// Appends the bytes of the payload to a buffer. Reusing the buffer between packets avoids
+// allocating a copy of every inverted payload.
+// buf: the buffer to append to
+// Returns the extended buffer
+func (payload Payload) AppendTo(buf []byte) []byte {
+    if !payload.inverted {
+        return append(buf, payload.data...)
+    }
+    for _, b := range payload.data {
+        buf = append(buf, ^b)
+    }
+    return buf
+}
+
+// Content-addressed storage of payloads and of other repeated data in replays.
+type payloadStore struct {
+    payloads map[[sha256.Size]byte][]byte // stored payloads; key is the SHA-256 hash of the payload
+    refs map[[sha256.Size]byte]int // number of packets that use each stored payload; key is the SHA-256 hash of the payload
+    strings map[string]string // stored strings, such as c_s_pairs, which are repeated in every packet
+    storedBytes int64 // number of payload bytes actually stored
+    totalBytes int64 // number of payload bytes of all the packets added to the store
+}
+
+func newPayloadStore() *payloadStore {
+    return &payloadStore{
+        payloads: make(map[[sha256.Size]byte][]byte),
+        refs: make(map[[sha256.Size]byte]int),
+        strings: make(map[string]string),
+    }
+}
+
+// Decodes a payload and adds it to the store, sharing the bytes of an identical or inverted payload
+// that is already stored.
+// hexPayload: the payload from the replay file, as a hex string
+// Returns the payload or any errors
+func (store *payloadStore) add(hexPayload string) (Payload, error) {
+    data, err := hex.DecodeString(hexPayload)
+    if err != nil {
+        return Payload{}, err
+    }
+    store.totalBytes += int64(len(data))
+
+    hash := sha256.Sum256(data)
+    stored, exists := store.payloads[hash]
+    if exists {
+        store.refs[hash]++
+        return Payload{data: stored}, nil
+    }
+
+    inverse := make([]byte, len(data))
+    for i, b := range data {
+        inverse[i] = ^b
+    }
+    inverseHash := sha256.Sum256(inverse)
+    stored, exists = store.payloads[inverseHash]
+    if exists {
+        store.refs[inverseHash]++
+        return Payload{data: stored, inverted: true}, nil
+    }
+
+    store.payloads[hash] = data
+    store.refs[hash] = 1
+    store.storedBytes += int64(len(data))
+    return Payload{data: data}, nil
+}
+
+// Releases a payload that a packet no longer uses, dropping its bytes once no packet uses them.
+// payload: the payload to release
+func (store *payloadStore) release(payload Payload) {
+    store.totalBytes -= int64(payload.Len())
+    hash := sha256.Sum256(payload.data)
+    store.refs[hash]--
+    if store.refs[hash] > 0 {
+        return
+    }
+    delete(store.refs, hash)
+    delete(store.payloads, hash)
+    store.storedBytes -= int64(payload.Len())
+}
+
+// Adds a string to the store, sharing an identical string that is already stored.
+// str: the string to add
+// Returns the stored string
+func (store *payloadStore) addString(str string) string {
+    stored, exists := store.strings[str]
+    if exists {
+        return stored
+    }
+    store.strings[str] = str
+    return str
+}
+
+// How much memory the cached replays use.
+type CacheStats struct {
+    Replays int // number of replays in memory
+    StoredPayloadBytes int64 // number of payload bytes kept in memory
+    TotalPayloadBytes int64 // number of payload bytes the replays would take up without sharing payloads
+}
+
+// A replay in the cache.
+type cachedReplay struct {
+    info ReplayInfo // the replay
+    lastUsed uint64 // value of the use counter of the cache when the replay was last gotten
+}
+
+// Replays that have been loaded into memory. Replays are loaded the first time they are needed and
+// kept until the replays of the registry are reloaded or, if the cache has a memory budget, until
+// the payloads of the cached replays take up more than the budget, when the replays that were used
+// least recently are dropped.
+type Cache struct {
+    registry *Registry // the replays on the server
+    maxBytes int64 // payload bytes the cached replays can take up; 0 for no limit
+    budget LoadBudget // how long loading a replay should take and how big its file should be
+    version int // version of the registry the loaded replays were read from
+    replays map[string]*cachedReplay // the replays that have been loaded; key is the replay name
+    uses uint64 // number of times a replay has been gotten, used to find the least recently used replay
+    store *payloadStore // the payloads of the loaded replays
+    mutex sync.Mutex // prevents multiple goroutines from loading replays at the same time
+}
+
+// Creates a new, empty Cache.
+// registry: the replays on the server
+// maxBytes: payload bytes the cached replays can take up; 0 for no limit
+// budget: how long loading a replay should take and how big its file should be
+// Returns the cache
+func NewCache(registry *Registry, maxBytes int64, budget LoadBudget) *Cache {
+    return &Cache{
+        registry: registry,
+        maxBytes: maxBytes,
+        budget: budget,
+        version: registry.Version(),
+        replays: make(map[string]*cachedReplay),
+        store: newPayloadStore(),
+    }
+}
+
+// Loads every replay of the registry, so that the first client to run each replay doesn't wait for
+// it to be read from disk. Replays that don't fit in the memory budget are dropped again, so this is
+// only worth doing if every replay fits. Replays are loaded as they are needed again after the
+// replays of the registry are reloaded.
+// Returns any errors
+func (cache *Cache) Preload() error {
+    for _, replayName := range cache.registry.Names() {
+        _, err := cache.Get(replayName)
+        if err != nil {
+            return fmt.Errorf("Unable to preload %s: %v", replayName, err)
+        }
+    }
+    return nil
+}
+
+// Gets a replay, loading it from disk if it is not in memory yet. The packets of the replay are
+// shared with every other user of the replay and must not be modified.
+// replayName: the name of the replay
+// Returns information about the replay along with the list of packets to send to the client, or any errors
+func (cache *Cache) Get(replayName string) (ReplayInfo, error) {
+    cache.mutex.Lock()
+    defer cache.mutex.Unlock()
+    // replays already handed out stay valid for the tests running them, since they are never modified
+    version := cache.registry.Version()
+    if version != cache.version {
+        cache.replays = make(map[string]*cachedReplay)
+        cache.store = newPayloadStore()
+        cache.version = version
+    }
+    cache.uses++
+    cached, exists := cache.replays[replayName]
+    if exists {
+        cacheLookups.Inc("hit")
+        cached.lastUsed = cache.uses
+        return cached.info, nil
+    }
+    cacheLookups.Inc("miss")
+
+    _, exists = cache.registry.Get(replayName)
+    if !exists {
+        return ReplayInfo{}, fmt.Errorf("%w: %s is not a replay on the server.", errs.ErrUnknownReplay, replayName)
+    }
+    loadStart := time.Now()
+    var replayFileInfo ReplayFileInfo
+    var err error
+    if IsCalibration(replayName) {
+        replayFileInfo = calibrationReplayFile(replayName)
+    } else {
+        replayFileInfo, err = readReplayFile(cache.registry.testsDir, replayName)
+        if err != nil {
+            return ReplayInfo{}, err
+        }
+    }
+    replayInfo, err := parseReplay(replayFileInfo, cache.store)
+    if err != nil {
+        return ReplayInfo{}, err
+    }
+    cache.checkBudget(replayName, time.Since(loadStart))
+    cache.replays[replayName] = &cachedReplay{
+        info: replayInfo,
+        lastUsed: cache.uses,
+    }
+    cache.evict(replayName)
+    cachePayloadBytes.Set("stored", float64(cache.store.storedBytes))
+    cachePayloadBytes.Set("total", float64(cache.store.totalBytes))
+    return replayInfo, nil
+}
+
+// Gets the metadata of a replay without loading its packets.
+// replayName: the name of the replay
+// Returns the metadata of the replay and true if the replay exists
+func (cache *Cache) Metadata(replayName string) (ReplayMetadata, bool) {
+    return cache.registry.Get(replayName)
+}
+
+// Records how long a replay took to load and how big its file is, and warns if either is over
+// budget.
+// replayName: the name of the replay that was loaded
+// loadTime: how long reading and parsing the replay file took
+func (cache *Cache) checkBudget(replayName string, loadTime time.Duration) {
+    replayParseSeconds.Set(replayName, loadTime.Seconds())
+    if cache.budget.ParseTime > 0 && loadTime > cache.budget.ParseTime {
+        slog.Warn("Replay took longer to load than its budget", "replay", replayName, "load_time", loadTime, "budget", cache.budget.ParseTime)
+    }
+
+    info, err := os.Stat(replayFilePath(cache.registry.testsDir, replayName))
+    if err != nil {
+        return
+    }
+    replayFileBytes.Set(replayName, float64(info.Size()))
+    if cache.budget.FileBytes > 0 && info.Size() > cache.budget.FileBytes {
+        slog.Warn("Replay file is bigger than its budget", "replay", replayName, "bytes", info.Size(), "budget_bytes", cache.budget.FileBytes)
+    }
+}
+
+// Drops the replays that were used least recently until the cache is within its memory budget. The
+// replay that was just loaded is always kept, even if it alone is over the budget. Must be called
+// with the mutex held.
+// keep: the name of the replay that was just loaded
+func (cache *Cache) evict(keep string) {
+    for cache.maxBytes > 0 && cache.store.storedBytes > cache.maxBytes {
+        oldestName := ""
+        var oldestUse uint64
+        for name, cached := range cache.replays {
+            if name != keep && (oldestName == "" || cached.lastUsed < oldestUse) {
+                oldestName = name
+                oldestUse = cached.lastUsed
+            }
+        }
+        if oldestName == "" {
+            return
+        }
+        cache.drop(oldestName)
+        cacheEvictions.Inc(oldestName)
+    }
+}
+
+// Drops a replay from the cache, along with the payloads no other cached replay uses. Clients that
+// are running the replay keep their copy. Must be called with the mutex held.
+// replayName: the name of the replay
+func (cache *Cache) drop(replayName string) {
+    for _, response := range cache.replays[replayName].info.Responses {
+        switch response := response.(type) {
+        case TCPResponseSet:
+            for _, packet := range response.Packets {
+                cache.store.release(packet.Payload)
+            }
+        case UDPPacket:
+            cache.store.release(response.Payload)
+        }
+    }
+    delete(cache.replays, replayName)
+}
+
+// Gets how much memory the cached replays use.
+// Returns the cache statistics
+func (cache *Cache) Stats() CacheStats {
+    cache.mutex.Lock()
+    defer cache.mutex.Unlock()
+    return CacheStats{
+        Replays: len(cache.replays),
+        StoredPayloadBytes: cache.store.storedBytes,
+        TotalPayloadBytes: cache.store.totalBytes,
+    }
+}
+
+// Gets the names of the replays in memory.
+// Returns the replay names, sorted alphabetically
+func (cache *Cache) Loaded() []string {
+    cache.mutex.Lock()
+    defer cache.mutex.Unlock()
+    names := make([]string, 0, len(cache.replays))
+    for name := range cache.replays {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
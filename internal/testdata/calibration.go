@@ -0,0 +1,70 @@
+// The built-in calibration replays, which send a fixed, well-known traffic pattern instead of the
+// traffic of an app. On a path that isn't throttled, a client running them should measure about
+// CalibrationMbps in both replays and find no differentiation, so they check the whole measurement
+// pipeline: the replay servers, the throughputs the client samples, and the analysis. They are built
+// in code rather than read from the tests directory so that they are the same on every server.
+package testdata
+
+import (
+    "crypto/sha1"
+    "encoding/hex"
+    "math/rand"
+    "time"
+)
+
+const (
+    CalibrationReplayName = "WeheCalibration" // the original replay of a calibration test
+    CalibrationRandomReplayName = "WeheCalibrationRandom" // the random replay of a calibration test
+    CalibrationRequest = "GET /wehe-calibration HTTP/1.1\r\nHost: wehe\r\n\r\n" // what the client sends to start a calibration replay
+    CalibrationMbps = 8 // the rate both calibration replays are sent at
+    CalibrationDuration = 10 * time.Second // how long both calibration replays last
+    calibrationPacketBytes = 10000 // bytes sent at a time; with CalibrationMbps, one packet every 10 ms
+)
+
+var (
+    // the payloads of the replays come from fixed seeds, so that they are the same on every server
+    // and don't compress, while the two replays still differ in content
+    calibrationSeeds = map[string]int64{
+        CalibrationReplayName: 1,
+        CalibrationRandomReplayName: 2,
+    }
+)
+
+// Checks if a replay is one of the built-in calibration replays.
+// replayName: the name of the replay
+// Returns true if the replay is a calibration replay
+func IsCalibration(replayName string) bool {
+    _, exists := calibrationSeeds[replayName]
+    return exists
+}
+
+// Builds a calibration replay as if it had been read from a replay file: one TCP response set,
+// answering CalibrationRequest, of calibrationPacketBytes packets evenly spaced to send
+// CalibrationMbps for CalibrationDuration.
+// replayName: the name of the calibration replay
+// Returns the contents of the replay file
+func calibrationReplayFile(replayName string) ReplayFileInfo {
+    payload := make([]byte, calibrationPacketBytes)
+    rand.New(rand.NewSource(calibrationSeeds[replayName])).Read(payload)
+    hexPayload := hex.EncodeToString(payload)
+    interval := time.Duration(calibrationPacketBytes * 8 * float64(time.Second) / (CalibrationMbps * 1000 * 1000))
+    var packets []TCPReplayFilePacket
+    for timestamp := time.Duration(0); timestamp < CalibrationDuration; timestamp += interval {
+        packets = append(packets, TCPReplayFilePacket{
+            Timestamp: timestamp.Seconds(),
+            Payload: hexPayload,
+        })
+    }
+    requestHash := sha1.Sum([]byte(CalibrationRequest))
+    return ReplayFileInfo{
+        ReplayName: replayName,
+        IsTCP: true,
+        ResponseSets: []ResponseSet{
+            {
+                RequestLength: len(CalibrationRequest),
+                RequestHash: hex.EncodeToString(requestHash[:]),
+                Packets: packets,
+            },
+        },
+    }
+}
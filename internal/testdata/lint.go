@@ -0,0 +1,143 @@
+// Checks replay payloads for sensitive content that should have been scrubbed. Replays are made from
+// real packet captures, so cookies, auth headers, and email addresses of whoever made the capture
+// can end up in them by mistake.
+package testdata
+
+import (
+    "encoding/hex"
+    "fmt"
+    "os"
+    "regexp"
+    "sort"
+)
+
+const (
+    maxLintFindings = 20 // findings recorded per replay; the rest are counted but not recorded
+    lintExcerptLen = 4 // number of bytes of a match shown in a finding, so that findings don't repeat the sensitive content
+)
+
+// Sensitive content found in a replay payload.
+type LintFinding struct {
+    Pattern string // the name of the pattern that matched
+    Packet int // index of the packet in the replay file; for TCP replays, packets are counted across response sets
+    Offset int // byte offset of the match in the payload
+    Excerpt string // the start of the match, so the content can be found without the finding repeating it
+}
+
+func (finding LintFinding) String() string {
+    return fmt.Sprintf("%s in packet %d at byte %d (%q...)", finding.Pattern, finding.Packet, finding.Offset, finding.Excerpt)
+}
+
+// The result of linting a replay.
+type LintResult struct {
+    ReplayName string // name of the replay
+    Findings []LintFinding // the first maxLintFindings findings
+    NumFindings int // the total number of findings
+    Allowed bool // true if the replay is served even though it has findings
+}
+
+// Scans replay payloads for sensitive content using a set of named regular expressions.
+type Linter struct {
+    names []string // the names of the patterns, sorted
+    patterns map[string]*regexp.Regexp // the patterns; key is the pattern name
+    allowUnscrubbed map[string]bool // replays that are served even if they have findings
+}
+
+// Creates a new Linter.
+// patterns: regular expressions matching sensitive content; key is the name of the pattern
+// allowUnscrubbed: names of replays that are served even if they have findings
+// Returns the linter or an error if a pattern can't be compiled
+func NewLinter(patterns map[string]string, allowUnscrubbed []string) (*Linter, error) {
+    linter := &Linter{
+        patterns: make(map[string]*regexp.Regexp),
+        allowUnscrubbed: make(map[string]bool),
+    }
+    for name, pattern := range patterns {
+        re, err := regexp.Compile(pattern)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid replay lint pattern %s: %v", name, err)
+        }
+        linter.names = append(linter.names, name)
+        linter.patterns[name] = re
+    }
+    sort.Strings(linter.names)
+    for _, replayName := range allowUnscrubbed {
+        linter.allowUnscrubbed[replayName] = true
+    }
+    return linter, nil
+}
+
+// Scans the payloads of a replay.
+// replayName: the name of the replay
+// replayFileInfo: the contents of the replay file
+// Returns the result of the scan or an error if a payload isn't valid hex
+func (linter *Linter) Lint(replayName string, replayFileInfo ReplayFileInfo) (LintResult, error) {
+    result := LintResult{
+        ReplayName: replayName,
+        Allowed: linter.allowUnscrubbed[replayName],
+    }
+    var hexPayloads []string
+    if replayFileInfo.IsTCP {
+        for _, responseSet := range replayFileInfo.ResponseSets {
+            for _, packet := range responseSet.Packets {
+                hexPayloads = append(hexPayloads, packet.Payload)
+            }
+        }
+    } else {
+        for _, packet := range replayFileInfo.Packets {
+            hexPayloads = append(hexPayloads, packet.Payload)
+        }
+    }
+
+    for i, hexPayload := range hexPayloads {
+        payload, err := hex.DecodeString(hexPayload)
+        if err != nil {
+            return LintResult{}, fmt.Errorf("Packet %d of replay %s has an invalid payload: %v", i, replayName, err)
+        }
+        for _, name := range linter.names {
+            for _, match := range linter.patterns[name].FindAllIndex(payload, -1) {
+                result.NumFindings++
+                if len(result.Findings) == maxLintFindings {
+                    continue
+                }
+                excerpt := payload[match[0]:match[1]]
+                if len(excerpt) > lintExcerptLen {
+                    excerpt = excerpt[:lintExcerptLen]
+                }
+                result.Findings = append(result.Findings, LintFinding{
+                    Pattern: name,
+                    Packet: i,
+                    Offset: match[0],
+                    Excerpt: string(excerpt),
+                })
+            }
+        }
+    }
+    return result, nil
+}
+
+// Scans the payloads of every replay in the tests directory.
+// testsDir: the directory containing a directory for each replay
+// Returns the result of each replay, sorted by replay name, or any errors
+func (linter *Linter) LintDir(testsDir string) ([]LintResult, error) {
+    entries, err := os.ReadDir(testsDir)
+    if err != nil {
+        return nil, err
+    }
+    var results []LintResult
+    for _, entry := range entries {
+        if !entry.IsDir() {
+            continue
+        }
+        replayFileInfo, err := readReplayFile(testsDir, entry.Name())
+        if err != nil {
+            return nil, fmt.Errorf("Unable to load replay %s: %v", entry.Name(), err)
+        }
+        result, err := linter.Lint(entry.Name(), replayFileInfo)
+        if err != nil {
+            return nil, err
+        }
+        results = append(results, result)
+    }
+    return results, nil
+}
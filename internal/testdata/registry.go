@@ -0,0 +1,441 @@
+// Keeps track of the replays available on the server.
+package testdata
+
+import (
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "slices"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    reloadCheckInterval = time.Minute // how often the tests directory is checked for changes
+)
+
+// The IP and port of a server in the original packet capture of a replay
+type Endpoint struct {
+    IP string // IP of the original server
+    Port int // port of the original server
+}
+
+// Information about a replay that is kept in memory without keeping its packets in memory.
+type ReplayMetadata struct {
+    Name string // name of the replay
+    IsTCP bool // true if replay is TCP, false if replay is UDP
+    ServerEndpoints []Endpoint // original servers the replay traffic came from; only known for UDP replays
+    Ports []int // ports the replay runs on, sorted; empty for TCP replays whose replay file doesn't declare them
+    Duration time.Duration // how long the replay lasts, as declared by the replay file or, if it isn't declared, the time the server takes to send its packets; 0 if unknown
+    Bytes int64 // payload bytes the server sends during the replay
+    Provenance *Provenance // where the traffic of the replay came from; nil if the replay file doesn't say
+}
+
+// Gets the average rate the server sends a replay at, to compare against how fast a client's link
+// is before running it.
+// Returns the rate in Mbps, or 0 if the duration of the replay isn't known
+func (metadata ReplayMetadata) AverageMbps() float64 {
+    if metadata.Duration <= 0 {
+        return 0
+    }
+    return float64(metadata.Bytes) * 8 / metadata.Duration.Seconds() / 1000000
+}
+
+// The replays available on the server.
+type Registry struct {
+    testsDir string // directory containing a directory for each replay
+    linter *Linter // checks replays for sensitive content before they are served; nil if replays aren't checked
+    calibration bool // true if the built-in calibration replays are served along with the replays in testsDir
+    replays map[string]ReplayMetadata // metadata of each replay; key is the replay name
+    version int // incremented every time the replays change so that data derived from them can be cached
+    modTime time.Time // modification time of the tests directory when the replays were last loaded
+    mutex sync.RWMutex
+}
+
+// Creates a new Registry and loads the replays in the tests directory.
+// testsDir: the path to a directory containing directories which contain the replay files
+// linter: checks replays for sensitive content before they are served; nil to serve every replay
+// Returns the registry or any errors
+func NewRegistry(testsDir string, linter *Linter) (*Registry, error) {
+    registry := &Registry{
+        testsDir: testsDir,
+        linter: linter,
+        replays: make(map[string]ReplayMetadata),
+    }
+    err := registry.Load()
+    if err != nil {
+        return nil, err
+    }
+    return registry, nil
+}
+
+// Loads the metadata of every replay in the tests directory, replacing the replays currently in the
+// registry. The name of a replay is the name of the directory that the replay file is contained in.
+// Replays that the linter finds sensitive content in are left out unless they are allowed.
+// Returns any errors
+func (registry *Registry) Load() error {
+    info, err := os.Stat(registry.testsDir)
+    if err != nil {
+        return err
+    }
+    entries, err := os.ReadDir(registry.testsDir)
+    if err != nil {
+        return err
+    }
+
+    replays := make(map[string]ReplayMetadata)
+    for _, entry := range entries {
+        if !entry.IsDir() {
+            continue
+        }
+        replayFileInfo, err := readReplayFile(registry.testsDir, entry.Name())
+        if err != nil {
+            return fmt.Errorf("Unable to load replay %s: %v", entry.Name(), err)
+        }
+        if registry.linter != nil {
+            serve, err := registry.lint(entry.Name(), replayFileInfo)
+            if err != nil {
+                return err
+            }
+            if !serve {
+                continue
+            }
+        }
+        metadata, err := newReplayMetadata(entry.Name(), replayFileInfo)
+        if err != nil {
+            return fmt.Errorf("Unable to load replay %s: %v", entry.Name(), err)
+        }
+        replays[entry.Name()] = metadata
+    }
+
+    registry.mutex.Lock()
+    defer registry.mutex.Unlock()
+    if registry.calibration {
+        err = addCalibrationReplays(replays)
+        if err != nil {
+            return err
+        }
+    }
+    registry.replays = replays
+    registry.version++
+    registry.modTime = info.ModTime()
+    return nil
+}
+
+// Serves the built-in calibration replays along with the replays in the tests directory, now and
+// after every reload.
+// Returns an error if a replay in the tests directory has the name of a calibration replay
+func (registry *Registry) EnableCalibration() error {
+    registry.mutex.Lock()
+    defer registry.mutex.Unlock()
+    replays := make(map[string]ReplayMetadata, len(registry.replays))
+    for name, metadata := range registry.replays {
+        replays[name] = metadata
+    }
+    err := addCalibrationReplays(replays)
+    if err != nil {
+        return err
+    }
+    registry.calibration = true
+    registry.replays = replays
+    registry.version++
+    return nil
+}
+
+// Adds the metadata of the calibration replays to a set of replays.
+// replays: the metadata of each replay; key is the replay name
+// Returns an error if one of the replays has the name of a calibration replay
+func addCalibrationReplays(replays map[string]ReplayMetadata) error {
+    for replayName := range calibrationSeeds {
+        _, exists := replays[replayName]
+        if exists {
+            return fmt.Errorf("Replay %s in the tests directory has the name of a built-in calibration replay", replayName)
+        }
+        metadata, err := newReplayMetadata(replayName, calibrationReplayFile(replayName))
+        if err != nil {
+            return err
+        }
+        replays[replayName] = metadata
+    }
+    return nil
+}
+
+// Reloads the replays whenever the tests directory changes, e.g. when the update subcommand swaps in
+// new replays, so that they are served without restarting the server. If the new replays can't be
+// loaded, the previous ones keep being served. This function should be run in a new thread, as it
+// never returns.
+// onReload: called after the replays are reloaded, e.g. to listen on the ports of new replays; nil if
+//     nothing depends on the replays changing
+func (registry *Registry) WatchForChanges(onReload func()) {
+    for {
+        time.Sleep(reloadCheckInterval)
+        info, err := os.Stat(registry.testsDir)
+        if err != nil {
+            continue
+        }
+        registry.mutex.RLock()
+        loadedModTime := registry.modTime
+        registry.mutex.RUnlock()
+        if info.ModTime().Equal(loadedModTime) {
+            continue
+        }
+        err = registry.Load()
+        if err != nil {
+            slog.Error("Unable to reload replays", "error", err)
+            continue
+        }
+        slog.Info("Reloaded replays", "dir", registry.testsDir, "replays", strings.Join(registry.Names(), ", "))
+        if onReload != nil {
+            onReload()
+        }
+    }
+}
+
+// Checks that every replay in a tests directory can be served, with the same checks that are run
+// when replays are loaded and first replayed, without adding them to a registry. Used to check new
+// replays before they replace the ones being served.
+// testsDir: the path to a directory containing directories which contain the replay files
+// linter: checks replays for sensitive content; nil to skip the check
+// Returns the names of the replays, sorted alphabetically, or an error describing the first replay
+//     that can't be served
+func ValidateDir(testsDir string, linter *Linter) ([]string, error) {
+    entries, err := os.ReadDir(testsDir)
+    if err != nil {
+        return nil, err
+    }
+    var names []string
+    for _, entry := range entries {
+        if !entry.IsDir() {
+            continue
+        }
+        replayFileInfo, err := readReplayFile(testsDir, entry.Name())
+        if err != nil {
+            return nil, fmt.Errorf("Unable to load replay %s: %v", entry.Name(), err)
+        }
+        _, err = newReplayMetadata(entry.Name(), replayFileInfo)
+        if err != nil {
+            return nil, fmt.Errorf("Unable to load replay %s: %v", entry.Name(), err)
+        }
+        _, err = parseReplay(replayFileInfo, newPayloadStore())
+        if err != nil {
+            return nil, fmt.Errorf("Unable to parse replay %s: %v", entry.Name(), err)
+        }
+        if linter != nil {
+            result, err := linter.Lint(entry.Name(), replayFileInfo)
+            if err != nil {
+                return nil, err
+            }
+            if result.NumFindings > 0 && !result.Allowed {
+                return nil, fmt.Errorf("Replay %s contains %d matches of sensitive content, e.g. %v", entry.Name(), result.NumFindings, result.Findings[0])
+            }
+        }
+        names = append(names, entry.Name())
+    }
+    if len(names) == 0 {
+        return nil, fmt.Errorf("No replays found in %s", testsDir)
+    }
+    sort.Strings(names)
+    return names, nil
+}
+
+// Checks a replay for sensitive content and prints what was found.
+// replayName: the name of the replay
+// replayFileInfo: the contents of the replay file
+// Returns true if the replay can be served, or any errors
+func (registry *Registry) lint(replayName string, replayFileInfo ReplayFileInfo) (bool, error) {
+    result, err := registry.linter.Lint(replayName, replayFileInfo)
+    if err != nil {
+        return false, err
+    }
+    if result.NumFindings == 0 {
+        return true, nil
+    }
+    if result.Allowed {
+        slog.Warn("Replay contains sensitive content but is allowed to be served", "replay", replayName, "matches", result.NumFindings)
+        return true, nil
+    }
+    // the excerpt of the match is left out so that the sensitive content doesn't end up in the logs
+    slog.Warn("Not serving replay: it contains sensitive content", "replay", replayName, "matches", result.NumFindings,
+        "pattern", result.Findings[0].Pattern, "packet", result.Findings[0].Packet, "offset", result.Findings[0].Offset)
+    return false, nil
+}
+
+// Gets the names of all the replays, sorted alphabetically.
+// Returns the replay names
+func (registry *Registry) Names() []string {
+    registry.mutex.RLock()
+    defer registry.mutex.RUnlock()
+    var names []string
+    for name := range registry.replays {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// Gets the metadata of a replay.
+// replayName: the name of the replay
+// Returns the metadata of the replay and true if the replay exists
+func (registry *Registry) Get(replayName string) (ReplayMetadata, bool) {
+    registry.mutex.RLock()
+    defer registry.mutex.RUnlock()
+    metadata, exists := registry.replays[replayName]
+    return metadata, exists
+}
+
+// Gets the metadata of all the replays, sorted by replay name.
+// Returns the metadata of all replays
+func (registry *Registry) All() []ReplayMetadata {
+    registry.mutex.RLock()
+    defer registry.mutex.RUnlock()
+    var replays []ReplayMetadata
+    for _, metadata := range registry.replays {
+        replays = append(replays, metadata)
+    }
+    sort.Slice(replays, func(i int, j int) bool {
+        return replays[i].Name < replays[j].Name
+    })
+    return replays
+}
+
+// Gets the ports the replays run on, so that the replay servers can listen on exactly the ports the
+// replays need. TCP replays whose replay files don't declare their ports aren't included.
+// Returns the TCP ports and the UDP ports, each sorted
+func (registry *Registry) Ports() ([]int, []int) {
+    registry.mutex.RLock()
+    defer registry.mutex.RUnlock()
+    var tcpPorts []int
+    var udpPorts []int
+    for _, metadata := range registry.replays {
+        if metadata.IsTCP {
+            tcpPorts = append(tcpPorts, metadata.Ports...)
+        } else {
+            udpPorts = append(udpPorts, metadata.Ports...)
+        }
+    }
+    slices.Sort(tcpPorts)
+    slices.Sort(udpPorts)
+    return slices.Compact(tcpPorts), slices.Compact(udpPorts)
+}
+
+// Gets the version of the replays, which changes every time the replays are reloaded.
+// Returns the version
+func (registry *Registry) Version() int {
+    registry.mutex.RLock()
+    defer registry.mutex.RUnlock()
+    return registry.version
+}
+
+// Checks if a replay can be run on a port. A replay only runs over its own protocol, and only on its
+// ports if they are known. TCP replays whose replay files don't declare their ports can run on any
+// TCP port.
+// isTCP: true if the port is a TCP port, false if it is a UDP port
+// port: the port
+// Returns true if the replay can be run on the port
+func (metadata ReplayMetadata) AllowsPort(isTCP bool, port int) bool {
+    if metadata.IsTCP != isTCP {
+        return false
+    }
+    return len(metadata.Ports) == 0 || slices.Contains(metadata.Ports, port)
+}
+
+// Builds the metadata of a replay from its replay file.
+// replayName: the name of the replay
+// replayFileInfo: the contents of the replay file
+// Returns the metadata or any errors
+func newReplayMetadata(replayName string, replayFileInfo ReplayFileInfo) (ReplayMetadata, error) {
+    metadata := ReplayMetadata{
+        Name: replayName,
+        IsTCP: replayFileInfo.IsTCP,
+        Duration: time.Duration(replayFileInfo.Duration * float64(time.Second)),
+    }
+
+    if len(replayFileInfo.Ports) > 0 && !replayFileInfo.IsTCP {
+        return ReplayMetadata{}, fmt.Errorf("Ports can only be declared by TCP replays; UDP replays run on the ports in their c_s_pairs")
+    }
+    if replayFileInfo.Provenance != nil && *replayFileInfo.Provenance != (Provenance{}) {
+        provenance := *replayFileInfo.Provenance
+        if provenance.CaptureDate != "" {
+            _, err := time.Parse(time.DateOnly, provenance.CaptureDate)
+            if err != nil {
+                return ReplayMetadata{}, fmt.Errorf("Capture date %s is not a date in the form YYYY-MM-DD", provenance.CaptureDate)
+            }
+        }
+        metadata.Provenance = &provenance
+    }
+    for _, port := range replayFileInfo.Ports {
+        if port < 1 || port > 65535 {
+            return ReplayMetadata{}, fmt.Errorf("Port %d is not a valid port number", port)
+        }
+        metadata.Ports = append(metadata.Ports, port)
+    }
+
+    seen := make(map[Endpoint]bool)
+    var lastTimestamp float64
+    for _, packet := range replayFileInfo.Packets {
+        endpoint, err := parseServerEndpoint(packet.CSPair)
+        if err != nil {
+            return ReplayMetadata{}, err
+        }
+        if !seen[endpoint] {
+            seen[endpoint] = true
+            metadata.ServerEndpoints = append(metadata.ServerEndpoints, endpoint)
+            metadata.Ports = append(metadata.Ports, endpoint.Port)
+        }
+        lastTimestamp = max(lastTimestamp, packet.Timestamp)
+        // payloads are hex encoded
+        metadata.Bytes += int64(len(packet.Payload) / 2)
+    }
+    // the response sets of a TCP replay are sent one after another, each starting after its think
+    // time; the time the client takes to send the requests isn't known
+    for _, responseSet := range replayFileInfo.ResponseSets {
+        var responseTime float64
+        for _, packet := range responseSet.Packets {
+            responseTime = max(responseTime, packet.Timestamp)
+            metadata.Bytes += int64(len(packet.Payload) / 2)
+        }
+        lastTimestamp += responseSet.ThinkTime + responseTime
+    }
+    slices.Sort(metadata.Ports)
+    metadata.Ports = slices.Compact(metadata.Ports)
+    if metadata.Duration == 0 {
+        metadata.Duration = time.Duration(lastTimestamp * float64(time.Second))
+    }
+    return metadata, nil
+}
+
+// Gets the server IP and port from a client & server pair.
+// csPair: the client & server of the original packet capture, in the form
+//     {client_IP}.{client_port}-{server_IP}.{server_port}
+// Returns the server endpoint or any errors
+func parseServerEndpoint(csPair string) (Endpoint, error) {
+    pieces := strings.Split(csPair, "-")
+    if len(pieces) != 2 {
+        return Endpoint{}, fmt.Errorf("Invalid c_s_pair: %s", csPair)
+    }
+    server := pieces[1]
+    portIndex := strings.LastIndex(server, ".")
+    if portIndex == -1 {
+        return Endpoint{}, fmt.Errorf("Invalid c_s_pair: %s", csPair)
+    }
+    port, err := strconv.Atoi(server[portIndex + 1:])
+    if err != nil || port < 0 || port > 65535 {
+        return Endpoint{}, fmt.Errorf("Invalid port in c_s_pair: %s", csPair)
+    }
+    return Endpoint{
+        IP: server[:portIndex],
+        Port: port,
+    }, nil
+}
+
+// Gets the path of a replay file, which is testsDir/replayName/replayName.pcap_server_all.json
+// testsDir: the directory containing a directory for each replay
+// replayName: the name of the replay
+// Returns the path of the replay file
+func replayFilePath(testsDir string, replayName string) string {
+    return filepath.Join(testsDir, replayName, replayName + ".pcap_server_all.json")
+}
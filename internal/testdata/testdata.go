@@ -2,17 +2,12 @@
 package testdata
 
 import (
-    "encoding/hex"
     "encoding/json"
+    "fmt"
     "os"
-    "path/filepath"
     "time"
 )
 
-const (
-    replaysRoot = "res/replays/"
-)
-
 type ReplayInfo struct {
     Responses []Response
     ReplayName string
@@ -28,43 +23,50 @@ type Response interface {
 type TCPResponseSet struct {
     RequestLength int // number of bytes that server should receive before sending the packets
     RequestHash string // hash of the bytes received from client
+    ThinkTime time.Duration // time the original server took to start responding after receiving the request
     Packets []TCPPacket // packets to send to client once server has received RequestLength packets
 }
 
 // A TCP packet to be sent as part of a replay
 type TCPPacket struct {
-    Timestamp time.Duration // time since the last packet received from the client that this packet should be sent
-    Payload []byte // the bytes to send to the server
+    Timestamp time.Duration // time since the first packet of the response set that this packet should be sent
+    Payload Payload // the bytes to send to the server
 }
 
-func newTCPPacket(timestamp float64, payload string) (TCPPacket, error) {
-    payloadBytes, err := hex.DecodeString(payload)
+func newTCPPacket(timestamp float64, payload string, store *payloadStore) (TCPPacket, error) {
+    sharedPayload, err := store.add(payload)
     if err != nil {
         return TCPPacket{}, err
     }
     return TCPPacket{
         Timestamp: time.Duration(timestamp * float64(time.Second)),
-        Payload: payloadBytes,
+        Payload: sharedPayload,
     }, nil
 }
 
 // A UDP packet to be sent as part of a replay
 type UDPPacket struct {
     CSPair string // the client & server of original packet capture, in the form {client_IP}.{client_port}-{server_IP}.{server_port}
+    ServerPort int // the port of the server in CSPair; the packet is sent from the replay server on this port
     Timestamp time.Duration // time since the start of the replay when this packet should be sent
-    Payload []byte // the bytes to send to the server
+    Payload Payload // the bytes to send to the server
     End bool // ???
 }
 
-func newUDPPacket(csPair string, timestamp float64, payload string, end bool) (UDPPacket, error) {
-    payloadBytes, err := hex.DecodeString(payload)
+func newUDPPacket(csPair string, timestamp float64, payload string, end bool, store *payloadStore) (UDPPacket, error) {
+    server, err := parseServerEndpoint(csPair)
+    if err != nil {
+        return UDPPacket{}, err
+    }
+    sharedPayload, err := store.add(payload)
     if err != nil {
         return UDPPacket{}, err
     }
     return UDPPacket{
-        CSPair: csPair,
+        CSPair: store.addString(csPair),
+        ServerPort: server.Port,
         Timestamp: time.Duration(timestamp * float64(time.Second)),
-        Payload: payloadBytes,
+        Payload: sharedPayload,
         End: end,
     }, nil
 }
@@ -73,13 +75,31 @@ func newUDPPacket(csPair string, timestamp float64, payload string, end bool) (U
 type ReplayFileInfo struct {
     ReplayName string `json:"test_name"` // name of the replay
     IsTCP bool `json:"is_tcp"` // true if replay is TCP, false if replay is UDP
+    // number of seconds the replay lasts; optional, since older replay files don't record it
+    Duration float64 `json:"duration"`
+    // ports of the original server of a TCP replay; optional, since older replay files don't record
+    // them. UDP replays record their ports in the c_s_pair of each packet.
+    Ports []int `json:"ports"`
+    // where the traffic of the replay came from; optional, since older replay files don't record it
+    Provenance *Provenance `json:"provenance"`
     Packets []UDPReplayFilePacket `json:"packets"` // the list of packets that are sent to the client
     ResponseSets []ResponseSet `json:"response_sets"`
 }
 
+// Where the traffic of a replay came from, so that datasets that publish the results of the replay
+// can document it. Every field is optional.
+type Provenance struct {
+    CaptureDate string `json:"capture_date,omitempty"` // the day the app session was captured, as YYYY-MM-DD
+    CaptureLocation string `json:"capture_location,omitempty"` // where the app session was captured, e.g. the city and network
+    UsageNotes string `json:"usage_notes,omitempty"` // terms, attribution, or anything else users of the traffic should know
+}
+
 type ResponseSet struct {
     RequestLength int `json:"request_length"`
     RequestHash string `json:"request_hash"`
+    // number of seconds between the server receiving the request and sending the first packet of the
+    // response in the original capture; optional, since older replay files don't record it
+    ThinkTime float64 `json:"think_time"`
     Packets []TCPReplayFilePacket `json:"packets"`
 }
 
@@ -96,32 +116,21 @@ type UDPReplayFilePacket struct {
     End bool `json:"end"` // ???
 }
 
-// Loads the tests from disk.
-// replayName: the name of the replay to load.
+// Converts the contents of a replay file into the packets to send to the client.
+// replayFileInfo: the contents of the replay file
+// store: where the payloads are kept so that they can be shared with other replays
 // Returns information about the replay along with the list of packets to send to the client, or any errors
-func ParseReplayJSON(replayName string) (ReplayInfo, error) {
-    // get the filepath, which is replayRootFolder/replayName/replayName.pcap_server_all.json
-    replayFile := filepath.Join(replaysRoot, replayName, replayName + ".pcap_server_all.json")
-    // read in the file
-    data, err := os.ReadFile(replayFile)
-    if err != nil {
-        return ReplayInfo{}, err
-    }
-
-    // unpack as json object
-    var replayFileInfo ReplayFileInfo
-    err = json.Unmarshal(data, &replayFileInfo)
-    if err != nil {
-        return ReplayInfo{}, err
-    }
-
+func parseReplay(replayFileInfo ReplayFileInfo, store *payloadStore) (ReplayInfo, error) {
     var responses []Response
     if replayFileInfo.IsTCP {
         // tcp replays
-        for _, responseSet := range replayFileInfo.ResponseSets {
+        for i, responseSet := range replayFileInfo.ResponseSets {
+            if responseSet.ThinkTime < 0 {
+                return ReplayInfo{}, fmt.Errorf("Response set %d has a negative think time: %f", i, responseSet.ThinkTime)
+            }
             var packets []TCPPacket
             for _, tcpReplayFilePacket := range responseSet.Packets {
-                tcpPacket, err := newTCPPacket(tcpReplayFilePacket.Timestamp, tcpReplayFilePacket.Payload)
+                tcpPacket, err := newTCPPacket(tcpReplayFilePacket.Timestamp, tcpReplayFilePacket.Payload, store)
                 if err != nil {
                     return ReplayInfo{}, err
                 }
@@ -130,6 +139,7 @@ func ParseReplayJSON(replayName string) (ReplayInfo, error) {
             tcpResponseSet := TCPResponseSet{
                 RequestLength: responseSet.RequestLength,
                 RequestHash: responseSet.RequestHash,
+                ThinkTime: time.Duration(responseSet.ThinkTime * float64(time.Second)),
                 Packets: packets,
             }
             responses = append(responses, tcpResponseSet)
@@ -137,7 +147,7 @@ func ParseReplayJSON(replayName string) (ReplayInfo, error) {
     } else {
         // udp replays
         for _, udpReplayFilePacket := range replayFileInfo.Packets {
-            udpPacket, err := newUDPPacket(udpReplayFilePacket.CSPair, udpReplayFilePacket.Timestamp, udpReplayFilePacket.Payload, udpReplayFilePacket.End)
+            udpPacket, err := newUDPPacket(udpReplayFilePacket.CSPair, udpReplayFilePacket.Timestamp, udpReplayFilePacket.Payload, udpReplayFilePacket.End, store)
             if err != nil {
                 return ReplayInfo{}, err
             }
@@ -151,3 +161,23 @@ func ParseReplayJSON(replayName string) (ReplayInfo, error) {
         IsTCP: replayFileInfo.IsTCP,
     }, nil
 }
+
+// Reads a replay file from disk and unpacks it.
+// testsDir: the directory containing a directory for each replay
+// replayName: the name of the replay to read
+// Returns the contents of the replay file or any errors
+func readReplayFile(testsDir string, replayName string) (ReplayFileInfo, error) {
+    // read in the file
+    data, err := os.ReadFile(replayFilePath(testsDir, replayName))
+    if err != nil {
+        return ReplayFileInfo{}, err
+    }
+
+    // unpack as json object
+    var replayFileInfo ReplayFileInfo
+    err = json.Unmarshal(data, &replayFileInfo)
+    if err != nil {
+        return ReplayFileInfo{}, err
+    }
+    return replayFileInfo, nil
+}
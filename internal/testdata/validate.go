@@ -0,0 +1,198 @@
+// Checks replay files for problems without serving them. The checks run when replays are loaded stop
+// at the first problem, and some problems, such as timestamps that go backwards, only show when a
+// client runs the replay. Validation reads every replay file and reports all of its problems at once.
+package testdata
+
+import (
+    "encoding/hex"
+    "fmt"
+    "os"
+    "slices"
+    "sort"
+    "time"
+)
+
+const (
+    maxValidationProblems = 20 // problems recorded per replay; the rest are counted but not recorded
+    requestHashLen = 40 // length of a request hash, the hex SHA-1 hash of the request
+)
+
+// The ports the replay servers listen on besides the ports of the replays.
+type PortCoverage struct {
+    TCPPorts []int // the TCP ports in the port numbers file, which TCP replays without declared ports run on
+    ReservedTCPPorts []int // TCP ports the server uses for something other than replays, e.g. the side channel
+}
+
+// The problems found in a replay.
+type ValidationResult struct {
+    ReplayName string // name of the replay
+    Problems []string // the first maxValidationProblems problems
+    NumProblems int // the total number of problems
+}
+
+// Adds a problem to the result of a replay.
+// format: the format of the problem, as for fmt.Sprintf
+// args: the values of the format
+func (result *ValidationResult) addProblem(format string, args ...any) {
+    result.NumProblems++
+    if len(result.Problems) < maxValidationProblems {
+        result.Problems = append(result.Problems, fmt.Sprintf(format, args...))
+    }
+}
+
+// Checks every replay in a tests directory: that its replay file parses, that it is a consistent TCP
+// or UDP replay, that its request hashes, payloads, and timestamps are well formed, and that its
+// ports can be listened on. Nothing is listened on.
+// testsDir: the directory containing a directory for each replay
+// ports: the ports the replay servers listen on besides the ports of the replays
+// Returns the result of each replay, sorted by replay name, or any errors
+func ValidateReplays(testsDir string, ports PortCoverage) ([]ValidationResult, error) {
+    entries, err := os.ReadDir(testsDir)
+    if err != nil {
+        return nil, err
+    }
+    var results []ValidationResult
+    for _, entry := range entries {
+        if !entry.IsDir() {
+            continue
+        }
+        results = append(results, validateReplay(testsDir, entry.Name(), ports))
+    }
+    if len(results) == 0 {
+        return nil, fmt.Errorf("No replays found in %s", testsDir)
+    }
+    sort.Slice(results, func(i int, j int) bool {
+        return results[i].ReplayName < results[j].ReplayName
+    })
+    return results, nil
+}
+
+// Checks one replay in a tests directory.
+// testsDir: the directory containing a directory for each replay
+// replayName: the name of the replay
+// ports: the ports the replay servers listen on besides the ports of the replays
+// Returns the problems found in the replay
+func validateReplay(testsDir string, replayName string, ports PortCoverage) ValidationResult {
+    result := ValidationResult{ReplayName: replayName}
+    replayFileInfo, err := readReplayFile(testsDir, replayName)
+    if err != nil {
+        result.addProblem("Unable to read replay file: %v", err)
+        return result
+    }
+    if replayFileInfo.ReplayName != replayName {
+        result.addProblem("test_name %q doesn't match the name of its directory", replayFileInfo.ReplayName)
+    }
+    if replayFileInfo.Duration < 0 {
+        result.addProblem("Negative duration: %f", replayFileInfo.Duration)
+    }
+    if replayFileInfo.Provenance != nil && replayFileInfo.Provenance.CaptureDate != "" {
+        _, err = time.Parse(time.DateOnly, replayFileInfo.Provenance.CaptureDate)
+        if err != nil {
+            result.addProblem("Capture date %s is not a date in the form YYYY-MM-DD", replayFileInfo.Provenance.CaptureDate)
+        }
+    }
+
+    if replayFileInfo.IsTCP {
+        validateTCPReplay(&result, replayFileInfo, ports)
+    } else {
+        validateUDPReplay(&result, replayFileInfo)
+    }
+    return result
+}
+
+// Checks the response sets and ports of a TCP replay.
+// result: where the problems are added
+// replayFileInfo: the contents of the replay file
+// ports: the ports the replay servers listen on besides the ports of the replays
+func validateTCPReplay(result *ValidationResult, replayFileInfo ReplayFileInfo, ports PortCoverage) {
+    if len(replayFileInfo.Packets) > 0 {
+        result.addProblem("TCP replay has %d UDP packets; its packets belong in response_sets", len(replayFileInfo.Packets))
+    }
+    if len(replayFileInfo.ResponseSets) == 0 {
+        result.addProblem("TCP replay has no response sets")
+    }
+    for i, responseSet := range replayFileInfo.ResponseSets {
+        if responseSet.RequestLength < 0 {
+            result.addProblem("Response set %d has a negative request length: %d", i, responseSet.RequestLength)
+        }
+        if responseSet.RequestHash != "" && !isHex(responseSet.RequestHash, requestHashLen) {
+            result.addProblem("Response set %d has a request hash that isn't %d hex digits: %q", i, requestHashLen, responseSet.RequestHash)
+        }
+        if responseSet.ThinkTime < 0 {
+            result.addProblem("Response set %d has a negative think time: %f", i, responseSet.ThinkTime)
+        }
+        lastTimestamp := 0.0
+        for j, packet := range responseSet.Packets {
+            if packet.Timestamp < lastTimestamp {
+                result.addProblem("Packet %d of response set %d is sent at %f, before the packet before it at %f", j, i, packet.Timestamp, lastTimestamp)
+            }
+            lastTimestamp = max(lastTimestamp, packet.Timestamp)
+            if !isHex(packet.Payload, -1) {
+                result.addProblem("Packet %d of response set %d has a payload that isn't hex", j, i)
+            }
+        }
+    }
+
+    // replays without declared ports run on the TCP ports of the port numbers file
+    if len(replayFileInfo.Ports) == 0 && len(ports.TCPPorts) == 0 {
+        result.addProblem("TCP replay declares no ports, and the port numbers file lists no TCP ports for it to run on")
+    }
+    for _, port := range replayFileInfo.Ports {
+        if port < 1 || port > 65535 {
+            result.addProblem("Port %d is not a valid port number", port)
+        } else if slices.Contains(ports.ReservedTCPPorts, port) {
+            result.addProblem("TCP port %d is used by the server for something other than replays", port)
+        }
+    }
+}
+
+// Checks the packets and ports of a UDP replay. UDP replays run on the ports in their c_s_pairs,
+// which the replay servers always listen on.
+// result: where the problems are added
+// replayFileInfo: the contents of the replay file
+func validateUDPReplay(result *ValidationResult, replayFileInfo ReplayFileInfo) {
+    if len(replayFileInfo.ResponseSets) > 0 {
+        result.addProblem("UDP replay has %d TCP response sets; its packets belong in packets", len(replayFileInfo.ResponseSets))
+    }
+    if len(replayFileInfo.Packets) == 0 {
+        result.addProblem("UDP replay has no packets")
+    }
+    if len(replayFileInfo.Ports) > 0 {
+        result.addProblem("UDP replay declares ports; UDP replays run on the ports in their c_s_pairs")
+    }
+    // each flow is sent in order, so timestamps only need to go forward within a flow
+    lastTimestamps := make(map[string]float64)
+    portZero := false
+    for i, packet := range replayFileInfo.Packets {
+        endpoint, err := parseServerEndpoint(packet.CSPair)
+        if err != nil {
+            result.addProblem("Packet %d: %v", i, err)
+        } else if endpoint.Port == 0 && !portZero {
+            portZero = true
+            result.addProblem("UDP port 0 in c_s_pair %s can't be listened on", packet.CSPair)
+        }
+        if packet.Timestamp < 0 {
+            result.addProblem("Packet %d has a negative timestamp: %f", i, packet.Timestamp)
+        }
+        lastTimestamp, seen := lastTimestamps[packet.CSPair]
+        if seen && packet.Timestamp < lastTimestamp {
+            result.addProblem("Packet %d of %s is sent at %f, before the packet before it at %f", i, packet.CSPair, packet.Timestamp, lastTimestamp)
+        }
+        lastTimestamps[packet.CSPair] = max(lastTimestamp, packet.Timestamp)
+        if !isHex(packet.Payload, -1) {
+            result.addProblem("Packet %d has a payload that isn't hex", i)
+        }
+    }
+}
+
+// Checks if a string is hex encoded.
+// str: the string
+// length: the number of hex digits the string must have; -1 for any even number
+// Returns true if the string is hex encoded
+func isHex(str string, length int) bool {
+    if length >= 0 && len(str) != length {
+        return false
+    }
+    _, err := hex.DecodeString(str)
+    return err == nil
+}
@@ -0,0 +1,252 @@
+// Fetches new replays and the list of test ports, and installs them in place of the ones on disk.
+// A source is either a .tar.gz archive served over HTTP(S) or a git repository, and contains a
+// replays directory, laid out like the tests directory, and a portNumbers.json file. Everything is
+// fetched into a staging directory next to the tests directory so that the new replays can be
+// renamed into place instead of copied over the old ones while they are being served.
+package update
+
+import (
+    "archive/tar"
+    "compress/gzip"
+    "context"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "wehe-server/internal/retry"
+)
+
+const (
+    ReplaysDirName = "replays" // directory of a source that contains a directory for each replay
+    PortNumbersFileName = "portNumbers.json" // file of a source that lists the test ports
+    downloadTimeout = 5 * time.Minute // how long downloading an archive can take
+    maxExtractedBytes = 4 << 30 // largest total size of the files extracted from an archive, in bytes
+)
+
+var (
+    // an operator is waiting on the update, so it isn't retried for long
+    downloadPolicy = retry.Policy{
+        Operation: "replay_update_download",
+        MaxAttempts: 4,
+        InitialDelay: 2 * time.Second,
+        MaxDelay: 30 * time.Second,
+        Jitter: 0.5,
+    }
+)
+
+// Fetches a source into a directory.
+// source: URL of a .tar.gz archive, or of a git repository, i.e. one ending in .git or starting with
+//     git@ or git://
+// dir: an empty directory to fetch the source into
+// Returns the directory within dir that contains the replays directory and the port numbers file,
+//     or any errors
+func Fetch(source string, dir string) (string, error) {
+    var err error
+    if isGitSource(source) {
+        err = cloneRepo(source, dir)
+    } else {
+        err = downloadArchive(source, dir)
+    }
+    if err != nil {
+        return "", err
+    }
+    return findRoot(dir)
+}
+
+// Checks if a source is a git repository rather than an archive.
+// source: the source
+// Returns true if the source should be cloned with git
+func isGitSource(source string) bool {
+    return strings.HasSuffix(source, ".git") || strings.HasPrefix(source, "git@") || strings.HasPrefix(source, "git://")
+}
+
+// Clones the latest commit of a git repository.
+// url: the URL of the repository
+// dir: the directory to clone into
+// Returns any errors
+func cloneRepo(url string, dir string) error {
+    // -- keeps a URL that starts with - from being taken as an option, e.g. --upload-pack, which
+    // runs a command
+    output, err := exec.Command("git", "clone", "--depth", "1", "--", url, dir).CombinedOutput()
+    if err != nil {
+        return fmt.Errorf("Unable to clone %s: %v: %s", url, err, strings.TrimSpace(string(output)))
+    }
+    return nil
+}
+
+// Downloads a .tar.gz archive and extracts it.
+// url: the URL of the archive
+// dir: the directory to extract the archive into
+// Returns any errors
+func downloadArchive(url string, dir string) error {
+    client := http.Client{Timeout: downloadTimeout}
+    var resp *http.Response
+    // only the request is retried; an archive that fails part way through extracting has already
+    // written some of its files
+    err := downloadPolicy.Do(context.Background(), func(ctx context.Context) error {
+        req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+        if err != nil {
+            return retry.Permanent(err)
+        }
+        resp, err = client.Do(req)
+        if err != nil {
+            return err
+        }
+        if resp.StatusCode != http.StatusOK {
+            resp.Body.Close()
+            err = fmt.Errorf("Unable to download %s: status %s", url, resp.Status)
+            if !retry.Retryable(resp.StatusCode) {
+                return retry.Permanent(err)
+            }
+            return err
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    gzipReader, err := gzip.NewReader(resp.Body)
+    if err != nil {
+        return fmt.Errorf("Unable to decompress %s: %v", url, err)
+    }
+    defer gzipReader.Close()
+    return extractTar(gzipReader, dir)
+}
+
+// Extracts the directories and regular files of a tar archive. Entries with paths that would land
+// outside of dir, and entries of any other type, such as links, are rejected.
+// reader: the tar archive
+// dir: the directory to extract the archive into
+// Returns any errors
+func extractTar(reader io.Reader, dir string) error {
+    tarReader := tar.NewReader(reader)
+    var extracted int64
+    for {
+        header, err := tarReader.Next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if !filepath.IsLocal(header.Name) {
+            return fmt.Errorf("Archive entry %s is outside of the archive", header.Name)
+        }
+        path := filepath.Join(dir, header.Name)
+        switch header.Typeflag {
+        case tar.TypeDir:
+            err = os.MkdirAll(path, 0755)
+        case tar.TypeReg:
+            extracted += header.Size
+            if extracted > maxExtractedBytes {
+                return fmt.Errorf("Archive is larger than %d bytes", maxExtractedBytes)
+            }
+            err = writeFile(path, tarReader)
+        default:
+            return fmt.Errorf("Archive entry %s is not a regular file or directory", header.Name)
+        }
+        if err != nil {
+            return err
+        }
+    }
+}
+
+// Writes a file, creating its directory if needed.
+// path: the path of the file
+// reader: the contents of the file
+// Returns any errors
+func writeFile(path string, reader io.Reader) error {
+    err := os.MkdirAll(filepath.Dir(path), 0755)
+    if err != nil {
+        return err
+    }
+    file, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    _, err = io.Copy(file, reader)
+    return err
+}
+
+// Finds the directory of a fetched source that contains the replays directory. Archives often wrap
+// everything in one top-level directory, e.g. the archives GitHub makes of a repository, so that
+// directory is looked in as well.
+// dir: the directory the source was fetched into
+// Returns the directory that contains the replays directory or an error if there isn't one
+func findRoot(dir string) (string, error) {
+    candidates := []string{dir}
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return "", err
+    }
+    if len(entries) == 1 && entries[0].IsDir() {
+        candidates = append(candidates, filepath.Join(dir, entries[0].Name()))
+    }
+    for _, candidate := range candidates {
+        info, err := os.Stat(filepath.Join(candidate, ReplaysDirName))
+        if err == nil && info.IsDir() {
+            return candidate, nil
+        }
+    }
+    return "", fmt.Errorf("Source has no %s directory", ReplaysDirName)
+}
+
+// Swaps a new directory in for an existing one with two renames, so that the existing directory is
+// never partly overwritten. Readers that look at the path between the renames find nothing there and
+// keep what they loaded before. Both directories must be on the same file system.
+// newDir: the directory to move into place
+// dir: the directory to replace
+// oldDir: where the replaced directory is moved to; it must not exist
+// Returns any errors; if the new directory can't be moved into place, the old one is put back
+func SwapDir(newDir string, dir string, oldDir string) error {
+    err := os.Rename(dir, oldDir)
+    if err != nil {
+        return err
+    }
+    err = os.Rename(newDir, dir)
+    if err != nil {
+        restoreErr := os.Rename(oldDir, dir)
+        if restoreErr != nil {
+            return fmt.Errorf("Unable to move %s to %s: %v; the previous directory is at %s: %v", newDir, dir, err, oldDir, restoreErr)
+        }
+        return err
+    }
+    return nil
+}
+
+// Replaces a file with a copy of another by writing the copy next to it and renaming it into place,
+// so that the file is never partly written.
+// newFile: the file to copy
+// file: the file to replace
+// Returns any errors
+func ReplaceFile(newFile string, file string) error {
+    data, err := os.ReadFile(newFile)
+    if err != nil {
+        return err
+    }
+    tmpFile, err := os.CreateTemp(filepath.Dir(file), "." + filepath.Base(file) + "-")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmpFile.Name())
+    _, err = tmpFile.Write(data)
+    closeErr := tmpFile.Close()
+    if err != nil {
+        return err
+    }
+    if closeErr != nil {
+        return closeErr
+    }
+    err = os.Chmod(tmpFile.Name(), 0644)
+    if err != nil {
+        return err
+    }
+    return os.Rename(tmpFile.Name(), file)
+}
@@ -0,0 +1,201 @@
+// Envelope encryption of uploaded results, so that the object store never sees plaintext
+// measurements. Each archive is encrypted with its own random AES-256-GCM data key, and the data key
+// is wrapped with an RSA public key from the config using RSA-OAEP with SHA-256. Only the analysis
+// host holds the private key, so a node that is compromised later can't read what it uploaded.
+//
+// An encrypted archive is laid out as:
+//     magic (8 bytes) | SHA-256 of the public key (32) | length of the wrapped key (2, big endian) |
+//     wrapped key | GCM nonce (12) | ciphertext and GCM tag
+// Everything before the ciphertext is authenticated as additional data.
+package upload
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/binary"
+    "encoding/pem"
+    "fmt"
+    "os"
+)
+
+const (
+    EncryptedSuffix = ".enc" // added to the object key of encrypted archives
+    envelopeMagic = "WEHEENC1" // the start of every encrypted archive, with the version of the layout
+    dataKeyLen = 32 // bytes in a data key, for AES-256
+    minRSABits = 2048 // smallest RSA key the data keys can be wrapped with
+)
+
+// Reads the RSA public key that data keys are wrapped with.
+// path: path of a PEM file with a PUBLIC KEY (PKIX) or RSA PUBLIC KEY (PKCS #1) block
+// Returns the public key or any errors
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+    block, err := readPEM(path)
+    if err != nil {
+        return nil, err
+    }
+    var publicKey *rsa.PublicKey
+    switch block.Type {
+    case "PUBLIC KEY":
+        key, err := x509.ParsePKIXPublicKey(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+        rsaKey, ok := key.(*rsa.PublicKey)
+        if !ok {
+            return nil, fmt.Errorf("Public key in %s is not an RSA key", path)
+        }
+        publicKey = rsaKey
+    case "RSA PUBLIC KEY":
+        publicKey, err = x509.ParsePKCS1PublicKey(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+    default:
+        return nil, fmt.Errorf("Expected a PUBLIC KEY or RSA PUBLIC KEY block in %s; got %s", path, block.Type)
+    }
+    if publicKey.N.BitLen() < minRSABits {
+        return nil, fmt.Errorf("Public key in %s has %d bits; it needs at least %d", path, publicKey.N.BitLen(), minRSABits)
+    }
+    return publicKey, nil
+}
+
+// Reads the RSA private key that unwraps data keys.
+// path: path of a PEM file with a PRIVATE KEY (PKCS #8) or RSA PRIVATE KEY (PKCS #1) block
+// Returns the private key or any errors
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+    block, err := readPEM(path)
+    if err != nil {
+        return nil, err
+    }
+    switch block.Type {
+    case "PRIVATE KEY":
+        key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+        rsaKey, ok := key.(*rsa.PrivateKey)
+        if !ok {
+            return nil, fmt.Errorf("Private key in %s is not an RSA key", path)
+        }
+        return rsaKey, nil
+    case "RSA PRIVATE KEY":
+        return x509.ParsePKCS1PrivateKey(block.Bytes)
+    default:
+        return nil, fmt.Errorf("Expected a PRIVATE KEY or RSA PRIVATE KEY block in %s; got %s", path, block.Type)
+    }
+}
+
+// Reads the first PEM block of a file.
+// path: path of the PEM file
+// Returns the block or any errors
+func readPEM(path string) (*pem.Block, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, fmt.Errorf("No PEM block found in %s", path)
+    }
+    return block, nil
+}
+
+// Gets the fingerprint of a public key, written in each encrypted archive so that the analysis host
+// can tell which private key it needs once keys are rotated.
+// publicKey: the public key
+// Returns the SHA-256 hash of the PKCS #1 encoding of the key
+func keyFingerprint(publicKey *rsa.PublicKey) [sha256.Size]byte {
+    return sha256.Sum256(x509.MarshalPKCS1PublicKey(publicKey))
+}
+
+// Encrypts an archive with a new data key wrapped with a public key.
+// publicKey: the public key the data key is wrapped with
+// plaintext: the archive
+// Returns the encrypted archive or any errors
+func Seal(publicKey *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+    dataKey := make([]byte, dataKeyLen)
+    _, err := rand.Read(dataKey)
+    if err != nil {
+        return nil, err
+    }
+    wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, dataKey, []byte(envelopeMagic))
+    if err != nil {
+        return nil, err
+    }
+    gcm, err := newGCM(dataKey)
+    if err != nil {
+        return nil, err
+    }
+    nonce := make([]byte, gcm.NonceSize())
+    _, err = rand.Read(nonce)
+    if err != nil {
+        return nil, err
+    }
+
+    fingerprint := keyFingerprint(publicKey)
+    var header bytes.Buffer
+    header.WriteString(envelopeMagic)
+    header.Write(fingerprint[:])
+    binary.Write(&header, binary.BigEndian, uint16(len(wrappedKey)))
+    header.Write(wrappedKey)
+    header.Write(nonce)
+    // the output can't share memory with the additional data, so the header is copied into it
+    envelope := make([]byte, header.Len(), header.Len() + len(plaintext) + gcm.Overhead())
+    copy(envelope, header.Bytes())
+    return gcm.Seal(envelope, nonce, plaintext, header.Bytes()), nil
+}
+
+// Decrypts an archive encrypted by Seal.
+// privateKey: the private key of the public key the data key was wrapped with
+// envelope: the encrypted archive
+// Returns the archive, or an error if the archive isn't encrypted, was encrypted for another key,
+//     or was changed after it was encrypted
+func Open(privateKey *rsa.PrivateKey, envelope []byte) ([]byte, error) {
+    headerLen := len(envelopeMagic) + sha256.Size + 2
+    if len(envelope) < headerLen || string(envelope[:len(envelopeMagic)]) != envelopeMagic {
+        return nil, fmt.Errorf("Not an encrypted results archive")
+    }
+    fingerprint := keyFingerprint(&privateKey.PublicKey)
+    if !bytes.Equal(envelope[len(envelopeMagic):len(envelopeMagic) + sha256.Size], fingerprint[:]) {
+        return nil, fmt.Errorf("Archive was encrypted for public key %x, not the given private key (%x)",
+            envelope[len(envelopeMagic):len(envelopeMagic) + sha256.Size], fingerprint)
+    }
+    wrappedKeyLen := int(binary.BigEndian.Uint16(envelope[headerLen - 2:headerLen]))
+    if len(envelope) < headerLen + wrappedKeyLen {
+        return nil, fmt.Errorf("Encrypted archive is cut short")
+    }
+    wrappedKey := envelope[headerLen:headerLen + wrappedKeyLen]
+    dataKey, err := rsa.DecryptOAEP(sha256.New(), nil, privateKey, wrappedKey, []byte(envelopeMagic))
+    if err != nil {
+        return nil, fmt.Errorf("Unable to unwrap the data key: %v", err)
+    }
+    gcm, err := newGCM(dataKey)
+    if err != nil {
+        return nil, err
+    }
+    nonceEnd := headerLen + wrappedKeyLen + gcm.NonceSize()
+    if len(envelope) < nonceEnd {
+        return nil, fmt.Errorf("Encrypted archive is cut short")
+    }
+    plaintext, err := gcm.Open(nil, envelope[nonceEnd - gcm.NonceSize():nonceEnd], envelope[nonceEnd:], envelope[:nonceEnd])
+    if err != nil {
+        return nil, fmt.Errorf("Unable to decrypt the archive; it may have been changed: %v", err)
+    }
+    return plaintext, nil
+}
+
+// Creates the AES-256-GCM cipher of a data key.
+// dataKey: the data key
+// Returns the cipher or any errors
+func newGCM(dataKey []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(dataKey)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
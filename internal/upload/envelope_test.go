@@ -0,0 +1,65 @@
+// Tests of the envelope encryption of uploaded results.
+package upload
+
+import (
+    "bytes"
+    "crypto/rand"
+    "crypto/rsa"
+    "testing"
+)
+
+// Checks that an archive sealed with a public key opens with its private key, and with no other key
+// or once it has been changed.
+func TestSealOpen(t *testing.T) {
+    privateKey, err := rsa.GenerateKey(rand.Reader, minRSABits)
+    if err != nil {
+        t.Fatal(err)
+    }
+    otherKey, err := rsa.GenerateKey(rand.Reader, minRSABits)
+    if err != nil {
+        t.Fatal(err)
+    }
+    archive := []byte("the gzipped tar of a test")
+
+    envelope, err := Seal(&privateKey.PublicKey, archive)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if bytes.Contains(envelope, archive) {
+        t.Fatal("Encrypted archive contains the plaintext")
+    }
+    opened, err := Open(privateKey, envelope)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(opened, archive) {
+        t.Fatalf("Opened %q; want %q", opened, archive)
+    }
+
+    again, err := Seal(&privateKey.PublicKey, archive)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if bytes.Equal(again, envelope) {
+        t.Error("Two archives were sealed with the same data key and nonce")
+    }
+
+    _, err = Open(otherKey, envelope)
+    if err == nil {
+        t.Error("Opened an archive with the wrong private key")
+    }
+    for _, i := range []int{len(envelopeMagic) + 40, len(envelope) - 1} {
+        tampered := bytes.Clone(envelope)
+        tampered[i] ^= 1
+        _, err = Open(privateKey, tampered)
+        if err == nil {
+            t.Errorf("Opened an archive changed at byte %d", i)
+        }
+    }
+    for _, cut := range []int{0, len(envelopeMagic) + 10, len(envelopeMagic) + 40, len(envelope) - 1} {
+        _, err = Open(privateKey, envelope[:cut])
+        if err == nil {
+            t.Errorf("Opened an archive cut to %d bytes", cut)
+        }
+    }
+}
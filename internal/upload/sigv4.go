@@ -0,0 +1,100 @@
+// Signs requests to the object store with AWS Signature Version 4, which S3-compatible stores and
+// the XML API of Google Cloud Storage (with HMAC keys) both accept.
+package upload
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+    "time"
+)
+
+const (
+    sigV4Algorithm = "AWS4-HMAC-SHA256"
+    sigV4Service = "s3"
+    sigV4TimeFormat = "20060102T150405Z"
+)
+
+// Signs a request by adding the Authorization, X-Amz-Date, and X-Amz-Content-Sha256 headers.
+// req: the request, which must have its Host set
+// payloadHash: the hex SHA-256 of the body of the request
+// accessKey: the ID of the HMAC key
+// secretKey: the secret of the HMAC key
+// region: the region of the bucket
+// now: the time of the request
+func signV4(req *http.Request, payloadHash string, accessKey string, secretKey string, region string, now time.Time) {
+    amzDate := now.UTC().Format(sigV4TimeFormat)
+    date := amzDate[:8]
+    req.Header.Set("X-Amz-Date", amzDate)
+    req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+    // every header set so far is signed, along with the host
+    headers := map[string]string{"host": req.Host}
+    for name, values := range req.Header {
+        headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+    }
+    names := make([]string, 0, len(headers))
+    for name := range headers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    var canonicalHeaders strings.Builder
+    for _, name := range names {
+        canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+    }
+    signedHeaders := strings.Join(names, ";")
+
+    canonicalRequest := strings.Join([]string{
+        req.Method,
+        req.URL.EscapedPath(),
+        req.URL.RawQuery,
+        canonicalHeaders.String(),
+        signedHeaders,
+        payloadHash,
+    }, "\n")
+    scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, sigV4Service)
+    stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+    key := hmacSHA256([]byte("AWS4" + secretKey), date)
+    key = hmacSHA256(key, region)
+    key = hmacSHA256(key, sigV4Service)
+    key = hmacSHA256(key, "aws4_request")
+    signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+    req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+        sigV4Algorithm, accessKey, scope, signedHeaders, signature))
+}
+
+// Escapes an object key for the path of a request. Every byte other than the unreserved characters
+// and the slashes between segments is percent-encoded, as Signature Version 4 requires.
+// key: the object key
+// Returns the escaped key
+func escapeKey(key string) string {
+    var escaped strings.Builder
+    for i := 0; i < len(key); i++ {
+        c := key[i]
+        if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || strings.IndexByte("-._~/", c) >= 0 {
+            escaped.WriteByte(c)
+        } else {
+            fmt.Fprintf(&escaped, "%%%02X", c)
+        }
+    }
+    return escaped.String()
+}
+
+// Gets the hex SHA-256 of data.
+func sha256Hex(data []byte) string {
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])
+}
+
+// Gets the HMAC-SHA256 of data.
+func hmacSHA256(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
@@ -0,0 +1,353 @@
+// Uploads the results of finished tests to an object store, Google Cloud Storage on M-Lab or any
+// S3-compatible store elsewhere, and deletes them from the local disk once they are stored, so that
+// results no longer pile up on the server until its disk fills. A test is finished once its
+// manifest has been written and left alone for a while, since old clients still fetch their
+// results from the server after the test.
+package upload
+
+import (
+    "archive/tar"
+    "bytes"
+    "compress/gzip"
+    "crypto/rsa"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+
+    "wehe-server/internal/artifacts"
+    "wehe-server/internal/metrics"
+    "wehe-server/internal/retry"
+)
+
+const (
+    gcsEndpoint = "https://storage.googleapis.com" // the XML API of Google Cloud Storage
+    gcsRegion = "auto" // GCS accepts any region in signatures
+    requestTimeout = 10 * time.Minute // how long an upload can take before it is given up on
+)
+
+var (
+    uploads = metrics.NewCounterVec("wehe_results_uploads_total",
+        "Number of tests uploaded to the results archive, by result (uploaded or failed).", "result")
+    // a test that fails to upload stays on disk, so it is retried on later passes for as long as it fails
+    uploadPolicy = retry.Policy{
+        Operation: "results_upload",
+        InitialDelay: time.Minute,
+        MaxDelay: 6 * time.Hour,
+        Jitter: 0.2,
+    }
+)
+
+// Where results are uploaded and how.
+type Settings struct {
+    Provider string // gcs or s3
+    Endpoint string // URL of the S3-compatible store; ignored for gcs
+    Region string // region of the bucket; ignored for gcs
+    Bucket string // the bucket the results are uploaded to
+    Prefix string // prepended to the object key of every test
+    AccessKey string // ID of the HMAC key the uploads are signed with
+    SecretKey string // secret of the HMAC key the uploads are signed with
+    MinAge time.Duration // how long after its manifest is written a test is uploaded
+    Interval time.Duration // how often the results directory is checked for finished tests
+    MaxMbps float64 // upload bandwidth the uploads can use; 0 for no limit
+    PublicKey *rsa.PublicKey // the key the data key of each archive is wrapped with; nil to upload archives unencrypted
+}
+
+// The state of the uploads, shown in the admin API.
+type Status struct {
+    Pending int `json:"pending"` // tests waiting to be retried after a failed upload
+    Uploaded int `json:"uploaded"` // tests uploaded since the server started
+    Failed int `json:"failed"` // failed uploads since the server started
+    LastUpload time.Time `json:"last_upload,omitempty"` // when the last test was uploaded
+    LastError string `json:"last_error,omitempty"` // the error of the last failed upload
+}
+
+// A test whose upload failed.
+type failedUpload struct {
+    attempts int // failed uploads of the test
+    next time.Time // when the test is uploaded again
+}
+
+// Uploads the results of finished tests in the background.
+type Uploader struct {
+    settings Settings
+    root string // the results directory
+    layout *artifacts.Layout // where the manifests are in the results directory
+    client http.Client // sends the uploads
+    retries map[string]failedUpload // tests whose upload failed; key is the path of the manifest
+    status Status // the state of the uploads
+    mutex sync.Mutex // protects status
+}
+
+// Creates a new Uploader. Start must be called for results to be uploaded.
+// settings: where results are uploaded and how
+// root: the results directory the tests are written to
+// layout: where the result files are in the results directory
+// Returns the uploader
+func New(settings Settings, root string, layout *artifacts.Layout) *Uploader {
+    if settings.Provider == "gcs" {
+        settings.Endpoint = gcsEndpoint
+        settings.Region = gcsRegion
+    }
+    settings.Endpoint = strings.TrimSuffix(settings.Endpoint, "/")
+    return &Uploader{
+        settings: settings,
+        root: root,
+        layout: layout,
+        client: http.Client{Timeout: requestTimeout},
+        retries: make(map[string]failedUpload),
+    }
+}
+
+// Gets the state of the uploads.
+// Returns the status
+func (uploader *Uploader) Status() Status {
+    uploader.mutex.Lock()
+    defer uploader.mutex.Unlock()
+    return uploader.status
+}
+
+// Uploads finished tests, then checks for more every interval. This function should be run in a new
+// thread, as it never returns.
+func (uploader *Uploader) Start() {
+    ticker := time.NewTicker(uploader.settings.Interval)
+    defer ticker.Stop()
+    for {
+        uploader.uploadFinishedTests(time.Now())
+        <-ticker.C
+    }
+}
+
+// Uploads every finished test that isn't waiting to be retried, one at a time.
+// now: the current time
+func (uploader *Uploader) uploadFinishedTests(now time.Time) {
+    pattern, err := uploader.layout.Glob(uploader.root, artifacts.TestManifest)
+    if err != nil {
+        slog.Error("Unable to find manifests to upload", "error", err)
+        return
+    }
+    manifestPaths, err := filepath.Glob(pattern)
+    if err != nil {
+        slog.Error("Unable to find manifests to upload", "error", err)
+        return
+    }
+    for _, manifestPath := range manifestPaths {
+        info, err := os.Stat(manifestPath)
+        if err != nil || now.Sub(info.ModTime()) < uploader.settings.MinAge {
+            continue
+        }
+        failed, exists := uploader.retries[manifestPath]
+        if exists && now.Before(failed.next) {
+            continue
+        }
+
+        err = uploader.uploadTest(manifestPath)
+        if err != nil {
+            failed.attempts++
+        }
+        delay, _ := uploadPolicy.Record(err, failed.attempts)
+        uploader.mutex.Lock()
+        if err != nil {
+            failed.next = now.Add(delay)
+            uploader.retries[manifestPath] = failed
+            uploader.status.Failed++
+            uploader.status.LastError = err.Error()
+            uploads.Inc("failed")
+            slog.Warn("Unable to upload test results", "manifest", manifestPath, "attempt", failed.attempts, "retry_in", delay, "error", err)
+        } else {
+            delete(uploader.retries, manifestPath)
+            uploader.status.Uploaded++
+            uploader.status.LastUpload = time.Now()
+            uploads.Inc("uploaded")
+        }
+        uploader.status.Pending = len(uploader.retries)
+        uploader.mutex.Unlock()
+    }
+}
+
+// Uploads the result files of a test as one gzipped tar, encrypted if there is a public key, then
+// deletes them.
+// manifestPath: the path of the manifest of the test
+// Returns any errors
+func (uploader *Uploader) uploadTest(manifestPath string) error {
+    manifest, err := artifacts.ReadManifest(manifestPath)
+    if err != nil {
+        return err
+    }
+    if manifest.UserID == "" || manifest.TestID == "" {
+        return fmt.Errorf("Manifest %s has no user ID or test ID", manifestPath)
+    }
+    err = manifest.Verify(uploader.root)
+    if err != nil {
+        return err
+    }
+    archive, err := uploader.archive(manifestPath, manifest)
+    if err != nil {
+        return err
+    }
+    startTime := manifest.StartTime.UTC()
+    key := fmt.Sprintf("%s%s/%s_%s.tar.gz", uploader.settings.Prefix, startTime.Format("2006/01/02"), manifest.UserID, manifest.TestID)
+    contentType := "application/gzip"
+    if uploader.settings.PublicKey != nil {
+        archive, err = Seal(uploader.settings.PublicKey, archive)
+        if err != nil {
+            return err
+        }
+        key += EncryptedSuffix
+        contentType = "application/octet-stream"
+    }
+    err = uploader.put(key, contentType, archive)
+    if err != nil {
+        return err
+    }
+    slog.Info("Uploaded test results", "user_id", manifest.UserID, "test_id", manifest.TestID, "key", key, "bytes", len(archive))
+    uploader.cleanUp(manifestPath, manifest)
+    return nil
+}
+
+// Writes the result files of a test and its manifest into a gzipped tar. Files are named by their
+// path in the results directory.
+// manifestPath: the path of the manifest of the test
+// manifest: the manifest of the test
+// Returns the gzipped tar or any errors
+func (uploader *Uploader) archive(manifestPath string, manifest artifacts.Manifest) ([]byte, error) {
+    relManifestPath, err := filepath.Rel(uploader.root, manifestPath)
+    if err != nil {
+        return nil, err
+    }
+    paths := []string{filepath.ToSlash(relManifestPath)}
+    for _, file := range manifest.Files {
+        paths = append(paths, file.Path)
+    }
+
+    var buf bytes.Buffer
+    gzipWriter := gzip.NewWriter(&buf)
+    tarWriter := tar.NewWriter(gzipWriter)
+    for _, path := range paths {
+        data, err := os.ReadFile(filepath.Join(uploader.root, filepath.FromSlash(path)))
+        if err != nil {
+            return nil, err
+        }
+        header := &tar.Header{
+            Name: path,
+            Mode: 0644,
+            Size: int64(len(data)),
+            ModTime: manifest.StartTime,
+        }
+        err = tarWriter.WriteHeader(header)
+        if err != nil {
+            return nil, err
+        }
+        _, err = tarWriter.Write(data)
+        if err != nil {
+            return nil, err
+        }
+    }
+    err = tarWriter.Close()
+    if err != nil {
+        return nil, err
+    }
+    err = gzipWriter.Close()
+    if err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// Uploads an object to the bucket.
+// key: the object key
+// contentType: the MIME type of the object
+// data: the contents of the object
+// Returns any errors
+func (uploader *Uploader) put(key string, contentType string, data []byte) error {
+    url := fmt.Sprintf("%s/%s/%s", uploader.settings.Endpoint, uploader.settings.Bucket, escapeKey(key))
+    var body io.Reader = bytes.NewReader(data)
+    if uploader.settings.MaxMbps > 0 {
+        body = newThrottledReader(body, uploader.settings.MaxMbps)
+    }
+    req, err := http.NewRequest(http.MethodPut, url, body)
+    if err != nil {
+        return err
+    }
+    req.ContentLength = int64(len(data))
+    req.Header.Set("Content-Type", contentType)
+    signV4(req, sha256Hex(data), uploader.settings.AccessKey, uploader.settings.SecretKey, uploader.settings.Region, time.Now())
+
+    resp, err := uploader.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+        return fmt.Errorf("Results archive returned status %s: %s", resp.Status, strings.TrimSpace(string(message)))
+    }
+    return nil
+}
+
+// Deletes the result files of an uploaded test, then any directories the deletes left empty. The
+// manifest is deleted first, so that a server that stops partway through never finds the manifest
+// again and uploads a test with files missing.
+// manifestPath: the path of the manifest of the test
+// manifest: the manifest of the test
+func (uploader *Uploader) cleanUp(manifestPath string, manifest artifacts.Manifest) {
+    paths := []string{manifestPath}
+    for _, file := range manifest.Files {
+        paths = append(paths, filepath.Join(uploader.root, filepath.FromSlash(file.Path)))
+    }
+    for _, path := range paths {
+        err := os.Remove(path)
+        if err != nil && !os.IsNotExist(err) {
+            slog.Warn("Unable to delete uploaded result file", "path", path, "error", err)
+            continue
+        }
+        // directories that still have files in them aren't removed
+        root := filepath.Clean(uploader.root)
+        for dir := filepath.Dir(path); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+            if os.Remove(dir) != nil {
+                break
+            }
+        }
+    }
+}
+
+// Limits how fast an upload is read, so that uploads don't take the bandwidth that replays need.
+type throttledReader struct {
+    reader io.Reader // the upload
+    bytesPerSecond float64 // how fast the upload can be read
+    start time.Time // when the upload was first read
+    read int64 // bytes read so far
+}
+
+// Creates a new throttledReader.
+// reader: the upload
+// mbps: how fast the upload can be read, in Mbps
+// Returns the reader
+func newThrottledReader(reader io.Reader, mbps float64) *throttledReader {
+    return &throttledReader{
+        reader: reader,
+        bytesPerSecond: mbps * 1000 * 1000 / 8,
+    }
+}
+
+// Reads from the upload, waiting first if the upload is ahead of its rate.
+func (throttled *throttledReader) Read(p []byte) (int, error) {
+    if throttled.start.IsZero() {
+        throttled.start = time.Now()
+    }
+    due := throttled.start.Add(time.Duration(float64(throttled.read) / throttled.bytesPerSecond * float64(time.Second)))
+    time.Sleep(time.Until(due))
+    // read at most a tenth of a second of data at a time so that the rate stays smooth
+    maxRead := max(int(throttled.bytesPerSecond / 10), 1)
+    if len(p) > maxRead {
+        p = p[:maxRead]
+    }
+    n, err := throttled.reader.Read(p)
+    throttled.read += int64(n)
+    return n, err
+}
@@ -0,0 +1,192 @@
+// Prints the report of a test as sections of plain text, to be read in a terminal.
+package xray
+
+import (
+    "fmt"
+    "io"
+    "sort"
+    "strings"
+    "time"
+
+    "wehe-server/internal/clienthandler"
+)
+
+const (
+    printTimeFormat = "2006-01-02 15:04:05.000 MST" // format of the times in the printed report
+)
+
+// Prints the report.
+// w: where to print the report
+// Returns any errors
+func (report Report) Print(w io.Writer) error {
+    var out strings.Builder
+    fmt.Fprintf(&out, "Test %s of user %s\n", report.TestID, report.UserID)
+    if !report.Start.IsZero() {
+        fmt.Fprintf(&out, "From %s to %s (%s)\n", formatTime(report.Start), formatTime(report.End), report.End.Sub(report.Start).Round(time.Millisecond))
+    }
+
+    section(&out, "Result files")
+    if len(report.Files) == 0 {
+        out.WriteString("  none\n")
+    }
+    for _, file := range report.Files {
+        kind := string(file.Kind)
+        if file.ReplayID != nil {
+            kind = fmt.Sprintf("%s[%d]", kind, *file.ReplayID)
+        }
+        fmt.Fprintf(&out, "  %-20s %8d B  %s\n", kind, file.Size, file.Path)
+    }
+    if report.Manifest != nil {
+        if report.Manifest.Error == "" {
+            fmt.Fprintf(&out, "  manifest lists %d files, all match\n", report.Manifest.Files)
+        } else {
+            fmt.Fprintf(&out, "  manifest lists %d files, MISMATCH: %s\n", report.Manifest.Files, report.Manifest.Error)
+        }
+    }
+
+    section(&out, "Side channel timeline")
+    if len(report.Timeline) == 0 {
+        out.WriteString("  no log lines found\n")
+    }
+    for _, line := range report.Timeline {
+        fmt.Fprintf(&out, "  %s %-5s %s", formatTime(line.Time), line.Level, line.Message)
+        if line.Fields != "" {
+            fmt.Fprintf(&out, "  %s", line.Fields)
+        }
+        out.WriteString("\n")
+    }
+
+    section(&out, "Replays")
+    if len(report.Replays) == 0 {
+        out.WriteString("  none\n")
+    }
+    for _, replay := range report.Replays {
+        printReplay(&out, replay)
+    }
+
+    section(&out, "Analysis")
+    if report.Decision == nil && report.Results == nil {
+        out.WriteString("  not analyzed\n")
+    }
+    printFields(&out, "decision", report.Decision, "differentiation", "area0var", "ks2_pval", "ks2_accept_ratio", "original_avg_xput", "random_avg_xput", "window_seconds")
+    printFields(&out, "results", report.Results, "replayName", "date", "area_test", "ks2_ratio_test", "ks2dVal", "ks2pVal", "xput_avg_original", "xput_avg_test")
+    printFields(&out, "side channel RTT", report.SideChannelRTT, "count", "min_ms", "median_ms", "average_ms", "max_ms")
+
+    section(&out, "Packet captures")
+    if len(report.Captures) == 0 {
+        out.WriteString("  none\n")
+    }
+    for _, capture := range report.Captures {
+        fmt.Fprintf(&out, "  %s: %d packets, %d B, %s to %s\n", capture.Path, capture.Packets, capture.Bytes, formatTime(capture.First), formatTime(capture.Last))
+    }
+
+    if len(report.Problems) > 0 {
+        section(&out, "Problems")
+        for _, problem := range report.Problems {
+            fmt.Fprintf(&out, "  %s\n", problem)
+        }
+    }
+    _, err := io.WriteString(w, out.String())
+    return err
+}
+
+// Prints what is known about a replay.
+// out: where to print the replay
+// replay: the replay
+func printReplay(out *strings.Builder, replay Replay) {
+    name := replay.Name
+    if name == "" {
+        name = "(no replay info)"
+    }
+    fmt.Fprintf(out, "  [%d] %s: %s\n", replay.ReplayID, replay.ReplayID, name)
+    if replay.Start != "" {
+        completed := "unknown"
+        if replay.Completed != nil {
+            completed = fmt.Sprint(*replay.Completed)
+        }
+        fmt.Fprintf(out, "      started %s, client %s, completed %s, %.3fs of packets", replay.Start, replay.ClientVersion, completed, replay.ReplayDuration)
+        if replay.MaxDuration > 0 {
+            fmt.Fprintf(out, " (limited to %.0fs)", replay.MaxDuration)
+        }
+        fmt.Fprintf(out, ", %d B sent\n", replay.BytesSent)
+    }
+    if len(replay.RequestHashMismatches) > 0 {
+        fmt.Fprintf(out, "      requests that didn't match the replay file: %v\n", replay.RequestHashMismatches)
+    }
+    if replay.SamplesPerReplay > 0 {
+        fmt.Fprintf(out, "      told to take %d throughput samples\n", replay.SamplesPerReplay)
+    }
+    if replay.ExperimentFlags != "" {
+        fmt.Fprintf(out, "      experiment flags: %q\n", replay.ExperimentFlags)
+    }
+    printThroughputs(out, "client xputs", replay.ClientXputs)
+    printThroughputs(out, "server xputs", replay.ServerXputs)
+    if replay.Jitter != nil {
+        jitter := replay.Jitter
+        fmt.Fprintf(out, "      jitter: send %.2f ms over %d packets (delay variation %.2f ms), receive %.2f ms over %d packets\n", jitter.SendJitterMs, jitter.SentPackets, jitter.SendDelayVariationMs, jitter.ReceiveJitterMs, jitter.ReceivedPackets)
+    }
+
+    phases := make([]string, 0, len(replay.Latencies))
+    for phase := range replay.Latencies {
+        phases = append(phases, string(phase))
+    }
+    sort.Strings(phases)
+    for _, phase := range phases {
+        latency := replay.Latencies[clienthandler.LatencyPhase(phase)]
+        fmt.Fprintf(out, "      latency %s: %d RTTs, median %.1f ms\n", phase, latency.Samples, latency.Median)
+    }
+
+    for _, exception := range replay.Exceptions {
+        fmt.Fprintf(out, "      exception %s %s: %s\n", formatTime(exception.Time), exception.Phase, exception.Message)
+    }
+    if replay.DroppedExceptions > 0 {
+        fmt.Fprintf(out, "      %d more exceptions weren't kept\n", replay.DroppedExceptions)
+    }
+}
+
+// Prints a summary of throughputs.
+// out: where to print the summary
+// label: what the throughputs are
+// throughputs: the summary; nothing is printed if nil
+func printThroughputs(out *strings.Builder, label string, throughputs *Throughputs) {
+    if throughputs == nil {
+        return
+    }
+    fmt.Fprintf(out, "      %s: %d samples over %.2fs, min %.3f, avg %.3f, max %.3f Mbps\n", label, throughputs.Samples, throughputs.Duration, throughputs.Min, throughputs.Average, throughputs.Max)
+}
+
+// Prints chosen fields of a result file on one line.
+// out: where to print the fields
+// label: what the file is
+// fields: the contents of the file; nothing is printed if nil
+// keys: the fields to print, in order; fields missing from the file are skipped
+func printFields(out *strings.Builder, label string, fields map[string]interface{}, keys ...string) {
+    if fields == nil {
+        return
+    }
+    var values []string
+    for _, key := range keys {
+        value, exists := fields[key]
+        if exists {
+            values = append(values, fmt.Sprintf("%s=%v", key, value))
+        }
+    }
+    fmt.Fprintf(out, "  %s: %s\n", label, strings.Join(values, " "))
+}
+
+// Starts a section of the report.
+// out: where to print the section
+// title: the title of the section
+func section(out *strings.Builder, title string) {
+    fmt.Fprintf(out, "\n== %s ==\n", title)
+}
+
+// Formats a time in UTC.
+// t: the time
+// Returns the formatted time, or "?" if the time is zero
+func formatTime(t time.Time) string {
+    if t.IsZero() {
+        return "?"
+    }
+    return t.UTC().Format(printTimeFormat)
+}
@@ -0,0 +1,728 @@
+// Gathers everything the server recorded about one test into a single report: the result files of
+// the test, what the replay info says about each replay, the throughputs measured by the client and
+// derived by the server, the latencies, the analysis, the exceptions, the lines the server logged
+// about the test, and the debug captures taken while it ran. Debugging a user report otherwise means
+// finding each of these by hand across the results directories, the log files, and the capture
+// directory.
+package xray
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "wehe-server/internal/artifacts"
+    "wehe-server/internal/clienthandler"
+    "wehe-server/internal/pcapfile"
+)
+
+const (
+    replayInfoTimeFormat = "2006-01-02 15:04:05" // format of the start time in the replay info files
+    captureTimeFormat = "20060102T150405Z" // format of the start time in the names of debug capture files
+    captureMargin = time.Minute // how far outside the lines and files of a test a debug capture can be and still be about it
+)
+
+var (
+    // user IDs and test IDs that can be looked up; they are used in glob patterns, so they can't
+    // contain wildcards
+    userIDPattern = regexp.MustCompile(`^[A-Za-z0-9@.-]+$`)
+    testIDPattern = regexp.MustCompile(`^([0-9]+)(_attempt[0-9]+)?$`)
+
+    // the fields of a log line that are shown on their own rather than with the other fields
+    logLineFields = map[string]bool{"time": true, "level": true, "msg": true, "user_id": true, "test_id": true}
+)
+
+// Where the server keeps what it recorded about tests.
+type Sources struct {
+    Layout *artifacts.Layout // how result files are laid out in the results directories
+    ResultsDirs []string // the directories result files are written to, e.g. the tmp and final results directories
+    LogFile string // the path of the server log; its rotated files are read too. Empty if the server logs to stdout
+    CaptureDir string // the directory debug captures are written to; empty if captures are off
+}
+
+// Everything the server recorded about a test.
+type Report struct {
+    UserID string `json:"user_id"` // the user ID of the test
+    TestID string `json:"test_id"` // the test ID, including the attempt number if the test was submitted more than once
+    Start time.Time `json:"start"` // when the test started; zero if no file or log line says
+    End time.Time `json:"end"` // when the last thing about the test was recorded; zero if nothing was
+    Files []File `json:"files"` // the result files of the test
+    Manifest *ManifestCheck `json:"manifest,omitempty"` // whether the files match the manifest; nil if there is no manifest
+    Replays []Replay `json:"replays"` // the replays of the test, in replay ID order
+    SideChannelRTT map[string]interface{} `json:"side_channel_rtt,omitempty"` // the side channel RTT file
+    Decision map[string]interface{} `json:"decision,omitempty"` // the decision file
+    Results map[string]interface{} `json:"results,omitempty"` // the results file
+    Timeline []LogLine `json:"timeline"` // the lines logged about the test, oldest first
+    Captures []Capture `json:"captures"` // the debug captures taken while the test ran
+    Problems []string `json:"problems"` // files that couldn't be read or parsed
+}
+
+// A result file of a test.
+type File struct {
+    Kind artifacts.Kind `json:"kind"` // the kind of result file
+    ReplayID *int `json:"replay_id,omitempty"` // the replay the file belongs to; omitted for files written once per test
+    Path string `json:"path"` // the path of the file
+    Size int64 `json:"size"` // the size of the file in bytes
+    Modified time.Time `json:"modified"` // when the file was last written
+    root string // the results directory the file is in
+}
+
+// The result of checking the result files against the manifest of the test.
+type ManifestCheck struct {
+    Path string `json:"path"` // the path of the manifest
+    Files int `json:"files"` // the number of files the manifest lists
+    Error string `json:"error,omitempty"` // the first file that is missing or doesn't match; empty if all match
+}
+
+// What the result files say about a replay.
+type Replay struct {
+    ReplayID clienthandler.ReplayType `json:"replay_id"` // the type of replay
+    Name string `json:"name"` // the name of the replay; empty if there is no replay info
+    Start string `json:"start,omitempty"` // when the client connected, as written in the replay info
+    Completed *bool `json:"completed,omitempty"` // whether the replay servers sent every packet
+    ReplayDuration float64 `json:"replay_duration"` // seconds the client took to send its packets
+    MaxDuration float64 `json:"max_duration"` // seconds the client asked the replay to run for; 0 for the whole replay
+    BytesSent int64 `json:"bytes_sent"` // bytes the replay servers sent
+    ClientVersion string `json:"client_version,omitempty"` // the version of the Wehe client
+    RequestHashMismatches []int `json:"request_hash_mismatches,omitempty"` // response sets whose request didn't match the replay file
+    Exceptions []clienthandler.Exception `json:"exceptions,omitempty"` // the exceptions of the test when the replay info was written
+    DroppedExceptions int `json:"dropped_exceptions,omitempty"` // exceptions that weren't kept
+    Jitter *clienthandler.JitterReport `json:"jitter,omitempty"` // the jitter the UDP replay servers measured; nil for TCP replays
+    SamplesPerReplay int `json:"samples_per_replay,omitempty"` // throughput samples the client was told to take; 0 if the replay info doesn't say
+    ExperimentFlags string `json:"experiment_flags,omitempty"` // the experiment flags the client sent; empty if it sent none
+    ClientXputs *Throughputs `json:"client_xputs,omitempty"` // the throughputs the client sent; nil if it sent none
+    ServerXputs *Throughputs `json:"server_xputs,omitempty"` // the throughputs sampled by the server; nil if none were
+    Latencies map[clienthandler.LatencyPhase]LatencySummary `json:"latencies,omitempty"` // the RTTs the client measured in each phase
+}
+
+// A summary of the throughputs of a replay.
+type Throughputs struct {
+    Samples int `json:"samples"` // the number of throughputs
+    Duration float64 `json:"duration"` // seconds from the start of the replay to the last sample
+    Min float64 `json:"min"` // the smallest throughput, in Mbps
+    Max float64 `json:"max"` // the largest throughput, in Mbps
+    Average float64 `json:"average"` // the average throughput, in Mbps
+}
+
+// A summary of a series of RTTs measured by the client.
+type LatencySummary struct {
+    Samples int `json:"samples"` // the number of RTTs
+    Median float64 `json:"median_ms"` // the median RTT, in milliseconds
+}
+
+// A line the server logged about the test.
+type LogLine struct {
+    Time time.Time `json:"time"` // when the line was logged
+    Level string `json:"level"` // the level of the line
+    Message string `json:"message"` // the message of the line
+    Fields string `json:"fields,omitempty"` // the other fields of the line, as key=value pairs
+}
+
+// A debug capture whose packets were captured while the test ran.
+type Capture struct {
+    Path string `json:"path"` // the path of the capture file
+    Packets int `json:"packets"` // the number of packets in the file
+    Bytes int64 `json:"bytes"` // the bytes of packets in the file
+    First time.Time `json:"first,omitempty"` // when the first packet was captured
+    Last time.Time `json:"last,omitempty"` // when the last packet was captured
+}
+
+// Gathers everything recorded about a test.
+// sources: where the server keeps what it recorded about tests
+// userID: the user ID of the test
+// testID: the test ID, with _attempt<n> for attempts after the first
+// Returns the report, or an error if the IDs are invalid or nothing at all was found about the test
+func Gather(sources Sources, userID string, testID string) (Report, error) {
+    if !userIDPattern.MatchString(userID) {
+        return Report{}, fmt.Errorf("Invalid user ID %s", userID)
+    }
+    testIDMatch := testIDPattern.FindStringSubmatch(testID)
+    if testIDMatch == nil {
+        return Report{}, fmt.Errorf("Invalid test ID %s; expected a number, optionally followed by _attempt<n>", testID)
+    }
+
+    report := Report{
+        UserID: userID,
+        TestID: testID,
+        Files: []File{},
+        Replays: []Replay{},
+        Timeline: []LogLine{},
+        Captures: []Capture{},
+        Problems: []string{},
+    }
+    err := report.findFiles(sources)
+    if err != nil {
+        return Report{}, err
+    }
+    report.readFiles()
+    report.readLogs(sources.LogFile, testIDMatch[1])
+    if len(report.Files) == 0 && len(report.Timeline) == 0 {
+        return Report{}, fmt.Errorf("Nothing was found about test %s of user %s", testID, userID)
+    }
+    report.findCaptures(sources.CaptureDir)
+    return report, nil
+}
+
+// Finds the result files of the test in every results directory.
+// sources: where the result files are
+// Returns any errors
+func (report *Report) findFiles(sources Sources) error {
+    perTest := []artifacts.Kind{artifacts.SideChannelRTT, artifacts.Decision, artifacts.AnalysisResults, artifacts.TestManifest}
+    perReplay := []artifacts.Kind{artifacts.ReplayInfo, artifacts.ClientThroughputs, artifacts.ServerThroughputs, artifacts.ClientLatencies}
+    add := func(root string, kind artifacts.Kind, replayID int, isPerReplay bool) error {
+        pattern, err := sources.Layout.TestGlob(root, kind, report.UserID, report.TestID, replayID)
+        if err != nil {
+            return err
+        }
+        paths, err := filepath.Glob(pattern)
+        if err != nil {
+            return err
+        }
+        for _, path := range paths {
+            info, err := os.Stat(path)
+            if err != nil {
+                report.addProblem(path, err)
+                continue
+            }
+            file := File{
+                Kind: kind,
+                Path: path,
+                Size: info.Size(),
+                Modified: info.ModTime(),
+                root: root,
+            }
+            if isPerReplay {
+                file.ReplayID = &replayID
+            }
+            report.Files = append(report.Files, file)
+        }
+        return nil
+    }
+
+    for _, root := range sources.ResultsDirs {
+        if root == "" {
+            continue
+        }
+        for _, kind := range perTest {
+            err := add(root, kind, 0, false)
+            if err != nil {
+                return err
+            }
+        }
+        for replayID := clienthandler.Original; replayID <= clienthandler.Tunneled; replayID++ {
+            for _, kind := range perReplay {
+                err := add(root, kind, int(replayID), true)
+                if err != nil {
+                    return err
+                }
+            }
+        }
+    }
+    return nil
+}
+
+// Reads the result files that were found. A file in more than one results directory, e.g. while it
+// is being moved, is read from the one found last. Files can be copied long after the test, so when
+// they were last written isn't used to tell when the test ran.
+func (report *Report) readFiles() {
+    replays := make(map[clienthandler.ReplayType]*Replay)
+    getReplay := func(replayID int) *Replay {
+        replayType := clienthandler.ReplayType(replayID)
+        replay, exists := replays[replayType]
+        if !exists {
+            replay = &Replay{ReplayID: replayType}
+            replays[replayType] = replay
+        }
+        return replay
+    }
+
+    for _, file := range report.Files {
+        data, err := os.ReadFile(file.Path)
+        if err != nil {
+            report.addProblem(file.Path, err)
+            continue
+        }
+        switch file.Kind {
+        case artifacts.ReplayInfo:
+            err = readReplayInfo(data, getReplay(*file.ReplayID))
+            if err == nil {
+                report.extendWindowFromReplay(*getReplay(*file.ReplayID))
+            }
+        case artifacts.ClientThroughputs:
+            var xputs [][]float64
+            err = json.Unmarshal(data, &xputs)
+            if err == nil && len(xputs) == 2 {
+                getReplay(*file.ReplayID).ClientXputs = summarizeThroughputs(xputs[0], xputs[1])
+            }
+        case artifacts.ServerThroughputs:
+            var xputs struct {
+                Throughputs []float64 `json:"throughputs"`
+                SampleTimes []float64 `json:"sample_times"`
+            }
+            err = json.Unmarshal(data, &xputs)
+            if err == nil {
+                getReplay(*file.ReplayID).ServerXputs = summarizeThroughputs(xputs.Throughputs, xputs.SampleTimes)
+            }
+        case artifacts.ClientLatencies:
+            var latencies map[clienthandler.LatencyPhase]clienthandler.LatencySeries
+            err = json.Unmarshal(data, &latencies)
+            if err == nil {
+                replay := getReplay(*file.ReplayID)
+                replay.Latencies = make(map[clienthandler.LatencyPhase]LatencySummary)
+                for phase, series := range latencies {
+                    replay.Latencies[phase] = LatencySummary{Samples: len(series.RTTs), Median: median(series.RTTs)}
+                }
+            }
+        case artifacts.SideChannelRTT:
+            err = json.Unmarshal(data, &report.SideChannelRTT)
+            // every RTT is in the file; the statistics are enough to debug with
+            delete(report.SideChannelRTT, "rtts_ms")
+        case artifacts.Decision:
+            err = json.Unmarshal(data, &report.Decision)
+        case artifacts.AnalysisResults:
+            err = json.Unmarshal(data, &report.Results)
+        case artifacts.TestManifest:
+            var manifest artifacts.Manifest
+            manifest, err = artifacts.ReadManifest(file.Path)
+            if err == nil {
+                report.checkManifest(file, manifest)
+            }
+        }
+        if err != nil {
+            report.addProblem(file.Path, err)
+        }
+    }
+
+    for replayID := clienthandler.Original; replayID <= clienthandler.Tunneled; replayID++ {
+        replay, exists := replays[replayID]
+        if exists {
+            report.Replays = append(report.Replays, *replay)
+        }
+    }
+}
+
+// Checks the result files against the manifest of the test.
+// file: the manifest file
+// manifest: the manifest
+func (report *Report) checkManifest(file File, manifest artifacts.Manifest) {
+    report.extendWindow(manifest.StartTime)
+    report.Manifest = &ManifestCheck{
+        Path: file.Path,
+        Files: len(manifest.Files),
+    }
+    // the manifest lists paths relative to the results directory it was written in
+    err := manifest.Verify(file.root)
+    if err != nil {
+        report.Manifest.Error = err.Error()
+    }
+}
+
+// Reads the items of a replay info file that help to debug a test. Items missing from files written
+// by older servers are left empty.
+// data: the contents of the replay info file
+// replay: where to put the items
+// Returns any errors
+func readReplayInfo(data []byte, replay *Replay) error {
+    var items []json.RawMessage
+    err := json.Unmarshal(data, &items)
+    if err != nil {
+        return err
+    }
+    // the item numbers are those in the doc comment of clienthandler.WriteReplayInfoToFile, minus one
+    targets := map[int]interface{}{
+        0: &replay.Start,
+        4: &replay.Name,
+        9: &replay.Completed,
+        16: &replay.ClientVersion,
+        18: &replay.MaxDuration,
+        19: &replay.BytesSent,
+        20: &replay.RequestHashMismatches,
+        27: &replay.Jitter,
+        29: &replay.SamplesPerReplay,
+        30: &replay.ExperimentFlags,
+    }
+    for i, target := range targets {
+        if i < len(items) {
+            err = json.Unmarshal(items[i], target)
+            if err != nil {
+                return fmt.Errorf("Item %d of the replay info: %v", i + 1, err)
+            }
+        }
+    }
+    if len(items) > 13 {
+        var duration string
+        err = json.Unmarshal(items[13], &duration)
+        if err == nil {
+            replay.ReplayDuration, err = strconv.ParseFloat(duration, 64)
+        }
+        if err != nil {
+            return fmt.Errorf("Item 14 of the replay info: %v", err)
+        }
+    }
+    if len(items) > 23 {
+        var exceptions struct {
+            Exceptions []clienthandler.Exception `json:"exceptions"`
+            Dropped int `json:"dropped"`
+        }
+        err = json.Unmarshal(items[23], &exceptions)
+        if err != nil {
+            return fmt.Errorf("Item 24 of the replay info: %v", err)
+        }
+        replay.Exceptions = exceptions.Exceptions
+        replay.DroppedExceptions = exceptions.Dropped
+    }
+    return nil
+}
+
+// Summarizes the throughputs of a replay.
+// throughputs: the throughputs, in Mbps
+// sampleTimes: seconds since the start of the replay at the end of each interval
+// Returns the summary, or nil if there are no throughputs
+func summarizeThroughputs(throughputs []float64, sampleTimes []float64) *Throughputs {
+    if len(throughputs) == 0 {
+        return nil
+    }
+    summary := &Throughputs{
+        Samples: len(throughputs),
+        Min: throughputs[0],
+        Max: throughputs[0],
+    }
+    sum := 0.0
+    for _, throughput := range throughputs {
+        summary.Min = min(summary.Min, throughput)
+        summary.Max = max(summary.Max, throughput)
+        sum += throughput
+    }
+    summary.Average = sum / float64(len(throughputs))
+    if len(sampleTimes) > 0 {
+        summary.Duration = sampleTimes[len(sampleTimes) - 1]
+    }
+    return summary
+}
+
+// Gets the median of a list of numbers.
+// values: the numbers
+// Returns the median, or 0 if there are no numbers
+func median(values []float64) float64 {
+    if len(values) == 0 {
+        return 0
+    }
+    sorted := append([]float64(nil), values...)
+    sort.Float64s(sorted)
+    middle := len(sorted) / 2
+    if len(sorted) % 2 == 0 {
+        return (sorted[middle - 1] + sorted[middle]) / 2
+    }
+    return sorted[middle]
+}
+
+// Reads the lines logged about the test from the server log and its rotated files. Log lines carry
+// the test ID without the attempt number, so the lines of every attempt of the test are included.
+// logFile: the path of the server log; empty if the server logs to stdout
+// testNumber: the test ID without the attempt number
+func (report *Report) readLogs(logFile string, testNumber string) {
+    if logFile == "" {
+        return
+    }
+    rotated, _ := filepath.Glob(logFile + ".*")
+    // oldest first: filename.N is older than filename.N-1, and filename is the newest
+    sort.Slice(rotated, func(i, j int) bool {
+        return rotatedNumber(logFile, rotated[i]) > rotatedNumber(logFile, rotated[j])
+    })
+    for _, path := range append(rotated, logFile) {
+        if rotatedNumber(logFile, path) < 0 {
+            continue
+        }
+        err := report.readLog(path, testNumber)
+        if err != nil && !errors.Is(err, os.ErrNotExist) {
+            report.addProblem(path, err)
+        }
+    }
+    sort.SliceStable(report.Timeline, func(i, j int) bool {
+        return report.Timeline[i].Time.Before(report.Timeline[j].Time)
+    })
+}
+
+// Gets the number of a rotated log file.
+// logFile: the path of the current log file
+// path: the path of the current log file or one of its rotated files
+// Returns the number after the dot, 0 for the current log file, or -1 if the path isn't a rotated
+//     log file
+func rotatedNumber(logFile string, path string) int {
+    if path == logFile {
+        return 0
+    }
+    number, err := strconv.Atoi(strings.TrimPrefix(path, logFile + "."))
+    if err != nil || number < 1 {
+        return -1
+    }
+    return number
+}
+
+// Reads the lines logged about the test from one log file, written as JSON or logfmt.
+// path: the path of the log file
+// testNumber: the test ID without the attempt number
+// Returns any errors
+func (report *Report) readLog(path string, testNumber string) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024)
+    for scanner.Scan() {
+        line := scanner.Text()
+        // most lines aren't about the test, so they are skipped before being parsed
+        if !strings.Contains(line, report.UserID) {
+            continue
+        }
+        var fields []logField
+        if strings.HasPrefix(line, "{") {
+            fields, err = parseJSONLine(line)
+        } else {
+            fields, err = parseLogfmtLine(line)
+        }
+        if err != nil {
+            continue
+        }
+        logLine, matches := toLogLine(fields, report.UserID, testNumber)
+        if matches {
+            report.Timeline = append(report.Timeline, logLine)
+            report.extendWindow(logLine.Time)
+        }
+    }
+    return scanner.Err()
+}
+
+// A key and value of a log line.
+type logField struct {
+    key string
+    value string
+}
+
+// Parses a log line written by the slog JSON handler. Groups are flattened to dotted keys, like the
+// logfmt handler writes them.
+// line: the line
+// Returns the fields of the line or any errors
+func parseJSONLine(line string) ([]logField, error) {
+    decoder := json.NewDecoder(strings.NewReader(line))
+    decoder.UseNumber()
+    var object map[string]interface{}
+    err := decoder.Decode(&object)
+    if err != nil {
+        return nil, err
+    }
+    var fields []logField
+    var flatten func(prefix string, object map[string]interface{})
+    flatten = func(prefix string, object map[string]interface{}) {
+        keys := make([]string, 0, len(object))
+        for key := range object {
+            keys = append(keys, key)
+        }
+        sort.Strings(keys)
+        for _, key := range keys {
+            group, isGroup := object[key].(map[string]interface{})
+            if isGroup {
+                flatten(prefix + key + ".", group)
+                continue
+            }
+            fields = append(fields, logField{key: prefix + key, value: fmt.Sprint(object[key])})
+        }
+    }
+    flatten("", object)
+    return fields, nil
+}
+
+// Parses a log line written by the slog text handler, i.e. key=value pairs separated by spaces,
+// with values quoted if they contain spaces or special characters.
+// line: the line
+// Returns the fields of the line or any errors
+func parseLogfmtLine(line string) ([]logField, error) {
+    var fields []logField
+    for line = strings.TrimSpace(line); line != ""; line = strings.TrimLeft(line, " ") {
+        key, rest, found := strings.Cut(line, "=")
+        if !found || key == "" || strings.Contains(key, " ") {
+            return nil, fmt.Errorf("Expected key=value at %q", line)
+        }
+        var value string
+        if strings.HasPrefix(rest, "\"") {
+            quoted, err := strconv.QuotedPrefix(rest)
+            if err != nil {
+                return nil, err
+            }
+            value, err = strconv.Unquote(quoted)
+            if err != nil {
+                return nil, err
+            }
+            rest = rest[len(quoted):]
+        } else {
+            end := strings.IndexByte(rest, ' ')
+            if end < 0 {
+                end = len(rest)
+            }
+            value = rest[:end]
+            rest = rest[end:]
+        }
+        fields = append(fields, logField{key: key, value: value})
+        line = rest
+    }
+    return fields, nil
+}
+
+// Converts the fields of a log line to a line of the timeline if the line is about the test.
+// fields: the fields of the line
+// userID: the user ID of the test
+// testNumber: the test ID without the attempt number
+// Returns the line and true if the line is about the test
+func toLogLine(fields []logField, userID string, testNumber string) (LogLine, bool) {
+    var logLine LogLine
+    var others []string
+    userMatches := false
+    testMatches := false
+    for _, field := range fields {
+        switch field.key {
+        case "time":
+            logLine.Time, _ = time.Parse(time.RFC3339Nano, field.value)
+        case "level":
+            logLine.Level = field.value
+        case "msg":
+            logLine.Message = field.value
+        case "user_id":
+            userMatches = field.value == userID
+        case "test_id":
+            testMatches = field.value == testNumber
+        }
+        if !logLineFields[field.key] {
+            value := field.value
+            if value == "" || strings.ContainsAny(value, " \"=") {
+                value = strconv.Quote(value)
+            }
+            others = append(others, field.key + "=" + value)
+        }
+    }
+    logLine.Fields = strings.Join(others, " ")
+    return logLine, userMatches && testMatches
+}
+
+// Finds the debug captures that hold packets from while the test ran, and counts their packets.
+// Captures are of a client rather than of a test, so a capture is included if any of its packets
+// were captured between the first and last things recorded about the test.
+// captureDir: the directory debug captures are written to; empty if captures are off
+func (report *Report) findCaptures(captureDir string) {
+    if captureDir == "" || report.Start.IsZero() {
+        return
+    }
+    windowStart := report.Start.Add(-captureMargin)
+    windowEnd := report.End.Add(captureMargin)
+    // captures are compressed, but older ones may not be
+    var paths []string
+    for _, pattern := range []string{"*.pcap", "*.pcap" + pcapfile.CompressedSuffix} {
+        matches, err := filepath.Glob(filepath.Join(captureDir, pattern))
+        if err != nil {
+            report.addProblem(captureDir, err)
+            return
+        }
+        paths = append(paths, matches...)
+    }
+    sort.Strings(paths)
+    for _, path := range paths {
+        // a capture that started after the test ended can't hold its packets
+        started, err := time.Parse(captureTimeFormat, strings.SplitN(filepath.Base(path), "_", 2)[0])
+        if err == nil && started.After(windowEnd) {
+            continue
+        }
+        capture, err := readCapture(path)
+        if err != nil {
+            report.addProblem(path, err)
+            continue
+        }
+        if capture.Packets > 0 && !capture.Last.Before(windowStart) && !capture.First.After(windowEnd) {
+            report.Captures = append(report.Captures, capture)
+        }
+    }
+}
+
+// Counts the packets of a capture file, from its index if it has one. A capture that is still
+// running has no index yet, so its packets are read.
+// path: the path of the capture file
+// Returns the capture or any errors
+func readCapture(path string) (Capture, error) {
+    if strings.HasSuffix(path, pcapfile.CompressedSuffix) {
+        index, err := pcapfile.ReadIndex(path)
+        if err == nil {
+            return Capture{
+                Path: path,
+                Packets: index.Packets,
+                Bytes: index.Bytes,
+                First: index.First,
+                Last: index.Last,
+            }, nil
+        }
+    }
+    reader, err := pcapfile.Open(path)
+    if err != nil {
+        return Capture{}, err
+    }
+    defer reader.Close()
+    capture := Capture{Path: path}
+    for {
+        _, captureInfo, err := reader.ReadPacketData()
+        if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+            // a capture that is still running ends in the middle of a packet
+            break
+        }
+        if err != nil {
+            return Capture{}, err
+        }
+        if capture.Packets == 0 {
+            capture.First = captureInfo.Timestamp
+        }
+        capture.Last = captureInfo.Timestamp
+        capture.Packets++
+        capture.Bytes += int64(captureInfo.Length)
+    }
+    return capture, nil
+}
+
+// Moves the start or end of the test to include a time something was recorded about it.
+// t: the time; ignored if zero
+func (report *Report) extendWindow(t time.Time) {
+    if t.IsZero() {
+        return
+    }
+    if report.Start.IsZero() || t.Before(report.Start) {
+        report.Start = t
+    }
+    if t.After(report.End) {
+        report.End = t
+    }
+}
+
+// Moves the start or end of the test to include a replay, whose start time is in UTC.
+// replay: the replay
+func (report *Report) extendWindowFromReplay(replay Replay) {
+    start, err := time.Parse(replayInfoTimeFormat, replay.Start)
+    if err != nil {
+        return
+    }
+    report.extendWindow(start)
+    report.extendWindow(start.Add(time.Duration(replay.ReplayDuration * float64(time.Second))))
+}
+
+// Records a file that couldn't be read or parsed.
+// path: the path of the file
+// err: what went wrong
+func (report *Report) addProblem(path string, err error) {
+    report.Problems = append(report.Problems, fmt.Sprintf("%s: %v", path, err))
+}
@@ -5,19 +5,70 @@ import (
     "flag"
     "fmt"
     "os"
+    "time"
 
     "wehe-server/internal/app"
+    "wehe-server/internal/buildinfo"
+    "wehe-server/internal/clienthandler"
     "wehe-server/internal/config"
 )
 
-//TODO: handle interrupt cleanup and add check to determine if client is too old
 func main() {
     // parse command line arguments
     replaySubcommand := flag.NewFlagSet("replay", flag.ExitOnError)
     configFile := replaySubcommand.String("c", "res/config/config.ini", "")
+    devMode := replaySubcommand.Bool("dev", false, "use embedded geolocation data and fixed resource readings instead of the real ones, for development")
+    validateMode := replaySubcommand.Bool("validate", false, "check every replay in tests_dir for problems and exit, without starting any listeners")
 
-    //updateSubcommand := flag.NewFlagSet("update", flag.ExitOnError)
-    // TODO: finish update subcommand
+    // checks the replays for sensitive content that should have been scrubbed
+    lintSubcommand := flag.NewFlagSet("lint", flag.ExitOnError)
+    lintConfigFile := lintSubcommand.String("c", "res/config/config.ini", "")
+
+    // analyzes tests from their client throughput files without running the server
+    analyzeSubcommand := flag.NewFlagSet("analyze", flag.ExitOnError)
+    analyzeConfigFile := analyzeSubcommand.String("c", "res/config/config.ini", "")
+    analyzePolicy := analyzeSubcommand.String("policy", "", "decision policy to use; defaults to the policy in the config file")
+    analyzeOutputDir := analyzeSubcommand.String("o", ".", "directory to write the decision files to")
+
+    // runs replays through the replay servers and compares what they send with the replay files
+    fidelitySubcommand := flag.NewFlagSet("fidelity", flag.ExitOnError)
+    fidelityConfigFile := fidelitySubcommand.String("c", "res/config/config.ini", "")
+    fidelityTestsDir := fidelitySubcommand.String("tests", "", "directory of the replays to check; defaults to the tests directory in the config file")
+    fidelityTolerance := fidelitySubcommand.Int("tolerance-ms", 50, "how far off schedule, in ms, the 95th percentile of packets can arrive for a replay to pass")
+    fidelityReportFile := fidelitySubcommand.String("o", "", "file to write the fidelity reports to as JSON")
+
+    // fetches new replays and test ports and installs them in place of the current ones
+    updateSubcommand := flag.NewFlagSet("update", flag.ExitOnError)
+    updateConfigFile := updateSubcommand.String("c", "res/config/config.ini", "")
+    updateSource := updateSubcommand.String("source", "", "URL of a .tar.gz archive or git repository to fetch from; defaults to the source in the config file")
+
+    // writes synthetic test results for trying out whatever reads the results directory at scale
+    corpusSubcommand := flag.NewFlagSet("corpus", flag.ExitOnError)
+    corpusConfigFile := corpusSubcommand.String("c", "res/config/config.ini", "")
+    corpusOutputDir := corpusSubcommand.String("o", "", "directory to write the synthetic results to; can't be a results directory in the config file")
+    corpusUsers := corpusSubcommand.Int("users", 100, "number of synthetic users")
+    corpusTestsPerUser := corpusSubcommand.Int("tests-per-user", 5, "number of tests each synthetic user runs")
+    corpusDifferentiationRate := corpusSubcommand.Float64("differentiation-rate", 0.1, "fraction of tests, from 0 to 1, whose original replay is throttled")
+    corpusDays := corpusSubcommand.Int("days", 30, "number of days before now that the tests are spread over")
+    corpusSeed := corpusSubcommand.Int64("seed", 0, "seed of the random choices, to make the same corpus again; 0 picks a new seed")
+
+    // prints everything recorded about one test, for debugging a user report
+    xraySubcommand := flag.NewFlagSet("xray", flag.ExitOnError)
+    xrayConfigFile := xraySubcommand.String("c", "res/config/config.ini", "")
+    xrayUserID := xraySubcommand.String("user", "", "user ID of the test")
+    xrayTestID := xraySubcommand.String("test", "", "test ID of the test, with _attempt<n> for attempts after the first")
+    xrayJSON := xraySubcommand.Bool("json", false, "print the report as JSON")
+
+    // measures what durable result writes cost on the disk of the tmp results directory
+    writeBenchSubcommand := flag.NewFlagSet("writebench", flag.ExitOnError)
+    writeBenchConfigFile := writeBenchSubcommand.String("c", "res/config/config.ini", "")
+    writeBenchFiles := writeBenchSubcommand.Int("files", 200, "number of files to write each way")
+    writeBenchSize := writeBenchSubcommand.Int("size", 4096, "size of each file in bytes; result files are usually a few KB")
+
+    // decrypts results archives that were encrypted before they were uploaded, on the analysis host
+    decryptSubcommand := flag.NewFlagSet("decrypt", flag.ExitOnError)
+    decryptKeyFile := decryptSubcommand.String("key", "", "PEM file of the RSA private key the archives were encrypted for")
+    decryptOutputDir := decryptSubcommand.String("o", ".", "directory to write the decrypted archives to")
 
     for _, arg := range os.Args {
         if arg == "-h" || arg == "--help" {
@@ -25,22 +76,52 @@ func main() {
             os.Exit(0)
         }
         if arg == "-v" || arg == "--version" {
-            //print version
+            info := buildinfo.Get()
+            fmt.Printf("wehe-server %s (commit %s, %s, %s/%s)\n", info.Version, info.Commit, info.GoVersion, info.GOOS, info.GOARCH)
             os.Exit(0)
         }
     }
 
-    if len(os.Args) < 1 {
-        fmt.Println("\"replay\" or \"update\" command expected")
+    if len(os.Args) < 2 {
+        fmt.Println("\"replay\", \"lint\", \"analyze\", \"fidelity\", \"update\", \"corpus\", \"xray\", \"writebench\", or \"decrypt\" command expected")
         os.Exit(1)
     }
 
     switch os.Args[1] {
     case "replay":
         replaySubcommand.Parse(os.Args[2:])
+    case "lint":
+        lintSubcommand.Parse(os.Args[2:])
+        configFile = lintConfigFile
+    case "analyze":
+        analyzeSubcommand.Parse(os.Args[2:])
+        configFile = analyzeConfigFile
+    case "fidelity":
+        fidelitySubcommand.Parse(os.Args[2:])
+        configFile = fidelityConfigFile
     case "update":
+        updateSubcommand.Parse(os.Args[2:])
+        configFile = updateConfigFile
+    case "corpus":
+        corpusSubcommand.Parse(os.Args[2:])
+        configFile = corpusConfigFile
+    case "xray":
+        xraySubcommand.Parse(os.Args[2:])
+        configFile = xrayConfigFile
+    case "writebench":
+        writeBenchSubcommand.Parse(os.Args[2:])
+        configFile = writeBenchConfigFile
+    case "decrypt":
+        // the analysis host has the private key but no server config
+        decryptSubcommand.Parse(os.Args[2:])
+        err := app.DecryptResults(*decryptKeyFile, *decryptOutputDir, decryptSubcommand.Args())
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        os.Exit(0)
     default:
-        fmt.Println("\"replay\" or \"update\" command expected")
+        fmt.Println("\"replay\", \"lint\", \"analyze\", \"fidelity\", \"update\", \"corpus\", \"xray\", \"writebench\", or \"decrypt\" command expected")
         os.Exit(1)
     }
 
@@ -51,8 +132,109 @@ func main() {
         os.Exit(1)
     }
 
+    if os.Args[1] == "lint" {
+        passed, err := app.LintReplays(config)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        if !passed {
+            os.Exit(1)
+        }
+        os.Exit(0)
+    }
+
+    if os.Args[1] == "analyze" {
+        err = app.Analyze(config, *analyzePolicy, *analyzeOutputDir, analyzeSubcommand.Args())
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        os.Exit(0)
+    }
+
+    if os.Args[1] == "fidelity" {
+        tolerance := time.Duration(*fidelityTolerance) * time.Millisecond
+        passed, err := app.CheckFidelity(config, *fidelityTestsDir, fidelitySubcommand.Args(), tolerance, *fidelityReportFile)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        if !passed {
+            os.Exit(1)
+        }
+        os.Exit(0)
+    }
+
+    if os.Args[1] == "update" {
+        err = app.Update(config, *updateSource)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        os.Exit(0)
+    }
+
+    if os.Args[1] == "corpus" {
+        if *corpusOutputDir == "" || *corpusUsers < 1 || *corpusTestsPerUser < 1 || *corpusDays < 1 || *corpusDifferentiationRate < 0 || *corpusDifferentiationRate > 1 {
+            fmt.Println("corpus needs an output directory, at least one user, test, and day, and a differentiation rate from 0 to 1")
+            os.Exit(1)
+        }
+        seed := *corpusSeed
+        if seed == 0 {
+            seed = time.Now().UnixNano()
+        }
+        err = app.GenerateCorpus(config, *corpusOutputDir, clienthandler.CorpusSettings{
+            Users: *corpusUsers,
+            TestsPerUser: *corpusTestsPerUser,
+            DifferentiationRate: *corpusDifferentiationRate,
+            End: time.Now(),
+            Days: *corpusDays,
+            Seed: seed,
+        })
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        os.Exit(0)
+    }
+
+    if os.Args[1] == "xray" {
+        if *xrayUserID == "" || *xrayTestID == "" {
+            fmt.Println("xray needs the user ID and test ID of a test")
+            os.Exit(1)
+        }
+        err = app.XRay(config, *xrayUserID, *xrayTestID, *xrayJSON)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        os.Exit(0)
+    }
+
+    if os.Args[1] == "writebench" {
+        err = app.BenchmarkResultWrites(config, *writeBenchFiles, *writeBenchSize)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        os.Exit(0)
+    }
+
+    if *validateMode {
+        passed, err := app.ValidateReplays(config)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        if !passed {
+            os.Exit(1)
+        }
+        os.Exit(0)
+    }
+
     // run the app
-    err = app.Run(config)
+    err = app.Run(config, *devMode)
     if err != nil {
         fmt.Println(err)
         os.Exit(1)